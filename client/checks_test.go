@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"net/url"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/client"
+)
+
+func (cs *clientSuite) TestChecksGet(c *check.C) {
+	cs.rsp = `{
+		"result": [
+			{"name": "chk1", "status": "up", "last-run": "2021-06-01T12:00:00Z"},
+			{"name": "chk2", "level": "alive", "status": "down", "failures": 5, "last-error": "exit status 1"}
+		],
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+
+	opts := client.ChecksOptions{
+		Level:   client.AliveLevel,
+		Names:   []string{"chk1", "chk2"},
+		Service: "svc1",
+	}
+	checks, err := cs.cli.Checks(&opts)
+	c.Assert(err, check.IsNil)
+	lastRun := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.Assert(checks, check.DeepEquals, []*client.CheckInfo{{
+		Name:    "chk1",
+		Status:  client.CheckStatusUp,
+		LastRun: &lastRun,
+	}, {
+		Name:      "chk2",
+		Level:     client.AliveLevel,
+		Status:    client.CheckStatusDown,
+		Failures:  5,
+		LastError: "exit status 1",
+	}})
+	c.Assert(cs.req.Method, check.Equals, "GET")
+	c.Assert(cs.req.URL.Path, check.Equals, "/v1/checks")
+	c.Assert(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"level":   {"alive"},
+		"names":   {"chk1,chk2"},
+		"service": {"svc1"},
+	})
+}
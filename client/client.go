@@ -381,6 +381,8 @@ const (
 	ErrorKindSystemRestart     = "system-restart"
 	ErrorKindDaemonRestart     = "daemon-restart"
 	ErrorKindNoDefaultServices = "no-default-services"
+	ErrorKindAdminRequired     = "admin-required"
+	ErrorKindInvalidLayer      = "invalid-layer"
 )
 
 func (rsp *response) err(cli *Client) error {
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"strconv"
 	"time"
@@ -28,6 +29,14 @@ import (
 
 const (
 	logReaderSize = 4 * 1024
+
+	// LogsSchemaVersion is the version of the logs API's schema that this
+	// client understands. A server may report a newer version, whose
+	// entries may have fields this client doesn't know about.
+	LogsSchemaVersion = 2
+
+	logsSchemaHeader = "X-Pebble-Logs-Schema"
+	logsMetaPrefix   = `{"meta":`
 )
 
 // LogsOptions holds the options for a call to Logs or FollowLogs.
@@ -39,10 +48,48 @@ type LogsOptions struct {
 	// slice means all services).
 	Services []string
 
+	// Groups is the list of service groups to fetch logs for, in addition
+	// to the services in Services.
+	Groups []string
+
 	// N defines the number of log lines to return from the buffer. In follow
 	// mode, the default is zero, in non-follow mode it's server-defined
 	// (currently 30). Set to -1 to return the entire buffer.
 	N int
+
+	// Origin, if set, limits the logs returned to those of that origin:
+	// "service" for the services' own output, or "pebble" for the lines
+	// pebble writes to their logs, such as those marking where a service
+	// started and exited.
+	Origin string
+
+	// WriteMeta, if set, is called once with the response's metadata, before
+	// any logs are written. Servers that predate the metadata object only
+	// report the schema version.
+	WriteMeta func(meta *LogsMeta) error
+}
+
+// LogsMeta is the metadata the server reports about a logs request.
+type LogsMeta struct {
+	// Schema is the version of the logs API's schema the server used.
+	Schema int `json:"schema"`
+
+	// ServerTime is the server's time when the request was made.
+	ServerTime time.Time `json:"server-time"`
+
+	// Services is the sorted list of services selected by the request.
+	Services []string `json:"services"`
+
+	// Filters are the filters the server applied.
+	Filters LogsFilters `json:"filters"`
+}
+
+// LogsFilters are the filters the server applied to a logs request.
+type LogsFilters struct {
+	N      int      `json:"n"`
+	Follow bool     `json:"follow"`
+	Origin string   `json:"origin,omitempty"`
+	Groups []string `json:"groups,omitempty"`
 }
 
 // LogEntry is the struct passed to the WriteLog function.
@@ -50,6 +97,18 @@ type LogEntry struct {
 	Time    time.Time `json:"time"`
 	Service string    `json:"service"`
 	Message string    `json:"message"`
+
+	// Origin is "pebble" for lines written by pebble rather than the
+	// service, and empty otherwise.
+	Origin string `json:"origin,omitempty"`
+
+	// Seq is the sequence number of the line in the service's log buffer,
+	// one more than the line before it, so a gap shows lines were missed
+	// (pebble also reports the gap with a log of its own). The numbers go
+	// on across restarts of the service, and only start again, at 1, with
+	// a new buffer. Seq is zero for pebble's notices of missed lines, and
+	// from servers before schema version 2.
+	Seq int64 `json:"seq,omitempty"`
 }
 
 // Logs fetches previously-written logs from the given services.
@@ -68,19 +127,42 @@ func (client *Client) logs(ctx context.Context, opts *LogsOptions, follow bool)
 	for _, service := range opts.Services {
 		query.Add("services", service)
 	}
+	for _, group := range opts.Groups {
+		query.Add("groups", group)
+	}
 	if opts.N != 0 {
 		query.Set("n", strconv.Itoa(opts.N))
 	}
+	if opts.Origin != "" {
+		query.Set("origin", opts.Origin)
+	}
 	if follow {
 		query.Set("follow", "true")
 	}
+	if opts.WriteMeta != nil {
+		query.Set("meta", "true")
+	}
 	res, err := client.raw(ctx, "GET", "/v1/logs", query, nil, nil)
 	if err != nil {
+		if ctx.Err() != nil {
+			// Cancelled (for example with Ctrl-C) before the response
+			// started, which isn't an error when following.
+			return nil
+		}
 		return err
 	}
 	defer res.Body.Close()
 
 	reader := bufio.NewReaderSize(res.Body, logReaderSize)
+	if opts.WriteMeta != nil {
+		err = decodeMeta(reader, res.Header, opts.WriteMeta)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 	for {
 		err = decodeLog(reader, opts.WriteLog)
 		if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
@@ -93,6 +175,39 @@ func (client *Client) logs(ctx context.Context, opts *LogsOptions, follow bool)
 	return nil
 }
 
+// Decode the metadata object from the start of reader, if the server sent
+// one, and call writeMeta on it. Servers that don't send one only report the
+// schema version, in the response header.
+func decodeMeta(reader *bufio.Reader, header http.Header, writeMeta func(meta *LogsMeta) error) error {
+	meta := &LogsMeta{}
+	b, err := reader.Peek(len(logsMetaPrefix))
+	switch {
+	case err == nil && string(b) == logsMetaPrefix:
+		line, err := reader.ReadSlice('\n')
+		if err != nil {
+			return fmt.Errorf("cannot read log metadata: %w", err)
+		}
+		var wrapper struct {
+			Meta *LogsMeta `json:"meta"`
+		}
+		err = json.Unmarshal(line, &wrapper)
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal log metadata: %w", err)
+		}
+		meta = wrapper.Meta
+	case err != nil && !errors.Is(err, io.EOF):
+		return fmt.Errorf("cannot read log metadata: %w", err)
+	default:
+		meta.Schema, _ = strconv.Atoi(header.Get(logsSchemaHeader))
+	}
+
+	err = writeMeta(meta)
+	if err != nil {
+		return fmt.Errorf("cannot output log metadata: %w", err)
+	}
+	return nil
+}
+
 // Decode next JSON log from reader and call writeLog on it. Return io.EOF if
 // no more logs to read.
 func decodeLog(reader *bufio.Reader, writeLog func(entry LogEntry) error) error {
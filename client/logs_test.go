@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"gopkg.in/check.v1"
 
@@ -67,6 +68,22 @@ func (cs *clientSuite) TestLogsServices(c *check.C) {
 `[1:])
 }
 
+func (cs *clientSuite) TestLogsGroups(c *check.C) {
+	cs.rsp = ""
+	out, writeLog := makeLogWriter()
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: writeLog,
+		Services: []string{"snappass"},
+		Groups:   []string{"web", "db"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"services": []string{"snappass"},
+		"groups":   []string{"web", "db"},
+	})
+	c.Check(out.String(), check.Equals, "")
+}
+
 func (cs *clientSuite) TestLogsN(c *check.C) {
 	cs.rsp = `
 {"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n"}
@@ -89,6 +106,29 @@ func (cs *clientSuite) TestLogsN(c *check.C) {
 `[1:])
 }
 
+func (cs *clientSuite) TestLogsOrigin(c *check.C) {
+	cs.rsp = `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"--- service \"thing\" started (pid 42, generation 1) ---","origin":"pebble","seq":1}
+`[1:]
+	var entries []client.LogEntry
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: func(entry client.LogEntry) error {
+			entries = append(entries, entry)
+			return nil
+		},
+		Origin: "pebble",
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"origin": []string{"pebble"},
+	})
+	c.Assert(entries, check.HasLen, 1)
+	c.Check(entries[0].Service, check.Equals, "thing")
+	c.Check(entries[0].Message, check.Equals, `--- service "thing" started (pid 42, generation 1) ---`)
+	c.Check(entries[0].Origin, check.Equals, "pebble")
+	c.Check(entries[0].Seq, check.Equals, int64(1))
+}
+
 func (cs *clientSuite) TestLogsAll(c *check.C) {
 	cs.rsp = `
 {"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n"}
@@ -146,6 +186,29 @@ func (cs *clientSuite) TestFollowLogs(c *check.C) {
 `[1:])
 }
 
+func (cs *clientSuite) TestFollowLogsCancelledEarly(c *check.C) {
+	started := make(chan struct{})
+	cli, err := client.New(nil)
+	c.Assert(err, check.IsNil)
+	cli.SetDoer(doerFunc(func(req *http.Request) (*http.Response, error) {
+		close(started)
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	out, writeLog := makeLogWriter()
+	err = cli.FollowLogs(ctx, &client.LogsOptions{
+		WriteLog: writeLog,
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(out.String(), check.Equals, "")
+}
+
 func (cs *clientSuite) TestLogsWriteLogError(c *check.C) {
 	cs.rsp = `{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n"}` + "\n"
 	err := cs.cli.Logs(&client.LogsOptions{
@@ -156,6 +219,132 @@ func (cs *clientSuite) TestLogsWriteLogError(c *check.C) {
 	c.Assert(err, check.ErrorMatches, "cannot output log: ERROR!")
 }
 
+func (cs *clientSuite) TestLogsMeta(c *check.C) {
+	cs.header = http.Header{"X-Pebble-Logs-Schema": []string{"1"}}
+	cs.rsp = `
+{"meta":{"schema":2,"server-time":"2021-05-03T03:55:50Z","services":["snappass","thing"],"filters":{"n":2,"follow":false,"groups":["web"]}}}
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n"}
+`[1:]
+	var metas []*client.LogsMeta
+	out, writeLog := makeLogWriter()
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: writeLog,
+		WriteMeta: func(meta *client.LogsMeta) error {
+			c.Check(out.String(), check.Equals, "")
+			metas = append(metas, meta)
+			return nil
+		},
+		N: 2,
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"n":    []string{"2"},
+		"meta": []string{"true"},
+	})
+	c.Assert(metas, check.HasLen, 1)
+	c.Check(metas[0], check.DeepEquals, &client.LogsMeta{
+		Schema:     client.LogsSchemaVersion,
+		ServerTime: time.Date(2021, 5, 3, 3, 55, 50, 0, time.UTC),
+		Services:   []string{"snappass", "thing"},
+		Filters: client.LogsFilters{
+			N:      2,
+			Groups: []string{"web"},
+		},
+	})
+	c.Check(out.String(), check.Equals, `
+2021-05-03T03:55:49.360Z [thing] log 1
+`[1:])
+}
+
+func (cs *clientSuite) TestLogsMetaOldServer(c *check.C) {
+	// Servers without the metadata object only report the schema version.
+	cs.header = http.Header{"X-Pebble-Logs-Schema": []string{"1"}}
+	cs.rsp = `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n"}
+`[1:]
+	var metas []*client.LogsMeta
+	out, writeLog := makeLogWriter()
+	writeMeta := func(meta *client.LogsMeta) error {
+		metas = append(metas, meta)
+		return nil
+	}
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog:  writeLog,
+		WriteMeta: writeMeta,
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(metas, check.DeepEquals, []*client.LogsMeta{{Schema: 1}})
+	c.Check(out.String(), check.Equals, `
+2021-05-03T03:55:49.360Z [thing] log 1
+`[1:])
+
+	// Nor do servers that predate the schema header, and there may be no
+	// logs at all.
+	cs.header = nil
+	cs.rsp = ""
+	metas = nil
+	err = cs.cli.Logs(&client.LogsOptions{
+		WriteLog:  writeLog,
+		WriteMeta: writeMeta,
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(metas, check.DeepEquals, []*client.LogsMeta{{Schema: 0}})
+}
+
+func (cs *clientSuite) TestFollowLogsMeta(c *check.C) {
+	readsChan := make(chan string)
+	cli, err := client.New(nil)
+	c.Assert(err, check.IsNil)
+	cli.SetDoer(doerFunc(func(req *http.Request) (*http.Response, error) {
+		c.Check(req.URL.Query(), check.DeepEquals, url.Values{
+			"follow": []string{"true"},
+			"meta":   []string{"true"},
+		})
+		rsp := &http.Response{
+			Body:       &followReader{readsChan},
+			Header:     http.Header{"X-Pebble-Logs-Schema": []string{"1"}},
+			StatusCode: http.StatusOK,
+		}
+		return rsp, nil
+	}))
+
+	go func() {
+		readsChan <- `{"meta":{"schema":1,"server-time":"2021-05-03T03:55:50Z","services":["thing"],"filters":{"n":0,"follow":true}}}` + "\n"
+		readsChan <- `{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1\n"}` + "\n"
+		readsChan <- ""
+	}()
+	var meta *client.LogsMeta
+	out, writeLog := makeLogWriter()
+	err = cli.FollowLogs(context.Background(), &client.LogsOptions{
+		WriteLog: writeLog,
+		WriteMeta: func(m *client.LogsMeta) error {
+			meta = m
+			return nil
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(meta, check.NotNil)
+	c.Check(meta.Schema, check.Equals, 1)
+	c.Check(meta.Services, check.DeepEquals, []string{"thing"})
+	c.Check(meta.Filters, check.DeepEquals, client.LogsFilters{Follow: true})
+	c.Check(out.String(), check.Equals, `
+2021-05-03T03:55:49.360Z [thing] log 1
+`[1:])
+}
+
+func (cs *clientSuite) TestLogsWriteMetaError(c *check.C) {
+	cs.rsp = ""
+	err := cs.cli.Logs(&client.LogsOptions{
+		WriteLog: func(entry client.LogEntry) error {
+			return nil
+		},
+		WriteMeta: func(meta *client.LogsMeta) error {
+			return fmt.Errorf("ERROR!")
+		},
+	})
+	c.Assert(err, check.ErrorMatches, "cannot output log metadata: ERROR!")
+}
+
 type doerFunc func(*http.Request) (*http.Response, error)
 
 func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A Notice is a record of something interesting that happened in the
+// system, such as a service being restarted. There'll only ever be one
+// Notice with the same type and key; repeated occurrences update its
+// last occurrence time, count, and data.
+type Notice struct {
+	Type          string            `json:"type"`
+	Key           string            `json:"key"`
+	FirstOccurred time.Time         `json:"first-occurred"`
+	LastOccurred  time.Time         `json:"last-occurred"`
+	LastAcked     time.Time         `json:"last-acked,omitempty"`
+	Occurrences   int               `json:"occurrences"`
+	LastData      map[string]string `json:"last-data,omitempty"`
+	ExpireAfter   time.Duration     `json:"expire-after,omitempty"`
+}
+
+type jsonNotice struct {
+	Notice
+	ExpireAfter string `json:"expire-after,omitempty"`
+}
+
+// NoticesOptions contains options for querying pebble for notices.
+type NoticesOptions struct {
+	// Types, if not empty, only returns notices of these types.
+	Types []string
+
+	// After, if set, only returns notices that last occurred after this
+	// time.
+	After time.Time
+
+	// All returns all notices, instead of only the unacknowledged ones.
+	All bool
+}
+
+// Notices returns the list of notices that match opts, ordered by last
+// occurrence time.
+func (client *Client) Notices(opts *NoticesOptions) ([]*Notice, error) {
+	q := make(url.Values)
+	if len(opts.Types) > 0 {
+		q.Set("types", strings.Join(opts.Types, ","))
+	}
+	if !opts.After.IsZero() {
+		q.Set("after", opts.After.Format(time.RFC3339))
+	}
+	if opts.All {
+		q.Set("select", "all")
+	}
+	var jns []*jsonNotice
+	_, err := client.doSync("GET", "/v1/notices", q, nil, nil, &jns)
+	if err != nil {
+		return nil, err
+	}
+
+	notices := make([]*Notice, len(jns))
+	for i, jn := range jns {
+		notices[i] = &jn.Notice
+		notices[i].ExpireAfter, _ = time.ParseDuration(jn.ExpireAfter)
+	}
+	return notices, nil
+}
+
+// AckNotices acknowledges the notices that occurred at or before the given
+// time, so they're no longer returned by Notices (unless they recur).
+func (client *Client) AckNotices(t time.Time) error {
+	var body bytes.Buffer
+	var op = warningsAction{Action: "okay", Timestamp: t}
+	if err := json.NewEncoder(&body).Encode(op); err != nil {
+		return err
+	}
+	_, err := client.doSync("POST", "/v1/notices", nil, nil, &body, nil)
+	return err
+}
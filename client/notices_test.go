@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/client"
+)
+
+func (cs *clientSuite) TestNotices(c *check.C) {
+	t1 := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	t2 := time.Date(2021, 6, 1, 13, 0, 0, 0, time.UTC)
+	cs.rsp = `{
+		"result": [{
+			"type": "service-restart",
+			"key": "svc1",
+			"first-occurred": "2021-06-01T12:00:00Z",
+			"last-occurred": "2021-06-01T13:00:00Z",
+			"occurrences": 2,
+			"last-data": {"backoff": "2"},
+			"expire-after": "168h0m0s"
+		}],
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+
+	notices, err := cs.cli.Notices(&client.NoticesOptions{
+		Types: []string{"service-restart", "other"},
+		After: t1,
+		All:   true,
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(notices, check.DeepEquals, []*client.Notice{{
+		Type:          "service-restart",
+		Key:           "svc1",
+		FirstOccurred: t1,
+		LastOccurred:  t2,
+		Occurrences:   2,
+		LastData:      map[string]string{"backoff": "2"},
+		ExpireAfter:   7 * 24 * time.Hour,
+	}})
+	c.Check(cs.req.Method, check.Equals, "GET")
+	c.Check(cs.req.URL.Path, check.Equals, "/v1/notices")
+	c.Check(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"types":  {"service-restart,other"},
+		"after":  {"2021-06-01T12:00:00Z"},
+		"select": {"all"},
+	})
+}
+
+func (cs *clientSuite) TestAckNotices(c *check.C) {
+	cs.rsp = `{
+		"result": 1,
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+	t := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	err := cs.cli.AckNotices(t)
+	c.Assert(err, check.IsNil)
+	c.Check(cs.req.Method, check.Equals, "POST")
+	c.Check(cs.req.URL.Path, check.Equals, "/v1/notices")
+	var body map[string]interface{}
+	c.Assert(json.NewDecoder(cs.req.Body).Decode(&body), check.IsNil)
+	c.Check(body, check.DeepEquals, map[string]interface{}{
+		"action":    "okay",
+		"timestamp": "2021-06-01T12:00:00Z",
+	})
+}
@@ -56,6 +56,30 @@ func (client *Client) AddLayer(opts *AddLayerOptions) error {
 	return err
 }
 
+// ReloadLayers asks the daemon to re-read its layers directory and replan,
+// as it does when it receives SIGHUP. If the new layers are invalid, the
+// current plan is kept and an error returned. It returns the ID of the replan
+// change, or "" if no services needed to be stopped, started or reloaded.
+func (client *Client) ReloadLayers() (changeID string, err error) {
+	var payload = struct {
+		Action string `json:"action"`
+	}{
+		Action: "reload",
+	}
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(&payload); err != nil {
+		return "", err
+	}
+	var rsp response
+	if err := client.do("POST", "/v1/layers", nil, nil, &body, &rsp); err != nil {
+		return "", err
+	}
+	if err := rsp.err(client); err != nil {
+		return "", err
+	}
+	return rsp.Change, nil
+}
+
 type PlanOptions struct{}
 
 // PlanBytes fetches the plan in YAML format.
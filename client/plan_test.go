@@ -75,3 +75,38 @@ services:
         command: cmd
 `[1:])
 }
+
+func (cs *clientSuite) TestReloadLayers(c *check.C) {
+	cs.rsp = `{
+		"type": "async",
+		"status-code": 202,
+		"change": "42"
+	}`
+	changeID, err := cs.cli.ReloadLayers()
+	c.Assert(err, check.IsNil)
+	c.Check(changeID, check.Equals, "42")
+	c.Check(cs.req.Method, check.Equals, "POST")
+	c.Check(cs.req.URL.Path, check.Equals, "/v1/layers")
+	var body map[string]interface{}
+	c.Assert(json.NewDecoder(cs.req.Body).Decode(&body), check.IsNil)
+	c.Check(body, check.DeepEquals, map[string]interface{}{
+		"action": "reload",
+	})
+
+	cs.rsp = `{
+		"type": "sync",
+		"status-code": 200,
+		"result": null
+	}`
+	changeID, err = cs.cli.ReloadLayers()
+	c.Assert(err, check.IsNil)
+	c.Check(changeID, check.Equals, "")
+
+	cs.rsp = `{
+		"type": "error",
+		"status-code": 400,
+		"result": {"message": "cannot reload layers: invalid layer"}
+	}`
+	_, err = cs.cli.ReloadLayers()
+	c.Check(err, check.ErrorMatches, "cannot reload layers: invalid layer")
+}
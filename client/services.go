@@ -24,44 +24,88 @@ import (
 
 type ServiceOptions struct {
 	Names []string
+
+	// Groups is the list of service groups to act on, in addition to the
+	// services in Names.
+	Groups []string
+
+	// Args are extra arguments to append to the service's command. They're
+	// only valid when starting a single service.
+	Args []string
+
+	// NoRestart makes Reload fail for services without a reload-signal,
+	// rather than restarting them.
+	NoRestart bool
 }
 
 func (client *Client) AutoStart(opts *ServiceOptions) (changeID string, err error) {
-	_, changeID, err = client.doMultiServiceAction("autostart", opts.Names)
+	_, changeID, err = client.doMultiServiceAction(&multiActionData{
+		Action:   "autostart",
+		Services: opts.Names,
+		Groups:   opts.Groups,
+	})
 	return changeID, err
 }
 
 func (client *Client) Start(opts *ServiceOptions) (changeID string, err error) {
-	_, changeID, err = client.doMultiServiceAction("start", opts.Names)
+	_, changeID, err = client.doMultiServiceAction(&multiActionData{
+		Action:   "start",
+		Services: opts.Names,
+		Groups:   opts.Groups,
+		Args:     opts.Args,
+	})
 	return changeID, err
 }
 
 func (client *Client) Stop(opts *ServiceOptions) (changeID string, err error) {
-	_, changeID, err = client.doMultiServiceAction("stop", opts.Names)
+	_, changeID, err = client.doMultiServiceAction(&multiActionData{
+		Action:   "stop",
+		Services: opts.Names,
+		Groups:   opts.Groups,
+	})
 	return changeID, err
 }
 
 func (client *Client) Restart(opts *ServiceOptions) (changeID string, err error) {
-	_, changeID, err = client.doMultiServiceAction("restart", opts.Names)
+	_, changeID, err = client.doMultiServiceAction(&multiActionData{
+		Action:   "restart",
+		Services: opts.Names,
+		Groups:   opts.Groups,
+	})
+	return changeID, err
+}
+
+// Reload sends the services their reload-signal, restarting those that
+// don't have one (unless opts.NoRestart is set).
+func (client *Client) Reload(opts *ServiceOptions) (changeID string, err error) {
+	_, changeID, err = client.doMultiServiceAction(&multiActionData{
+		Action:    "reload",
+		Services:  opts.Names,
+		Groups:    opts.Groups,
+		NoRestart: opts.NoRestart,
+	})
 	return changeID, err
 }
 
 func (client *Client) Replan(opts *ServiceOptions) (changeID string, err error) {
-	_, changeID, err = client.doMultiServiceAction("replan", opts.Names)
+	_, changeID, err = client.doMultiServiceAction(&multiActionData{
+		Action:   "replan",
+		Services: opts.Names,
+		Groups:   opts.Groups,
+	})
 	return changeID, err
 }
 
 type multiActionData struct {
-	Action   string   `json:"action"`
-	Services []string `json:"services"`
+	Action    string   `json:"action"`
+	Services  []string `json:"services"`
+	Groups    []string `json:"groups,omitempty"`
+	Args      []string `json:"args,omitempty"`
+	NoRestart bool     `json:"no-restart,omitempty"`
 }
 
-func (client *Client) doMultiServiceAction(actionName string, services []string) (result json.RawMessage, changeID string, err error) {
-	action := multiActionData{
-		Action:   actionName,
-		Services: services,
-	}
-	data, err := json.Marshal(&action)
+func (client *Client) doMultiServiceAction(action *multiActionData) (result json.RawMessage, changeID string, err error) {
+	data, err := json.Marshal(action)
 	if err != nil {
 		return nil, "", fmt.Errorf("cannot marshal multi-service action: %s", err)
 	}
@@ -76,6 +120,17 @@ type ServicesOptions struct {
 	// Names is the list of service names to query for. If slice is nil or
 	// empty, fetch information for all services.
 	Names []string
+
+	// Groups is the list of service groups to query for, in addition to
+	// the services in Names.
+	Groups []string
+
+	// Usage requests the resource usage of running services, which the
+	// daemon reads from /proc when asked.
+	Usage bool
+
+	// Logging requests a description of each service's log pipeline.
+	Logging bool
 }
 
 // ServiceInfo holds status information for a single service.
@@ -83,6 +138,77 @@ type ServiceInfo struct {
 	Name    string         `json:"name"`
 	Startup ServiceStartup `json:"startup"`
 	Current ServiceStatus  `json:"current"`
+
+	// MemoryCurrent is the service's current memory usage in bytes. It's
+	// only reported for services with resource limits applied.
+	MemoryCurrent int64 `json:"memory-current,omitempty"`
+
+	// FailingChecks lists the service's health checks (those in its
+	// on-check-failure section) that are currently failing.
+	FailingChecks []string `json:"failing-checks,omitempty"`
+
+	// Args are the extra arguments the service was started with, if any.
+	Args []string `json:"args,omitempty"`
+
+	// Usage is the resource usage of the service's processes. It's only
+	// reported for running services when ServicesOptions.Usage is set, and
+	// only if the daemon can read it.
+	Usage *ServiceUsage `json:"usage,omitempty"`
+
+	// Logging describes the service's log pipeline. It's only reported
+	// when ServicesOptions.Logging is set.
+	Logging *ServiceLogging `json:"logging,omitempty"`
+}
+
+// ServiceLogging describes a service's log pipeline: the one its process's
+// output goes through if it's running, and otherwise the one it would be
+// started with.
+type ServiceLogging struct {
+	// Encoding is the service's log-encoding, if any.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Files are the service's log-files patterns, if any.
+	Files []string `json:"files,omitempty"`
+
+	// Stages are the stages of the pipeline, in order.
+	Stages []string `json:"stages"`
+
+	// Mode is how far the pipeline has fallen back after panics: "full"
+	// (all stages), "minimal" (without the optional stages), or "dropping"
+	// (output is dropped).
+	Mode string `json:"mode"`
+
+	// DisabledStages are the optional stages left out of the service's
+	// pipelines until the next replan, after panicking too often.
+	DisabledStages []string `json:"disabled-stages,omitempty"`
+
+	// BufferSize is the capacity of the service's log buffer in bytes, and
+	// BufferUsed the number of bytes of logs it holds.
+	BufferSize int `json:"buffer-size"`
+	BufferUsed int `json:"buffer-used"`
+
+	// BufferBorrowed is the number of bytes of BufferSize borrowed from
+	// the log burst reserve during a burst of output.
+	BufferBorrowed int `json:"buffer-borrowed,omitempty"`
+}
+
+// ServiceUsage holds the combined resource usage of a service's processes.
+type ServiceUsage struct {
+	// Processes is the number of processes counted.
+	Processes int `json:"processes"`
+
+	// RSS is the resident set size in bytes.
+	RSS int64 `json:"rss"`
+
+	// CPUSeconds is the user plus system CPU time used, in seconds.
+	CPUSeconds float64 `json:"cpu-seconds"`
+
+	// Threads is the number of threads.
+	Threads int `json:"threads"`
+
+	// FDs is the number of open file descriptors, or nil if the daemon
+	// couldn't count them.
+	FDs *int `json:"fds,omitempty"`
 }
 
 // ServiceStartup defines the different startup modes for a service.
@@ -109,6 +235,15 @@ func (client *Client) Services(opts *ServicesOptions) ([]*ServiceInfo, error) {
 	query := url.Values{
 		"names": []string{strings.Join(opts.Names, ",")},
 	}
+	if len(opts.Groups) > 0 {
+		query.Set("groups", strings.Join(opts.Groups, ","))
+	}
+	if opts.Usage {
+		query.Set("usage", "true")
+	}
+	if opts.Logging {
+		query.Set("logging", "true")
+	}
 	var services []*ServiceInfo
 	_, err := client.doSync("GET", "/v1/services", query, nil, nil, &services)
 	if err != nil {
@@ -60,6 +60,86 @@ func (cs *clientSuite) TestStartStop(c *check.C) {
 	}
 }
 
+func (cs *clientSuite) TestStartArgs(c *check.C) {
+	cs.rsp = `{
+		"result": {},
+		"status": "OK",
+		"status-code": 202,
+		"type": "async",
+		"change": "42"
+	}`
+
+	opts := client.ServiceOptions{
+		Names: []string{"one"},
+		Args:  []string{"--foo", "a b"},
+	}
+	changeId, err := cs.cli.Start(&opts)
+	c.Check(err, check.IsNil)
+	c.Check(changeId, check.Equals, "42")
+
+	var body map[string]interface{}
+	c.Assert(json.NewDecoder(cs.req.Body).Decode(&body), check.IsNil)
+	c.Check(body, check.DeepEquals, map[string]interface{}{
+		"action":   "start",
+		"services": []interface{}{"one"},
+		"args":     []interface{}{"--foo", "a b"},
+	})
+}
+
+func (cs *clientSuite) TestStopGroups(c *check.C) {
+	cs.rsp = `{
+		"result": {},
+		"status": "OK",
+		"status-code": 202,
+		"type": "async",
+		"change": "42"
+	}`
+
+	opts := client.ServiceOptions{
+		Names:  []string{"one"},
+		Groups: []string{"web", "db"},
+	}
+	changeId, err := cs.cli.Stop(&opts)
+	c.Check(err, check.IsNil)
+	c.Check(changeId, check.Equals, "42")
+
+	var body map[string]interface{}
+	c.Assert(json.NewDecoder(cs.req.Body).Decode(&body), check.IsNil)
+	c.Check(body, check.DeepEquals, map[string]interface{}{
+		"action":   "stop",
+		"services": []interface{}{"one"},
+		"groups":   []interface{}{"web", "db"},
+	})
+}
+
+func (cs *clientSuite) TestReload(c *check.C) {
+	cs.rsp = `{
+		"result": {},
+		"status": "OK",
+		"status-code": 202,
+		"type": "async",
+		"change": "42"
+	}`
+
+	opts := client.ServiceOptions{
+		Names:     []string{"one", "two"},
+		NoRestart: true,
+	}
+	changeId, err := cs.cli.Reload(&opts)
+	c.Check(err, check.IsNil)
+	c.Check(changeId, check.Equals, "42")
+	c.Check(cs.req.Method, check.Equals, "POST")
+	c.Check(cs.req.URL.Path, check.Equals, "/v1/services")
+
+	var body map[string]interface{}
+	c.Assert(json.NewDecoder(cs.req.Body).Decode(&body), check.IsNil)
+	c.Check(body, check.DeepEquals, map[string]interface{}{
+		"action":     "reload",
+		"services":   []interface{}{"one", "two"},
+		"no-restart": true,
+	})
+}
+
 func (cs *clientSuite) TestAutostart(c *check.C) {
 	cs.rsp = `{
 		"result": {},
@@ -87,7 +167,7 @@ func (cs *clientSuite) TestServicesGet(c *check.C) {
 	cs.rsp = `{
 		"result": [
 			{"name": "svc1", "startup": "enabled", "current": "inactive"},
-			{"name": "svc2", "startup": "disabled", "current": "active"}
+			{"name": "svc2", "startup": "disabled", "current": "active", "memory-current": 4096, "failing-checks": ["chk1"], "args": ["-v"]}
 		],
 		"status": "OK",
 		"status-code": 200,
@@ -101,7 +181,7 @@ func (cs *clientSuite) TestServicesGet(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(services, check.DeepEquals, []*client.ServiceInfo{
 		{Name: "svc1", Startup: client.StartupEnabled, Current: client.StatusInactive},
-		{Name: "svc2", Startup: client.StartupDisabled, Current: client.StatusActive},
+		{Name: "svc2", Startup: client.StartupDisabled, Current: client.StatusActive, MemoryCurrent: 4096, FailingChecks: []string{"chk1"}, Args: []string{"-v"}},
 	})
 	c.Assert(cs.req.Method, check.Equals, "GET")
 	c.Assert(cs.req.URL.Path, check.Equals, "/v1/services")
@@ -110,6 +190,105 @@ func (cs *clientSuite) TestServicesGet(c *check.C) {
 	})
 }
 
+func (cs *clientSuite) TestServicesGetGroups(c *check.C) {
+	cs.rsp = `{
+		"result": [],
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+
+	opts := client.ServicesOptions{
+		Groups: []string{"web", "db"},
+	}
+	_, err := cs.cli.Services(&opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"names":  {""},
+		"groups": {"web,db"},
+	})
+}
+
+func (cs *clientSuite) TestServicesGetUsage(c *check.C) {
+	cs.rsp = `{
+		"result": [
+			{"name": "svc1", "startup": "enabled", "current": "active", "usage": {"processes": 2, "rss": 4096, "cpu-seconds": 1.5, "threads": 3, "fds": 7}},
+			{"name": "svc2", "startup": "enabled", "current": "active", "usage": {"processes": 1, "rss": 8192, "cpu-seconds": 0, "threads": 1}},
+			{"name": "svc3", "startup": "disabled", "current": "inactive"}
+		],
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+
+	opts := client.ServicesOptions{
+		Usage: true,
+	}
+	services, err := cs.cli.Services(&opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"names": {""},
+		"usage": {"true"},
+	})
+	fds := 7
+	c.Assert(services, check.DeepEquals, []*client.ServiceInfo{
+		{
+			Name:    "svc1",
+			Startup: client.StartupEnabled,
+			Current: client.StatusActive,
+			Usage:   &client.ServiceUsage{Processes: 2, RSS: 4096, CPUSeconds: 1.5, Threads: 3, FDs: &fds},
+		},
+		{
+			Name:    "svc2",
+			Startup: client.StartupEnabled,
+			Current: client.StatusActive,
+			Usage:   &client.ServiceUsage{Processes: 1, RSS: 8192, Threads: 1},
+		},
+		{
+			Name:    "svc3",
+			Startup: client.StartupDisabled,
+			Current: client.StatusInactive,
+		},
+	})
+}
+
+func (cs *clientSuite) TestServicesGetLogging(c *check.C) {
+	cs.rsp = `{
+		"result": [
+			{"name": "svc1", "startup": "enabled", "current": "active", "logging": {"encoding": "utf-16le", "files": ["/var/log/svc1/*.log"], "stages": ["format", "buffer"], "mode": "minimal", "disabled-stages": ["decode"], "buffer-size": 135168, "buffer-used": 2048, "buffer-borrowed": 32768}}
+		],
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+
+	opts := client.ServicesOptions{
+		Names:   []string{"svc1"},
+		Logging: true,
+	}
+	services, err := cs.cli.Services(&opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"names":   {"svc1"},
+		"logging": {"true"},
+	})
+	c.Assert(services, check.DeepEquals, []*client.ServiceInfo{{
+		Name:    "svc1",
+		Startup: client.StartupEnabled,
+		Current: client.StatusActive,
+		Logging: &client.ServiceLogging{
+			Encoding:       "utf-16le",
+			Files:          []string{"/var/log/svc1/*.log"},
+			Stages:         []string{"format", "buffer"},
+			Mode:           "minimal",
+			DisabledStages: []string{"decode"},
+			BufferSize:     135168,
+			BufferUsed:     2048,
+			BufferBorrowed: 32768,
+		},
+	}})
+}
+
 func (cs *clientSuite) TestRestart(c *check.C) {
 	cs.rsp = `{
 		"result": {},
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TimersOptions are the filtering options for querying timers.
+type TimersOptions struct {
+	// Names is the list of timer names to query for. If slice is nil or
+	// empty, fetch information for all timers.
+	Names []string
+}
+
+// TimerInfo holds status information for a single timer.
+type TimerInfo struct {
+	Name string
+
+	// NextRun is the time the timer's command is next due to run.
+	NextRun time.Time
+
+	// Running is true if the timer's command is currently running.
+	Running bool
+
+	// LastRun holds the result of the most recent (completed) run, or nil
+	// if the timer hasn't run since the daemon started.
+	LastRun *TimerRun
+}
+
+// TimerRun holds the result of a single run of a timer's command.
+type TimerRun struct {
+	StartTime time.Time
+	Duration  time.Duration
+	ExitCode  int
+
+	// Error is the reason the run failed, or empty if it succeeded.
+	Error string
+
+	// Output is the (possibly truncated) combined stdout and stderr of the
+	// command.
+	Output string
+}
+
+type timerInfoJSON struct {
+	Name    string            `json:"name"`
+	NextRun time.Time         `json:"next-run"`
+	Running bool              `json:"running"`
+	LastRun *timerRunInfoJSON `json:"last-run"`
+}
+
+type timerRunInfoJSON struct {
+	StartTime time.Time `json:"start-time"`
+	Duration  string    `json:"duration"`
+	ExitCode  int       `json:"exit-code"`
+	Error     string    `json:"error"`
+	Output    string    `json:"output"`
+}
+
+// Timers fetches information about specific timers (or all of them),
+// ordered by timer name.
+func (client *Client) Timers(opts *TimersOptions) ([]*TimerInfo, error) {
+	query := url.Values{
+		"names": []string{strings.Join(opts.Names, ",")},
+	}
+	var infos []*timerInfoJSON
+	_, err := client.doSync("GET", "/v1/timers", query, nil, nil, &infos)
+	if err != nil {
+		return nil, err
+	}
+	timers := make([]*TimerInfo, len(infos))
+	for i, info := range infos {
+		timer := &TimerInfo{
+			Name:    info.Name,
+			NextRun: info.NextRun,
+			Running: info.Running,
+		}
+		if info.LastRun != nil {
+			duration, err := time.ParseDuration(info.LastRun.Duration)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration for timer %q: %w", info.Name, err)
+			}
+			timer.LastRun = &TimerRun{
+				StartTime: info.LastRun.StartTime,
+				Duration:  duration,
+				ExitCode:  info.LastRun.ExitCode,
+				Error:     info.LastRun.Error,
+				Output:    info.LastRun.Output,
+			}
+		}
+		timers[i] = timer
+	}
+	return timers, nil
+}
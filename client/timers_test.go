@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"net/url"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/client"
+)
+
+func (cs *clientSuite) TestTimersGet(c *check.C) {
+	cs.rsp = `{
+		"result": [
+			{"name": "t1", "next-run": "2021-06-01T12:00:00Z"},
+			{"name": "t2", "next-run": "2021-06-01T13:00:00Z", "running": true, "last-run": {
+				"start-time": "2021-06-01T11:00:00Z",
+				"duration": "1.5s",
+				"exit-code": 3,
+				"error": "exit status 3",
+				"output": "oops\n"
+			}}
+		],
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+
+	opts := client.TimersOptions{
+		Names: []string{"t1", "t2"},
+	}
+	timers, err := cs.cli.Timers(&opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(timers, check.DeepEquals, []*client.TimerInfo{{
+		Name:    "t1",
+		NextRun: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+	}, {
+		Name:    "t2",
+		NextRun: time.Date(2021, 6, 1, 13, 0, 0, 0, time.UTC),
+		Running: true,
+		LastRun: &client.TimerRun{
+			StartTime: time.Date(2021, 6, 1, 11, 0, 0, 0, time.UTC),
+			Duration:  1500 * time.Millisecond,
+			ExitCode:  3,
+			Error:     "exit status 3",
+			Output:    "oops\n",
+		},
+	}})
+	c.Assert(cs.req.Method, check.Equals, "GET")
+	c.Assert(cs.req.URL.Path, check.Equals, "/v1/timers")
+	c.Assert(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"names": {"t1,t2"},
+	})
+}
+
+func (cs *clientSuite) TestTimersGetInvalidDuration(c *check.C) {
+	cs.rsp = `{
+		"result": [
+			{"name": "t1", "next-run": "2021-06-01T12:00:00Z", "last-run": {"duration": "foo"}}
+		],
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+
+	_, err := cs.cli.Timers(&client.TimersOptions{})
+	c.Assert(err, check.ErrorMatches, `invalid duration for timer "t1": .*`)
+}
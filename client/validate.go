@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"net/url"
+	"strings"
+)
+
+// ValidateLoggingOptions are the options for validating the services'
+// logging configuration.
+type ValidateLoggingOptions struct {
+	// Services is the list of service names to validate. If slice is nil or
+	// empty, validate all services.
+	Services []string
+}
+
+// LoggingReport describes how a service's output would be logged under the
+// current plan.
+type LoggingReport struct {
+	// Service is the name of the service.
+	Service string `json:"service"`
+
+	// Stages are the stages of the service's log pipeline, in order.
+	Stages []string `json:"stages"`
+
+	// Warnings describe problems with the service's logging options.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Sample is the first few lines of sample output as they'd appear in
+	// the service's logs, after being run through its log pipeline.
+	Sample []string `json:"sample,omitempty"`
+}
+
+// ValidateLogging checks the logging configuration of specific services (or
+// all of them) without starting them, ordered by service name.
+func (client *Client) ValidateLogging(opts *ValidateLoggingOptions) ([]*LoggingReport, error) {
+	query := make(url.Values)
+	if len(opts.Services) > 0 {
+		query.Set("services", strings.Join(opts.Services, ","))
+	}
+	var reports []*LoggingReport
+	_, err := client.doSync("GET", "/v1/validate/logging", query, nil, nil, &reports)
+	if err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"net/url"
+
+	"gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/client"
+)
+
+func (cs *clientSuite) TestValidateLogging(c *check.C) {
+	cs.rsp = `{
+		"result": [
+			{"service": "svc1", "stages": ["format", "buffer"], "sample": ["2021-06-01T12:00:00.000Z [svc1] sample line 1"]},
+			{"service": "svc2", "stages": ["decode", "format", "buffer"], "warnings": ["log-encoding \"utf-16le\" isn't applied to the lines read from log-files"]}
+		],
+		"status": "OK",
+		"status-code": 200,
+		"type": "sync"
+	}`
+
+	opts := client.ValidateLoggingOptions{
+		Services: []string{"svc1", "svc2"},
+	}
+	reports, err := cs.cli.ValidateLogging(&opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(reports, check.DeepEquals, []*client.LoggingReport{{
+		Service: "svc1",
+		Stages:  []string{"format", "buffer"},
+		Sample:  []string{"2021-06-01T12:00:00.000Z [svc1] sample line 1"},
+	}, {
+		Service:  "svc2",
+		Stages:   []string{"decode", "format", "buffer"},
+		Warnings: []string{`log-encoding "utf-16le" isn't applied to the lines read from log-files`},
+	}})
+	c.Assert(cs.req.Method, check.Equals, "GET")
+	c.Assert(cs.req.URL.Path, check.Equals, "/v1/validate/logging")
+	c.Assert(cs.req.URL.Query(), check.DeepEquals, url.Values{
+		"services": {"svc1,svc2"},
+	})
+}
+
+func (cs *clientSuite) TestValidateLoggingAll(c *check.C) {
+	cs.rsp = `{"result": [], "status": "OK", "status-code": 200, "type": "sync"}`
+
+	reports, err := cs.cli.ValidateLogging(&client.ValidateLoggingOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(reports, check.HasLen, 0)
+	c.Assert(cs.req.URL.Query(), check.DeepEquals, url.Values{})
+}
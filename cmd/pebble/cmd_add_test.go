@@ -79,3 +79,34 @@ services:
 		s.ResetStdStreams()
 	}
 }
+
+func (s *PebbleSuite) TestAddInvalidLayer(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{
+    "type": "error",
+    "status-code": 400,
+    "result": {
+        "message": "plan has 2 problems:\n- plan service \"a\" failure-log-lines must be between 0 and 1000, not 5000\n- plan service \"b\" watchdog-log-silence must be greater than zero",
+        "kind": "invalid-layer",
+        "value": [
+            {"field": "services.a.failure-log-lines", "code": "out-of-range", "message": "plan service \"a\" failure-log-lines must be between 0 and 1000, not 5000"},
+            {"field": "services.b.watchdog-log-silence", "code": "out-of-range", "message": "plan service \"b\" watchdog-log-silence must be greater than zero"}
+        ]
+    }
+}`)
+	})
+
+	layerPath := filepath.Join(c.MkDir(), "layer.yaml")
+	err := ioutil.WriteFile(layerPath, []byte("services: {}\n"), 0644)
+	c.Assert(err, check.IsNil)
+
+	restore := fakeArgs("pebble", "add", "foo", layerPath)
+	defer restore()
+
+	err = pebble.RunMain()
+	c.Assert(err, check.NotNil)
+	c.Check(err.Error(), check.Equals, `plan has 2 problems:
+       - plan service "a" failure-log-lines must be between 0 and 1000, not 5000
+       - plan service "b" watchdog-log-silence must be greater than zero`)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/canonical/pebble/client"
+)
+
+type cmdChecks struct {
+	clientMixin
+	timeMixin
+	Level      string `long:"level"`
+	Service    string `long:"service"`
+	Format     string `long:"format"`
+	Positional struct {
+		Checks []string `positional-arg-name:"<check>"`
+	} `positional-args:"yes"`
+}
+
+var checksDescs = map[string]string{
+	"level":   "Check level to filter for: \"alive\" or \"ready\".",
+	"service": "Only show the checks associated with this service.",
+	"format":  "Output format: \"text\" (default) or \"json\".",
+}
+
+var shortChecksHelp = "Query the status of configured health checks"
+var longChecksHelp = `
+The checks command lists status information about the health checks specified,
+or about all checks if none are specified.
+`
+
+func (cmd *cmdChecks) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+	switch cmd.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf(`invalid output format (expected "json" or "text", not %q)`, cmd.Format)
+	}
+
+	opts := client.ChecksOptions{
+		Level:   client.CheckLevel(cmd.Level),
+		Names:   cmd.Positional.Checks,
+		Service: cmd.Service,
+	}
+	checks, err := cmd.client.Checks(&opts)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Format == "json" {
+		if checks == nil {
+			checks = []*client.CheckInfo{}
+		}
+		encoder := json.NewEncoder(Stdout)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(checks)
+	}
+
+	if len(checks) == 0 {
+		if len(cmd.Positional.Checks) == 0 && cmd.Level == "" && cmd.Service == "" {
+			fmt.Fprintln(Stderr, "Plan has no health checks")
+		} else {
+			fmt.Fprintln(Stderr, "No matching health checks")
+		}
+		return nil
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	fmt.Fprintln(w, "Check\tLevel\tStatus\tFailures\tLast Run\tError")
+
+	for _, check := range checks {
+		level := string(check.Level)
+		if level == "" {
+			level = "-"
+		}
+		lastRun := "-"
+		if check.LastRun != nil {
+			lastRun = cmd.fmtTime(*check.LastRun)
+		}
+		lastError := check.LastError
+		if lastError == "" {
+			lastError = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+			check.Name, level, check.Status, check.Failures, lastRun, lastError)
+	}
+	return nil
+}
+
+func init() {
+	addCommand("checks", shortChecksHelp, longChecksHelp, func() flags.Commander { return &cmdChecks{} }, merge(checksDescs, timeDescs), nil)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/check.v1"
+
+	pebble "github.com/canonical/pebble/cmd/pebble"
+)
+
+const checksResponse = `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [
+		{"name": "chk1", "status": "up", "last-run": "2021-06-01T12:00:00Z"},
+		{"name": "chk2", "level": "alive", "status": "down", "failures": 3, "last-error": "exit status 1", "last-run": "2021-06-01T12:00:01Z"},
+		{"name": "chk3", "level": "ready", "status": "up"}
+	]
+}`
+
+func (s *PebbleSuite) TestChecks(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/checks")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{})
+		fmt.Fprint(w, checksResponse)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"checks", "--abs-time"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+Check  Level  Status  Failures  Last Run              Error
+chk1   -      up      0         2021-06-01T12:00:00Z  -
+chk2   alive  down    3         2021-06-01T12:00:01Z  exit status 1
+chk3   ready  up      0         -                     -
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestChecksFilters(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/checks")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{
+			"level":   {"alive"},
+			"names":   {"chk1,chk2"},
+			"service": {"svc1"},
+		})
+		fmt.Fprint(w, `{"type": "sync", "status-code": 200, "result": []}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"checks", "--level", "alive", "--service", "svc1", "chk1", "chk2"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, "")
+	c.Check(s.Stderr(), check.Equals, "No matching health checks\n")
+}
+
+func (s *PebbleSuite) TestChecksNone(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"type": "sync", "status-code": 200, "result": []}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"checks"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, "")
+	c.Check(s.Stderr(), check.Equals, "Plan has no health checks\n")
+}
+
+func (s *PebbleSuite) TestChecksJSON(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, checksResponse)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"checks", "--format", "json"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+[
+    {
+        "name": "chk1",
+        "status": "up",
+        "last-run": "2021-06-01T12:00:00Z"
+    },
+    {
+        "name": "chk2",
+        "level": "alive",
+        "status": "down",
+        "failures": 3,
+        "last-error": "exit status 1",
+        "last-run": "2021-06-01T12:00:01Z"
+    },
+    {
+        "name": "chk3",
+        "level": "ready",
+        "status": "up"
+    }
+]
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestChecksInvalidFormat(c *check.C) {
+	_, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"checks", "--format", "yaml"})
+	c.Assert(err, check.ErrorMatches, `invalid output format \(expected "json" or "text", not "yaml"\)`)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type cmdDebugReplayLog struct {
+	Pipeline   string  `long:"pipeline"`
+	Speed      float64 `long:"speed"`
+	Positional struct {
+		Capture string `positional-arg-name:"<capture>"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+var replayLogDescs = map[string]string{
+	"pipeline": "Comma-separated stages to replay through: decode=ENCODING, format[=NAME] (the default) and ring[=SIZE].",
+	"speed":    "Reproduce the original pacing, scaled by this factor (2 for twice as fast); by default, replay at once.",
+}
+
+var shortReplayLogHelp = "Replay captured service output through a log pipeline"
+var longReplayLogHelp = `
+The replay-log command feeds the chunks of service output recorded in a
+capture through the given log pipeline, with the original chunk boundaries,
+and writes the result to standard output.
+
+A truncated capture is replayed up to its last complete record.
+`
+
+func (cmd *cmdDebugReplayLog) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+	if cmd.Speed < 0 {
+		return fmt.Errorf("speed must not be negative")
+	}
+	spec := cmd.Pipeline
+	if spec == "" {
+		spec = "format"
+	}
+	pipeline, err := servicelog.NewPipeline(spec, Stdout)
+	if err != nil {
+		return err
+	}
+	defer pipeline.Close()
+
+	f, err := os.Open(cmd.Positional.Capture)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = servicelog.Replay(f, pipeline, cmd.Speed)
+	if err == servicelog.ErrTruncatedCapture {
+		fmt.Fprintf(Stderr, "WARNING: %s is truncated; replayed up to the last complete record\n", cmd.Positional.Capture)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot replay %s: %w", cmd.Positional.Capture, err)
+	}
+	return nil
+}
+
+func init() {
+	addDebugCommand("replay-log", shortReplayLogHelp, longReplayLogHelp, func() flags.Commander { return &cmdDebugReplayLog{} }, replayLogDescs, nil)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+
+	pebble "github.com/canonical/pebble/cmd/pebble"
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+func writeCapture(c *check.C, chunks ...string) (path string, capture []byte) {
+	var buf bytes.Buffer
+	recorder := servicelog.NewRecorder(ioutil.Discard, &buf)
+	for _, chunk := range chunks {
+		_, err := recorder.Write([]byte(chunk))
+		c.Assert(err, check.IsNil)
+	}
+	path = filepath.Join(c.MkDir(), "capture")
+	err := ioutil.WriteFile(path, buf.Bytes(), 0644)
+	c.Assert(err, check.IsNil)
+	return path, buf.Bytes()
+}
+
+func (s *PebbleSuite) TestDebugReplayLog(c *check.C) {
+	path, _ := writeCapture(c, "first line\nsec", "ond line\n")
+
+	restore := fakeArgs("pebble", "debug", "replay-log", "--pipeline", "ring=16", path)
+	defer restore()
+
+	err := pebble.RunMain()
+	c.Assert(err, check.IsNil)
+	c.Check(s.Stdout(), check.Equals, "first line\nsecond line\n")
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestDebugReplayLogFormat(c *check.C) {
+	path, _ := writeCapture(c, "first line\n")
+
+	restore := fakeArgs("pebble", "debug", "replay-log", path)
+	defer restore()
+
+	err := pebble.RunMain()
+	c.Assert(err, check.IsNil)
+	c.Check(s.Stdout(), check.Matches, `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z \[replay\] first line\n`)
+}
+
+func (s *PebbleSuite) TestDebugReplayLogTruncated(c *check.C) {
+	path, capture := writeCapture(c, "first line\n", "second line\n")
+	err := ioutil.WriteFile(path, capture[:len(capture)-5], 0644)
+	c.Assert(err, check.IsNil)
+
+	restore := fakeArgs("pebble", "debug", "replay-log", "--pipeline", "ring", path)
+	defer restore()
+
+	err = pebble.RunMain()
+	c.Assert(err, check.IsNil)
+	c.Check(s.Stdout(), check.Equals, "first line\n")
+	c.Check(s.Stderr(), check.Equals, "WARNING: "+path+" is truncated; replayed up to the last complete record\n")
+}
+
+func (s *PebbleSuite) TestDebugReplayLogErrors(c *check.C) {
+	path, _ := writeCapture(c, "first line\n")
+	notCapture := filepath.Join(c.MkDir(), "log")
+	err := ioutil.WriteFile(notCapture, []byte("not a capture, just a longer line of text\n"), 0644)
+	c.Assert(err, check.IsNil)
+
+	for _, test := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--pipeline", "filter", path}, `invalid pipeline stage "filter"`},
+		{[]string{"--speed", "-1", path}, `speed must not be negative`},
+		{[]string{filepath.Join(c.MkDir(), "missing")}, `open .*: no such file or directory`},
+		{[]string{notCapture}, `cannot replay .*: invalid capture`},
+	} {
+		restore := fakeArgs(append([]string{"pebble", "debug", "replay-log"}, test.args...)...)
+		err := pebble.RunMain()
+		restore()
+		c.Check(err, check.ErrorMatches, test.err, check.Commentf("args %q", test.args))
+	}
+}
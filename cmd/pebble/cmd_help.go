@@ -172,11 +172,11 @@ var helpCategories = []helpCategory{{
 }, {
 	Label:       "Plan",
 	Description: "view and change configuration",
-	Commands:    []string{"add", "plan"},
+	Commands:    []string{"add", "plan", "validate"},
 }, {
 	Label:       "Services",
 	Description: "manage services",
-	Commands:    []string{"services", "logs", "start", "restart", "signal", "stop", "replan"},
+	Commands:    []string{"services", "logs", "start", "restart", "reload", "signal", "stop", "replan", "checks", "timers"},
 }, {
 	Label:       "Files",
 	Description: "work with files and execute commands",
@@ -187,8 +187,8 @@ var helpCategories = []helpCategory{{
 	Commands:    []string{"changes", "tasks"},
 }, {
 	Label:       "Warnings",
-	Description: "manage warnings",
-	Commands:    []string{"warnings", "okay"},
+	Description: "manage warnings and notices",
+	Commands:    []string{"warnings", "notices", "okay"},
 }}
 
 var (
@@ -33,6 +33,7 @@ const (
 
 type cmdLogs struct {
 	clientMixin
+	groupMixin
 	Follow     bool   `short:"f" long:"follow"`
 	Format     string `long:"format"`
 	N          string `short:"n"`
@@ -91,6 +92,7 @@ func (cmd *cmdLogs) Execute(args []string) error {
 	opts := client.LogsOptions{
 		WriteLog: writeLog,
 		Services: cmd.Positional.Services,
+		Groups:   cmd.Groups,
 		N:        n,
 	}
 	var err error
@@ -121,5 +123,5 @@ func notifyContext(parent context.Context, signals ...os.Signal) context.Context
 }
 
 func init() {
-	addCommand("logs", shortLogsHelp, longLogsHelp, func() flags.Commander { return &cmdLogs{} }, logsDescs, nil)
+	addCommand("logs", shortLogsHelp, longLogsHelp, func() flags.Commander { return &cmdLogs{} }, merge(logsDescs, groupDescs), nil)
 }
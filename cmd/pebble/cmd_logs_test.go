@@ -138,3 +138,61 @@ func (s *PebbleSuite) TestLogsFollow(c *C) {
 `[1:])
 	c.Check(s.Stderr(), Equals, "")
 }
+
+func (s *PebbleSuite) TestLogsServicesFollowJSON(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "GET")
+		c.Check(r.URL.Path, Equals, "/v1/logs")
+		c.Check(r.URL.Query(), DeepEquals, url.Values{
+			"services": []string{"thing", "snappass"},
+			"n":        []string{"5"},
+			"follow":   []string{"true"},
+		})
+		fmt.Fprintf(w, `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1"}
+{"time":"2021-05-03T03:55:49.654334232Z","service":"snappass","message":"log two"}
+`[1:])
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"logs", "-f", "-n5", "--format=json", "thing", "snappass"})
+	c.Assert(err, IsNil)
+	c.Assert(rest, HasLen, 0)
+	c.Check(s.Stdout(), Equals, `
+{"time":"2021-05-03T03:55:49.360994155Z","service":"thing","message":"log 1"}
+{"time":"2021-05-03T03:55:49.654334232Z","service":"snappass","message":"log two"}
+`[1:])
+	c.Check(s.Stderr(), Equals, "")
+}
+
+func (s *PebbleSuite) TestLogsGroupsZero(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "GET")
+		c.Check(r.URL.Path, Equals, "/v1/logs")
+		c.Check(r.URL.Query(), DeepEquals, url.Values{
+			"groups": []string{"web"},
+			"follow": []string{"true"},
+		})
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"logs", "-f", "-n0", "--group", "web"})
+	c.Assert(err, IsNil)
+	c.Assert(rest, HasLen, 0)
+	c.Check(s.Stdout(), Equals, "")
+	c.Check(s.Stderr(), Equals, "")
+}
+
+func (s *PebbleSuite) TestLogsInvalidN(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("unexpected request to %s", r.URL.Path)
+	})
+	for _, n := range []string{"-n-1", "-nx", "-nsome"} {
+		_, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"logs", n})
+		c.Check(err, ErrorMatches, `expected n to be a non-negative integer or "all", not .*`)
+	}
+}
+
+func (s *PebbleSuite) TestLogsInvalidFormat(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("unexpected request to %s", r.URL.Path)
+	})
+	_, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"logs", "--format", "yaml"})
+	c.Assert(err, ErrorMatches, `invalid output format \(expected "json" or "text", not "yaml"\)`)
+}
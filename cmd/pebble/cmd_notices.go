@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/canonical/pebble/client"
+)
+
+type cmdNotices struct {
+	clientMixin
+	timeMixin
+	All   bool     `long:"all"`
+	Types []string `long:"type"`
+}
+
+var shortNoticesHelp = "List notices"
+var longNoticesHelp = `
+The notices command lists notices about things that have happened in the
+system, such as services being restarted. Repeated occurrences of the same
+notice are combined, with a count of how many times it occurred.
+
+Once notices have been listed with 'pebble notices', 'pebble okay' may be used
+to acknowledge them. An acknowledged notice will not be listed again unless it
+occurs again.
+`
+
+func init() {
+	addCommand("notices", shortNoticesHelp, longNoticesHelp, func() flags.Commander { return &cmdNotices{} }, merge(timeDescs, map[string]string{
+		"all":  "Show all notices, including acknowledged ones",
+		"type": "Only show notices of this type (can be repeated)",
+	}), nil)
+}
+
+func (cmd *cmdNotices) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+	now := time.Now()
+
+	notices, err := cmd.client.Notices(&client.NoticesOptions{
+		Types: cmd.Types,
+		All:   cmd.All,
+	})
+	if err != nil {
+		return err
+	}
+	if len(notices) == 0 {
+		fmt.Fprintln(Stderr, "No notices.")
+		return nil
+	}
+
+	if err := writeWarningTimestamp(now); err != nil {
+		return err
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	fmt.Fprintln(w, "Type\tKey\tFirst\tLast\tCount\tData")
+
+	for _, notice := range notices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", notice.Type, notice.Key,
+			cmd.fmtTime(notice.FirstOccurred), cmd.fmtTime(notice.LastOccurred),
+			notice.Occurrences, formatNoticeData(notice.LastData))
+	}
+	return nil
+}
+
+// formatNoticeData formats a notice's data as "k1=v1,k2=v2", sorted by key.
+func formatNoticeData(data map[string]string) string {
+	if len(data) == 0 {
+		return "-"
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + data[k]
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/check.v1"
+
+	pebble "github.com/canonical/pebble/cmd/pebble"
+)
+
+func (s *warningSuite) TestNotices(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, check.Equals, "GET")
+		c.Check(r.URL.Path, check.Equals, "/v1/notices")
+		c.Check(r.URL.Query(), check.DeepEquals, url.Values{
+			"types":  {"service-restart"},
+			"select": {"all"},
+		})
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [{
+		"type": "service-restart",
+		"key": "svc1",
+		"first-occurred": "2021-06-01T12:00:00Z",
+		"last-occurred": "2021-06-01T13:00:00Z",
+		"occurrences": 2,
+		"last-data": {"delay": "1s", "backoff": "2"},
+		"expire-after": "168h0m0s"
+	}, {
+		"type": "service-restart",
+		"key": "svc2",
+		"first-occurred": "2021-06-01T14:00:00Z",
+		"last-occurred": "2021-06-01T14:00:00Z",
+		"occurrences": 1,
+		"expire-after": "168h0m0s"
+	}]
+}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"notices", "--abs-time", "--all", "--type", "service-restart"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+Type             Key   First                 Last                  Count  Data
+service-restart  svc1  2021-06-01T12:00:00Z  2021-06-01T13:00:00Z  2      backoff=2,delay=1s
+service-restart  svc2  2021-06-01T14:00:00Z  2021-06-01T14:00:00Z  1      -
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+
+	// Listing notices allows them to be acknowledged.
+	_, err = pebble.LastWarningTimestamp()
+	c.Check(err, check.IsNil)
+}
+
+func (s *warningSuite) TestNoNotices(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Query(), check.HasLen, 0)
+		fmt.Fprint(w, `{"type": "sync", "status-code": 200, "result": []}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"notices"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, "")
+	c.Check(s.Stderr(), check.Equals, "No notices.\n")
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/jessevdk/go-flags"
+
+	"github.com/canonical/pebble/client"
+)
+
+var shortReloadHelp = "Reload a service's configuration"
+var longReloadHelp = `
+The reload command sends the named service(s) their configured reload-signal,
+so they can reload their configuration without restarting. If the service has
+a reload-ready-log or reload-ready-check, the command waits for the service to
+log a matching line or for the check to pass.
+
+Services without a reload-signal are restarted instead, unless --no-restart
+is given.
+`
+
+type cmdReload struct {
+	waitMixin
+	groupMixin
+	NoRestart  bool `long:"no-restart"`
+	Positional struct {
+		Services []string `positional-arg-name:"<service>"`
+	} `positional-args:"yes"`
+}
+
+func init() {
+	addCommand("reload", shortReloadHelp, longReloadHelp, func() flags.Commander { return &cmdReload{} }, merge(waitDescs, groupDescs, map[string]string{
+		"no-restart": "Fail for services without a reload-signal, rather than restarting them.",
+	}), nil)
+}
+
+func (cmd cmdReload) Execute(args []string) error {
+	if len(args) > 1 {
+		return ErrExtraArgs
+	}
+	if err := cmd.requireServices(cmd.Positional.Services); err != nil {
+		return err
+	}
+
+	servopts := client.ServiceOptions{
+		Names:     cmd.Positional.Services,
+		Groups:    cmd.Groups,
+		NoRestart: cmd.NoRestart,
+	}
+	changeID, err := cmd.client.Reload(&servopts)
+	if err != nil {
+		return err
+	}
+
+	if _, err := cmd.wait(changeID); err != nil {
+		if err == noWait {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
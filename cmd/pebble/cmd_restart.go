@@ -27,22 +27,27 @@ The restart command restarts the named service(s) in the correct order.
 
 type cmdRestart struct {
 	waitMixin
+	groupMixin
 	Positional struct {
-		Services []string `positional-arg-name:"<service>" required:"1"`
+		Services []string `positional-arg-name:"<service>"`
 	} `positional-args:"yes"`
 }
 
 func init() {
-	addCommand("restart", shortRestartHelp, longRestartHelp, func() flags.Commander { return &cmdRestart{} }, waitDescs, nil)
+	addCommand("restart", shortRestartHelp, longRestartHelp, func() flags.Commander { return &cmdRestart{} }, merge(waitDescs, groupDescs), nil)
 }
 
 func (cmd cmdRestart) Execute(args []string) error {
 	if len(args) > 1 {
 		return ErrExtraArgs
 	}
+	if err := cmd.requireServices(cmd.Positional.Services); err != nil {
+		return err
+	}
 
 	servopts := client.ServiceOptions{
-		Names: cmd.Positional.Services,
+		Names:  cmd.Positional.Services,
+		Groups: cmd.Groups,
 	}
 	changeID, err := cmd.client.Restart(&servopts)
 	if err != nil {
@@ -28,6 +28,7 @@ import (
 	"github.com/canonical/pebble/cmd"
 	"github.com/canonical/pebble/internal/daemon"
 	"github.com/canonical/pebble/internal/logger"
+	"github.com/canonical/pebble/internal/strutil"
 	"github.com/canonical/pebble/internal/systemd"
 )
 
@@ -39,17 +40,23 @@ The run command starts pebble and runs the configured environment.
 type cmdRun struct {
 	clientMixin
 
-	CreateDirs bool `long:"create-dirs"`
-	Hold       bool `long:"hold"`
-	Verbose    bool `short:"v" long:"verbose"`
+	CreateDirs      bool   `long:"create-dirs"`
+	Hold            bool   `long:"hold"`
+	Verbose         bool   `short:"v" long:"verbose"`
+	LogMemoryLimit  string `long:"log-memory-limit"`
+	LogBurstReserve string `long:"log-burst-reserve"`
+	TraceLogLatency bool   `long:"trace-log-latency"`
 }
 
 func init() {
 	addCommand("run", shortRunHelp, longRunHelp, func() flags.Commander { return &cmdRun{} },
 		map[string]string{
-			"create-dirs": "Create pebble directory on startup if it doesn't exist",
-			"hold":        "Do not start default services automatically",
-			"verbose":     "Log all output from services to stdout",
+			"create-dirs":       "Create pebble directory on startup if it doesn't exist",
+			"hold":              "Do not start default services automatically",
+			"verbose":           "Log all output from services to stdout",
+			"log-memory-limit":  "Limit the total memory of all services' log buffers (for example 16MB)",
+			"log-burst-reserve": "Memory services' log buffers may borrow during bursts of output (for example 4MB)",
+			"trace-log-latency": "Measure the latency of services' log lines (reported in metrics)",
 		}, nil)
 }
 
@@ -128,6 +135,27 @@ func runDaemon(rcmd *cmdRun, ch chan os.Signal) error {
 	if rcmd.Verbose {
 		dopts.ServiceOutput = os.Stdout
 	}
+	if rcmd.LogMemoryLimit != "" {
+		limit, err := strutil.ParseByteSize(rcmd.LogMemoryLimit)
+		if err != nil {
+			return fmt.Errorf("invalid log memory limit: %v", err)
+		}
+		if limit <= 0 {
+			return fmt.Errorf("log memory limit must be greater than zero")
+		}
+		dopts.LogMemoryLimit = limit
+	}
+	if rcmd.LogBurstReserve != "" {
+		size, err := strutil.ParseByteSize(rcmd.LogBurstReserve)
+		if err != nil {
+			return fmt.Errorf("invalid log burst reserve: %v", err)
+		}
+		if size <= 0 {
+			return fmt.Errorf("log burst reserve must be greater than zero")
+		}
+		dopts.LogBurstReserve = size
+	}
+	dopts.TraceLogLatency = rcmd.TraceLogLatency
 
 	d, err := daemon.New(&dopts)
 	if err != nil {
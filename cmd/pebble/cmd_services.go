@@ -15,15 +15,23 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/jessevdk/go-flags"
 
 	"github.com/canonical/pebble/client"
+	"github.com/canonical/pebble/internal/strutil"
+	"github.com/canonical/pebble/internal/strutil/quantity"
 )
 
 type cmdServices struct {
 	clientMixin
+	groupMixin
+	Usage      bool `long:"usage"`
+	Logging    bool `long:"logging"`
 	Positional struct {
 		Services []string `positional-arg-name:"<service>"`
 	} `positional-args:"yes"`
@@ -32,23 +40,44 @@ type cmdServices struct {
 var shortServicesHelp = "Query the status of configured services"
 var longServicesHelp = `
 The services command lists status information about the services specified, or
-about all services if none are specified.
+about all services if none are specified. Services with failing health checks
+are marked with the names of those checks.
+
+With --usage, the resident memory, CPU time, thread count and open file
+descriptors of each running service's processes are shown too. Fields are
+shown as "-" when the daemon can't read them.
+
+With --logging, each service's log pipeline is described instead: its stages
+(those its running process's output goes through, or those it would be
+started with), its log encoding and files, any stages left out after
+panicking, and how much of its log buffer is used.
 `
 
+var servicesDescs = map[string]string{
+	"usage":   "Show resource usage of running services",
+	"logging": "Describe the log pipeline of each service",
+}
+
 func (cmd *cmdServices) Execute(args []string) error {
 	if len(args) > 0 {
 		return ErrExtraArgs
 	}
+	if cmd.Usage && cmd.Logging {
+		return errors.New("cannot use --usage and --logging together")
+	}
 
 	opts := client.ServicesOptions{
-		Names: cmd.Positional.Services,
+		Names:   cmd.Positional.Services,
+		Groups:  cmd.Groups,
+		Usage:   cmd.Usage,
+		Logging: cmd.Logging,
 	}
 	services, err := cmd.client.Services(&opts)
 	if err != nil {
 		return err
 	}
 	if len(services) == 0 {
-		if len(cmd.Positional.Services) == 0 {
+		if len(cmd.Positional.Services) == 0 && len(cmd.Groups) == 0 {
 			fmt.Fprintln(Stderr, "Plan has no services")
 		} else {
 			fmt.Fprintln(Stderr, "No matching services")
@@ -56,17 +85,88 @@ func (cmd *cmdServices) Execute(args []string) error {
 		return nil
 	}
 
+	if cmd.Logging {
+		for i, svc := range services {
+			if i > 0 {
+				fmt.Fprintln(Stdout)
+			}
+			printServiceLogging(svc)
+		}
+		return nil
+	}
+
 	w := tabWriter()
 	defer w.Flush()
 
-	fmt.Fprintln(w, "Service\tStartup\tCurrent")
+	if cmd.Usage {
+		fmt.Fprintln(w, "Service\tStartup\tRSS\tCPU\tThreads\tFDs\tCurrent")
+	} else {
+		fmt.Fprintln(w, "Service\tStartup\tCurrent")
+	}
 
 	for _, svc := range services {
-		fmt.Fprintf(w, "%s\t%s\t%s\n", svc.Name, svc.Startup, svc.Current)
+		current := string(svc.Current)
+		if len(svc.Args) > 0 {
+			current += " (args: " + strings.Join(svc.Args, " ") + ")"
+		}
+		if len(svc.FailingChecks) > 0 {
+			current += " (failing checks: " + strings.Join(svc.FailingChecks, ", ") + ")"
+		}
+		if cmd.Usage {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", svc.Name, svc.Startup, formatUsage(svc.Usage), current)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", svc.Name, svc.Startup, current)
+		}
 	}
 	return nil
 }
 
+// printServiceLogging prints a description of the service's log pipeline.
+func printServiceLogging(svc *client.ServiceInfo) {
+	fmt.Fprintf(Stdout, "%s (%s):\n", svc.Name, svc.Current)
+	logging := svc.Logging
+	if logging == nil {
+		fmt.Fprintln(Stdout, "  pipeline:  -")
+		return
+	}
+	fmt.Fprintf(Stdout, "  pipeline:  %s (%s)\n", strings.Join(logging.Stages, " -> "), logging.Mode)
+	if logging.Encoding != "" {
+		fmt.Fprintf(Stdout, "  encoding:  %s\n", logging.Encoding)
+	}
+	if len(logging.Files) > 0 {
+		fmt.Fprintf(Stdout, "  log files: %s\n", strings.Join(logging.Files, ", "))
+	}
+	if len(logging.DisabledStages) > 0 {
+		fmt.Fprintf(Stdout, "  disabled:  %s (until the next replan)\n", strings.Join(logging.DisabledStages, ", "))
+	}
+	if logging.BufferSize > 0 && logging.BufferBorrowed > 0 {
+		fmt.Fprintf(Stdout, "  buffer:    %s of %s used (%s borrowed)\n",
+			strutil.SizeToStr(int64(logging.BufferUsed)), strutil.SizeToStr(int64(logging.BufferSize)),
+			strutil.SizeToStr(int64(logging.BufferBorrowed)))
+	} else if logging.BufferSize > 0 {
+		fmt.Fprintf(Stdout, "  buffer:    %s of %s used\n",
+			strutil.SizeToStr(int64(logging.BufferUsed)), strutil.SizeToStr(int64(logging.BufferSize)))
+	} else {
+		fmt.Fprintln(Stdout, "  buffer:    -")
+	}
+}
+
+// formatUsage returns the RSS, CPU, Threads and FDs columns for a service.
+func formatUsage(usage *client.ServiceUsage) string {
+	if usage == nil {
+		return "-\t-\t-\t-"
+	}
+	cpu := "0s"
+	if usage.CPUSeconds > 0 {
+		cpu = strings.TrimSpace(quantity.FormatDuration(usage.CPUSeconds))
+	}
+	fds := "-"
+	if usage.FDs != nil {
+		fds = strconv.Itoa(*usage.FDs)
+	}
+	return fmt.Sprintf("%s\t%s\t%d\t%s", strutil.SizeToStr(usage.RSS), cpu, usage.Threads, fds)
+}
+
 func init() {
-	addCommand("services", shortServicesHelp, longServicesHelp, func() flags.Commander { return &cmdServices{} }, nil, nil)
+	addCommand("services", shortServicesHelp, longServicesHelp, func() flags.Commander { return &cmdServices{} }, merge(servicesDescs, groupDescs), nil)
 }
@@ -51,6 +51,70 @@ svc3     enabled  backoff
 	c.Check(s.Stderr(), check.Equals, "")
 }
 
+func (s *PebbleSuite) TestServicesUsage(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/services")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{"names": {""}, "usage": {"true"}})
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [
+		{"name": "svc1", "current": "active", "startup": "enabled", "usage": {"processes": 2, "rss": 4200000, "cpu-seconds": 75.5, "threads": 3, "fds": 12}},
+		{"name": "svc2", "current": "active", "startup": "enabled", "usage": {"processes": 1, "rss": 12000, "cpu-seconds": 0, "threads": 1}},
+		{"name": "svc3", "current": "inactive", "startup": "disabled"}
+	]
+}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"services", "--usage"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+Service  Startup   RSS   CPU    Threads  FDs  Current
+svc1     enabled   4MB   1m16s  3        12   active
+svc2     enabled   12kB  0s     1        -    active
+svc3     disabled  -     -      -        -    inactive
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestServicesLogging(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/services")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{"names": {"svc1,svc2"}, "logging": {"true"}})
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [
+		{"name": "svc1", "current": "active", "startup": "enabled", "logging": {"encoding": "utf-16le", "files": ["/var/log/svc1/*.log", "/var/log/svc1.err"], "stages": ["format", "buffer", "output"], "mode": "minimal", "disabled-stages": ["decode"], "buffer-size": 135168, "buffer-used": 2048, "buffer-borrowed": 32768}},
+		{"name": "svc2", "current": "inactive", "startup": "disabled", "logging": {"stages": ["format", "buffer", "output"], "mode": "full", "buffer-size": 0, "buffer-used": 0}}
+	]
+}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"services", "--logging", "svc1", "svc2"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+svc1 (active):
+  pipeline:  format -> buffer -> output (minimal)
+  encoding:  utf-16le
+  log files: /var/log/svc1/*.log, /var/log/svc1.err
+  disabled:  decode (until the next replan)
+  buffer:    2kB of 135kB used (32kB borrowed)
+
+svc2 (inactive):
+  pipeline:  format -> buffer -> output (full)
+  buffer:    -
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestServicesUsageAndLogging(c *check.C) {
+	_, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"services", "--usage", "--logging"})
+	c.Assert(err, check.ErrorMatches, "cannot use --usage and --logging together")
+}
+
 func (s *PebbleSuite) TestServicesNames(c *check.C) {
 	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
 		c.Assert(r.Method, check.Equals, "GET")
@@ -75,3 +139,45 @@ foo      enabled   inactive
 `[1:])
 	c.Check(s.Stderr(), check.Equals, "")
 }
+
+func (s *PebbleSuite) TestServicesGroups(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/services")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{"names": {"foo"}, "groups": {"web"}})
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": []
+}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"services", "--group", "web", "foo"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, "")
+	c.Check(s.Stderr(), check.Equals, "No matching services\n")
+}
+
+func (s *PebbleSuite) TestServicesFailingChecks(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/services")
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [
+		{"name": "svc1", "current": "active", "startup": "enabled", "failing-checks": ["chk1", "chk2"]},
+		{"name": "svc2", "current": "active", "startup": "enabled", "args": ["--log-level=debug"]}
+	]
+}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"services"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+Service  Startup  Current
+svc1     enabled  active (failing checks: chk1, chk2)
+svc2     enabled  active (args: --log-level=debug)
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
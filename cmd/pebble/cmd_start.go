@@ -15,6 +15,9 @@
 package main
 
 import (
+	"errors"
+	"os"
+
 	"github.com/canonical/pebble/client"
 	"github.com/jessevdk/go-flags"
 )
@@ -23,17 +26,26 @@ var shortStartHelp = "Start a service and its dependencies"
 var longStartHelp = `
 The start command starts the service with the provided name and
 any other services it depends on, in the correct order.
+
+Extra arguments may be appended to a single service's command using "--",
+for example:
+
+pebble start web -- --log-level=debug
+
+The extra arguments are kept if the service is restarted automatically, and
+dropped the next time it's started without them.
 `
 
 type cmdStart struct {
 	waitMixin
+	groupMixin
 	Positional struct {
-		Services []string `positional-arg-name:"<service>" required:"1"`
+		Services []string `positional-arg-name:"<service>"`
 	} `positional-args:"yes"`
 }
 
 func init() {
-	addCommand("start", shortStartHelp, longStartHelp, func() flags.Commander { return &cmdStart{} }, waitDescs, nil)
+	addCommand("start", shortStartHelp, longStartHelp, func() flags.Commander { return &cmdStart{} }, merge(waitDescs, groupDescs), nil)
 }
 
 func (cmd cmdStart) Execute(args []string) error {
@@ -41,8 +53,25 @@ func (cmd cmdStart) Execute(args []string) error {
 		return ErrExtraArgs
 	}
 
+	// The arguments after "--" end up in the positional arguments too,
+	// so split them off here.
+	names := cmd.Positional.Services
+	var extraArgs []string
+	if extra := argsAfterDoubleDash(os.Args); len(extra) > 0 {
+		n := len(names) - len(extra)
+		if n != 1 {
+			return errors.New(`extra arguments may only be given when starting a single service`)
+		}
+		names, extraArgs = names[:n], extra
+	}
+	if err := cmd.requireServices(names); err != nil {
+		return err
+	}
+
 	servopts := client.ServiceOptions{
-		Names: cmd.Positional.Services,
+		Names:  names,
+		Groups: cmd.Groups,
+		Args:   extraArgs,
 	}
 	changeID, err := cmd.client.Start(&servopts)
 	if err != nil {
@@ -57,3 +86,14 @@ func (cmd cmdStart) Execute(args []string) error {
 	}
 	return nil
 }
+
+// argsAfterDoubleDash returns the command line arguments after the first
+// "--", if any.
+func argsAfterDoubleDash(args []string) []string {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[i+1:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+
+	"gopkg.in/check.v1"
+
+	pebble "github.com/canonical/pebble/cmd/pebble"
+)
+
+func (s *PebbleSuite) TestStartArgs(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, check.Equals, "POST")
+		c.Check(r.URL.Path, check.Equals, "/v1/services")
+		assertBodyEquals(c, r.Body, map[string]interface{}{
+			"action":   "start",
+			"services": []interface{}{"srv1"},
+			"args":     []interface{}{"--log-level=debug", "a b"},
+		})
+		fmt.Fprint(w, `{
+    "type": "async",
+    "status-code": 202,
+    "change": "42"
+}`)
+	})
+
+	restore := fakeArgs("pebble", "start", "--no-wait", "srv1", "--", "--log-level=debug", "a b")
+	defer restore()
+
+	err := pebble.RunMain()
+	c.Assert(err, check.IsNil)
+	c.Check(s.Stdout(), check.Equals, "42\n")
+}
+
+func (s *PebbleSuite) TestStartArgsMultipleServices(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("unexpected request")
+	})
+
+	restore := fakeArgs("pebble", "start", "srv1", "srv2", "--", "--log-level=debug")
+	defer restore()
+
+	err := pebble.RunMain()
+	c.Assert(err, check.ErrorMatches, "extra arguments may only be given when starting a single service")
+}
+
+func (s *PebbleSuite) TestStartGroups(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, check.Equals, "POST")
+		c.Check(r.URL.Path, check.Equals, "/v1/services")
+		assertBodyEquals(c, r.Body, map[string]interface{}{
+			"action":   "start",
+			"services": nil,
+			"groups":   []interface{}{"web", "db"},
+		})
+		fmt.Fprint(w, `{
+    "type": "async",
+    "status-code": 202,
+    "change": "42"
+}`)
+	})
+
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"start", "--no-wait", "--group", "web", "--group", "db"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, "42\n")
+}
+
+func (s *PebbleSuite) TestStartNoServices(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("unexpected request")
+	})
+
+	_, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"start"})
+	c.Assert(err, check.ErrorMatches, "at least one service or --group must be specified")
+}
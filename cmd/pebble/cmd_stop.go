@@ -27,22 +27,27 @@ any other service that depends on it, in the correct order.
 
 type cmdStop struct {
 	waitMixin
+	groupMixin
 	Positional struct {
-		Services []string `positional-arg-name:"<service>" required:"1"`
+		Services []string `positional-arg-name:"<service>"`
 	} `positional-args:"yes"`
 }
 
 func init() {
-	addCommand("stop", shortStopHelp, longStopHelp, func() flags.Commander { return &cmdStop{} }, waitDescs, nil)
+	addCommand("stop", shortStopHelp, longStopHelp, func() flags.Commander { return &cmdStop{} }, merge(waitDescs, groupDescs), nil)
 }
 
 func (cmd cmdStop) Execute(args []string) error {
 	if len(args) > 1 {
 		return ErrExtraArgs
 	}
+	if err := cmd.requireServices(cmd.Positional.Services); err != nil {
+		return err
+	}
 
 	servopts := client.ServiceOptions{
-		Names: cmd.Positional.Services,
+		Names:  cmd.Positional.Services,
+		Groups: cmd.Groups,
 	}
 	changeID, err := cmd.client.Stop(&servopts)
 	if err != nil {
@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/canonical/pebble/client"
+)
+
+type cmdTimers struct {
+	clientMixin
+	timeMixin
+	Positional struct {
+		Timers []string `positional-arg-name:"<timer>"`
+	} `positional-args:"yes"`
+}
+
+var shortTimersHelp = "Query the status of configured timers"
+var longTimersHelp = `
+The timers command lists status information about the timers specified, or
+about all timers if none are specified, including when each will next run
+and the result of its last run.
+`
+
+func (cmd *cmdTimers) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+
+	opts := client.TimersOptions{
+		Names: cmd.Positional.Timers,
+	}
+	timers, err := cmd.client.Timers(&opts)
+	if err != nil {
+		return err
+	}
+	if len(timers) == 0 {
+		if len(cmd.Positional.Timers) == 0 {
+			fmt.Fprintln(Stderr, "Plan has no timers")
+		} else {
+			fmt.Fprintln(Stderr, "No matching timers")
+		}
+		return nil
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	fmt.Fprintln(w, "Timer\tNext\tLast\tResult")
+
+	for _, timer := range timers {
+		last := "-"
+		result := "-"
+		if timer.LastRun != nil {
+			last = cmd.fmtTime(timer.LastRun.StartTime)
+			result = "ok"
+			if timer.LastRun.Error != "" {
+				result = timer.LastRun.Error
+			}
+		}
+		if timer.Running {
+			result = "running"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", timer.Name, cmd.fmtTime(timer.NextRun), last, result)
+	}
+	return nil
+}
+
+func init() {
+	addCommand("timers", shortTimersHelp, longTimersHelp, func() flags.Commander { return &cmdTimers{} }, timeDescs, nil)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/check.v1"
+
+	pebble "github.com/canonical/pebble/cmd/pebble"
+)
+
+func (s *PebbleSuite) TestTimers(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/timers")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{"names": {""}})
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [
+		{"name": "t1", "next-run": "2021-06-01T12:00:00Z"},
+		{"name": "t2", "next-run": "2021-06-01T13:00:00Z", "last-run": {
+			"start-time": "2021-06-01T11:00:00Z", "duration": "1s", "exit-code": 0}},
+		{"name": "t3", "next-run": "2021-06-01T14:00:00Z", "last-run": {
+			"start-time": "2021-06-01T11:30:00Z", "duration": "1s", "exit-code": 3, "error": "exit status 3"}},
+		{"name": "t4", "next-run": "2021-06-01T15:00:00Z", "running": true}
+	]
+}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"timers", "--abs-time"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+Timer  Next                  Last                  Result
+t1     2021-06-01T12:00:00Z  -                     -
+t2     2021-06-01T13:00:00Z  2021-06-01T11:00:00Z  ok
+t3     2021-06-01T14:00:00Z  2021-06-01T11:30:00Z  exit status 3
+t4     2021-06-01T15:00:00Z  -                     running
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestTimersNames(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/timers")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{"names": {"foo,bar"}})
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": []
+}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"timers", "foo", "bar"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, "")
+	c.Check(s.Stderr(), check.Equals, "No matching timers\n")
+}
+
+func (s *PebbleSuite) TestTimersNone(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+    "type": "sync",
+    "status-code": 200,
+    "result": []
+}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"timers"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, "")
+	c.Check(s.Stderr(), check.Equals, "Plan has no timers\n")
+}
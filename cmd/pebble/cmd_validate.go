@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/canonical/pebble/client"
+)
+
+type cmdValidate struct {
+	clientMixin
+	Logging    bool   `long:"logging"`
+	Format     string `long:"format"`
+	Positional struct {
+		Services []string `positional-arg-name:"<service>"`
+	} `positional-args:"yes"`
+}
+
+var validateDescs = map[string]string{
+	"logging": "Validate the services' logging configuration.",
+	"format":  "Output format: \"text\" (default) or \"json\".",
+}
+
+var shortValidateHelp = "Validate the configuration of the services"
+var longValidateHelp = `
+The validate command checks the configuration of the services specified, or of
+all services if none are specified, without starting or changing them.
+
+With --logging, each service's log pipeline is built as it would be to start
+the service, and sample output is run through it. The stages of the pipeline,
+any problems found, and the first lines of the sample output as they'd appear
+in the service's logs are shown. The command fails if any problems are found.
+`
+
+func (cmd *cmdValidate) Execute(args []string) error {
+	if len(args) > 0 {
+		return ErrExtraArgs
+	}
+	if !cmd.Logging {
+		return errors.New("must specify what to validate, for example --logging")
+	}
+	switch cmd.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf(`invalid output format (expected "json" or "text", not %q)`, cmd.Format)
+	}
+
+	opts := client.ValidateLoggingOptions{
+		Services: cmd.Positional.Services,
+	}
+	reports, err := cmd.client.ValidateLogging(&opts)
+	if err != nil {
+		return err
+	}
+
+	warnings := 0
+	for _, report := range reports {
+		warnings += len(report.Warnings)
+	}
+
+	if cmd.Format == "json" {
+		if reports == nil {
+			reports = []*client.LoggingReport{}
+		}
+		encoder := json.NewEncoder(Stdout)
+		encoder.SetIndent("", "    ")
+		if err := encoder.Encode(reports); err != nil {
+			return err
+		}
+	} else {
+		if len(reports) == 0 {
+			fmt.Fprintln(Stderr, "Plan has no services")
+			return nil
+		}
+		for i, report := range reports {
+			if i > 0 {
+				fmt.Fprintln(Stdout)
+			}
+			fmt.Fprintf(Stdout, "%s: %s\n", report.Service, strings.Join(report.Stages, " -> "))
+			for _, warning := range report.Warnings {
+				fmt.Fprintf(Stdout, "  warning: %s\n", warning)
+			}
+			for _, line := range report.Sample {
+				fmt.Fprintf(Stdout, "  sample: %s\n", line)
+			}
+		}
+	}
+
+	if warnings > 0 {
+		return fmt.Errorf("logging configuration has %d problem(s)", warnings)
+	}
+	return nil
+}
+
+func init() {
+	addCommand("validate", shortValidateHelp, longValidateHelp, func() flags.Commander { return &cmdValidate{} }, validateDescs, nil)
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/check.v1"
+
+	pebble "github.com/canonical/pebble/cmd/pebble"
+)
+
+const validateLoggingResponse = `{
+    "type": "sync",
+    "status-code": 200,
+    "result": [
+		{"service": "svc1", "stages": ["format", "buffer"], "sample": ["2021-06-01T12:00:00.000Z [svc1] sample line 1", "2021-06-01T12:00:00.000Z [svc1] sample line 2"]},
+		{"service": "svc2", "stages": ["decode", "format", "buffer"], "warnings": ["log-encoding \"utf-16le\" isn't applied to the lines read from log-files"]}
+	]
+}`
+
+func (s *PebbleSuite) TestValidateLogging(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/validate/logging")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{})
+		fmt.Fprint(w, validateLoggingResponse)
+	})
+	_, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"validate", "--logging"})
+	c.Assert(err, check.ErrorMatches, `logging configuration has 1 problem\(s\)`)
+	c.Check(s.Stdout(), check.Equals, `
+svc1: format -> buffer
+  sample: 2021-06-01T12:00:00.000Z [svc1] sample line 1
+  sample: 2021-06-01T12:00:00.000Z [svc1] sample line 2
+
+svc2: decode -> format -> buffer
+  warning: log-encoding "utf-16le" isn't applied to the lines read from log-files
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestValidateLoggingServices(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, "GET")
+		c.Assert(r.URL.Path, check.Equals, "/v1/validate/logging")
+		c.Assert(r.URL.Query(), check.DeepEquals, url.Values{
+			"services": {"svc1"},
+		})
+		fmt.Fprint(w, `{"type": "sync", "status-code": 200, "result": [
+			{"service": "svc1", "stages": ["format", "buffer"]}
+		]}`)
+	})
+	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"validate", "--logging", "--format", "json", "svc1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(rest, check.HasLen, 0)
+	c.Check(s.Stdout(), check.Equals, `
+[
+    {
+        "service": "svc1",
+        "stages": [
+            "format",
+            "buffer"
+        ]
+    }
+]
+`[1:])
+	c.Check(s.Stderr(), check.Equals, "")
+}
+
+func (s *PebbleSuite) TestValidateNothing(c *check.C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatalf("unexpected request")
+	})
+	_, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"validate"})
+	c.Assert(err, check.ErrorMatches, "must specify what to validate, for example --logging")
+}
+
+func (s *PebbleSuite) TestValidateInvalidFormat(c *check.C) {
+	_, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"validate", "--logging", "--format", "foo"})
+	c.Assert(err, check.ErrorMatches, `invalid output format \(expected "json" or "text", not "foo"\)`)
+}
@@ -52,12 +52,14 @@ again unless it happens again, _and_ a cooldown time has passed.
 Warnings expire automatically, and once expired they are forgotten.
 `
 
-var shortOkayHelp = "Acknowledge warnings"
+var shortOkayHelp = "Acknowledge warnings and notices"
 var longOkayHelp = `
-The okay command acknowledges the warnings listed with 'pebble warnings'.
+The okay command acknowledges the warnings and notices listed with
+'pebble warnings' and 'pebble notices'.
 
 Once acknowledged a warning won't appear again unless it re-occurrs and
-sufficient time has passed.
+sufficient time has passed. An acknowledged notice won't appear again unless
+it re-occurs.
 `
 
 func init() {
@@ -154,7 +156,11 @@ func (cmd *cmdOkay) Execute(args []string) error {
 		return err
 	}
 
-	return cmd.client.Okay(last)
+	err = cmd.client.Okay(last)
+	if err != nil {
+		return err
+	}
+	return cmd.client.AckNotices(last)
 }
 
 const warnFileEnvKey = "PEBBLE_LAST_WARNING_TIMESTAMP_FILENAME"
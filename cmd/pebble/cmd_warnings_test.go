@@ -145,10 +145,14 @@ func (s *warningSuite) TestOkay(c *check.C) {
 	var n int
 	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
 		n++
-		if n != 1 {
-			c.Fatalf("expected 1 request, now on %d", n)
+		switch n {
+		case 1:
+			c.Check(r.URL.Path, check.Equals, "/v1/warnings")
+		case 2:
+			c.Check(r.URL.Path, check.Equals, "/v1/notices")
+		default:
+			c.Fatalf("expected 2 requests, now on %d", n)
 		}
-		c.Check(r.URL.Path, check.Equals, "/v1/warnings")
 		c.Check(r.URL.Query(), check.HasLen, 0)
 		c.Assert(DecodedRequestBody(c, r), check.DeepEquals, map[string]interface{}{"action": "okay", "timestamp": t0.Format(time.RFC3339Nano)})
 		c.Check(r.Method, check.Equals, "POST")
@@ -163,6 +167,7 @@ func (s *warningSuite) TestOkay(c *check.C) {
 	rest, err := pebble.Parser(pebble.Client()).ParseArgs([]string{"okay"})
 	c.Assert(err, check.IsNil)
 	c.Check(rest, check.HasLen, 0)
+	c.Check(n, check.Equals, 2)
 	c.Check(s.Stderr(), check.Equals, "")
 	c.Check(s.Stdout(), check.Equals, "")
 }
@@ -38,6 +38,7 @@ var (
 	NoEscColorTable = noesc
 
 	WriteWarningTimestamp = writeWarningTimestamp
+	LastWarningTimestamp  = lastWarningTimestamp
 	MaybePresentWarnings  = maybePresentWarnings
 
 	GetEnvPaths = getEnvPaths
@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+)
+
+// groupMixin adds a repeatable --group option to select services by the
+// groups they belong to, in addition to any services named explicitly.
+type groupMixin struct {
+	Groups []string `long:"group" value-name:"<group>"`
+}
+
+var groupDescs = map[string]string{
+	"group": "Include the services in this group (may be repeated).",
+}
+
+// requireServices returns an error if no services and no groups were given.
+func (gmx groupMixin) requireServices(names []string) error {
+	if len(names) == 0 && len(gmx.Groups) == 0 {
+		return errors.New("at least one service or --group must be specified")
+	}
+	return nil
+}
@@ -407,11 +407,18 @@ func errorToMessage(e error) (normalMessage string, err error) {
 		} else {
 			msg = fmt.Sprintf(`%s (try with sudo)`, cerr.Message)
 		}
+	case client.ErrorKindAdminRequired:
+		msg = fmt.Sprintf(`%s (ask for "admin" access in the identities configuration, or try with sudo)`, cerr.Message)
 	case client.ErrorKindSystemRestart:
 		isError = false
 		msg = "pebble is about to reboot the system"
 	case client.ErrorKindNoDefaultServices:
 		msg = "no default services"
+	case client.ErrorKindInvalidLayer:
+		// Keep one problem per line rather than filling the list into a
+		// paragraph, indented to line up with the error prefix.
+		indent := "\n" + strings.Repeat(" ", len(errorPrefix))
+		return "", errors.New(strings.Replace(cerr.Message, "\n", indent, -1))
 	default:
 		msg = cerr.Message
 	}
@@ -142,6 +142,19 @@ func (s *PebbleSuite) TestErrorResult(c *C) {
 	c.Assert(err, ErrorMatches, `cannot do something`)
 }
 
+func (s *PebbleSuite) TestErrorAdminRequired(c *C) {
+	s.RedirectClientToTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(403)
+		fmt.Fprintln(w, `{"type": "error", "status-code": 403, "result": {"message": "admin access required", "kind": "admin-required"}}`)
+	})
+
+	restore := fakeArgs("pebble", "signal", "HUP", "srv1")
+	defer restore()
+
+	err := pebble.RunMain()
+	c.Assert(err, ErrorMatches, `admin access required \(ask for "admin" access in the identities\s+configuration, or try with sudo\)`)
+}
+
 func (s *PebbleSuite) TestGetEnvPaths(c *C) {
 	os.Setenv("PEBBLE", "")
 	os.Setenv("PEBBLE_SOCKET", "")
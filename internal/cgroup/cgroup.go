@@ -0,0 +1,384 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package cgroup implements a minimal interface to the unified (v2) cgroup
+// hierarchy, used to apply resource limits to services.
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/pebble/internal/strutil"
+)
+
+const (
+	// DefaultRoot is where the unified cgroup hierarchy is normally mounted.
+	DefaultRoot = "/sys/fs/cgroup"
+
+	// cpuPeriod is the period (in microseconds) written to cpu.max.
+	cpuPeriod = 100000
+)
+
+var (
+	// ErrUnavailable is returned when the cgroup v2 hierarchy is not
+	// mounted at the configured root (for example, on cgroup v1 systems).
+	ErrUnavailable = errors.New("cgroup v2 hierarchy not available")
+
+	// procSelfCgroup lists the cgroups of the current process.
+	procSelfCgroup = "/proc/self/cgroup"
+
+	rmdir = os.Remove
+)
+
+// FakeProcSelfCgroup sets the file listing the current process's cgroups,
+// normally /proc/self/cgroup, for tests.
+func FakeProcSelfCgroup(path string) (restore func()) {
+	old := procSelfCgroup
+	procSelfCgroup = path
+	return func() {
+		procSelfCgroup = old
+	}
+}
+
+// FakeRmdir sets the function used to remove a group's directory, for
+// tests that use an ordinary directory as the hierarchy, whose interface
+// files are not removed along with it as in the cgroup filesystem.
+func FakeRmdir(f func(path string) error) (restore func()) {
+	old := rmdir
+	rmdir = f
+	return func() {
+		rmdir = old
+	}
+}
+
+// Limits holds the resource limits to apply to a cgroup. Zero values mean
+// "no limit".
+type Limits struct {
+	// MemoryMax is the maximum memory usage in bytes (memory.max).
+	MemoryMax int64
+
+	// CPUQuota is the CPU quota as a percentage of a single CPU, so 50 means
+	// half a CPU and 200 means two full CPUs (cpu.max).
+	CPUQuota float64
+}
+
+// Manager creates and removes cgroups under a single pebble-owned subtree of
+// the cgroup hierarchy, nested under pebble's own cgroup: under systemd or
+// in a container, that's the part of the hierarchy delegated to pebble.
+//
+// The subtree is <own>/<name>, and pebble itself is moved into the leaf
+// <own>/<name>/<name> beside the groups created, so name must not be used
+// for a group.
+type Manager struct {
+	root string
+	name string
+}
+
+// NewManager returns a manager for the subtree named name under the current
+// process's cgroup in the hierarchy mounted at root.
+func NewManager(root, name string) *Manager {
+	return &Manager{
+		root: root,
+		name: name,
+	}
+}
+
+// parent returns the directory of the current process's own cgroup, as
+// listed in /proc/self/cgroup, which the subtree is created in: that of
+// the leaf if the process was already moved into it.
+func (m *Manager) parent() (string, error) {
+	data, err := ioutil.ReadFile(procSelfCgroup)
+	if os.IsNotExist(err) {
+		return "", ErrUnavailable
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The entry for the unified hierarchy is "0::<path>".
+		if strings.HasPrefix(line, "0::") {
+			dir := filepath.Join(m.root, line[len("0::"):])
+			leaf := string(filepath.Separator) + filepath.Join(m.name, m.name)
+			return strings.TrimSuffix(dir, leaf), nil
+		}
+	}
+	return "", ErrUnavailable
+}
+
+// Available returns nil if the cgroup v2 hierarchy is mounted at the
+// manager's root and provides the given controllers to the current
+// process's cgroup, otherwise it returns an error describing why not.
+func (m *Manager) Available(controllers ...string) error {
+	parent, err := m.parent()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if os.IsNotExist(err) {
+		return ErrUnavailable
+	}
+	if err != nil {
+		return err
+	}
+	available := strings.Fields(string(data))
+	for _, controller := range controllers {
+		if !strutil.ListContains(available, controller) {
+			return fmt.Errorf("cgroup controller %q not available", controller)
+		}
+	}
+	return nil
+}
+
+// Create creates (or reuses) the cgroup for the named service and applies
+// the given limits to it. The caller should call Remove on the returned
+// group once the service's processes have exited.
+//
+// The controllers are enabled in the current process's cgroup, which the
+// kernel only allows if it's the root of the hierarchy or has no
+// processes of its own, so unless it's the root its processes are first
+// moved into the subtree's leaf: pebble itself, and any services started
+// without limits.
+func (m *Manager) Create(name string, limits Limits) (*Group, error) {
+	controllers := limits.controllers()
+	err := m.Available(controllers...)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := m.parent()
+	if err != nil {
+		return nil, err
+	}
+
+	// Controllers must be enabled in each ancestor's subtree_control for
+	// the interface files to appear in the service's cgroup.
+	dir := filepath.Join(parent, m.name)
+	leaf := filepath.Join(dir, m.name)
+	err = os.MkdirAll(leaf, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = moveProcesses(parent, leaf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot move processes out of %s: %w", parent, err)
+	}
+	err = enableControllers(parent, controllers)
+	if errors.Is(err, syscall.EBUSY) {
+		return nil, fmt.Errorf("cannot enable cgroup controllers in %s, which has processes of its own", parent)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = enableControllers(dir, controllers)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Group{path: filepath.Join(dir, name)}
+	err = os.Mkdir(g.path, 0755)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	err = g.apply(limits)
+	if err != nil {
+		g.Remove()
+		return nil, err
+	}
+	return g, nil
+}
+
+func (l Limits) controllers() []string {
+	var controllers []string
+	if l.CPUQuota > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if l.MemoryMax > 0 {
+		controllers = append(controllers, "memory")
+	}
+	return controllers
+}
+
+// moveProcesses moves the processes in the cgroup at dir into the one at
+// leaf, unless dir is the root of the hierarchy, which may have processes
+// of its own. Only non-root cgroups have a cgroup.type file.
+func moveProcesses(dir, leaf string) error {
+	_, err := os.Stat(filepath.Join(dir, "cgroup.type"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	pids, err := (&Group{path: dir}).Procs()
+	if err != nil {
+		return err
+	}
+	target := &Group{path: leaf}
+	for _, pid := range pids {
+		err := target.AddProcess(pid)
+		// A process that has exited since can't be moved.
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
+
+func enableControllers(dir string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for i, controller := range controllers {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString("+" + controller)
+	}
+	return writeFile(filepath.Join(dir, "cgroup.subtree_control"), b.String())
+}
+
+// Group is a single cgroup created by a Manager.
+type Group struct {
+	path string
+}
+
+// Path returns the group's directory in the cgroup filesystem.
+func (g *Group) Path() string {
+	return g.path
+}
+
+func (g *Group) apply(limits Limits) error {
+	if limits.MemoryMax > 0 {
+		err := writeFile(filepath.Join(g.path, "memory.max"), strconv.FormatInt(limits.MemoryMax, 10))
+		if err != nil {
+			return err
+		}
+	}
+	if limits.CPUQuota > 0 {
+		quota := int64(limits.CPUQuota * cpuPeriod / 100)
+		if quota < 1000 {
+			// The kernel rejects quotas below 1ms.
+			quota = 1000
+		}
+		err := writeFile(filepath.Join(g.path, "cpu.max"), fmt.Sprintf("%d %d", quota, cpuPeriod))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddProcess moves the process with the given PID into the group. Any
+// children it forked before the move stay where they were.
+func (g *Group) AddProcess(pid int) error {
+	return writeFile(filepath.Join(g.path, "cgroup.procs"), strconv.Itoa(pid))
+}
+
+// Open opens the group's directory, to start a process in the group with
+// clone3's CLONE_INTO_CGROUP (as by SysProcAttr.CgroupFD), so that it's
+// covered by the limits from the start. It fails if the directory is not
+// in the cgroup v2 filesystem.
+func (g *Group) Open() (*os.File, error) {
+	dir, err := os.Open(g.path)
+	if err != nil {
+		return nil, err
+	}
+	var fs unix.Statfs_t
+	err = unix.Fstatfs(int(dir.Fd()), &fs)
+	if err == nil && fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		err = ErrUnavailable
+	}
+	if err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return dir, nil
+}
+
+// Kill kills the processes in the group, using cgroup.kill where the
+// kernel provides it, or else by sending each of them SIGKILL.
+func (g *Group) Kill() error {
+	killFile := filepath.Join(g.path, "cgroup.kill")
+	if _, err := os.Stat(killFile); err == nil {
+		return writeFile(killFile, "1")
+	}
+	pids, err := g.Procs()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		err := syscall.Kill(pid, syscall.SIGKILL)
+		if err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemoryCurrent returns the group's current memory usage in bytes, as
+// reported by memory.current.
+func (g *Group) MemoryCurrent() (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(g.path, "memory.current"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Procs returns the PIDs of the processes in the group, as listed in
+// cgroup.procs.
+func (g *Group) Procs() ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(g.path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PID %q in cgroup.procs", field)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// Remove removes the group. This fails with EBUSY if the group still has
+// processes.
+func (g *Group) Remove() error {
+	err := rmdir(g.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func writeFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(content)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cgroup_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/cgroup"
+	"github.com/canonical/pebble/internal/testutil"
+)
+
+// Hook up check.v1 into the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type cgroupSuite struct {
+	root     string
+	self     string
+	restores []func()
+}
+
+var _ = Suite(&cgroupSuite{})
+
+func (s *cgroupSuite) SetUpTest(c *C) {
+	s.root = c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(s.root, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), 0644)
+	c.Assert(err, IsNil)
+	s.self = filepath.Join(c.MkDir(), "cgroup")
+	s.fakeSelf(c, "0::/\n")
+	s.restores = []func(){
+		cgroup.FakeProcSelfCgroup(s.self),
+		// The interface files are ordinary files here, so they need
+		// removing along with the group.
+		cgroup.FakeRmdir(os.RemoveAll),
+	}
+}
+
+func (s *cgroupSuite) TearDownTest(c *C) {
+	for _, restore := range s.restores {
+		restore()
+	}
+}
+
+func (s *cgroupSuite) fakeSelf(c *C, content string) {
+	err := ioutil.WriteFile(s.self, []byte(content), 0644)
+	c.Assert(err, IsNil)
+}
+
+func (s *cgroupSuite) TestAvailable(c *C) {
+	m := cgroup.NewManager(s.root, "pebble")
+	c.Assert(m.Available(), IsNil)
+	c.Assert(m.Available("cpu", "memory"), IsNil)
+	c.Assert(m.Available("hugetlb"), ErrorMatches, `cgroup controller "hugetlb" not available`)
+
+	m = cgroup.NewManager(c.MkDir(), "pebble")
+	c.Assert(m.Available(), Equals, cgroup.ErrUnavailable)
+
+	// Only the unified hierarchy is used.
+	s.fakeSelf(c, "12:memory:/\n1:name=systemd:/\n")
+	m = cgroup.NewManager(s.root, "pebble")
+	c.Assert(m.Available(), Equals, cgroup.ErrUnavailable)
+}
+
+func (s *cgroupSuite) TestCreateNested(c *C) {
+	// The subtree is created under the process's own cgroup, whose
+	// controllers are the ones available.
+	own := filepath.Join(s.root, "system.slice", "pebble.service")
+	err := os.MkdirAll(own, 0755)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(own, "cgroup.controllers"), []byte("memory pids\n"), 0644)
+	c.Assert(err, IsNil)
+	s.fakeSelf(c, "1:name=systemd:/system.slice/pebble.service\n0::/system.slice/pebble.service\n")
+
+	m := cgroup.NewManager(s.root, "pebble")
+	_, err = m.Create("svc1", cgroup.Limits{CPUQuota: 50})
+	c.Assert(err, ErrorMatches, `cgroup controller "cpu" not available`)
+	g, err := m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, IsNil)
+	c.Assert(g.Path(), Equals, filepath.Join(own, "pebble", "svc1"))
+
+	c.Assert(filepath.Join(s.root, "cgroup.subtree_control"), testutil.FileAbsent)
+	c.Assert(filepath.Join(own, "cgroup.subtree_control"), testutil.FileEquals, "+memory")
+	c.Assert(filepath.Join(own, "pebble", "cgroup.subtree_control"), testutil.FileEquals, "+memory")
+}
+
+func (s *cgroupSuite) TestCreateMovesProcesses(c *C) {
+	// The kernel refuses to enable controllers in a (non-root) cgroup
+	// with processes, so pebble's are first moved into a leaf beside
+	// the services' groups.
+	own := filepath.Join(s.root, "system.slice", "pebble.service")
+	err := os.MkdirAll(own, 0755)
+	c.Assert(err, IsNil)
+	for name, content := range map[string]string{
+		"cgroup.controllers": "cpu memory pids\n",
+		"cgroup.type":        "domain\n",
+		"cgroup.procs":       "1234\n",
+	} {
+		err = ioutil.WriteFile(filepath.Join(own, name), []byte(content), 0644)
+		c.Assert(err, IsNil)
+	}
+	s.fakeSelf(c, "0::/system.slice/pebble.service\n")
+
+	m := cgroup.NewManager(s.root, "pebble")
+	g, err := m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, IsNil)
+	c.Assert(g.Path(), Equals, filepath.Join(own, "pebble", "svc1"))
+	c.Assert(filepath.Join(own, "pebble", "pebble", "cgroup.procs"), testutil.FileEquals, "1234")
+	c.Assert(filepath.Join(own, "cgroup.subtree_control"), testutil.FileEquals, "+memory")
+	c.Assert(filepath.Join(own, "pebble", "cgroup.subtree_control"), testutil.FileEquals, "+memory")
+
+	// Once moved, the process's cgroup is the leaf, and the groups are
+	// still created beside it.
+	s.fakeSelf(c, "0::/system.slice/pebble.service/pebble/pebble\n")
+	err = ioutil.WriteFile(filepath.Join(own, "cgroup.procs"), nil, 0644)
+	c.Assert(err, IsNil)
+	g, err = m.Create("svc2", cgroup.Limits{CPUQuota: 50})
+	c.Assert(err, IsNil)
+	c.Assert(g.Path(), Equals, filepath.Join(own, "pebble", "svc2"))
+	c.Assert(m.Available("cpu"), IsNil)
+}
+
+func (s *cgroupSuite) TestCreateRootKeepsProcesses(c *C) {
+	// The root of the hierarchy, which has no cgroup.type, may have
+	// processes of its own.
+	err := ioutil.WriteFile(filepath.Join(s.root, "cgroup.procs"), []byte("1\n1234\n"), 0644)
+	c.Assert(err, IsNil)
+	m := cgroup.NewManager(s.root, "pebble")
+	_, err = m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Join(s.root, "pebble", "pebble", "cgroup.procs"), testutil.FileAbsent)
+}
+
+func (s *cgroupSuite) TestCreate(c *C) {
+	m := cgroup.NewManager(s.root, "pebble")
+	g, err := m.Create("svc1", cgroup.Limits{MemoryMax: 64 * 1000 * 1000, CPUQuota: 50})
+	c.Assert(err, IsNil)
+	c.Assert(g.Path(), Equals, filepath.Join(s.root, "pebble", "svc1"))
+
+	c.Assert(filepath.Join(s.root, "cgroup.subtree_control"), testutil.FileEquals, "+cpu +memory")
+	c.Assert(filepath.Join(s.root, "pebble", "cgroup.subtree_control"), testutil.FileEquals, "+cpu +memory")
+	c.Assert(filepath.Join(g.Path(), "memory.max"), testutil.FileEquals, "64000000")
+	c.Assert(filepath.Join(g.Path(), "cpu.max"), testutil.FileEquals, "50000 100000")
+}
+
+func (s *cgroupSuite) TestCreateSingleLimit(c *C) {
+	m := cgroup.NewManager(s.root, "pebble")
+	g, err := m.Create("svc1", cgroup.Limits{CPUQuota: 250})
+	c.Assert(err, IsNil)
+
+	c.Assert(filepath.Join(s.root, "pebble", "cgroup.subtree_control"), testutil.FileEquals, "+cpu")
+	c.Assert(filepath.Join(g.Path(), "cpu.max"), testutil.FileEquals, "250000 100000")
+	c.Assert(filepath.Join(g.Path(), "memory.max"), testutil.FileAbsent)
+}
+
+func (s *cgroupSuite) TestCreateMinimumQuota(c *C) {
+	m := cgroup.NewManager(s.root, "pebble")
+	g, err := m.Create("svc1", cgroup.Limits{CPUQuota: 0.1})
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Join(g.Path(), "cpu.max"), testutil.FileEquals, "1000 100000")
+}
+
+func (s *cgroupSuite) TestCreateUnavailable(c *C) {
+	m := cgroup.NewManager(c.MkDir(), "pebble")
+	_, err := m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, Equals, cgroup.ErrUnavailable)
+
+	err = ioutil.WriteFile(filepath.Join(s.root, "cgroup.controllers"), []byte("cpu\n"), 0644)
+	c.Assert(err, IsNil)
+	m = cgroup.NewManager(s.root, "pebble")
+	_, err = m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, ErrorMatches, `cgroup controller "memory" not available`)
+	c.Assert(filepath.Join(s.root, "pebble"), testutil.FileAbsent)
+}
+
+func (s *cgroupSuite) TestAddProcessAndMemoryCurrent(c *C) {
+	m := cgroup.NewManager(s.root, "pebble")
+	g, err := m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, IsNil)
+
+	err = g.AddProcess(1234)
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Join(g.Path(), "cgroup.procs"), testutil.FileEquals, "1234")
+
+	_, err = g.MemoryCurrent()
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	err = ioutil.WriteFile(filepath.Join(g.Path(), "memory.current"), []byte("4096\n"), 0644)
+	c.Assert(err, IsNil)
+	current, err := g.MemoryCurrent()
+	c.Assert(err, IsNil)
+	c.Assert(current, Equals, int64(4096))
+}
+
+func (s *cgroupSuite) TestProcs(c *C) {
+	m := cgroup.NewManager(s.root, "pebble")
+	g, err := m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, IsNil)
+
+	_, err = g.Procs()
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	err = ioutil.WriteFile(filepath.Join(g.Path(), "cgroup.procs"), []byte("1234\n1240\n"), 0644)
+	c.Assert(err, IsNil)
+	pids, err := g.Procs()
+	c.Assert(err, IsNil)
+	c.Assert(pids, DeepEquals, []int{1234, 1240})
+
+	err = ioutil.WriteFile(filepath.Join(g.Path(), "cgroup.procs"), []byte("1234\nfoo\n"), 0644)
+	c.Assert(err, IsNil)
+	_, err = g.Procs()
+	c.Assert(err, ErrorMatches, `invalid PID "foo" in cgroup.procs`)
+}
+
+func (s *cgroupSuite) TestOpen(c *C) {
+	m := cgroup.NewManager(s.root, "pebble")
+	g, err := m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, IsNil)
+
+	// Processes can only be started in a group in the cgroup filesystem.
+	_, err = g.Open()
+	c.Assert(err, Equals, cgroup.ErrUnavailable)
+}
+
+func (s *cgroupSuite) TestKill(c *C) {
+	m := cgroup.NewManager(s.root, "pebble")
+	g, err := m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, IsNil)
+
+	cmd := exec.Command("sleep", "10")
+	err = cmd.Start()
+	c.Assert(err, IsNil)
+	defer cmd.Process.Kill()
+	err = g.AddProcess(cmd.Process.Pid)
+	c.Assert(err, IsNil)
+
+	// Without cgroup.kill, each process is sent SIGKILL.
+	c.Assert(g.Kill(), IsNil)
+	err = cmd.Wait()
+	c.Assert(err, ErrorMatches, "signal: killed")
+
+	err = ioutil.WriteFile(filepath.Join(g.Path(), "cgroup.kill"), nil, 0644)
+	c.Assert(err, IsNil)
+	c.Assert(g.Kill(), IsNil)
+	c.Assert(filepath.Join(g.Path(), "cgroup.kill"), testutil.FileEquals, "1")
+}
+
+func (s *cgroupSuite) TestRemove(c *C) {
+	m := cgroup.NewManager(s.root, "pebble")
+	g, err := m.Create("svc1", cgroup.Limits{MemoryMax: 1000})
+	c.Assert(err, IsNil)
+
+	c.Assert(g.Remove(), IsNil)
+	c.Assert(g.Path(), testutil.FileAbsent)
+	c.Assert(g.Remove(), IsNil)
+}
+
+// TestRealCgroup exercises the real cgroup hierarchy, so it must be run as
+// root on a cgroup v2 system with PEBBLE_TEST_CGROUPS=1.
+func (s *cgroupSuite) TestRealCgroup(c *C) {
+	if os.Getenv("PEBBLE_TEST_CGROUPS") != "1" {
+		c.Skip("set PEBBLE_TEST_CGROUPS=1 to run tests against the real cgroup hierarchy")
+	}
+	if os.Getuid() != 0 {
+		c.Skip("cgroup tests must be run as root")
+	}
+
+	for _, restore := range s.restores {
+		restore()
+	}
+	s.restores = nil
+
+	m := cgroup.NewManager(cgroup.DefaultRoot, "pebble-test")
+	if err := m.Available("cpu", "memory"); err != nil {
+		c.Skip(err.Error())
+	}
+	g, err := m.Create("svc1", cgroup.Limits{MemoryMax: 64 * 1024 * 1024, CPUQuota: 50})
+	c.Assert(err, IsNil)
+	defer os.Remove(filepath.Dir(g.Path()))
+	defer g.Remove()
+
+	dir, err := g.Open()
+	c.Assert(err, IsNil)
+	dir.Close()
+
+	cmd := exec.Command("sleep", "10")
+	err = cmd.Start()
+	c.Assert(err, IsNil)
+	defer cmd.Process.Kill()
+
+	err = g.AddProcess(cmd.Process.Pid)
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Join(g.Path(), "cgroup.procs"), testutil.FileContains, strconv.Itoa(cmd.Process.Pid))
+	c.Assert(filepath.Join(g.Path(), "memory.max"), testutil.FileEquals, "67108864\n")
+	c.Assert(filepath.Join(g.Path(), "cpu.max"), testutil.FileEquals, "50000 100000\n")
+
+	current, err := g.MemoryCurrent()
+	c.Assert(err, IsNil)
+	c.Assert(current > 0, Equals, true)
+
+	c.Assert(g.Remove(), ErrorMatches, ".* device or resource busy") // still has a process
+
+	c.Assert(g.Kill(), IsNil)
+	cmd.Wait()
+	c.Assert(g.Remove(), IsNil)
+}
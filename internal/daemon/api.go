@@ -57,6 +57,10 @@ var api = []*Command{{
 	UserOK: true,
 	GET:    v1GetService,
 	POST:   v1PostService,
+}, {
+	Path:   "/v1/checks",
+	UserOK: true,
+	GET:    v1GetChecks,
 }, {
 	Path:   "/v1/plan",
 	UserOK: true,
@@ -86,6 +90,27 @@ var api = []*Command{{
 	Path:   "/v1/signals",
 	UserOK: true,
 	POST:   v1PostSignals,
+}, {
+	Path:   "/v1/notices",
+	UserOK: true,
+	GET:    v1GetNotices,
+	POST:   v1AckNotices,
+}, {
+	Path:   "/v1/timers",
+	UserOK: true,
+	GET:    v1GetTimers,
+}, {
+	Path:   "/v1/metrics",
+	UserOK: true,
+	GET:    v1GetMetrics,
+}, {
+	Path:   "/v1/validate/logging",
+	UserOK: true,
+	GET:    v1GetValidateLogging,
+}, {
+	Path:      "/v1/debug/profile",
+	AdminOnly: true,
+	GET:       v1GetDebugProfile,
 }}
 
 var (
@@ -95,6 +120,7 @@ var (
 	stateEnsureBefore    = (*state.State).EnsureBefore
 
 	overlordServiceManager = (*overlord.Overlord).ServiceManager
+	overlordCheckManager   = (*overlord.Overlord).CheckManager
 
 	muxVars = mux.Vars
 )
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/canonical/pebble/internal/overlord/checkstate"
+	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/strutil"
+)
+
+type checkInfo struct {
+	Name      string     `json:"name"`
+	Level     string     `json:"level,omitempty"`
+	Status    string     `json:"status"`
+	Failures  int        `json:"failures,omitempty"`
+	LastError string     `json:"last-error,omitempty"`
+	LastRun   *time.Time `json:"last-run,omitempty"`
+}
+
+func v1GetChecks(c *Command, r *http.Request, _ *userState) Response {
+	query := r.URL.Query()
+	level := plan.CheckLevel(query.Get("level"))
+	switch level {
+	case plan.UnsetLevel, plan.AliveLevel, plan.ReadyLevel:
+	default:
+		return statusBadRequest(`level must be "alive" or "ready"`)
+	}
+	names := strutil.CommaSeparatedList(query.Get("names"))
+
+	servmgr := overlordServiceManager(c.d.overlord)
+	p, err := servmgr.Plan()
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+
+	if service := query.Get("service"); service != "" {
+		config, ok := p.Services[service]
+		if !ok {
+			return statusNotFound("cannot find service %q", service)
+		}
+		serviceNames := serviceCheckNames(config)
+		if len(serviceNames) == 0 {
+			return SyncResponse([]checkInfo{})
+		}
+		if len(names) > 0 {
+			var filtered []string
+			for _, name := range names {
+				if strutil.ListContains(serviceNames, name) {
+					filtered = append(filtered, name)
+				}
+			}
+			if len(filtered) == 0 {
+				return SyncResponse([]checkInfo{})
+			}
+			serviceNames = filtered
+		}
+		names = serviceNames
+	}
+
+	checkmgr := overlordCheckManager(c.d.overlord)
+	checks, err := checkmgr.Checks(level, names)
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+
+	infos := make([]checkInfo, 0, len(checks))
+	for _, check := range checks {
+		info := checkInfo{
+			Name:      check.Name,
+			Level:     string(check.Level),
+			Status:    "up",
+			Failures:  check.Failures,
+			LastError: check.LastError,
+		}
+		if !check.Healthy {
+			info.Status = "down"
+		}
+		if !check.LastRun.IsZero() {
+			lastRun := check.LastRun
+			info.LastRun = &lastRun
+		}
+		infos = append(infos, info)
+	}
+	return SyncResponse(infos)
+}
+
+// serviceCheckNames returns the names of the checks associated with the
+// given service (those listed in its on-check-failure section), sorted.
+func serviceCheckNames(config *plan.Service) []string {
+	names := make([]string, 0, len(config.OnCheckFailure))
+	for name := range config.OnCheckFailure {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// failingChecks returns the names of the given service's checks that are
+// currently failing (over their failure threshold).
+func failingChecks(config *plan.Service, checks []*checkstate.CheckInfo) []string {
+	var failing []string
+	for _, check := range checks {
+		if check.Healthy {
+			continue
+		}
+		if _, ok := config.OnCheckFailure[check.Name]; ok {
+			failing = append(failing, check.Name)
+		}
+	}
+	return failing
+}
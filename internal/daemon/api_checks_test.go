@@ -0,0 +1,164 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var checksLayer = `
+services:
+    svc1:
+        override: replace
+        command: sleep 300
+        on-check-failure:
+            chk1: ignore
+            chk2: ignore
+
+    svc2:
+        override: replace
+        command: sleep 300
+        on-check-failure:
+            chk3: ignore
+
+checks:
+    chk1:
+        override: replace
+        level: alive
+        period: 10ms
+        threshold: 1
+        exec:
+            command: /bin/false
+
+    chk2:
+        override: replace
+        level: ready
+        period: 10ms
+        exec:
+            command: /bin/true
+
+    chk3:
+        override: replace
+        period: 10ms
+        exec:
+            command: /bin/true
+`
+
+func (s *apiSuite) getChecks(c *C, query string) (int, []map[string]interface{}) {
+	req, err := http.NewRequest("GET", "/v1/checks?"+query, nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetChecks(apiCmd("/v1/checks"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		return rec.Code, nil
+	}
+
+	var body struct {
+		Result []map[string]interface{} `json:"result"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Assert(err, IsNil)
+	return rec.Code, body.Result
+}
+
+// waitChecksRun waits until all the checks have run at least once, and
+// chk1 is down.
+func (s *apiSuite) waitChecksRun(c *C) []map[string]interface{} {
+	for i := 0; i < 200; i++ {
+		_, checks := s.getChecks(c, "")
+		allRun := len(checks) > 0
+		for _, check := range checks {
+			allRun = allRun && check["last-run"] != nil
+		}
+		if allRun && checks[0]["status"] == "down" {
+			return checks
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for checks to run")
+	return nil
+}
+
+func (s *apiSuite) TestChecksGet(c *C) {
+	writeTestLayer(s.pebbleDir, checksLayer)
+	s.daemon(c)
+
+	checks := s.waitChecksRun(c)
+	c.Assert(checks, HasLen, 3)
+	for _, check := range checks {
+		delete(check, "last-run")
+	}
+	c.Check(checks, DeepEquals, []map[string]interface{}{
+		{"name": "chk1", "level": "alive", "status": "down", "failures": checks[0]["failures"], "last-error": "exit status 1"},
+		{"name": "chk2", "level": "ready", "status": "up"},
+		{"name": "chk3", "status": "up"},
+	})
+	c.Check(checks[0]["failures"].(float64) >= 1, Equals, true)
+}
+
+func (s *apiSuite) TestChecksFilters(c *C) {
+	writeTestLayer(s.pebbleDir, checksLayer)
+	s.daemon(c)
+
+	checkNames := func(query string) []string {
+		code, checks := s.getChecks(c, query)
+		c.Assert(code, Equals, 200)
+		names := []string{}
+		for _, check := range checks {
+			names = append(names, check["name"].(string))
+		}
+		return names
+	}
+	c.Check(checkNames("level=alive"), DeepEquals, []string{"chk1"})
+	c.Check(checkNames("level=ready"), DeepEquals, []string{"chk2"})
+	c.Check(checkNames("names=chk3,chk1"), DeepEquals, []string{"chk1", "chk3"})
+	c.Check(checkNames("service=svc1"), DeepEquals, []string{"chk1", "chk2"})
+	c.Check(checkNames("service=svc2"), DeepEquals, []string{"chk3"})
+	c.Check(checkNames("service=svc1&level=ready"), DeepEquals, []string{"chk2"})
+	c.Check(checkNames("service=svc1&names=chk2,chk3"), DeepEquals, []string{"chk2"})
+	c.Check(checkNames("service=svc2&names=chk1"), DeepEquals, []string{})
+
+	code, _ := s.getChecks(c, "level=foo")
+	c.Check(code, Equals, 400)
+	code, _ = s.getChecks(c, "service=nosvc")
+	c.Check(code, Equals, 404)
+}
+
+func (s *apiSuite) TestServicesFailingChecks(c *C) {
+	writeTestLayer(s.pebbleDir, checksLayer)
+	s.daemon(c)
+	s.waitChecksRun(c)
+
+	req, err := http.NewRequest("GET", "/v1/services", nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetServices(apiCmd("/v1/services"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, 200)
+
+	var body map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Assert(err, IsNil)
+	c.Check(body["result"], DeepEquals, []interface{}{
+		map[string]interface{}{"name": "svc1", "startup": "disabled", "current": "inactive", "failing-checks": []interface{}{"chk1"}},
+		map[string]interface{}{"name": "svc2", "startup": "disabled", "current": "inactive"},
+	})
+}
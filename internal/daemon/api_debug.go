@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"bytes"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+const (
+	debugProfileDefaultSeconds = 10
+	debugProfileMaxSeconds     = 60
+)
+
+// v1GetDebugProfile captures a CPU profile of the daemon for the number of
+// seconds given (10 by default), and returns it in the pprof format. Samples
+// from the goroutines handling a service's logs are labelled with the
+// service's name and the stage of its log pipeline.
+func v1GetDebugProfile(c *Command, r *http.Request, _ *userState) Response {
+	seconds := float64(debugProfileDefaultSeconds)
+	if s := r.URL.Query().Get("seconds"); s != "" {
+		var err error
+		seconds, err = strconv.ParseFloat(s, 64)
+		if err != nil || seconds <= 0 || seconds > debugProfileMaxSeconds {
+			return statusBadRequest("seconds must be a number greater than 0 and at most %d, not %q", debugProfileMaxSeconds, s)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := pprof.StartCPUProfile(&buf)
+	if err != nil {
+		return statusInternalError("cannot start CPU profile: %v", err)
+	}
+	timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		timer.Stop()
+	}
+	pprof.StopCPUProfile()
+	return profileResponse(buf.Bytes())
+}
+
+// profileResponse is a Response implementation to serve a profile in the
+// pprof format rather than the usual JSON.
+type profileResponse []byte
+
+func (r profileResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(r)
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *apiSuite) TestDebugProfile(c *C) {
+	cmd := apiCmd("/v1/debug/profile")
+	c.Check(cmd.AdminOnly, Equals, true)
+
+	req, err := http.NewRequest("GET", "/v1/debug/profile?seconds=0.1", nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetDebugProfile(cmd, req, nil)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, 200)
+	c.Check(rec.Header().Get("Content-Type"), Equals, "application/octet-stream")
+	// Profiles are gzipped protocol buffers.
+	c.Check(bytes.HasPrefix(rec.Body.Bytes(), []byte{0x1f, 0x8b}), Equals, true)
+}
+
+func (s *apiSuite) TestDebugProfileInvalidSeconds(c *C) {
+	for _, seconds := range []string{"foo", "0", "-1", "61"} {
+		req, err := http.NewRequest("GET", "/v1/debug/profile?seconds="+seconds, nil)
+		c.Assert(err, IsNil)
+		rsp := v1GetDebugProfile(apiCmd("/v1/debug/profile"), req, nil).(*resp)
+		c.Check(rsp.Status, Equals, 400, Commentf("seconds=%s", seconds))
+		c.Check(rsp.Result.(*errorResult).Message, Matches, `seconds must be a number greater than 0 and at most 60, not ".*"`)
+	}
+}
+
+func (s *apiSuite) TestDebugProfileInProgress(c *C) {
+	var buf bytes.Buffer
+	err := pprof.StartCPUProfile(&buf)
+	c.Assert(err, IsNil)
+	defer pprof.StopCPUProfile()
+
+	req, err := http.NewRequest("GET", "/v1/debug/profile?seconds=0.1", nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetDebugProfile(apiCmd("/v1/debug/profile"), req, nil).(*resp)
+	c.Check(rsp.Status, Equals, 500)
+	c.Check(rsp.Result.(*errorResult).Message, Matches, "cannot start CPU profile: .*")
+}
@@ -30,7 +30,6 @@ import (
 	. "gopkg.in/check.v1"
 
 	"github.com/canonical/pebble/client"
-	"github.com/canonical/pebble/internal/logger"
 )
 
 var _ = Suite(&execSuite{})
@@ -40,10 +39,6 @@ type execSuite struct {
 	client *client.Client
 }
 
-func (s *execSuite) SetUpSuite(c *C) {
-	logger.SetLogger(logger.New(os.Stderr, "[test] "))
-}
-
 func (s *execSuite) SetUpTest(c *C) {
 	socketPath := c.MkDir() + ".pebble.socket"
 	daemon, err := New(&Options{
@@ -35,14 +35,27 @@ const (
 	logReaderSize  = 4 * 1024
 )
 
+// logsSchemaVersion is the version of the format of the logs API's JSON
+// objects (jsonLog and jsonLogsMeta), sent in the X-Pebble-Logs-Schema
+// header and in the metadata object. Clients may rely on the fields of the
+// versions they know, so it must be bumped whenever a field is removed,
+// renamed, or changes type or meaning, and when a field is added, so that
+// clients can tell which fields to expect.
+const logsSchemaVersion = 2
+
+// logsSchemaHeader is the header giving the logs schema version.
+const logsSchemaHeader = "X-Pebble-Logs-Schema"
+
 type serviceManager interface {
 	Services(names []string) ([]*servstate.ServiceInfo, error)
 	ServiceLogs(services []string, last int) (map[string]servicelog.Iterator, error)
+	GroupServices(groups []string) ([]string, error)
 }
 
 func v1GetLogs(c *Command, _ *http.Request, _ *userState) Response {
 	return logsResponse{
 		svcMgr: overlordServiceManager(c.d.overlord),
+		dying:  c.d.Dying(),
 	}
 }
 
@@ -50,12 +63,25 @@ func v1GetLogs(c *Command, _ *http.Request, _ *userState) Response {
 // JSON Lines format.
 type logsResponse struct {
 	svcMgr serviceManager
+
+	// dying is closed when the daemon is shutting down, so that follow
+	// requests finish instead of holding up the server's shutdown.
+	dying <-chan struct{}
 }
 
 func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	query := req.URL.Query()
 
 	services := query["services"]
+	if groups := query["groups"]; len(groups) > 0 {
+		groupServices, err := r.svcMgr.GroupServices(groups)
+		if err != nil {
+			response := statusBadRequest("%v", err)
+			response.ServeHTTP(w, req)
+			return
+		}
+		services = appendUnique(services, groupServices...)
+	}
 
 	followStr := query.Get("follow")
 	if followStr != "" && followStr != "true" && followStr != "false" {
@@ -65,6 +91,20 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	follow := followStr == "true"
 
+	metaStr := query.Get("meta")
+	if metaStr != "" && metaStr != "true" && metaStr != "false" {
+		response := statusBadRequest(`meta parameter must be "true" or "false"`)
+		response.ServeHTTP(w, req)
+		return
+	}
+
+	origin := query.Get("origin")
+	if origin != "" && origin != originService && origin != originPebble {
+		response := statusBadRequest(`origin parameter must be "service" or "pebble"`)
+		response.ServeHTTP(w, req)
+		return
+	}
+
 	var numLogs int
 	nStr := query.Get("n")
 	if nStr != "" {
@@ -95,7 +135,13 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	itsByName, err := r.svcMgr.ServiceLogs(services, numLogs)
+	// When filtering by origin, it's not known how many lines to read for
+	// the last numLogs that match, so read all of them.
+	last := numLogs
+	if origin != "" && numLogs > 0 {
+		last = -1
+	}
+	itsByName, err := r.svcMgr.ServiceLogs(services, last)
 	if err != nil {
 		response := statusInternalError("cannot fetch log iterators: %v", err)
 		response.ServeHTTP(w, req)
@@ -106,14 +152,40 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// but "application/x-ndjson" is what most people seem to use:
 	// https://github.com/wardi/jsonlines/issues/9
 	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(logsSchemaHeader, strconv.Itoa(logsSchemaVersion))
 	encoder := json.NewEncoder(w)
 	encoder.SetEscapeHTML(false)
 
+	// The metadata object, if asked for, comes before any logs, and is
+	// sent straight away when following.
+	if metaStr == "true" {
+		meta := &jsonLogsMeta{
+			Schema:     logsSchemaVersion,
+			ServerTime: time.Now().UTC(),
+			Services:   append([]string(nil), services...),
+			Filters: jsonLogsFilters{
+				N:      numLogs,
+				Follow: follow,
+				Origin: origin,
+				Groups: query["groups"],
+			},
+		}
+		sort.Strings(meta.Services)
+		err := encoder.Encode(map[string]*jsonLogsMeta{"meta": meta})
+		if err != nil {
+			logger.Noticef("error writing logs: %v", err)
+			return
+		}
+		if follow {
+			flushWriter(w)
+		}
+	}
+
 	// Use a buffered channel as a FIFO for keeping the latest numLogs logs if
 	// request "n" is set (the default).
-	var fifo chan servicelog.Entry
+	var fifo chan logEntry
 	if numLogs > 0 {
-		fifo = make(chan servicelog.Entry, numLogs)
+		fifo = make(chan logEntry, numLogs)
 	}
 	flushFifo := func() bool { // helper to flush any logs in the FIFO
 		if numLogs <= 0 || len(fifo) == 0 {
@@ -134,7 +206,7 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Background goroutine to stream ordered logs: it sends parsed logs on
 	// logs channel, any error on errorChan channel, and stops when the request
 	// is cancelled or this handler returns.
-	logs := make(chan servicelog.Entry)
+	logs := make(chan logEntry)
 	errorChan := make(chan error, 1)
 	ctx, cancel := context.WithCancel(req.Context())
 	defer cancel()
@@ -162,6 +234,10 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 
+			if origin != "" && log.origin != origin {
+				continue
+			}
+
 			// Logs are coming faster than we can send them (probably a slow
 			// client), so stop now.
 			if !follow && log.Time.After(requestStarted) {
@@ -197,14 +273,38 @@ func (r logsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 		case <-req.Context().Done():
 			return
+
+		case <-r.dying:
+			_ = flushFifo()
+			return
 		}
 	}
 }
 
+// Origins of logs: a service's own output, or lines pebble wrote to its
+// logs, such as those marking where it started and exited.
+const (
+	originService = "service"
+	originPebble  = "pebble"
+)
+
+// logEntry is a parsed log and its origin.
+type logEntry struct {
+	servicelog.Entry
+	origin string
+}
+
 // streamLogs reads and parses logs from the given services, merging the
 // log streams and ordering by timestamp. It sends the parsed logs to the
 // logs channel, and returns when the done channel is closed.
-func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog.Entry, done <-chan struct{}) error {
+//
+// Lines pebble wrote to a service's logs are sent with the service's name
+// and the "pebble" origin. Writers never wait for a slow reader: if a
+// service's ring buffer laps its iterator, the skipped output is lost. Any
+// gap in the sequence numbers of a service's logs, as from that, is
+// reported with a "pebble" log giving the entries missed, sent before the
+// service's next log.
+func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- logEntry, done <-chan struct{}) error {
 	// Need to close iterators in same goroutine we're reading them from.
 	defer func() {
 		for _, it := range itsByName {
@@ -235,8 +335,19 @@ func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog
 		parsers[i] = servicelog.NewParser(iterators[i], logReaderSize)
 	}
 
-	// Slice of next entries for each service
-	nexts := make([]servicelog.Entry, len(services))
+	// Slice of next entries for each service, with any notice of missed
+	// entries to send before each, and the sequence number of the last.
+	nexts := make([]logEntry, len(services))
+	notices := make([]logEntry, len(services))
+	lastSeqs := make([]int64, len(services))
+	parsed := func(i int) logEntry {
+		entry := parsers[i].Entry()
+		if entry.Service == servicelog.PebbleName {
+			entry.Service = services[i]
+			return logEntry{entry, originPebble}
+		}
+		return logEntry{entry, originService}
+	}
 
 	// Main loop: output earliest log per iteration. Stop when done is closed.
 	for {
@@ -246,15 +357,33 @@ func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog
 				continue
 			}
 			if parser.Next() {
-				nexts[i] = parser.Entry()
+				nexts[i] = parsed(i)
 			} else if parser.Err() != nil {
 				return fmt.Errorf("error parsing logs: %w", parser.Err())
 			} else if iterators[i].Next(nil) {
 				// Parsed all in parser buffer, but iterator now has more.
 				if parser.Next() {
-					nexts[i] = parser.Entry()
+					nexts[i] = parsed(i)
 				}
 			}
+			if nexts[i].Time.IsZero() {
+				continue
+			}
+			seq := nexts[i].Seq
+			if seq == 0 {
+				continue
+			}
+			if last := lastSeqs[i]; last > 0 && seq > last+1 {
+				notices[i] = logEntry{
+					Entry: servicelog.Entry{
+						Time:    nexts[i].Time,
+						Service: services[i],
+						Message: missedNotice(last+1, seq-1),
+					},
+					origin: originPebble,
+				}
+			}
+			lastSeqs[i] = seq
 		}
 
 		// Find the log with the next earliest timestamp.
@@ -272,7 +401,7 @@ func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog
 		// or done signal.
 		if earliest < 0 {
 			select {
-			case logs <- servicelog.Entry{}:
+			case logs <- logEntry{}:
 			case <-done:
 				return nil
 			}
@@ -284,7 +413,15 @@ func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog
 			continue
 		}
 
-		// Send log to caller.
+		// Send any notice of missed output first, then the log itself.
+		if !notices[earliest].Time.IsZero() {
+			select {
+			case logs <- notices[earliest]:
+			case <-done:
+				return nil
+			}
+			notices[earliest].Time = time.Time{}
+		}
 		select {
 		case logs <- nexts[earliest]:
 		case <-done:
@@ -294,23 +431,64 @@ func streamLogs(itsByName map[string]servicelog.Iterator, logs chan<- servicelog
 	}
 }
 
+// missedNotice returns the message of the notice that the entries from
+// first to last were missed.
+func missedNotice(first, last int64) string {
+	if first == last {
+		return fmt.Sprintf("(... missed entry %d ...)", first)
+	}
+	return fmt.Sprintf("(... missed entries %d-%d ...)", first, last)
+}
+
 // Each log is written as a JSON object followed by a newline (JSON Lines):
 //
-// {"time":"2021-04-23T01:28:52.660Z","service":"redis","message":"redis started up"}
-// {"time":"2021-04-23T01:28:52.798Z","service":"thing","message":"did something"}
+// {"time":"2021-04-23T01:28:52.660Z","service":"redis","message":"redis started up","seq":1}
+// {"time":"2021-04-23T01:28:52.798Z","service":"thing","message":"did something","seq":40}
+// {"time":"2021-04-23T01:28:53.001Z","service":"thing","message":"--- service \"thing\" exited with code 0 after 1.2s ---","origin":"pebble","seq":41}
+//
+// The seq field is the sequence number of the log in its service's log
+// buffer (see servicelog.Entry). The numbers go on across restarts of the
+// service: they only start again with a new buffer, for a service started
+// after being removed from the plan, whose first log is numbered 1. Notices
+// of missed logs have no seq field.
 type jsonLog struct {
 	Time    time.Time `json:"time"`
 	Service string    `json:"service"`
 	Message string    `json:"message"`
+	Origin  string    `json:"origin,omitempty"` // only set for lines written by pebble
+	Seq     int64     `json:"seq,omitempty"`
+}
+
+// The metadata object sent first when asked for with meta=true is wrapped
+// in a "meta" object, so it can't be mistaken for a log:
+//
+// {"meta":{"schema":2,"server-time":"2021-04-23T01:28:54.123Z","services":["redis","thing"],"filters":{"n":30,"follow":false}}}
+type jsonLogsMeta struct {
+	Schema     int             `json:"schema"`
+	ServerTime time.Time       `json:"server-time"`
+	Services   []string        `json:"services"`
+	Filters    jsonLogsFilters `json:"filters"`
 }
 
-func newJSONLog(entry servicelog.Entry) *jsonLog {
+type jsonLogsFilters struct {
+	N      int      `json:"n"`
+	Follow bool     `json:"follow"`
+	Origin string   `json:"origin,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+func newJSONLog(entry logEntry) *jsonLog {
 	message := strings.TrimSuffix(entry.Message, "\n")
-	return &jsonLog{
+	log := &jsonLog{
 		Time:    entry.Time,
 		Service: entry.Service,
 		Message: message,
+		Seq:     entry.Seq,
+	}
+	if entry.origin == originPebble {
+		log.Origin = originPebble
 	}
+	return log
 }
 
 func flushWriter(w io.Writer) {
@@ -23,6 +23,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"sort"
 	"strings"
 	"time"
@@ -37,14 +38,27 @@ var _ = Suite(&logsSuite{})
 
 type logsSuite struct{}
 
+// newFormatWriter returns servicelog.NewFormatWriter(dest, serviceName),
+// which can't fail without options.
+func newFormatWriter(dest io.Writer, serviceName string) io.Writer {
+	w, err := servicelog.NewFormatWriter(dest, serviceName)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
 type testLogEntry struct {
 	Time    time.Time
 	Service string
 	Message string
+	Origin  string
+	Seq     int64
 }
 
 type testServiceManager struct {
 	buffers        map[string]*servicelog.RingBuffer
+	groups         map[string][]string
 	servicesErr    error
 	serviceLogsErr error
 }
@@ -86,6 +100,18 @@ func (m testServiceManager) ServiceLogs(services []string, last int) (map[string
 	return its, nil
 }
 
+func (m testServiceManager) GroupServices(groups []string) ([]string, error) {
+	var services []string
+	for _, group := range groups {
+		names, ok := m.groups[group]
+		if !ok {
+			return nil, fmt.Errorf("group %q does not exist", group)
+		}
+		services = append(services, names...)
+	}
+	return services, nil
+}
+
 func (s *logsSuite) TestInvalidFollow(c *C) {
 	rec := s.recordResponse(c, "/v1/logs?follow=invalid", nil)
 	c.Assert(rec.Code, Equals, http.StatusBadRequest)
@@ -102,6 +128,18 @@ func (s *logsSuite) TestInvalidN(c *C) {
 	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `n must be -1, 0, or a positive integer`)
 }
 
+func (s *logsSuite) TestInvalidOrigin(c *C) {
+	rec := s.recordResponse(c, "/v1/logs?origin=invalid", nil)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `origin parameter must be "service" or "pebble"`)
+}
+
+func (s *logsSuite) TestInvalidMeta(c *C) {
+	rec := s.recordResponse(c, "/v1/logs?meta=invalid", nil)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `meta parameter must be "true" or "false"`)
+}
+
 func (s *logsSuite) TestServicesError(c *C) {
 	svcMgr := testServiceManager{
 		servicesErr: fmt.Errorf("Services error!"),
@@ -122,7 +160,7 @@ func (s *logsSuite) TestServiceLogsError(c *C) {
 
 func (s *logsSuite) TestOneServiceDefaults(c *C) {
 	rb := servicelog.NewRingBuffer(4096)
-	lw := servicelog.NewFormatWriter(rb, "nginx")
+	lw := newFormatWriter(rb, "nginx")
 	for i := 0; i < 32; i++ {
 		fmt.Fprintf(lw, "message %d\n", i)
 	}
@@ -146,9 +184,48 @@ func (s *logsSuite) TestOneServiceDefaults(c *C) {
 	c.Check(logs[29].Message, Equals, "truncated")
 }
 
+func (s *logsSuite) TestOrigin(c *C) {
+	rb := servicelog.NewRingBuffer(4096)
+	lw := newFormatWriter(rb, "nginx")
+	c.Assert(servicelog.WriteEvent(rb, `--- service "nginx" started ---`), IsNil)
+	fmt.Fprintf(lw, "message 0\n")
+	c.Assert(servicelog.WriteEvent(rb, `--- service "nginx" exited ---`), IsNil)
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{
+			"nginx": rb,
+		},
+	}
+
+	// Lines written by pebble are given the service's name, and marked
+	// with their origin.
+	rec := s.recordResponse(c, "/v1/logs", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs := decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 3)
+	checkLog(c, logs[0], "nginx", `--- service "nginx" started ---`)
+	c.Check(logs[0].Origin, Equals, "pebble")
+	checkLog(c, logs[1], "nginx", "message 0")
+	c.Check(logs[1].Origin, Equals, "")
+	checkLog(c, logs[2], "nginx", `--- service "nginx" exited ---`)
+	c.Check(logs[2].Origin, Equals, "pebble")
+
+	rec = s.recordResponse(c, "/v1/logs?origin=service", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs = decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "nginx", "message 0")
+
+	// The last n lines are those that match.
+	rec = s.recordResponse(c, "/v1/logs?origin=service&n=1", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs = decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "nginx", "message 0")
+}
+
 func (s *logsSuite) TestOneServiceWithN(c *C) {
 	rb := servicelog.NewRingBuffer(4096)
-	lw := servicelog.NewFormatWriter(rb, "nginx")
+	lw := newFormatWriter(rb, "nginx")
 	for i := 0; i < 20; i++ {
 		fmt.Fprintf(lw, "message %d\n", i)
 	}
@@ -171,7 +248,7 @@ func (s *logsSuite) TestOneServiceWithN(c *C) {
 func (s *logsSuite) TestOneServiceAllLogs(c *C) {
 	exampleLog := "2021-05-20T16:55:00.000Z [nginx] message 00\n"
 	rb := servicelog.NewRingBuffer(len(exampleLog) * 20)
-	lw := servicelog.NewFormatWriter(rb, "nginx")
+	lw := newFormatWriter(rb, "nginx")
 	for i := 0; i < 40; i++ {
 		fmt.Fprintf(lw, "message %02d\n", i)
 	}
@@ -193,7 +270,7 @@ func (s *logsSuite) TestOneServiceAllLogs(c *C) {
 
 func (s *logsSuite) TestOneServiceOutOfTwo(c *C) {
 	rb := servicelog.NewRingBuffer(4096)
-	lw := servicelog.NewFormatWriter(rb, "nginx")
+	lw := newFormatWriter(rb, "nginx")
 	for i := 0; i < 20; i++ {
 		fmt.Fprintf(lw, "message %d\n", i)
 	}
@@ -214,6 +291,36 @@ func (s *logsSuite) TestOneServiceOutOfTwo(c *C) {
 	}
 }
 
+func (s *logsSuite) TestGroups(c *C) {
+	rb := servicelog.NewRingBuffer(4096)
+	lw := newFormatWriter(rb, "nginx")
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(lw, "message %d\n", i)
+	}
+
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{
+			"nginx":  rb,
+			"unused": nil,
+		},
+		groups: map[string][]string{
+			"web": {"nginx"},
+		},
+	}
+	rec := s.recordResponse(c, "/v1/logs?n=3&groups=web", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	logs := decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 3)
+	for i := 0; i < 3; i++ {
+		checkLog(c, logs[i], "nginx", fmt.Sprintf("message %d", i+17))
+	}
+
+	rec = s.recordResponse(c, "/v1/logs?groups=db", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	checkError(c, rec.Body.Bytes(), http.StatusBadRequest, `group "db" does not exist`)
+}
+
 func (s *logsSuite) TestNoLogs(c *C) {
 	svcMgr := testServiceManager{
 		buffers: map[string]*servicelog.RingBuffer{
@@ -232,8 +339,8 @@ func (s *logsSuite) TestNoLogs(c *C) {
 func (s *logsSuite) TestMultipleServicesAll(c *C) {
 	rb1 := servicelog.NewRingBuffer(4096)
 	rb2 := servicelog.NewRingBuffer(4096)
-	lw1 := servicelog.NewFormatWriter(rb1, "one")
-	lw2 := servicelog.NewFormatWriter(rb2, "two")
+	lw1 := newFormatWriter(rb1, "one")
+	lw2 := newFormatWriter(rb2, "two")
 	for i := 0; i < 10; i++ {
 		fmt.Fprintf(lw1, "message1 %d\n", i)
 		time.Sleep(time.Millisecond)
@@ -261,8 +368,8 @@ func (s *logsSuite) TestMultipleServicesAll(c *C) {
 func (s *logsSuite) TestMultipleServicesN(c *C) {
 	rb1 := servicelog.NewRingBuffer(4096)
 	rb2 := servicelog.NewRingBuffer(4096)
-	lw1 := servicelog.NewFormatWriter(rb1, "one")
-	lw2 := servicelog.NewFormatWriter(rb2, "two")
+	lw1 := newFormatWriter(rb1, "one")
+	lw2 := newFormatWriter(rb2, "two")
 	for i := 0; i < 30; i++ {
 		fmt.Fprintf(lw1, "message1 %d\n", i)
 		time.Sleep(time.Millisecond)
@@ -290,8 +397,8 @@ func (s *logsSuite) TestMultipleServicesN(c *C) {
 func (s *logsSuite) TestMultipleServicesNFewLogs(c *C) {
 	rb1 := servicelog.NewRingBuffer(4096)
 	rb2 := servicelog.NewRingBuffer(4096)
-	lw1 := servicelog.NewFormatWriter(rb1, "one")
-	lw2 := servicelog.NewFormatWriter(rb2, "two")
+	lw1 := newFormatWriter(rb1, "one")
+	lw2 := newFormatWriter(rb2, "two")
 	fmt.Fprintf(lw1, "message1 1\n")
 	time.Sleep(time.Millisecond)
 	fmt.Fprintf(lw2, "message2 1\n")
@@ -314,7 +421,7 @@ func (s *logsSuite) TestMultipleServicesNFewLogs(c *C) {
 
 func (s *logsSuite) TestLoggingTooFast(c *C) {
 	rb := servicelog.NewRingBuffer(1024)
-	lw := servicelog.NewFormatWriter(rb, "svc")
+	lw := newFormatWriter(rb, "svc")
 
 	// We should only receive these first three logs
 	for i := 0; i < 3; i++ {
@@ -380,8 +487,8 @@ func (r *responseRecorder) WriteHeader(status int) {
 func (s *logsSuite) TestMultipleServicesFollow(c *C) {
 	rb1 := servicelog.NewRingBuffer(4096)
 	rb2 := servicelog.NewRingBuffer(4096)
-	lw1 := servicelog.NewFormatWriter(rb1, "one")
-	lw2 := servicelog.NewFormatWriter(rb2, "two")
+	lw1 := newFormatWriter(rb1, "one")
+	lw2 := newFormatWriter(rb2, "two")
 	fmt.Fprintf(lw1, "message1 1\n")
 	time.Sleep(time.Millisecond)
 	fmt.Fprintf(lw2, "message2 1\n")
@@ -456,6 +563,350 @@ func (s *logsSuite) TestMultipleServicesFollow(c *C) {
 	c.Assert(rec.status, Equals, http.StatusOK)
 }
 
+func (s *logsSuite) TestFollowSlowClient(c *C) {
+	rb := servicelog.NewRingBuffer(256)
+	lw := newFormatWriter(rb, "svc")
+	fmt.Fprintf(lw, "message 0\n")
+
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{"svc": rb},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "/v1/logs?follow=true&n=1", nil)
+	c.Assert(err, IsNil)
+	rsp := logsResponse{svcMgr: svcMgr}
+
+	// Flush blocks until the test receives from logChan, simulating a slow
+	// client.
+	logChan := make(chan string)
+	rec := &followRecorder{logChan: logChan}
+	done := make(chan struct{})
+	go func() {
+		rsp.ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	waitLogs := func() []testLogEntry {
+		select {
+		case logsStr := <-logChan:
+			return decodeLogs(c, strings.NewReader(logsStr))
+		case <-time.After(time.Second):
+			c.Fatalf("timed out waiting for log")
+			return nil
+		}
+	}
+
+	logs := waitLogs()
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "svc", "message 0")
+
+	// The next log's flush blocks the client, and writing many times the
+	// buffer's size meanwhile must not block on it.
+	written := make(chan struct{})
+	go func() {
+		for i := 1; i <= 50; i++ {
+			fmt.Fprintf(lw, "message %d\n", i)
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for writes to the service's logs")
+	}
+
+	// The client catches up, told which logs it missed: exactly those it
+	// didn't receive. "message N" is log N+1, and after the buffer laps the
+	// client, the first log may be the end of one whose start was lost.
+	received := map[int64]bool{1: true}
+	missed := map[int64]bool{}
+	for {
+		logs := waitLogs()
+		for _, log := range logs {
+			if log.Origin == "pebble" {
+				c.Check(log.Service, Equals, "svc")
+				c.Check(log.Seq, Equals, int64(0))
+				var first, last int64
+				if _, err := fmt.Sscanf(log.Message, "(... missed entries %d-%d ...)", &first, &last); err != nil {
+					_, err := fmt.Sscanf(log.Message, "(... missed entry %d ...)", &first)
+					c.Assert(err, IsNil, Commentf("%q", log.Message))
+					last = first
+				}
+				for seq := first; seq <= last; seq++ {
+					missed[seq] = true
+				}
+				continue
+			}
+			if log.Seq == 0 {
+				// The truncation text.
+				continue
+			}
+			c.Check(strings.HasSuffix(fmt.Sprintf("message %d", log.Seq-1), log.Message), Equals, true,
+				Commentf("log %d: %q", log.Seq, log.Message))
+			received[log.Seq] = true
+		}
+		if len(logs) > 0 && logs[len(logs)-1].Message == "message 50" {
+			break
+		}
+	}
+	c.Assert(missed, Not(HasLen), 0)
+	for seq := int64(1); seq <= 51; seq++ {
+		c.Check(received[seq] != missed[seq], Equals, true, Commentf("log %d", seq))
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for request to be finished")
+	}
+}
+
+func (s *logsSuite) TestFollowDying(c *C) {
+	rb := servicelog.NewRingBuffer(4096)
+	lw := newFormatWriter(rb, "svc")
+	fmt.Fprintf(lw, "message 1\n")
+
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{"svc": rb},
+	}
+	dying := make(chan struct{})
+	server := httptest.NewServer(logsResponse{svcMgr: svcMgr, dying: dying})
+	defer server.Close()
+
+	rsp, err := http.Get(server.URL + "/v1/logs?follow=true&n=1")
+	c.Assert(err, IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, Equals, http.StatusOK)
+	reader := bufio.NewReader(rsp.Body)
+	log, ok := decodeLog(c, reader)
+	c.Assert(ok, Equals, true)
+	checkLog(c, log, "svc", "message 1")
+
+	fmt.Fprintf(lw, "message 2\n")
+	log, ok = decodeLog(c, reader)
+	c.Assert(ok, Equals, true)
+	checkLog(c, log, "svc", "message 2")
+
+	// Shutting down the daemon ends the response.
+	close(dying)
+	ended := make(chan bool)
+	go func() {
+		_, ok := decodeLog(c, reader)
+		ended <- !ok
+	}()
+	select {
+	case ok := <-ended:
+		c.Check(ok, Equals, true)
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for response to end")
+	}
+}
+
+func (s *logsSuite) TestSchemaHeader(c *C) {
+	rb := servicelog.NewRingBuffer(4096)
+	fmt.Fprintf(newFormatWriter(rb, "nginx"), "message\n")
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{"nginx": rb},
+	}
+
+	rec := s.recordResponse(c, "/v1/logs", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("X-Pebble-Logs-Schema"), Equals, "2")
+	logs := decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "nginx", "message")
+
+	// Following, the header is sent with the first logs.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "/v1/logs?follow=true&n=1", nil)
+	c.Assert(err, IsNil)
+	logChan := make(chan string)
+	followRec := &followRecorder{logChan: logChan}
+	done := make(chan struct{})
+	go func() {
+		logsResponse{svcMgr: svcMgr}.ServeHTTP(followRec, req)
+		close(done)
+	}()
+	select {
+	case logsStr := <-logChan:
+		logs := decodeLogs(c, strings.NewReader(logsStr))
+		c.Assert(logs, HasLen, 1)
+		checkLog(c, logs[0], "nginx", "message")
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for log")
+	}
+	c.Check(followRec.Header().Get("X-Pebble-Logs-Schema"), Equals, "2")
+	cancel()
+	<-done
+}
+
+type testLogsMeta struct {
+	Schema     int
+	ServerTime time.Time `json:"server-time"`
+	Services   []string
+	Filters    map[string]interface{}
+}
+
+// decodeMeta decodes the metadata object from the first line read from
+// reader.
+func decodeMeta(c *C, reader *bufio.Reader) testLogsMeta {
+	line, err := reader.ReadSlice('\n')
+	c.Assert(err, IsNil)
+	var wrapper struct {
+		Meta *testLogsMeta
+	}
+	err = json.Unmarshal(line, &wrapper)
+	c.Assert(err, IsNil)
+	c.Assert(wrapper.Meta, NotNil, Commentf("expected metadata object, got %q", line))
+	return *wrapper.Meta
+}
+
+func (s *logsSuite) TestMeta(c *C) {
+	rb1 := servicelog.NewRingBuffer(4096)
+	rb2 := servicelog.NewRingBuffer(4096)
+	rb3 := servicelog.NewRingBuffer(4096)
+	fmt.Fprintf(newFormatWriter(rb1, "one"), "message 1\n")
+	err := servicelog.WriteEvent(rb2, `--- service "two" started (pid 42, generation 1) ---`)
+	c.Assert(err, IsNil)
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{
+			"one":   rb1,
+			"two":   rb2,
+			"three": rb3,
+		},
+		groups: map[string][]string{"web": {"two"}},
+	}
+
+	before := time.Now().UTC()
+	rec := s.recordResponse(c, "/v1/logs?meta=true&services=one&groups=web&origin=pebble&n=10", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Header().Get("X-Pebble-Logs-Schema"), Equals, "2")
+	reader := bufio.NewReader(rec.Body)
+	meta := decodeMeta(c, reader)
+	c.Check(meta.Schema, Equals, 2)
+	c.Check(meta.ServerTime.Before(before), Equals, false)
+	c.Check(meta.ServerTime.After(time.Now()), Equals, false)
+	c.Check(meta.Services, DeepEquals, []string{"one", "two"})
+	c.Check(meta.Filters, DeepEquals, map[string]interface{}{
+		"n":      10.0,
+		"follow": false,
+		"origin": "pebble",
+		"groups": []interface{}{"web"},
+	})
+	logs := decodeLogs(c, reader)
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "two", `--- service "two" started (pid 42, generation 1) ---`)
+
+	// Without any logs, there's just the metadata object.
+	rec = s.recordResponse(c, "/v1/logs?meta=true&services=three", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	reader = bufio.NewReader(rec.Body)
+	meta = decodeMeta(c, reader)
+	c.Check(meta.Services, DeepEquals, []string{"three"})
+	c.Check(meta.Filters, DeepEquals, map[string]interface{}{
+		"n":      30.0,
+		"follow": false,
+	})
+	c.Check(decodeLogs(c, reader), HasLen, 0)
+
+	// Without meta=true, there's no metadata object.
+	rec = s.recordResponse(c, "/v1/logs?meta=false&services=one", svcMgr)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	logs = decodeLogs(c, rec.Body)
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "one", "message 1")
+}
+
+func (s *logsSuite) TestMetaFollow(c *C) {
+	rb := servicelog.NewRingBuffer(4096)
+	lw := newFormatWriter(rb, "nginx")
+	svcMgr := testServiceManager{
+		buffers: map[string]*servicelog.RingBuffer{"nginx": rb},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "/v1/logs?follow=true&meta=true", nil)
+	c.Assert(err, IsNil)
+	logChan := make(chan string)
+	rec := &followRecorder{logChan: logChan}
+	done := make(chan struct{})
+	go func() {
+		logsResponse{svcMgr: svcMgr}.ServeHTTP(rec, req)
+		close(done)
+	}()
+	wait := func() string {
+		select {
+		case logsStr := <-logChan:
+			return logsStr
+		case <-time.After(time.Second):
+			c.Fatalf("timed out waiting for response")
+			return ""
+		}
+	}
+
+	// The metadata object is sent before there are any logs.
+	meta := decodeMeta(c, bufio.NewReader(strings.NewReader(wait())))
+	c.Check(meta.Schema, Equals, 2)
+	c.Check(meta.Services, DeepEquals, []string{"nginx"})
+	c.Check(meta.Filters, DeepEquals, map[string]interface{}{
+		"n":      0.0,
+		"follow": true,
+	})
+	c.Check(rec.Header().Get("X-Pebble-Logs-Schema"), Equals, "2")
+
+	time.Sleep(10 * time.Millisecond) // ensure we'll be using the notification channel
+	fmt.Fprintf(lw, "message\n")
+	logs := decodeLogs(c, strings.NewReader(wait()))
+	c.Assert(logs, HasLen, 1)
+	checkLog(c, logs[0], "nginx", "message")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for request to be finished")
+	}
+}
+
+// logsSchemaFields are the JSON fields of the logs API's objects in each
+// version of the schema. A change to the fields must come with a new
+// version of the schema (see logsSchemaVersion), and a new entry here.
+var logsSchemaFields = map[int]map[string][]string{
+	1: {
+		"log":     {"time", "service", "message", "origin"},
+		"meta":    {"schema", "server-time", "services", "filters"},
+		"filters": {"n", "follow", "origin", "groups"},
+	},
+	2: {
+		"log":     {"time", "service", "message", "origin", "seq"},
+		"meta":    {"schema", "server-time", "services", "filters"},
+		"filters": {"n", "follow", "origin", "groups"},
+	},
+}
+
+func jsonFields(v interface{}) []string {
+	var fields []string
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+func (s *logsSuite) TestSchemaFields(c *C) {
+	fields, ok := logsSchemaFields[logsSchemaVersion]
+	c.Assert(ok, Equals, true, Commentf("no fields recorded for logs schema version %d", logsSchemaVersion))
+	comment := Commentf("logs API fields changed: bump logsSchemaVersion and record the new fields in logsSchemaFields")
+	c.Check(jsonFields(jsonLog{}), DeepEquals, fields["log"], comment)
+	c.Check(jsonFields(jsonLogsMeta{}), DeepEquals, fields["meta"], comment)
+	c.Check(jsonFields(jsonLogsFilters{}), DeepEquals, fields["filters"], comment)
+}
+
 type followRecorder struct {
 	logChan chan string
 	header  http.Header
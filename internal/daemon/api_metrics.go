@@ -0,0 +1,230 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/pebble/internal/overlord/servstate"
+	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+// Metrics are exposed in the Prometheus text exposition format (version
+// 0.0.4). All metric names are prefixed with "pebble_", and follow the
+// Prometheus conventions: counters end in "_total", and durations and sizes
+// use base units (seconds and bytes).
+//
+// The following metrics are exposed:
+//
+//	pebble_build_info{version}               always 1
+//	pebble_service_state{service,state}      1 for the service's current state, 0 for others
+//	pebble_service_state_seconds{service}    seconds since the service last changed state
+//	pebble_service_restarts_total{service}   automatic restarts since the service was started
+//	pebble_service_log_bytes_total{service}  bytes written to the service's log buffer
+//	pebble_service_log_dropped_bytes_total{service}
+//	                                         log bytes dropped for lack of log memory
+//	pebble_service_log_panics_total{service} panics recovered from the service's log pipeline
+//	pebble_service_log_latency_seconds{service,stage}
+//	                                         histogram of the latency of log lines from
+//	                                         the service to each pipeline stage (only
+//	                                         with pebble run --trace-log-latency)
+//	pebble_log_memory_bytes                  memory used by all services' log buffers
+//	pebble_log_memory_limit_bytes            limit on log buffer memory (0 if unlimited)
+//	pebble_log_reserve_bytes                 size of the burst reserve (0 if none)
+//	pebble_log_reserve_lent_bytes            memory currently lent from the burst reserve
+//	pebble_log_reserve_loans                 log buffers currently borrowing from the reserve
+//	pebble_log_reserve_borrows_total         loans granted from the burst reserve
+//	pebble_log_reserve_denied_total          loans refused for lack of reserve or log memory
+//	pebble_log_reserve_returned_bytes_total  memory returned to the reserve as loans ended
+//	pebble_log_reserve_reclaimed_bytes_total memory reclaimed from log buffers for other borrowers
+//	pebble_check_up{check,level}             1 if the check is up, 0 if it's down
+//	pebble_check_failures{check,level}       number of consecutive failures of the check
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var metricsServiceStates = []servstate.ServiceStatus{
+	servstate.StatusActive,
+	servstate.StatusBackoff,
+	servstate.StatusError,
+	servstate.StatusInactive,
+}
+
+func v1GetMetrics(c *Command, r *http.Request, _ *userState) Response {
+	servmgr := overlordServiceManager(c.d.overlord)
+	services, err := servmgr.Services(nil)
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+	checkmgr := overlordCheckManager(c.d.overlord)
+	checks, err := checkmgr.Checks(plan.UnsetLevel, nil)
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+
+	w := &metricsWriter{}
+	now := time.Now()
+
+	w.header("pebble_build_info", "gauge", "Pebble build information.")
+	w.sample("pebble_build_info", 1, "version", c.d.Version)
+
+	w.header("pebble_service_state", "gauge", "Current state of the service (1 for the current state).")
+	for _, svc := range services {
+		for _, state := range metricsServiceStates {
+			value := 0
+			if svc.Current == state {
+				value = 1
+			}
+			w.sample("pebble_service_state", value, "service", svc.Name, "state", string(state))
+		}
+	}
+
+	w.header("pebble_service_state_seconds", "gauge", "Seconds since the service last changed state.")
+	for _, svc := range services {
+		if svc.CurrentSince.IsZero() {
+			continue
+		}
+		w.sample("pebble_service_state_seconds", now.Sub(svc.CurrentSince).Seconds(), "service", svc.Name)
+	}
+
+	w.header("pebble_service_restarts_total", "counter", "Number of automatic restarts of the service.")
+	for _, svc := range services {
+		w.sample("pebble_service_restarts_total", svc.Restarts, "service", svc.Name)
+	}
+
+	w.header("pebble_service_log_bytes_total", "counter", "Bytes written to the service's log buffer.")
+	for _, svc := range services {
+		w.sample("pebble_service_log_bytes_total", svc.LogBytes, "service", svc.Name)
+	}
+
+	w.header("pebble_service_log_dropped_bytes_total", "counter", "Log bytes dropped because the log memory limit was reached.")
+	for _, svc := range services {
+		w.sample("pebble_service_log_dropped_bytes_total", svc.LogDroppedBytes, "service", svc.Name)
+	}
+
+	w.header("pebble_service_log_panics_total", "counter", "Panics recovered from the service's log pipeline.")
+	for _, svc := range services {
+		w.sample("pebble_service_log_panics_total", svc.LogPanics, "service", svc.Name)
+	}
+
+	w.header("pebble_service_log_latency_seconds", "histogram", "Latency of the service's log lines from arrival to each pipeline stage.")
+	for _, svc := range services {
+		stages := make([]string, 0, len(svc.LogLatency))
+		for stage := range svc.LogLatency {
+			stages = append(stages, stage)
+		}
+		sort.Strings(stages)
+		for _, stage := range stages {
+			w.histogram("pebble_service_log_latency_seconds", svc.LogLatency[stage], "service", svc.Name, "stage", stage)
+		}
+	}
+
+	logMemory := servmgr.LogMemoryStats()
+	w.header("pebble_log_memory_bytes", "gauge", "Memory used by the log buffers of all services.")
+	w.sample("pebble_log_memory_bytes", logMemory.Used)
+	w.header("pebble_log_memory_limit_bytes", "gauge", "Limit on the memory used by log buffers (0 if unlimited).")
+	w.sample("pebble_log_memory_limit_bytes", logMemory.Limit)
+
+	logReserve := servmgr.LogReserveStats()
+	w.header("pebble_log_reserve_bytes", "gauge", "Size of the reserve log buffers borrow from during bursts (0 if none).")
+	w.sample("pebble_log_reserve_bytes", logReserve.Limit)
+	w.header("pebble_log_reserve_lent_bytes", "gauge", "Memory currently lent to log buffers from the burst reserve.")
+	w.sample("pebble_log_reserve_lent_bytes", logReserve.Lent)
+	w.header("pebble_log_reserve_loans", "gauge", "Number of log buffers currently borrowing from the burst reserve.")
+	w.sample("pebble_log_reserve_loans", logReserve.Loans)
+	w.header("pebble_log_reserve_borrows_total", "counter", "Number of loans granted from the burst reserve.")
+	w.sample("pebble_log_reserve_borrows_total", logReserve.Borrows)
+	w.header("pebble_log_reserve_denied_total", "counter", "Number of loans refused because the burst reserve or log memory had run out.")
+	w.sample("pebble_log_reserve_denied_total", logReserve.Denied)
+	w.header("pebble_log_reserve_returned_bytes_total", "counter", "Memory log buffers returned to the burst reserve as their loans expired or they were freed.")
+	w.sample("pebble_log_reserve_returned_bytes_total", logReserve.Returned)
+	w.header("pebble_log_reserve_reclaimed_bytes_total", "counter", "Memory reclaimed from log buffers for others that needed to borrow.")
+	w.sample("pebble_log_reserve_reclaimed_bytes_total", logReserve.Reclaimed)
+
+	w.header("pebble_check_up", "gauge", "Whether the health check is up (1) or down (0).")
+	for _, check := range checks {
+		value := 0
+		if check.Healthy {
+			value = 1
+		}
+		w.sample("pebble_check_up", value, "check", check.Name, "level", string(check.Level))
+	}
+
+	w.header("pebble_check_failures", "gauge", "Number of consecutive failures of the health check.")
+	for _, check := range checks {
+		w.sample("pebble_check_failures", check.Failures, "check", check.Name, "level", string(check.Level))
+	}
+
+	return metricsResponse(w.buf.Bytes())
+}
+
+// metricsWriter accumulates metrics in the Prometheus text format.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *metricsWriter) header(name, metricType, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(&w.buf, "# TYPE %s %s\n", name, metricType)
+}
+
+// sample writes a single sample; labels are given as name, value pairs.
+func (w *metricsWriter) sample(name string, value interface{}, labels ...string) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&w.buf, `%s="%s"`, labels[i], metricsLabelEscaper.Replace(labels[i+1]))
+		}
+		w.buf.WriteByte('}')
+	}
+	fmt.Fprintf(&w.buf, " %v\n", value)
+}
+
+// histogram writes the samples of a latency histogram: a cumulative count
+// for each bucket, then the sum (in seconds) and the count.
+func (w *metricsWriter) histogram(name string, h servicelog.LatencyHistogram, labels ...string) {
+	var cumulative uint64
+	for i, count := range h.Buckets {
+		cumulative += count
+		le := "+Inf"
+		if i < len(servicelog.LatencyBuckets) {
+			le = strconv.FormatFloat(servicelog.LatencyBuckets[i].Seconds(), 'g', -1, 64)
+		}
+		w.sample(name+"_bucket", cumulative, append(labels, "le", le)...)
+	}
+	w.sample(name+"_sum", h.Sum.Seconds(), labels...)
+	w.sample(name+"_count", h.Count, labels...)
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsResponse is a Response implementation to serve metrics in the
+// Prometheus text format rather than the usual JSON.
+type metricsResponse []byte
+
+func (r metricsResponse) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(r)
+}
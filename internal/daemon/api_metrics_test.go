@@ -0,0 +1,243 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/overlord/servstate"
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+// scrapeMetrics fetches the metrics and parses them into a map of series
+// (name plus labels, as written) to value.
+func (s *apiSuite) scrapeMetrics(c *C) map[string]float64 {
+	req, err := http.NewRequest("GET", "/v1/metrics", nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetMetrics(apiCmd("/v1/metrics"), req, nil)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, 200)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "text/plain; version=0.0.4; charset=utf-8")
+
+	metrics := make(map[string]float64)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		c.Assert(i, Not(Equals), -1, Commentf("invalid line %q", line))
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		c.Assert(err, IsNil, Commentf("invalid line %q", line))
+		metrics[line[:i]] = value
+	}
+	return metrics
+}
+
+func (s *apiSuite) TestMetrics(c *C) {
+	writeTestLayer(s.pebbleDir, `
+services:
+    test1:
+        override: replace
+        command: /bin/sh -c "echo hello; exec sleep 10"
+        backoff-delay: 50ms
+    test2:
+        override: replace
+        command: sleep 10
+
+checks:
+    chk1:
+        override: replace
+        level: alive
+        period: 1h
+        exec:
+            command: /bin/true
+`)
+	d := s.daemon(c)
+	d.Version = "v1.2.3"
+	d.overlord.Loop()
+
+	metrics := s.scrapeMetrics(c)
+	c.Check(metrics[`pebble_build_info{version="v1.2.3"}`], Equals, 1.0)
+	c.Check(metrics[`pebble_service_state{service="test1",state="inactive"}`], Equals, 1.0)
+	c.Check(metrics[`pebble_service_state{service="test1",state="active"}`], Equals, 0.0)
+	c.Check(metrics[`pebble_service_restarts_total{service="test1"}`], Equals, 0.0)
+	c.Check(metrics[`pebble_check_up{check="chk1",level="alive"}`], Equals, 1.0)
+	c.Check(metrics[`pebble_check_failures{check="chk1",level="alive"}`], Equals, 0.0)
+	_, ok := metrics[`pebble_service_state_seconds{service="test1"}`]
+	c.Check(ok, Equals, false)
+
+	// Start test service
+	payload := bytes.NewBufferString(`{"action": "start", "services": ["test1"]}`)
+	req, err := http.NewRequest("POST", "/v1/services", payload)
+	c.Assert(err, IsNil)
+	rsp := v1PostServices(apiCmd("/v1/services"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Check(rec.Result().StatusCode, Equals, 202)
+
+	// Wait for the start change to finish, so the service is fully running.
+	st := d.overlord.State()
+	st.Lock()
+	chg := st.Change(rsp.Change)
+	st.Unlock()
+	select {
+	case <-chg.Ready():
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for service to start")
+	}
+
+	serviceMgr := d.overlord.ServiceManager()
+	waitService := func(f func(svc *servstate.ServiceInfo) bool) {
+		for i := 0; ; i++ {
+			if i > 200 {
+				c.Fatalf("timed out waiting for service")
+			}
+			services, err := serviceMgr.Services([]string{"test1"})
+			c.Assert(err, IsNil)
+			if len(services) == 1 && f(services[0]) {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitService(func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive && svc.LogBytes > 0
+	})
+
+	metrics = s.scrapeMetrics(c)
+	c.Check(metrics[`pebble_service_state{service="test1",state="active"}`], Equals, 1.0)
+	c.Check(metrics[`pebble_service_state{service="test1",state="inactive"}`], Equals, 0.0)
+	c.Check(metrics[`pebble_service_state{service="test2",state="inactive"}`], Equals, 1.0)
+	c.Check(metrics[`pebble_service_state_seconds{service="test1"}`] >= 0, Equals, true)
+	c.Check(metrics[`pebble_service_log_bytes_total{service="test1"}`] > 0, Equals, true)
+	c.Check(metrics[`pebble_service_log_bytes_total{service="test2"}`], Equals, 0.0)
+	c.Check(metrics[`pebble_service_log_dropped_bytes_total{service="test1"}`], Equals, 0.0)
+	c.Check(metrics[`pebble_service_log_panics_total{service="test1"}`], Equals, 0.0)
+	c.Check(metrics[`pebble_log_memory_bytes`], Equals, 100*1024.0)
+	c.Check(metrics[`pebble_log_memory_limit_bytes`], Equals, 0.0)
+	for _, name := range []string{"bytes", "lent_bytes", "loans", "borrows_total", "denied_total", "returned_bytes_total", "reclaimed_bytes_total"} {
+		value, ok := metrics["pebble_log_reserve_"+name]
+		c.Check(ok, Equals, true, Commentf("missing pebble_log_reserve_%s", name))
+		c.Check(value, Equals, 0.0)
+	}
+
+	// Crash the service and wait for it to be restarted after the backoff.
+	err = serviceMgr.SendSignal([]string{"test1"}, "SIGKILL")
+	c.Assert(err, IsNil)
+	waitService(func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive && svc.Restarts == 1
+	})
+
+	metrics = s.scrapeMetrics(c)
+	c.Check(metrics[`pebble_service_state{service="test1",state="active"}`], Equals, 1.0)
+	c.Check(metrics[`pebble_service_restarts_total{service="test1"}`], Equals, 1.0)
+	c.Check(metrics[`pebble_service_restarts_total{service="test2"}`], Equals, 0.0)
+}
+
+func (s *apiSuite) TestMetricsLabelEscaping(c *C) {
+	w := &metricsWriter{}
+	w.sample("foo", 42, "a", `x"y\z`+"\n", "b", "c")
+	c.Check(w.buf.String(), Equals, `foo{a="x\"y\\z\n",b="c"} 42`+"\n")
+}
+
+func (s *apiSuite) TestMetricsHistogram(c *C) {
+	h := servicelog.LatencyHistogram{
+		Buckets: make([]uint64, len(servicelog.LatencyBuckets)+1),
+		Count:   4,
+		Sum:     12*time.Second + 3*time.Millisecond,
+	}
+	h.Buckets[0] = 1
+	h.Buckets[3] = 2
+	h.Buckets[len(servicelog.LatencyBuckets)] = 1
+	w := &metricsWriter{}
+	w.histogram("foo_seconds", h, "stage", "buffer")
+	c.Check(w.buf.String(), Equals, `
+foo_seconds_bucket{stage="buffer",le="0.0001"} 1
+foo_seconds_bucket{stage="buffer",le="0.0005"} 1
+foo_seconds_bucket{stage="buffer",le="0.001"} 1
+foo_seconds_bucket{stage="buffer",le="0.005"} 3
+foo_seconds_bucket{stage="buffer",le="0.01"} 3
+foo_seconds_bucket{stage="buffer",le="0.05"} 3
+foo_seconds_bucket{stage="buffer",le="0.1"} 3
+foo_seconds_bucket{stage="buffer",le="0.5"} 3
+foo_seconds_bucket{stage="buffer",le="1"} 3
+foo_seconds_bucket{stage="buffer",le="5"} 3
+foo_seconds_bucket{stage="buffer",le="10"} 3
+foo_seconds_bucket{stage="buffer",le="+Inf"} 4
+foo_seconds_sum{stage="buffer"} 12.003
+foo_seconds_count{stage="buffer"} 4
+`[1:])
+}
+
+func (s *apiSuite) TestMetricsLogLatency(c *C) {
+	writeTestLayer(s.pebbleDir, `
+services:
+    test1:
+        override: replace
+        command: /bin/sh -c "echo hello; exec sleep 10"
+    test2:
+        override: replace
+        command: sleep 10
+`)
+	d, err := New(&Options{Dir: s.pebbleDir, TraceLogLatency: true})
+	c.Assert(err, IsNil)
+	d.addRoutes()
+	s.d = d
+	d.overlord.Loop()
+
+	payload := bytes.NewBufferString(`{"action": "start", "services": ["test1"]}`)
+	req, err := http.NewRequest("POST", "/v1/services", payload)
+	c.Assert(err, IsNil)
+	rsp := v1PostServices(apiCmd("/v1/services"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Check(rec.Result().StatusCode, Equals, 202)
+	st := d.overlord.State()
+	st.Lock()
+	chg := st.Change(rsp.Change)
+	st.Unlock()
+	select {
+	case <-chg.Ready():
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for service to start")
+	}
+
+	serviceMgr := d.overlord.ServiceManager()
+	for i := 0; ; i++ {
+		if i > 200 {
+			c.Fatalf("timed out waiting for service logs")
+		}
+		services, err := serviceMgr.Services([]string{"test1"})
+		c.Assert(err, IsNil)
+		if services[0].LogLatency[servicelog.StageBuffer].Count > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	metrics := s.scrapeMetrics(c)
+	c.Check(metrics[`pebble_service_log_latency_seconds_count{service="test1",stage="buffer"}`], Equals, 1.0)
+	c.Check(metrics[`pebble_service_log_latency_seconds_bucket{service="test1",stage="buffer",le="+Inf"}`], Equals, 1.0)
+	_, ok := metrics[`pebble_service_log_latency_seconds_count{service="test2",stage="buffer"}`]
+	c.Check(ok, Equals, false)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/canonical/pebble/internal/overlord/state"
+	"github.com/canonical/pebble/internal/strutil"
+)
+
+func v1GetNotices(c *Command, r *http.Request, _ *userState) Response {
+	query := r.URL.Query()
+	filter := &state.NoticeFilter{}
+
+	sel := query.Get("select")
+	switch sel {
+	case "all":
+		filter.All = true
+	case "pending", "":
+	default:
+		return statusBadRequest("invalid select parameter: %q", sel)
+	}
+
+	for _, t := range strutil.CommaSeparatedList(query.Get("types")) {
+		filter.Types = append(filter.Types, state.NoticeType(t))
+	}
+
+	if after := query.Get("after"); after != "" {
+		t, err := time.Parse(time.RFC3339, after)
+		if err != nil {
+			return statusBadRequest("invalid after parameter: %q", after)
+		}
+		filter.After = t
+	}
+
+	st := c.d.overlord.State()
+	st.Lock()
+	defer st.Unlock()
+
+	notices := st.Notices(filter)
+	if len(notices) == 0 {
+		return SyncResponse([]*state.Notice{})
+	}
+	return SyncResponse(notices)
+}
+
+func v1AckNotices(c *Command, r *http.Request, _ *userState) Response {
+	defer r.Body.Close()
+	var op struct {
+		Action    string    `json:"action"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&op); err != nil {
+		return statusBadRequest("cannot decode request body into notices operation: %v", err)
+	}
+	if op.Action != "okay" {
+		return statusBadRequest("unknown notice action %q", op.Action)
+	}
+	st := c.d.overlord.State()
+	st.Lock()
+	defer st.Unlock()
+	n := st.AckNotices(op.Timestamp)
+
+	return SyncResponse(n)
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/overlord/state"
+)
+
+func (s *apiSuite) getNotices(c *check.C, query string) []map[string]interface{} {
+	req, err := http.NewRequest("GET", "/v1/notices?"+query, nil)
+	c.Assert(err, check.IsNil)
+	rsp := v1GetNotices(apiCmd("/v1/notices"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, 200)
+
+	var body struct {
+		Result []map[string]interface{} `json:"result"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Assert(err, check.IsNil)
+	return body.Result
+}
+
+func (s *apiSuite) TestNotices(c *check.C) {
+	d := s.daemon(c)
+	st := d.overlord.State()
+	st.Lock()
+	st.AddNotice(state.ServiceRestartNotice, "svc1", map[string]string{"backoff": "1"})
+	st.AddNotice(state.ServiceRestartNotice, "svc1", map[string]string{"backoff": "2"})
+	st.AddNotice("other", "foo", nil)
+	st.Unlock()
+
+	notices := s.getNotices(c, "")
+	c.Assert(notices, check.HasLen, 2)
+	c.Check(notices[0]["type"], check.Equals, "service-restart")
+	c.Check(notices[0]["key"], check.Equals, "svc1")
+	c.Check(notices[0]["occurrences"], check.Equals, 2.0)
+	c.Check(notices[0]["last-data"], check.DeepEquals, map[string]interface{}{"backoff": "2"})
+	c.Check(notices[1]["type"], check.Equals, "other")
+
+	notices = s.getNotices(c, "types=other")
+	c.Assert(notices, check.HasLen, 1)
+	c.Check(notices[0]["key"], check.Equals, "foo")
+
+	after := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	notices = s.getNotices(c, "after="+after)
+	c.Assert(notices, check.HasLen, 0)
+}
+
+func (s *apiSuite) TestNoticesBadRequest(c *check.C) {
+	s.daemon(c)
+
+	for _, query := range []string{"select=foo", "after=foo"} {
+		req, err := http.NewRequest("GET", "/v1/notices?"+query, nil)
+		c.Assert(err, check.IsNil)
+		rsp := v1GetNotices(apiCmd("/v1/notices"), req, nil).(*resp)
+		c.Check(rsp.Status, check.Equals, 400, check.Commentf("query %q", query))
+	}
+}
+
+func (s *apiSuite) TestAckNotices(c *check.C) {
+	d := s.daemon(c)
+	st := d.overlord.State()
+	st.Lock()
+	st.AddNotice(state.ServiceRestartNotice, "svc1", nil)
+	st.Unlock()
+
+	body := bytes.NewBufferString(`{"action": "okay", "timestamp": "` + time.Now().Add(time.Second).Format(time.RFC3339) + `"}`)
+	req, err := http.NewRequest("POST", "/v1/notices", body)
+	c.Assert(err, check.IsNil)
+	rsp := v1AckNotices(apiCmd("/v1/notices"), req, nil).(*resp)
+	c.Assert(rsp.Status, check.Equals, 200)
+	c.Check(rsp.Result, check.Equals, 1)
+
+	c.Check(s.getNotices(c, ""), check.HasLen, 0)
+	c.Check(s.getNotices(c, "select=all"), check.HasLen, 1)
+
+	req, err = http.NewRequest("POST", "/v1/notices", bytes.NewBufferString(`{"action": "foo"}`))
+	c.Assert(err, check.IsNil)
+	rsp = v1AckNotices(apiCmd("/v1/notices"), req, nil).(*resp)
+	c.Check(rsp.Status, check.Equals, 400)
+}
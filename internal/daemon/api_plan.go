@@ -16,6 +16,8 @@ package daemon
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
 	"gopkg.in/yaml.v3"
@@ -55,7 +57,22 @@ func v1PostLayers(c *Command, r *http.Request, _ *userState) Response {
 		return statusBadRequest("cannot decode request body: %v", err)
 	}
 
-	if payload.Action != "add" {
+	switch payload.Action {
+	case "add":
+	case "reload":
+		changeID, err := c.d.ReloadLayers()
+		if err != nil {
+			var formatErr *plan.FormatError
+			if errors.As(err, &formatErr) {
+				return formatErrorResponse("cannot reload layers: %v", formatErr)
+			}
+			return statusBadRequest("cannot reload layers: %v", err)
+		}
+		if changeID == "" {
+			return SyncResponse(nil)
+		}
+		return AsyncResponse(nil, changeID)
+	default:
 		return statusBadRequest("invalid action %q", payload.Action)
 	}
 	if payload.Label == "" {
@@ -79,10 +96,43 @@ func v1PostLayers(c *Command, r *http.Request, _ *userState) Response {
 		if _, ok := err.(*servstate.LabelExists); ok {
 			return statusBadRequest("%v", err)
 		}
-		if _, ok := err.(*plan.FormatError); ok {
-			return statusBadRequest("%v", err)
+		if formatErr, ok := err.(*plan.FormatError); ok {
+			return formatErrorResponse("%v", formatErr)
 		}
 		return statusInternalError("%v", err)
 	}
 	return SyncResponse(true)
 }
+
+// layerProblem is the JSON form of a plan.FormatProblem.
+type layerProblem struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// formatErrorResponse returns a 400 response for a layer format error. The
+// problems it lists, if any, are included as the error value so that
+// clients can act on them.
+func formatErrorResponse(format string, err *plan.FormatError) Response {
+	result := &errorResult{
+		Kind:    errorKindInvalidLayer,
+		Message: fmt.Sprintf(format, err),
+	}
+	if len(err.Problems) > 0 {
+		problems := make([]layerProblem, len(err.Problems))
+		for i, problem := range err.Problems {
+			problems[i] = layerProblem{
+				Field:   problem.Field,
+				Code:    problem.Code,
+				Message: problem.Message,
+			}
+		}
+		result.Value = problems
+	}
+	return &resp{
+		Type:   ResponseTypeError,
+		Result: result,
+		Status: http.StatusBadRequest,
+	}
+}
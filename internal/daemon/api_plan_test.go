@@ -16,8 +16,11 @@ package daemon
 
 import (
 	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/yaml.v3"
@@ -197,4 +200,144 @@ func (s *apiSuite) TestLayersCombineFormatError(c *C) {
 	c.Assert(rsp.Type, Equals, ResponseTypeError)
 	result := rsp.Result.(*errorResult)
 	c.Assert(result.Message, Matches, `layer "base" must define "override" for service "dynamic"`)
+	c.Assert(result.Kind, Equals, errorKindInvalidLayer)
+	c.Assert(result.Value, IsNil)
+}
+
+func (s *apiSuite) TestLayersAddProblems(c *C) {
+	writeTestLayer(s.pebbleDir, planLayer)
+	_ = s.daemon(c)
+	layersCmd := apiCmd("/v1/layers")
+
+	layer := `
+services:
+    dynamic:
+        override: replace
+        command: echo dynamic
+        failure-log-lines: 2000
+        watchdog-log-silence: 0s
+        reload-signal: SIGHUP
+        reload-ready-log: "[a-"
+`
+	payload, err := json.Marshal(map[string]interface{}{
+		"action": "add",
+		"label":  "foo",
+		"format": "yaml",
+		"layer":  layer,
+	})
+	c.Assert(err, IsNil)
+	req, err := http.NewRequest("POST", "/v1/layers", bytes.NewBuffer(payload))
+	c.Assert(err, IsNil)
+	rsp := v1PostLayers(layersCmd, req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+
+	var body struct {
+		Type   string `json:"type"`
+		Result struct {
+			Kind    string `json:"kind"`
+			Message string `json:"message"`
+			Value   []map[string]string
+		} `json:"result"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Assert(err, IsNil)
+	c.Check(body.Type, Equals, "error")
+	c.Check(body.Result.Kind, Equals, "invalid-layer")
+	c.Check(body.Result.Message, Matches, `
+plan has 3 problems:
+- plan service "dynamic" failure-log-lines must be between 0 and 1000, not 2000
+- plan service "dynamic" reload-ready-log invalid: error parsing regexp: .*
+- plan service "dynamic" watchdog-log-silence must be greater than zero`[1:])
+	c.Assert(body.Result.Value, HasLen, 3)
+	c.Check(body.Result.Value[0], DeepEquals, map[string]string{
+		"field":   "services.dynamic.failure-log-lines",
+		"code":    "out-of-range",
+		"message": `plan service "dynamic" failure-log-lines must be between 0 and 1000, not 2000`,
+	})
+	c.Check(body.Result.Value[1]["field"], Equals, "services.dynamic.reload-ready-log")
+	c.Check(body.Result.Value[1]["code"], Equals, "bad-regex")
+	c.Check(body.Result.Value[1]["message"], Matches, `plan service "dynamic" reload-ready-log invalid: error parsing regexp: .*`)
+	c.Check(body.Result.Value[2], DeepEquals, map[string]string{
+		"field":   "services.dynamic.watchdog-log-silence",
+		"code":    "out-of-range",
+		"message": `plan service "dynamic" watchdog-log-silence must be greater than zero`,
+	})
+	s.planLayersHasLen(c, 1)
+}
+
+func (s *apiSuite) TestLayersReload(c *C) {
+	writeTestLayer(s.pebbleDir, planLayer)
+	_ = s.daemon(c)
+	layersCmd := apiCmd("/v1/layers")
+
+	// Add a layer through the API, which is kept across reloads.
+	payload := `{"action": "add", "label": "foo", "format": "yaml", "layer": "services:\n dynamic:\n  override: replace\n  command: echo dynamic\n"}`
+	req, err := http.NewRequest("POST", "/v1/layers", bytes.NewBufferString(payload))
+	c.Assert(err, IsNil)
+	rsp := v1PostLayers(layersCmd, req, nil).(*resp)
+	c.Assert(rsp.Status, Equals, 200)
+
+	writeTestLayerFile(c, s.pebbleDir, "001-base.yaml", `
+services:
+    static:
+        override: replace
+        command: echo updated
+`)
+	writeTestLayerFile(c, s.pebbleDir, "002-extra.yaml", `
+services:
+    extra:
+        override: replace
+        command: echo extra
+`)
+	req, err = http.NewRequest("POST", "/v1/layers", bytes.NewBufferString(`{"action": "reload"}`))
+	c.Assert(err, IsNil)
+	rsp = v1PostLayers(layersCmd, req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, 200)
+	c.Assert(rsp.Type, Equals, ResponseTypeSync)
+	c.Assert(rsp.Result, IsNil)
+	c.Assert(s.planYAML(c), Equals, `
+services:
+    dynamic:
+        override: replace
+        command: echo dynamic
+    extra:
+        override: replace
+        command: echo extra
+    static:
+        override: replace
+        command: echo updated
+`[1:])
+	s.planLayersHasLen(c, 3)
+}
+
+func (s *apiSuite) TestLayersReloadInvalid(c *C) {
+	writeTestLayer(s.pebbleDir, planLayer)
+	_ = s.daemon(c)
+	layersCmd := apiCmd("/v1/layers")
+	before := s.planYAML(c)
+
+	writeTestLayerFile(c, s.pebbleDir, "002-bad.yaml", `
+services:
+    static:
+        command: echo bad
+`)
+	req, err := http.NewRequest("POST", "/v1/layers", bytes.NewBufferString(`{"action": "reload"}`))
+	c.Assert(err, IsNil)
+	rsp := v1PostLayers(layersCmd, req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	c.Assert(rsp.Type, Equals, ResponseTypeError)
+	c.Assert(rsp.Result.(*errorResult).Message, Equals, `cannot reload layers: layer "bad" must define "override" for service "static"`)
+	c.Assert(s.planYAML(c), Equals, before)
+	s.planLayersHasLen(c, 1)
+}
+
+func writeTestLayerFile(c *C, pebbleDir, filename, layerYAML string) {
+	err := ioutil.WriteFile(filepath.Join(pebbleDir, "layers", filename), []byte(layerYAML), 0644)
+	c.Assert(err, IsNil)
 }
@@ -23,30 +23,131 @@ import (
 
 	"github.com/canonical/pebble/internal/overlord/servstate"
 	"github.com/canonical/pebble/internal/overlord/state"
+	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/procstat"
 	"github.com/canonical/pebble/internal/strutil"
 )
 
 type serviceInfo struct {
-	Name    string `json:"name"`
-	Startup string `json:"startup"`
-	Current string `json:"current"`
+	Name          string        `json:"name"`
+	Startup       string        `json:"startup"`
+	Current       string        `json:"current"`
+	MemoryCurrent int64         `json:"memory-current,omitempty"`
+	FailingChecks []string      `json:"failing-checks,omitempty"`
+	Args          []string      `json:"args,omitempty"`
+	Usage         *serviceUsage `json:"usage,omitempty"`
+	Logging       *logInfo      `json:"logging,omitempty"`
+}
+
+type logInfo struct {
+	Encoding       string   `json:"encoding,omitempty"`
+	Files          []string `json:"files,omitempty"`
+	Stages         []string `json:"stages"`
+	Mode           string   `json:"mode"`
+	DisabledStages []string `json:"disabled-stages,omitempty"`
+	BufferSize     int      `json:"buffer-size"`
+	BufferUsed     int      `json:"buffer-used"`
+	BufferBorrowed int      `json:"buffer-borrowed,omitempty"`
+}
+
+func newLogInfo(logging *servstate.LoggingInfo) *logInfo {
+	return &logInfo{
+		Encoding:       logging.Encoding,
+		Files:          logging.Files,
+		Stages:         logging.Stages,
+		Mode:           string(logging.Mode),
+		DisabledStages: logging.DisabledStages,
+		BufferSize:     logging.BufferSize,
+		BufferUsed:     logging.BufferUsed,
+		BufferBorrowed: logging.BufferBorrowed,
+	}
+}
+
+type serviceUsage struct {
+	Processes  int     `json:"processes"`
+	RSS        int64   `json:"rss"`
+	CPUSeconds float64 `json:"cpu-seconds"`
+	Threads    int     `json:"threads"`
+	FDs        *int    `json:"fds,omitempty"`
+}
+
+func newServiceUsage(usage *procstat.Usage) *serviceUsage {
+	result := &serviceUsage{
+		Processes:  usage.Processes,
+		RSS:        usage.RSS,
+		CPUSeconds: usage.CPUTime.Seconds(),
+		Threads:    usage.Threads,
+	}
+	if usage.FDs >= 0 {
+		fds := usage.FDs
+		result.FDs = &fds
+	}
+	return result
 }
 
 func v1GetServices(c *Command, r *http.Request, _ *userState) Response {
-	names := strutil.CommaSeparatedList(r.URL.Query().Get("names"))
+	query := r.URL.Query()
+	names := strutil.CommaSeparatedList(query.Get("names"))
+	usageStr := query.Get("usage")
+	if usageStr != "" && usageStr != "true" && usageStr != "false" {
+		return statusBadRequest(`usage parameter must be "true" or "false"`)
+	}
+	loggingStr := query.Get("logging")
+	if loggingStr != "" && loggingStr != "true" && loggingStr != "false" {
+		return statusBadRequest(`logging parameter must be "true" or "false"`)
+	}
 
 	servmgr := overlordServiceManager(c.d.overlord)
+	if groups := strutil.CommaSeparatedList(query.Get("groups")); len(groups) > 0 {
+		groupServices, err := servmgr.GroupServices(groups)
+		if err != nil {
+			return statusBadRequest("%v", err)
+		}
+		names = appendUnique(names, groupServices...)
+	}
 	services, err := servmgr.Services(names)
 	if err != nil {
 		return statusInternalError("%v", err)
 	}
+	p, err := servmgr.Plan()
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+	checks, err := overlordCheckManager(c.d.overlord).Checks(plan.UnsetLevel, nil)
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+
+	// Usage is only sampled when asked for, as it may walk all of /proc.
+	var usages map[string]*procstat.Usage
+	if usageStr == "true" {
+		usages = servmgr.ServiceUsage(names)
+	}
+	var loggings map[string]*servstate.LoggingInfo
+	if loggingStr == "true" {
+		loggings, err = servmgr.ServiceLogging(names)
+		if err != nil {
+			return statusInternalError("%v", err)
+		}
+	}
 
 	infos := make([]serviceInfo, 0, len(services))
 	for _, svc := range services {
 		info := serviceInfo{
-			Name:    svc.Name,
-			Startup: string(svc.Startup),
-			Current: string(svc.Current),
+			Name:          svc.Name,
+			Startup:       string(svc.Startup),
+			Current:       string(svc.Current),
+			MemoryCurrent: svc.MemoryCurrent,
+			Args:          svc.Args,
+		}
+		if config, ok := p.Services[svc.Name]; ok {
+			info.FailingChecks = failingChecks(config, checks)
+		}
+		if usage, ok := usages[svc.Name]; ok {
+			info.Usage = newServiceUsage(usage)
+		}
+		if logging, ok := loggings[svc.Name]; ok {
+			info.Logging = newLogInfo(logging)
 		}
 		infos = append(infos, info)
 	}
@@ -57,6 +158,12 @@ func v1PostServices(c *Command, r *http.Request, _ *userState) Response {
 	var payload struct {
 		Action   string   `json:"action"`
 		Services []string `json:"services"`
+		Groups   []string `json:"groups"`
+		Args     []string `json:"args"`
+
+		// NoRestart makes reload fail for services without a reload-signal,
+		// rather than restarting them.
+		NoRestart bool `json:"no-restart"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -64,8 +171,23 @@ func v1PostServices(c *Command, r *http.Request, _ *userState) Response {
 		return statusBadRequest("cannot decode data from request body: %v", err)
 	}
 
-	var err error
 	servmgr := overlordServiceManager(c.d.overlord)
+	if len(payload.Groups) > 0 {
+		if payload.Action == "replan" || payload.Action == "autostart" {
+			return statusBadRequest("%s accepts no service groups", payload.Action)
+		}
+		groupServices, err := servmgr.GroupServices(payload.Groups)
+		if err != nil {
+			return statusBadRequest("%v", err)
+		}
+		payload.Services = appendUnique(payload.Services, groupServices...)
+	}
+
+	if len(payload.Args) > 0 && (payload.Action != "start" || len(payload.Services) != 1) {
+		return statusBadRequest("args are only supported when starting a single service")
+	}
+
+	var err error
 	switch payload.Action {
 	case "replan":
 		if len(payload.Services) != 0 {
@@ -105,7 +227,11 @@ func v1PostServices(c *Command, r *http.Request, _ *userState) Response {
 		if err != nil {
 			break
 		}
-		taskSet, err = servstate.Start(st, services)
+		var args map[string][]string
+		if len(payload.Args) > 0 {
+			args = map[string][]string{payload.Services[0]: payload.Args}
+		}
+		taskSet, err = servstate.StartWithArgs(st, services, args)
 	case "stop":
 		services, err = servmgr.StopOrder(payload.Services)
 		if err != nil {
@@ -113,62 +239,52 @@ func v1PostServices(c *Command, r *http.Request, _ *userState) Response {
 		}
 		taskSet, err = servstate.Stop(st, services)
 	case "restart":
-		services, err = servmgr.StopOrder(payload.Services)
-		if err != nil {
-			break
-		}
-		services = intersectOrdered(payload.Services, services)
-		var stopTasks *state.TaskSet
-		stopTasks, err = servstate.Stop(st, services)
-		if err != nil {
-			break
-		}
-		services, err = servmgr.StartOrder(payload.Services)
-		if err != nil {
-			break
-		}
-		var startTasks *state.TaskSet
-		startTasks, err = servstate.Start(st, services)
+		taskSet, services, err = restartTasks(st, servmgr, payload.Services)
+	case "reload":
+		// Reload the services that have a reload-signal, and fall back to
+		// restarting the others (unless asked not to).
+		var p *plan.Plan
+		p, err = servmgr.Plan()
 		if err != nil {
 			break
 		}
-		startTasks.WaitAll(stopTasks)
-		taskSet = state.NewTaskSet()
-		taskSet.AddAll(stopTasks)
-		taskSet.AddAll(startTasks)
-	case "replan":
-		var stopNames, startNames []string
-		stopNames, startNames, err = servmgr.Replan()
-		if err != nil {
-			break
+		var reloadNames, restartNames []string
+		for _, name := range payload.Services {
+			config, ok := p.Services[name]
+			switch {
+			case !ok:
+				err = fmt.Errorf("service %q does not exist", name)
+			case config.ReloadSignal != "":
+				reloadNames = append(reloadNames, name)
+			case payload.NoRestart:
+				err = fmt.Errorf("service %q has no reload-signal", name)
+			default:
+				restartNames = append(restartNames, name)
+			}
+			if err != nil {
+				break
+			}
 		}
-		var stopTasks *state.TaskSet
-		stopTasks, err = servstate.Stop(st, stopNames)
 		if err != nil {
 			break
 		}
-		var startTasks *state.TaskSet
-		startTasks, err = servstate.Start(st, startNames)
+		taskSet, err = servstate.Reload(st, reloadNames)
 		if err != nil {
 			break
 		}
-		startTasks.WaitAll(stopTasks)
-		taskSet = state.NewTaskSet()
-		taskSet.AddAll(stopTasks)
-		taskSet.AddAll(startTasks)
-
-		// Populate a list of services affected by the replan for summary.
-		replanned := make(map[string]bool)
-		for _, v := range stopNames {
-			replanned[v] = true
+		services = reloadNames
+		if len(restartNames) > 0 {
+			var restartTaskSet *state.TaskSet
+			var restarted []string
+			restartTaskSet, restarted, err = restartTasks(st, servmgr, restartNames)
+			if err != nil {
+				break
+			}
+			taskSet.AddAll(restartTaskSet)
+			services = append(services, restarted...)
 		}
-		for _, v := range startNames {
-			replanned[v] = true
-		}
-		for k := range replanned {
-			services = append(services, k)
-		}
-		sort.Strings(services)
+	case "replan":
+		taskSet, services, err = replanTasks(st, servmgr)
 		payload.Services = services
 	default:
 		return statusBadRequest("action %q is unsupported", payload.Action)
@@ -192,6 +308,79 @@ func v1PostServices(c *Command, r *http.Request, _ *userState) Response {
 	return AsyncResponse(nil, change.ID())
 }
 
+// replanTasks returns a task set to stop, start and reload the services whose
+// configuration has changed since they were started, and the sorted list of
+// services affected.
+func replanTasks(st *state.State, servmgr *servstate.ServiceManager) (*state.TaskSet, []string, error) {
+	stopNames, startNames, reloadNames, err := servmgr.Replan()
+	if err != nil {
+		return nil, nil, err
+	}
+	stopTasks, err := servstate.Stop(st, stopNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	startTasks, err := servstate.Start(st, startNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	startTasks.WaitAll(stopTasks)
+	reloadTasks, err := servstate.Reload(st, reloadNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	taskSet := state.NewTaskSet()
+	taskSet.AddAll(stopTasks)
+	taskSet.AddAll(startTasks)
+	taskSet.AddAll(reloadTasks)
+
+	// Populate a list of services affected by the replan for summary.
+	replanned := make(map[string]bool)
+	for _, v := range stopNames {
+		replanned[v] = true
+	}
+	for _, v := range startNames {
+		replanned[v] = true
+	}
+	for _, v := range reloadNames {
+		replanned[v] = true
+	}
+	var services []string
+	for k := range replanned {
+		services = append(services, k)
+	}
+	sort.Strings(services)
+	return taskSet, services, nil
+}
+
+// restartTasks returns a task set to restart the given services, stopping
+// them and starting them (with any dependencies) in the proper order, and
+// the resolved list of services started.
+func restartTasks(st *state.State, servmgr *servstate.ServiceManager, names []string) (*state.TaskSet, []string, error) {
+	services, err := servmgr.StopOrder(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	services = intersectOrdered(names, services)
+	stopTasks, err := servstate.Stop(st, services)
+	if err != nil {
+		return nil, nil, err
+	}
+	services, err = servmgr.StartOrder(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	startTasks, err := servstate.Start(st, services)
+	if err != nil {
+		return nil, nil, err
+	}
+	startTasks.WaitAll(stopTasks)
+	taskSet := state.NewTaskSet()
+	taskSet.AddAll(stopTasks)
+	taskSet.AddAll(startTasks)
+	return taskSet, services, nil
+}
+
 func v1GetService(c *Command, r *http.Request, _ *userState) Response {
 	return statusBadRequest("not implemented")
 }
@@ -200,6 +389,16 @@ func v1PostService(c *Command, r *http.Request, _ *userState) Response {
 	return statusBadRequest("not implemented")
 }
 
+// appendUnique appends the values to list, skipping those already present.
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		if !strutil.ListContains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 // intersectOrdered returns the intersection of left and right where
 // the right's ordering is persisted in the resulting set.
 func intersectOrdered(left []string, orderedRight []string) []string {
@@ -24,7 +24,9 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/canonical/pebble/internal/overlord/servstate"
 	"github.com/canonical/pebble/internal/overlord/state"
+	"github.com/canonical/pebble/internal/procstat"
 
 	. "gopkg.in/check.v1"
 )
@@ -112,6 +114,209 @@ func (s *apiSuite) TestServicesStart(c *C) {
 	c.Assert(tasks[2].Summary(), Equals, `Start service "test3"`)
 }
 
+func (s *apiSuite) TestServicesStartArgs(c *C) {
+	writeTestLayer(s.pebbleDir, servicesLayer)
+	d := s.daemon(c)
+	st := d.overlord.State()
+
+	restore := FakeStateEnsureBefore(func(st *state.State, d time.Duration) {})
+	defer restore()
+
+	payload := bytes.NewBufferString(`{"action": "start", "services": ["test1"], "args": ["--foo", "a b"]}`)
+	req, err := http.NewRequest("POST", "/v1/services", payload)
+	c.Assert(err, IsNil)
+	rsp := v1PostServices(apiCmd("/v1/services"), req, nil).(*resp)
+	c.Assert(rsp.Status, Equals, 202)
+
+	st.Lock()
+	defer st.Unlock()
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	tasks := chg.Tasks()
+	c.Assert(tasks, HasLen, 2)
+
+	// Only the requested service gets the extra arguments, not its
+	// dependencies.
+	request, err := servstate.TaskServiceRequest(tasks[0])
+	c.Assert(err, IsNil)
+	c.Check(request.Name, Equals, "test1")
+	c.Check(request.Args, DeepEquals, []string{"--foo", "a b"})
+	request, err = servstate.TaskServiceRequest(tasks[1])
+	c.Assert(err, IsNil)
+	c.Check(request.Name, Equals, "test2")
+	c.Check(request.Args, IsNil)
+}
+
+func (s *apiSuite) TestServicesArgsErrors(c *C) {
+	writeTestLayer(s.pebbleDir, servicesLayer)
+	s.daemon(c)
+
+	for _, body := range []string{
+		`{"action": "start", "services": ["test1", "test2"], "args": ["--foo"]}`,
+		`{"action": "restart", "services": ["test1"], "args": ["--foo"]}`,
+		`{"action": "stop", "services": ["test1"], "args": ["--foo"]}`,
+	} {
+		req, err := http.NewRequest("POST", "/v1/services", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+		rsp := v1PostServices(apiCmd("/v1/services"), req, nil).(*resp)
+		c.Check(rsp.Status, Equals, 400, Commentf(body))
+		c.Check(rsp.Result.(*errorResult).Message, Equals, "args are only supported when starting a single service")
+	}
+}
+
+var groupsLayer = `
+services:
+    web1:
+        override: replace
+        command: sleep 300
+        groups: [web]
+    web2:
+        override: replace
+        command: sleep 300
+        groups: [web, frontend]
+    db:
+        override: replace
+        command: sleep 300
+        groups: [backend]
+`
+
+func (s *apiSuite) TestServicesGroups(c *C) {
+	writeTestLayer(s.pebbleDir, groupsLayer)
+	d := s.daemon(c)
+	st := d.overlord.State()
+
+	restore := FakeStateEnsureBefore(func(st *state.State, d time.Duration) {})
+	defer restore()
+
+	payload := bytes.NewBufferString(`{"action": "stop", "services": ["db"], "groups": ["web", "frontend"]}`)
+	req, err := http.NewRequest("POST", "/v1/services", payload)
+	c.Assert(err, IsNil)
+	rsp := v1PostServices(apiCmd("/v1/services"), req, nil).(*resp)
+	c.Assert(rsp.Status, Equals, 202)
+
+	st.Lock()
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	var summaries []string
+	for _, task := range chg.Tasks() {
+		summaries = append(summaries, task.Summary())
+	}
+	st.Unlock()
+	c.Check(summaries, DeepEquals, []string{
+		`Stop service "db"`,
+		`Stop service "web1"`,
+		`Stop service "web2"`,
+	})
+
+	req, err = http.NewRequest("GET", "/v1/services?groups=frontend,backend", nil)
+	c.Assert(err, IsNil)
+	rsp = v1GetServices(apiCmd("/v1/services"), req, nil).(*resp)
+	c.Assert(rsp.Status, Equals, 200)
+	var names []string
+	for _, info := range rsp.Result.([]serviceInfo) {
+		names = append(names, info.Name)
+	}
+	c.Check(names, DeepEquals, []string{"db", "web2"})
+}
+
+func (s *apiSuite) TestServicesGroupsErrors(c *C) {
+	writeTestLayer(s.pebbleDir, groupsLayer)
+	s.daemon(c)
+
+	for _, test := range []struct {
+		body    string
+		message string
+	}{{
+		body:    `{"action": "start", "groups": ["nope"]}`,
+		message: `group "nope" does not exist \(known groups: backend, frontend, web\)`,
+	}, {
+		body:    `{"action": "replan", "groups": ["web"]}`,
+		message: `replan accepts no service groups`,
+	}, {
+		body:    `{"action": "autostart", "groups": ["web"]}`,
+		message: `autostart accepts no service groups`,
+	}} {
+		req, err := http.NewRequest("POST", "/v1/services", bytes.NewBufferString(test.body))
+		c.Assert(err, IsNil)
+		rsp := v1PostServices(apiCmd("/v1/services"), req, nil).(*resp)
+		c.Check(rsp.Status, Equals, 400, Commentf(test.body))
+		c.Check(rsp.Result.(*errorResult).Message, Matches, test.message)
+	}
+
+	req, err := http.NewRequest("GET", "/v1/services?groups=nope", nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetServices(apiCmd("/v1/services"), req, nil).(*resp)
+	c.Check(rsp.Status, Equals, 400)
+}
+
+var reloadLayer = `
+services:
+    reloadable:
+        override: replace
+        command: sleep 300
+        reload-signal: SIGHUP
+    plain:
+        override: replace
+        command: sleep 300
+`
+
+func (s *apiSuite) TestServicesReload(c *C) {
+	writeTestLayer(s.pebbleDir, reloadLayer)
+	d := s.daemon(c)
+	st := d.overlord.State()
+
+	restore := FakeStateEnsureBefore(func(st *state.State, d time.Duration) {})
+	defer restore()
+
+	payload := bytes.NewBufferString(`{"action": "reload", "services": ["reloadable", "plain"]}`)
+	req, err := http.NewRequest("POST", "/v1/services", payload)
+	c.Assert(err, IsNil)
+	rsp := v1PostServices(apiCmd("/v1/services"), req, nil).(*resp)
+	c.Assert(rsp.Status, Equals, 202)
+
+	st.Lock()
+	defer st.Unlock()
+	chg := st.Change(rsp.Change)
+	c.Assert(chg, NotNil)
+	c.Check(chg.Kind(), Equals, "reload")
+	c.Check(chg.Summary(), Equals, `Reload service "reloadable" and 1 more`)
+	var summaries []string
+	for _, task := range chg.Tasks() {
+		summaries = append(summaries, task.Summary())
+	}
+	// Services without a reload-signal are restarted instead.
+	c.Check(summaries, DeepEquals, []string{
+		`Reload service "reloadable"`,
+		`Stop service "plain"`,
+		`Start service "plain"`,
+	})
+}
+
+func (s *apiSuite) TestServicesReloadErrors(c *C) {
+	writeTestLayer(s.pebbleDir, reloadLayer)
+	s.daemon(c)
+
+	for _, test := range []struct {
+		body    string
+		message string
+	}{{
+		body:    `{"action": "reload", "services": ["reloadable", "plain"], "no-restart": true}`,
+		message: `cannot reload services: service "plain" has no reload-signal`,
+	}, {
+		body:    `{"action": "reload", "services": ["nope"]}`,
+		message: `cannot reload services: service "nope" does not exist`,
+	}, {
+		body:    `{"action": "reload"}`,
+		message: `no services to reload provided`,
+	}} {
+		req, err := http.NewRequest("POST", "/v1/services", bytes.NewBufferString(test.body))
+		c.Assert(err, IsNil)
+		rsp := v1PostServices(apiCmd("/v1/services"), req, nil).(*resp)
+		c.Check(rsp.Status, Equals, 400, Commentf(test.body))
+		c.Check(rsp.Result.(*errorResult).Message, Equals, test.message)
+	}
+}
+
 func (s *apiSuite) TestServicesStop(c *C) {
 	// Setup
 	writeTestLayer(s.pebbleDir, servicesLayer)
@@ -230,6 +435,94 @@ func (s *apiSuite) TestServicesGet(c *C) {
 	})
 }
 
+func (s *apiSuite) TestServicesGetUsage(c *C) {
+	writeTestLayer(s.pebbleDir, servicesLayer)
+	s.daemon(c)
+
+	// Services that aren't running have no usage.
+	req, err := http.NewRequest("GET", "/v1/services?names=test1&usage=true", nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetServices(apiCmd("/v1/services"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, 200)
+	var body map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Check(err, IsNil)
+	c.Check(body["result"], DeepEquals, []interface{}{
+		map[string]interface{}{"startup": "enabled", "name": "test1", "current": "inactive"},
+	})
+
+	req, err = http.NewRequest("GET", "/v1/services?usage=yes", nil)
+	c.Assert(err, IsNil)
+	rsp = v1GetServices(apiCmd("/v1/services"), req, nil).(*resp)
+	c.Check(rsp.Status, Equals, 400)
+	c.Check(rsp.Result.(*errorResult).Message, Equals, `usage parameter must be "true" or "false"`)
+}
+
+func (s *apiSuite) TestServicesGetLogging(c *C) {
+	writeTestLayer(s.pebbleDir, `
+services:
+    test1:
+        override: replace
+        command: sleep 10
+        log-encoding: utf-16le
+        log-files:
+            - /var/log/test1/*.log
+`)
+	s.daemon(c)
+
+	req, err := http.NewRequest("GET", "/v1/services?names=test1&logging=true", nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetServices(apiCmd("/v1/services"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, 200)
+	var body map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Check(err, IsNil)
+	c.Check(body["result"], DeepEquals, []interface{}{
+		map[string]interface{}{
+			"startup": "disabled",
+			"name":    "test1",
+			"current": "inactive",
+			"logging": map[string]interface{}{
+				"encoding":    "utf-16le",
+				"files":       []interface{}{"/var/log/test1/*.log"},
+				"stages":      []interface{}{"decode", "format", "buffer"},
+				"mode":        "full",
+				"buffer-size": 0.0,
+				"buffer-used": 0.0,
+			},
+		},
+	})
+
+	req, err = http.NewRequest("GET", "/v1/services?logging=yes", nil)
+	c.Assert(err, IsNil)
+	rsp = v1GetServices(apiCmd("/v1/services"), req, nil).(*resp)
+	c.Check(rsp.Status, Equals, 400)
+	c.Check(rsp.Result.(*errorResult).Message, Equals, `logging parameter must be "true" or "false"`)
+}
+
+func (s *apiSuite) TestNewServiceUsage(c *C) {
+	usage := newServiceUsage(&procstat.Usage{
+		Processes: 2,
+		RSS:       4096,
+		CPUTime:   1500 * time.Millisecond,
+		Threads:   3,
+		FDs:       7,
+	})
+	data, err := json.Marshal(usage)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"processes":2,"rss":4096,"cpu-seconds":1.5,"threads":3,"fds":7}`)
+
+	// File descriptors that couldn't be counted are left out.
+	usage = newServiceUsage(&procstat.Usage{Processes: 1, RSS: 4096, FDs: -1})
+	data, err = json.Marshal(usage)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"processes":1,"rss":4096,"cpu-seconds":0,"threads":0}`)
+}
+
 func (s *apiSuite) TestServicesRestart(c *C) {
 	// Setup
 	writeTestLayer(s.pebbleDir, servicesLayer)
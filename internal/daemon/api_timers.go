@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/canonical/pebble/internal/strutil"
+)
+
+type timerInfo struct {
+	Name    string        `json:"name"`
+	NextRun time.Time     `json:"next-run"`
+	Running bool          `json:"running,omitempty"`
+	LastRun *timerRunInfo `json:"last-run,omitempty"`
+}
+
+type timerRunInfo struct {
+	StartTime time.Time `json:"start-time"`
+	Duration  string    `json:"duration"`
+	ExitCode  int       `json:"exit-code"`
+	Error     string    `json:"error,omitempty"`
+	Output    string    `json:"output,omitempty"`
+}
+
+func v1GetTimers(c *Command, r *http.Request, _ *userState) Response {
+	names := strutil.CommaSeparatedList(r.URL.Query().Get("names"))
+
+	// Ensure the plan has been loaded, so that the timers are running.
+	servmgr := overlordServiceManager(c.d.overlord)
+	_, err := servmgr.Plan()
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+
+	timermgr := c.d.overlord.TimerManager()
+	timers, err := timermgr.Timers(names)
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+
+	infos := make([]timerInfo, 0, len(timers))
+	for _, timer := range timers {
+		info := timerInfo{
+			Name:    timer.Name,
+			NextRun: timer.NextRun,
+			Running: timer.Running,
+		}
+		if timer.LastRun != nil {
+			info.LastRun = &timerRunInfo{
+				StartTime: timer.LastRun.StartTime,
+				Duration:  timer.LastRun.Duration.String(),
+				ExitCode:  timer.LastRun.ExitCode,
+				Error:     timer.LastRun.Error,
+				Output:    timer.LastRun.Output,
+			}
+		}
+		infos = append(infos, info)
+	}
+	return SyncResponse(infos)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var timersLayer = `
+timers:
+    backup:
+        override: replace
+        command: echo backup
+        every: 1h
+
+    cleanup:
+        override: replace
+        command: echo cleanup
+        schedule: "03:00"
+`
+
+func (s *apiSuite) TestTimersGet(c *C) {
+	writeTestLayer(s.pebbleDir, timersLayer)
+	s.daemon(c)
+
+	// Wait for the timers to be scheduled (next-run is set asynchronously).
+	var body map[string]interface{}
+	for i := 0; ; i++ {
+		req, err := http.NewRequest("GET", "/v1/timers", nil)
+		c.Assert(err, IsNil)
+		rsp := v1GetTimers(apiCmd("/v1/timers"), req, nil).(*resp)
+		rec := httptest.NewRecorder()
+		rsp.ServeHTTP(rec, req)
+		c.Assert(rec.Code, Equals, 200)
+		c.Assert(rsp.Type, Equals, ResponseTypeSync)
+
+		body = nil
+		err = json.Unmarshal(rec.Body.Bytes(), &body)
+		c.Assert(err, IsNil)
+		scheduled := true
+		for _, timer := range body["result"].([]interface{}) {
+			nextRun := timer.(map[string]interface{})["next-run"].(string)
+			scheduled = scheduled && nextRun != "0001-01-01T00:00:00Z"
+		}
+		if scheduled {
+			break
+		}
+		if i >= 100 {
+			c.Fatalf("timed out waiting for timers to be scheduled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	timers := body["result"].([]interface{})
+	c.Assert(timers, HasLen, 2)
+	backup := timers[0].(map[string]interface{})
+	c.Check(backup["name"], Equals, "backup")
+	nextRun, err := time.Parse(time.RFC3339, backup["next-run"].(string))
+	c.Assert(err, IsNil)
+	c.Check(nextRun.After(time.Now().Add(59*time.Minute)), Equals, true)
+	c.Check(backup["running"], IsNil)
+	c.Check(backup["last-run"], IsNil)
+	c.Check(timers[1].(map[string]interface{})["name"], Equals, "cleanup")
+}
+
+func (s *apiSuite) TestTimersGetNames(c *C) {
+	writeTestLayer(s.pebbleDir, timersLayer)
+	s.daemon(c)
+
+	req, err := http.NewRequest("GET", "/v1/timers?names=cleanup", nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetTimers(apiCmd("/v1/timers"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, 200)
+
+	var body map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Assert(err, IsNil)
+	timers := body["result"].([]interface{})
+	c.Assert(timers, HasLen, 1)
+	c.Check(timers[0].(map[string]interface{})["name"], Equals, "cleanup")
+}
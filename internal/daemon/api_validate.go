@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"net/http"
+
+	"github.com/canonical/pebble/internal/strutil"
+)
+
+type loggingReportInfo struct {
+	Service  string   `json:"service"`
+	Stages   []string `json:"stages"`
+	Warnings []string `json:"warnings,omitempty"`
+	Sample   []string `json:"sample,omitempty"`
+}
+
+func v1GetValidateLogging(c *Command, r *http.Request, _ *userState) Response {
+	names := strutil.CommaSeparatedList(r.URL.Query().Get("services"))
+
+	servmgr := overlordServiceManager(c.d.overlord)
+	p, err := servmgr.Plan()
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+	for _, name := range names {
+		if _, ok := p.Services[name]; !ok {
+			return statusNotFound("cannot find service %q", name)
+		}
+	}
+
+	reports, err := servmgr.ValidateLogging(names)
+	if err != nil {
+		return statusInternalError("%v", err)
+	}
+	infos := make([]loggingReportInfo, 0, len(reports))
+	for _, report := range reports {
+		infos = append(infos, loggingReportInfo{
+			Service:  report.Service,
+			Stages:   report.Stages,
+			Warnings: report.Warnings,
+			Sample:   report.Sample,
+		})
+	}
+	return SyncResponse(infos)
+}
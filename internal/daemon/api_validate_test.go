@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+var validateLoggingLayer = `
+services:
+    svc1:
+        override: replace
+        command: sleep 300
+
+    svc2:
+        override: replace
+        command: sleep 300
+        log-encoding: utf-16le
+        log-files:
+            - /var/log/svc2/*.log
+`
+
+func (s *apiSuite) validateLogging(c *C, query string) (int, []map[string]interface{}) {
+	req, err := http.NewRequest("GET", "/v1/validate/logging?"+query, nil)
+	c.Assert(err, IsNil)
+	rsp := v1GetValidateLogging(apiCmd("/v1/validate/logging"), req, nil).(*resp)
+	rec := httptest.NewRecorder()
+	rsp.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		return rec.Code, nil
+	}
+
+	var body struct {
+		Result []map[string]interface{} `json:"result"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &body)
+	c.Assert(err, IsNil)
+	return rec.Code, body.Result
+}
+
+func (s *apiSuite) TestValidateLogging(c *C) {
+	writeTestLayer(s.pebbleDir, validateLoggingLayer)
+	s.daemon(c)
+
+	code, reports := s.validateLogging(c, "")
+	c.Assert(code, Equals, 200)
+	c.Assert(reports, HasLen, 2)
+	c.Check(reports[0]["service"], Equals, "svc1")
+	c.Check(reports[0]["stages"], DeepEquals, []interface{}{"format", "buffer"})
+	c.Check(reports[0]["warnings"], IsNil)
+	c.Assert(reports[0]["sample"], HasLen, 3)
+	c.Check(reports[0]["sample"].([]interface{})[0], Matches, `\S+ \[svc1\] sample line 1: plain ASCII output`)
+	c.Check(reports[1]["service"], Equals, "svc2")
+	c.Check(reports[1]["stages"], DeepEquals, []interface{}{"decode", "format", "buffer"})
+	c.Check(reports[1]["warnings"], DeepEquals, []interface{}{
+		`log-encoding "utf-16le" isn't applied to the lines read from log-files`,
+	})
+	c.Assert(reports[1]["sample"], HasLen, 3)
+	c.Check(reports[1]["sample"].([]interface{})[1], Matches, `\S+ \[svc2\] sample line 2: UTF-8 output, héllo wörld ✓`)
+
+	code, reports = s.validateLogging(c, "services=svc2")
+	c.Assert(code, Equals, 200)
+	c.Assert(reports, HasLen, 1)
+	c.Check(reports[0]["service"], Equals, "svc2")
+
+	code, _ = s.validateLogging(c, "services=svc1,nosvc")
+	c.Check(code, Equals, 404)
+}
@@ -65,6 +65,19 @@ type Options struct {
 	// ServiceOuput is an optional io.Writer for the service log output, if set, all services
 	// log output will be written to the writer.
 	ServiceOutput io.Writer
+
+	// LogMemoryLimit is an optional limit on the total memory used by the
+	// log buffers of all services, in bytes. Zero means no limit.
+	LogMemoryLimit int64
+
+	// LogBurstReserve is an optional size, in bytes, of a reserve of memory
+	// services' log buffers may borrow from during bursts. Zero means no
+	// reserve.
+	LogBurstReserve int64
+
+	// TraceLogLatency enables measuring the latency of services' log
+	// lines, reported in the metrics.
+	TraceLogLatency bool
 }
 
 // A Daemon listens for requests and routes them to the right command
@@ -84,6 +97,9 @@ type Daemon struct {
 	router              *mux.Router
 	standbyOpinions     *standby.StandbyOpinions
 
+	// identities maps local user IDs to their configured access level
+	identities map[uint32]identityAccess
+
 	// set to remember we need to restart the system
 	restartSystem bool
 
@@ -97,6 +113,12 @@ type Daemon struct {
 	rebootIsMissing bool
 
 	mu sync.Mutex
+
+	// reloadMu serializes layer reloads, and reloadChange is the replan
+	// change made by the last one
+	reloadMu      sync.Mutex
+	reloadChange  *state.Change
+	reloadSignals chan os.Signal
 }
 
 // XXX Placeholder for now.
@@ -128,11 +150,13 @@ const (
 	accessOK accessResult = iota
 	accessUnauthorized
 	accessForbidden
+	accessAdminRequired
 )
 
 // canAccess checks the following properties:
 //
 // - if the user is `root` everything is allowed
+// - if the user has an "admin" identity everything is allowed
 // - if a user is logged in and the command doesn't have AdminOnly, everything is allowed
 // - POST/PUT/DELETE all require the admin, or just login if not AdminOnly
 //
@@ -141,6 +165,11 @@ const (
 // - UserOK: any uid on the local system can access GET
 // - AdminOnly: only the administrator can access this
 // - UntrustedOK: can access this via the untrusted socket
+//
+// Once identities are configured, UserOK only lets users with an identity
+// access GET (besides root and the daemon's own user): those with a "read"
+// identity may do no more, and are told that admin access is required if
+// they attempt anything else.
 func (c *Command) canAccess(r *http.Request, user *userState) accessResult {
 	if c.AdminOnly && (c.UserOK || c.GuestOK || c.UntrustedOK) {
 		logger.Panicf("internal error: command cannot have AdminOnly together with any *OK flag")
@@ -180,7 +209,7 @@ func (c *Command) canAccess(r *http.Request, user *userState) accessResult {
 			return accessOK
 		}
 
-		if isUser && c.UserOK {
+		if isUser && c.UserOK && (len(c.d.identities) == 0 || c.d.identities[uid] != "") {
 			return accessOK
 		}
 	}
@@ -195,6 +224,13 @@ func (c *Command) canAccess(r *http.Request, user *userState) accessResult {
 		return accessOK
 	}
 
+	switch c.d.identities[uid] {
+	case adminAccess:
+		return accessOK
+	case readAccess:
+		return accessAdminRequired
+	}
+
 	if c.AdminOnly {
 		return accessUnauthorized
 	}
@@ -231,6 +267,14 @@ func (c *Command) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case accessForbidden:
 		statusForbidden("forbidden").ServeHTTP(w, r)
 		return
+	case accessAdminRequired:
+		rsp := &resp{
+			Type:   ResponseTypeError,
+			Result: &errorResult{Kind: errorKindAdminRequired, Message: "admin access required"},
+			Status: 403,
+		}
+		rsp.ServeHTTP(w, r)
+		return
 	}
 
 	var rspf ResponseFunc
@@ -457,6 +501,12 @@ func (d *Daemon) Start() {
 
 	d.overlord.Loop()
 
+	// Reload layers on SIGHUP. The channel has room for only one signal,
+	// so that signals received during a reload are coalesced into one more.
+	d.reloadSignals = make(chan os.Signal, 1)
+	signal.Notify(d.reloadSignals, syscall.SIGHUP)
+	d.tomb.Go(d.handleReloadSignals)
+
 	d.tomb.Go(func() error {
 		if d.untrustedListener != nil {
 			d.tomb.Go(func() error {
@@ -511,6 +561,75 @@ var (
 
 var shutdownTimeout = 25 * time.Second
 
+// outputDrainTimeout is how long Stop waits for service logs to be written
+// to pebble's output.
+var outputDrainTimeout = 5 * time.Second
+
+func (d *Daemon) handleReloadSignals() error {
+	for {
+		select {
+		case <-d.reloadSignals:
+			logger.Noticef("Reloading layers on SIGHUP signal.")
+			// Errors are logged by ReloadLayers.
+			_, _ = d.ReloadLayers()
+		case <-d.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+// ReloadLayers re-reads the layers directory and replans, as happens when the
+// daemon receives SIGHUP. If the new layers are invalid, the current plan is
+// kept and the error returned. If the replan change from the previous reload
+// is still in progress, it waits for that to finish first.
+//
+// It returns the ID of the replan change, or "" if no services needed to be
+// stopped, started or reloaded.
+func (d *Daemon) ReloadLayers() (changeID string, err error) {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+
+	if d.reloadChange != nil {
+		select {
+		case <-d.reloadChange.Ready():
+		case <-d.tomb.Dying():
+			return "", fmt.Errorf("daemon is stopping")
+		}
+	}
+
+	servmgr := overlordServiceManager(d.overlord)
+	summary, err := servmgr.ReloadLayers()
+	if err != nil {
+		logger.Noticef("Cannot reload layers, keeping current plan: %v", err)
+		return "", err
+	}
+	if summary == "" {
+		summary = "no changes"
+	}
+	logger.Noticef("Reloaded layers: %s", summary)
+
+	st := d.overlord.State()
+	st.Lock()
+	defer st.Unlock()
+	taskSet, services, err := replanTasks(st, servmgr)
+	if err != nil {
+		logger.Noticef("Cannot replan after reloading layers: %v", err)
+		return "", err
+	}
+	if len(services) == 0 {
+		return "", nil
+	}
+	var changeSummary string
+	if len(services) == 1 {
+		changeSummary = fmt.Sprintf("Replan service %q", services[0])
+	} else {
+		changeSummary = fmt.Sprintf("Replan service %q and %d more", services[0], len(services)-1)
+	}
+	d.reloadChange = newChange(st, "replan", changeSummary, []*state.TaskSet{taskSet}, services)
+	stateEnsureBefore(st, 0)
+	return d.reloadChange.ID(), nil
+}
+
 // Stop shuts down the Daemon.
 func (d *Daemon) Stop(sigCh chan<- os.Signal) error {
 	if d.rebootIsMissing {
@@ -522,6 +641,9 @@ func (d *Daemon) Stop(sigCh chan<- os.Signal) error {
 	}
 
 	d.tomb.Kill(nil)
+	if d.reloadSignals != nil {
+		signal.Stop(d.reloadSignals)
+	}
 
 	d.mu.Lock()
 	restartSystem := d.restartSystem
@@ -567,6 +689,15 @@ func (d *Daemon) Stop(sigCh chan<- os.Signal) error {
 	}
 	d.overlord.Stop()
 
+	// Copy any service logs that haven't been written to pebble's output
+	// yet, but don't let a blocked output hold up the shutdown.
+	ctx, cancel = context.WithTimeout(context.Background(), outputDrainTimeout)
+	dropped := d.overlord.ServiceManager().DrainOutput(ctx)
+	cancel()
+	for name, n := range dropped {
+		logger.Noticef("Cannot write logs of service %q to output before exiting: %d bytes dropped", name, n)
+	}
+
 	err := d.tomb.Wait()
 	if err != nil {
 		// do not stop the shutdown even if the tomb errors
@@ -708,6 +839,12 @@ func New(opts *Options) (*Daemon, error) {
 		untrustedSocketPath: opts.SocketPath + ".untrusted",
 	}
 
+	identities, err := loadIdentities(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	d.identities = identities
+
 	ovld, err := overlord.New(opts.Dir, d, opts.ServiceOutput)
 	if err == errExpectedReboot {
 		// we proceed without overlord until we reach Stop
@@ -722,6 +859,9 @@ func New(opts *Options) (*Daemon, error) {
 	}
 	d.overlord = ovld
 	d.state = ovld.State()
+	ovld.ServiceManager().SetLogMemoryLimit(opts.LogMemoryLimit)
+	ovld.ServiceManager().SetLogBurstReserve(opts.LogBurstReserve)
+	ovld.ServiceManager().SetLogLatencyTracing(opts.TraceLogLatency)
 	return d, nil
 }
 
@@ -15,14 +15,17 @@
 package daemon
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sync"
 	"syscall"
 	"testing"
@@ -35,9 +38,11 @@ import (
 	// XXX Delete import above and make this file like the other ones.
 	. "gopkg.in/check.v1"
 
+	"github.com/canonical/pebble/internal/logger"
 	"github.com/canonical/pebble/internal/osutil"
 	"github.com/canonical/pebble/internal/overlord/patch"
 	"github.com/canonical/pebble/internal/overlord/restart"
+	"github.com/canonical/pebble/internal/overlord/servstate"
 	"github.com/canonical/pebble/internal/overlord/standby"
 	"github.com/canonical/pebble/internal/overlord/state"
 	"github.com/canonical/pebble/internal/systemd"
@@ -45,7 +50,17 @@ import (
 )
 
 // Hook up check.v1 into the "go test" runner
-func Test(t *testing.T) { check.TestingT(t) }
+func Test(t *testing.T) {
+	// The logger is set once, before any daemon goroutines are running,
+	// as some of them (such as the checks of daemons that are never
+	// stopped) outlive the test that started them. The logs are kept in
+	// testLog too, for tests to check.
+	logger.SetLogger(logger.New(io.MultiWriter(os.Stderr, testLog), "[test] "))
+	check.TestingT(t)
+}
+
+// testLog holds the daemon's logs during the tests.
+var testLog = &lockedBuffer{}
 
 type daemonSuite struct {
 	pebbleDir       string
@@ -331,6 +346,43 @@ func (s *daemonSuite) TestUserAccess(c *check.C) {
 	c.Check(cmd.canAccess(put, nil), check.Equals, accessUnauthorized)
 }
 
+func (s *daemonSuite) TestIdentityUserAccess(c *check.C) {
+	d := s.newDaemon(c)
+	d.identities = map[uint32]identityAccess{
+		42: readAccess,
+		43: adminAccess,
+	}
+
+	request := func(method string, uid int) *http.Request {
+		return &http.Request{Method: method, RemoteAddr: fmt.Sprintf("pid=100;uid=%d;socket=;", uid)}
+	}
+
+	// A read identity may only GET from UserOK (and GuestOK) endpoints.
+	cmd := &Command{d: d, UserOK: true}
+	c.Check(cmd.canAccess(request("GET", 42), nil), check.Equals, accessOK)
+	c.Check(cmd.canAccess(request("POST", 42), nil), check.Equals, accessAdminRequired)
+	c.Check(cmd.canAccess(request("PUT", 42), nil), check.Equals, accessAdminRequired)
+	cmd = &Command{d: d, GuestOK: true}
+	c.Check(cmd.canAccess(request("GET", 42), nil), check.Equals, accessOK)
+	c.Check(cmd.canAccess(request("POST", 42), nil), check.Equals, accessAdminRequired)
+	cmd = &Command{d: d, AdminOnly: true}
+	c.Check(cmd.canAccess(request("GET", 42), nil), check.Equals, accessAdminRequired)
+	c.Check(cmd.canAccess(request("POST", 42), nil), check.Equals, accessAdminRequired)
+
+	// An admin identity may do anything.
+	for _, cmd := range []*Command{{d: d, UserOK: true}, {d: d, AdminOnly: true}} {
+		c.Check(cmd.canAccess(request("GET", 43), nil), check.Equals, accessOK)
+		c.Check(cmd.canAccess(request("POST", 43), nil), check.Equals, accessOK)
+	}
+
+	// Other users only get guest access once there are identities.
+	cmd = &Command{d: d, UserOK: true}
+	c.Check(cmd.canAccess(request("GET", 44), nil), check.Equals, accessUnauthorized)
+	c.Check(cmd.canAccess(request("POST", 44), nil), check.Equals, accessUnauthorized)
+	cmd = &Command{d: d, GuestOK: true}
+	c.Check(cmd.canAccess(request("GET", 44), nil), check.Equals, accessOK)
+}
+
 func (s *daemonSuite) TestLoggedInUserAccess(c *check.C) {
 	d := s.newDaemon(c)
 
@@ -1047,3 +1099,129 @@ func (s *daemonSuite) TestDegradedModeReply(c *check.C) {
 	rec = doTestReq(c, cmd, "POST")
 	c.Check(rec.Code, check.Equals, 200)
 }
+
+// lockedBuffer is a bytes.Buffer that can be read while the daemon's
+// goroutines are logging to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func (s *daemonSuite) TestReloadLayersOnSIGHUP(c *check.C) {
+	testLog.Reset()
+
+	writeTestLayer(s.pebbleDir, `
+services:
+    svc1:
+        override: replace
+        command: sleep 10
+        startup: enabled
+`)
+	d := s.newDaemon(c)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	d.generalListener = l
+	d.Start()
+	defer d.Stop(nil)
+
+	servmgr := d.overlord.ServiceManager()
+	waitActive := func(names ...string) {
+		for i := 0; ; i++ {
+			infos, err := servmgr.Services(names)
+			c.Assert(err, check.IsNil)
+			active := len(infos) == len(names)
+			for _, info := range infos {
+				active = active && info.Current == servstate.StatusActive
+			}
+			if active {
+				return
+			}
+			if i >= 500 {
+				c.Fatalf("timed out waiting for services %v to be active", names)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitLog := func(pattern string) {
+		for i := 0; !regexp.MustCompile(pattern).MatchString(testLog.String()); i++ {
+			if i >= 500 {
+				c.Fatalf("timed out waiting for log matching %q", pattern)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	defer func() {
+		st := d.overlord.State()
+		st.Lock()
+		taskSet, err := servstate.Stop(st, []string{"svc1", "svc2"})
+		c.Assert(err, check.IsNil)
+		chg := st.NewChange("stop", "Stop services")
+		chg.AddAll(taskSet)
+		st.EnsureBefore(0)
+		st.Unlock()
+		<-chg.Ready()
+	}()
+
+	// Replan with the unchanged layers starts the enabled service.
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	c.Assert(err, check.IsNil)
+	waitActive("svc1")
+	waitLog(`Reloaded layers: no changes`)
+
+	// A new layer file is picked up, and its service started.
+	err = ioutil.WriteFile(filepath.Join(s.pebbleDir, "layers", "002-extra.yaml"), []byte(`
+services:
+    svc2:
+        override: replace
+        command: sleep 10
+        startup: enabled
+`), 0644)
+	c.Assert(err, check.IsNil)
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	c.Assert(err, check.IsNil)
+	waitActive("svc1", "svc2")
+	waitLog(`Reloaded layers: services added: svc2`)
+
+	// An invalid layer is rejected, keeping the current plan and leaving
+	// the services running.
+	st := d.overlord.State()
+	st.Lock()
+	numChanges := len(st.Changes())
+	st.Unlock()
+	err = ioutil.WriteFile(filepath.Join(s.pebbleDir, "layers", "003-bad.yaml"), []byte(`
+services:
+    svc1:
+        command: sleep 20
+`), 0644)
+	c.Assert(err, check.IsNil)
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	c.Assert(err, check.IsNil)
+	waitLog(`Cannot reload layers, keeping current plan: layer "bad" must define "override" for service "svc1"`)
+
+	p, err := servmgr.Plan()
+	c.Assert(err, check.IsNil)
+	c.Check(p.Layers, check.HasLen, 2)
+	c.Check(p.Services["svc1"].Command, check.Equals, "sleep 10")
+	waitActive("svc1", "svc2")
+	st.Lock()
+	c.Check(st.Changes(), check.HasLen, numChanges)
+	st.Unlock()
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// identitiesFile is the name of the file in the pebble directory that
+// configures which local users may access the API, and at what level.
+const identitiesFile = "identities.yaml"
+
+// identityAccess is the level of API access granted to an identity.
+type identityAccess string
+
+const (
+	// readAccess allows read-only (GET) access to the endpoints that
+	// normal users may read.
+	readAccess identityAccess = "read"
+
+	// adminAccess allows full access to the API, as for root.
+	adminAccess identityAccess = "admin"
+)
+
+type identitiesConfig struct {
+	Identities map[string]*identity `yaml:"identities"`
+}
+
+type identity struct {
+	Access identityAccess `yaml:"access"`
+	Local  *localIdentity `yaml:"local"`
+}
+
+// localIdentity identifies a client connecting over the unix socket by the
+// user ID of the peer process.
+type localIdentity struct {
+	UserID *uint32 `yaml:"user-id"`
+}
+
+// loadIdentities reads the identities file in pebbleDir, returning the
+// access level for each configured user ID. It's not an error for the file
+// to be missing.
+func loadIdentities(pebbleDir string) (map[uint32]identityAccess, error) {
+	path := filepath.Join(pebbleDir, identitiesFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	identities, err := parseIdentities(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load identities from %q: %v", path, err)
+	}
+	return identities, nil
+}
+
+func parseIdentities(data []byte) (map[uint32]identityAccess, error) {
+	var config identitiesConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&config)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	identities := make(map[uint32]identityAccess, len(config.Identities))
+	names := make(map[uint32]string, len(config.Identities))
+	for name, ident := range config.Identities {
+		if ident == nil {
+			return nil, fmt.Errorf("identity %q must not be empty", name)
+		}
+		switch ident.Access {
+		case readAccess, adminAccess:
+		case "":
+			return nil, fmt.Errorf("identity %q must have an access level", name)
+		default:
+			return nil, fmt.Errorf("identity %q has invalid access level %q, must be %q or %q",
+				name, ident.Access, readAccess, adminAccess)
+		}
+		if ident.Local == nil || ident.Local.UserID == nil {
+			return nil, fmt.Errorf("identity %q must have a local user-id", name)
+		}
+		uid := *ident.Local.UserID
+		if other, ok := names[uid]; ok {
+			first, second := other, name
+			if second < first {
+				first, second = second, first
+			}
+			return nil, fmt.Errorf("identities %q and %q have the same user-id %d", first, second, uid)
+		}
+		names[uid] = name
+		identities[uid] = ident.Access
+	}
+	return identities, nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/osutil/sys"
+)
+
+const testIdentities = `
+identities:
+    alice:
+        access: admin
+        local:
+            user-id: 1000
+    bob:
+        access: read
+        local:
+            user-id: 1001
+`
+
+func (s *daemonSuite) TestLoadIdentities(c *C) {
+	identities, err := loadIdentities(s.pebbleDir)
+	c.Assert(err, IsNil)
+	c.Check(identities, HasLen, 0)
+
+	err = ioutil.WriteFile(filepath.Join(s.pebbleDir, "identities.yaml"), []byte(testIdentities), 0600)
+	c.Assert(err, IsNil)
+	identities, err = loadIdentities(s.pebbleDir)
+	c.Assert(err, IsNil)
+	c.Check(identities, DeepEquals, map[uint32]identityAccess{
+		1000: adminAccess,
+		1001: readAccess,
+	})
+}
+
+func (s *daemonSuite) TestLoadIdentitiesErrors(c *C) {
+	for _, test := range []struct {
+		yaml  string
+		error string
+	}{{
+		yaml:  "identities:\n    alice:\n",
+		error: `identity "alice" must not be empty`,
+	}, {
+		yaml:  "identities:\n    alice:\n        local: {user-id: 1000}\n",
+		error: `identity "alice" must have an access level`,
+	}, {
+		yaml:  "identities:\n    alice:\n        access: root\n        local: {user-id: 1000}\n",
+		error: `identity "alice" has invalid access level "root", must be "read" or "admin"`,
+	}, {
+		yaml:  "identities:\n    alice:\n        access: read\n",
+		error: `identity "alice" must have a local user-id`,
+	}, {
+		yaml:  "identities:\n    alice:\n        access: read\n        local: {}\n",
+		error: `identity "alice" must have a local user-id`,
+	}, {
+		yaml: "identities:\n    alice:\n        access: read\n        local: {user-id: 1000}\n" +
+			"    bob:\n        access: admin\n        local: {user-id: 1000}\n",
+		error: `identities "alice" and "bob" have the same user-id 1000`,
+	}, {
+		yaml:  "identities:\n    alice:\n        access: read\n        foo: bar\n",
+		error: `(?s).*field foo not found.*`,
+	}} {
+		err := ioutil.WriteFile(filepath.Join(s.pebbleDir, "identities.yaml"), []byte(test.yaml), 0600)
+		c.Assert(err, IsNil)
+		_, err = loadIdentities(s.pebbleDir)
+		c.Check(err, ErrorMatches, `cannot load identities from ".*": `+test.error, Commentf(test.yaml))
+
+		_, err = New(&Options{Dir: s.pebbleDir, SocketPath: s.socketPath})
+		c.Check(err, NotNil)
+	}
+}
+
+func (s *daemonSuite) TestIdentityAccess(c *C) {
+	restore := FakeGetuid(func() sys.UserID { return 4242 })
+	defer restore()
+
+	err := ioutil.WriteFile(filepath.Join(s.pebbleDir, "identities.yaml"), []byte(testIdentities), 0600)
+	c.Assert(err, IsNil)
+	d := s.newDaemon(c)
+
+	type result struct {
+		Status int
+		Kind   string
+	}
+	request := func(uid, method, path string) result {
+		// Use an invalid body, so that allowed POST requests fail
+		// harmlessly after the access checks.
+		req, err := http.NewRequest(method, path, strings.NewReader("@"))
+		c.Assert(err, IsNil)
+		req.RemoteAddr = "pid=100;uid=" + uid + ";socket=;"
+		rec := httptest.NewRecorder()
+		d.router.ServeHTTP(rec, req)
+		res := result{Status: rec.Code}
+		if rec.Code >= 400 {
+			var rsp struct {
+				Result errorResult `json:"result"`
+			}
+			c.Assert(json.Unmarshal(rec.Body.Bytes(), &rsp), IsNil)
+			res.Kind = string(rsp.Result.Kind)
+		}
+		return res
+	}
+
+	reads := []string{"/v1/services", "/v1/changes", "/v1/plan?format=yaml", "/v1/checks", "/v1/warnings"}
+	writes := []string{"/v1/services", "/v1/layers", "/v1/signals", "/v1/warnings"}
+
+	// Admin identity can do anything.
+	for _, path := range reads {
+		c.Check(request("1000", "GET", path).Status, Equals, 200, Commentf(path))
+	}
+	for _, path := range writes {
+		res := request("1000", "POST", path)
+		c.Check(res.Status, Equals, 400, Commentf(path))
+	}
+
+	// Read identity can read, and is told it needs admin access to write.
+	for _, path := range reads {
+		c.Check(request("1001", "GET", path).Status, Equals, 200, Commentf(path))
+	}
+	for _, path := range writes {
+		res := request("1001", "POST", path)
+		c.Check(res.Status, Equals, 403, Commentf(path))
+		c.Check(res.Kind, Equals, "admin-required", Commentf(path))
+	}
+
+	// Users without an identity may no longer read once identities are
+	// configured, nor write.
+	for _, path := range reads {
+		res := request("1002", "GET", path)
+		c.Check(res.Status, Equals, 401, Commentf(path))
+		c.Check(res.Kind, Equals, "login-required", Commentf(path))
+	}
+	c.Check(request("1002", "GET", "/v1/system-info").Status, Equals, 200)
+	for _, path := range writes {
+		res := request("1002", "POST", path)
+		c.Check(res.Status, Equals, 401, Commentf(path))
+		c.Check(res.Kind, Equals, "login-required", Commentf(path))
+	}
+
+	// The daemon's own user can still do anything.
+	for _, path := range reads {
+		c.Check(request("4242", "GET", path).Status, Equals, 200, Commentf(path))
+	}
+
+	// Root can always do anything.
+	for _, path := range writes {
+		c.Check(request("0", "POST", path).Status, Equals, 400, Commentf(path))
+	}
+}
@@ -123,7 +123,9 @@ const (
 	errorKindNoDefaultServices = errorKind("no-default-services")
 	errorKindNotFound          = errorKind("not-found")
 	errorKindPermissionDenied  = errorKind("permission-denied")
+	errorKindAdminRequired     = errorKind("admin-required")
 	errorKindGenericFileError  = errorKind("generic-file-error")
+	errorKindInvalidLayer      = errorKind("invalid-layer")
 )
 
 type errorValue interface{}
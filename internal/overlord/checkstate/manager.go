@@ -145,13 +145,31 @@ func (m *CheckManager) Checks(level plan.CheckLevel, names []string) ([]*CheckIn
 	return infos, nil
 }
 
+// CheckStatus returns when the named check was last run and its number of
+// consecutive failures, or ok false if there's no such check.
+func (m *CheckManager) CheckStatus(name string) (lastRun time.Time, failures int, ok bool) {
+	m.mutex.Lock()
+	check, ok := m.checks[name]
+	m.mutex.Unlock()
+	if !ok {
+		return time.Time{}, 0, false
+	}
+	info := check.info()
+	return info.LastRun, info.Failures, true
+}
+
 // CheckInfo provides status information about a single check.
 type CheckInfo struct {
 	Name         string
+	Level        plan.CheckLevel
 	Healthy      bool
 	Failures     int
 	LastError    string
 	ErrorDetails string
+
+	// LastRun is the time the check was last run, or zero if it hasn't
+	// run yet.
+	LastRun time.Time
 }
 
 // checkData holds state for an active health check.
@@ -166,6 +184,7 @@ type checkData struct {
 	failures  int
 	actionRan bool
 	lastErr   error
+	lastRun   time.Time
 }
 
 type checker interface {
@@ -195,6 +214,8 @@ func (c *checkData) loop() {
 }
 
 func (c *checkData) runCheck() {
+	start := time.Now()
+
 	// Run the check with a timeout.
 	ctx, cancel := context.WithTimeout(c.ctx, c.config.Timeout.Value)
 	defer cancel()
@@ -204,6 +225,7 @@ func (c *checkData) runCheck() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	c.lastRun = start
 	if err == nil {
 		// Successful check
 		c.lastErr = nil
@@ -238,8 +260,10 @@ func (c *checkData) info() *CheckInfo {
 
 	info := &CheckInfo{
 		Name:     c.config.Name,
+		Level:    c.config.Level,
 		Healthy:  c.failures < c.config.Threshold,
 		Failures: c.failures,
+		LastRun:  c.lastRun,
 	}
 	if c.lastErr != nil {
 		info.LastError = c.lastErr.Error()
@@ -78,7 +78,7 @@ func (s *ManagerSuite) TestChecks(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(checks, DeepEquals, []*CheckInfo{
 		{Name: "chk1", Healthy: true},
-		{Name: "chk2", Healthy: true},
+		{Name: "chk2", Level: plan.AliveLevel, Healthy: true},
 		{Name: "chk3", Healthy: true},
 	})
 
@@ -86,14 +86,14 @@ func (s *ManagerSuite) TestChecks(c *C) {
 	checks, err = mgr.Checks(plan.AliveLevel, nil)
 	c.Assert(err, IsNil)
 	c.Assert(checks, DeepEquals, []*CheckInfo{
-		{Name: "chk2", Healthy: true},
+		{Name: "chk2", Level: plan.AliveLevel, Healthy: true},
 	})
 
 	// Check names filter works
 	checks, err = mgr.Checks("", []string{"chk3", "chk2"})
 	c.Assert(err, IsNil)
 	c.Assert(checks, DeepEquals, []*CheckInfo{
-		{Name: "chk2", Healthy: true},
+		{Name: "chk2", Level: plan.AliveLevel, Healthy: true},
 		{Name: "chk3", Healthy: true},
 	})
 
@@ -101,7 +101,7 @@ func (s *ManagerSuite) TestChecks(c *C) {
 	checks, err = mgr.Checks(plan.AliveLevel, []string{"chk3", "chk2"})
 	c.Assert(err, IsNil)
 	c.Assert(checks, DeepEquals, []*CheckInfo{
-		{Name: "chk2", Healthy: true},
+		{Name: "chk2", Level: plan.AliveLevel, Healthy: true},
 	})
 
 	// Re-configuring should update checks
@@ -242,6 +242,7 @@ func (s *ManagerSuite) TestFailures(c *C) {
 	})
 	c.Assert(check.Healthy, Equals, true)
 	c.Assert(check.LastError, Matches, "exit status 1")
+	c.Assert(check.LastRun.IsZero(), Equals, false)
 	c.Assert(failureName, Equals, "")
 
 	// Shouldn't have called failure handler after only 2 failures
@@ -269,6 +270,13 @@ func (s *ManagerSuite) TestFailures(c *C) {
 	c.Assert(check.Failures, Equals, 0)
 	c.Assert(check.LastError, Equals, "")
 	c.Assert(failureName, Equals, "")
+
+	lastRun, failures, ok := mgr.CheckStatus("chk1")
+	c.Assert(ok, Equals, true)
+	c.Assert(lastRun.IsZero(), Equals, false)
+	c.Assert(failures, Equals, 0)
+	_, _, ok = mgr.CheckStatus("chk2")
+	c.Assert(ok, Equals, false)
 }
 
 func waitCheck(c *C, mgr *CheckManager, name string, f func(check *CheckInfo) bool) *CheckInfo {
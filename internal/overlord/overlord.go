@@ -33,6 +33,7 @@ import (
 	"github.com/canonical/pebble/internal/overlord/restart"
 	"github.com/canonical/pebble/internal/overlord/servstate"
 	"github.com/canonical/pebble/internal/overlord/state"
+	"github.com/canonical/pebble/internal/overlord/timerstate"
 	"github.com/canonical/pebble/internal/strutil"
 	"github.com/canonical/pebble/internal/timing"
 )
@@ -68,6 +69,7 @@ type Overlord struct {
 	serviceMgr *servstate.ServiceManager
 	commandMgr *cmdstate.CommandManager
 	checkMgr   *checkstate.CheckManager
+	timerMgr   *timerstate.TimerManager
 }
 
 // New creates a new Overlord with all its state managers.
@@ -122,6 +124,14 @@ func New(pebbleDir string, restartHandler restart.Handler, serviceOutput io.Writ
 	// Tell service manager about check failures.
 	o.checkMgr.NotifyCheckFailed(o.serviceMgr.CheckFailed)
 
+	// Let service manager wait for checks to pass after a reload.
+	o.serviceMgr.SetCheckStatusFunc(o.checkMgr.CheckStatus)
+
+	o.timerMgr = timerstate.NewManager(s)
+
+	// Tell timer manager about plan updates.
+	o.serviceMgr.NotifyPlanChanged(o.timerMgr.PlanChanged)
+
 	// the shared task runner should be added last!
 	o.stateEng.AddManager(o.runner)
 
@@ -407,6 +417,12 @@ func (o *Overlord) CheckManager() *checkstate.CheckManager {
 	return o.checkMgr
 }
 
+// TimerManager returns the timer manager responsible for running scheduled
+// commands under the overlord.
+func (o *Overlord) TimerManager() *timerstate.TimerManager {
+	return o.timerMgr
+}
+
 // Fake creates an Overlord without any managers and with a backend
 // not using disk. Managers can be added with AddManager. For testing.
 func Fake() *Overlord {
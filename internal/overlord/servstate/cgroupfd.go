@@ -0,0 +1,49 @@
+//go:build go1.20 && linux
+// +build go1.20,linux
+
+package servstate
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/pebble/internal/cgroup"
+)
+
+// startInCgroup sets cmd up to start its process in group, so that
+// anything the process forks is covered by the group's limits too. It
+// returns the group's directory, to be closed once the process has
+// started, or nil if the process can't be started in the group, and must
+// be moved into it once started instead.
+func startInCgroup(cmd *exec.Cmd, group *cgroup.Group) *os.File {
+	if !kernelAtLeast(5, 7) {
+		// CLONE_INTO_CGROUP was added in Linux 5.7, and os/exec
+		// doesn't fall back to starting the process without it.
+		return nil
+	}
+	dir, err := group.Open()
+	if err != nil {
+		return nil
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return dir
+}
+
+// kernelAtLeast reports whether the running kernel's version is at least
+// major.minor.
+func kernelAtLeast(major, minor int) bool {
+	var uts unix.Utsname
+	if unix.Uname(&uts) != nil {
+		return false
+	}
+	var kernelMajor, kernelMinor int
+	_, err := fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &kernelMajor, &kernelMinor)
+	if err != nil {
+		return false
+	}
+	return kernelMajor > major || kernelMajor == major && kernelMinor >= minor
+}
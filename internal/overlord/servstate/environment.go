@@ -0,0 +1,146 @@
+package servstate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/canonical/pebble/internal/plan"
+)
+
+// serviceEnvironment returns the environment variables to set for the
+// service's processes. Variables are loaded from the service's environment
+// files in order, then from its inline environment (reading any file
+// references), with later values overriding earlier ones.
+//
+// The values may be secrets, so errors never include them.
+func serviceEnvironment(config *plan.Service) (map[string]string, error) {
+	env := make(map[string]string)
+	for _, entry := range config.EnvironmentFiles {
+		path, optional := plan.EnvironmentFilePath(entry)
+		data, err := ioutil.ReadFile(path)
+		if optional && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read environment file: %w", err)
+		}
+		vars, err := parseEnvFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse environment file %q: %w", path, err)
+		}
+		for k, v := range vars {
+			env[k] = v
+		}
+	}
+	for k, v := range config.Environment {
+		if v.File == "" {
+			env[k] = v.Value
+			continue
+		}
+		data, err := ioutil.ReadFile(v.File)
+		if v.Optional && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read environment variable %q: %w", k, err)
+		}
+		env[k] = strings.TrimSpace(string(data))
+	}
+	return env, nil
+}
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnvFile parses the contents of a dotenv-style environment file: one
+// KEY=VALUE per line, with optional "export " prefixes, blank lines and
+// "#" comments. Values may be single-quoted (taken literally) or
+// double-quoted (with \n, \t, \" and \\ escapes). CRLF line endings are
+// accepted.
+func parseEnvFile(data []byte) (map[string]string, error) {
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(strings.TrimSuffix(scanner.Text(), "\r"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		equals := strings.IndexByte(line, '=')
+		if equals < 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNum)
+		}
+		key := strings.TrimSpace(line[:equals])
+		if !envNameRegexp.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid variable name", lineNum)
+		}
+		value, err := parseEnvValue(strings.TrimSpace(line[equals+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		env[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// parseEnvValue parses the (already trimmed) value part of an environment
+// file line. Error messages must not include the value itself.
+func parseEnvValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	var value, rest string
+	switch s[0] {
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single-quoted value")
+		}
+		value, rest = s[1:end+1], s[end+2:]
+	case '"':
+		var b strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' || i+1 == len(s) {
+				b.WriteByte(s[i])
+				continue
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\':
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			}
+		}
+		if i == len(s) {
+			return "", fmt.Errorf("unterminated double-quoted value")
+		}
+		value, rest = b.String(), s[i+1:]
+	default:
+		// Unquoted values end at a comment preceded by whitespace.
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSpace(s), nil
+	}
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected text after quoted value")
+	}
+	return value, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package servstate_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/overlord/servstate"
+)
+
+var parseEnvFileTests = []struct {
+	data  string
+	env   map[string]string
+	error string
+}{{
+	data: "",
+	env:  map[string]string{},
+}, {
+	data: "A=1\nB=two words\n",
+	env:  map[string]string{"A": "1", "B": "two words"},
+}, {
+	data: "A=1\r\nB=2\r\n",
+	env:  map[string]string{"A": "1", "B": "2"},
+}, {
+	data: "# comment\n\n  export A = 1 # trailing comment\n",
+	env:  map[string]string{"A": "1"},
+}, {
+	data: "A=1\nA=2\n",
+	env:  map[string]string{"A": "2"},
+}, {
+	data: "EMPTY=\nQUOTED=\"\"\n",
+	env:  map[string]string{"EMPTY": "", "QUOTED": ""},
+}, {
+	data: `A="a \"quoted\" # value\n\twith\\escapes"` + "\r\n",
+	env:  map[string]string{"A": "a \"quoted\" # value\n\twith\\escapes"},
+}, {
+	data: `A='single $quoted \n' # comment`,
+	env:  map[string]string{"A": `single $quoted \n`},
+}, {
+	data: "A=b=c\n",
+	env:  map[string]string{"A": "b=c"},
+}, {
+	data:  "A=1\nsecret\n",
+	error: "line 2: expected KEY=VALUE",
+}, {
+	data:  "1A=secret\n",
+	error: "line 1: invalid variable name",
+}, {
+	data:  `A="secret`,
+	error: "line 1: unterminated double-quoted value",
+}, {
+	data:  `A='secret`,
+	error: "line 1: unterminated single-quoted value",
+}, {
+	data:  `A="secret" secret`,
+	error: "line 1: unexpected text after quoted value",
+}}
+
+func (s *S) TestParseEnvFile(c *C) {
+	for _, test := range parseEnvFileTests {
+		c.Logf("Input: %q", test.data)
+		env, err := servstate.ParseEnvFile([]byte(test.data))
+		if test.error != "" {
+			c.Check(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(env, DeepEquals, test.env)
+	}
+}
@@ -15,15 +15,19 @@
 package servstate
 
 import (
+	"io"
 	"os/exec"
 	"syscall"
 	"time"
 
 	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/servicelog"
 )
 
 var CalculateNextBackoff = calculateNextBackoff
 var GetAction = getAction
+var LastLogs = lastLogs
+var ParseEnvFile = parseEnvFile
 
 func (m *ServiceManager) RunningCmds() map[string]*exec.Cmd {
 	m.servicesLock.Lock()
@@ -60,10 +64,52 @@ func (m *ServiceManager) Config(serviceName string) *plan.Service {
 	return s.config
 }
 
+func (m *ServiceManager) LogWriteError(err error) {
+	m.logWriteError(err)
+}
+
+func FakeLogErrorInterval(interval time.Duration) (restore func()) {
+	old := logErrorInterval
+	logErrorInterval = interval
+	return func() {
+		logErrorInterval = old
+	}
+}
+
+// FakeNoticef sets the function the manager reports log pipeline failures
+// with. It must be called before any services are started.
+func (m *ServiceManager) FakeNoticef(f func(format string, v ...interface{})) {
+	m.noticef = f
+}
+
 func (m *ServiceManager) GetJitter(duration time.Duration) time.Duration {
 	return m.getJitter(duration)
 }
 
+func FakeCgroupRoot(root string) (restore func()) {
+	old := cgroupRoot
+	cgroupRoot = root
+	return func() {
+		cgroupRoot = old
+	}
+}
+
+func FakeWatchdogClock(clock servicelog.Clock) (restore func()) {
+	old := watchdogClock
+	watchdogClock = clock
+	return func() {
+		watchdogClock = old
+	}
+}
+
+func FakeProcRoot(root string) (restore func()) {
+	old := procRoot
+	procRoot = root
+	return func() {
+		procRoot = old
+	}
+}
+
 func FakeOkayWait(wait time.Duration) (restore func()) {
 	old := okayWait
 	okayWait = wait
@@ -72,6 +118,14 @@ func FakeOkayWait(wait time.Duration) (restore func()) {
 	}
 }
 
+func FakeOutputClosedWait(wait time.Duration) (restore func()) {
+	old := outputClosedWait
+	outputClosedWait = wait
+	return func() {
+		outputClosedWait = old
+	}
+}
+
 func FakeKillWait(kill, fail time.Duration) (restore func()) {
 	old1, old2 := killWait, failWait
 	killWait, failWait = kill, fail
@@ -87,3 +141,11 @@ func FakeSetCmdCredential(f func(cmd *exec.Cmd, credential *syscall.Credential))
 		setCmdCredential = old
 	}
 }
+
+func FakeNewDecodeWriter(f func(dest io.Writer, encoding string) io.Writer) (restore func()) {
+	old := newDecodeWriter
+	newDecodeWriter = f
+	return func() {
+		newDecodeWriter = old
+	}
+}
@@ -1,22 +1,31 @@
 package servstate
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
 	"gopkg.in/tomb.v2"
 
+	"github.com/canonical/pebble/internal/cgroup"
 	"github.com/canonical/pebble/internal/logger"
 	"github.com/canonical/pebble/internal/osutil"
 	"github.com/canonical/pebble/internal/overlord/restart"
 	"github.com/canonical/pebble/internal/overlord/state"
 	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/procstat"
 	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/strutil"
 	"github.com/canonical/pebble/internal/strutil/shlex"
 )
 
@@ -51,14 +60,54 @@ func TaskServiceRequest(task *state.Task) (*ServiceRequest, error) {
 }
 
 var (
+	cgroupRoot = cgroup.DefaultRoot
+	procRoot   = procstat.DefaultRoot
+
+	// cgroupRemoveRetries is how many more times removing a service's
+	// cgroup is tried, cgroupRemoveDelay apart, after its processes are
+	// killed.
+	cgroupRemoveRetries = 10
+	cgroupRemoveDelay   = 20 * time.Millisecond
+
+	// watchdogClock times the log-silence watchdog. In tests it's faked
+	// along with the servicelog clock that times the service's output.
+	watchdogClock = servicelog.SystemClock
+
+	defaultHookTimeout = 30 * time.Second
+
+	defaultReloadTimeout = 30 * time.Second
+	reloadPollInterval   = 100 * time.Millisecond
+
 	okayWait = 1 * time.Second
 	killWait = 5 * time.Second
 	failWait = 10 * time.Second
+
+	// outputHandoverWait is how long a service's start waits for the logs
+	// of its previous process to be copied to the output.
+	outputHandoverWait = 1 * time.Second
+
+	// outputClosedWait is how long after a service's output has ended its
+	// process may take to exit before it's noted as still running.
+	outputClosedWait = 1 * time.Second
 )
 
 const (
-	maxLogBytes  = 100 * 1024
-	lastLogLines = 20
+	// Default size of a service's log buffer, if log-buffer-size isn't set.
+	maxLogBytes = 100 * 1024
+
+	// Size that the log buffers of services that aren't running are shrunk
+	// to when the log memory limit is reached.
+	minIdleLogBytes = 4 * 1024
+
+	// Fraction of the log burst reserve a single service's buffer may
+	// borrow, and how long it keeps a loan after it last borrowed.
+	maxLogLoanFraction = 4
+	logLoanDuration    = 30 * time.Second
+
+	// Number of lines (unless configured) and maximum size of the service
+	// output recorded when a service fails.
+	defaultFailureLogLines = 50
+	maxFailureLogBytes     = 16 * 1024
 )
 
 // serviceState represents the state a service's state machine is in.
@@ -81,6 +130,7 @@ type serviceData struct {
 	state       serviceState
 	config      *plan.Service
 	logs        *servicelog.RingBuffer
+	logTracer   *servicelog.Tracer // nil unless log latency is traced
 	started     chan error
 	stopped     chan error
 	cmd         *exec.Cmd
@@ -88,6 +138,53 @@ type serviceData struct {
 	backoffTime time.Duration
 	resetTimer  *time.Timer
 	restarting  bool
+	cgroup      *cgroup.Group
+
+	// restartOnType and restartReason describe why the service is being
+	// restarted when restarting is set.
+	restartOnType string
+	restartReason string
+
+	// watchdogTimer is the log-silence watchdog's timer, if it's set, and
+	// closing watchdogStop stops the goroutine waiting for it.
+	watchdogTimer servicelog.Timer
+	watchdogStop  chan struct{}
+	watchdogStart time.Time
+
+	// processExited is set when the process has exited but after-stop hooks
+	// are still running (before exited is called).
+	processExited bool
+
+	// stateSince is when the service last changed state, and restarts is
+	// the number of times it has been restarted automatically.
+	stateSince time.Time
+	restarts   int
+
+	// args are extra arguments appended to the command, as requested when
+	// the service was last started.
+	args []string
+
+	// generation is the number of times the service's process has been
+	// started, and startTime when it was last started.
+	generation int
+	startTime  time.Time
+
+	// outputFinished is closed when the logs of the service's last process
+	// have been copied to the output.
+	outputFinished <-chan struct{}
+
+	// logPanics is the number of panics in each stage of the service's log
+	// pipeline since the last replan, and logPanicsTotal the number since
+	// the service was first started.
+	logPanicsLock  sync.Mutex
+	logPanics      map[string]int
+	logPanicsTotal int
+
+	// logStages are the stages of the log pipeline of the service's last
+	// process, and logMode how far its guard has fallen back after panics.
+	// They're protected by logPanicsLock too.
+	logStages []string
+	logMode   LogMode
 }
 
 func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
@@ -109,11 +206,25 @@ func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
 	}
 
 	// Create the service object (or reuse the existing one by name).
-	service := m.serviceForStart(task, config)
+	service := m.serviceForStart(task, config, request.Args)
 	if service == nil {
 		return nil
 	}
 
+	// Render the service's files, then run the before-start hooks; if
+	// either fails, don't start the service.
+	err = renderFiles(config)
+	if err != nil {
+		m.removeService(config.Name)
+		return fmt.Errorf("cannot start service: %w", err)
+	}
+	err = runHooks(config, service.logs, "before-start", config.BeforeStart)
+	if err != nil {
+		addLastLogs(task, service.logs, config.FailureLogLines)
+		m.removeService(config.Name)
+		return fmt.Errorf("cannot start service: %w", err)
+	}
+
 	// Start the service and transition to stateStarting.
 	err = service.start()
 	if err != nil {
@@ -126,7 +237,15 @@ func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
 	select {
 	case err := <-service.started:
 		if err != nil {
-			addLastLogs(task, service.logs)
+			addLastLogs(task, service.logs, config.FailureLogLines)
+			// The process has exited, so let its output be copied before
+			// the logs are discarded.
+			if service.outputFinished != nil {
+				select {
+				case <-service.outputFinished:
+				case <-time.After(outputHandoverWait):
+				}
+			}
 			m.removeService(config.Name)
 			return fmt.Errorf("cannot start service: %w", err)
 		}
@@ -149,8 +268,8 @@ func (m *ServiceManager) doStart(task *state.Task, tomb *tomb.Tomb) error {
 // serviceForStart looks up the service by name in the services map; it
 // creates a new service object if one doesn't exist, returns the existing one
 // if it already exists but is stopped, or returns nil if it already exists
-// and is running.
-func (m *ServiceManager) serviceForStart(task *state.Task, config *plan.Service) *serviceData {
+// and is running. The service will be started with the given extra args.
+func (m *ServiceManager) serviceForStart(task *state.Task, config *plan.Service, args []string) *serviceData {
 	m.servicesLock.Lock()
 	defer m.servicesLock.Unlock()
 
@@ -158,12 +277,17 @@ func (m *ServiceManager) serviceForStart(task *state.Task, config *plan.Service)
 	if service == nil {
 		// Not already started, create a new service object.
 		service = &serviceData{
-			manager: m,
-			state:   stateInitial,
-			config:  config.Copy(),
-			logs:    servicelog.NewRingBuffer(maxLogBytes),
-			started: make(chan error, 1),
-			stopped: make(chan error, 2), // enough for killTimeElapsed to send, and exit if it happens after
+			manager:    m,
+			state:      stateInitial,
+			config:     config.Copy(),
+			logs:       m.newLogBuffer(logBufferSize(config)),
+			started:    make(chan error, 1),
+			stopped:    make(chan error, 2), // enough for killTimeElapsed to send, and exit if it happens after
+			stateSince: time.Now(),
+			args:       args,
+		}
+		if m.traceLogLatency {
+			service.logTracer = servicelog.NewTracer()
 		}
 		m.services[config.Name] = service
 		return service
@@ -174,16 +298,23 @@ func (m *ServiceManager) serviceForStart(task *state.Task, config *plan.Service)
 
 	switch service.state {
 	case stateInitial, stateStarting, stateRunning:
-		taskLogf(task, "Service %q already started.", config.Name)
+		if len(args) > 0 {
+			taskLogf(task, "Service %q already started, not applying extra arguments.", config.Name)
+		} else {
+			taskLogf(task, "Service %q already started.", config.Name)
+		}
 		return nil
 	case stateBackoff, stateStopped, stateExited:
 		// Start allowed when service is backing off, was stopped, or has exited.
 		service.backoffNum = 0
 		service.backoffTime = 0
+		service.args = args
 		service.transition(stateInitial)
+		m.resizeLogBuffer(service)
 		return service
 	default:
 		// Cannot start service while terminating or killing, handle in start().
+		service.args = args
 		return service
 	}
 }
@@ -233,6 +364,142 @@ func (m *ServiceManager) doStop(task *state.Task, tomb *tomb.Tomb) error {
 	}
 }
 
+func (m *ServiceManager) doReload(task *state.Task, tomb *tomb.Tomb) error {
+	m.state.Lock()
+	request, err := TaskServiceRequest(task)
+	m.state.Unlock()
+	if err != nil {
+		return err
+	}
+
+	releasePlan, err := m.acquirePlan()
+	if err != nil {
+		return fmt.Errorf("cannot acquire plan lock: %w", err)
+	}
+	config, ok := m.plan.Services[request.Name]
+	releasePlan()
+	if !ok {
+		return fmt.Errorf("cannot find service %q in plan", request.Name)
+	}
+	if config.ReloadSignal == "" {
+		return fmt.Errorf("cannot reload service %q: no reload-signal configured", request.Name)
+	}
+	// Re-render the service's files for it to pick up.
+	err = renderFiles(config)
+	if err != nil {
+		return fmt.Errorf("cannot reload service %q: %w", request.Name, err)
+	}
+
+	m.servicesLock.Lock()
+	service := m.services[request.Name]
+	if service == nil {
+		m.servicesLock.Unlock()
+		return fmt.Errorf("cannot reload service %q: service is not running", request.Name)
+	}
+	// Only look at the output written after the signal is sent.
+	var logs servicelog.Iterator
+	if config.ReloadReadyLog != "" {
+		logs = service.logs.TailIterator()
+		defer logs.Close()
+	}
+	sent := time.Now()
+	err = service.sendSignal(config.ReloadSignal)
+	m.servicesLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot reload service %q: %w", request.Name, err)
+	}
+
+	err = m.waitReloadReady(tomb, config, logs, sent)
+	if err != nil {
+		return fmt.Errorf("cannot reload service %q: %w", request.Name, err)
+	}
+	return nil
+}
+
+// waitReloadReady waits until the service's reload-ready-log pattern is
+// found in the output read from logs, and its reload-ready-check has passed
+// after the reload signal was sent. It returns immediately if neither is
+// configured.
+func (m *ServiceManager) waitReloadReady(tomb *tomb.Tomb, config *plan.Service, logs servicelog.Iterator, sent time.Time) error {
+	logReady := config.ReloadReadyLog == ""
+	checkReady := config.ReloadReadyCheck == ""
+	if logReady && checkReady {
+		return nil
+	}
+
+	var logMatch *regexp.Regexp
+	var parser *servicelog.Parser
+	notify := make(chan bool, 1)
+	if !logReady {
+		var err error
+		logMatch, err = regexp.Compile(config.ReloadReadyLog)
+		if err != nil {
+			return err
+		}
+		parser = servicelog.NewParser(logs, 4096)
+		logs.Notify(notify)
+	}
+
+	timeout := defaultReloadTimeout
+	if config.ReloadTimeout.IsSet {
+		timeout = config.ReloadTimeout.Value
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(reloadPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for !logReady {
+			if parser.Next() {
+				logReady = logMatch.MatchString(parser.Entry().Message)
+				continue
+			}
+			if parser.Err() != nil {
+				return fmt.Errorf("cannot read logs: %w", parser.Err())
+			}
+			if !logs.Next(nil) {
+				break
+			}
+		}
+		if !checkReady {
+			var err error
+			checkReady, err = m.checkPassedSince(config.ReloadReadyCheck, sent)
+			if err != nil {
+				return err
+			}
+		}
+		if logReady && checkReady {
+			return nil
+		}
+
+		select {
+		case <-notify:
+		case <-ticker.C:
+		case <-timer.C:
+			if !logReady {
+				return fmt.Errorf("no output matching %q within %s", config.ReloadReadyLog, timeout)
+			}
+			return fmt.Errorf("check %q did not pass within %s", config.ReloadReadyCheck, timeout)
+		case <-tomb.Dying():
+			return fmt.Errorf("reload aborted while waiting for service to be ready")
+		}
+	}
+}
+
+// checkPassedSince reports whether the named health check has run since the
+// given time, and passed.
+func (m *ServiceManager) checkPassedSince(name string, since time.Time) (bool, error) {
+	if m.checkStatus == nil {
+		return false, fmt.Errorf("check %q not found", name)
+	}
+	lastRun, failures, ok := m.checkStatus(name)
+	if !ok {
+		return false, fmt.Errorf("check %q not found", name)
+	}
+	return lastRun.After(since) && failures == 0, nil
+}
+
 // serviceForStop looks up the service by name in the services map; it
 // returns the service object if it exists and is running, or nil if it's
 // already stopped or has never been started.
@@ -266,9 +533,85 @@ func (m *ServiceManager) removeService(name string) {
 	m.servicesLock.Lock()
 	defer m.servicesLock.Unlock()
 
+	if s := m.services[name]; s != nil {
+		s.logs.Free()
+	}
 	delete(m.services, name)
 }
 
+// logBufferSize returns the size of the log buffer for a service with the
+// given config.
+func logBufferSize(config *plan.Service) int {
+	size, err := config.LogBufferBytes()
+	if err != nil || size == 0 {
+		// An invalid size has already been reported by plan validation.
+		return maxLogBytes
+	}
+	return size
+}
+
+// newLogBuffer allocates a log buffer of size bytes for a new service from
+// the log memory budget. If the budget doesn't have room for a full
+// buffer, the buffers of services that aren't running are shrunk first.
+// The buffer borrows from the log burst reserve, if any. The caller must
+// hold servicesLock.
+func (m *ServiceManager) newLogBuffer(size int) *servicelog.RingBuffer {
+	available := m.logBudget.Available()
+	if available >= 0 && available < int64(size) {
+		m.shrinkIdleLogs(size - int(available))
+	}
+	logs := servicelog.NewRingBufferWithBudget(size, m.logBudget)
+	if m.logReserve != nil {
+		logs.SetReserve(m.logReserve)
+	}
+	return logs
+}
+
+// resizeLogBuffer resizes the log buffer of a service being started again
+// to the size in its config, which may have changed, or back to it if the
+// buffer was shrunk while the service wasn't running. As much of the
+// buffer's latest logs as fit are kept. Memory for a bigger buffer is
+// found like for a new one. The caller must hold servicesLock.
+func (m *ServiceManager) resizeLogBuffer(s *serviceData) {
+	size := logBufferSize(s.config)
+	current := s.logs.Size() - s.logs.Borrowed()
+	if size == current {
+		return
+	}
+	if grow := size - current; grow > 0 {
+		available := m.logBudget.Available()
+		if available >= 0 && available < int64(grow) {
+			m.shrinkIdleLogs(grow - int(available))
+		}
+	}
+	s.logs.Resize(size)
+}
+
+// shrinkIdleLogs shrinks the log buffers of stopped and exited services to
+// minIdleLogBytes, least recently written first, until at least needed
+// bytes have been released. The caller must hold servicesLock.
+func (m *ServiceManager) shrinkIdleLogs(needed int) {
+	var idle []*serviceData
+	for _, s := range m.services {
+		if s.state == stateStopped || s.state == stateExited {
+			idle = append(idle, s)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].logs.LastWrite().Before(idle[j].logs.LastWrite())
+	})
+	for _, s := range idle {
+		if needed <= 0 {
+			break
+		}
+		freed := s.logs.Shrink(minIdleLogBytes)
+		if freed > 0 {
+			logger.Debugf("Shrunk log buffer of service %q by %d bytes", s.config.Name, freed)
+		}
+		needed -= freed
+	}
+}
+
 // transition changes the service's state machine to the given state.
 func (s *serviceData) transition(state serviceState) {
 	logger.Debugf("Service %q transitioning to state %q", s.config.Name, state)
@@ -277,6 +620,9 @@ func (s *serviceData) transition(state serviceState) {
 
 // transitionRestarting changes the service's state and also sets the restarting flag.
 func (s *serviceData) transitionRestarting(state serviceState, restarting bool) {
+	if state != s.state {
+		s.stateSince = time.Now()
+	}
 	s.state = state
 	s.restarting = restarting
 }
@@ -307,6 +653,107 @@ func logError(err error) {
 	}
 }
 
+// logPipeline returns the writer for the service's output: a formatter
+// writing to logs, after any optional stages, behind a guard that contains
+// panics in any of them, calling onPanic for each. After a panic, output
+// goes through a new formatter straight to the buffer, and optional stages
+// that have panicked maxLogPanics times since the last replan are left out
+// of later pipelines. If the service has log-coalesce set, its writes are
+// joined into lines in front of the guard, so that the guard also contains
+// panics from lines passed on after the delay. If there are log targets,
+// output is fanned out to them alongside the formatter, and closing the
+// pipeline closes them. It also returns the names of the stages, in order.
+func (s *serviceData) logPipeline(logs *servicelog.RingBuffer, tracer *servicelog.Tracer, targets []*logTarget, onPanic func(err *servicelog.PanicError)) (io.WriteCloser, []string) {
+	name := s.config.Name
+	newFormatter := func() io.Writer {
+		formatter, _ := servicelog.NewFormatWriter(logs, name, servicelog.WithTracer(tracer)) // can't fail
+		return servicelog.NewStageWriter(formatter, servicelog.StageFormat)
+	}
+	full := newFormatter()
+	if len(targets) > 0 {
+		fanout := servicelog.NewFanoutWriter(logTargetRetry)
+		_ = fanout.Add("buffer", full)
+		for _, target := range targets {
+			_ = fanout.Add(target.label, target.writer)
+		}
+		full = fanout
+	}
+	stages := s.logStageNames(s.config)
+	if strutil.ListContains(stages, servicelog.StageDecode) {
+		full = servicelog.NewStageWriter(newDecodeWriter(full, s.config.LogEncoding), servicelog.StageDecode)
+	}
+	guard := servicelog.NewGuardWriter(full, newFormatter(), onPanic)
+	if strutil.ListContains(stages, servicelog.StageCoalesce) {
+		return servicelog.NewCoalesceWriter(guard, s.config.LogCoalesce.Value), stages
+	}
+	return guard, stages
+}
+
+// logStageNames returns the names of the stages of the log pipeline that
+// would be built for the service with the given config, in order.
+func (s *serviceData) logStageNames(config *plan.Service) []string {
+	stages := []string{servicelog.StageFormat, servicelog.StageBuffer}
+	if config.LogEncoding != "" && !s.logStageDisabled(servicelog.StageDecode) {
+		stages = append([]string{servicelog.StageDecode}, stages...)
+	}
+	if config.LogCoalesce.Value > 0 {
+		stages = append([]string{servicelog.StageCoalesce}, stages...)
+	}
+	return stages
+}
+
+// optionalLogStages are the stages of a log pipeline that can be left out
+// after they've panicked too often.
+var optionalLogStages = map[string]bool{
+	servicelog.StageDecode: true,
+}
+
+// maxLogPanics is the number of panics after which an optional stage is
+// left out of a service's log pipeline until the next replan.
+const maxLogPanics = 3
+
+func (s *serviceData) logStageDisabled(stage string) bool {
+	s.logPanicsLock.Lock()
+	defer s.logPanicsLock.Unlock()
+	return s.logPanics[stage] >= maxLogPanics
+}
+
+// logPanicked records a panic in the service's log pipeline. It's called
+// from the goroutine copying the service's output.
+func (s *serviceData) logPanicked(name string, err *servicelog.PanicError) {
+	s.logPanicsLock.Lock()
+	if s.logPanics == nil {
+		s.logPanics = make(map[string]int)
+	}
+	s.logPanics[err.Stage]++
+	s.logPanicsTotal++
+	// Each panic recovered by the guard moves it on a step: to the minimal
+	// pipeline, and then to dropping the output.
+	if s.logMode == LogModeFull {
+		s.logMode = LogModeMinimal
+		var stages []string
+		for _, stage := range s.logStages {
+			if !optionalLogStages[stage] {
+				stages = append(stages, stage)
+			}
+		}
+		s.logStages = stages
+	} else {
+		s.logMode = LogModeDropping
+	}
+	disabled := optionalLogStages[err.Stage] && s.logPanics[err.Stage] == maxLogPanics
+	s.logPanicsLock.Unlock()
+	s.manager.logPipelinePanic(name, err, disabled)
+}
+
+// resetLogPanics forgets the panics counted towards leaving out stages of
+// the service's log pipeline.
+func (s *serviceData) resetLogPanics() {
+	s.logPanicsLock.Lock()
+	defer s.logPanicsLock.Unlock()
+	s.logPanics = nil
+}
+
 // startInternal is an internal helper used to actually start (or restart) the
 // command. It assumes the caller has ensures the service is in a valid state,
 // and it sets s.cmd and other relevant fields.
@@ -317,55 +764,180 @@ func (s *serviceData) startInternal() error {
 		// it does not hurt to double check and report.
 		return fmt.Errorf("cannot parse service command: %s", err)
 	}
-	s.cmd = exec.Command(args[0], args[1:]...)
-	s.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-	// Start as another user if specified in plan.
-	uid, gid, err := osutil.NormalizeUidGid(s.config.UserID, s.config.GroupID, s.config.User, s.config.Group)
+	// Extra arguments are passed through as-is, not parsed again.
+	args = append(args, s.args...)
+	s.cmd, err = serviceCommand(s.config, args)
 	if err != nil {
 		return err
 	}
-	if uid != nil && gid != nil {
-		setCmdCredential(s.cmd, &syscall.Credential{
-			Uid: uint32(*uid),
-			Gid: uint32(*gid),
-		})
-	}
+	s.processExited = false
 
-	// Pass service description's environment variables to child process.
-	s.cmd.Env = os.Environ()
-	for k, v := range s.config.Environment {
-		s.cmd.Env = append(s.cmd.Env, k+"="+v)
+	// The process writes its output to a pipe of our own, rather than one
+	// set up by os/exec, so that the end of its output is seen even if the
+	// process keeps running after closing it (see copyOutput).
+	outputReader, outputWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("cannot create output pipe: %w", err)
 	}
+	s.cmd.Stdout = outputWriter
+	s.cmd.Stderr = outputWriter
 
 	// Set up stdout and stderr to write to log ring buffer.
 	var outputIterator servicelog.Iterator
 	if s.manager.serviceOutput != nil {
+		// The previous process's copier reads until there's nothing left
+		// in the buffer, so let it finish before anything is written for
+		// this one, or that would be copied twice.
+		if s.outputFinished != nil {
+			select {
+			case <-s.outputFinished:
+			case <-time.After(outputHandoverWait):
+			}
+			s.outputFinished = nil
+		}
 		// Use the head iterator so that we copy from where this service
 		// started (previous logs have already been copied).
 		outputIterator = s.logs.HeadIterator(0)
+		if s.logTracer != nil {
+			s.logTracer.TraceIterator(outputIterator, servicelog.StageOutput)
+		}
+	}
+	// Output is copied once the start banner has been written, as the
+	// process's pid isn't known until it has started; log files are held
+	// back until then too.
+	gate := make(chan struct{})
+	name := s.config.Name
+	targets := s.openLogTargets()
+	pipeline, stages := s.logPipeline(s.logs, s.logTracer, targets, func(err *servicelog.PanicError) {
+		s.logPanicked(name, err)
+	})
+	if s.manager.serviceOutput != nil {
+		stages = append(stages, servicelog.StageOutput)
+	}
+	s.logPanicsLock.Lock()
+	s.logStages = stages
+	s.logMode = LogModeFull
+	s.logPanicsLock.Unlock()
+
+	// Follow the service's log files, if any, from before the process
+	// starts so that nothing it logs is missed. Lines from them go through
+	// a formatter of their own, so they aren't mixed with incomplete lines
+	// of the process's output.
+	var tailer *servicelog.Tailer
+	if len(s.config.LogFiles) > 0 {
+		formatter, _ := servicelog.NewFormatWriter(s.logs, s.config.Name, servicelog.WithTracer(s.logTracer)) // can't fail
+		tailer = servicelog.NewTailer(s.config.LogFiles, &gatedWriter{open: gate, dest: formatter})
+		tailer.Start()
 	}
-	logWriter := servicelog.NewFormatWriter(s.logs, s.config.Name)
-	s.cmd.Stdout = logWriter
-	s.cmd.Stderr = logWriter
 
 	// Start the process!
-	logger.Noticef("Service %q starting: %s", s.config.Name, s.config.Command)
+	if len(s.args) > 0 {
+		logger.Noticef("Service %q starting: %s (with extra arguments %q)", s.config.Name, s.config.Command, s.args)
+	} else {
+		logger.Noticef("Service %q starting: %s", s.config.Name, s.config.Command)
+	}
+	// Create the cgroup for the service's resource limits, if any, first,
+	// so the process can be started in it. Failing to do so is not fatal:
+	// the service runs without them and the user is warned.
+	limitsErr := s.createCgroup()
+	var cgroupDir *os.File
+	if s.cgroup != nil {
+		cgroupDir = startInCgroup(s.cmd, s.cgroup)
+	}
 	err = s.cmd.Start()
+	if cgroupDir != nil {
+		cgroupDir.Close()
+	}
+	// The process has its own copy of the pipe's write end now, and the
+	// end of its output is only seen once that's the only one left.
+	outputWriter.Close()
 	if err != nil {
+		if s.cgroup != nil {
+			s.cgroup.Remove()
+			s.cgroup = nil
+		}
+		outputReader.Close()
+		close(gate)
+		if tailer != nil {
+			tailer.Stop()
+		}
 		if outputIterator != nil {
 			_ = outputIterator.Close()
 		}
+		closeLogTargets(name, targets)
 		_ = s.logs.Close()
 		return fmt.Errorf("cannot start service: %w", err)
 	}
+	s.generation++
+	s.startTime = time.Now()
+	logEvent(s.logs, s.config.Name, "started (pid %d, generation %d)", s.cmd.Process.Pid, s.generation)
+	close(gate)
 	s.resetTimer = time.AfterFunc(s.config.BackoffLimit.Value, func() { logError(s.backoffResetElapsed()) })
 
+	// Where the process couldn't be started in its cgroup, move it there
+	// now; anything it has forked already isn't covered by the limits.
+	if s.cgroup != nil && cgroupDir == nil {
+		limitsErr = s.cgroup.AddProcess(s.cmd.Process.Pid)
+		if limitsErr != nil {
+			s.cgroup.Remove()
+			s.cgroup = nil
+		}
+	}
+	if limitsErr != nil {
+		logger.Noticef("Cannot apply resource limits to service %q: %v", s.config.Name, limitsErr)
+		s.manager.warnf("Cannot apply resource limits to service %q: %v", s.config.Name, limitsErr)
+	}
+
+	// Start a goroutine to copy the process's output to its log pipeline.
+	// It inherits the profiler labels.
+	exited := make(chan struct{})
+	outputDone := make(chan error, 1)
+	pid := s.cmd.Process.Pid
+	servicelog.WithLabels(name, servicelog.StageFormat, func() {
+		go func() {
+			outputDone <- copyOutput(s.logs, name, pid, outputReader, pipeline, exited)
+		}()
+	})
+
 	// Start a goroutine to wait for the process to finish.
 	done := make(chan struct{})
+	config := s.config
+	cmd := s.cmd
+	startTime := s.startTime
 	go func() {
-		waitErr := s.cmd.Wait()
+		waitErr := cmd.Wait()
+		close(exited)
+		// Wait for the rest of the output (as os/exec would if it had set
+		// up the pipe) so that it's logged before the exit.
+		outputErr := <-outputDone
+		if tailer != nil {
+			tailer.Stop()
+		}
+		// The pipeline has closed its log targets, unless a panic left
+		// them out of it.
+		closeLogTargets(config.Name, targets)
+		logEvent(s.logs, config.Name, "%s after %s", exitDescription(cmd), time.Since(startTime).Round(time.Millisecond))
 		close(done)
+		var writeErr *servicelog.WriteError
+		if errors.As(outputErr, &writeErr) {
+			// Writing the service's output to its log buffer failed.
+			s.manager.logWriteError(outputErr)
+		}
+		if waitErr == nil {
+			waitErr = outputErr
+		}
+		if len(config.AfterStop) > 0 {
+			s.setProcessExited()
+			err := runHooks(config, s.logs, "after-stop", config.AfterStop)
+			if err != nil {
+				logger.Noticef("Service %q %v", config.Name, err)
+			}
+		}
+		// The cgroup is removed before the exit is handled, so that a
+		// restart doesn't reuse it while it's still being removed.
+		if group := s.takeCgroup(); group != nil {
+			s.manager.removeCgroup(config.Name, group)
+		}
 		err := s.exited(waitErr)
 		if err != nil {
 			logger.Noticef("Cannot transition state after service exit: %v", err)
@@ -373,31 +945,235 @@ func (s *serviceData) startInternal() error {
 	}()
 
 	// Start a goroutine to read from the service's log buffer and copy to the output.
-	if s.manager.serviceOutput != nil {
-		go func() {
-			defer outputIterator.Close()
-			for outputIterator.Next(done) {
-				_, err := io.Copy(s.manager.serviceOutput, outputIterator)
-				if err != nil {
-					logger.Noticef("Service %q log write failed: %v", s.config.Name, err)
-				}
+	if outputIterator != nil {
+		s.outputFinished = s.manager.startOutputCopier(s.config.Name, outputIterator, done)
+		if s.outputFinished == nil {
+			_ = outputIterator.Close()
+		}
+	}
+
+	return nil
+}
+
+// copyOutput copies a service's output from r to its log pipeline until
+// the process closes its end of the pipe, usually by exiting, and then
+// closes the pipeline, ending any incomplete last line so that nothing
+// logged afterwards (such as the next process's output) runs on from it.
+// If the process hasn't exited shortly after its output has ended, it has
+// closed its output but is still running, which is noted once in its logs;
+// it's still supervised as usual.
+func copyOutput(logs *servicelog.RingBuffer, name string, pid int, r *os.File, pipeline io.WriteCloser, exited <-chan struct{}) error {
+	_, err := io.Copy(pipeline, r)
+	r.Close()
+	closeErr := pipeline.Close()
+	if err == nil {
+		err = closeErr
+	}
+	select {
+	case <-exited:
+	case <-time.After(outputClosedWait):
+		logger.Noticef("Service %q closed its output but is still running (pid %d)", name, pid)
+		logEvent(logs, name, "closed its output but is still running (pid %d)", pid)
+	}
+	return err
+}
+
+// gatedWriter holds back writes to dest until open is closed.
+type gatedWriter struct {
+	open <-chan struct{}
+	dest io.Writer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.open
+	return w.dest.Write(p)
+}
+
+// logEvent writes a line marking an event in the named service's lifecycle
+// to its logs, tagged as coming from pebble rather than the service.
+func logEvent(logs *servicelog.RingBuffer, name, format string, args ...interface{}) {
+	message := fmt.Sprintf("--- service %q %s ---", name, fmt.Sprintf(format, args...))
+	// The buffer is only closed if the service failed to start, and then
+	// there's nothing more to mark.
+	_ = servicelog.WriteEvent(logs, message)
+}
+
+// exitDescription describes how the given command's process exited.
+func exitDescription(cmd *exec.Cmd) string {
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return "killed by " + unix.SignalName(status.Signal())
+	}
+	return fmt.Sprintf("exited with code %d", exitCode(cmd))
+}
+
+// createCgroup creates a cgroup with the service's memory and CPU limits,
+// if it has any, for its process to run in, and sets s.cgroup.
+func (s *serviceData) createCgroup() error {
+	s.cgroup = nil
+	memoryMax, err := s.config.MemoryLimitBytes()
+	if err != nil {
+		return err
+	}
+	cpuQuota, err := s.config.CPUQuotaPercent()
+	if err != nil {
+		return err
+	}
+	if memoryMax == 0 && cpuQuota == 0 {
+		return nil
+	}
+
+	cgroups := cgroup.NewManager(cgroupRoot, "pebble")
+	group, err := cgroups.Create(s.config.Name, cgroup.Limits{MemoryMax: memoryMax, CPUQuota: cpuQuota})
+	if err != nil {
+		return err
+	}
+	s.cgroup = group
+	return nil
+}
+
+// takeCgroup returns the service's cgroup, if it has one, once its process
+// has exited, and clears s.cgroup so the group is no longer used.
+func (s *serviceData) takeCgroup() *cgroup.Group {
+	s.manager.servicesLock.Lock()
+	defer s.manager.servicesLock.Unlock()
+	group := s.cgroup
+	s.cgroup = nil
+	return group
+}
+
+// removeCgroup removes the named service's cgroup once its process has
+// exited. Any processes left in it, such as daemons the service started,
+// keep it from being removed, so they're killed and removal is retried for
+// a while before the user is warned. It's called without servicesLock
+// held, as that takes a while.
+func (m *ServiceManager) removeCgroup(name string, group *cgroup.Group) {
+	err := group.Remove()
+	for i := 0; errors.Is(err, syscall.EBUSY) && i < cgroupRemoveRetries; i++ {
+		if i == 0 {
+			killErr := group.Kill()
+			if killErr != nil {
+				logger.Debugf("Cannot kill processes left in cgroup for service %q: %v", name, killErr)
 			}
-		}()
+		}
+		time.Sleep(cgroupRemoveDelay)
+		err = group.Remove()
 	}
+	if err != nil {
+		logger.Noticef("Cannot remove cgroup for service %q: %v", name, err)
+		m.warnf("Cannot remove cgroup for service %q: %v", name, err)
+	}
+}
 
+// setProcessExited records that the process has exited, so that timers
+// don't act on it while its after-stop hooks run.
+func (s *serviceData) setProcessExited() {
+	s.manager.servicesLock.Lock()
+	defer s.manager.servicesLock.Unlock()
+	s.processExited = true
+}
+
+// serviceCommand returns a command to run args with the service's user,
+// group, and environment. The command is placed in its own process group.
+func serviceCommand(config *plan.Service, args []string) (*exec.Cmd, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// Start as another user if specified in plan.
+	uid, gid, err := osutil.NormalizeUidGid(config.UserID, config.GroupID, config.User, config.Group)
+	if err != nil {
+		return nil, err
+	}
+	if uid != nil && gid != nil {
+		setCmdCredential(cmd, &syscall.Credential{
+			Uid: uint32(*uid),
+			Gid: uint32(*gid),
+		})
+	}
+
+	// Pass service description's environment variables to child process.
+	env, err := serviceEnvironment(config)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	return cmd, nil
+}
+
+// runHooks runs the service's hook commands of the given type (for example
+// "before-start") in order, stopping at the first one that fails. Output is
+// written to logs, tagged as "service/hookType". It must be called without
+// holding servicesLock, as hooks may take up to the hook timeout to run.
+func runHooks(config *plan.Service, logs io.Writer, hookType string, commands []string) error {
+	timeout := defaultHookTimeout
+	if config.HookTimeout.IsSet {
+		timeout = config.HookTimeout.Value
+	}
+	for _, command := range commands {
+		logger.Debugf("Service %q running %s command: %s", config.Name, hookType, command)
+		err := runHook(config, logs, hookType, command, timeout)
+		if err != nil {
+			return fmt.Errorf("%s command %q failed: %w", hookType, command, err)
+		}
+	}
 	return nil
 }
 
+func runHook(config *plan.Service, logs io.Writer, hookType, command string, timeout time.Duration) error {
+	args, err := shlex.Split(command)
+	if err != nil {
+		return err
+	}
+	cmd, err := serviceCommand(config, args)
+	if err != nil {
+		return err
+	}
+	logWriter, err := servicelog.NewFormatWriter(logs, config.Name+"/"+hookType)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = logWriter
+	cmd.Stderr = logWriter
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		// Kill the whole process group, so that Wait doesn't block on
+		// children holding the output open.
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
 // okayWaitElapsed is called when the okay-wait timer has elapsed (and the
 // service is considered running successfully).
 func (s *serviceData) okayWaitElapsed() error {
 	s.manager.servicesLock.Lock()
 	defer s.manager.servicesLock.Unlock()
 
+	if s.processExited {
+		// Let exited report the exit once the after-stop hooks are done.
+		return nil
+	}
+
 	switch s.state {
 	case stateStarting:
 		s.started <- nil // still running fine after short duration, no error
 		s.transition(stateRunning)
+		s.startWatchdog()
 
 	default:
 		// Ignore if timer elapsed in any other state.
@@ -414,6 +1190,7 @@ func (s *serviceData) exited(waitErr error) error {
 	if s.resetTimer != nil {
 		s.resetTimer.Stop()
 	}
+	s.stopWatchdog()
 
 	switch s.state {
 	case stateStarting:
@@ -422,19 +1199,22 @@ func (s *serviceData) exited(waitErr error) error {
 
 	case stateRunning:
 		logger.Noticef("Service %q stopped unexpectedly with code %d", s.config.Name, exitCode(s.cmd))
+		logs := s.recordFailure()
 		action, onType := getAction(s.config, waitErr == nil)
 		switch action {
 		case plan.ActionIgnore:
 			logger.Noticef("Service %q %s action is %q, not doing anything further", s.config.Name, onType, action)
+			logEvent(s.logs, s.config.Name, "%s action is %q, not restarting", onType, action)
 			s.transition(stateExited)
 
 		case plan.ActionShutdown:
 			logger.Noticef("Service %q %s action is %q, triggering server exit", s.config.Name, onType, action)
+			logEvent(s.logs, s.config.Name, "%s action is %q, shutting down pebble", onType, action)
 			s.manager.restarter.HandleRestart(restart.RestartDaemon)
 			s.transition(stateExited)
 
 		case plan.ActionRestart:
-			s.doBackoff(action, onType)
+			s.doBackoff(action, onType, exitDescription(s.cmd), logs)
 
 		default:
 			return fmt.Errorf("internal error: unexpected action %q", action)
@@ -442,8 +1222,8 @@ func (s *serviceData) exited(waitErr error) error {
 
 	case stateTerminating, stateKilling:
 		if s.restarting {
-			logger.Noticef("Service %q exited after check failure, restarting", s.config.Name)
-			s.doBackoff(plan.ActionRestart, "on-check-failure")
+			logger.Noticef("Service %q exited after %s, restarting", s.config.Name, s.restartReason)
+			s.doBackoff(plan.ActionRestart, s.restartOnType, s.restartReason, "")
 		} else {
 			logger.Noticef("Service %q stopped", s.config.Name)
 			s.stopped <- nil
@@ -456,13 +1236,34 @@ func (s *serviceData) exited(waitErr error) error {
 	return nil
 }
 
+// recordFailure records a warning about the service's unexpected exit, and
+// a service-failure notice including its most recent output, and returns
+// that output. The output is kept out of the warning, whose message is
+// fixed, as warnings are told apart by their message.
+func (s *serviceData) recordFailure() string {
+	logs, err := lastLogs(s.logs, s.config.FailureLogLines)
+	if err != nil {
+		logger.Noticef("Cannot read logs for service %q: %v", s.config.Name, err)
+	}
+	code := exitCode(s.cmd)
+	s.manager.warnf("Service %q stopped unexpectedly with code %d", s.config.Name, code)
+	data := map[string]string{
+		"exit-code": strconv.Itoa(code),
+	}
+	if logs != "" {
+		data["last-logs"] = logs
+	}
+	s.manager.addNotice(state.ServiceFailureNotice, s.config.Name, data)
+	return logs
+}
+
 // addLastLogs adds the last few lines of service output to the task's log.
-func addLastLogs(task *state.Task, logBuffer *servicelog.RingBuffer) {
+func addLastLogs(task *state.Task, logBuffer *servicelog.RingBuffer, lines int) {
 	st := task.State()
 	st.Lock()
 	defer st.Unlock()
 
-	logs, err := servicelog.LastLines(logBuffer, lastLogLines, "    ", true)
+	logs, err := lastLogs(logBuffer, lines)
 	if err != nil {
 		task.Errorf("Cannot read service logs: %v", err)
 	}
@@ -471,11 +1272,53 @@ func addLastLogs(task *state.Task, logBuffer *servicelog.RingBuffer) {
 		task.Logf("Most recent service output:\n%s", logs)
 	}
 }
-func (s *serviceData) doBackoff(action plan.ServiceAction, onType string) {
+
+// lastLogs returns the last lines of service output (defaultFailureLogLines
+// if lines is zero), indented and with the timestamp prefixes stripped. The
+// result is at most about maxFailureLogBytes long, and is empty if the
+// service hasn't written any output.
+func lastLogs(logBuffer *servicelog.RingBuffer, lines int) (string, error) {
+	if lines == 0 {
+		lines = defaultFailureLogLines
+	}
+	logs, err := servicelog.LastLines(logBuffer, lines, "    ", true)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(logs) == "" {
+		return "", nil
+	}
+	if len(logs) > maxFailureLogBytes {
+		// Keep the most recent output, starting at a line boundary.
+		logs = logs[len(logs)-maxFailureLogBytes:]
+		if i := strings.IndexByte(logs, '\n'); i >= 0 {
+			logs = logs[i+1:]
+		}
+		logs = "    (...)\n" + logs
+	}
+	return logs, nil
+}
+
+// doBackoff schedules a restart of the service after a backoff delay. The
+// service-restart notice records reason, why the service is restarted
+// (such as how it exited, or "log-silence watchdog"), and includes logs,
+// the output that led up to an unexpected exit, if it's not empty.
+func (s *serviceData) doBackoff(action plan.ServiceAction, onType, reason, logs string) {
 	s.backoffNum++
 	s.backoffTime = calculateNextBackoff(s.config, s.backoffTime)
 	logger.Noticef("Service %q %s action is %q, waiting ~%s before restart (backoff %d)",
 		s.config.Name, onType, action, s.backoffTime, s.backoffNum)
+	logEvent(s.logs, s.config.Name, "%s action is %q, restarting in ~%s (backoff %d)", onType, action, s.backoffTime, s.backoffNum)
+	data := map[string]string{
+		"action":  onType,
+		"backoff": strconv.Itoa(s.backoffNum),
+		"delay":   s.backoffTime.String(),
+		"reason":  reason,
+	}
+	if logs != "" {
+		data["last-logs"] = logs
+	}
+	s.manager.addNotice(state.ServiceRestartNotice, s.config.Name, data)
 	s.transition(stateBackoff)
 	duration := s.backoffTime + s.manager.getJitter(s.backoffTime)
 	time.AfterFunc(duration, func() { logError(s.backoffTimeElapsed()) })
@@ -592,16 +1435,40 @@ func (s *serviceData) stop() error {
 // backoffTimeElapsed is called when the current backoff's timer has elapsed,
 // to restart the service.
 func (s *serviceData) backoffTimeElapsed() error {
+	s.manager.servicesLock.Lock()
+	if s.state != stateBackoff {
+		// Ignore if timer elapsed in any other state.
+		s.manager.servicesLock.Unlock()
+		return nil
+	}
+	config := s.config
+	s.manager.servicesLock.Unlock()
+
+	// Render files and run the before-start hooks without holding the
+	// lock, as they may take a while. The state is checked again afterwards
+	// in case the service was stopped in the meantime.
+	hookErr := renderFiles(config)
+	if hookErr == nil {
+		hookErr = runHooks(config, s.logs, "before-start", config.BeforeStart)
+	}
+
 	s.manager.servicesLock.Lock()
 	defer s.manager.servicesLock.Unlock()
 
 	switch s.state {
 	case stateBackoff:
+		if hookErr != nil {
+			logger.Noticef("Service %q %v", s.config.Name, hookErr)
+			s.doBackoff(plan.ActionRestart, "on-failure", hookErr.Error(), "")
+			return nil
+		}
 		err := s.startInternal()
 		if err != nil {
 			return err
 		}
+		s.restarts++
 		s.transition(stateRunning)
+		s.startWatchdog()
 
 	default:
 		// Ignore if timer elapsed in any other state.
@@ -616,6 +1483,11 @@ func (s *serviceData) terminateTimeElapsed() error {
 	s.manager.servicesLock.Lock()
 	defer s.manager.servicesLock.Unlock()
 
+	if s.processExited {
+		// Process has exited but after-stop hooks are still running.
+		return nil
+	}
+
 	switch s.state {
 	case stateTerminating:
 		logger.Debugf("Attempting to stop service %q again by sending SIGKILL", s.config.Name)
@@ -640,6 +1512,11 @@ func (s *serviceData) killTimeElapsed() error {
 	s.manager.servicesLock.Lock()
 	defer s.manager.servicesLock.Unlock()
 
+	if s.processExited {
+		// Process has exited but after-stop hooks are still running.
+		return nil
+	}
+
 	switch s.state {
 	case stateKilling:
 		if s.restarting {
@@ -702,13 +1579,15 @@ func (s *serviceData) checkFailed(action plan.ServiceAction) {
 					logger.Noticef("Cannot send SIGTERM to process: %v", err)
 				}
 				s.transitionRestarting(stateTerminating, true)
+				s.restartOnType = onType
+				s.restartReason = "check failure"
 				time.AfterFunc(killWait, func() { logError(s.terminateTimeElapsed()) })
 			case stateBackoff:
 				logger.Noticef("Service %q %s action is %q, waiting for current backoff",
 					s.config.Name, onType, action)
 				return
 			case stateExited:
-				s.doBackoff(action, onType)
+				s.doBackoff(action, onType, "check failure", "")
 			}
 
 		default:
@@ -722,6 +1601,105 @@ func (s *serviceData) checkFailed(action plan.ServiceAction) {
 	}
 }
 
+// startWatchdog starts the log-silence watchdog timer if the service has one
+// configured. It's called when the service transitions to running, so the
+// watchdog is never active while the service is starting or stopping.
+func (s *serviceData) startWatchdog() {
+	if !s.config.WatchdogLogSilence.IsSet {
+		return
+	}
+	s.watchdogStart = watchdogClock.Now()
+	s.resetWatchdog(s.config.WatchdogLogSilence.Value)
+}
+
+func (s *serviceData) resetWatchdog(duration time.Duration) {
+	s.stopWatchdog()
+	timer := watchdogClock.NewTimer(duration)
+	stop := make(chan struct{})
+	s.watchdogTimer = timer
+	s.watchdogStop = stop
+	go func() {
+		select {
+		case <-timer.C():
+			logError(s.watchdogElapsed())
+		case <-stop:
+		}
+	}()
+}
+
+func (s *serviceData) stopWatchdog() {
+	if s.watchdogTimer == nil {
+		return
+	}
+	s.watchdogTimer.Stop()
+	close(s.watchdogStop)
+	s.watchdogTimer = nil
+	s.watchdogStop = nil
+}
+
+// watchdogElapsed is called when the log-silence watchdog timer fires. If
+// the service has written output since the timer was set, the timer is reset
+// to fire when the silence would reach the configured limit; otherwise the
+// service's on-failure action is applied.
+func (s *serviceData) watchdogElapsed() error {
+	s.manager.servicesLock.Lock()
+	defer s.manager.servicesLock.Unlock()
+
+	if s.processExited {
+		return nil
+	}
+
+	switch s.state {
+	case stateRunning:
+		limit := s.config.WatchdogLogSilence.Value
+		lastOutput := s.logs.LastWrite()
+		if lastOutput.Before(s.watchdogStart) {
+			lastOutput = s.watchdogStart
+		}
+		silence := watchdogClock.Now().Sub(lastOutput)
+		if silence < limit {
+			s.resetWatchdog(limit - silence)
+			return nil
+		}
+
+		logger.Noticef("Service %q produced no output for %s, triggering log-silence watchdog",
+			s.config.Name, silence.Round(time.Millisecond))
+		action, onType := getAction(s.config, false)
+		switch action {
+		case plan.ActionIgnore:
+			logger.Noticef("Service %q %s action is %q, not doing anything further", s.config.Name, onType, action)
+			s.watchdogStart = watchdogClock.Now()
+			s.resetWatchdog(limit)
+
+		case plan.ActionShutdown:
+			logger.Noticef("Service %q %s action is %q, triggering server exit", s.config.Name, onType, action)
+			s.manager.restarter.HandleRestart(restart.RestartDaemon)
+
+		case plan.ActionRestart:
+			logger.Noticef("Service %q %s action is %q, terminating process before restarting",
+				s.config.Name, onType, action)
+			err := syscall.Kill(-s.cmd.Process.Pid, syscall.SIGTERM)
+			if err != nil {
+				logger.Noticef("Cannot send SIGTERM to process: %v", err)
+			}
+			s.transitionRestarting(stateTerminating, true)
+			s.restartOnType = onType
+			s.restartReason = "log-silence watchdog"
+			time.AfterFunc(killWait, func() { logError(s.terminateTimeElapsed()) })
+
+		default:
+			return fmt.Errorf("internal error: unexpected action %q", action)
+		}
+
+	default:
+		// Ignore if timer elapsed in any other state.
+		return nil
+	}
+	return nil
+}
+
 var setCmdCredential = func(cmd *exec.Cmd, credential *syscall.Credential) {
 	cmd.SysProcAttr.Credential = credential
 }
+
+var newDecodeWriter = servicelog.NewDecodeWriter
@@ -0,0 +1,121 @@
+package servstate
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	"github.com/canonical/pebble/internal/logger"
+	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+// logTargetRetry is how long a log target that fails is set aside before
+// it's written to again.
+var logTargetRetry = 5 * time.Second
+
+// logTarget is an open writer for one of a service's log targets.
+type logTarget struct {
+	label  string
+	writer io.WriteCloser
+}
+
+// openLogTargets opens the writers for the service's file and syslog log
+// targets, in order of name. A target that can't be opened is left out,
+// with a warning, rather than failing the start: the service's output
+// still goes to its log buffer.
+func (s *serviceData) openLogTargets() []*logTarget {
+	config := s.config
+	names := make([]string, 0, len(config.LogTargets))
+	for name := range config.LogTargets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var targets []*logTarget
+	for _, name := range names {
+		target := config.LogTargets[name]
+		var writer io.WriteCloser
+		var err error
+		switch target.Type {
+		case plan.FileLogTarget:
+			writer, err = openFileLogTarget(config.Name, target)
+		case plan.SyslogLogTarget:
+			writer, err = openSyslogLogTarget(config.Name, target)
+		default:
+			// Buffer targets write nowhere else.
+			continue
+		}
+		if err != nil {
+			logger.Noticef("Cannot open log target %q of service %q: %v", name, config.Name, err)
+			s.manager.warnf("Cannot open log target %q of service %q: %v", name, config.Name, err)
+			continue
+		}
+		targets = append(targets, &logTarget{
+			label:  string(target.Type) + ":" + name,
+			writer: writer,
+		})
+	}
+	return targets
+}
+
+func openFileLogTarget(serviceName string, target *plan.LogTarget) (io.WriteCloser, error) {
+	maxSize, err := target.FileMaxSize()
+	if err != nil {
+		return nil, err
+	}
+	file, err := servicelog.NewRotatingFileWriter(target.Path, maxSize, target.FileMaxFiles(), target.Compress)
+	if err != nil {
+		return nil, err
+	}
+	formatter, err := servicelog.NewFormatWriter(file, serviceName)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileLogTarget{
+		formatter: formatter,
+		file:      file,
+	}, nil
+}
+
+func openSyslogLogTarget(serviceName string, target *plan.LogTarget) (io.WriteCloser, error) {
+	network, addr, err := target.SyslogAddress()
+	if err != nil {
+		return nil, err
+	}
+	return servicelog.NewSyslogWriter(network, addr, serviceName, servicelog.FacilityDaemon)
+}
+
+// fileLogTarget writes a service's output to a file in the same format as
+// its log buffer.
+type fileLogTarget struct {
+	formatter io.Writer
+	file      io.WriteCloser
+}
+
+func (t *fileLogTarget) Write(p []byte) (int, error) {
+	return t.formatter.Write(p)
+}
+
+// Close ends any incomplete line and closes the file.
+func (t *fileLogTarget) Close() error {
+	var err error
+	if c, ok := t.formatter.(io.Closer); ok {
+		err = c.Close()
+	}
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closeLogTargets closes the writers for the service's log targets,
+// logging any errors.
+func closeLogTargets(serviceName string, targets []*logTarget) {
+	for _, target := range targets {
+		if err := target.writer.Close(); err != nil {
+			logger.Noticef("Cannot close log target %q of service %q: %v", target.label, serviceName, err)
+		}
+	}
+}
@@ -1,17 +1,23 @@
 package servstate
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/canonical/pebble/internal/cgroup"
+	"github.com/canonical/pebble/internal/logger"
 	"github.com/canonical/pebble/internal/overlord/restart"
 	"github.com/canonical/pebble/internal/overlord/state"
 	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/procstat"
 	"github.com/canonical/pebble/internal/servicelog"
 )
 
@@ -23,20 +29,60 @@ type ServiceManager struct {
 	planLock     sync.Mutex
 	plan         *plan.Plan
 	planHandlers []PlanFunc
+	dirLabels    map[string]bool // labels of layers read from the layers directory
 
 	servicesLock sync.Mutex
 	services     map[string]*serviceData
 
+	checkStatus CheckStatusFunc
+
 	serviceOutput io.Writer
 	restarter     Restarter
 
 	randLock sync.Mutex
 	rand     *rand.Rand
+
+	logErrorsLock sync.Mutex
+	logErrors     map[string]*logErrorStatus
+	// noticef reports log pipeline failures, logger.Noticef unless faked
+	// by tests.
+	noticef func(format string, v ...interface{})
+
+	logBudget  *servicelog.Budget
+	logReserve *servicelog.Reserve // protected by servicesLock
+
+	traceLogLatency bool // set by SetLogLatencyTracing before services start
+
+	outputLock    sync.Mutex
+	outputCopiers map[*outputCopier]bool
+	outputDrain   chan struct{} // closed by DrainOutput
+	outputDrained bool
+	outputClosed  int32 // set atomically when nothing more may be written
+
+	// outputWriteLock is read-locked by copiers while checking outputClosed
+	// and writing, so DrainOutput can wait for writes in progress.
+	outputWriteLock sync.RWMutex
 }
 
+// logErrorStatus tracks when a log write failure was last reported, and
+// how many failures have been suppressed since.
+type logErrorStatus struct {
+	lastLogged time.Time
+	suppressed int
+}
+
+// logErrorInterval is the minimum time between reports of log write
+// failures for the same service and stage.
+var logErrorInterval = time.Minute
+
 // PlanFunc is the type of function used by NotifyPlanChanged.
 type PlanFunc func(p *plan.Plan)
 
+// CheckStatusFunc is the type of function used by SetCheckStatusFunc. It
+// returns when the named health check was last run and its number of
+// consecutive failures, or ok false if there's no such check.
+type CheckStatusFunc func(name string) (lastRun time.Time, failures int, ok bool)
+
 type Restarter interface {
 	HandleRestart(t restart.RestartType)
 }
@@ -60,20 +106,169 @@ func NewManager(s *state.State, runner *state.TaskRunner, pebbleDir string, serv
 		serviceOutput: serviceOutput,
 		restarter:     restarter,
 		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		logBudget:     servicelog.NewBudget(0),
+		outputCopiers: make(map[*outputCopier]bool),
+		outputDrain:   make(chan struct{}),
+		noticef:       logger.Noticef,
 	}
 
 	runner.AddHandler("start", manager.doStart, nil)
 	runner.AddHandler("stop", manager.doStop, nil)
+	runner.AddHandler("reload", manager.doReload, nil)
 
 	return manager, nil
 }
 
+// warnf records a warning in the state. It does so asynchronously, as it's
+// often called with servicesLock held and the state lock must be acquired
+// first.
+func (m *ServiceManager) warnf(template string, args ...interface{}) {
+	go func() {
+		m.state.Lock()
+		defer m.state.Unlock()
+		m.state.Warnf(template, args...)
+	}()
+}
+
+// addNotice records a notice in the state, asynchronously like warnf.
+func (m *ServiceManager) addNotice(noticeType state.NoticeType, key string, data map[string]string) {
+	go func() {
+		m.state.Lock()
+		defer m.state.Unlock()
+		m.state.AddNotice(noticeType, key, data)
+	}()
+}
+
+// SetLogMemoryLimit sets the maximum total memory used by the log buffers
+// of all services, or removes the limit if limit is zero. Existing buffers
+// are not affected, but new services get smaller buffers (or none, in which
+// case their logs are dropped) if the limit has been reached.
+func (m *ServiceManager) SetLogMemoryLimit(limit int64) {
+	m.logBudget.SetLimit(limit)
+}
+
+// SetLogBurstReserve sets the size of the reserve of memory that services'
+// log buffers may borrow from during bursts of output, or removes it if
+// size is zero. Each buffer may borrow up to a quarter of the reserve, and
+// keeps its loan until it hasn't borrowed for logLoanDuration. It applies
+// to services started afterwards.
+func (m *ServiceManager) SetLogBurstReserve(size int64) {
+	m.servicesLock.Lock()
+	defer m.servicesLock.Unlock()
+	if size <= 0 {
+		m.logReserve = nil
+		return
+	}
+	bufferLimit := size / maxLogLoanFraction
+	if bufferLimit < servicelog.ReserveChunk {
+		bufferLimit = servicelog.ReserveChunk
+	}
+	m.logReserve = servicelog.NewReserve(int(size), int(bufferLimit), logLoanDuration)
+}
+
+// SetLogLatencyTracing enables or disables tracing of the latency of each
+// service's log lines (see ServiceInfo.LogLatency). It applies to services
+// started for the first time afterwards, so it should be called before any
+// services are started.
+func (m *ServiceManager) SetLogLatencyTracing(enabled bool) {
+	m.servicesLock.Lock()
+	defer m.servicesLock.Unlock()
+	m.traceLogLatency = enabled
+}
+
+// LogMemoryStats returns the accounting of memory used by service logs.
+func (m *ServiceManager) LogMemoryStats() servicelog.BudgetStats {
+	return m.logBudget.Stats()
+}
+
+// LogReserveStats returns the accounting of the log burst reserve, which
+// is all zero if there's no reserve.
+func (m *ServiceManager) LogReserveStats() servicelog.ReserveStats {
+	m.servicesLock.Lock()
+	reserve := m.logReserve
+	m.servicesLock.Unlock()
+	return reserve.Stats()
+}
+
+// logWriteError logs a failure to write a service's logs. A destination
+// that's failing usually fails for every line, so failures from the same
+// service and pipeline stage are only logged once per logErrorInterval,
+// with a count of the ones suppressed in between.
+func (m *ServiceManager) logWriteError(err error) {
+	key := ""
+	var writeErr *servicelog.WriteError
+	if errors.As(err, &writeErr) {
+		key = writeErr.Service + "\x00" + writeErr.Stage
+	}
+
+	suppressed, ok := m.logErrorDue(key)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		m.noticef("Log write failed: %v (%d similar failures suppressed)", err, suppressed)
+	} else {
+		m.noticef("Log write failed: %v", err)
+	}
+}
+
+// logPipelinePanic reports a panic recovered from a service's log pipeline,
+// with its stack, and records a notice. As with write failures, the panics
+// of the same service and stage are only logged once per logErrorInterval.
+// If disabled is set, the stage has panicked too often and is left out of
+// the service's pipeline until the next replan.
+func (m *ServiceManager) logPipelinePanic(name string, err *servicelog.PanicError, disabled bool) {
+	action := "switching to safe mode"
+	if disabled {
+		action = "disabling stage until replan"
+	}
+	if suppressed, ok := m.logErrorDue(name + "\x00" + err.Stage + "\x00panic"); ok {
+		if suppressed > 0 {
+			m.noticef("Service %q log %v, %s (%d similar panics suppressed)\n%s", name, err, action, suppressed, err.Stack)
+		} else {
+			m.noticef("Service %q log %v, %s\n%s", name, err, action, err.Stack)
+		}
+	}
+	m.addNotice(state.ServiceLogPanicNotice, name, map[string]string{
+		"stage":    err.Stage,
+		"panic":    fmt.Sprint(err.Value),
+		"disabled": strconv.FormatBool(disabled),
+	})
+}
+
+// logErrorDue reports whether a log pipeline failure with the given key
+// should be logged now, and how many were suppressed since the last one.
+func (m *ServiceManager) logErrorDue(key string) (suppressed int, ok bool) {
+	m.logErrorsLock.Lock()
+	defer m.logErrorsLock.Unlock()
+	if m.logErrors == nil {
+		m.logErrors = make(map[string]*logErrorStatus)
+	}
+	status := m.logErrors[key]
+	now := time.Now()
+	if status != nil && now.Sub(status.lastLogged) < logErrorInterval {
+		status.suppressed++
+		return 0, false
+	}
+	if status != nil {
+		suppressed = status.suppressed
+	}
+	m.logErrors[key] = &logErrorStatus{lastLogged: now}
+	return suppressed, true
+}
+
 // NotifyPlanChanged adds f to the list of functions that are called whenever
 // the plan is updated.
 func (m *ServiceManager) NotifyPlanChanged(f PlanFunc) {
 	m.planHandlers = append(m.planHandlers, f)
 }
 
+// SetCheckStatusFunc sets the function used to look up the status of a
+// health check, for services with a reload-ready-check.
+func (m *ServiceManager) SetCheckStatusFunc(f CheckStatusFunc) {
+	m.checkStatus = f
+}
+
 func (m *ServiceManager) updatePlan(p *plan.Plan) {
 	m.plan = p
 	for _, f := range m.planHandlers {
@@ -86,10 +281,115 @@ func (m *ServiceManager) reloadPlan() error {
 	if err != nil {
 		return err
 	}
+	m.dirLabels = layerLabels(p.Layers)
 	m.updatePlan(p)
 	return nil
 }
 
+func layerLabels(layers []*plan.Layer) map[string]bool {
+	labels := make(map[string]bool, len(layers))
+	for _, layer := range layers {
+		labels[layer.Label] = true
+	}
+	return labels
+}
+
+// ReloadLayers re-reads the layers directory and replaces the plan with the
+// result. Layers that were added through the API rather than read from the
+// directory are kept, ordered after the directory's layers (unless a file
+// with the same label now exists). If the new plan is invalid, the current
+// plan is kept and the error returned.
+//
+// It returns a summary of what changed, for example "services added: srv3;
+// checks changed: chk1", or "" if nothing did. As with changes made through
+// the API, the caller must replan for running services to pick up changes.
+func (m *ServiceManager) ReloadLayers() (summary string, err error) {
+	releasePlan, err := m.acquirePlan()
+	if err != nil {
+		return "", err
+	}
+	defer releasePlan()
+
+	p, err := plan.ReadDir(m.pebbleDir)
+	if err != nil {
+		return "", err
+	}
+	layers := p.Layers
+	order := 0
+	if len(layers) > 0 {
+		order = layers[len(layers)-1].Order
+	}
+	for _, layer := range m.plan.Layers {
+		if m.dirLabels[layer.Label] {
+			continue
+		}
+		if index, _ := findLayer(layers, layer.Label); index >= 0 {
+			continue
+		}
+		order++
+		kept := *layer
+		kept.Order = order
+		layers = append(layers, &kept)
+	}
+
+	old := m.plan
+	err = m.updatePlanLayers(layers)
+	if err != nil {
+		return "", err
+	}
+	m.dirLabels = layerLabels(p.Layers)
+	return planChanges(old, m.plan), nil
+}
+
+// planChanges summarizes the differences between the services, checks and
+// timers of two plans.
+func planChanges(old, new *plan.Plan) string {
+	var parts []string
+	for _, section := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"services", old.Services, new.Services},
+		{"checks", old.Checks, new.Checks},
+		{"timers", old.Timers, new.Timers},
+	} {
+		added, changed, removed := diffMaps(section.old, section.new)
+		for _, change := range []struct {
+			kind  string
+			names []string
+		}{{"added", added}, {"changed", changed}, {"removed", removed}} {
+			if len(change.names) > 0 {
+				parts = append(parts, fmt.Sprintf("%s %s: %s", section.name, change.kind, strings.Join(change.names, ", ")))
+			}
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// diffMaps returns the sorted keys added, changed and removed between two
+// maps of the same type with string keys.
+func diffMaps(old, new interface{}) (added, changed, removed []string) {
+	oldValue := reflect.ValueOf(old)
+	newValue := reflect.ValueOf(new)
+	for _, key := range newValue.MapKeys() {
+		oldElem := oldValue.MapIndex(key)
+		if !oldElem.IsValid() {
+			added = append(added, key.String())
+		} else if !reflect.DeepEqual(oldElem.Interface(), newValue.MapIndex(key).Interface()) {
+			changed = append(changed, key.String())
+		}
+	}
+	for _, key := range oldValue.MapKeys() {
+		if !newValue.MapIndex(key).IsValid() {
+			removed = append(removed, key.String())
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(changed)
+	sort.Strings(removed)
+	return added, changed, removed
+}
+
 // Plan returns the configuration plan.
 func (m *ServiceManager) Plan() (*plan.Plan, error) {
 	releasePlan, err := m.acquirePlan()
@@ -143,6 +443,7 @@ func (m *ServiceManager) updatePlanLayers(layers []*plan.Layer) error {
 		Layers:   layers,
 		Services: combined.Services,
 		Checks:   combined.Checks,
+		Timers:   combined.Timers,
 	}
 	m.updatePlan(p)
 	return nil
@@ -223,8 +524,90 @@ type ServiceInfo struct {
 	Name    string
 	Startup ServiceStartup
 	Current ServiceStatus
+
+	// MemoryCurrent is the service's current memory usage in bytes, or
+	// zero if it's not known (no limits are applied to the service).
+	MemoryCurrent int64
+
+	// CurrentSince is when the service last changed state, or zero if it
+	// has never been started.
+	CurrentSince time.Time
+
+	// Restarts is the number of times the service has been restarted
+	// automatically (by its on-success, on-failure, or on-check-failure
+	// action) since it was first started.
+	Restarts int
+
+	// LogBytes is the total number of bytes written to the service's log
+	// buffer, including timestamp prefixes.
+	LogBytes int64
+
+	// LogDroppedBytes is the number of bytes of the service's logs dropped
+	// because the log memory limit left no room for its log buffer.
+	LogDroppedBytes int64
+
+	// LogLatency holds the latency of the service's log lines per pipeline
+	// stage (see servicelog.Tracer), or nil if latency tracing isn't
+	// enabled.
+	LogLatency map[string]servicelog.LatencyHistogram
+
+	// LogPanics is the number of panics recovered from the service's log
+	// pipeline since it was first started.
+	LogPanics int
+
+	// Args are the extra arguments the service was last started with, if
+	// any (these are kept over automatic restarts).
+	Args []string
 }
 
+// LoggingInfo describes a service's log pipeline: the one its process's
+// output goes through if it's running, and otherwise the one it would be
+// started with.
+type LoggingInfo struct {
+	// Encoding is the service's log-encoding, if any.
+	Encoding string
+
+	// Files are the service's log-files patterns, if any.
+	Files []string
+
+	// Stages are the stages of the pipeline, in order.
+	Stages []string
+
+	// Mode is how far the pipeline has fallen back after panics.
+	Mode LogMode
+
+	// DisabledStages are the optional stages left out of the service's
+	// pipelines until the next replan, after panicking too often.
+	DisabledStages []string
+
+	// BufferSize is the capacity of the service's log buffer in bytes, and
+	// BufferUsed the number of bytes of logs it holds. Both are zero if
+	// the service has never been started.
+	BufferSize int
+	BufferUsed int
+
+	// BufferBorrowed is the number of bytes of BufferSize borrowed from
+	// the log burst reserve.
+	BufferBorrowed int
+}
+
+// LogMode is the state of a service's log pipeline.
+type LogMode string
+
+const (
+	// LogModeFull means output goes through all of the pipeline's stages.
+	LogModeFull LogMode = "full"
+
+	// LogModeMinimal means a stage has panicked, and output goes through a
+	// minimal pipeline without the optional stages until the service is
+	// restarted.
+	LogModeMinimal LogMode = "minimal"
+
+	// LogModeDropping means the minimal pipeline has panicked too, and
+	// output is dropped until the service is restarted.
+	LogModeDropping LogMode = "dropping"
+)
+
 type ServiceStartup string
 
 const (
@@ -284,6 +667,24 @@ func (m *ServiceManager) Services(names []string) ([]*ServiceInfo, error) {
 			default:
 				info.Current = StatusError
 			}
+			if s.cgroup != nil {
+				current, err := s.cgroup.MemoryCurrent()
+				if err == nil {
+					info.MemoryCurrent = current
+				}
+			}
+			info.CurrentSince = s.stateSince
+			info.Restarts = s.restarts
+			_, end := s.logs.Positions()
+			info.LogBytes = int64(end)
+			info.LogDroppedBytes = s.logs.Dropped()
+			if s.logTracer != nil {
+				info.LogLatency = s.logTracer.Latency()
+			}
+			s.logPanicsLock.Lock()
+			info.LogPanics = s.logPanicsTotal
+			s.logPanicsLock.Unlock()
+			info.Args = append([]string(nil), s.args...)
 		}
 		services = append(services, info)
 	}
@@ -293,6 +694,120 @@ func (m *ServiceManager) Services(names []string) ([]*ServiceInfo, error) {
 	return services, nil
 }
 
+// ServiceLogging describes the log pipelines of the named services (or of
+// all services if names is empty), as they are at the time of the call.
+func (m *ServiceManager) ServiceLogging(names []string) (map[string]*LoggingInfo, error) {
+	releasePlan, err := m.acquirePlan()
+	if err != nil {
+		return nil, err
+	}
+	defer releasePlan()
+
+	m.servicesLock.Lock()
+	defer m.servicesLock.Unlock()
+
+	requested := make(map[string]bool, len(names))
+	for _, name := range names {
+		requested[name] = true
+	}
+	infos := make(map[string]*LoggingInfo)
+	for name, config := range m.plan.Services {
+		if len(names) > 0 && !requested[name] {
+			continue
+		}
+		infos[name] = m.loggingInfo(config, m.services[name])
+	}
+	return infos, nil
+}
+
+// loggingInfo describes the log pipeline of the service with the given
+// config, where s is its data (nil if it has never been started).
+func (m *ServiceManager) loggingInfo(config *plan.Service, s *serviceData) *LoggingInfo {
+	info := &LoggingInfo{
+		Encoding: config.LogEncoding,
+		Files:    append([]string(nil), config.LogFiles...),
+		Mode:     LogModeFull,
+	}
+	if s == nil {
+		s = &serviceData{}
+	} else {
+		info.BufferSize = s.logs.Size()
+		info.BufferUsed = s.logs.Buffered()
+		info.BufferBorrowed = s.logs.Borrowed()
+	}
+	for stage := range optionalLogStages {
+		if s.logStageDisabled(stage) {
+			info.DisabledStages = append(info.DisabledStages, stage)
+		}
+	}
+	sort.Strings(info.DisabledStages)
+
+	switch s.state {
+	case stateStarting, stateRunning, stateTerminating, stateKilling:
+		s.logPanicsLock.Lock()
+		info.Stages = append([]string(nil), s.logStages...)
+		info.Mode = s.logMode
+		s.logPanicsLock.Unlock()
+	default:
+		info.Stages = s.logStageNames(config)
+		if m.serviceOutput != nil {
+			info.Stages = append(info.Stages, servicelog.StageOutput)
+		}
+	}
+	return info
+}
+
+// ServiceUsage returns the resource usage of the processes of the named
+// services (or of all services if names is empty), read on demand from the
+// proc filesystem. A service's usage covers its cgroup if it has one, and
+// otherwise its process and all descendants. Services that aren't running, or
+// whose usage can't be read (for example, on systems without /proc), are
+// omitted.
+func (m *ServiceManager) ServiceUsage(names []string) map[string]*procstat.Usage {
+	type serviceProcess struct {
+		pid   int
+		group *cgroup.Group
+	}
+	requested := make(map[string]bool, len(names))
+	for _, name := range names {
+		requested[name] = true
+	}
+	processes := make(map[string]serviceProcess)
+	m.servicesLock.Lock()
+	for name, s := range m.services {
+		if len(names) > 0 && !requested[name] {
+			continue
+		}
+		if (s.state != stateStarting && s.state != stateRunning) || s.cmd == nil || s.cmd.Process == nil {
+			continue
+		}
+		processes[name] = serviceProcess{pid: s.cmd.Process.Pid, group: s.cgroup}
+	}
+	m.servicesLock.Unlock()
+
+	// Read the usage without holding the lock, as it may walk all of /proc.
+	usages := make(map[string]*procstat.Usage, len(processes))
+	for name, process := range processes {
+		usage, err := processUsage(process.pid, process.group)
+		if err != nil {
+			logger.Debugf("Cannot read resource usage of service %q: %v", name, err)
+			continue
+		}
+		usages[name] = usage
+	}
+	return usages
+}
+
+func processUsage(pid int, group *cgroup.Group) (*procstat.Usage, error) {
+	if group != nil {
+		pids, err := group.Procs()
+		if err == nil && len(pids) > 0 {
+			return procstat.ProcessesUsage(procRoot, pids)
+		}
+	}
+	return procstat.TreeUsage(procRoot, pid)
+}
+
 // DefaultServiceNames returns the name of the services set to start
 // by default.
 func (m *ServiceManager) DefaultServiceNames() ([]string, error) {
@@ -312,6 +827,18 @@ func (m *ServiceManager) DefaultServiceNames() ([]string, error) {
 	return m.plan.StartOrder(names)
 }
 
+// GroupServices returns the names of the services in any of the given
+// groups, sorted by name.
+func (m *ServiceManager) GroupServices(groups []string) ([]string, error) {
+	releasePlan, err := m.acquirePlan()
+	if err != nil {
+		return nil, err
+	}
+	defer releasePlan()
+
+	return m.plan.GroupServices(groups)
+}
+
 // StartOrder returns the provided services, together with any required
 // dependencies, in the proper order for starting them all up.
 func (m *ServiceManager) StartOrder(services []string) ([]string, error) {
@@ -373,11 +900,13 @@ func (m *ServiceManager) ServiceLogs(services []string, last int) (map[string]se
 }
 
 // Replan returns a list of services to stop and services to start because
-// their plans had changed between when they started and this call.
-func (m *ServiceManager) Replan() ([]string, []string, error) {
+// their plans had changed between when they started and this call, and a
+// list of running services to reload instead of restarting, because they
+// have a reload-signal and only reload-safe fields changed.
+func (m *ServiceManager) Replan() (stop, start, reload []string, err error) {
 	releasePlan, err := m.acquirePlan()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	defer releasePlan()
 
@@ -385,19 +914,29 @@ func (m *ServiceManager) Replan() ([]string, []string, error) {
 	defer m.servicesLock.Unlock()
 
 	needsRestart := make(map[string]bool)
-	var stop []string
 	for name, s := range m.services {
+		// Give log pipeline stages left out after panicking another chance.
+		s.resetLogPanics()
 		if config, ok := m.plan.Services[name]; ok {
-			if config.Equal(s.config) {
+			// Also treat a running service as changed if its rendered files
+			// would change (for example, if a template source was updated).
+			running := s.state == stateStarting || s.state == stateRunning
+			if config.Equal(s.config) && !(running && renderChanged(config)) {
 				continue
 			}
+			reloadable := config.ReloadSignal != "" && config.ReloadSafe(s.config)
 			s.config = config.Copy() // update service config from plan
+			if reloadable && running {
+				reload = append(reload, name)
+				continue
+			}
 		}
 		needsRestart[name] = true
 		stop = append(stop, name)
 	}
 
-	var start []string
+	sort.Strings(reload)
+
 	for name, config := range m.plan.Services {
 		if needsRestart[name] || config.Startup == plan.StartupEnabled {
 			start = append(start, name)
@@ -406,7 +945,7 @@ func (m *ServiceManager) Replan() ([]string, []string, error) {
 
 	stop, err = m.plan.StopOrder(stop)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	for i, name := range stop {
 		if !needsRestart[name] {
@@ -416,10 +955,10 @@ func (m *ServiceManager) Replan() ([]string, []string, error) {
 
 	start, err = m.plan.StartOrder(start)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	return stop, start, nil
+	return stop, start, reload, nil
 }
 
 func (m *ServiceManager) SendSignal(services []string, signal string) error {
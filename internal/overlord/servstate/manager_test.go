@@ -16,15 +16,19 @@ package servstate_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -32,12 +36,14 @@ import (
 	. "gopkg.in/check.v1"
 	"gopkg.in/yaml.v3"
 
+	"github.com/canonical/pebble/internal/cgroup"
 	"github.com/canonical/pebble/internal/logger"
 	"github.com/canonical/pebble/internal/overlord/checkstate"
 	"github.com/canonical/pebble/internal/overlord/restart"
 	"github.com/canonical/pebble/internal/overlord/servstate"
 	"github.com/canonical/pebble/internal/overlord/state"
 	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/servicelog"
 	"github.com/canonical/pebble/internal/testutil"
 )
 
@@ -56,6 +62,8 @@ type S struct {
 	log          string
 	logBuffer    bytes.Buffer
 	logBufferMut sync.Mutex
+	// logWriteHook, if set, is called before each write to logBuffer.
+	logWriteHook func(p []byte)
 
 	st *state.State
 
@@ -132,7 +140,11 @@ func (s *S) SetUpTest(c *C) {
 	s.logBufferMut.Lock()
 	s.logBuffer.Reset()
 	s.logBufferMut.Unlock()
+	s.logWriteHook = nil
 	logOutput := writerFunc(func(p []byte) (int, error) {
+		if s.logWriteHook != nil {
+			s.logWriteHook(p)
+		}
 		s.logBufferMut.Lock()
 		defer s.logBufferMut.Unlock()
 		return s.logBuffer.Write(p)
@@ -170,7 +182,8 @@ func (s *S) assertLog(c *C, expected string) {
 	}
 	c.Assert(err, IsNil)
 	c.Assert(string(data), Matches, "(?s)"+expected)
-	c.Assert(s.logBuffer.String(), Matches, "(?s)"+expected)
+	// The output may end with lines marking a service's restart.
+	c.Assert(s.logBuffer.String(), Matches, "(?s)"+expected+`([^\n]* \[pebble\] [^\n]*\n)*`)
 }
 
 func (s *S) logBufferString() string {
@@ -309,10 +322,11 @@ func (s *S) TestReplanServices(c *C) {
 	err := s.manager.CombineLayer(layer)
 	c.Assert(err, IsNil)
 
-	stops, starts, err := s.manager.Replan()
+	stops, starts, reloads, err := s.manager.Replan()
 	c.Assert(err, IsNil)
 	c.Check(stops, DeepEquals, []string{"test2"})
 	c.Check(starts, DeepEquals, []string{"test1", "test2"})
+	c.Check(reloads, HasLen, 0)
 
 	s.stopTestServices(c)
 }
@@ -340,7 +354,7 @@ services:
 	c.Assert(err, IsNil)
 
 	// Call Replan and ensure the ServiceManager's config has updated.
-	_, _, err = s.manager.Replan()
+	_, _, _, err = s.manager.Replan()
 	c.Assert(err, IsNil)
 	config = s.manager.Config("test2")
 	c.Assert(config, NotNil)
@@ -375,14 +389,15 @@ services:
 
 func (s *S) TestServiceLogs(c *C) {
 	outputs := map[string]string{
-		"test1": `2.* \[test1\] test1\n`,
-		"test2": `2.* \[test2\] test2\n`,
+		"test1": `2.* \[pebble\] --- service "test1" started .*\n2.* \[test1\] test1\n`,
+		"test2": `2.* \[pebble\] --- service "test2" started .*\n2.* \[test2\] test2\n`,
 	}
 	s.testServiceLogs(c, outputs)
 
 	// Run test again, but ensure the logs from the previous run are still in the ring buffer.
-	outputs["test1"] += outputs["test1"]
-	outputs["test2"] += outputs["test2"]
+	// The previous run's processes were stopped in between.
+	outputs["test1"] += `2.* \[pebble\] --- service "test1" killed by SIGTERM after .*\n` + outputs["test1"]
+	outputs["test2"] += `2.* \[pebble\] --- service "test2" killed by SIGTERM after .*\n` + outputs["test2"]
 	s.testServiceLogs(c, outputs)
 }
 
@@ -469,6 +484,13 @@ func (s *S) serviceByName(c *C, name string) *servstate.ServiceInfo {
 	return services[0]
 }
 
+func (s *S) serviceLogging(c *C, name string) *servstate.LoggingInfo {
+	infos, err := s.manager.ServiceLogging([]string{name})
+	c.Assert(err, IsNil)
+	c.Assert(infos[name], NotNil)
+	return infos[name]
+}
+
 func (s *S) TestStartFastExitCommand(c *C) {
 	chg := s.startServices(c, []string{"test4"}, 1)
 
@@ -615,6 +637,68 @@ services:
 	s.planLayersHasLen(c, manager, 3)
 }
 
+func (s *S) TestReloadLayers(c *C) {
+	// Add a layer through the API, which is kept when reloading.
+	layer := parseLayer(c, 0, "api", `
+services:
+    api:
+        override: replace
+        command: echo api
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	summary, err := s.manager.ReloadLayers()
+	c.Assert(err, IsNil)
+	c.Check(summary, Equals, "")
+
+	err = os.Remove(filepath.Join(s.dir, "layers", "002-two.yaml"))
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(s.dir, "layers", "003-three.yaml"), []byte(`
+services:
+    test2:
+        override: merge
+        command: echo changed
+    test6:
+        override: replace
+        command: echo new
+checks:
+    chk1:
+        override: replace
+        exec:
+            command: "true"
+`), 0644)
+	c.Assert(err, IsNil)
+
+	summary, err = s.manager.ReloadLayers()
+	c.Assert(err, IsNil)
+	c.Check(summary, Equals, "services added: test6; services changed: test2; "+
+		"services removed: test3, test4, test5; checks added: chk1")
+	p, err := s.manager.Plan()
+	c.Assert(err, IsNil)
+	var labels []string
+	var orders []int
+	for _, layer := range p.Layers {
+		labels = append(labels, layer.Label)
+		orders = append(orders, layer.Order)
+	}
+	c.Check(labels, DeepEquals, []string{"base", "three", "api"})
+	c.Check(orders, DeepEquals, []int{1, 3, 4})
+
+	// An invalid layer keeps the current plan.
+	err = ioutil.WriteFile(filepath.Join(s.dir, "layers", "004-bad.yaml"), []byte(`
+services:
+    test2:
+        command: echo bad
+`), 0644)
+	c.Assert(err, IsNil)
+	_, err = s.manager.ReloadLayers()
+	c.Check(err, ErrorMatches, `layer "bad" must define "override" for service "test2"`)
+	newPlan, err := s.manager.Plan()
+	c.Assert(err, IsNil)
+	c.Check(newPlan, Equals, p)
+}
+
 func (s *S) TestCombineLayer(c *C) {
 	dir := c.MkDir()
 	os.Mkdir(filepath.Join(dir, "layers"), 0755)
@@ -747,10 +831,14 @@ func (s *S) TestServices(c *C) {
 	})
 
 	// Start a service and ensure it's marked active
+	before := time.Now()
 	s.startServices(c, []string{"test2"}, 1)
 
 	services, err = s.manager.Services(nil)
 	c.Assert(err, IsNil)
+	c.Assert(services[1].CurrentSince.After(before), Equals, true)
+	services[1].CurrentSince = time.Time{}
+	services[1].LogBytes = 0 // depends on timing of output
 	c.Assert(services, DeepEquals, []*servstate.ServiceInfo{
 		{Name: "test1", Current: servstate.StatusInactive, Startup: servstate.StartupEnabled},
 		{Name: "test2", Current: servstate.StatusActive, Startup: servstate.StartupDisabled},
@@ -806,425 +894,2298 @@ PEBBLE_ENV_TEST_PARENT=from-parent
 `[1:])
 }
 
-type writerFunc func([]byte) (int, error)
-
-func (f writerFunc) Write(p []byte) (int, error) {
-	return f(p)
-}
-
-func (s *S) TestActionRestart(c *C) {
-	// Add custom backoff delay so it auto-restarts quickly.
-	layer := parseLayer(c, 0, "layer", `
+func (s *S) TestEnvironmentFiles(c *C) {
+	dir := c.MkDir()
+	logPath := filepath.Join(dir, "log.txt")
+	defaultsPath := filepath.Join(dir, "defaults.env")
+	err := ioutil.WriteFile(defaultsPath, []byte("PEBBLE_ENVFILE_TEST_1=defaults\r\nPEBBLE_ENVFILE_TEST_2=defaults\r\nPEBBLE_ENVFILE_TEST_3=defaults\r\n"), 0600)
+	c.Assert(err, IsNil)
+	localPath := filepath.Join(dir, "local.env")
+	err = ioutil.WriteFile(localPath, []byte("export PEBBLE_ENVFILE_TEST_2=\"local value\"\n"), 0600)
+	c.Assert(err, IsNil)
+	passPath := filepath.Join(dir, "pass")
+	err = ioutil.WriteFile(passPath, []byte("s3cret\n"), 0600)
+	c.Assert(err, IsNil)
+	layer := parseLayer(c, 0, "envlayer", fmt.Sprintf(`
 services:
-    test2:
-        override: merge
-        command: /bin/sh -c "echo test2; exec sleep 300"
-        backoff-delay: 50ms
-        backoff-limit: 150ms
-`)
-	err := s.manager.AppendLayer(layer)
+    envtest:
+        override: replace
+        command: /bin/sh -c "env | grep PEBBLE_ENVFILE_TEST | sort > %s; sleep 300"
+        environment-files:
+            - %s
+            - %s
+            - -%s
+        environment:
+            PEBBLE_ENVFILE_TEST_1: inline
+            PEBBLE_ENVFILE_TEST_PASS: {file: %s}
+            PEBBLE_ENVFILE_TEST_MISSING: {file: %s, optional: true}
+`, logPath, defaultsPath, localPath, filepath.Join(dir, "missing.env"), passPath, filepath.Join(dir, "missing")))
+	err = s.manager.AppendLayer(layer)
 	c.Assert(err, IsNil)
 
-	// Start service and wait till it starts up the first time.
-	chg := s.startServices(c, []string{"test2"}, 1)
-	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
-		return svc.Current == servstate.StatusActive
-	})
-	c.Assert(s.manager.BackoffNum("test2"), Equals, 0)
+	chg := s.startServices(c, []string{"envtest"}, 1)
+	defer s.stopServices(c, []string{"envtest"}, 1)
 	s.st.Lock()
-	c.Check(chg.Status(), Equals, state.DoneStatus)
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
 	s.st.Unlock()
-	time.Sleep(10 * time.Millisecond) // ensure it has enough time to write to the log
-	c.Check(s.logBufferString(), Matches, `2.* \[test2\] test2\n`)
 
-	// Send signal to process to terminate it early.
-	err = s.manager.SendSignal([]string{"test2"}, "SIGTERM")
+	// Later files override earlier ones, and inline values override files.
+	data, err := ioutil.ReadFile(logPath)
 	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `
+PEBBLE_ENVFILE_TEST_1=inline
+PEBBLE_ENVFILE_TEST_2=local value
+PEBBLE_ENVFILE_TEST_3=defaults
+PEBBLE_ENVFILE_TEST_PASS=s3cret
+`[1:])
 
-	// Wait for it to go into backoff state.
-	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
-		return svc.Current == servstate.StatusBackoff && s.manager.BackoffNum("test2") == 1
-	})
-
-	// Then wait for it to auto-restart (backoff time plus a bit).
-	time.Sleep(75 * time.Millisecond)
-	svc := s.serviceByName(c, "test2")
-	c.Assert(svc.Current, Equals, servstate.StatusActive)
-	c.Check(s.logBufferString(), Matches, `2.* \[test2\] test2\n`)
+	// The plan only records where values come from, not the values.
+	out, err := yaml.Marshal(s.manager.Config("envtest"))
+	c.Assert(err, IsNil)
+	c.Check(string(out), Matches, `(?s).*PEBBLE_ENVFILE_TEST_PASS:\n\s+file: .*/pass\n.*`)
+	c.Check(string(out), Not(Matches), `(?s).*(s3cret|local value).*`)
+}
 
-	// Send signal to terminate it again.
-	err = s.manager.SendSignal([]string{"test2"}, "SIGTERM")
+func (s *S) TestEnvironmentFileErrors(c *C) {
+	dir := c.MkDir()
+	envPath := filepath.Join(dir, "app.env")
+	err := ioutil.WriteFile(envPath, []byte("A=1\ns3cret\n"), 0600)
 	c.Assert(err, IsNil)
+	missingPath := filepath.Join(dir, "missing.env")
+
+	for i, test := range []struct {
+		yaml  string
+		error string
+	}{{
+		yaml:  "environment-files: [" + missingPath + "]",
+		error: `cannot read environment file: open .*/missing.env: no such file or directory`,
+	}, {
+		yaml:  "environment: {PASS: {file: " + missingPath + "}}",
+		error: `cannot read environment variable "PASS": open .*/missing.env: no such file or directory`,
+	}, {
+		yaml:  "environment-files: [" + envPath + "]",
+		error: `cannot parse environment file ".*/app.env": line 2: expected KEY=VALUE`,
+	}} {
+		layer := parseLayer(c, 0, "envlayer-"+strconv.Itoa(i), `
+services:
+    envtest:
+        override: replace
+        command: sleep 300
+        `+test.yaml+`
+`)
+		err = s.manager.AppendLayer(layer)
+		c.Assert(err, IsNil)
 
-	// Wait for it to go into backoff state.
-	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
-		return svc.Current == servstate.StatusBackoff && s.manager.BackoffNum("test2") == 2
-	})
+		chg := s.startServices(c, []string{"envtest"}, 1)
+		s.st.Lock()
+		c.Check(chg.Status(), Equals, state.ErrorStatus)
+		c.Check(chg.Err(), ErrorMatches, `(?s).*\(`+test.error+`\)`)
+		c.Check(chg.Err(), Not(ErrorMatches), `(?s).*s3cret.*`)
+		s.st.Unlock()
+		c.Check(s.serviceByName(c, "envtest").Current, Equals, servstate.StatusInactive)
+	}
+}
 
-	// Then wait for it to auto-restart (backoff time plus a bit).
-	time.Sleep(125 * time.Millisecond)
-	svc = s.serviceByName(c, "test2")
-	c.Assert(svc.Current, Equals, servstate.StatusActive)
-	c.Check(s.logBufferString(), Matches, `2.* \[test2\] test2\n`)
+func (s *S) TestServiceUsage(c *C) {
+	chg := s.startServices(c, []string{"test2"}, 1)
+	defer s.stopServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
 
-	// Test that backoff reset time is working (set to backoff-limit)
-	time.Sleep(175 * time.Millisecond)
-	c.Check(s.manager.BackoffNum("test2"), Equals, 0)
+	// Only running services are reported.
+	usages := s.manager.ServiceUsage(nil)
+	c.Assert(usages, HasLen, 1)
+	usage := usages["test2"]
+	c.Assert(usage, NotNil)
+	c.Check(usage.Processes > 0, Equals, true)
+	c.Check(usage.RSS > 0, Equals, true)
+	c.Check(usage.Threads > 0, Equals, true)
+	c.Check(usage.FDs > 0, Equals, true)
 
-	// Send signal to process to terminate it early.
-	err = s.manager.SendSignal([]string{"test2"}, "SIGTERM")
+	c.Check(s.manager.ServiceUsage([]string{"test1"}), HasLen, 0)
+
+	// Usage that can't be read is omitted.
+	restore := servstate.FakeProcRoot(c.MkDir())
+	defer restore()
+	c.Check(s.manager.ServiceUsage([]string{"test2"}), HasLen, 0)
+}
+
+func (s *S) TestLogMemoryLimit(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    logmem1:
+        override: replace
+        command: /bin/sh -c "echo logmem1; sleep 300"
+    logmem2:
+        override: replace
+        command: /bin/sh -c "echo logmem2; sleep 300"
+    logmem3:
+        override: replace
+        command: /bin/sh -c "echo logmem3; sleep 300"
+    logmem4:
+        override: replace
+        command: /bin/sh -c "echo logmem4; sleep 300"
+    logmem5:
+        override: replace
+        command: /bin/sh -c "echo logmem5; sleep 300"
+`)
+	err := s.manager.AppendLayer(layer)
 	c.Assert(err, IsNil)
+	s.manager.SetLogMemoryLimit(220 * 1024)
+	defer func() {
+		for _, name := range []string{"logmem2", "logmem3", "logmem4", "logmem5"} {
+			s.stopServices(c, []string{name}, 1)
+		}
+	}()
 
-	// Wait for it to go into backoff state (back to backoff 1 again).
-	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
-		return svc.Current == servstate.StatusBackoff && s.manager.BackoffNum("test2") == 1
+	start := func(name string) {
+		chg := s.startServices(c, []string{name}, 1)
+		s.st.Lock()
+		c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+		s.st.Unlock()
+	}
+	start("logmem1")
+	s.stopServices(c, []string{"logmem1"}, 1)
+	start("logmem2")
+	c.Check(s.manager.LogMemoryStats().Used, Equals, int64(200*1024))
+
+	// There's no room for another full buffer, so the stopped service's
+	// buffer is shrunk to make room.
+	start("logmem3")
+	c.Check(s.manager.LogMemoryStats().Used, Equals, int64(204*1024))
+
+	// With no idle services left to shrink, the next service gets what's
+	// left, and the one after that gets nothing and drops its logs.
+	start("logmem4")
+	start("logmem5")
+	stats := s.manager.LogMemoryStats()
+	c.Check(stats.Used, Equals, int64(220*1024))
+	c.Check(stats.Limit, Equals, int64(220*1024))
+	c.Check(stats.Denied, Equals, int64(1))
+	s.waitUntilService(c, "logmem5", func(svc *servstate.ServiceInfo) bool {
+		return svc.LogDroppedBytes > 0
 	})
-
-	// Then wait for it to auto-restart (backoff time plus a bit).
-	time.Sleep(75 * time.Millisecond)
-	svc = s.serviceByName(c, "test2")
-	c.Assert(svc.Current, Equals, servstate.StatusActive)
-	c.Check(s.logBufferString(), Matches, `2.* \[test2\] test2\n`)
+	c.Check(s.serviceByName(c, "logmem4").LogDroppedBytes, Equals, int64(0))
+	c.Check(s.manager.LogMemoryStats().Dropped > 0, Equals, true)
 }
 
-func (s *S) TestStopDuringBackoff(c *C) {
+func (s *S) TestLogBurstReserve(c *C) {
 	layer := parseLayer(c, 0, "layer", `
 services:
-    test2:
-        override: merge
-        command: sleep 0.1
+    bursty:
+        override: replace
+        command: /bin/sh -c "yes burst | head -n 50000; exec sleep 300"
+    quiet:
+        override: replace
+        command: /bin/sh -c "echo quiet; exec sleep 300"
 `)
 	err := s.manager.AppendLayer(layer)
 	c.Assert(err, IsNil)
+	s.manager.SetLogBurstReserve(400 * 1024)
+	defer s.manager.SetLogBurstReserve(0)
 
-	// Start service and wait till it starts up the first time.
-	chg := s.startServices(c, []string{"test2"}, 1)
-	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
-		return svc.Current == servstate.StatusActive
-	})
-	c.Assert(s.manager.BackoffNum("test2"), Equals, 0)
+	chg := s.startServices(c, []string{"bursty", "quiet"}, 2)
+	defer s.stopServices(c, []string{"bursty", "quiet"}, 2)
 	s.st.Lock()
-	c.Check(chg.Status(), Equals, state.DoneStatus)
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
 	s.st.Unlock()
 
-	// Wait for it to exit and go into backoff state.
-	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
-		return svc.Current == servstate.StatusBackoff && s.manager.BackoffNum("test2") == 1
+	// The burst borrows up to a quarter of the reserve, on top of the
+	// usual buffer, and the quiet service borrows nothing.
+	s.waitUntilLogging(c, "bursty", func(logging *servstate.LoggingInfo) bool {
+		return logging.BufferBorrowed == 100*1024
 	})
-
-	// Ensure it can be stopped successfully.
-	chg = s.stopServices(c, []string{"test2"}, 1)
-	s.st.Lock()
-	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
-	s.st.Unlock()
-	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
-		return svc.Current == servstate.StatusInactive
+	logging := s.serviceLogging(c, "bursty")
+	c.Check(logging.BufferSize, Equals, 200*1024)
+	c.Check(logging.BufferUsed, Equals, 200*1024)
+	s.waitUntilLogging(c, "quiet", func(logging *servstate.LoggingInfo) bool {
+		return logging.BufferUsed > 0
 	})
+	c.Check(s.serviceLogging(c, "quiet").BufferBorrowed, Equals, 0)
+
+	stats := s.manager.LogReserveStats()
+	c.Check(stats.Limit, Equals, int64(400*1024))
+	c.Check(stats.BufferLimit, Equals, int64(100*1024))
+	c.Check(stats.Lent, Equals, int64(100*1024))
+	c.Check(stats.Loans, Equals, int64(1))
+	c.Check(stats.Borrows > 0, Equals, true)
+	c.Check(s.manager.LogMemoryStats().Used, Equals, int64(300*1024))
 }
 
-func (s *S) TestOnCheckFailureRestartWhileRunning(c *C) {
-	// Create check manager and tell it about plan updates
-	checkMgr := checkstate.NewManager()
-	defer checkMgr.PlanChanged(&plan.Plan{})
-	s.manager.NotifyPlanChanged(checkMgr.PlanChanged)
+func (s *S) TestLogEncoding(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    utf16:
+        override: replace
+        command: /bin/sh -c "printf '\\377\\376h\\000\\351\\000l\\000l\\000o\\000\\n\\000'; exec sleep 300"
+        log-encoding: auto
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	chg := s.startServices(c, []string{"utf16"}, 1)
+	defer s.stopServices(c, []string{"utf16"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
 
-	// Tell service manager about check failures
-	checkMgr.NotifyCheckFailed(s.manager.CheckFailed)
+	iterators, err := s.manager.ServiceLogs([]string{"utf16"}, -1)
+	c.Assert(err, IsNil)
+	it := iterators["utf16"]
+	c.Assert(it, NotNil)
+	defer it.Close()
+	buf := &bytes.Buffer{}
+	for it.Next(nil) {
+		_, err = io.Copy(buf, it)
+		c.Assert(err, IsNil)
+	}
+	c.Check(buf.String(), Matches, `2.* \[pebble\] --- service "utf16" started .*\n2.* \[utf16\] héllo\n`)
+}
 
-	tempDir := c.MkDir()
-	tempFile := filepath.Join(tempDir, "out")
-	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+func (s *S) TestLogCoalesce(c *C) {
+	layer := parseLayer(c, 0, "layer", `
 services:
-    test2:
+    unbuffered:
         override: replace
-        command: /bin/sh -c 'echo x >>%s; sleep 1'
-        backoff-delay: 50ms
-        on-check-failure:
-            chk1: restart
-
-checks:
-    chk1:
-         override: replace
-         period: 75ms  # a bit longer than shortOkayWait
-         threshold: 1
-         exec:
-             command: will-fail
-`, tempFile))
+        command: /bin/sh -c "for b in h e l l o; do printf $b; done; echo; printf 'prompt> '; exec sleep 300"
+        log-coalesce: 50ms
+`)
 	err := s.manager.AppendLayer(layer)
 	c.Assert(err, IsNil)
+	chg := s.startServices(c, []string{"unbuffered"}, 1)
+	defer s.stopServices(c, []string{"unbuffered"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
 
-	// Start service and wait till it starts up (output file is written to)
-	s.startServices(c, []string{"test2"}, 1)
-	for i := 0; ; i++ {
-		if i >= 100 {
-			c.Fatalf("failed waiting for command to start")
-		}
-		b, _ := ioutil.ReadFile(tempFile)
-		if string(b) == "x\n" {
-			break
-		}
-		time.Sleep(5 * time.Millisecond)
-	}
+	c.Check(s.serviceLogging(c, "unbuffered").Stages, DeepEquals, []string{"coalesce", "format", "buffer", "output"})
 
-	// Now wait till check happens (it will-fail)
-	for i := 0; ; i++ {
+	// The incomplete line is passed on after the delay.
+	for i := 0; !strings.Contains(s.serviceLogs(c, "unbuffered"), "prompt> "); i++ {
 		if i >= 100 {
-			c.Fatalf("failed waiting for check to fail")
-		}
-		checks, err := checkMgr.Checks("", nil)
-		c.Assert(err, IsNil)
-		if len(checks) == 1 && !checks[0].Healthy {
-			c.Assert(checks[0].Failures, Equals, 1)
-			c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
-			break
+			c.Fatalf("timed out waiting for output")
 		}
-		time.Sleep(5 * time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
 	}
+	c.Check(s.serviceLogs(c, "unbuffered"), Matches, `
+2.* \[pebble\] --- service "unbuffered" started .*
+2.* \[unbuffered\] hello
+2.* \[unbuffered\] prompt> $`[1:])
+}
 
-	// Check failure should terminate process, backoff, and restart it, so wait for that
-	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
-		return svc.Current == servstate.StatusBackoff
-	})
-	for i := 0; ; i++ {
+func (s *S) TestLogFiles(c *C) {
+	logFile := filepath.Join(s.dir, "vendor.log")
+	err := ioutil.WriteFile(logFile, []byte("written before start\n"), 0644)
+	c.Assert(err, IsNil)
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    vendor:
+        override: replace
+        command: /bin/sh -c "echo to stdout; echo to file >>%s; exec sleep 300"
+        log-files:
+            - %s/*.log
+`, logFile, s.dir))
+	err = s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	chg := s.startServices(c, []string{"vendor"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	// Lines appended to the file while the service runs are added to its
+	// logs, and an incomplete last line is written when it stops.
+	for i := 0; !strings.Contains(s.serviceLogs(c, "vendor"), "to file"); i++ {
 		if i >= 100 {
-			c.Fatalf("failed waiting for command to start")
-		}
-		b, err := ioutil.ReadFile(tempFile)
-		c.Assert(err, IsNil)
-		if string(b) == "x\nx\n" {
-			break
+			c.Fatalf("timed out waiting for log file lines")
 		}
-		time.Sleep(5 * time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
 	}
-
-	// Shouldn't be restarted again
-	time.Sleep(100 * time.Millisecond)
-	b, err := ioutil.ReadFile(tempFile)
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0)
 	c.Assert(err, IsNil)
-	c.Assert(string(b), Equals, "x\nx\n")
-	checks, err := checkMgr.Checks("", nil)
+	_, err = f.WriteString("no newline")
 	c.Assert(err, IsNil)
-	c.Assert(len(checks), Equals, 1)
-	c.Assert(checks[0].Healthy, Equals, false)
-	c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
-	svc := s.serviceByName(c, "test2")
-	c.Assert(svc.Current, Equals, servstate.StatusActive)
-	c.Assert(s.manager.BackoffNum("test2"), Equals, 1)
+	s.stopServices(c, []string{"vendor"}, 1)
+	_, err = f.WriteString("\nafter stop\n")
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	c.Check(s.serviceLogs(c, "vendor"), Matches, `(?s)2.* \[vendor\] to stdout\n2.* \[vendor\] to file\n2.* \[vendor\] no newline\n2.* \[pebble\] --- service "vendor" killed by SIGTERM after .* ---\n`)
 }
 
-func (s *S) TestOnCheckFailureRestartDuringBackoff(c *C) {
-	// Create check manager and tell it about plan updates
-	checkMgr := checkstate.NewManager()
+func (s *S) TestLogBufferSize(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    sized:
+        override: replace
+        command: /bin/sh -c "seq -f 'line %g' 1000; exec sleep 300"
+        log-buffer-size: 16kB
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	chg := s.startServices(c, []string{"sized"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	for i := 0; !strings.Contains(s.serviceLogs(c, "sized"), "line 1000\n"); i++ {
+		if i >= 100 {
+			c.Fatalf("timed out waiting for output")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	logging := s.serviceLogging(c, "sized")
+	c.Check(logging.BufferSize, Equals, 16*1000)
+	c.Check(logging.BufferUsed > 15*1000, Equals, true)
+	s.stopServices(c, []string{"sized"}, 1)
+
+	// The new size applies when the service is started again, keeping the
+	// latest logs that fit.
+	layer = parseLayer(c, 1, "layer1", `
+services:
+    sized:
+        override: merge
+        command: /bin/sh -c "exec sleep 300"
+        log-buffer-size: 4kB
+`)
+	err = s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	chg = s.startServices(c, []string{"sized"}, 1)
+	defer s.stopServices(c, []string{"sized"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	logging = s.serviceLogging(c, "sized")
+	c.Check(logging.BufferSize, Equals, 4*1000)
+	logs := s.serviceLogs(c, "sized")
+	c.Check(len(logs) <= 4*1000, Equals, true)
+	c.Check(logs, Matches, `(?s).*\[sized\] line 1000\n.*\[pebble\] --- service "sized" started .*`)
+	c.Check(strings.Contains(logs, "line 900\n"), Equals, false)
+}
+
+func (s *S) TestLogTargets(c *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	received := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+
+	logFile := filepath.Join(s.dir, "targets", "out.log")
+	c.Assert(os.Mkdir(filepath.Dir(logFile), 0755), IsNil)
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    targeted:
+        override: replace
+        command: /bin/sh -c "echo hello; exec sleep 300"
+        log-targets:
+            file:
+                type: file
+                path: %s
+            remote:
+                type: syslog
+                address: udp://%s
+`, logFile, conn.LocalAddr()))
+	err = s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	chg := s.startServices(c, []string{"targeted"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	// The output goes to the targets as well as to the log buffer.
+	select {
+	case msg := <-received:
+		c.Check(msg, Matches, `<30>1 .* targeted - - - hello`)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for syslog message")
+	}
+	waitFileContains(c, logFile, "hello")
+	c.Check(s.serviceLogs(c, "targeted"), Matches, `(?s).*\[targeted\] hello\n`)
+	s.stopServices(c, []string{"targeted"}, 1)
+	data, err := ioutil.ReadFile(logFile)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Matches, `2.* \[targeted\] hello\n`)
+
+	// Restarting after the targets change rebuilds the pipeline: output
+	// goes to the new file, and no longer to syslog.
+	newLogFile := filepath.Join(s.dir, "targets", "new.log")
+	layer = parseLayer(c, 1, "layer1", fmt.Sprintf(`
+services:
+    targeted:
+        override: merge
+        command: /bin/sh -c "echo again; exec sleep 300"
+        log-targets:
+            file:
+                type: file
+                path: %s
+            remote:
+                type: buffer
+`, newLogFile))
+	err = s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	chg = s.startServices(c, []string{"targeted"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	waitFileContains(c, newLogFile, "again")
+	s.stopServices(c, []string{"targeted"}, 1)
+
+	data, err = ioutil.ReadFile(logFile)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Matches, `2.* \[targeted\] hello\n`)
+	select {
+	case msg := <-received:
+		c.Errorf("unexpected syslog message %q", msg)
+	default:
+	}
+}
+
+func waitFileContains(c *C, path, s string) {
+	for i := 0; ; i++ {
+		data, _ := ioutil.ReadFile(path)
+		if strings.Contains(string(data), s) {
+			return
+		}
+		if i >= 100 {
+			c.Fatalf("timed out waiting for %q in %s", s, path)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (s *S) TestLifecycleLogs(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: replace
+        command: /bin/sh -c "echo run; sleep 0.2; exit 3"
+        backoff-delay: 50ms
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Let the first run fail and the service be restarted, then stop it.
+	s.startServices(c, []string{"test2"}, 1)
+	for i := 0; strings.Count(s.serviceLogs(c, "test2"), "[test2] run\n") < 2; i++ {
+		if i >= 100 {
+			c.Fatalf("timed out waiting for restart")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	s.stopServices(c, []string{"test2"}, 1)
+
+	c.Check(s.serviceLogs(c, "test2"), Matches, `
+2.* \[pebble\] --- service "test2" started \(pid \d+, generation 1\) ---
+2.* \[test2\] run
+2.* \[pebble\] --- service "test2" exited with code 3 after [0-9.]+m?s ---
+2.* \[pebble\] --- service "test2" on-failure action is "restart", restarting in ~50ms \(backoff 1\) ---
+2.* \[pebble\] --- service "test2" started \(pid \d+, generation 2\) ---
+2.* \[test2\] run
+2.* \[pebble\] --- service "test2" killed by SIGTERM after [0-9.]+m?s ---
+`[1:])
+}
+
+func (s *S) TestOutputClosedStillRunning(c *C) {
+	defer servstate.FakeOutputClosedWait(50 * time.Millisecond)()
+	layer := parseLayer(c, 0, "layer", `
+services:
+    daemonizer:
+        override: replace
+        command: /bin/sh -c "printf partial; exec >&- 2>&-; exec sleep 300"
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	chg := s.startServices(c, []string{"daemonizer"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	// The incomplete line is ended when the output is closed, and the
+	// service is still supervised as running.
+	for i := 0; !strings.Contains(s.serviceLogs(c, "daemonizer"), "closed its output"); i++ {
+		if i >= 100 {
+			c.Fatalf("timed out waiting for output to be closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Check(s.serviceByName(c, "daemonizer").Current, Equals, servstate.StatusActive)
+	s.stopServices(c, []string{"daemonizer"}, 1)
+	c.Check(s.serviceLogs(c, "daemonizer"), Matches, `
+2.* \[pebble\] --- service "daemonizer" started \(pid (\d+), generation 1\) ---
+2.* \[daemonizer\] partial \[incomplete line\]
+2.* \[pebble\] --- service "daemonizer" closed its output but is still running \(pid \d+\) ---
+2.* \[pebble\] --- service "daemonizer" killed by SIGTERM after [0-9.]+m?s ---
+`[1:])
+}
+
+func (s *S) TestOutputClosedThenExit(c *C) {
+	// The first process closes its output and exits, and the second one
+	// (started by the restart) closes its output and keeps running.
+	flag := filepath.Join(c.MkDir(), "flag")
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    closer:
+        override: replace
+        command: /bin/sh -c "printf partial; exec >&- 2>&-; if [ -e %[1]s ]; then exec sleep 300; fi; touch %[1]s; sleep 0.2; exit 3"
+        backoff-delay: 50ms
+`, flag))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	s.startServices(c, []string{"closer"}, 1)
+	for i := 0; strings.Count(s.serviceLogs(c, "closer"), "[closer] partial") < 2; i++ {
+		if i >= 100 {
+			c.Fatalf("timed out waiting for restart")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	s.stopServices(c, []string{"closer"}, 1)
+
+	// Each process's incomplete line is ended before anything else is
+	// logged, so nothing runs on from it, and the process that exited soon
+	// after closing its output isn't noted as still running.
+	c.Check(s.serviceLogs(c, "closer"), Matches, `
+2.* \[pebble\] --- service "closer" started \(pid \d+, generation 1\) ---
+2.* \[closer\] partial \[incomplete line\]
+2.* \[pebble\] --- service "closer" exited with code 3 after [0-9.]+m?s ---
+2.* \[pebble\] --- service "closer" on-failure action is "restart", restarting in ~50ms \(backoff 1\) ---
+2.* \[pebble\] --- service "closer" started \(pid \d+, generation 2\) ---
+2.* \[closer\] partial \[incomplete line\]
+2.* \[pebble\] --- service "closer" killed by SIGTERM after [0-9.]+m?s ---
+`[1:])
+}
+
+// serviceLogs returns the contents of the named service's log buffer.
+func (s *S) serviceLogs(c *C, name string) string {
+	iterators, err := s.manager.ServiceLogs([]string{name}, -1)
+	c.Assert(err, IsNil)
+	it := iterators[name]
+	c.Assert(it, NotNil)
+	defer it.Close()
+	buf := &bytes.Buffer{}
+	for it.Next(nil) {
+		_, err = io.Copy(buf, it)
+		c.Assert(err, IsNil)
+	}
+	return buf.String()
+}
+
+// panickingDecoder is a log-encoding stage that passes output through, and
+// panics on output containing "boom".
+type panickingDecoder struct {
+	dest io.Writer
+}
+
+func (w panickingDecoder) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("boom")) {
+		panic("decoder exploded")
+	}
+	return w.dest.Write(p)
+}
+
+func (s *S) TestLogPanics(c *C) {
+	var decoders int32
+	defer servstate.FakeNewDecodeWriter(func(dest io.Writer, encoding string) io.Writer {
+		atomic.AddInt32(&decoders, 1)
+		return panickingDecoder{dest}
+	})()
+	layer := parseLayer(c, 0, "layer", `
+services:
+    panicky:
+        override: replace
+        command: /bin/sh -c "echo one; sleep 0.05; echo boom; sleep 0.05; echo two; exec sleep 300"
+        log-encoding: utf-8
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// run starts the service, waits for all its output, and stops it.
+	runs := 0
+	run := func() string {
+		runs++
+		s.startServices(c, []string{"panicky"}, 1)
+		var logs string
+		for i := 0; strings.Count(logs, "[panicky] two\n") < runs; i++ {
+			if i >= 100 {
+				c.Fatalf("timed out waiting for logs")
+			}
+			time.Sleep(20 * time.Millisecond)
+			logs = s.serviceLogs(c, "panicky")
+		}
+		s.stopServices(c, []string{"panicky"}, 1)
+		return logs
+	}
+
+	// The decoder's panic doesn't take the daemon down: the output goes on
+	// being logged, without the decoder.
+	logs := run()
+	c.Check(logs, Matches, `(?s)2.* \[panicky\] one\n2.* \[panicky\] boom\n2.* \[panicky\] two\n`)
+	c.Check(atomic.LoadInt32(&decoders), Equals, int32(1))
+	c.Check(s.serviceByName(c, "panicky").LogPanics, Equals, 1)
+
+	var notices []*state.Notice
+	for i := 0; i < 100 && len(notices) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		s.st.Lock()
+		notices = s.st.Notices(&state.NoticeFilter{Types: []state.NoticeType{state.ServiceLogPanicNotice}})
+		s.st.Unlock()
+	}
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Key(), Equals, "panicky")
+	c.Check(notices[0].LastData(), DeepEquals, map[string]string{
+		"stage":    "decode",
+		"panic":    "decoder exploded",
+		"disabled": "false",
+	})
+
+	// After panicking maxLogPanics times, the decoder is left out.
+	run()
+	run()
+	c.Check(atomic.LoadInt32(&decoders), Equals, int32(3))
+	c.Check(s.serviceByName(c, "panicky").LogPanics, Equals, 3)
+	logging := s.serviceLogging(c, "panicky")
+	c.Check(logging.DisabledStages, DeepEquals, []string{"decode"})
+	c.Check(logging.Stages, DeepEquals, []string{"format", "buffer", "output"})
+	logs = run()
+	c.Check(logs, Matches, `(?s)(2.* \[panicky\] one\n2.* \[panicky\] boom\n2.* \[panicky\] two\n){4}`)
+	c.Check(atomic.LoadInt32(&decoders), Equals, int32(3))
+	c.Check(s.serviceByName(c, "panicky").LogPanics, Equals, 3)
+	for i := 0; i < 100; i++ {
+		s.st.Lock()
+		notices = s.st.Notices(&state.NoticeFilter{Types: []state.NoticeType{state.ServiceLogPanicNotice}})
+		s.st.Unlock()
+		if notices[0].LastData()["disabled"] == "true" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(notices[0].Occurrences(), Equals, 3)
+	c.Check(notices[0].LastData()["disabled"], Equals, "true")
+
+	// A replan gives it another chance.
+	_, _, _, err = s.manager.Replan()
+	c.Assert(err, IsNil)
+	c.Check(s.serviceLogging(c, "panicky").DisabledStages, HasLen, 0)
+	run()
+	c.Check(atomic.LoadInt32(&decoders), Equals, int32(4))
+	c.Check(s.serviceByName(c, "panicky").LogPanics, Equals, 4)
+}
+
+func (s *S) TestLoggingInfo(c *C) {
+	defer servstate.FakeNewDecodeWriter(func(dest io.Writer, encoding string) io.Writer {
+		return panickingDecoder{dest}
+	})()
+	boom := filepath.Join(c.MkDir(), "boom")
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    introspected:
+        override: replace
+        command: /bin/sh -c "echo one; while [ ! -e %s ]; do sleep 0.01; done; echo boom; echo two; exec sleep 300"
+        log-encoding: utf-8
+        log-files:
+            - /var/log/introspected/*.log
+`, boom))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Before it's started, the service's pipeline is the one it would be
+	// started with.
+	c.Check(s.serviceLogging(c, "introspected"), DeepEquals, &servstate.LoggingInfo{
+		Encoding: "utf-8",
+		Files:    []string{"/var/log/introspected/*.log"},
+		Stages:   []string{"decode", "format", "buffer", "output"},
+		Mode:     servstate.LogModeFull,
+	})
+
+	s.startServices(c, []string{"introspected"}, 1)
+	defer s.stopServices(c, []string{"introspected"}, 1)
+	s.waitUntilLogging(c, "introspected", func(logging *servstate.LoggingInfo) bool {
+		return logging.BufferUsed > 0
+	})
+	logging := s.serviceLogging(c, "introspected")
+	c.Check(logging.Stages, DeepEquals, []string{"decode", "format", "buffer", "output"})
+	c.Check(logging.Mode, Equals, servstate.LogModeFull)
+	c.Check(logging.BufferSize > 0, Equals, true)
+
+	// A panic in the decoder is reflected straight away.
+	err = ioutil.WriteFile(boom, nil, 0644)
+	c.Assert(err, IsNil)
+	s.waitUntilLogging(c, "introspected", func(logging *servstate.LoggingInfo) bool {
+		return logging.Mode == servstate.LogModeMinimal
+	})
+	logging = s.serviceLogging(c, "introspected")
+	c.Check(logging.Stages, DeepEquals, []string{"format", "buffer", "output"})
+	c.Check(logging.DisabledStages, HasLen, 0)
+}
+
+func (s *S) TestLogLatency(c *C) {
+	s.manager.SetLogLatencyTracing(true)
+	layer := parseLayer(c, 0, "layer", `
+services:
+    traced:
+        override: replace
+        command: /bin/sh -c "echo one; echo two; exec sleep 300"
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	chg := s.startServices(c, []string{"traced"}, 1)
+	defer s.stopServices(c, []string{"traced"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	// Both lines reach the log buffer and are copied to the output.
+	s.waitUntilService(c, "traced", func(svc *servstate.ServiceInfo) bool {
+		return svc.LogLatency[servicelog.StageOutput].Count == 2
+	})
+	services, err := s.manager.Services([]string{"traced"})
+	c.Assert(err, IsNil)
+	c.Check(services[0].LogLatency[servicelog.StageBuffer].Count, Equals, uint64(2))
+
+	// Services that have not been started have no histograms.
+	services, err = s.manager.Services([]string{"test1"})
+	c.Assert(err, IsNil)
+	c.Check(services[0].LogLatency, IsNil)
+}
+
+func (s *S) TestDrainOutput(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    drain1:
+        override: replace
+        command: /bin/sh -c "echo drain1; sleep 300"
+    drain2:
+        override: replace
+        command: /bin/sh -c "echo drain2; exit 1"
+        on-failure: ignore
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	chg := s.startServices(c, []string{"drain1"}, 1)
+	defer s.stopServices(c, []string{"drain1"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	s.startServices(c, []string{"drain2"}, 1)
+	s.waitUntilService(c, "drain2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusInactive || svc.Current == servstate.StatusError
+	})
+
+	// Logs already written by both the running and the exited service are
+	// copied before DrainOutput returns.
+	dropped := s.manager.DrainOutput(context.Background())
+	c.Check(dropped, HasLen, 0)
+	output := s.logBufferString()
+	c.Check(output, Matches, `(?s).*\[drain1\] drain1\n.*`)
+	c.Check(output, Matches, `(?s).*\[drain2\] drain2\n.*`)
+
+	// Services started after the output is drained don't write to it.
+	s.startServices(c, []string{"drain2"}, 1)
+	s.waitUntilService(c, "drain2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusInactive || svc.Current == servstate.StatusError
+	})
+	time.Sleep(50 * time.Millisecond)
+	c.Check(s.logBufferString(), Equals, "")
+}
+
+func (s *S) TestDrainOutputDeadline(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    stuck:
+        override: replace
+        command: /bin/sh -c "echo stuck; sleep 0.1; echo more; sleep 300"
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// The first write to the output blocks until unblocked.
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	var writesLock sync.Mutex
+	var drained bool
+	var lateWrites []string
+	s.logWriteHook = func(p []byte) {
+		writesLock.Lock()
+		if drained {
+			lateWrites = append(lateWrites, string(p))
+		}
+		writesLock.Unlock()
+		select {
+		case <-entered:
+		default:
+			close(entered)
+			<-unblock
+		}
+	}
+
+	s.startServices(c, []string{"stuck"}, 1)
+	defer s.stopServices(c, []string{"stuck"}, 1)
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for output write")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	dropped := s.manager.DrainOutput(ctx)
+	c.Check(time.Since(start) < time.Second, Equals, true)
+	writesLock.Lock()
+	drained = true
+	writesLock.Unlock()
+	c.Check(dropped, HasLen, 1)
+	c.Check(dropped["stuck"] > 0, Equals, true, Commentf("dropped %d", dropped["stuck"]))
+
+	// Once unblocked, nothing more is written to the output: neither the
+	// rest of the stuck write's data nor the service's later logs.
+	close(unblock)
+	time.Sleep(200 * time.Millisecond)
+	writesLock.Lock()
+	c.Check(lateWrites, HasLen, 0)
+	writesLock.Unlock()
+	c.Check(s.logBufferString(), Matches, `(?s)2.* \[pebble\] --- service "stuck" started .* ---\n.*`)
+}
+
+var planLayerLimits = `
+services:
+    limited:
+        override: replace
+        command: sleep 10
+        memory-limit: 64MB
+        cpu-quota: 50%
+`
+
+// fakeCgroups sets up an ordinary directory as the cgroup hierarchy, with
+// pebble's own cgroup at own, and returns the directory of that cgroup.
+// Unless own is the root, pebble's process is listed in it.
+func fakeCgroups(c *C, own string, rmdir func(path string) error) (dir string, restore func()) {
+	root := c.MkDir()
+	dir = filepath.Join(root, own)
+	err := os.MkdirAll(dir, 0755)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("cpu io memory pids\n"), 0644)
+	c.Assert(err, IsNil)
+	if own != "" {
+		err = ioutil.WriteFile(filepath.Join(dir, "cgroup.type"), []byte("domain\n"), 0644)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+		c.Assert(err, IsNil)
+	}
+	self := filepath.Join(c.MkDir(), "cgroup")
+	err = ioutil.WriteFile(self, []byte("0::/"+own+"\n"), 0644)
+	c.Assert(err, IsNil)
+	restores := []func(){
+		servstate.FakeCgroupRoot(root),
+		cgroup.FakeProcSelfCgroup(self),
+		cgroup.FakeRmdir(rmdir),
+	}
+	return dir, func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
+
+func (s *S) TestResourceLimits(c *C) {
+	own, restore := fakeCgroups(c, "system.slice/pebble.service", os.RemoveAll)
+	defer restore()
+
+	layer := parseLayer(c, 0, "limits", planLayerLimits)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	s.startServices(c, []string{"limited"}, 1)
+	cmd := s.manager.RunningCmds()["limited"]
+	c.Assert(cmd, NotNil)
+
+	// The service's cgroup is under pebble's own, beside the leaf pebble
+	// was moved into. Not being in the cgroup filesystem, the process is
+	// moved into it once started.
+	c.Check(filepath.Join(own, "pebble", "pebble", "cgroup.procs"), testutil.FileEquals, strconv.Itoa(os.Getpid()))
+	group := filepath.Join(own, "pebble", "limited")
+	c.Check(filepath.Join(group, "memory.max"), testutil.FileEquals, "64000000")
+	c.Check(filepath.Join(group, "cpu.max"), testutil.FileEquals, "50000 100000")
+	c.Check(filepath.Join(group, "cgroup.procs"), testutil.FileEquals, strconv.Itoa(cmd.Process.Pid))
+
+	err = ioutil.WriteFile(filepath.Join(group, "memory.current"), []byte("12345\n"), 0644)
+	c.Assert(err, IsNil)
+	svc := s.serviceByName(c, "limited")
+	c.Check(svc.MemoryCurrent, Equals, int64(12345))
+
+	// Usage is read for the processes in the group.
+	usage := s.manager.ServiceUsage([]string{"limited"})["limited"]
+	c.Assert(usage, NotNil)
+	c.Check(usage.Processes, Equals, 1)
+
+	// Group is removed once the service exits.
+	s.stopServices(c, []string{"limited"}, 1)
+	c.Check(group, testutil.FileAbsent)
+	svc = s.serviceByName(c, "limited")
+	c.Check(svc.MemoryCurrent, Equals, int64(0))
+}
+
+func (s *S) TestResourceLimitsRemoveBusy(c *C) {
+	// The manager isn't locked while removal is retried.
+	var unlocked int32
+	_, restore := fakeCgroups(c, "", func(path string) error {
+		done := make(chan struct{})
+		go func() {
+			s.manager.Services(nil)
+			close(done)
+		}()
+		select {
+		case <-done:
+			atomic.StoreInt32(&unlocked, 1)
+		case <-time.After(time.Second):
+		}
+		return &os.PathError{Op: "remove", Path: path, Err: syscall.EBUSY}
+	})
+	defer restore()
+
+	layer := parseLayer(c, 0, "limits", planLayerLimits)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// A cgroup that can't be removed, even after killing what's left in
+	// it, is warned about rather than left silently.
+	s.startServices(c, []string{"limited"}, 1)
+	s.stopServices(c, []string{"limited"}, 1)
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("timed out waiting for warning")
+		}
+		s.st.Lock()
+		warnings := s.st.AllWarnings()
+		s.st.Unlock()
+		if len(warnings) > 0 {
+			c.Check(warnings[0].String(), Matches, `Cannot remove cgroup for service "limited": remove .*/pebble/limited: device or resource busy`)
+			c.Check(atomic.LoadInt32(&unlocked), Equals, int32(1))
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *S) TestResourceLimitsUnavailable(c *C) {
+	restore := servstate.FakeCgroupRoot(c.MkDir())
+	defer restore()
+
+	layer := parseLayer(c, 0, "limits", planLayerLimits)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Service still starts, but with a warning.
+	chg := s.startServices(c, []string{"limited"}, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("timed out waiting for warning")
+		}
+		s.st.Lock()
+		warnings := s.st.AllWarnings()
+		s.st.Unlock()
+		if len(warnings) > 0 {
+			c.Check(warnings[0].String(), Equals, `Cannot apply resource limits to service "limited": cgroup v2 hierarchy not available`)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.stopServices(c, []string{"limited"}, 1)
+}
+
+func (s *S) TestValidateLogging(c *C) {
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    enc:
+        override: replace
+        command: sleep 300
+        log-encoding: utf-16le
+        log-coalesce: 50ms
+        log-files:
+            - %s/*.log
+    ready:
+        override: replace
+        command: /bin/sh -c "echo starting; echo listening; sleep 300"
+        reload-signal: SIGHUP
+        reload-ready-log: ^reloaded
+`, s.dir))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	reports, err := s.manager.ValidateLogging([]string{"enc", "ready"})
+	c.Assert(err, IsNil)
+	c.Assert(reports, HasLen, 2)
+	c.Check(reports[0].Service, Equals, "enc")
+	c.Check(reports[0].Stages, DeepEquals, []string{"coalesce", "decode", "format", "buffer", "output"})
+	c.Check(reports[0].Warnings, DeepEquals, []string{
+		`log-encoding "utf-16le" isn't applied to the lines read from log-files`,
+	})
+	c.Assert(reports[0].Sample, HasLen, 3)
+	c.Check(reports[0].Sample[0], Matches, `2.* \[enc\] sample line 1: plain ASCII output`)
+	c.Check(reports[0].Sample[1], Matches, `2.* \[enc\] sample line 2: UTF-8 output, héllo wörld ✓`)
+	c.Check(reports[1].Service, Equals, "ready")
+	c.Check(reports[1].Stages, DeepEquals, []string{"format", "buffer", "output"})
+	c.Check(reports[1].Warnings, HasLen, 0)
+
+	// Nothing was started, or created.
+	c.Check(s.manager.RunningCmds(), HasLen, 0)
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.log"))
+	c.Assert(err, IsNil)
+	c.Check(matches, HasLen, 0)
+
+	// The reload-ready-log pattern is checked against the service's output.
+	s.startServices(c, []string{"ready"}, 1)
+	defer s.stopServices(c, []string{"ready"}, 1)
+	for i := 0; !strings.Contains(s.serviceLogs(c, "ready"), "listening"); i++ {
+		if i >= 100 {
+			c.Fatalf("timed out waiting for output")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	reports, err = s.manager.ValidateLogging([]string{"ready"})
+	c.Assert(err, IsNil)
+	c.Assert(reports, HasLen, 1)
+	c.Check(reports[0].Warnings, DeepEquals, []string{
+		`reload-ready-log "^reloaded" matches none of the last 2 lines of output`,
+	})
+
+	// A memory limit too small to share between the services.
+	s.manager.SetLogMemoryLimit(10000)
+	defer s.manager.SetLogMemoryLimit(0)
+	reports, err = s.manager.ValidateLogging([]string{"enc"})
+	c.Assert(err, IsNil)
+	c.Assert(reports, HasLen, 1)
+	c.Check(reports[0].Warnings, HasLen, 2)
+	c.Check(reports[0].Warnings[0], Matches, `log memory limit of 10000 bytes leaves 1428 bytes for each of 7 services, less than the 4096 needed for one line; .*`)
+
+	// Panics in a stage are reported.
+	restore := servstate.FakeNewDecodeWriter(func(dest io.Writer, encoding string) io.Writer {
+		return writerFunc(func(p []byte) (int, error) {
+			panic("bad decoder")
+		})
+	})
+	defer restore()
+	s.manager.SetLogMemoryLimit(0)
+	reports, err = s.manager.ValidateLogging([]string{"enc"})
+	c.Assert(err, IsNil)
+	c.Assert(reports, HasLen, 1)
+	c.Check(reports[0].Warnings[0], Equals, `panic in log pipeline stage "decode": bad decoder`)
+	// Output goes through the safe pipeline instead.
+	c.Check(reports[0].Sample[0], Matches, `2.* \[enc\] .*`)
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (s *S) TestActionRestart(c *C) {
+	// Add custom backoff delay so it auto-restarts quickly.
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: merge
+        command: /bin/sh -c "echo test2; exec sleep 300"
+        backoff-delay: 50ms
+        backoff-limit: 150ms
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Start service and wait till it starts up the first time.
+	chg := s.startServices(c, []string{"test2"}, 1)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive
+	})
+	c.Assert(s.manager.BackoffNum("test2"), Equals, 0)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus)
+	s.st.Unlock()
+	time.Sleep(10 * time.Millisecond) // ensure it has enough time to write to the log
+	c.Check(s.logBufferString(), Matches, `2.* \[pebble\] --- service "test2" started \(pid \d+, generation 1\) ---\n2.* \[test2\] test2\n`)
+
+	// Send signal to process to terminate it early.
+	err = s.manager.SendSignal([]string{"test2"}, "SIGTERM")
+	c.Assert(err, IsNil)
+
+	// Wait for it to go into backoff state.
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusBackoff && s.manager.BackoffNum("test2") == 1
+	})
+
+	// Then wait for it to auto-restart (backoff time plus a bit).
+	time.Sleep(75 * time.Millisecond)
+	svc := s.serviceByName(c, "test2")
+	c.Assert(svc.Current, Equals, servstate.StatusActive)
+	c.Check(svc.Restarts, Equals, 1)
+	c.Check(svc.LogBytes > 0, Equals, true)
+	c.Check(s.logBufferString(), Matches, `(?s).*\[pebble\] --- service "test2" started \(pid \d+, generation 2\) ---\n2.* \[test2\] test2\n`)
+
+	// Send signal to terminate it again.
+	err = s.manager.SendSignal([]string{"test2"}, "SIGTERM")
+	c.Assert(err, IsNil)
+
+	// Wait for it to go into backoff state.
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusBackoff && s.manager.BackoffNum("test2") == 2
+	})
+
+	// Then wait for it to auto-restart (backoff time plus a bit).
+	time.Sleep(125 * time.Millisecond)
+	svc = s.serviceByName(c, "test2")
+	c.Assert(svc.Current, Equals, servstate.StatusActive)
+	c.Check(svc.Restarts, Equals, 2)
+	c.Check(s.logBufferString(), Matches, `(?s).*\[pebble\] --- service "test2" started \(pid \d+, generation 3\) ---\n2.* \[test2\] test2\n`)
+
+	// Test that backoff reset time is working (set to backoff-limit)
+	time.Sleep(175 * time.Millisecond)
+	c.Check(s.manager.BackoffNum("test2"), Equals, 0)
+
+	// Send signal to process to terminate it early.
+	err = s.manager.SendSignal([]string{"test2"}, "SIGTERM")
+	c.Assert(err, IsNil)
+
+	// Wait for it to go into backoff state (back to backoff 1 again).
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusBackoff && s.manager.BackoffNum("test2") == 1
+	})
+
+	// Then wait for it to auto-restart (backoff time plus a bit).
+	time.Sleep(75 * time.Millisecond)
+	svc = s.serviceByName(c, "test2")
+	c.Assert(svc.Current, Equals, servstate.StatusActive)
+	c.Check(s.logBufferString(), Matches, `(?s).*\[pebble\] --- service "test2" started \(pid \d+, generation 4\) ---\n2.* \[test2\] test2\n`)
+}
+
+func (s *S) TestStartWithArgs(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: merge
+        command: /bin/sh -c "echo args=[$*]; exec sleep 300" sh
+        backoff-delay: 50ms
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Start service with extra arguments, which aren't parsed again.
+	s.st.Lock()
+	ts, err := servstate.StartWithArgs(s.st, []string{"test2"}, map[string][]string{
+		"test2": {"--foo", "a b"},
+	})
+	c.Assert(err, IsNil)
+	chg := s.st.NewChange("test", "Start test")
+	chg.AddAll(ts)
+	s.st.Unlock()
+	s.ensure(c, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	time.Sleep(10 * time.Millisecond) // ensure it has enough time to write to the log
+	c.Check(s.logBufferString(), Matches, `(?s).* \[test2\] args=\[--foo a b\]\n([^\n]* \[pebble\] [^\n]*\n)*`)
+	c.Check(s.serviceByName(c, "test2").Args, DeepEquals, []string{"--foo", "a b"})
+
+	// Automatic restarts keep the extra arguments.
+	err = s.manager.SendSignal([]string{"test2"}, "SIGTERM")
+	c.Assert(err, IsNil)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive && svc.Restarts == 1
+	})
+	time.Sleep(10 * time.Millisecond)
+	c.Check(s.logBufferString(), Matches, `(?s).* \[test2\] args=\[--foo a b\]\n([^\n]* \[pebble\] [^\n]*\n)*`)
+	c.Check(s.serviceByName(c, "test2").Args, DeepEquals, []string{"--foo", "a b"})
+
+	// A normal start drops them again.
+	chg = s.stopServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	chg = s.startServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(s.logBufferString(), Matches, `(?s).* \[test2\] args=\[\]\n([^\n]* \[pebble\] [^\n]*\n)*`)
+	c.Check(s.serviceByName(c, "test2").Args, IsNil)
+}
+
+// reloadScript is a service that re-reads its config file on SIGHUP.
+const reloadScript = `
+trap 'echo "reloaded $(cat "$1")"' HUP
+echo "started $(cat "$1")"
+while true; do sleep 0.01; done
+`
+
+func (s *S) setupReloadService(c *C, options string) (configPath string) {
+	script := filepath.Join(s.dir, "reload.sh")
+	err := ioutil.WriteFile(script, []byte(reloadScript), 0755)
+	c.Assert(err, IsNil)
+	configPath = filepath.Join(s.dir, "reload.conf")
+	err = ioutil.WriteFile(configPath, []byte("one"), 0644)
+	c.Assert(err, IsNil)
+
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    test2:
+        override: merge
+        command: /bin/sh %s %s
+        reload-signal: SIGHUP
+%s`, script, configPath, options))
+	err = s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	chg := s.startServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	return configPath
+}
+
+func (s *S) reloadServices(c *C, services []string) *state.Change {
+	s.st.Lock()
+	ts, err := servstate.Reload(s.st, services)
+	c.Check(err, IsNil)
+	chg := s.st.NewChange("test", "Reload test")
+	chg.AddAll(ts)
+	s.st.Unlock()
+
+	s.ensure(c, 1)
+
+	return chg
+}
+
+func (s *S) TestReload(c *C) {
+	configPath := s.setupReloadService(c, `        reload-ready-log: ^reloaded
+`)
+	defer s.stopServices(c, []string{"test2"}, 1)
+
+	err := ioutil.WriteFile(configPath, []byte("two"), 0644)
+	c.Assert(err, IsNil)
+	chg := s.reloadServices(c, []string{"test2"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	// The service was reloaded rather than restarted.
+	time.Sleep(10 * time.Millisecond) // ensure it has enough time to write to the log
+	c.Check(s.logBufferString(), Matches, `(?s)2.* \[test2\] started one\n.*2.* \[test2\] reloaded two\n`)
+	svc := s.serviceByName(c, "test2")
+	c.Check(svc.Current, Equals, servstate.StatusActive)
+	c.Check(svc.Restarts, Equals, 0)
+}
+
+func (s *S) TestReloadNotReady(c *C) {
+	s.setupReloadService(c, `        reload-ready-log: ^never
+        reload-timeout: 100ms
+`)
+	defer s.stopServices(c, []string{"test2"}, 1)
+
+	chg := s.reloadServices(c, []string{"test2"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.ErrorStatus)
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot reload service "test2": no output matching "\^never" within 100ms.*`)
+	s.st.Unlock()
+}
+
+func (s *S) TestReloadReadyCheck(c *C) {
+	var mutex sync.Mutex
+	lastRun := time.Now()
+	s.manager.SetCheckStatusFunc(func(name string) (time.Time, int, bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if name != "chk1" {
+			return time.Time{}, 0, false
+		}
+		return lastRun, 0, true
+	})
+	s.setupReloadService(c, `        reload-ready-check: chk1
+        reload-timeout: 1s
+`)
+	defer s.stopServices(c, []string{"test2"}, 1)
+
+	// The check must run after the signal is sent, so a check that last ran
+	// before the reload doesn't count.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		lastRun = time.Now()
+		mutex.Unlock()
+	}()
+	start := time.Now()
+	chg := s.reloadServices(c, []string{"test2"})
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	c.Check(time.Since(start) >= 50*time.Millisecond, Equals, true)
+}
+
+func (s *S) TestReloadErrors(c *C) {
+	chg := s.reloadServices(c, []string{"test2"})
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot reload service "test2": no reload-signal configured.*`)
+	s.st.Unlock()
+
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: merge
+        reload-signal: SIGHUP
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	chg = s.reloadServices(c, []string{"test2"})
+	s.st.Lock()
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot reload service "test2": service is not running.*`)
+	s.st.Unlock()
+}
+
+func (s *S) TestReplanReload(c *C) {
+	s.setupReloadService(c, "")
+	defer s.stopServices(c, []string{"test2"}, 1)
+
+	// Only reload-safe fields changed: reload.
+	layer := parseLayer(c, 0, "layer2", `
+services:
+    test2:
+        override: merge
+        summary: Reloadable
+        on-failure: ignore
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	stops, starts, reloads, err := s.manager.Replan()
+	c.Assert(err, IsNil)
+	c.Check(stops, HasLen, 0)
+	c.Check(starts, DeepEquals, []string{"test1", "test2"})
+	c.Check(reloads, DeepEquals, []string{"test2"})
+	c.Check(s.manager.Config("test2").Summary, Equals, "Reloadable")
+
+	// Nothing changed: nothing to do.
+	stops, _, reloads, err = s.manager.Replan()
+	c.Assert(err, IsNil)
+	c.Check(stops, HasLen, 0)
+	c.Check(reloads, HasLen, 0)
+
+	// Environment changed: restart.
+	layer = parseLayer(c, 0, "layer3", `
+services:
+    test2:
+        override: merge
+        environment:
+            FOO: bar
+`)
+	err = s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+	stops, _, reloads, err = s.manager.Replan()
+	c.Assert(err, IsNil)
+	c.Check(stops, DeepEquals, []string{"test2"})
+	c.Check(reloads, HasLen, 0)
+}
+
+func (s *S) TestRender(c *C) {
+	dest := filepath.Join(s.dir, "app.conf")
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    test2:
+        override: merge
+        environment:
+            PORT: "8080"
+        render:
+            %s:
+                template: |
+                    service={{.Service}}
+                    port={{.Env.PORT}}
+                mode: "0600"
+                user-id: %d
+                group-id: %d
+`, dest, os.Getuid(), os.Getgid()))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	chg := s.startServices(c, []string{"test2"}, 1)
+	defer s.stopServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Assert(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+
+	data, err := ioutil.ReadFile(dest)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "service=test2\nport=8080\n")
+	st, err := os.Stat(dest)
+	c.Assert(err, IsNil)
+	c.Check(st.Mode().Perm(), Equals, os.FileMode(0600))
+	c.Check(st.Sys().(*syscall.Stat_t).Uid, Equals, uint32(os.Getuid()))
+	c.Check(st.Sys().(*syscall.Stat_t).Gid, Equals, uint32(os.Getgid()))
+}
+
+func (s *S) TestRenderError(c *C) {
+	dest := filepath.Join(s.dir, "app.conf")
+	err := ioutil.WriteFile(dest, []byte("old"), 0644)
+	c.Assert(err, IsNil)
+	source := filepath.Join(s.dir, "app.conf.tmpl")
+	err = ioutil.WriteFile(source, []byte("service={{.Service}}\nport={{.Env.PORT}}\n"), 0644)
+	c.Assert(err, IsNil)
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    test2:
+        override: merge
+        render:
+            %s:
+                source: %s
+`, dest, source))
+	err = s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	chg := s.startServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.ErrorStatus)
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot start service: cannot render ".*/app.conf": template: .*/app.conf:2:.*map has no entry for key "PORT".*`)
+	s.st.Unlock()
+	c.Check(s.serviceByName(c, "test2").Current, Equals, servstate.StatusInactive)
+
+	// The destination is left untouched, with no temporary files behind.
+	data, err := ioutil.ReadFile(dest)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "old")
+	matches, err := filepath.Glob(dest + ".*")
+	c.Assert(err, IsNil)
+	c.Check(matches, DeepEquals, []string{source})
+}
+
+func (s *S) TestReplanRenderChanged(c *C) {
+	dest := filepath.Join(s.dir, "app.conf")
+	source := filepath.Join(s.dir, "app.conf.tmpl")
+	err := ioutil.WriteFile(source, []byte("one"), 0644)
+	c.Assert(err, IsNil)
+	s.setupReloadService(c, fmt.Sprintf(`        render:
+            %s:
+                source: %s
+`, dest, source))
+	defer s.stopServices(c, []string{"test2"}, 1)
+
+	_, _, reloads, err := s.manager.Replan()
+	c.Assert(err, IsNil)
+	c.Check(reloads, HasLen, 0)
+
+	// Changing the template source triggers a reload, which re-renders.
+	err = ioutil.WriteFile(source, []byte("two"), 0644)
+	c.Assert(err, IsNil)
+	_, _, reloads, err = s.manager.Replan()
+	c.Assert(err, IsNil)
+	c.Check(reloads, DeepEquals, []string{"test2"})
+
+	chg := s.reloadServices(c, reloads)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	data, err := ioutil.ReadFile(dest)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "two")
+}
+
+func (s *S) TestStopDuringBackoff(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: merge
+        command: sleep 0.1
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Start service and wait till it starts up the first time.
+	chg := s.startServices(c, []string{"test2"}, 1)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive
+	})
+	c.Assert(s.manager.BackoffNum("test2"), Equals, 0)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus)
+	s.st.Unlock()
+
+	// Wait for it to exit and go into backoff state.
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusBackoff && s.manager.BackoffNum("test2") == 1
+	})
+
+	// Ensure it can be stopped successfully.
+	chg = s.stopServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusInactive
+	})
+}
+
+func (s *S) TestOnCheckFailureRestartWhileRunning(c *C) {
+	// Create check manager and tell it about plan updates
+	checkMgr := checkstate.NewManager()
+	defer checkMgr.PlanChanged(&plan.Plan{})
+	s.manager.NotifyPlanChanged(checkMgr.PlanChanged)
+
+	// Tell service manager about check failures
+	checkMgr.NotifyCheckFailed(s.manager.CheckFailed)
+
+	tempDir := c.MkDir()
+	tempFile := filepath.Join(tempDir, "out")
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    test2:
+        override: replace
+        command: /bin/sh -c 'echo x >>%s; sleep 1'
+        backoff-delay: 50ms
+        on-check-failure:
+            chk1: restart
+
+checks:
+    chk1:
+         override: replace
+         period: 75ms  # a bit longer than shortOkayWait
+         threshold: 1
+         exec:
+             command: will-fail
+`, tempFile))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Start service and wait till it starts up (output file is written to)
+	s.startServices(c, []string{"test2"}, 1)
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("failed waiting for command to start")
+		}
+		b, _ := ioutil.ReadFile(tempFile)
+		if string(b) == "x\n" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Now wait till check happens (it will-fail)
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("failed waiting for check to fail")
+		}
+		checks, err := checkMgr.Checks("", nil)
+		c.Assert(err, IsNil)
+		if len(checks) == 1 && !checks[0].Healthy {
+			c.Assert(checks[0].Failures, Equals, 1)
+			c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Check failure should terminate process, backoff, and restart it, so wait for that
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusBackoff
+	})
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("failed waiting for command to start")
+		}
+		b, err := ioutil.ReadFile(tempFile)
+		c.Assert(err, IsNil)
+		if string(b) == "x\nx\n" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Shouldn't be restarted again
+	time.Sleep(100 * time.Millisecond)
+	b, err := ioutil.ReadFile(tempFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "x\nx\n")
+	checks, err := checkMgr.Checks("", nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(checks), Equals, 1)
+	c.Assert(checks[0].Healthy, Equals, false)
+	c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
+	svc := s.serviceByName(c, "test2")
+	c.Assert(svc.Current, Equals, servstate.StatusActive)
+	c.Assert(s.manager.BackoffNum("test2"), Equals, 1)
+}
+
+func (s *S) TestOnCheckFailureRestartDuringBackoff(c *C) {
+	// Create check manager and tell it about plan updates
+	checkMgr := checkstate.NewManager()
+	defer checkMgr.PlanChanged(&plan.Plan{})
+	s.manager.NotifyPlanChanged(checkMgr.PlanChanged)
+
+	// Tell service manager about check failures
+	checkMgr.NotifyCheckFailed(s.manager.CheckFailed)
+
+	tempDir := c.MkDir()
+	tempFile := filepath.Join(tempDir, "out")
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    test2:
+        override: replace
+        command: /bin/sh -c 'echo x >>%s; sleep 0.075'
+        backoff-delay: 50ms
+        backoff-factor: 100  # ensure it only backoff-restarts once
+        on-check-failure:
+            chk1: restart
+
+checks:
+    chk1:
+         override: replace
+         period: 100ms
+         threshold: 1
+         exec:
+             command: will-fail
+`, tempFile))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Start service and wait till it starts up (output file is written to)
+	s.startServices(c, []string{"test2"}, 1)
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("failed waiting for command to start")
+		}
+		b, _ := ioutil.ReadFile(tempFile)
+		if string(b) == "x\n" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Ensure it exits and goes into backoff state
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusBackoff
+	})
+
+	// Check failure should wait for current backoff (after which it will be restarted)
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("failed waiting for command to start")
+		}
+		b, err := ioutil.ReadFile(tempFile)
+		c.Assert(err, IsNil)
+		if string(b) == "x\nx\n" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	svc := s.serviceByName(c, "test2")
+	c.Assert(svc.Current, Equals, servstate.StatusActive)
+	c.Assert(s.manager.BackoffNum("test2"), Equals, 1)
+
+	// Shouldn't be restarted again
+	time.Sleep(125 * time.Millisecond)
+	b, err := ioutil.ReadFile(tempFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "x\nx\n")
+	checks, err := checkMgr.Checks("", nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(checks), Equals, 1)
+	c.Assert(checks[0].Healthy, Equals, false)
+	c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
+}
+
+func (s *S) TestOnCheckFailureIgnore(c *C) {
+	// Create check manager and tell it about plan updates
+	checkMgr := checkstate.NewManager()
+	defer checkMgr.PlanChanged(&plan.Plan{})
+	s.manager.NotifyPlanChanged(checkMgr.PlanChanged)
+
+	// Tell service manager about check failures
+	checkMgr.NotifyCheckFailed(s.manager.CheckFailed)
+
+	tempDir := c.MkDir()
+	tempFile := filepath.Join(tempDir, "out")
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    test2:
+        override: replace
+        command: /bin/sh -c 'echo x >>%s; sleep 1'
+        on-check-failure:
+            chk1: ignore
+
+checks:
+    chk1:
+         override: replace
+         period: 75ms  # a bit longer than shortOkayWait
+         threshold: 1
+         exec:
+             command: will-fail
+`, tempFile))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Start service and wait till it starts up (output file is written to)
+	s.startServices(c, []string{"test2"}, 1)
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("failed waiting for command to start")
+		}
+		b, _ := ioutil.ReadFile(tempFile)
+		if string(b) == "x\n" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Now wait till check happens (it will-fail)
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("failed waiting for check to fail")
+		}
+		checks, err := checkMgr.Checks("", nil)
+		c.Assert(err, IsNil)
+		if len(checks) == 1 && !checks[0].Healthy {
+			c.Assert(checks[0].Failures, Equals, 1)
+			c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Service shouldn't have been restarted
+	time.Sleep(100 * time.Millisecond)
+	b, err := ioutil.ReadFile(tempFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "x\n")
+	checks, err := checkMgr.Checks("", nil)
+	c.Assert(err, IsNil)
+	c.Assert(len(checks), Equals, 1)
+	c.Assert(checks[0].Healthy, Equals, false)
+	c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
+	svc := s.serviceByName(c, "test2")
+	c.Assert(svc.Current, Equals, servstate.StatusActive)
+}
+
+func (s *S) TestOnCheckFailureShutdown(c *C) {
+	// Create check manager and tell it about plan updates
+	checkMgr := checkstate.NewManager()
 	defer checkMgr.PlanChanged(&plan.Plan{})
 	s.manager.NotifyPlanChanged(checkMgr.PlanChanged)
 
-	// Tell service manager about check failures
-	checkMgr.NotifyCheckFailed(s.manager.CheckFailed)
+	// Tell service manager about check failures
+	checkMgr.NotifyCheckFailed(s.manager.CheckFailed)
+
+	tempDir := c.MkDir()
+	tempFile := filepath.Join(tempDir, "out")
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    test2:
+        override: replace
+        command: /bin/sh -c 'echo x >>%s; sleep 1'
+        on-check-failure:
+            chk1: shutdown
+
+checks:
+    chk1:
+         override: replace
+         period: 75ms  # a bit longer than shortOkayWait
+         threshold: 1
+         exec:
+             command: will-fail
+`, tempFile))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	// Start service and wait till it starts up (output file is written to)
+	s.startServices(c, []string{"test2"}, 1)
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("failed waiting for command to start")
+		}
+		b, _ := ioutil.ReadFile(tempFile)
+		if string(b) == "x\n" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Now wait till check happens (it will-fail)
+	for i := 0; ; i++ {
+		if i >= 100 {
+			c.Fatalf("failed waiting for check to fail")
+		}
+		checks, err := checkMgr.Checks("", nil)
+		c.Assert(err, IsNil)
+		if len(checks) == 1 && !checks[0].Healthy {
+			c.Assert(checks[0].Failures, Equals, 1)
+			c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// It should have closed the stopDaemon channel.
+	select {
+	case <-s.stopDaemon:
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for stop-daemon channel")
+	}
+}
+
+func (s *S) waitForWarning(c *C) *state.Warning {
+	for i := 0; i < 100; i++ {
+		s.st.Lock()
+		warnings := s.st.AllWarnings()
+		s.st.Unlock()
+		if len(warnings) > 0 {
+			return warnings[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for warning")
+	return nil
+}
+
+func (s *S) TestFailureRecordsLastLogs(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: replace
+        command: /bin/sh -c 'echo first; echo second; echo third; exec sleep 10'
+        on-failure: ignore
+        failure-log-lines: 2
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	s.startServices(c, []string{"test2"}, 1)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive
+	})
+	cmd := s.manager.RunningCmds()["test2"]
+	c.Assert(cmd, NotNil)
+	err = cmd.Process.Kill()
+	c.Assert(err, IsNil)
+
+	// The output is only in the notice, the warning's message being fixed.
+	warning := s.waitForWarning(c)
+	c.Assert(warning.String(), Equals, `Service "test2" stopped unexpectedly with code 137`)
+	notice := s.waitForNotice(c, state.ServiceFailureNotice)
+	c.Check(notice.Key(), Equals, "test2")
+	c.Check(notice.LastData(), DeepEquals, map[string]string{
+		"exit-code": "137",
+		"last-logs": "    (...)\n    second\n    third",
+	})
+}
+
+// waitForNotice waits for a notice of the given type to be recorded.
+func (s *S) waitForNotice(c *C, noticeType state.NoticeType) *state.Notice {
+	for i := 0; i < 100; i++ {
+		s.st.Lock()
+		notices := s.st.Notices(&state.NoticeFilter{Types: []state.NoticeType{noticeType}})
+		s.st.Unlock()
+		if len(notices) > 0 {
+			return notices[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for %s notice", noticeType)
+	return nil
+}
+
+func (s *S) TestFailureRecordsNoLogs(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: replace
+        command: sleep 10
+        on-failure: ignore
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	s.startServices(c, []string{"test2"}, 1)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive
+	})
+	cmd := s.manager.RunningCmds()["test2"]
+	c.Assert(cmd, NotNil)
+	err = cmd.Process.Kill()
+	c.Assert(err, IsNil)
+
+	warning := s.waitForWarning(c)
+	c.Assert(warning.String(), Equals, `Service "test2" stopped unexpectedly with code 137`)
+	notice := s.waitForNotice(c, state.ServiceFailureNotice)
+	c.Check(notice.LastData(), DeepEquals, map[string]string{"exit-code": "137"})
+}
+
+func (s *S) TestRestartRecordsNotice(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: merge
+        command: /bin/sh -c "echo test2; exec sleep 300"
+        backoff-delay: 50ms
+        backoff-limit: 150ms
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	s.startServices(c, []string{"test2"}, 1)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive
+	})
+	err = s.manager.SendSignal([]string{"test2"}, "SIGTERM")
+	c.Assert(err, IsNil)
+
+	notice := s.waitForNotice(c, state.ServiceRestartNotice)
+	c.Check(notice.Key(), Equals, "test2")
+	c.Check(notice.Occurrences(), Equals, 1)
+	c.Check(notice.LastData(), DeepEquals, map[string]string{
+		"action":    "on-failure",
+		"backoff":   "1",
+		"delay":     "50ms",
+		"reason":    "killed by SIGTERM",
+		"last-logs": "    test2",
+	})
+}
+
+func (s *S) TestLastLogsBounded(c *C) {
+	rb := servicelog.NewRingBuffer(1024 * 1024)
+	logs, err := servstate.LastLogs(rb, 0)
+	c.Assert(err, IsNil)
+	c.Assert(logs, Equals, "")
+
+	line := strings.Repeat("x", 1023) + "\n"
+	for i := 0; i < 100; i++ {
+		_, err := rb.Write([]byte(line))
+		c.Assert(err, IsNil)
+	}
+	logs, err = servstate.LastLogs(rb, 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(logs) <= 16*1024, Equals, true)
+	c.Assert(strings.HasPrefix(logs, "    (...)\n    xxx"), Equals, true)
+	c.Assert(strings.HasSuffix(logs, "xxx"), Equals, true)
+}
+
+func (s *S) waitForFileContent(c *C, path, expected string) {
+	for i := 0; ; i++ {
+		if i >= 100 {
+			b, _ := ioutil.ReadFile(path)
+			c.Fatalf("timed out waiting for %q, got %q", expected, b)
+		}
+		b, _ := ioutil.ReadFile(path)
+		if string(b) == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *S) TestHooksOrder(c *C) {
+	out := filepath.Join(c.MkDir(), "out")
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    test2:
+        override: replace
+        command: /bin/sh -c 'echo svc >>%[1]s; sleep 10'
+        before-start:
+            - /bin/sh -c 'echo before1 >>%[1]s'
+            - /bin/sh -c 'echo before2 >>%[1]s; echo hook output'
+        after-stop:
+            - /bin/sh -c 'echo after >>%[1]s'
+`, out))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	chg := s.startServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	s.waitForFileContent(c, out, "before1\nbefore2\nsvc\n")
+
+	chg = s.stopServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	s.waitForFileContent(c, out, "before1\nbefore2\nsvc\nafter\n")
+
+	// Hook output goes to the service's log buffer, tagged with the hook.
+	iterators, err := s.manager.ServiceLogs([]string{"test2"}, -1)
+	c.Assert(err, IsNil)
+	defer iterators["test2"].Close()
+	logs, err := ioutil.ReadAll(iterators["test2"])
+	c.Assert(err, IsNil)
+	c.Assert(string(logs), Matches, `(?s).* \[test2/before-start\] hook output\n.* \[pebble\] --- service "test2" started .*`)
+}
+
+func (s *S) TestBeforeStartFailure(c *C) {
+	out := filepath.Join(c.MkDir(), "out")
+	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
+services:
+    test2:
+        override: replace
+        command: /bin/sh -c 'echo svc >>%[1]s; sleep 10'
+        before-start:
+            - /bin/sh -c 'echo oops; exit 3'
+            - /bin/sh -c 'echo before2 >>%[1]s'
+`, out))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	chg := s.startServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.ErrorStatus)
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot start service: before-start command ".*" failed: exit status 3.*`)
+	c.Check(chg.Tasks()[0].Log()[0], Matches, `(?s).* INFO Most recent service output:\n    oops`)
+	s.st.Unlock()
+
+	c.Assert(out, testutil.FileAbsent)
+	svc := s.serviceByName(c, "test2")
+	c.Assert(svc.Current, Equals, servstate.StatusInactive)
+}
+
+func (s *S) TestHookTimeout(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: replace
+        command: sleep 10
+        hook-timeout: 100ms
+        before-start:
+            - /bin/sh -c 'sleep 10; echo done'
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	start := time.Now()
+	chg := s.startServices(c, []string{"test2"}, 1)
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.ErrorStatus)
+	c.Check(chg.Err(), ErrorMatches, `(?s).*cannot start service: before-start command ".*" failed: timed out after 100ms.*`)
+	s.st.Unlock()
+}
 
-	tempDir := c.MkDir()
-	tempFile := filepath.Join(tempDir, "out")
+func (s *S) TestAfterStopFailure(c *C) {
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: replace
+        command: sleep 10
+        after-stop:
+            - /bin/sh -c 'exit 1'
+`)
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
+
+	s.startServices(c, []string{"test2"}, 1)
+	chg := s.stopServices(c, []string{"test2"}, 1)
+	s.st.Lock()
+	c.Check(chg.Status(), Equals, state.DoneStatus, Commentf("Error: %v", chg.Err()))
+	s.st.Unlock()
+	svc := s.serviceByName(c, "test2")
+	c.Assert(svc.Current, Equals, servstate.StatusInactive)
+}
+
+func (s *S) TestHooksOnRestart(c *C) {
+	out := filepath.Join(c.MkDir(), "out")
 	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
 services:
     test2:
         override: replace
-        command: /bin/sh -c 'echo x >>%s; sleep 0.075'
+        command: /bin/sh -c 'echo svc >>%[1]s; sleep 0.1'
         backoff-delay: 50ms
-        backoff-factor: 100  # ensure it only backoff-restarts once
-        on-check-failure:
-            chk1: restart
-
-checks:
-    chk1:
-         override: replace
-         period: 100ms
-         threshold: 1
-         exec:
-             command: will-fail
-`, tempFile))
+        before-start:
+            - /bin/sh -c 'echo before >>%[1]s'
+        after-stop:
+            - /bin/sh -c 'echo after >>%[1]s'
+`, out))
 	err := s.manager.AppendLayer(layer)
 	c.Assert(err, IsNil)
 
-	// Start service and wait till it starts up (output file is written to)
 	s.startServices(c, []string{"test2"}, 1)
-	for i := 0; ; i++ {
-		if i >= 100 {
-			c.Fatalf("failed waiting for command to start")
-		}
-		b, _ := ioutil.ReadFile(tempFile)
-		if string(b) == "x\n" {
-			break
-		}
-		time.Sleep(5 * time.Millisecond)
-	}
+	s.waitForFileContent(c, out, "before\nsvc\nafter\nbefore\nsvc\n")
+	s.stopServices(c, []string{"test2"}, 1)
+}
 
-	// Ensure it exits and goes into backoff state
-	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
-		return svc.Current == servstate.StatusBackoff
-	})
+// fakeClock fakes the clock of the service logs and of the log-silence
+// watchdog, which then only move when the test advances them.
+func (s *S) fakeClock() *servicelog.TestClock {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 0, time.UTC))
+	s.AddCleanup(servicelog.FakeClock(clock))
+	s.AddCleanup(servstate.FakeWatchdogClock(clock))
+	return clock
+}
 
-	// Check failure should wait for current backoff (after which it will be restarted)
-	for i := 0; ; i++ {
+// waitWatchdog waits until the watchdog's timer is set on clock, the only
+// one set for services without log options.
+func waitWatchdog(c *C, clock *servicelog.TestClock) {
+	for i := 0; clock.Pending() != 1; i++ {
 		if i >= 100 {
-			c.Fatalf("failed waiting for command to start")
-		}
-		b, err := ioutil.ReadFile(tempFile)
-		c.Assert(err, IsNil)
-		if string(b) == "x\nx\n" {
-			break
+			c.Fatalf("timed out waiting for watchdog")
 		}
 		time.Sleep(5 * time.Millisecond)
 	}
-	svc := s.serviceByName(c, "test2")
-	c.Assert(svc.Current, Equals, servstate.StatusActive)
-	c.Assert(s.manager.BackoffNum("test2"), Equals, 1)
-
-	// Shouldn't be restarted again
-	time.Sleep(125 * time.Millisecond)
-	b, err := ioutil.ReadFile(tempFile)
-	c.Assert(err, IsNil)
-	c.Assert(string(b), Equals, "x\nx\n")
-	checks, err := checkMgr.Checks("", nil)
-	c.Assert(err, IsNil)
-	c.Assert(len(checks), Equals, 1)
-	c.Assert(checks[0].Healthy, Equals, false)
-	c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
 }
 
-func (s *S) TestOnCheckFailureIgnore(c *C) {
-	// Create check manager and tell it about plan updates
-	checkMgr := checkstate.NewManager()
-	defer checkMgr.PlanChanged(&plan.Plan{})
-	s.manager.NotifyPlanChanged(checkMgr.PlanChanged)
-
-	// Tell service manager about check failures
-	checkMgr.NotifyCheckFailed(s.manager.CheckFailed)
-
+func (s *S) TestWatchdogLogSilenceRestart(c *C) {
+	clock := s.fakeClock()
 	tempDir := c.MkDir()
 	tempFile := filepath.Join(tempDir, "out")
 	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
 services:
     test2:
         override: replace
-        command: /bin/sh -c 'echo x >>%s; sleep 1'
-        on-check-failure:
-            chk1: ignore
-
-checks:
-    chk1:
-         override: replace
-         period: 75ms  # a bit longer than shortOkayWait
-         threshold: 1
-         exec:
-             command: will-fail
+        command: /bin/sh -c 'echo x >>%s; echo started; sleep 10'
+        backoff-delay: 50ms
+        watchdog-log-silence: 150ms
 `, tempFile))
 	err := s.manager.AppendLayer(layer)
 	c.Assert(err, IsNil)
 
-	// Start service and wait till it starts up (output file is written to)
+	// Start service; it writes one line of output then goes quiet.
 	s.startServices(c, []string{"test2"}, 1)
-	for i := 0; ; i++ {
-		if i >= 100 {
-			c.Fatalf("failed waiting for command to start")
-		}
-		b, _ := ioutil.ReadFile(tempFile)
-		if string(b) == "x\n" {
-			break
-		}
-		time.Sleep(5 * time.Millisecond)
-	}
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive
+	})
+	waitWatchdog(c, clock)
+	s.waitForLogs(c, "test2", "[test2] started\n")
 
-	// Now wait till check happens (it will-fail)
-	for i := 0; ; i++ {
-		if i >= 100 {
-			c.Fatalf("failed waiting for check to fail")
-		}
-		checks, err := checkMgr.Checks("", nil)
-		c.Assert(err, IsNil)
-		if len(checks) == 1 && !checks[0].Healthy {
-			c.Assert(checks[0].Failures, Equals, 1)
-			c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
-			break
-		}
-		time.Sleep(5 * time.Millisecond)
-	}
+	// Nothing happens until the silence reaches the limit.
+	clock.Advance(149 * time.Millisecond)
+	c.Assert(clock.Pending(), Equals, 1)
+	c.Assert(s.manager.BackoffNum("test2"), Equals, 0)
 
-	// Service shouldn't have been restarted
-	time.Sleep(100 * time.Millisecond)
-	b, err := ioutil.ReadFile(tempFile)
-	c.Assert(err, IsNil)
-	c.Assert(string(b), Equals, "x\n")
-	checks, err := checkMgr.Checks("", nil)
+	// Watchdog should terminate process, backoff, and restart it.
+	clock.Advance(time.Millisecond)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusBackoff
+	})
+	s.waitForFileContent(c, tempFile, "x\nx\n")
+	c.Assert(s.manager.BackoffNum("test2"), Equals, 1)
+
+	// The reason is recorded with the restart.
+	notice := s.waitForNotice(c, state.ServiceRestartNotice)
+	c.Check(notice.LastData()["reason"], Equals, "log-silence watchdog")
+
+	s.stopServices(c, []string{"test2"}, 1)
+}
+
+func (s *S) TestWatchdogLogSilenceResetByOutput(c *C) {
+	clock := s.fakeClock()
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: replace
+        command: /bin/sh -c 'while true; do echo tick; sleep 0.02; done'
+        watchdog-log-silence: 150ms
+`)
+	err := s.manager.AppendLayer(layer)
 	c.Assert(err, IsNil)
-	c.Assert(len(checks), Equals, 1)
-	c.Assert(checks[0].Healthy, Equals, false)
-	c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
+
+	s.startServices(c, []string{"test2"}, 1)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive
+	})
+	waitWatchdog(c, clock)
+
+	// Output 100ms in puts the watchdog off when its timer fires at
+	// 150ms, until 250ms, and so on while the service keeps producing it.
+	for i := 1; i <= 4; i++ {
+		clock.Advance(100 * time.Millisecond)
+		s.waitForLogs(c, "test2", fmt.Sprintf("51.%d00Z [test2] tick\n", i))
+		waitWatchdog(c, clock)
+	}
 	svc := s.serviceByName(c, "test2")
 	c.Assert(svc.Current, Equals, servstate.StatusActive)
-}
-
-func (s *S) TestOnCheckFailureShutdown(c *C) {
-	// Create check manager and tell it about plan updates
-	checkMgr := checkstate.NewManager()
-	defer checkMgr.PlanChanged(&plan.Plan{})
-	s.manager.NotifyPlanChanged(checkMgr.PlanChanged)
+	c.Assert(s.manager.BackoffNum("test2"), Equals, 0)
 
-	// Tell service manager about check failures
-	checkMgr.NotifyCheckFailed(s.manager.CheckFailed)
+	s.stopServices(c, []string{"test2"}, 1)
+}
 
-	tempDir := c.MkDir()
-	tempFile := filepath.Join(tempDir, "out")
+func (s *S) TestWatchdogLogSilenceNotResetByEvents(c *C) {
+	clock := s.fakeClock()
+	s.AddCleanup(servstate.FakeOutputClosedWait(10 * time.Millisecond))
+	closeFile := filepath.Join(c.MkDir(), "close")
 	layer := parseLayer(c, 0, "layer", fmt.Sprintf(`
 services:
     test2:
         override: replace
-        command: /bin/sh -c 'echo x >>%s; sleep 1'
-        on-check-failure:
-            chk1: shutdown
+        command: /bin/sh -c 'echo started; while [ ! -e %s ]; do sleep 0.01; done; exec >&- 2>&-; sleep 10'
+        backoff-delay: 50ms
+        watchdog-log-silence: 150ms
+`, closeFile))
+	err := s.manager.AppendLayer(layer)
+	c.Assert(err, IsNil)
 
-checks:
-    chk1:
-         override: replace
-         period: 75ms  # a bit longer than shortOkayWait
-         threshold: 1
-         exec:
-             command: will-fail
-`, tempFile))
+	s.startServices(c, []string{"test2"}, 1)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusActive
+	})
+	waitWatchdog(c, clock)
+	s.waitForLogs(c, "test2", "[test2] started\n")
+
+	// Pebble's own line about the service 100ms in isn't the service's
+	// output, so the watchdog still fires at 150ms.
+	clock.Advance(100 * time.Millisecond)
+	err = ioutil.WriteFile(closeFile, nil, 0644)
+	c.Assert(err, IsNil)
+	s.waitForLogs(c, "test2", "51.100Z [pebble] --- service \"test2\" closed its output")
+	clock.Advance(50 * time.Millisecond)
+	s.waitUntilService(c, "test2", func(svc *servstate.ServiceInfo) bool {
+		return svc.Current == servstate.StatusBackoff
+	})
+
+	s.stopServices(c, []string{"test2"}, 1)
+}
+
+func (s *S) TestWatchdogLogSilenceIgnore(c *C) {
+	clock := s.fakeClock()
+	layer := parseLayer(c, 0, "layer", `
+services:
+    test2:
+        override: replace
+        command: sleep 10
+        on-failure: ignore
+        watchdog-log-silence: 50ms
+`)
 	err := s.manager.AppendLayer(layer)
 	c.Assert(err, IsNil)
 
-	// Start service and wait till it starts up (output file is written to)
+	// The watchdog fires, and is set again, each time the silence
+	// reaches the limit, without the service being restarted.
 	s.startServices(c, []string{"test2"}, 1)
-	for i := 0; ; i++ {
-		if i >= 100 {
-			c.Fatalf("failed waiting for command to start")
-		}
-		b, _ := ioutil.ReadFile(tempFile)
-		if string(b) == "x\n" {
-			break
-		}
-		time.Sleep(5 * time.Millisecond)
+	waitWatchdog(c, clock)
+	for i := 0; i < 3; i++ {
+		clock.Advance(50 * time.Millisecond)
+		waitWatchdog(c, clock)
 	}
+	svc := s.serviceByName(c, "test2")
+	c.Assert(svc.Current, Equals, servstate.StatusActive)
+	c.Assert(s.manager.BackoffNum("test2"), Equals, 0)
 
-	// Now wait till check happens (it will-fail)
+	s.stopServices(c, []string{"test2"}, 1)
+}
+
+// waitForLogs waits until the service's logs contain text.
+func (s *S) waitForLogs(c *C, name, text string) {
 	for i := 0; ; i++ {
-		if i >= 100 {
-			c.Fatalf("failed waiting for check to fail")
+		logs := s.serviceLogs(c, name)
+		if strings.Contains(logs, text) {
+			return
 		}
-		checks, err := checkMgr.Checks("", nil)
-		c.Assert(err, IsNil)
-		if len(checks) == 1 && !checks[0].Healthy {
-			c.Assert(checks[0].Failures, Equals, 1)
-			c.Assert(checks[0].LastError, Matches, ".* executable file not found .*")
-			break
+		if i >= 100 {
+			c.Fatalf("timed out waiting for %q in logs %q", text, logs)
 		}
-		time.Sleep(5 * time.Millisecond)
-	}
-
-	// It should have closed the stopDaemon channel.
-	select {
-	case <-s.stopDaemon:
-	case <-time.After(time.Second):
-		c.Fatalf("timed out waiting for stop-daemon channel")
+		time.Sleep(10 * time.Millisecond)
 	}
 }
 
@@ -1239,6 +3200,16 @@ func (s *S) waitUntilService(c *C, service string, f func(svc *servstate.Service
 	c.Fatalf("timed out waiting for service")
 }
 
+func (s *S) waitUntilLogging(c *C, name string, f func(logging *servstate.LoggingInfo) bool) {
+	for i := 0; i < 100; i++ {
+		if f(s.serviceLogging(c, name)) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for service logging")
+}
+
 func (s *S) TestActionShutdown(c *C) {
 	layer := parseLayer(c, 0, "layer", `
 services:
@@ -1372,6 +3343,34 @@ func (s *S) TestGetJitter(c *C) {
 	}
 }
 
+func (s *S) TestLogWriteError(c *C) {
+	var notices []string
+	s.manager.FakeNoticef(func(format string, v ...interface{}) {
+		notices = append(notices, fmt.Sprintf(format, v...))
+	})
+
+	outputErr := &servicelog.WriteError{Service: "svc1", Stage: servicelog.StageOutput, Err: syscall.EPIPE}
+	formatErr := &servicelog.WriteError{Service: "svc1", Stage: servicelog.StageFormat, Err: syscall.ENOSPC}
+	for i := 0; i < 3; i++ {
+		s.manager.LogWriteError(outputErr)
+		s.manager.LogWriteError(formatErr)
+	}
+	c.Check(notices, DeepEquals, []string{
+		`Log write failed: cannot write logs for service "svc1" (output): broken pipe`,
+		`Log write failed: cannot write logs for service "svc1" (format): no space left on device`,
+	})
+
+	// Once the interval has passed, the next failure is logged along with
+	// the number suppressed.
+	notices = nil
+	restoreInterval := servstate.FakeLogErrorInterval(0)
+	defer restoreInterval()
+	s.manager.LogWriteError(outputErr)
+	c.Check(notices, DeepEquals, []string{
+		`Log write failed: cannot write logs for service "svc1" (output): broken pipe (2 similar failures suppressed)`,
+	})
+}
+
 func (s *S) TestCalculateNextBackoff(c *C) {
 	tests := []struct {
 		delay   time.Duration
@@ -0,0 +1,18 @@
+//go:build !go1.20 || !linux
+// +build !go1.20 !linux
+
+package servstate
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/canonical/pebble/internal/cgroup"
+)
+
+// startInCgroup returns nil, as processes can only be started in a cgroup
+// with SysProcAttr.CgroupFD, from Go 1.20 on Linux; they're moved into
+// their group once started instead.
+func startInCgroup(cmd *exec.Cmd, group *cgroup.Group) *os.File {
+	return nil
+}
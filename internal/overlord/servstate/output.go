@@ -0,0 +1,158 @@
+package servstate
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+// outputCopier copies a service's logs from its ring buffer to the output
+// given to NewManager (normally pebble's stdout).
+type outputCopier struct {
+	// pending is the number of bytes read from the ring buffer but not yet
+	// written to the output. It's updated atomically by the copier, so it
+	// must be the first field to be 64-bit aligned on 32-bit platforms.
+	pending int64
+
+	manager  *ServiceManager
+	service  string
+	iterator servicelog.Iterator
+	finished chan struct{}
+}
+
+// startOutputCopier starts a goroutine copying logs from iterator to the
+// manager's output until done is closed (when the service's process has
+// exited) or the output is drained, and all logs have been copied. It
+// returns a channel that's closed when the copier has finished, or nil if
+// the output has already been drained, in which case the caller should
+// close the iterator.
+func (m *ServiceManager) startOutputCopier(service string, iterator servicelog.Iterator, done <-chan struct{}) <-chan struct{} {
+	m.outputLock.Lock()
+	defer m.outputLock.Unlock()
+	if m.outputDrained {
+		return nil
+	}
+	c := &outputCopier{
+		manager:  m,
+		service:  service,
+		iterator: iterator,
+		finished: make(chan struct{}),
+	}
+	m.outputCopiers[c] = true
+
+	// Stop waiting for more logs when either the process exits or the
+	// output is drained; the iterator still returns any logs already
+	// in the buffer.
+	cancel := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-m.outputDrain:
+		}
+		close(cancel)
+	}()
+
+	servicelog.WithLabels(service, servicelog.StageOutput, func() {
+		go c.copy(cancel)
+	})
+	return c.finished
+}
+
+// copy copies logs to the output until cancel is closed and the logs
+// already in the buffer have been copied, or until the output is drained.
+func (c *outputCopier) copy(cancel <-chan struct{}) {
+	m := c.manager
+	defer func() {
+		m.outputLock.Lock()
+		delete(m.outputCopiers, c)
+		m.outputLock.Unlock()
+		close(c.finished)
+	}()
+	defer c.iterator.Close()
+	for atomic.LoadInt32(&m.outputClosed) == 0 && c.iterator.Next(cancel) {
+		atomic.StoreInt64(&c.pending, int64(c.iterator.Buffered()))
+		_, err := io.Copy(c, c.iterator)
+		if err != nil {
+			m.logWriteError(&servicelog.WriteError{
+				Service: c.service,
+				Stage:   servicelog.StageOutput,
+				Err:     err,
+			})
+		}
+	}
+}
+
+// Write writes p to the manager's output, or discards it once the output
+// has been drained.
+func (c *outputCopier) Write(p []byte) (int, error) {
+	c.manager.outputWriteLock.RLock()
+	defer c.manager.outputWriteLock.RUnlock()
+	if atomic.LoadInt32(&c.manager.outputClosed) != 0 {
+		return len(p), nil
+	}
+	n, err := c.manager.serviceOutput.Write(p)
+	atomic.AddInt64(&c.pending, -int64(n))
+	return n, err
+}
+
+// DrainOutput finishes copying service logs to the output given to
+// NewManager. It stops waiting for new logs and waits for the logs already
+// written by services to be copied, until ctx is done. Nothing is written
+// to the output after DrainOutput returns, except the remainder of a write
+// that was already blocked when ctx was done, and no more services have
+// their logs copied to it.
+//
+// DrainOutput returns the number of bytes that were being copied when ctx
+// was done, for each service whose logs couldn't all be copied in time.
+func (m *ServiceManager) DrainOutput(ctx context.Context) map[string]int64 {
+	m.outputLock.Lock()
+	if !m.outputDrained {
+		m.outputDrained = true
+		close(m.outputDrain)
+	}
+	copiers := make([]*outputCopier, 0, len(m.outputCopiers))
+	for c := range m.outputCopiers {
+		copiers = append(copiers, c)
+	}
+	m.outputLock.Unlock()
+
+	dropped := make(map[string]int64)
+	for _, c := range copiers {
+		select {
+		case <-c.finished:
+		case <-ctx.Done():
+		}
+	}
+	atomic.StoreInt32(&m.outputClosed, 1)
+
+	// Writes that started before the output was closed hold the read lock;
+	// wait for them to finish, unless the deadline has already passed.
+	written := make(chan struct{})
+	go func() {
+		m.outputWriteLock.Lock()
+		m.outputWriteLock.Unlock()
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-ctx.Done():
+	}
+
+	for _, c := range copiers {
+		select {
+		case <-c.finished:
+			continue
+		default:
+		}
+		// Logs the copier hasn't read from the buffer yet are dropped too,
+		// but aren't counted.
+		n := atomic.LoadInt64(&c.pending)
+		if n < 0 {
+			n = 0
+		}
+		dropped[c.service] += n
+	}
+	return dropped
+}
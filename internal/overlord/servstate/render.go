@@ -0,0 +1,142 @@
+package servstate
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/template"
+
+	"github.com/canonical/pebble/internal/osutil"
+	"github.com/canonical/pebble/internal/osutil/sys"
+	"github.com/canonical/pebble/internal/plan"
+)
+
+// renderData is the data available to the templates in a service's render
+// section, for example {{.Service}} or {{.Env.PORT}}.
+type renderData struct {
+	Service  string
+	Hostname string
+	Env      map[string]string
+}
+
+// renderFiles renders the templates in the service's render section and
+// atomically writes them to their destinations, so that a failed render
+// never leaves a partially-written file behind.
+func renderFiles(config *plan.Service) error {
+	for _, dest := range renderDestinations(config) {
+		render := config.Render[dest]
+		content, err := renderTemplate(config, dest, render)
+		if err != nil {
+			return fmt.Errorf("cannot render %q: %w", dest, err)
+		}
+		err = writeRenderedFile(config, dest, render, content)
+		if err != nil {
+			return fmt.Errorf("cannot write %q: %w", dest, err)
+		}
+	}
+	return nil
+}
+
+// renderChanged reports whether rendering the service's templates would
+// change any of the destination files, for example because the template
+// source file has been updated. A render error counts as a change, so that
+// the error is reported when the service is next started or reloaded.
+func renderChanged(config *plan.Service) bool {
+	for _, dest := range renderDestinations(config) {
+		content, err := renderTemplate(config, dest, config.Render[dest])
+		if err != nil {
+			return true
+		}
+		current, err := ioutil.ReadFile(dest)
+		if err != nil || !bytes.Equal(current, content) {
+			return true
+		}
+	}
+	return false
+}
+
+func renderDestinations(config *plan.Service) []string {
+	dests := make([]string, 0, len(config.Render))
+	for dest := range config.Render {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+	return dests
+}
+
+func renderTemplate(config *plan.Service, dest string, render *plan.RenderFile) ([]byte, error) {
+	text := render.Template
+	if render.Source != "" {
+		source, err := ioutil.ReadFile(render.Source)
+		if err != nil {
+			return nil, err
+		}
+		text = string(source)
+	}
+	// Use the destination as the template name, so that errors (which
+	// include the line number) say which file failed to render.
+	tmpl, err := template.New(dest).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	env, err := serviceEnvironment(config)
+	if err != nil {
+		return nil, err
+	}
+	data := &renderData{
+		Service:  config.Name,
+		Hostname: hostname,
+		Env:      env,
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeRenderedFile(config *plan.Service, dest string, render *plan.RenderFile, content []byte) error {
+	mode, err := render.FileMode()
+	if err != nil {
+		return err
+	}
+
+	// The file is owned by the user the service runs as, unless the owner
+	// is specified explicitly.
+	userID, groupID, user, group := render.UserID, render.GroupID, render.User, render.Group
+	if userID == nil && groupID == nil && user == "" && group == "" {
+		userID, groupID, user, group = config.UserID, config.GroupID, config.User, config.Group
+	}
+	uid, gid, err := osutil.NormalizeUidGid(userID, groupID, user, group)
+	if err != nil {
+		return err
+	}
+	var fileUID sys.UserID = osutil.NoChown
+	var fileGID sys.GroupID = osutil.NoChown
+	if uid != nil && gid != nil {
+		fileUID, fileGID = sys.UserID(*uid), sys.GroupID(*gid)
+	}
+
+	file, err := osutil.NewAtomicFile(dest, mode, 0, fileUID, fileGID)
+	if err != nil {
+		return err
+	}
+	defer file.Cancel()
+	_, err = file.Write(content)
+	if err != nil {
+		return err
+	}
+	// Set the mode explicitly, as it's affected by the umask on creation.
+	err = file.Chmod(mode)
+	if err != nil {
+		return err
+	}
+	return file.Commit()
+}
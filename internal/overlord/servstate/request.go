@@ -9,15 +9,28 @@ import (
 // ServiceRequest holds the details required to perform service tasks.
 type ServiceRequest struct {
 	Name string
+
+	// Args are extra arguments to append to the service's command when
+	// starting it.
+	Args []string
 }
 
 // Start creates and returns a task set for starting the given services.
 func Start(s *state.State, services []string) (*state.TaskSet, error) {
+	return StartWithArgs(s, services, nil)
+}
+
+// StartWithArgs creates and returns a task set for starting the given
+// services, appending the extra arguments in args (keyed by service name)
+// to their commands. The extra arguments are kept when a service is
+// restarted automatically, and dropped when it's next started normally.
+func StartWithArgs(s *state.State, services []string, args map[string][]string) (*state.TaskSet, error) {
 	var tasks []*state.Task
 	for _, name := range services {
 		task := s.NewTask("start", fmt.Sprintf("Start service %q", name))
 		req := ServiceRequest{
 			Name: name,
+			Args: args[name],
 		}
 		task.Set("service-request", &req)
 		if len(tasks) > 0 {
@@ -46,3 +59,18 @@ func Stop(s *state.State, services []string) (*state.TaskSet, error) {
 	}
 	return state.NewTaskSet(tasks...), nil
 }
+
+// Reload creates and returns a task set for reloading the given services,
+// by sending them their reload-signal.
+func Reload(s *state.State, services []string) (*state.TaskSet, error) {
+	var tasks []*state.Task
+	for _, name := range services {
+		task := s.NewTask("reload", fmt.Sprintf("Reload service %q", name))
+		req := ServiceRequest{
+			Name: name,
+		}
+		task.Set("service-request", &req)
+		tasks = append(tasks, task)
+	}
+	return state.NewTaskSet(tasks...), nil
+}
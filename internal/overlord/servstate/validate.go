@@ -0,0 +1,202 @@
+package servstate
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+// LoggingReport describes how a service's output would be logged under the
+// current plan, as found by ValidateLogging.
+type LoggingReport struct {
+	Service string
+	// Stages are the stages of the service's log pipeline, in order.
+	Stages []string
+	// Warnings describe problems with the service's logging options.
+	Warnings []string
+	// Sample is the first few lines of the sample output as they'd appear
+	// in the service's logs.
+	Sample []string
+}
+
+// loggingSample is the output run through each service's log pipeline by
+// ValidateLogging.
+var loggingSample = []string{
+	"sample line 1: plain ASCII output",
+	"sample line 2: UTF-8 output, héllo wörld ✓",
+	"sample line 3:\tindented\twith\ttabs",
+	"",
+	"sample line 5: " + strings.Repeat("long ", 1000),
+	"sample line 6: the end",
+}
+
+const (
+	// Number of lines of sample output included in a LoggingReport.
+	loggingReportLines = 3
+
+	// Number of lines of a service's recent output that reload-ready-log
+	// is checked against.
+	recentLogLines = 100
+)
+
+// ValidateLogging checks the logging options of the named services (all
+// services if names is empty) in the current plan. Each service's log
+// pipeline is built as it would be to start the service, but writing to a
+// buffer of its own, and the sample output is run through it. Nothing is
+// started, and no files are opened or created.
+func (m *ServiceManager) ValidateLogging(names []string) ([]*LoggingReport, error) {
+	releasePlan, err := m.acquirePlan()
+	if err != nil {
+		return nil, err
+	}
+	defer releasePlan()
+
+	requested := make(map[string]bool, len(names))
+	for _, name := range names {
+		requested[name] = true
+	}
+
+	var reports []*LoggingReport
+	matchNames := len(names) > 0
+	for name, config := range m.plan.Services {
+		if matchNames && !requested[name] {
+			continue
+		}
+		reports = append(reports, m.validateLogging(config, len(m.plan.Services)))
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Service < reports[j].Service
+	})
+	return reports, nil
+}
+
+func (m *ServiceManager) validateLogging(config *plan.Service, numServices int) *LoggingReport {
+	report := &LoggingReport{Service: config.Name}
+	warnf := func(format string, args ...interface{}) {
+		report.Warnings = append(report.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	// The pipeline is built by a stand-in for the service, with the plan's
+	// config and the panics counted against the running service's stages.
+	s := &serviceData{manager: m, config: config}
+	var recent string
+	m.servicesLock.Lock()
+	existing := m.services[config.Name]
+	m.servicesLock.Unlock()
+	if existing != nil {
+		existing.logPanicsLock.Lock()
+		s.logPanics = make(map[string]int, len(existing.logPanics))
+		for stage, n := range existing.logPanics {
+			s.logPanics[stage] = n
+		}
+		existing.logPanicsLock.Unlock()
+		var err error
+		recent, err = servicelog.LastLines(existing.logs, recentLogLines, "", true)
+		if err != nil {
+			warnf("cannot read recent output: %v", err)
+		}
+	}
+
+	logs := servicelog.NewRingBuffer(maxLogBytes)
+	var panics []*servicelog.PanicError
+	pipeline, stages := s.logPipeline(logs, nil, nil, func(err *servicelog.PanicError) {
+		panics = append(panics, err)
+	})
+	if m.serviceOutput != nil {
+		stages = append(stages, servicelog.StageOutput)
+	}
+	report.Stages = stages
+	if config.LogEncoding != "" && s.logStageDisabled(servicelog.StageDecode) {
+		warnf("log-encoding is left out after %d panics, until the next replan", maxLogPanics)
+	}
+
+	for _, line := range loggingSample {
+		_, err := pipeline.Write(encodeSample(line+"\n", config.LogEncoding))
+		if err != nil {
+			warnf("cannot write sample output: %v", err)
+			break
+		}
+	}
+	// Closing the pipeline passes on anything held back, such as by
+	// log-coalesce.
+	if err := pipeline.Close(); err != nil {
+		warnf("cannot write sample output: %v", err)
+	}
+	for _, err := range panics {
+		warnf("%v", err)
+	}
+	it := logs.TailIterator()
+	sample, err := ioutil.ReadAll(it)
+	it.Close()
+	if err != nil {
+		warnf("cannot read sample output: %v", err)
+	}
+	lines := strings.SplitAfter(string(sample), "\n")
+	if len(lines) > loggingReportLines {
+		lines = lines[:loggingReportLines]
+	}
+	for _, line := range lines {
+		if line != "" {
+			report.Sample = append(report.Sample, strings.TrimSuffix(line, "\n"))
+		}
+	}
+
+	// The pattern is only checked against real output: the sample output
+	// isn't expected to match it.
+	if config.ReloadReadyLog != "" && strings.TrimSpace(recent) != "" {
+		lines := strings.Split(recent, "\n")
+		matched := false
+		// The plan has already checked that the pattern compiles.
+		if re, err := regexp.Compile(config.ReloadReadyLog); err == nil {
+			for _, line := range lines {
+				if re.MatchString(line) {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			warnf("reload-ready-log %q matches none of the last %d lines of output", config.ReloadReadyLog, len(lines))
+		}
+	}
+
+	if limit := m.logBudget.Stats().Limit; limit > 0 {
+		share := limit / int64(numServices)
+		if share < servicelog.MinBudgetedSize {
+			warnf("log memory limit of %d bytes leaves %d bytes for each of %d services, less than the %d needed for one line; services started once it's used up drop their output",
+				limit, share, numServices, servicelog.MinBudgetedSize)
+		}
+	}
+
+	if config.LogEncoding != "" && len(config.LogFiles) > 0 {
+		warnf("log-encoding %q isn't applied to the lines read from log-files", config.LogEncoding)
+	}
+
+	return report
+}
+
+// encodeSample returns text, which is UTF-8, in the given log-encoding.
+func encodeSample(text, encoding string) []byte {
+	var order binary.ByteOrder
+	switch encoding {
+	case servicelog.EncodingUTF16LE:
+		order = binary.LittleEndian
+	case servicelog.EncodingUTF16BE:
+		order = binary.BigEndian
+	default:
+		return []byte(text)
+	}
+	units := utf16.Encode([]rune(text))
+	encoded := make([]byte, 2*len(units))
+	for i, unit := range units {
+		order.PutUint16(encoded[2*i:], unit)
+	}
+	return encoded
+}
@@ -66,6 +66,21 @@ func (t *Task) AccumulateUndoingTime(duration time.Duration) {
 	t.accumulateUndoingTime(duration)
 }
 
+func (s *State) AddNoticeAt(noticeType NoticeType, key string, data map[string]string, t time.Time) {
+	s.addNotice(noticeType, key, data, t)
+}
+
+func (n *Notice) SetExpireAfter(expireAfter time.Duration) {
+	n.expireAfter = expireAfter
+}
+
+var (
+	ErrNoNoticeType          = errNoNoticeType
+	ErrNoNoticeKey           = errNoNoticeKey
+	ErrNoNoticeFirstOccurred = errNoNoticeFirstOccurred
+	ErrNoNoticeExpireAfter   = errNoNoticeExpireAfter
+)
+
 var (
 	ErrNoWarningMessage     = errNoWarningMessage
 	ErrBadWarningMessage    = errBadWarningMessage
@@ -0,0 +1,300 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/canonical/pebble/internal/logger"
+)
+
+var (
+	DefaultNoticeExpireAfter = time.Hour * 24 * 7
+
+	errNoNoticeType          = errors.New("notice has no type")
+	errNoNoticeKey           = errors.New("notice has no key")
+	errNoNoticeFirstOccurred = errors.New("notice has no first-occurred timestamp")
+	errNoNoticeExpireAfter   = errors.New("notice has no expire-after duration")
+)
+
+// NoticeType is the type of a notice, which determines the meaning of its
+// key and data.
+type NoticeType string
+
+const (
+	// ServiceRestartNotice is recorded whenever a service is scheduled to
+	// be restarted after exiting. The key is the service name.
+	ServiceRestartNotice NoticeType = "service-restart"
+
+	// ServiceFailureNotice is recorded whenever a service exits
+	// unexpectedly, with its exit code and most recent output. The key is
+	// the service name.
+	ServiceFailureNotice NoticeType = "service-failure"
+
+	// ServiceLogPanicNotice is recorded when a panic is recovered from a
+	// service's log pipeline. The key is the service name.
+	ServiceLogPanicNotice NoticeType = "service-log-panic"
+)
+
+type jsonNotice struct {
+	Type          NoticeType        `json:"type"`
+	Key           string            `json:"key"`
+	FirstOccurred time.Time         `json:"first-occurred"`
+	LastOccurred  time.Time         `json:"last-occurred"`
+	LastAcked     *time.Time        `json:"last-acked,omitempty"`
+	Occurrences   int               `json:"occurrences"`
+	LastData      map[string]string `json:"last-data,omitempty"`
+	ExpireAfter   string            `json:"expire-after,omitempty"`
+}
+
+// Notice is a record of something interesting that happened in the
+// system. Notices are deduplicated by type and key: recording a notice
+// that already exists updates its last occurrence time, occurrence count,
+// and data.
+type Notice struct {
+	noticeType NoticeType
+	key        string
+	// the first time this notice occurred
+	firstOccurred time.Time
+	// the last time this notice occurred
+	lastOccurred time.Time
+	// the last time the user acknowledged this notice
+	lastAcked time.Time
+	// number of times this notice has occurred
+	occurrences int
+	// additional data about the last occurrence
+	lastData map[string]string
+	// how much time since the last occurrence should we drop the notice
+	expireAfter time.Duration
+}
+
+func (n *Notice) Type() NoticeType            { return n.noticeType }
+func (n *Notice) Key() string                 { return n.key }
+func (n *Notice) FirstOccurred() time.Time    { return n.firstOccurred }
+func (n *Notice) LastOccurred() time.Time     { return n.lastOccurred }
+func (n *Notice) LastAcked() time.Time        { return n.lastAcked }
+func (n *Notice) Occurrences() int            { return n.occurrences }
+func (n *Notice) LastData() map[string]string { return n.lastData }
+
+func (n *Notice) String() string {
+	return string(n.noticeType) + " " + n.key
+}
+
+func (n *Notice) MarshalJSON() ([]byte, error) {
+	jn := jsonNotice{
+		Type:          n.noticeType,
+		Key:           n.key,
+		FirstOccurred: n.firstOccurred,
+		LastOccurred:  n.lastOccurred,
+		Occurrences:   n.occurrences,
+		LastData:      n.lastData,
+		ExpireAfter:   n.expireAfter.String(),
+	}
+	if !n.lastAcked.IsZero() {
+		jn.LastAcked = &n.lastAcked
+	}
+	return json.Marshal(jn)
+}
+
+func (n *Notice) UnmarshalJSON(data []byte) error {
+	var jn jsonNotice
+	err := json.Unmarshal(data, &jn)
+	if err != nil {
+		return err
+	}
+	n.noticeType = jn.Type
+	n.key = jn.Key
+	n.firstOccurred = jn.FirstOccurred
+	n.lastOccurred = jn.LastOccurred
+	if jn.LastAcked != nil {
+		n.lastAcked = *jn.LastAcked
+	}
+	n.occurrences = jn.Occurrences
+	n.lastData = jn.LastData
+	if jn.ExpireAfter != "" {
+		n.expireAfter, err = time.ParseDuration(jn.ExpireAfter)
+		if err != nil {
+			return err
+		}
+	}
+	return n.validate()
+}
+
+func (n *Notice) validate() error {
+	if n.noticeType == "" {
+		return errNoNoticeType
+	}
+	if n.key == "" {
+		return errNoNoticeKey
+	}
+	if n.firstOccurred.IsZero() {
+		return errNoNoticeFirstOccurred
+	}
+	if n.expireAfter == 0 {
+		return errNoNoticeExpireAfter
+	}
+	return nil
+}
+
+func (n *Notice) expiredBefore(now time.Time) bool {
+	return n.lastOccurred.Add(n.expireAfter).Before(now)
+}
+
+// acked reports whether the notice has been acknowledged since it last
+// occurred.
+func (n *Notice) acked() bool {
+	return !n.lastAcked.Before(n.lastOccurred)
+}
+
+type noticeKey struct {
+	noticeType NoticeType
+	key        string
+}
+
+// flattenNotices returns all non-expired notices as a flat list, for
+// serialising. Call with the lock held.
+func (s *State) flattenNotices() []*Notice {
+	now := time.Now()
+	flat := make([]*Notice, 0, len(s.notices))
+	for _, n := range s.notices {
+		if n.expiredBefore(now) {
+			continue
+		}
+		flat = append(flat, n)
+	}
+	return flat
+}
+
+// unflattenNotices takes a flat list of notices and replaces the notice
+// map with them, ignoring expired notices in the process. Call with the
+// lock held.
+func (s *State) unflattenNotices(flat []*Notice) {
+	now := time.Now()
+	s.notices = make(map[noticeKey]*Notice, len(flat))
+	for _, n := range flat {
+		if n.expiredBefore(now) {
+			continue
+		}
+		s.notices[noticeKey{n.noticeType, n.key}] = n
+	}
+}
+
+// AddNotice records an occurrence of a notice: if it's the first notice
+// with this type and key it'll be added, otherwise the existing one will
+// have its last occurrence time and data updated, and its count
+// incremented.
+func (s *State) AddNotice(noticeType NoticeType, key string, data map[string]string) {
+	s.addNotice(noticeType, key, data, time.Now().UTC())
+}
+
+func (s *State) addNotice(noticeType NoticeType, key string, data map[string]string, t time.Time) {
+	s.writing()
+
+	k := noticeKey{noticeType, key}
+	n := s.notices[k]
+	if n == nil {
+		n = &Notice{
+			noticeType:    noticeType,
+			key:           key,
+			firstOccurred: t,
+			expireAfter:   DefaultNoticeExpireAfter,
+		}
+		if err := n.validate(); err != nil {
+			// programming error!
+			logger.Panicf("internal error, please report: attempted to add invalid notice: %v", err)
+			return
+		}
+		s.notices[k] = n
+	}
+	n.lastOccurred = t
+	n.occurrences++
+	n.lastData = data
+}
+
+// NoticeFilter allows filtering notices by various fields.
+type NoticeFilter struct {
+	// Types, if not empty, only includes notices of these types.
+	Types []NoticeType
+
+	// After, if set, only includes notices that last occurred after this
+	// time.
+	After time.Time
+
+	// All, if true, includes notices that have already been acknowledged.
+	All bool
+}
+
+func (f *NoticeFilter) matches(n *Notice) bool {
+	if f == nil {
+		return !n.acked()
+	}
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if n.noticeType == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.After.IsZero() && !n.lastOccurred.After(f.After) {
+		return false
+	}
+	return f.All || !n.acked()
+}
+
+type byLastOccurred []*Notice
+
+func (a byLastOccurred) Len() int           { return len(a) }
+func (a byLastOccurred) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLastOccurred) Less(i, j int) bool { return a[i].lastOccurred.Before(a[j].lastOccurred) }
+
+// Notices returns the notices that match filter (if filter is nil, all
+// unacknowledged notices), sorted by last occurrence time.
+func (s *State) Notices(filter *NoticeFilter) []*Notice {
+	s.reading()
+
+	var notices []*Notice
+	for _, n := range s.flattenNotices() {
+		if filter.matches(n) {
+			notices = append(notices, n)
+		}
+	}
+	sort.Sort(byLastOccurred(notices))
+	return notices
+}
+
+// AckNotices marks notices that occurred at or before the given time as
+// acknowledged, and returns the number of notices acknowledged.
+func (s *State) AckNotices(t time.Time) int {
+	t = t.UTC()
+	s.writing()
+
+	count := 0
+	for _, n := range s.notices {
+		if n.lastOccurred.After(t) || n.acked() {
+			continue
+		}
+		n.lastAcked = t
+		count++
+	}
+	return count
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package state_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/overlord/state"
+)
+
+func (ss *stateSuite) TestAddNoticeDeduplicates(c *C) {
+	st := state.New(nil)
+	st.Lock()
+	defer st.Unlock()
+
+	now := time.Now().UTC()
+	st.AddNoticeAt(state.ServiceRestartNotice, "svc1", map[string]string{"n": "1"}, now.Add(-3*time.Minute))
+	st.AddNoticeAt(state.ServiceRestartNotice, "svc2", nil, now.Add(-2*time.Minute))
+	st.AddNoticeAt(state.ServiceRestartNotice, "svc1", map[string]string{"n": "2"}, now.Add(-time.Minute))
+	st.AddNoticeAt("other", "svc1", nil, now)
+
+	notices := st.Notices(nil)
+	c.Assert(notices, HasLen, 3)
+
+	c.Check(notices[0].Type(), Equals, state.ServiceRestartNotice)
+	c.Check(notices[0].Key(), Equals, "svc2")
+	c.Check(notices[0].Occurrences(), Equals, 1)
+
+	c.Check(notices[1].Type(), Equals, state.ServiceRestartNotice)
+	c.Check(notices[1].Key(), Equals, "svc1")
+	c.Check(notices[1].Occurrences(), Equals, 2)
+	c.Check(notices[1].FirstOccurred(), Equals, now.Add(-3*time.Minute))
+	c.Check(notices[1].LastOccurred(), Equals, now.Add(-time.Minute))
+	c.Check(notices[1].LastData(), DeepEquals, map[string]string{"n": "2"})
+
+	c.Check(notices[2].Type(), Equals, state.NoticeType("other"))
+	c.Check(notices[2].Key(), Equals, "svc1")
+	c.Check(notices[2].Occurrences(), Equals, 1)
+}
+
+func (ss *stateSuite) TestNoticesFilter(c *C) {
+	st := state.New(nil)
+	st.Lock()
+	defer st.Unlock()
+
+	now := time.Now().UTC()
+	st.AddNoticeAt(state.ServiceRestartNotice, "svc1", nil, now.Add(-2*time.Minute))
+	st.AddNoticeAt(state.ServiceRestartNotice, "svc2", nil, now.Add(-time.Minute))
+	st.AddNoticeAt("other", "foo", nil, now)
+
+	notices := st.Notices(&state.NoticeFilter{Types: []state.NoticeType{state.ServiceRestartNotice}})
+	c.Assert(notices, HasLen, 2)
+	c.Check(notices[0].Key(), Equals, "svc1")
+	c.Check(notices[1].Key(), Equals, "svc2")
+
+	notices = st.Notices(&state.NoticeFilter{After: now.Add(-2 * time.Minute)})
+	c.Assert(notices, HasLen, 2)
+	c.Check(notices[0].Key(), Equals, "svc2")
+	c.Check(notices[1].Key(), Equals, "foo")
+}
+
+func (ss *stateSuite) TestAckNotices(c *C) {
+	st := state.New(nil)
+	st.Lock()
+	defer st.Unlock()
+
+	now := time.Now().UTC()
+	st.AddNoticeAt(state.ServiceRestartNotice, "svc1", nil, now.Add(-2*time.Minute))
+	st.AddNoticeAt(state.ServiceRestartNotice, "svc2", nil, now)
+
+	c.Check(st.AckNotices(now.Add(-time.Minute)), Equals, 1)
+	c.Check(st.AckNotices(now.Add(-time.Minute)), Equals, 0)
+
+	notices := st.Notices(nil)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Key(), Equals, "svc2")
+
+	notices = st.Notices(&state.NoticeFilter{All: true})
+	c.Assert(notices, HasLen, 2)
+	c.Check(notices[0].LastAcked(), Equals, now.Add(-time.Minute))
+
+	// Acknowledged notice reappears if it occurs again.
+	st.AddNoticeAt(state.ServiceRestartNotice, "svc1", nil, now.Add(time.Minute))
+	notices = st.Notices(nil)
+	c.Assert(notices, HasLen, 2)
+	c.Check(notices[1].Key(), Equals, "svc1")
+	c.Check(notices[1].Occurrences(), Equals, 2)
+}
+
+func (ss *stateSuite) TestNoticesPersisted(c *C) {
+	b := new(fakeStateBackend)
+	st := state.New(b)
+	st.Lock()
+	st.AddNotice(state.ServiceRestartNotice, "svc1", map[string]string{"a": "b"})
+	st.AddNotice(state.ServiceRestartNotice, "svc1", map[string]string{"c": "d"})
+	st.AckNotices(time.Now())
+	notices := st.Notices(&state.NoticeFilter{All: true})
+	st.Unlock()
+	c.Assert(notices, HasLen, 1)
+
+	st2, err := state.ReadState(nil, bytes.NewBuffer(b.checkpoints[len(b.checkpoints)-1]))
+	c.Assert(err, IsNil)
+	st2.Lock()
+	defer st2.Unlock()
+	notices2 := st2.Notices(&state.NoticeFilter{All: true})
+	c.Assert(notices2, HasLen, 1)
+	c.Check(notices2[0], DeepEquals, notices[0])
+	c.Check(notices2[0].Occurrences(), Equals, 2)
+	c.Check(notices2[0].LastData(), DeepEquals, map[string]string{"c": "d"})
+
+	// Still deduplicated against the restored notice.
+	st2.AddNotice(state.ServiceRestartNotice, "svc1", nil)
+	notices2 = st2.Notices(nil)
+	c.Assert(notices2, HasLen, 1)
+	c.Check(notices2[0].Occurrences(), Equals, 3)
+}
+
+func (ss *stateSuite) TestPruneNotices(c *C) {
+	st := state.New(nil)
+	st.Lock()
+	defer st.Unlock()
+
+	now := time.Now().UTC()
+	st.AddNoticeAt(state.ServiceRestartNotice, "old", nil, now.Add(-time.Minute))
+	st.AddNoticeAt(state.ServiceRestartNotice, "new", nil, now)
+	st.Notices(nil)[0].SetExpireAfter(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	st.Prune(time.Hour, time.Hour, 100)
+
+	notices := st.Notices(nil)
+	c.Assert(notices, HasLen, 1)
+	c.Check(notices[0].Key(), Equals, "new")
+}
+
+func (ss *stateSuite) TestUnmarshalNoticeErrors(c *C) {
+	for _, t := range []struct {
+		b string
+		e error
+	}{
+		{`{"type": "x", "key": "k", "first-occurred": "2006-01-02T15:04:05Z", "expire-after": "1h"}`, nil},
+		{`{             "key": "k", "first-occurred": "2006-01-02T15:04:05Z", "expire-after": "1h"}`, state.ErrNoNoticeType},
+		{`{"type": "x",             "first-occurred": "2006-01-02T15:04:05Z", "expire-after": "1h"}`, state.ErrNoNoticeKey},
+		{`{"type": "x", "key": "k",                                           "expire-after": "1h"}`, state.ErrNoNoticeFirstOccurred},
+		{`{"type": "x", "key": "k", "first-occurred": "2006-01-02T15:04:05Z"                      }`, state.ErrNoNoticeExpireAfter},
+	} {
+		var n state.Notice
+		c.Check(json.Unmarshal([]byte(t.b), &n), Equals, t.e)
+	}
+}
@@ -691,6 +691,8 @@ func (ss *stateSuite) TestMethodEntrance(c *C) {
 		func() { st.Warnf("hello") },
 		func() { st.OkayWarnings(time.Time{}) },
 		func() { st.UnshowAllWarnings() },
+		func() { st.AddNotice(state.ServiceRestartNotice, "foo", nil) },
+		func() { st.AckNotices(time.Time{}) },
 	}
 
 	reads := []func(){
@@ -707,6 +709,7 @@ func (ss *stateSuite) TestMethodEntrance(c *C) {
 		func() { st.AllWarnings() },
 		func() { st.PendingWarnings() },
 		func() { st.WarningsSummary() },
+		func() { st.Notices(nil) },
 	}
 
 	for i, f := range reads {
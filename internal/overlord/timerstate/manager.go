@@ -0,0 +1,224 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package timerstate
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/canonical/pebble/internal/logger"
+	"github.com/canonical/pebble/internal/overlord/state"
+	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/strutil"
+	"github.com/canonical/pebble/internal/timeutil"
+)
+
+// TimerManager runs the commands configured in the plan's timers section on
+// their schedules.
+type TimerManager struct {
+	state *state.State
+	clock clock
+
+	mutex    sync.Mutex
+	timers   map[string]*timerData
+	lastRuns map[string]time.Time // as persisted when the manager started
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+// clock abstracts the passing of time so tests can control when timers fire.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// NewManager creates a new timer manager. The time of each timer's last run
+// is recorded in st, so that missed runs can be caught up after a restart
+// if the timer is configured to do so.
+func NewManager(st *state.State) *TimerManager {
+	m := &TimerManager{
+		state: st,
+		clock: realClock{},
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	// Read these now rather than in PlanChanged, which is called with the
+	// plan lock held (and the state lock must be acquired first).
+	m.lastRuns = m.readLastRuns()
+	return m
+}
+
+// PlanChanged handles updates to the plan (server configuration), stopping
+// the timers that were removed or changed and starting the new ones as
+// required. Timers whose configuration is unchanged are left running, so
+// that a plan update doesn't kill their runs in progress.
+func (m *TimerManager) PlanChanged(p *plan.Plan) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// First stop the timers that were removed or changed.
+	stopped := 0
+	for name, timer := range m.timers {
+		if config, ok := p.Timers[name]; !ok || !reflect.DeepEqual(config, timer.config) {
+			timer.cancel()
+			stopped++
+		}
+	}
+
+	// Then configure and start new timers, keeping the history of ones that
+	// were already running.
+	timers := make(map[string]*timerData, len(p.Timers))
+	started := 0
+	for name, config := range p.Timers {
+		if old, ok := m.timers[name]; ok && reflect.DeepEqual(config, old.config) {
+			timers[name] = old
+			continue
+		}
+		schedule, err := timeutil.ParseSchedule(config.Schedule)
+		if err != nil && config.Schedule != "" {
+			// This has already been checked when parsing the config.
+			logger.Noticef("Internal error: invalid schedule for timer %q: %v", name, err)
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		timer := &timerData{
+			manager:  m,
+			config:   config,
+			schedule: schedule,
+			ctx:      ctx,
+			cancel:   cancel,
+		}
+		last := m.clock.Now()
+		catchUp := false
+		if old, ok := m.timers[name]; ok {
+			// Continue the schedule from the last run (or from when the
+			// timer was first started, if it hasn't run yet).
+			timer.lastRun = old.info().LastRun
+			last = old.started
+			if timer.lastRun != nil {
+				last = timer.lastRun.StartTime
+			}
+		} else if lastRun, ok := m.lastRuns[name]; ok && config.CatchUp {
+			// Run straight away if a run was missed while the daemon was
+			// down; otherwise missed runs are skipped.
+			catchUp = !timer.next(lastRun).After(last)
+		}
+		timer.started = last
+		timers[name] = timer
+		started++
+		go timer.loop(last, catchUp)
+	}
+	m.timers = timers
+
+	logger.Debugf("Configured timer manager (stopped %d, started %d, kept %d)",
+		stopped, started, len(timers)-started)
+}
+
+// Timers returns the list of currently-configured timers and their status,
+// ordered by name. If names is non-empty, the list is filtered to only
+// include the named timers.
+func (m *TimerManager) Timers(names []string) ([]*TimerInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var infos []*TimerInfo
+	for _, timer := range m.timers {
+		if len(names) > 0 && !strutil.ListContains(names, timer.config.Name) {
+			continue
+		}
+		infos = append(infos, timer.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// TimerInfo provides status information about a single timer.
+type TimerInfo struct {
+	Name    string
+	NextRun time.Time
+	Running bool
+	LastRun *RunInfo
+}
+
+// RunInfo provides information about a single run of a timer's command.
+type RunInfo struct {
+	StartTime time.Time
+	Duration  time.Duration
+	ExitCode  int
+	Error     string
+	Output    string
+}
+
+// getJitter returns a random duration between zero and max.
+func (m *TimerManager) getJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	m.randLock.Lock()
+	defer m.randLock.Unlock()
+	return time.Duration(m.rand.Int63n(int64(max)))
+}
+
+// timerState is the persisted state of a single timer.
+type timerState struct {
+	LastRun time.Time `json:"last-run"`
+}
+
+// readLastRuns returns the start times of each timer's last run, as
+// recorded in the state.
+func (m *TimerManager) readLastRuns() map[string]time.Time {
+	m.state.Lock()
+	defer m.state.Unlock()
+
+	var timers map[string]*timerState
+	err := m.state.Get("timers", &timers)
+	if err != nil && err != state.ErrNoState {
+		logger.Noticef("Cannot read timer state: %v", err)
+	}
+	lastRuns := make(map[string]time.Time, len(timers))
+	for name, timer := range timers {
+		lastRuns[name] = timer.LastRun
+	}
+	return lastRuns
+}
+
+// recordRun records the start time of a timer's run in the state.
+func (m *TimerManager) recordRun(name string, start time.Time) {
+	m.state.Lock()
+	defer m.state.Unlock()
+
+	var timers map[string]*timerState
+	err := m.state.Get("timers", &timers)
+	if err != nil && err != state.ErrNoState {
+		logger.Noticef("Cannot read timer state: %v", err)
+	}
+	if timers == nil {
+		timers = make(map[string]*timerState)
+	}
+	timers[name] = &timerState{LastRun: start}
+	m.state.Set("timers", timers)
+}
@@ -0,0 +1,429 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package timerstate
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/logger"
+	"github.com/canonical/pebble/internal/overlord/state"
+	"github.com/canonical/pebble/internal/plan"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type ManagerSuite struct {
+	st    *state.State
+	clock *fakeClock
+	mgr   *TimerManager
+}
+
+var _ = Suite(&ManagerSuite{})
+
+var setLoggerOnce sync.Once
+
+func (s *ManagerSuite) SetUpSuite(c *C) {
+	// This can happen in parallel with tests if -test.count=N with N>1 is specified.
+	setLoggerOnce.Do(func() {
+		logger.SetLogger(logger.New(os.Stderr, "[test] "))
+	})
+}
+
+func (s *ManagerSuite) SetUpTest(c *C) {
+	s.st = state.New(nil)
+	// Schedules are calculated relative to the real time, so start there.
+	s.clock = &fakeClock{now: time.Now()}
+	s.mgr = s.newManager()
+}
+
+func (s *ManagerSuite) TearDownTest(c *C) {
+	s.mgr.PlanChanged(&plan.Plan{})
+}
+
+func (s *ManagerSuite) newManager() *TimerManager {
+	mgr := NewManager(s.st)
+	mgr.clock = s.clock
+	return mgr
+}
+
+// fakeClock is a clock whose time only moves when Advance is called.
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	when time.Time
+	ch   chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &fakeWaiter{when: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*fakeWaiter
+	for _, w := range c.waiters {
+		if w.when.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// waitWaiters waits until n callers are waiting on After.
+func (c *fakeClock) waitWaiters(cc *C, n int) {
+	for i := 0; i < 500; i++ {
+		c.mutex.Lock()
+		num := len(c.waiters)
+		c.mutex.Unlock()
+		if num >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cc.Fatalf("timed out waiting for %d clock waiters", n)
+}
+
+func (s *ManagerSuite) timer(c *C, name string) *TimerInfo {
+	timers, err := s.mgr.Timers([]string{name})
+	c.Assert(err, IsNil)
+	c.Assert(timers, HasLen, 1)
+	return timers[0]
+}
+
+// waitLastRun waits until the named timer has completed a run.
+func (s *ManagerSuite) waitLastRun(c *C, name string) *RunInfo {
+	for i := 0; i < 500; i++ {
+		info := s.timer(c, name)
+		if info.LastRun != nil && !info.Running {
+			return info.LastRun
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for timer %q to run", name)
+	return nil
+}
+
+func (s *ManagerSuite) TestEvery(c *C) {
+	start := s.clock.Now()
+	s.mgr.PlanChanged(&plan.Plan{
+		Timers: map[string]*plan.Timer{
+			"t1": {
+				Name:    "t1",
+				Command: "echo hello",
+				Every:   plan.OptionalDuration{Value: 15 * time.Minute, IsSet: true},
+				Timeout: plan.OptionalDuration{Value: time.Minute},
+				Overlap: plan.OverlapSkip,
+			},
+		},
+	})
+	s.clock.waitWaiters(c, 1)
+
+	info := s.timer(c, "t1")
+	c.Assert(info.Name, Equals, "t1")
+	c.Assert(info.NextRun, Equals, start.Add(15*time.Minute))
+	c.Assert(info.Running, Equals, false)
+	c.Assert(info.LastRun, IsNil)
+
+	s.clock.Advance(15 * time.Minute)
+	run := s.waitLastRun(c, "t1")
+	c.Assert(run, DeepEquals, &RunInfo{
+		StartTime: start.Add(15 * time.Minute),
+		ExitCode:  0,
+		Output:    "hello\n",
+	})
+
+	s.clock.waitWaiters(c, 1)
+	info = s.timer(c, "t1")
+	c.Assert(info.NextRun, Equals, start.Add(30*time.Minute))
+
+	// Last run is recorded in the state.
+	s.st.Lock()
+	var timers map[string]*timerState
+	err := s.st.Get("timers", &timers)
+	s.st.Unlock()
+	c.Assert(err, IsNil)
+	c.Assert(timers["t1"].LastRun.Equal(start.Add(15*time.Minute)), Equals, true)
+}
+
+func (s *ManagerSuite) TestSchedule(c *C) {
+	now := s.clock.Now()
+	s.mgr.PlanChanged(&plan.Plan{
+		Timers: map[string]*plan.Timer{
+			"t1": {
+				Name:     "t1",
+				Command:  "echo hello",
+				Schedule: "10:00",
+				Timeout:  plan.OptionalDuration{Value: time.Minute},
+			},
+		},
+	})
+	s.clock.waitWaiters(c, 1)
+
+	expected := time.Date(now.Year(), now.Month(), now.Day(), 10, 0, 0, 0, time.Local)
+	if !expected.After(now) {
+		expected = expected.AddDate(0, 0, 1)
+	}
+	info := s.timer(c, "t1")
+	c.Assert(info.NextRun.Equal(expected), Equals, true, Commentf("%s != %s", info.NextRun, expected))
+}
+
+func (s *ManagerSuite) TestJitter(c *C) {
+	start := s.clock.Now()
+	s.mgr.PlanChanged(&plan.Plan{
+		Timers: map[string]*plan.Timer{
+			"t1": {
+				Name:    "t1",
+				Command: "echo hello",
+				Every:   plan.OptionalDuration{Value: time.Hour, IsSet: true},
+				Jitter:  plan.OptionalDuration{Value: 5 * time.Minute, IsSet: true},
+				Timeout: plan.OptionalDuration{Value: time.Minute},
+			},
+		},
+	})
+	s.clock.waitWaiters(c, 1)
+
+	info := s.timer(c, "t1")
+	c.Assert(info.NextRun.Before(start.Add(time.Hour)), Equals, false)
+	c.Assert(info.NextRun.Before(start.Add(time.Hour+5*time.Minute)), Equals, true)
+}
+
+func (s *ManagerSuite) TestFailure(c *C) {
+	s.mgr.PlanChanged(&plan.Plan{
+		Timers: map[string]*plan.Timer{
+			"t1": {
+				Name:    "t1",
+				Command: "/bin/sh -c 'echo oops; exit 3'",
+				Every:   plan.OptionalDuration{Value: time.Minute, IsSet: true},
+				Timeout: plan.OptionalDuration{Value: time.Minute},
+			},
+		},
+	})
+	s.clock.waitWaiters(c, 1)
+	s.clock.Advance(time.Minute)
+
+	run := s.waitLastRun(c, "t1")
+	c.Assert(run.ExitCode, Equals, 3)
+	c.Assert(run.Error, Equals, "exit status 3")
+	c.Assert(run.Output, Equals, "oops\n")
+}
+
+func (s *ManagerSuite) TestTimeout(c *C) {
+	s.mgr.PlanChanged(&plan.Plan{
+		Timers: map[string]*plan.Timer{
+			"t1": {
+				Name:    "t1",
+				Command: "sleep 10",
+				Every:   plan.OptionalDuration{Value: time.Hour, IsSet: true},
+				Timeout: plan.OptionalDuration{Value: time.Minute},
+			},
+		},
+	})
+	s.clock.waitWaiters(c, 1)
+	s.clock.Advance(time.Hour)
+
+	// Wait till the loop and the run's timeout are both waiting.
+	s.clock.waitWaiters(c, 2)
+	c.Assert(s.timer(c, "t1").Running, Equals, true)
+	s.clock.Advance(time.Minute)
+
+	run := s.waitLastRun(c, "t1")
+	c.Assert(run.ExitCode, Equals, -1)
+	c.Assert(run.Error, Equals, "timed out after 1m0s")
+	c.Assert(run.Duration, Equals, time.Minute)
+}
+
+func (s *ManagerSuite) TestOverlapSkip(c *C) {
+	s.mgr.PlanChanged(&plan.Plan{
+		Timers: map[string]*plan.Timer{
+			"t1": {
+				Name:    "t1",
+				Command: "sleep 10",
+				Every:   plan.OptionalDuration{Value: time.Minute, IsSet: true},
+				Timeout: plan.OptionalDuration{Value: time.Hour},
+				Overlap: plan.OverlapSkip,
+			},
+		},
+	})
+	s.clock.waitWaiters(c, 1)
+	s.clock.Advance(time.Minute)
+	s.clock.waitWaiters(c, 2)
+
+	// Second run is due while the first is still active, so it's skipped
+	// (only the loop and the first run's timeout are waiting).
+	s.clock.Advance(time.Minute)
+	s.clock.waitWaiters(c, 2)
+	time.Sleep(20 * time.Millisecond)
+	s.clock.mutex.Lock()
+	c.Assert(s.clock.waiters, HasLen, 2)
+	s.clock.mutex.Unlock()
+
+	// Timing out the first run allows the next one to start.
+	s.clock.Advance(time.Hour)
+	run := s.waitLastRun(c, "t1")
+	c.Assert(run.Error, Equals, "timed out after 1h0m0s")
+}
+
+func (s *ManagerSuite) TestOverlapAllow(c *C) {
+	s.mgr.PlanChanged(&plan.Plan{
+		Timers: map[string]*plan.Timer{
+			"t1": {
+				Name:    "t1",
+				Command: "sleep 10",
+				Every:   plan.OptionalDuration{Value: time.Minute, IsSet: true},
+				Timeout: plan.OptionalDuration{Value: time.Hour},
+				Overlap: plan.OverlapAllow,
+			},
+		},
+	})
+	s.clock.waitWaiters(c, 1)
+	s.clock.Advance(time.Minute)
+	s.clock.waitWaiters(c, 2)
+
+	// Second run starts alongside the first (so there are two timeouts).
+	s.clock.Advance(time.Minute)
+	s.clock.waitWaiters(c, 3)
+}
+
+func (s *ManagerSuite) TestCatchUp(c *C) {
+	now := s.clock.Now()
+	s.st.Lock()
+	s.st.Set("timers", map[string]*timerState{
+		"missed":     {LastRun: now.Add(-2 * time.Hour)},
+		"not-missed": {LastRun: now.Add(-30 * time.Minute)},
+		"no-catchup": {LastRun: now.Add(-2 * time.Hour)},
+	})
+	s.st.Unlock()
+	s.mgr = s.newManager()
+
+	timer := func(name string, catchUp bool) *plan.Timer {
+		return &plan.Timer{
+			Name:    name,
+			Command: "echo " + name,
+			Every:   plan.OptionalDuration{Value: time.Hour, IsSet: true},
+			Timeout: plan.OptionalDuration{Value: time.Minute},
+			CatchUp: catchUp,
+		}
+	}
+	s.mgr.PlanChanged(&plan.Plan{
+		Timers: map[string]*plan.Timer{
+			"missed":     timer("missed", true),
+			"not-missed": timer("not-missed", true),
+			"no-catchup": timer("no-catchup", false),
+		},
+	})
+
+	run := s.waitLastRun(c, "missed")
+	c.Assert(run.StartTime, Equals, now)
+	c.Assert(run.Output, Equals, "missed\n")
+
+	s.clock.waitWaiters(c, 3)
+	c.Assert(s.timer(c, "not-missed").LastRun, IsNil)
+	c.Assert(s.timer(c, "not-missed").NextRun, Equals, now.Add(time.Hour))
+	c.Assert(s.timer(c, "no-catchup").LastRun, IsNil)
+	c.Assert(s.timer(c, "no-catchup").NextRun, Equals, now.Add(time.Hour))
+}
+
+func (s *ManagerSuite) TestPlanChangedKeepsHistory(c *C) {
+	start := s.clock.Now()
+	config := &plan.Timer{
+		Name:    "t1",
+		Command: "echo hello",
+		Every:   plan.OptionalDuration{Value: 15 * time.Minute, IsSet: true},
+		Timeout: plan.OptionalDuration{Value: time.Minute},
+	}
+	s.mgr.PlanChanged(&plan.Plan{Timers: map[string]*plan.Timer{"t1": config}})
+	s.clock.waitWaiters(c, 1)
+	s.clock.Advance(15 * time.Minute)
+	s.waitLastRun(c, "t1")
+	s.clock.waitWaiters(c, 1)
+
+	// Schedule of a changed timer continues from the last run, rather than
+	// from the change.
+	s.clock.Advance(5 * time.Minute)
+	changed := *config
+	changed.Command = "echo changed"
+	s.mgr.PlanChanged(&plan.Plan{Timers: map[string]*plan.Timer{"t1": &changed}})
+	s.clock.waitWaiters(c, 2) // includes the old loop's waiter
+	info := s.timer(c, "t1")
+	c.Assert(info.LastRun, NotNil)
+	c.Assert(info.NextRun, Equals, start.Add(30*time.Minute))
+
+	s.mgr.PlanChanged(&plan.Plan{})
+	timers, err := s.mgr.Timers(nil)
+	c.Assert(err, IsNil)
+	c.Assert(timers, HasLen, 0)
+}
+
+func (s *ManagerSuite) TestPlanChangedKeepsUnchangedTimers(c *C) {
+	config := &plan.Timer{
+		Name:    "t1",
+		Command: "sleep 10",
+		Every:   plan.OptionalDuration{Value: time.Hour, IsSet: true},
+		Timeout: plan.OptionalDuration{Value: time.Minute},
+	}
+	s.mgr.PlanChanged(&plan.Plan{Timers: map[string]*plan.Timer{"t1": config}})
+	s.clock.waitWaiters(c, 1)
+	s.clock.Advance(time.Hour)
+	s.clock.waitWaiters(c, 2)
+	c.Assert(s.timer(c, "t1").Running, Equals, true)
+
+	// An equal config (even if a different value) and an unrelated new
+	// timer leave the running job alone.
+	same := *config
+	s.mgr.PlanChanged(&plan.Plan{Timers: map[string]*plan.Timer{
+		"t1": &same,
+		"t2": {
+			Name:    "t2",
+			Command: "echo hello",
+			Every:   plan.OptionalDuration{Value: time.Hour, IsSet: true},
+		},
+	}})
+	s.clock.waitWaiters(c, 3)
+	c.Assert(s.timer(c, "t1").Running, Equals, true)
+
+	s.clock.Advance(time.Minute)
+	run := s.waitLastRun(c, "t1")
+	c.Assert(run.ExitCode, Equals, -1)
+	c.Assert(run.Error, Equals, "timed out after 1m0s")
+}
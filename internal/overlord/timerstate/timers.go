@@ -0,0 +1,204 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package timerstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/canonical/pebble/internal/logger"
+	"github.com/canonical/pebble/internal/plan"
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/strutil/shlex"
+	"github.com/canonical/pebble/internal/timeutil"
+)
+
+const (
+	// maxOutputBytes is the maximum amount of output kept for each run. It
+	// must be larger than the chunks os/exec copies output in.
+	maxOutputBytes = 64 * 1024
+)
+
+// timerData holds state for an active timer.
+type timerData struct {
+	manager  *TimerManager
+	config   *plan.Timer
+	schedule []*timeutil.Schedule
+	ctx      context.Context
+	cancel   context.CancelFunc
+	started  time.Time
+
+	mutex   sync.Mutex
+	nextRun time.Time
+	running int
+	lastRun *RunInfo
+}
+
+// next returns the time of the first run due after last.
+func (t *timerData) next(last time.Time) time.Time {
+	var next time.Time
+	if t.config.Every.IsSet {
+		next = last.Add(t.config.Every.Value)
+	} else {
+		for _, sched := range t.schedule {
+			window := sched.Next(last)
+			start := window.Start
+			if window.Spread {
+				start = start.Add(t.manager.getJitter(window.End.Sub(window.Start)))
+			}
+			if next.IsZero() || start.Before(next) {
+				next = start
+			}
+		}
+	}
+	return next.Add(t.manager.getJitter(t.config.Jitter.Value))
+}
+
+func (t *timerData) loop(last time.Time, catchUp bool) {
+	logger.Debugf("Timer %q starting", t.config.Name)
+
+	if catchUp {
+		logger.Noticef("Timer %q missed a run, running now", t.config.Name)
+		t.trigger()
+		last = t.manager.clock.Now()
+	}
+	for {
+		next := t.next(last)
+		t.mutex.Lock()
+		t.nextRun = next
+		t.mutex.Unlock()
+
+		select {
+		case <-t.manager.clock.After(next.Sub(t.manager.clock.Now())):
+			// Missed runs (for example, if the system was suspended) are
+			// skipped rather than run in quick succession.
+			last = t.manager.clock.Now()
+			t.trigger()
+		case <-t.ctx.Done():
+			logger.Debugf("Timer %q stopped: %v", t.config.Name, t.ctx.Err())
+			return
+		}
+	}
+}
+
+// trigger starts a run of the timer's command, unless the previous run is
+// still active and the overlap policy is to skip.
+func (t *timerData) trigger() {
+	t.mutex.Lock()
+	if t.running > 0 && t.config.Overlap != plan.OverlapAllow {
+		t.mutex.Unlock()
+		logger.Noticef("Timer %q previous run still active, skipping", t.config.Name)
+		return
+	}
+	t.running++
+	t.mutex.Unlock()
+
+	go t.run()
+}
+
+// run runs the timer's command and records the result.
+func (t *timerData) run() {
+	clock := t.manager.clock
+	start := clock.Now()
+	t.manager.recordRun(t.config.Name, start)
+
+	output := servicelog.NewRingBuffer(maxOutputBytes)
+	exitCode, err := t.runCommand(output)
+	info := &RunInfo{
+		StartTime: start,
+		Duration:  clock.Now().Sub(start),
+		ExitCode:  exitCode,
+	}
+	if err != nil {
+		info.Error = err.Error()
+		logger.Noticef("Timer %q run failed: %v", t.config.Name, err)
+	}
+	it := output.TailIterator()
+	outputBytes, _ := ioutil.ReadAll(it)
+	it.Close()
+	info.Output = string(outputBytes)
+
+	t.mutex.Lock()
+	t.running--
+	t.lastRun = info
+	t.mutex.Unlock()
+}
+
+// runCommand runs the timer's command with the configured timeout, writing
+// its output to the given buffer.
+func (t *timerData) runCommand(output *servicelog.RingBuffer) (exitCode int, err error) {
+	args, err := shlex.Split(t.config.Command)
+	if err != nil {
+		return -1, fmt.Errorf("cannot parse command: %w", err)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = os.Environ()
+	for k, v := range t.config.Environment {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = cmd.Start()
+	if err != nil {
+		return -1, fmt.Errorf("cannot start command: %w", err)
+	}
+	logger.Debugf("Timer %q running command: %s", t.config.Name, t.config.Command)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-t.manager.clock.After(t.config.Timeout.Value):
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return -1, fmt.Errorf("timed out after %s", t.config.Timeout.Value)
+	case <-t.ctx.Done():
+		// Timer was stopped (plan changed), don't leave the command running.
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return -1, fmt.Errorf("timer stopped")
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), fmt.Errorf("exit status %d", exitErr.ExitCode())
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// info returns user-facing timer information for use in Timers (and tests).
+func (t *timerData) info() *TimerInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return &TimerInfo{
+		Name:    t.config.Name,
+		NextRun: t.nextRun,
+		Running: t.running > 0,
+		LastRun: t.lastRun,
+	}
+}
@@ -16,20 +16,26 @@ package plan
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v3"
 
 	"github.com/canonical/pebble/internal/osutil"
+	"github.com/canonical/pebble/internal/strutil"
 	"github.com/canonical/pebble/internal/strutil/shlex"
+	"github.com/canonical/pebble/internal/timeutil"
 )
 
 const (
@@ -37,15 +43,21 @@ const (
 	defaultBackoffFactor = 2.0
 	defaultBackoffLimit  = 30 * time.Second
 
+	maxFailureLogLines = 1000
+	maxLogCoalesce     = time.Second
+
 	defaultCheckPeriod    = 10 * time.Second
 	defaultCheckTimeout   = 3 * time.Second
 	defaultCheckThreshold = 3
+
+	defaultTimerTimeout = 10 * time.Minute
 )
 
 type Plan struct {
 	Layers   []*Layer            `yaml:"-"`
 	Services map[string]*Service `yaml:"services,omitempty"`
 	Checks   map[string]*Check   `yaml:"checks,omitempty"`
+	Timers   map[string]*Timer   `yaml:"timers,omitempty"`
 }
 
 type Layer struct {
@@ -55,6 +67,7 @@ type Layer struct {
 	Description string              `yaml:"description,omitempty"`
 	Services    map[string]*Service `yaml:"services,omitempty"`
 	Checks      map[string]*Check   `yaml:"checks,omitempty"`
+	Timers      map[string]*Timer   `yaml:"timers,omitempty"`
 }
 
 type Service struct {
@@ -66,17 +79,27 @@ type Service struct {
 	Override    Override       `yaml:"override,omitempty"`
 	Command     string         `yaml:"command,omitempty"`
 
+	// Named groups of services (for bulk operations), not to be confused
+	// with the Unix group the service runs as
+	Groups []string `yaml:"groups,omitempty"`
+
 	// Service dependencies
 	After    []string `yaml:"after,omitempty"`
 	Before   []string `yaml:"before,omitempty"`
 	Requires []string `yaml:"requires,omitempty"`
 
+	// Commands run before the service starts and after it stops
+	BeforeStart []string         `yaml:"before-start,omitempty"`
+	AfterStop   []string         `yaml:"after-stop,omitempty"`
+	HookTimeout OptionalDuration `yaml:"hook-timeout,omitempty"`
+
 	// Options for command execution
-	Environment map[string]string `yaml:"environment,omitempty"`
-	UserID      *int              `yaml:"user-id,omitempty"`
-	User        string            `yaml:"user,omitempty"`
-	GroupID     *int              `yaml:"group-id,omitempty"`
-	Group       string            `yaml:"group,omitempty"`
+	Environment      map[string]EnvValue `yaml:"environment,omitempty"`
+	EnvironmentFiles []string            `yaml:"environment-files,omitempty"`
+	UserID           *int                `yaml:"user-id,omitempty"`
+	User             string              `yaml:"user,omitempty"`
+	GroupID          *int                `yaml:"group-id,omitempty"`
+	Group            string              `yaml:"group,omitempty"`
 
 	// Auto-restart and backoff functionality
 	OnSuccess      ServiceAction            `yaml:"on-success,omitempty"`
@@ -85,20 +108,71 @@ type Service struct {
 	BackoffDelay   OptionalDuration         `yaml:"backoff-delay,omitempty"`
 	BackoffFactor  OptionalFloat            `yaml:"backoff-factor,omitempty"`
 	BackoffLimit   OptionalDuration         `yaml:"backoff-limit,omitempty"`
+
+	// Number of lines of output to record when the service fails
+	FailureLogLines int `yaml:"failure-log-lines,omitempty"`
+
+	// Apply the on-failure action if the service produces no output for
+	// this long while running
+	WatchdogLogSilence OptionalDuration `yaml:"watchdog-log-silence,omitempty"`
+
+	// Encoding of the service's output, converted to UTF-8 for its logs
+	LogEncoding string `yaml:"log-encoding,omitempty"`
+
+	// Longest time to hold back an incomplete line of the service's
+	// output, joining the small writes it's made of (0 to not join them)
+	LogCoalesce OptionalDuration `yaml:"log-coalesce,omitempty"`
+
+	// Log files written by the service (glob patterns), followed while it
+	// runs and added to its logs
+	LogFiles []string `yaml:"log-files,omitempty"`
+
+	// Size of the in-memory buffer holding the service's recent logs
+	LogBufferSize string `yaml:"log-buffer-size,omitempty"`
+
+	// Destinations the service's output is written to as well as its log
+	// buffer, keyed by name
+	LogTargets map[string]*LogTarget `yaml:"log-targets,omitempty"`
+
+	// Resource limits (applied using cgroup v2 when available)
+	MemoryLimit string `yaml:"memory-limit,omitempty"`
+	CPUQuota    string `yaml:"cpu-quota,omitempty"`
+
+	// Signal sent to reload the service's configuration without restarting
+	// it, and how to tell when the reload has finished
+	ReloadSignal     string           `yaml:"reload-signal,omitempty"`
+	ReloadReadyLog   string           `yaml:"reload-ready-log,omitempty"`
+	ReloadReadyCheck string           `yaml:"reload-ready-check,omitempty"`
+	ReloadTimeout    OptionalDuration `yaml:"reload-timeout,omitempty"`
+
+	// Files rendered from templates before the service starts, keyed by
+	// destination path
+	Render map[string]*RenderFile `yaml:"render,omitempty"`
 }
 
 // Copy returns a deep copy of the service.
 func (s *Service) Copy() *Service {
 	copied := *s
+	copied.Groups = append([]string(nil), s.Groups...)
 	copied.After = append([]string(nil), s.After...)
 	copied.Before = append([]string(nil), s.Before...)
 	copied.Requires = append([]string(nil), s.Requires...)
+	copied.BeforeStart = append([]string(nil), s.BeforeStart...)
+	copied.AfterStop = append([]string(nil), s.AfterStop...)
 	if s.Environment != nil {
-		copied.Environment = make(map[string]string)
+		copied.Environment = make(map[string]EnvValue)
 		for k, v := range s.Environment {
 			copied.Environment[k] = v
 		}
 	}
+	copied.EnvironmentFiles = append([]string(nil), s.EnvironmentFiles...)
+	copied.LogFiles = append([]string(nil), s.LogFiles...)
+	if s.LogTargets != nil {
+		copied.LogTargets = make(map[string]*LogTarget, len(s.LogTargets))
+		for k, v := range s.LogTargets {
+			copied.LogTargets[k] = v.Copy()
+		}
+	}
 	if s.UserID != nil {
 		userID := *s.UserID
 		copied.UserID = &userID
@@ -113,6 +187,12 @@ func (s *Service) Copy() *Service {
 			copied.OnCheckFailure[k] = v
 		}
 	}
+	if s.Render != nil {
+		copied.Render = make(map[string]*RenderFile, len(s.Render))
+		for k, v := range s.Render {
+			copied.Render[k] = v.Copy()
+		}
+	}
 	return &copied
 }
 
@@ -144,18 +224,31 @@ func (s *Service) Merge(other *Service) {
 	if other.Group != "" {
 		s.Group = other.Group
 	}
+	s.Groups = append(s.Groups, other.Groups...)
 	s.After = append(s.After, other.After...)
 	s.Before = append(s.Before, other.Before...)
 	s.Requires = append(s.Requires, other.Requires...)
+	s.BeforeStart = append(s.BeforeStart, other.BeforeStart...)
+	s.AfterStop = append(s.AfterStop, other.AfterStop...)
+	if other.HookTimeout.IsSet {
+		s.HookTimeout = other.HookTimeout
+	}
+	if len(other.Environment) > 0 && s.Environment == nil {
+		s.Environment = make(map[string]EnvValue)
+	}
 	for k, v := range other.Environment {
 		s.Environment[k] = v
 	}
+	s.EnvironmentFiles = append(s.EnvironmentFiles, other.EnvironmentFiles...)
 	if other.OnSuccess != "" {
 		s.OnSuccess = other.OnSuccess
 	}
 	if other.OnFailure != "" {
 		s.OnFailure = other.OnFailure
 	}
+	if len(other.OnCheckFailure) > 0 && s.OnCheckFailure == nil {
+		s.OnCheckFailure = make(map[string]ServiceAction)
+	}
 	for k, v := range other.OnCheckFailure {
 		s.OnCheckFailure[k] = v
 	}
@@ -168,6 +261,109 @@ func (s *Service) Merge(other *Service) {
 	if other.BackoffLimit.IsSet {
 		s.BackoffLimit = other.BackoffLimit
 	}
+	if other.FailureLogLines != 0 {
+		s.FailureLogLines = other.FailureLogLines
+	}
+	if other.WatchdogLogSilence.IsSet {
+		s.WatchdogLogSilence = other.WatchdogLogSilence
+	}
+	if other.LogEncoding != "" {
+		s.LogEncoding = other.LogEncoding
+	}
+	if other.LogCoalesce.IsSet {
+		s.LogCoalesce = other.LogCoalesce
+	}
+	s.LogFiles = append(s.LogFiles, other.LogFiles...)
+	if other.LogBufferSize != "" {
+		s.LogBufferSize = other.LogBufferSize
+	}
+	if len(other.LogTargets) > 0 && s.LogTargets == nil {
+		s.LogTargets = make(map[string]*LogTarget)
+	}
+	for k, v := range other.LogTargets {
+		s.LogTargets[k] = v.Copy()
+	}
+	if other.MemoryLimit != "" {
+		s.MemoryLimit = other.MemoryLimit
+	}
+	if other.CPUQuota != "" {
+		s.CPUQuota = other.CPUQuota
+	}
+	if other.ReloadSignal != "" {
+		s.ReloadSignal = other.ReloadSignal
+	}
+	if other.ReloadReadyLog != "" {
+		s.ReloadReadyLog = other.ReloadReadyLog
+	}
+	if other.ReloadReadyCheck != "" {
+		s.ReloadReadyCheck = other.ReloadReadyCheck
+	}
+	if other.ReloadTimeout.IsSet {
+		s.ReloadTimeout = other.ReloadTimeout
+	}
+	if len(other.Render) > 0 && s.Render == nil {
+		s.Render = make(map[string]*RenderFile)
+	}
+	for k, v := range other.Render {
+		s.Render[k] = v.Copy()
+	}
+}
+
+// MemoryLimitBytes returns the service's memory-limit in bytes, or zero if
+// no limit is set.
+func (s *Service) MemoryLimitBytes() (int64, error) {
+	if s.MemoryLimit == "" {
+		return 0, nil
+	}
+	limit, err := strutil.ParseByteSize(s.MemoryLimit)
+	if err != nil {
+		return 0, err
+	}
+	if limit <= 0 {
+		return 0, fmt.Errorf("memory limit must be greater than zero")
+	}
+	return limit, nil
+}
+
+// Limits on the size of a service's log buffer.
+const (
+	minLogBufferSize = 4 * 1000
+	maxLogBufferSize = 64 * 1000 * 1000
+)
+
+var errLogBufferSizeRange = errors.New("must be between 4kB and 64MB")
+
+// LogBufferBytes returns the service's log-buffer-size in bytes, or zero if
+// it isn't set.
+func (s *Service) LogBufferBytes() (int, error) {
+	if s.LogBufferSize == "" {
+		return 0, nil
+	}
+	size, err := strutil.ParseByteSize(s.LogBufferSize)
+	if err != nil {
+		return 0, err
+	}
+	if size < minLogBufferSize || size > maxLogBufferSize {
+		return 0, errLogBufferSizeRange
+	}
+	return int(size), nil
+}
+
+// CPUQuotaPercent returns the service's cpu-quota as a percentage of a
+// single CPU (for example, "150%" is one and a half CPUs), or zero if no
+// quota is set.
+func (s *Service) CPUQuotaPercent() (float64, error) {
+	if s.CPUQuota == "" {
+		return 0, nil
+	}
+	if !strings.HasSuffix(s.CPUQuota, "%") {
+		return 0, fmt.Errorf("cpu quota must be a percentage like \"50%%\"")
+	}
+	quota, err := strconv.ParseFloat(strings.TrimSuffix(s.CPUQuota, "%"), 64)
+	if err != nil || quota <= 0 {
+		return 0, fmt.Errorf("cpu quota must be a positive percentage like \"50%%\"")
+	}
+	return quota, nil
 }
 
 // Equal returns true when the two services are equal in value.
@@ -178,6 +374,210 @@ func (s *Service) Equal(other *Service) bool {
 	return reflect.DeepEqual(s, other)
 }
 
+// ReloadSafe reports whether the only differences between the two services
+// are in fields that a running service can pick up by being reloaded (or
+// that don't affect the running process at all), rather than needing a
+// restart. The command, its execution options, hooks, and resource limits
+// aren't reload-safe.
+func (s *Service) ReloadSafe(other *Service) bool {
+	return reflect.DeepEqual(s.withoutReloadSafe(), other.withoutReloadSafe())
+}
+
+// withoutReloadSafe returns a copy of the service with the reload-safe
+// fields cleared.
+func (s *Service) withoutReloadSafe() *Service {
+	copied := s.Copy()
+	copied.Summary = ""
+	copied.Description = ""
+	copied.Startup = StartupUnknown
+	copied.Override = UnknownOverride
+	copied.Groups = nil
+	copied.After = nil
+	copied.Before = nil
+	copied.Requires = nil
+	copied.OnSuccess = ""
+	copied.OnFailure = ""
+	copied.OnCheckFailure = nil
+	copied.BackoffDelay = OptionalDuration{}
+	copied.BackoffFactor = OptionalFloat{}
+	copied.BackoffLimit = OptionalDuration{}
+	copied.FailureLogLines = 0
+	copied.WatchdogLogSilence = OptionalDuration{}
+	copied.LogBufferSize = ""
+	copied.ReloadSignal = ""
+	copied.ReloadReadyLog = ""
+	copied.ReloadReadyCheck = ""
+	copied.ReloadTimeout = OptionalDuration{}
+	copied.Render = nil
+	return copied
+}
+
+// EnvironmentFilePath returns the path of an entry in a service's
+// environment-files list, and whether the file is optional (marked by a "-"
+// prefix, as in systemd's EnvironmentFile).
+func EnvironmentFilePath(entry string) (path string, optional bool) {
+	if strings.HasPrefix(entry, "-") {
+		return entry[1:], true
+	}
+	return entry, false
+}
+
+// RenderFile specifies a file rendered from a Go text/template before the
+// service starts. The template is given inline or read from a source file.
+type RenderFile struct {
+	Template string `yaml:"template,omitempty"`
+	Source   string `yaml:"source,omitempty"`
+	Mode     string `yaml:"mode,omitempty"`
+	UserID   *int   `yaml:"user-id,omitempty"`
+	User     string `yaml:"user,omitempty"`
+	GroupID  *int   `yaml:"group-id,omitempty"`
+	Group    string `yaml:"group,omitempty"`
+}
+
+// Copy returns a deep copy of the render file configuration.
+func (r *RenderFile) Copy() *RenderFile {
+	copied := *r
+	if r.UserID != nil {
+		userID := *r.UserID
+		copied.UserID = &userID
+	}
+	if r.GroupID != nil {
+		groupID := *r.GroupID
+		copied.GroupID = &groupID
+	}
+	return &copied
+}
+
+// FileMode returns the rendered file's permissions, 0644 if mode isn't set.
+func (r *RenderFile) FileMode() (os.FileMode, error) {
+	if r.Mode == "" {
+		return 0644, nil
+	}
+	mode, err := strconv.ParseUint(r.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("mode must be an octal permission like \"0644\"")
+	}
+	return os.FileMode(mode), nil
+}
+
+// LogTarget specifies a destination for a service's output besides its log
+// buffer: a file, rotated when it gets too big, or a syslog receiver. A
+// "buffer" target writes nowhere else, so that a layer can turn off a
+// target of the same name from an earlier layer.
+type LogTarget struct {
+	Type LogTargetType `yaml:"type,omitempty"`
+
+	// File targets
+	Path     string `yaml:"path,omitempty"`
+	MaxSize  string `yaml:"max-size,omitempty"`
+	MaxFiles *int   `yaml:"max-files,omitempty"`
+	Compress bool   `yaml:"compress,omitempty"`
+
+	// Syslog targets
+	Address string `yaml:"address,omitempty"`
+}
+
+type LogTargetType string
+
+const (
+	UnknownLogTarget LogTargetType = ""
+	FileLogTarget    LogTargetType = "file"
+	SyslogLogTarget  LogTargetType = "syslog"
+	BufferLogTarget  LogTargetType = "buffer"
+)
+
+const (
+	defaultLogFileMaxSize  = 10 * 1024 * 1024
+	defaultLogFileMaxFiles = 5
+)
+
+// Copy returns a deep copy of the log target configuration.
+func (t *LogTarget) Copy() *LogTarget {
+	copied := *t
+	if t.MaxFiles != nil {
+		maxFiles := *t.MaxFiles
+		copied.MaxFiles = &maxFiles
+	}
+	return &copied
+}
+
+// FileMaxSize returns the size in bytes a file target is rotated at,
+// 10MB if max-size isn't set.
+func (t *LogTarget) FileMaxSize() (int64, error) {
+	if t.MaxSize == "" {
+		return defaultLogFileMaxSize, nil
+	}
+	size, err := strutil.ParseByteSize(t.MaxSize)
+	if err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("max-size must be greater than zero")
+	}
+	return size, nil
+}
+
+// FileMaxFiles returns the number of rotated files a file target keeps,
+// 5 if max-files isn't set.
+func (t *LogTarget) FileMaxFiles() int {
+	if t.MaxFiles == nil {
+		return defaultLogFileMaxFiles
+	}
+	return *t.MaxFiles
+}
+
+// SyslogAddress returns the network ("udp" or "tcp") and host:port of a
+// syslog target's address, which is of the form "udp://host:port".
+func (t *LogTarget) SyslogAddress() (network, addr string, err error) {
+	i := strings.Index(t.Address, "://")
+	if i < 0 {
+		return "", "", fmt.Errorf(`address must be of the form "udp://host:port" or "tcp://host:port"`)
+	}
+	network, addr = t.Address[:i], t.Address[i+3:]
+	if network != "udp" && network != "tcp" {
+		return "", "", fmt.Errorf(`address network must be "udp" or "tcp", not %q`, network)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("address invalid: %v", err)
+	}
+	return network, addr, nil
+}
+
+// validate checks that the target's type is known and that only the
+// options for its type are set.
+func (t *LogTarget) validate() error {
+	fileOptions := t.Path != "" || t.MaxSize != "" || t.MaxFiles != nil || t.Compress
+	switch t.Type {
+	case FileLogTarget:
+		if !filepath.IsAbs(t.Path) {
+			return fmt.Errorf("path must be an absolute path")
+		}
+		if _, err := t.FileMaxSize(); err != nil {
+			return err
+		}
+		if t.FileMaxFiles() < 0 {
+			return fmt.Errorf("max-files must not be negative")
+		}
+		if t.Address != "" {
+			return fmt.Errorf(`address is only valid for "syslog" targets`)
+		}
+	case SyslogLogTarget:
+		if _, _, err := t.SyslogAddress(); err != nil {
+			return err
+		}
+		if fileOptions {
+			return fmt.Errorf(`path, max-size, max-files and compress are only valid for "file" targets`)
+		}
+	case BufferLogTarget:
+		if fileOptions || t.Address != "" {
+			return fmt.Errorf(`"buffer" targets take no options`)
+		}
+	default:
+		return fmt.Errorf(`type must be "file", "syslog" or "buffer"`)
+	}
+	return nil
+}
+
 type ServiceStartup string
 
 const (
@@ -388,22 +788,143 @@ func (c *ExecCheck) Merge(other *ExecCheck) {
 	}
 }
 
+// Timer specifies configuration for a command run on a schedule.
+type Timer struct {
+	// Basic details
+	Name     string   `yaml:"-"`
+	Override Override `yaml:"override,omitempty"`
+	Command  string   `yaml:"command,omitempty"`
+
+	// When to run the command: either every given interval, or according to
+	// a schedule such as "mon-fri,09:00~10:00" (see timeutil.ParseSchedule)
+	Every    OptionalDuration `yaml:"every,omitempty"`
+	Schedule string           `yaml:"schedule,omitempty"`
+
+	// Run options
+	Jitter      OptionalDuration  `yaml:"jitter,omitempty"`
+	Timeout     OptionalDuration  `yaml:"timeout,omitempty"`
+	Overlap     TimerOverlap      `yaml:"overlap,omitempty"`
+	CatchUp     bool              `yaml:"catch-up,omitempty"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+}
+
+// Copy returns a deep copy of the timer configuration.
+func (t *Timer) Copy() *Timer {
+	copied := *t
+	if t.Environment != nil {
+		copied.Environment = make(map[string]string, len(t.Environment))
+		for k, v := range t.Environment {
+			copied.Environment[k] = v
+		}
+	}
+	return &copied
+}
+
+// Merge merges the fields set in other into t.
+func (t *Timer) Merge(other *Timer) {
+	if other.Command != "" {
+		t.Command = other.Command
+	}
+	if other.Every.IsSet {
+		t.Every = other.Every
+		t.Schedule = ""
+	}
+	if other.Schedule != "" {
+		t.Schedule = other.Schedule
+		t.Every = OptionalDuration{}
+	}
+	if other.Jitter.IsSet {
+		t.Jitter = other.Jitter
+	}
+	if other.Timeout.IsSet {
+		t.Timeout = other.Timeout
+	}
+	if other.Overlap != "" {
+		t.Overlap = other.Overlap
+	}
+	if other.CatchUp {
+		t.CatchUp = true
+	}
+	for k, v := range other.Environment {
+		if t.Environment == nil {
+			t.Environment = make(map[string]string)
+		}
+		t.Environment[k] = v
+	}
+}
+
+// TimerOverlap specifies what happens when a timer is due while its previous
+// run is still active.
+type TimerOverlap string
+
+const (
+	OverlapUnset TimerOverlap = ""
+	OverlapSkip  TimerOverlap = "skip"
+	OverlapAllow TimerOverlap = "allow"
+)
+
 // FormatError is the error returned when a layer has a format error, such as
 // a missing "override" field.
 type FormatError struct {
 	Message string
+
+	// Problems lists each problem found, for the validation sites that
+	// report all their problems rather than stopping at the first one
+	// (currently the service logging options). If set, Message describes
+	// them all.
+	Problems []FormatProblem
 }
 
 func (e *FormatError) Error() string {
 	return e.Message
 }
 
+// FormatProblem is a single problem found in a layer.
+type FormatProblem struct {
+	// Field is the path of the field with the problem, for example
+	// "services.srv1.reload-ready-log".
+	Field string
+	// Code identifies the kind of problem, for example "bad-regex".
+	Code string
+	// Message describes the problem.
+	Message string
+}
+
+// Codes used in FormatProblem.
+const (
+	ProblemOutOfRange   = "out-of-range"
+	ProblemBadRegex     = "bad-regex"
+	ProblemInvalidValue = "invalid-value"
+)
+
+// problemsError returns a FormatError describing the given problems, sorted
+// by field, or nil if there are none.
+func problemsError(problems []FormatProblem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Field < problems[j].Field
+	})
+	if len(problems) == 1 {
+		return &FormatError{Message: problems[0].Message, Problems: problems}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "plan has %d problems:", len(problems))
+	for _, problem := range problems {
+		b.WriteString("\n- ")
+		b.WriteString(problem.Message)
+	}
+	return &FormatError{Message: b.String(), Problems: problems}
+}
+
 // CombineLayers combines the given layers into a single layer, with the later
 // layers overriding earlier ones.
 func CombineLayers(layers ...*Layer) (*Layer, error) {
 	combined := &Layer{
 		Services: make(map[string]*Service),
 		Checks:   make(map[string]*Check),
+		Timers:   make(map[string]*Timer),
 	}
 	if len(layers) == 0 {
 		return combined, nil
@@ -462,9 +983,36 @@ func CombineLayers(layers ...*Layer) (*Layer, error) {
 			}
 		}
 
+		for name, timer := range layer.Timers {
+			switch timer.Override {
+			case MergeOverride:
+				if old, ok := combined.Timers[name]; ok {
+					copied := old.Copy()
+					copied.Merge(timer)
+					combined.Timers[name] = copied
+					break
+				}
+				fallthrough
+			case ReplaceOverride:
+				combined.Timers[name] = timer.Copy()
+			case UnknownOverride:
+				return nil, &FormatError{
+					Message: fmt.Sprintf(`layer %q must define "override" for timer %q`,
+						layer.Label, timer.Name),
+				}
+			default:
+				return nil, &FormatError{
+					Message: fmt.Sprintf(`layer %q has invalid "override" value for timer %q`,
+						layer.Label, timer.Name),
+				}
+			}
+		}
+
 	}
 
 	// Ensure fields in combined layers validate correctly (and set defaults).
+	// Problems with the logging options are collected and reported together.
+	var logProblems []FormatProblem
 	for name, service := range combined.Services {
 		if service.Command == "" {
 			return nil, &FormatError{
@@ -477,6 +1025,49 @@ func CombineLayers(layers ...*Layer) (*Layer, error) {
 				Message: fmt.Sprintf("plan service %q command invalid: %v", name, err),
 			}
 		}
+		for _, group := range service.Groups {
+			if group == "" {
+				return nil, &FormatError{
+					Message: fmt.Sprintf("plan service %q has an empty group name", name),
+				}
+			}
+		}
+		for _, hook := range [...]struct {
+			field    string
+			commands []string
+		}{{"before-start", service.BeforeStart}, {"after-stop", service.AfterStop}} {
+			for _, command := range hook.commands {
+				args, err := shlex.Split(command)
+				if err == nil && len(args) == 0 {
+					err = fmt.Errorf("empty command")
+				}
+				if err != nil {
+					return nil, &FormatError{
+						Message: fmt.Sprintf("plan service %q %s command invalid: %v", name, hook.field, err),
+					}
+				}
+			}
+		}
+		if service.HookTimeout.IsSet && service.HookTimeout.Value <= 0 {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan service %q hook-timeout must be greater than zero", name),
+			}
+		}
+		for _, path := range service.EnvironmentFiles {
+			path, _ = EnvironmentFilePath(path)
+			if !filepath.IsAbs(path) {
+				return nil, &FormatError{
+					Message: fmt.Sprintf("plan service %q environment file %q must be an absolute path", name, path),
+				}
+			}
+		}
+		for key, value := range service.Environment {
+			if value.File != "" && !filepath.IsAbs(value.File) {
+				return nil, &FormatError{
+					Message: fmt.Sprintf("plan service %q environment variable %q file must be an absolute path", name, key),
+				}
+			}
+		}
 		if !validServiceAction(service.OnSuccess) {
 			return nil, &FormatError{
 				Message: fmt.Sprintf("plan service %q on-success action %q invalid", name, service.OnSuccess),
@@ -507,8 +1098,129 @@ func CombineLayers(layers ...*Layer) (*Layer, error) {
 		if !service.BackoffLimit.IsSet {
 			service.BackoffLimit.Value = defaultBackoffLimit
 		}
+		if service.FailureLogLines < 0 || service.FailureLogLines > maxFailureLogLines {
+			logProblems = append(logProblems, FormatProblem{
+				Field: "services." + name + ".failure-log-lines",
+				Code:  ProblemOutOfRange,
+				Message: fmt.Sprintf("plan service %q failure-log-lines must be between 0 and %d, not %d",
+					name, maxFailureLogLines, service.FailureLogLines),
+			})
+		}
+		if service.WatchdogLogSilence.IsSet && service.WatchdogLogSilence.Value <= 0 {
+			logProblems = append(logProblems, FormatProblem{
+				Field:   "services." + name + ".watchdog-log-silence",
+				Code:    ProblemOutOfRange,
+				Message: fmt.Sprintf("plan service %q watchdog-log-silence must be greater than zero", name),
+			})
+		}
+		if service.LogCoalesce.Value < 0 || service.LogCoalesce.Value > maxLogCoalesce {
+			logProblems = append(logProblems, FormatProblem{
+				Field: "services." + name + ".log-coalesce",
+				Code:  ProblemOutOfRange,
+				Message: fmt.Sprintf("plan service %q log-coalesce must be between 0 and %s, not %s",
+					name, maxLogCoalesce, service.LogCoalesce.Value),
+			})
+		}
+		switch service.LogEncoding {
+		case "", "auto", "utf-8", "utf-16le", "utf-16be":
+		default:
+			logProblems = append(logProblems, FormatProblem{
+				Field: "services." + name + ".log-encoding",
+				Code:  ProblemInvalidValue,
+				Message: fmt.Sprintf(`plan service %q log-encoding must be "auto", "utf-8", "utf-16le" or "utf-16be", not %q`,
+					name, service.LogEncoding),
+			})
+		}
+		for _, pattern := range service.LogFiles {
+			if _, err := filepath.Match(pattern, ""); err != nil || !filepath.IsAbs(pattern) {
+				logProblems = append(logProblems, FormatProblem{
+					Field:   "services." + name + ".log-files",
+					Code:    ProblemInvalidValue,
+					Message: fmt.Sprintf("plan service %q log file %q must be an absolute path or glob pattern", name, pattern),
+				})
+			}
+		}
+		if _, err := service.LogBufferBytes(); err != nil {
+			code := ProblemInvalidValue
+			if err == errLogBufferSizeRange {
+				code = ProblemOutOfRange
+			}
+			logProblems = append(logProblems, FormatProblem{
+				Field:   "services." + name + ".log-buffer-size",
+				Code:    code,
+				Message: fmt.Sprintf("plan service %q log-buffer-size %v", name, err),
+			})
+		}
+		for targetName, target := range service.LogTargets {
+			if err := target.validate(); err != nil {
+				logProblems = append(logProblems, FormatProblem{
+					Field:   "services." + name + ".log-targets." + targetName,
+					Code:    ProblemInvalidValue,
+					Message: fmt.Sprintf("plan service %q log target %q %v", name, targetName, err),
+				})
+			}
+		}
+		if _, err := service.MemoryLimitBytes(); err != nil {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan service %q memory-limit invalid: %v", name, err),
+			}
+		}
+		if _, err := service.CPUQuotaPercent(); err != nil {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan service %q cpu-quota invalid: %v", name, err),
+			}
+		}
+		if service.ReloadSignal != "" && unix.SignalNum(service.ReloadSignal) == 0 {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan service %q reload-signal %q invalid", name, service.ReloadSignal),
+			}
+		}
+		if service.ReloadReadyLog != "" {
+			if _, err := regexp.Compile(service.ReloadReadyLog); err != nil {
+				logProblems = append(logProblems, FormatProblem{
+					Field:   "services." + name + ".reload-ready-log",
+					Code:    ProblemBadRegex,
+					Message: fmt.Sprintf("plan service %q reload-ready-log invalid: %v", name, err),
+				})
+			}
+		}
+		if (service.ReloadReadyLog != "" || service.ReloadReadyCheck != "" || service.ReloadTimeout.IsSet) && service.ReloadSignal == "" {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan service %q must set reload-signal to use reload options", name),
+			}
+		}
+		if service.ReloadTimeout.IsSet && service.ReloadTimeout.Value <= 0 {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan service %q reload-timeout must be greater than zero", name),
+			}
+		}
+		for dest, render := range service.Render {
+			if !filepath.IsAbs(dest) {
+				return nil, &FormatError{
+					Message: fmt.Sprintf("plan service %q render destination %q must be an absolute path", name, dest),
+				}
+			}
+			if render == nil || (render.Template == "") == (render.Source == "") {
+				return nil, &FormatError{
+					Message: fmt.Sprintf(`plan service %q render %q must set one of "template" or "source"`, name, dest),
+				}
+			}
+			if render.Source != "" && !filepath.IsAbs(render.Source) {
+				return nil, &FormatError{
+					Message: fmt.Sprintf("plan service %q render %q source must be an absolute path", name, dest),
+				}
+			}
+			if _, err := render.FileMode(); err != nil {
+				return nil, &FormatError{
+					Message: fmt.Sprintf("plan service %q render %q %v", name, dest, err),
+				}
+			}
+		}
 
 	}
+	if err := problemsError(logProblems); err != nil {
+		return nil, err
+	}
 
 	for name, check := range combined.Checks {
 		if check.Level != UnsetLevel && check.Level != AliveLevel && check.Level != ReadyLevel {
@@ -585,6 +1297,59 @@ func CombineLayers(layers ...*Layer) (*Layer, error) {
 		}
 	}
 
+	for name, timer := range combined.Timers {
+		if timer.Command == "" {
+			return nil, &FormatError{
+				Message: fmt.Sprintf(`plan must define "command" for timer %q`, name),
+			}
+		}
+		_, err := shlex.Split(timer.Command)
+		if err != nil {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan timer %q command invalid: %v", name, err),
+			}
+		}
+		if timer.Every.IsSet == (timer.Schedule != "") {
+			return nil, &FormatError{
+				Message: fmt.Sprintf(`plan must specify one of "every" or "schedule" for timer %q`, name),
+			}
+		}
+		if timer.Every.IsSet && timer.Every.Value <= 0 {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan timer %q every must be greater than zero", name),
+			}
+		}
+		if timer.Schedule != "" {
+			_, err := timeutil.ParseSchedule(timer.Schedule)
+			if err != nil {
+				return nil, &FormatError{
+					Message: fmt.Sprintf("plan timer %q schedule invalid: %v", name, err),
+				}
+			}
+		}
+		if timer.Jitter.Value < 0 {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan timer %q jitter must not be negative", name),
+			}
+		}
+		if !timer.Timeout.IsSet {
+			timer.Timeout.Value = defaultTimerTimeout
+		} else if timer.Timeout.Value <= 0 {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("plan timer %q timeout must be greater than zero", name),
+			}
+		}
+		switch timer.Overlap {
+		case OverlapUnset:
+			timer.Overlap = OverlapSkip
+		case OverlapSkip, OverlapAllow:
+		default:
+			return nil, &FormatError{
+				Message: fmt.Sprintf(`plan timer %q overlap must be "skip" or "allow"`, name),
+			}
+		}
+	}
+
 	// Ensure combined layers don't have cycles.
 	err := combined.checkCycles()
 	if err != nil {
@@ -610,6 +1375,45 @@ func (p *Plan) StopOrder(names []string) ([]string, error) {
 	return order(p.Services, names, true)
 }
 
+// GroupServices returns the names of the services in any of the named
+// groups, sorted by name. An error is returned if a group has no services.
+func (p *Plan) GroupServices(groups []string) ([]string, error) {
+	members := make(map[string][]string)
+	for name, service := range p.Services {
+		for _, group := range service.Groups {
+			members[group] = append(members[group], name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, group := range groups {
+		if _, ok := members[group]; !ok {
+			return nil, unknownGroupError(group, members)
+		}
+		for _, name := range members[group] {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func unknownGroupError(group string, members map[string][]string) error {
+	if len(members) == 0 {
+		return fmt.Errorf("group %q does not exist (no groups defined)", group)
+	}
+	known := make([]string, 0, len(members))
+	for name := range members {
+		known = append(known, name)
+	}
+	sort.Strings(known)
+	return fmt.Errorf("group %q does not exist (known groups: %s)", group, strings.Join(known, ", "))
+}
+
 func order(services map[string]*Service, names []string, stop bool) ([]string, error) {
 	// For stop, create a list of reversed dependencies.
 	predecessors := map[string][]string(nil)
@@ -697,6 +1501,7 @@ func ParseLayer(order int, label string, data []byte) (*Layer, error) {
 	layer := Layer{
 		Services: map[string]*Service{},
 		Checks:   map[string]*Check{},
+		Timers:   map[string]*Timer{},
 	}
 	dec := yaml.NewDecoder(bytes.NewBuffer(data))
 	dec.KnownFields(true)
@@ -727,6 +1532,13 @@ func ParseLayer(order int, label string, data []byte) (*Layer, error) {
 				Message: fmt.Sprintf("service object cannot be null for service %q", name),
 			}
 		}
+		for targetName, target := range service.LogTargets {
+			if target == nil {
+				return nil, &FormatError{
+					Message: fmt.Sprintf("log target object cannot be null for log target %q of service %q", targetName, name),
+				}
+			}
+		}
 		service.Name = name
 	}
 
@@ -744,6 +1556,20 @@ func ParseLayer(order int, label string, data []byte) (*Layer, error) {
 		check.Name = name
 	}
 
+	for name, timer := range layer.Timers {
+		if name == "" {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("cannot use empty string as timer name"),
+			}
+		}
+		if timer == nil {
+			return nil, &FormatError{
+				Message: fmt.Sprintf("timer object cannot be null for timer %q", name),
+			}
+		}
+		timer.Name = name
+	}
+
 	err = layer.checkCycles()
 	if err != nil {
 		return nil, err
@@ -846,6 +1672,7 @@ func ReadDir(dir string) (*Plan, error) {
 		Layers:   layers,
 		Services: combined.Services,
 		Checks:   combined.Checks,
+		Timers:   combined.Timers,
 	}
 	return plan, err
 }
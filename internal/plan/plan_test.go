@@ -38,6 +38,8 @@ const (
 	defaultCheckPeriod    = 10 * time.Second
 	defaultCheckTimeout   = 3 * time.Second
 	defaultCheckThreshold = 3
+
+	defaultTimerTimeout = 10 * time.Minute
 )
 
 // TODOs:
@@ -156,10 +158,10 @@ var planTests = []planTest{{
 				Before:   []string{"srv3"},
 				After:    []string{"srv2"},
 				Requires: []string{"srv2", "srv3"},
-				Environment: map[string]string{
-					"var1": "val1",
-					"var0": "val0",
-					"var2": "val2",
+				Environment: map[string]plan.EnvValue{
+					"var1": {Value: "val1"},
+					"var0": {Value: "val0"},
+					"var2": {Value: "val2"},
 				},
 				BackoffDelay:  plan.OptionalDuration{Value: time.Second, IsSet: true},
 				BackoffFactor: plan.OptionalFloat{Value: 1.5, IsSet: true},
@@ -180,6 +182,7 @@ var planTests = []planTest{{
 			},
 		},
 		Checks: map[string]*plan.Check{},
+		Timers: map[string]*plan.Timer{},
 	}, {
 		Order:       1,
 		Label:       "layer-1",
@@ -191,8 +194,8 @@ var planTests = []planTest{{
 				Override: "merge",
 				Before:   []string{"srv5"},
 				After:    []string{"srv4"},
-				Environment: map[string]string{
-					"var3": "val3",
+				Environment: map[string]plan.EnvValue{
+					"var3": {Value: "val3"},
 				},
 			},
 			"srv2": {
@@ -215,6 +218,7 @@ var planTests = []planTest{{
 			},
 		},
 		Checks: map[string]*plan.Check{},
+		Timers: map[string]*plan.Timer{},
 	}},
 	result: &plan.Layer{
 		Summary:     "Simple override layer.",
@@ -229,11 +233,11 @@ var planTests = []planTest{{
 				After:    []string{"srv2", "srv4"},
 				Before:   []string{"srv3", "srv5"},
 				Requires: []string{"srv2", "srv3"},
-				Environment: map[string]string{
-					"var1": "val1",
-					"var0": "val0",
-					"var2": "val2",
-					"var3": "val3",
+				Environment: map[string]plan.EnvValue{
+					"var1": {Value: "val1"},
+					"var0": {Value: "val0"},
+					"var2": {Value: "val2"},
+					"var3": {Value: "val3"},
 				},
 				BackoffDelay:  plan.OptionalDuration{Value: time.Second, IsSet: true},
 				BackoffFactor: plan.OptionalFloat{Value: 1.5, IsSet: true},
@@ -276,6 +280,7 @@ var planTests = []planTest{{
 			},
 		},
 		Checks: map[string]*plan.Check{},
+		Timers: map[string]*plan.Timer{},
 	},
 	start: map[string][]string{
 		"srv1": {"srv2", "srv1", "srv3"},
@@ -288,129 +293,840 @@ var planTests = []planTest{{
 		"srv3": {"srv3", "srv1"},
 	},
 }, {
-	summary: "Order loop on before/after",
-	error:   "services in before/after loop: srv1, srv2, srv3",
+	summary: "Order loop on before/after",
+	error:   "services in before/after loop: srv1, srv2, srv3",
+	input: []string{`
+		summary: Order loop
+		services:
+			srv1:
+				override: replace
+				command: cmd
+				after:
+					- srv3
+			srv2:
+				override: replace
+				command: cmd
+				after:
+					- srv1
+				before:
+					- srv3
+			srv3:
+				override: replace
+				command: cmd
+	`},
+}, {
+	summary: "Handling of nulls and typed values in environment",
+	input: []string{`
+		services:
+			srv1:
+				override: replace
+				command: cmd
+				environment:
+					a: true
+					b: 1.1
+					c:
+	`},
+	layers: []*plan.Layer{{
+		Order: 0,
+		Label: "layer-0",
+		Services: map[string]*plan.Service{
+			"srv1": {
+				Name:     "srv1",
+				Override: "replace",
+				Command:  "cmd",
+				Environment: map[string]plan.EnvValue{
+					"a": {Value: "true"},
+					"b": {Value: "1.1"},
+					"c": {Value: ""},
+				},
+			},
+		},
+		Checks: map[string]*plan.Check{},
+		Timers: map[string]*plan.Timer{},
+	}},
+}, {
+	summary: "Hooks are appended when merging",
+	input: []string{`
+		services:
+			srv1:
+				override: replace
+				command: cmd
+				before-start:
+					- mkdir -p /run/srv1
+				after-stop:
+					- rm -rf /run/srv1
+	`, `
+		services:
+			srv1:
+				override: merge
+				before-start:
+					- touch /run/srv1/ready
+				hook-timeout: 5s
+	`},
+	result: &plan.Layer{
+		Services: map[string]*plan.Service{
+			"srv1": {
+				Name:          "srv1",
+				Override:      "replace",
+				Command:       "cmd",
+				BeforeStart:   []string{"mkdir -p /run/srv1", "touch /run/srv1/ready"},
+				AfterStop:     []string{"rm -rf /run/srv1"},
+				HookTimeout:   plan.OptionalDuration{Value: 5 * time.Second, IsSet: true},
+				BackoffDelay:  plan.OptionalDuration{Value: defaultBackoffDelay},
+				BackoffFactor: plan.OptionalFloat{Value: defaultBackoffFactor},
+				BackoffLimit:  plan.OptionalDuration{Value: defaultBackoffLimit},
+			},
+		},
+		Checks: map[string]*plan.Check{},
+		Timers: map[string]*plan.Timer{},
+	},
+}, {
+	summary: "Groups are appended when merging",
+	input: []string{`
+		services:
+			srv1:
+				override: replace
+				command: cmd
+				groups:
+					- web
+	`, `
+		services:
+			srv1:
+				override: merge
+				groups:
+					- frontend
+	`},
+	result: &plan.Layer{
+		Services: map[string]*plan.Service{
+			"srv1": {
+				Name:          "srv1",
+				Override:      "replace",
+				Command:       "cmd",
+				Groups:        []string{"web", "frontend"},
+				BackoffDelay:  plan.OptionalDuration{Value: defaultBackoffDelay},
+				BackoffFactor: plan.OptionalFloat{Value: defaultBackoffFactor},
+				BackoffLimit:  plan.OptionalDuration{Value: defaultBackoffLimit},
+			},
+		},
+		Checks: map[string]*plan.Check{},
+		Timers: map[string]*plan.Timer{},
+	},
+}, {
+	summary: "Environment files and file references are merged",
+	input: []string{`
+		services:
+			srv1:
+				override: replace
+				command: cmd
+				environment-files:
+					- /etc/srv1/defaults.env
+				environment:
+					A: a
+					PASS: {file: /run/secrets/pass}
+	`, `
+		services:
+			srv1:
+				override: merge
+				environment-files:
+					- -/etc/srv1/local.env
+				environment:
+					TOKEN: {file: /run/secrets/token, optional: true}
+	`},
+	result: &plan.Layer{
+		Services: map[string]*plan.Service{
+			"srv1": {
+				Name:     "srv1",
+				Override: "replace",
+				Command:  "cmd",
+				Environment: map[string]plan.EnvValue{
+					"A":     {Value: "a"},
+					"PASS":  {File: "/run/secrets/pass"},
+					"TOKEN": {File: "/run/secrets/token", Optional: true},
+				},
+				EnvironmentFiles: []string{"/etc/srv1/defaults.env", "-/etc/srv1/local.env"},
+				BackoffDelay:     plan.OptionalDuration{Value: defaultBackoffDelay},
+				BackoffFactor:    plan.OptionalFloat{Value: defaultBackoffFactor},
+				BackoffLimit:     plan.OptionalDuration{Value: defaultBackoffLimit},
+			},
+		},
+		Checks: map[string]*plan.Check{},
+		Timers: map[string]*plan.Timer{},
+	},
+}, {
+	summary: "Log files are merged",
+	input: []string{`
+		services:
+			srv1:
+				override: replace
+				command: cmd
+				log-files:
+					- /var/log/vendor/*.log
+	`, `
+		services:
+			srv1:
+				override: merge
+				log-files:
+					- /var/log/vendor/audit/*.log
+	`},
+	result: &plan.Layer{
+		Services: map[string]*plan.Service{
+			"srv1": {
+				Name:          "srv1",
+				Override:      "replace",
+				Command:       "cmd",
+				LogFiles:      []string{"/var/log/vendor/*.log", "/var/log/vendor/audit/*.log"},
+				BackoffDelay:  plan.OptionalDuration{Value: defaultBackoffDelay},
+				BackoffFactor: plan.OptionalFloat{Value: defaultBackoffFactor},
+				BackoffLimit:  plan.OptionalDuration{Value: defaultBackoffLimit},
+			},
+		},
+		Checks: map[string]*plan.Check{},
+		Timers: map[string]*plan.Timer{},
+	},
+}, {
+	summary: `Relative environment file`,
+	error:   `plan service "svc1" environment file "app.env" must be an absolute path`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				environment-files:
+					- -app.env
+	`},
+}, {
+	summary: `Relative environment variable file`,
+	error:   `plan service "svc1" environment variable "PASS" file must be an absolute path`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				environment:
+					PASS: {file: pass}
+	`},
+}, {
+	summary: `Environment file reference without file`,
+	error:   `cannot parse layer "layer-0": environment value must specify a file`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				environment:
+					PASS: {optional: true}
+	`},
+}, {
+	summary: `Environment file reference with unknown field`,
+	error:   `cannot parse layer "layer-0": environment value has unknown field "path"`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				environment:
+					PASS: {path: /run/secrets/pass}
+	`},
+}, {
+	summary: `Invalid environment value`,
+	error:   `cannot parse layer "layer-0": environment value must be a string or {file: path}`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				environment:
+					PASS: [a, b]
+	`},
+}, {
+	summary: `Empty group name`,
+	error:   `plan service "svc1" has an empty group name`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				groups:
+					- ""
+	`},
+}, {
+	summary: `Invalid before-start command`,
+	error:   `plan service "svc1" before-start command invalid: EOF found when expecting closing quote`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				before-start:
+					- foo '
+	`},
+}, {
+	summary: `Empty after-stop command`,
+	error:   `plan service "svc1" after-stop command invalid: empty command`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				after-stop:
+					- ""
+	`},
+}, {
+	summary: `Zero hook-timeout`,
+	error:   `plan service "svc1" hook-timeout must be greater than zero`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				hook-timeout: 0s
+	`},
+}, {
+	summary: "Timers are combined and defaults set",
+	input: []string{`
+		timers:
+			prune:
+				override: replace
+				command: prune-logs --all
+				every: 15m
+				jitter: 1m
+			renew:
+				override: replace
+				command: renew-certs
+				every: 24h
+				environment:
+					A: a
+	`, `
+		timers:
+			prune:
+				override: replace
+				command: prune-logs
+				schedule: 9:00-11:00
+			renew:
+				override: merge
+				schedule: mon,03:00
+				timeout: 1m
+				overlap: allow
+				catch-up: true
+				environment:
+					B: b
+	`},
+	result: &plan.Layer{
+		Services: map[string]*plan.Service{},
+		Checks:   map[string]*plan.Check{},
+		Timers: map[string]*plan.Timer{
+			"prune": {
+				Name:     "prune",
+				Override: plan.ReplaceOverride,
+				Command:  "prune-logs",
+				Schedule: "9:00-11:00",
+				Timeout:  plan.OptionalDuration{Value: defaultTimerTimeout},
+				Overlap:  plan.OverlapSkip,
+			},
+			"renew": {
+				Name:     "renew",
+				Override: plan.ReplaceOverride,
+				Command:  "renew-certs",
+				Schedule: "mon,03:00",
+				Timeout:  plan.OptionalDuration{Value: time.Minute, IsSet: true},
+				Overlap:  plan.OverlapAllow,
+				CatchUp:  true,
+				Environment: map[string]string{
+					"A": "a",
+					"B": "b",
+				},
+			},
+		},
+	},
+}, {
+	summary: `Timer without command`,
+	error:   `plan must define "command" for timer "t1"`,
+	input: []string{`
+		timers:
+			t1:
+				override: replace
+				every: 1m
+	`},
+}, {
+	summary: `Timer without every or schedule`,
+	error:   `plan must specify one of "every" or "schedule" for timer "t1"`,
+	input: []string{`
+		timers:
+			t1:
+				override: replace
+				command: cmd
+	`},
+}, {
+	summary: `Timer with both every and schedule`,
+	error:   `plan must specify one of "every" or "schedule" for timer "t1"`,
+	input: []string{`
+		timers:
+			t1:
+				override: replace
+				command: cmd
+				every: 1m
+				schedule: 9:00
+	`},
+}, {
+	summary: `Timer with invalid schedule`,
+	error:   `plan timer "t1" schedule invalid: .*`,
+	input: []string{`
+		timers:
+			t1:
+				override: replace
+				command: cmd
+				schedule: whenever
+	`},
+}, {
+	summary: `Timer with invalid overlap`,
+	error:   `plan timer "t1" overlap must be "skip" or "allow"`,
+	input: []string{`
+		timers:
+			t1:
+				override: replace
+				command: cmd
+				every: 1m
+				overlap: queue
+	`},
+}, {
+	summary: `Timer without override`,
+	error:   `layer "layer-0" must define "override" for timer "t1"`,
+	input: []string{`
+		timers:
+			t1:
+				command: cmd
+				every: 1m
+	`},
+}, {
+	summary: "Unknown keys are not accepted",
+	error:   "(?s).*field future not found.*",
+	input: []string{`
+		services:
+			srv1:
+				future: true
+				override: replace
+				command: cmd
+	`},
+}, {
+	summary: `Cannot use service name "pebble"`,
+	error:   `cannot use reserved service name "pebble"`,
+	input: []string{`
+		services:
+			pebble:
+				command: cmd
+	`},
+}, {
+	summary: `Cannot have null service definition`,
+	error:   `service object cannot be null for service "svc1"`,
+	input: []string{`
+		services:
+			svc1: ~
+	`},
+}, {
+	summary: `Cannot use empty string as service name`,
+	error:   "cannot use empty string as service name",
+	input: []string{`
+		services:
+			"":
+				override: replace
+				command: cmd
+	`},
+}, {
+	summary: `Invalid action`,
+	error:   `plan service "svc1" on-success action "foo" invalid`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				on-success: foo
+	`},
+}, {
+	summary: `Invalid backoff-delay duration`,
+	error:   `cannot parse layer "layer-0": invalid duration "foo"`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				backoff-delay: foo
+	`},
+}, {
+	summary: `Zero backoff-factor`,
+	error:   `plan service "svc1" backoff-factor must be 1.0 or greater, not 0`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				backoff-factor: 0
+	`},
+}, {
+	summary: `Too small backoff-factor`,
+	error:   `plan service "svc1" backoff-factor must be 1.0 or greater, not 0.5`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				backoff-factor: 0.5
+	`},
+}, {
+	summary: `Too many failure-log-lines`,
+	error:   `plan service "svc1" failure-log-lines must be between 0 and 1000, not 1001`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				failure-log-lines: 1001
+	`},
+}, {
+	summary: `Zero watchdog-log-silence`,
+	error:   `plan service "svc1" watchdog-log-silence must be greater than zero`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				watchdog-log-silence: 0s
+	`},
+}, {
+	summary: `Invalid log-encoding`,
+	error:   `plan service "svc1" log-encoding must be "auto", "utf-8", "utf-16le" or "utf-16be", not "latin1"`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-encoding: latin1
+	`},
+}, {
+	summary: `Out of range log-coalesce`,
+	error:   `plan service "svc1" log-coalesce must be between 0 and 1s, not 2s`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-coalesce: 2s
+	`},
+}, {
+	summary: `Relative log file`,
+	error:   `plan service "svc1" log file "logs/\*.log" must be an absolute path or glob pattern`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-files:
+					- logs/*.log
+	`},
+}, {
+	summary: `Bad log file pattern`,
+	error:   `plan service "svc1" log file "/var/log/\[vendor.log" must be an absolute path or glob pattern`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-files:
+					- /var/log/[vendor.log
+	`},
+}, {
+	summary: `Invalid memory-limit`,
+	error:   `plan service "svc1" memory-limit invalid: .*`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				memory-limit: lots
+	`},
+}, {
+	summary: `Invalid cpu-quota`,
+	error:   `plan service "svc1" cpu-quota invalid: cpu quota must be a percentage like "50%"`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				cpu-quota: 0.5
+	`},
+}, {
+	summary: `Zero cpu-quota`,
+	error:   `plan service "svc1" cpu-quota invalid: cpu quota must be a positive percentage like "50%"`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				cpu-quota: 0%
+	`},
+}, {
+	summary: `Invalid reload-signal`,
+	error:   `plan service "svc1" reload-signal "SIGFOO" invalid`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				reload-signal: SIGFOO
+	`},
+}, {
+	summary: `Invalid reload-ready-log`,
+	error:   `plan service "svc1" reload-ready-log invalid: error parsing regexp: .*`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				reload-signal: SIGHUP
+				reload-ready-log: "("
+	`},
+}, {
+	summary: `Reload options without reload-signal`,
+	error:   `plan service "svc1" must set reload-signal to use reload options`,
 	input: []string{`
-		summary: Order loop
 		services:
-			srv1:
+			"svc1":
 				override: replace
 				command: cmd
-				after:
-					- srv3
-			srv2:
+				reload-ready-check: chk1
+	`},
+}, {
+	summary: `Zero reload-timeout`,
+	error:   `plan service "svc1" reload-timeout must be greater than zero`,
+	input: []string{`
+		services:
+			"svc1":
 				override: replace
 				command: cmd
-				after:
-					- srv1
-				before:
-					- srv3
-			srv3:
+				reload-signal: SIGHUP
+				reload-timeout: 0s
+	`},
+}, {
+	summary: `Relative render destination`,
+	error:   `plan service "svc1" render destination "app.conf" must be an absolute path`,
+	input: []string{`
+		services:
+			"svc1":
 				override: replace
 				command: cmd
+				render:
+					app.conf:
+						template: foo
 	`},
 }, {
-	summary: "Handling of nulls and typed values in environment",
+	summary: `Render without template or source`,
+	error:   `plan service "svc1" render "/etc/app.conf" must set one of "template" or "source"`,
 	input: []string{`
 		services:
-			srv1:
+			"svc1":
 				override: replace
 				command: cmd
-				environment:
-					a: true
-					b: 1.1
-					c:
+				render:
+					/etc/app.conf:
+						mode: "0600"
 	`},
-	layers: []*plan.Layer{{
-		Order: 0,
-		Label: "layer-0",
-		Services: map[string]*plan.Service{
-			"srv1": {
-				Name:     "srv1",
-				Override: "replace",
-				Command:  "cmd",
-				Environment: map[string]string{
-					"a": "true",
-					"b": "1.1",
-					"c": "",
-				},
-			},
-		},
-		Checks: map[string]*plan.Check{},
-	}},
 }, {
-	summary: "Unknown keys are not accepted",
-	error:   "(?s).*field future not found.*",
+	summary: `Render with both template and source`,
+	error:   `plan service "svc1" render "/etc/app.conf" must set one of "template" or "source"`,
 	input: []string{`
 		services:
-			srv1:
-				future: true
+			"svc1":
 				override: replace
 				command: cmd
+				render:
+					/etc/app.conf:
+						template: foo
+						source: /etc/app.conf.tmpl
 	`},
 }, {
-	summary: `Cannot use service name "pebble"`,
-	error:   `cannot use reserved service name "pebble"`,
+	summary: `Relative render source`,
+	error:   `plan service "svc1" render "/etc/app.conf" source must be an absolute path`,
 	input: []string{`
 		services:
-			pebble:
+			"svc1":
+				override: replace
 				command: cmd
+				render:
+					/etc/app.conf:
+						source: app.conf.tmpl
 	`},
 }, {
-	summary: `Cannot have null service definition`,
-	error:   `service object cannot be null for service "svc1"`,
+	summary: `Invalid render mode`,
+	error:   `plan service "svc1" render "/etc/app.conf" mode must be an octal permission like "0644"`,
 	input: []string{`
 		services:
-			svc1: ~
+			"svc1":
+				override: replace
+				command: cmd
+				render:
+					/etc/app.conf:
+						template: foo
+						mode: "0999"
 	`},
 }, {
-	summary: `Cannot use empty string as service name`,
-	error:   "cannot use empty string as service name",
+	summary: `Log target without type`,
+	error:   `plan service "svc1" log target "out" type must be "file", "syslog" or "buffer"`,
 	input: []string{`
 		services:
-			"":
+			"svc1":
 				override: replace
 				command: cmd
+				log-targets:
+					out:
+						path: /var/log/svc1.log
 	`},
 }, {
-	summary: `Invalid action`,
-	error:   `plan service "svc1" on-success action "foo" invalid`,
+	summary: `Relative log target path`,
+	error:   `plan service "svc1" log target "out" path must be an absolute path`,
 	input: []string{`
 		services:
 			"svc1":
 				override: replace
 				command: cmd
-				on-success: foo
+				log-targets:
+					out:
+						type: file
+						path: svc1.log
 	`},
 }, {
-	summary: `Invalid backoff-delay duration`,
-	error:   `cannot parse layer "layer-0": invalid duration "foo"`,
+	summary: `Invalid log target max-size`,
+	error:   `plan service "svc1" log target "out" max-size must be greater than zero`,
 	input: []string{`
 		services:
 			"svc1":
 				override: replace
 				command: cmd
-				backoff-delay: foo
+				log-targets:
+					out:
+						type: file
+						path: /var/log/svc1.log
+						max-size: 0B
 	`},
 }, {
-	summary: `Zero backoff-factor`,
-	error:   `plan service "svc1" backoff-factor must be 1.0 or greater, not 0`,
+	summary: `Negative log target max-files`,
+	error:   `plan service "svc1" log target "out" max-files must not be negative`,
 	input: []string{`
 		services:
 			"svc1":
 				override: replace
 				command: cmd
-				backoff-factor: 0
+				log-targets:
+					out:
+						type: file
+						path: /var/log/svc1.log
+						max-files: -1
 	`},
 }, {
-	summary: `Too small backoff-factor`,
-	error:   `plan service "svc1" backoff-factor must be 1.0 or greater, not 0.5`,
+	summary: `Log target file with address`,
+	error:   `plan service "svc1" log target "out" address is only valid for "syslog" targets`,
 	input: []string{`
 		services:
 			"svc1":
 				override: replace
 				command: cmd
-				backoff-factor: 0.5
+				log-targets:
+					out:
+						type: file
+						path: /var/log/svc1.log
+						address: udp://localhost:514
+	`},
+}, {
+	summary: `Invalid log target syslog network`,
+	error:   `plan service "svc1" log target "out" address network must be "udp" or "tcp", not "http"`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-targets:
+					out:
+						type: syslog
+						address: http://localhost:514
+	`},
+}, {
+	summary: `Log target syslog without port`,
+	error:   `plan service "svc1" log target "out" address invalid: .*missing port.*`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-targets:
+					out:
+						type: syslog
+						address: udp://localhost
+	`},
+}, {
+	summary: `Log target syslog with path`,
+	error:   `plan service "svc1" log target "out" path, max-size, max-files and compress are only valid for "file" targets`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-targets:
+					out:
+						type: syslog
+						address: tcp://localhost:601
+						compress: true
+	`},
+}, {
+	summary: `Log target buffer with options`,
+	error:   `plan service "svc1" log target "out" "buffer" targets take no options`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-targets:
+					out:
+						type: buffer
+						path: /var/log/svc1.log
+	`},
+}, {
+	summary: `Null log target`,
+	error:   `log target object cannot be null for log target "out" of service "svc1"`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-targets:
+					out: null
+	`},
+}, {
+	summary: `Log buffer size too small`,
+	error:   `plan service "svc1" log-buffer-size must be between 4kB and 64MB`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-buffer-size: 1kB
+	`},
+}, {
+	summary: `Log buffer size too big`,
+	error:   `plan service "svc1" log-buffer-size must be between 4kB and 64MB`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-buffer-size: 1GB
+	`},
+}, {
+	summary: `Invalid log buffer size`,
+	error:   `plan service "svc1" log-buffer-size cannot parse "lots": .*`,
+	input: []string{`
+		services:
+			"svc1":
+				override: replace
+				command: cmd
+				log-buffer-size: lots
 	`},
 }, {
 	summary: `Invalid backoff-factor`,
@@ -510,6 +1226,7 @@ var planTests = []planTest{{
 				},
 			},
 		},
+		Timers: map[string]*plan.Timer{},
 	},
 }, {
 	summary: "Checks override replace works correctly",
@@ -586,6 +1303,7 @@ var planTests = []planTest{{
 				},
 			},
 		},
+		Timers: map[string]*plan.Timer{},
 	},
 }, {
 	summary: "Checks override merge works correctly",
@@ -664,6 +1382,7 @@ var planTests = []planTest{{
 				},
 			},
 		},
+		Timers: map[string]*plan.Timer{},
 	},
 }, {
 	summary: "One of http, tcp, or exec must be present for check",
@@ -758,6 +1477,234 @@ func (s *S) TestParseLayer(c *C) {
 	}
 }
 
+func (s *S) TestReloadSafe(c *C) {
+	base := &plan.Service{
+		Name:         "srv1",
+		Command:      "cmd",
+		Environment:  map[string]plan.EnvValue{"a": {Value: "b"}},
+		ReloadSignal: "SIGHUP",
+	}
+
+	other := base.Copy()
+	other.Summary = "new summary"
+	other.After = []string{"srv2"}
+	other.OnFailure = plan.ActionShutdown
+	other.ReloadTimeout = plan.OptionalDuration{Value: time.Second, IsSet: true}
+	c.Check(base.ReloadSafe(other), Equals, true)
+	c.Check(other.ReloadSafe(base), Equals, true)
+
+	other = base.Copy()
+	other.Command = "cmd --flag"
+	c.Check(base.ReloadSafe(other), Equals, false)
+
+	other = base.Copy()
+	other.Environment["a"] = plan.EnvValue{Value: "c"}
+	c.Check(base.ReloadSafe(other), Equals, false)
+
+	other = base.Copy()
+	other.MemoryLimit = "64MB"
+	c.Check(base.ReloadSafe(other), Equals, false)
+}
+
+func (s *S) TestRenderMerge(c *C) {
+	layer1, err := plan.ParseLayer(1, "layer1", []byte(`
+services:
+    srv1:
+        override: replace
+        command: cmd
+        render:
+            /etc/a.conf:
+                template: a
+            /etc/b.conf:
+                template: b
+`))
+	c.Assert(err, IsNil)
+	layer2, err := plan.ParseLayer(2, "layer2", []byte(`
+services:
+    srv1:
+        override: merge
+        render:
+            /etc/b.conf:
+                source: /etc/b.conf.tmpl
+                mode: "0600"
+`))
+	c.Assert(err, IsNil)
+	combined, err := plan.CombineLayers(layer1, layer2)
+	c.Assert(err, IsNil)
+	c.Check(combined.Services["srv1"].Render, DeepEquals, map[string]*plan.RenderFile{
+		"/etc/a.conf": {Template: "a"},
+		"/etc/b.conf": {Source: "/etc/b.conf.tmpl", Mode: "0600"},
+	})
+	// The layers themselves aren't modified.
+	c.Check(layer1.Services["srv1"].Render["/etc/b.conf"], DeepEquals, &plan.RenderFile{Template: "b"})
+}
+
+func (s *S) TestLogBufferSize(c *C) {
+	layer1, err := plan.ParseLayer(1, "layer1", []byte(`
+services:
+    srv1:
+        override: replace
+        command: cmd
+        log-buffer-size: 16kB
+`))
+	c.Assert(err, IsNil)
+	layer2, err := plan.ParseLayer(2, "layer2", []byte(`
+services:
+    srv1:
+        override: merge
+        log-buffer-size: 1MB
+`))
+	c.Assert(err, IsNil)
+
+	combined, err := plan.CombineLayers(layer1)
+	c.Assert(err, IsNil)
+	size, err := combined.Services["srv1"].LogBufferBytes()
+	c.Assert(err, IsNil)
+	c.Check(size, Equals, 16*1000)
+
+	combined, err = plan.CombineLayers(layer1, layer2)
+	c.Assert(err, IsNil)
+	size, err = combined.Services["srv1"].LogBufferBytes()
+	c.Assert(err, IsNil)
+	c.Check(size, Equals, 1000*1000)
+
+	// Unset, the default buffer size is used.
+	size, err = (&plan.Service{}).LogBufferBytes()
+	c.Assert(err, IsNil)
+	c.Check(size, Equals, 0)
+
+	// Changing the size doesn't need a restart: it's applied when the
+	// service is next started.
+	c.Check(layer1.Services["srv1"].ReloadSafe(combined.Services["srv1"]), Equals, true)
+}
+
+func (s *S) TestLogTargetsMerge(c *C) {
+	layer1, err := plan.ParseLayer(1, "layer1", []byte(`
+services:
+    srv1:
+        override: replace
+        command: cmd
+        log-targets:
+            file:
+                type: file
+                path: /var/log/srv1.log
+            remote:
+                type: syslog
+                address: udp://logs.example.com:514
+`))
+	c.Assert(err, IsNil)
+	layer2, err := plan.ParseLayer(2, "layer2", []byte(`
+services:
+    srv1:
+        override: merge
+        log-targets:
+            file:
+                type: file
+                path: /var/log/srv1/out.log
+                max-size: 1MB
+                max-files: 2
+                compress: true
+            remote:
+                type: buffer
+`))
+	c.Assert(err, IsNil)
+	combined, err := plan.CombineLayers(layer1, layer2)
+	c.Assert(err, IsNil)
+	maxFiles := 2
+	c.Check(combined.Services["srv1"].LogTargets, DeepEquals, map[string]*plan.LogTarget{
+		"file": {
+			Type:     plan.FileLogTarget,
+			Path:     "/var/log/srv1/out.log",
+			MaxSize:  "1MB",
+			MaxFiles: &maxFiles,
+			Compress: true,
+		},
+		"remote": {Type: plan.BufferLogTarget},
+	})
+	// The layers themselves aren't modified.
+	c.Check(layer1.Services["srv1"].LogTargets["file"], DeepEquals, &plan.LogTarget{
+		Type: plan.FileLogTarget,
+		Path: "/var/log/srv1.log",
+	})
+
+	target := layer1.Services["srv1"].LogTargets["file"]
+	size, err := target.FileMaxSize()
+	c.Assert(err, IsNil)
+	c.Check(size, Equals, int64(10*1024*1024))
+	c.Check(target.FileMaxFiles(), Equals, 5)
+	target = combined.Services["srv1"].LogTargets["file"]
+	size, err = target.FileMaxSize()
+	c.Assert(err, IsNil)
+	c.Check(size, Equals, int64(1000*1000))
+	c.Check(target.FileMaxFiles(), Equals, 2)
+	network, addr, err := layer1.Services["srv1"].LogTargets["remote"].SyslogAddress()
+	c.Assert(err, IsNil)
+	c.Check(network, Equals, "udp")
+	c.Check(addr, Equals, "logs.example.com:514")
+
+	// Replacing the service drops the targets of earlier layers.
+	layer3, err := plan.ParseLayer(3, "layer3", []byte(`
+services:
+    srv1:
+        override: replace
+        command: cmd
+`))
+	c.Assert(err, IsNil)
+	combined, err = plan.CombineLayers(layer1, layer2, layer3)
+	c.Assert(err, IsNil)
+	c.Check(combined.Services["srv1"].LogTargets, HasLen, 0)
+}
+
+func (s *S) TestGroupServices(c *C) {
+	layer, err := plan.ParseLayer(0, "layer", reindent(`
+		services:
+			web1:
+				override: replace
+				command: cmd
+				groups: [web]
+				requires: [db]
+				after: [web2]
+			web2:
+				override: replace
+				command: cmd
+				groups: [web, frontend]
+			db:
+				override: replace
+				command: cmd
+				groups: [data]
+				before: [web1, web2]
+			other:
+				override: replace
+				command: cmd
+	`))
+	c.Assert(err, IsNil)
+	combined, err := plan.CombineLayers(layer)
+	c.Assert(err, IsNil)
+	p := plan.Plan{Services: combined.Services}
+
+	names, err := p.GroupServices([]string{"web"})
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"web1", "web2"})
+
+	names, err = p.GroupServices([]string{"frontend", "data", "web"})
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"db", "web1", "web2"})
+
+	// Dependency ordering is honoured when starting a group.
+	names, err = p.GroupServices([]string{"web"})
+	c.Assert(err, IsNil)
+	names, err = p.StartOrder(names)
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"db", "web2", "web1"})
+
+	_, err = p.GroupServices([]string{"web", "backend"})
+	c.Check(err, ErrorMatches, `group "backend" does not exist \(known groups: data, frontend, web\)`)
+
+	p = plan.Plan{}
+	_, err = p.GroupServices([]string{"web"})
+	c.Check(err, ErrorMatches, `group "web" does not exist \(no groups defined\)`)
+}
+
 func (s *S) TestCombineLayersCycle(c *C) {
 	// Even if individual layers don't have cycles, combined layers might.
 	layer1, err := plan.ParseLayer(1, "label1", []byte(`
@@ -833,6 +1780,54 @@ services:
 	c.Assert(combined.Services["srv1"].Command, Equals, "foo --bar")
 }
 
+func (s *S) TestLogProblems(c *C) {
+	layer, err := plan.ParseLayer(1, "label1", []byte(`
+services:
+    srv1:
+        override: replace
+        command: cmd
+        failure-log-lines: -1
+        reload-signal: SIGHUP
+        reload-ready-log: "("
+    srv2:
+        override: replace
+        command: cmd
+        watchdog-log-silence: 0s
+`))
+	c.Assert(err, IsNil)
+	_, err = plan.CombineLayers(layer)
+	c.Assert(err, ErrorMatches, `
+plan has 3 problems:
+- plan service "srv1" failure-log-lines must be between 0 and 1000, not -1
+- plan service "srv1" reload-ready-log invalid: error parsing regexp: missing closing \): .*
+- plan service "srv2" watchdog-log-silence must be greater than zero`[1:])
+	formatErr, ok := err.(*plan.FormatError)
+	c.Assert(ok, Equals, true, Commentf("error must be *plan.FormatError, not %T", err))
+	c.Assert(formatErr.Problems, HasLen, 3)
+	c.Check(formatErr.Problems[0].Field, Equals, "services.srv1.failure-log-lines")
+	c.Check(formatErr.Problems[0].Code, Equals, plan.ProblemOutOfRange)
+	c.Check(formatErr.Problems[1].Field, Equals, "services.srv1.reload-ready-log")
+	c.Check(formatErr.Problems[1].Code, Equals, plan.ProblemBadRegex)
+	c.Check(formatErr.Problems[2].Field, Equals, "services.srv2.watchdog-log-silence")
+	c.Check(formatErr.Problems[2].Code, Equals, plan.ProblemOutOfRange)
+	for _, problem := range formatErr.Problems {
+		c.Check(strings.Contains(err.Error(), problem.Message), Equals, true)
+	}
+
+	// A single problem is reported on its own.
+	layer, err = plan.ParseLayer(1, "label1", []byte(`
+services:
+    srv2:
+        override: replace
+        command: cmd
+        watchdog-log-silence: 0s
+`))
+	c.Assert(err, IsNil)
+	_, err = plan.CombineLayers(layer)
+	c.Check(err, ErrorMatches, `plan service "srv2" watchdog-log-silence must be greater than zero`)
+	c.Check(err.(*plan.FormatError).Problems, HasLen, 1)
+}
+
 func (s *S) TestReadDir(c *C) {
 	tempDir := c.MkDir()
 
@@ -932,6 +1927,24 @@ func (s *S) TestReadDirDupNames(c *C) {
 	}
 }
 
+func (s *S) TestResourceLimits(c *C) {
+	service := &plan.Service{}
+	memory, err := service.MemoryLimitBytes()
+	c.Assert(err, IsNil)
+	c.Assert(memory, Equals, int64(0))
+	quota, err := service.CPUQuotaPercent()
+	c.Assert(err, IsNil)
+	c.Assert(quota, Equals, 0.0)
+
+	service = &plan.Service{MemoryLimit: "64MB", CPUQuota: "150%"}
+	memory, err = service.MemoryLimitBytes()
+	c.Assert(err, IsNil)
+	c.Assert(memory, Equals, int64(64*1000*1000))
+	quota, err = service.CPUQuotaPercent()
+	c.Assert(err, IsNil)
+	c.Assert(quota, Equals, 150.0)
+}
+
 func (s *S) TestMarshalLayer(c *C) {
 	layerBytes := reindent(`
 		summary: Simple layer
@@ -953,9 +1966,32 @@ func (s *S) TestMarshalLayer(c *C) {
 					var0: val0
 					var1: val1
 					var2: val2
+					var3:
+						file: /run/secrets/var3
+						optional: true
+				environment-files:
+					- /etc/srv1.env
+					- -/etc/srv1.local.env
 				backoff-delay: 1s
 				backoff-factor: 1.5
 				backoff-limit: 10s
+				failure-log-lines: 100
+				watchdog-log-silence: 5m0s
+				log-encoding: utf-16le
+				log-coalesce: 50ms
+				log-files:
+					- /var/log/srv1/*.log
+				memory-limit: 64MB
+				cpu-quota: 50%
+				reload-signal: SIGHUP
+				reload-ready-log: reloaded
+				reload-ready-check: chk1
+				reload-timeout: 10s
+				render:
+					/etc/srv1.conf:
+						template: port={{.Env.PORT}}
+						mode: "0600"
+						user: nobody
 			srv2:
 				override: replace
 				command: srv2cmd
@@ -65,3 +65,56 @@ func (o *OptionalFloat) UnmarshalYAML(value *yaml.Node) error {
 	o.IsSet = true
 	return nil
 }
+
+// EnvValue is the value of a service environment variable: either a literal
+// string, or a reference to a file whose contents are read when the service
+// starts, written in YAML as {file: /path/to/file}.
+type EnvValue struct {
+	Value    string
+	File     string
+	Optional bool
+}
+
+type envFileRef struct {
+	File     string `yaml:"file"`
+	Optional bool   `yaml:"optional,omitempty"`
+}
+
+func (v EnvValue) MarshalYAML() (interface{}, error) {
+	if v.File == "" {
+		return v.Value, nil
+	}
+	return envFileRef{File: v.File, Optional: v.Optional}, nil
+}
+
+func (v *EnvValue) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		var s string
+		err := value.Decode(&s)
+		if err != nil {
+			return err
+		}
+		*v = EnvValue{Value: s}
+		return nil
+	case yaml.MappingNode:
+		for i := 0; i < len(value.Content); i += 2 {
+			key := value.Content[i].Value
+			if key != "file" && key != "optional" {
+				return fmt.Errorf("environment value has unknown field %q", key)
+			}
+		}
+		var ref envFileRef
+		err := value.Decode(&ref)
+		if err != nil {
+			return err
+		}
+		if ref.File == "" {
+			return fmt.Errorf("environment value must specify a file")
+		}
+		*v = EnvValue{File: ref.File, Optional: ref.Optional}
+		return nil
+	default:
+		return fmt.Errorf("environment value must be a string or {file: path}")
+	}
+}
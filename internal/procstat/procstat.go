@@ -0,0 +1,201 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package procstat reads the resource usage of processes from the Linux
+// proc filesystem.
+package procstat
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultRoot is where the proc filesystem is normally mounted.
+	DefaultRoot = "/proc"
+
+	// clockTicks is the unit of the CPU times in /proc/<pid>/stat. It's
+	// USER_HZ, which is 100 on all Linux platforms Go supports (reading it
+	// properly requires sysconf, which needs cgo).
+	clockTicks = 100
+)
+
+// Usage is the combined resource usage of a set of processes.
+type Usage struct {
+	// Processes is the number of processes counted.
+	Processes int
+
+	// RSS is the resident set size in bytes.
+	RSS int64
+
+	// CPUTime is the user plus system CPU time used.
+	CPUTime time.Duration
+
+	// Threads is the number of threads.
+	Threads int
+
+	// FDs is the number of open file descriptors, or -1 if they couldn't be
+	// counted for every process (usually due to permissions).
+	FDs int
+}
+
+// TreeUsage returns the combined usage of the process with the given PID and
+// all its descendants, using the proc filesystem mounted at root.
+func TreeUsage(root string, pid int) (*Usage, error) {
+	pids, err := descendants(root, pid)
+	if err != nil {
+		return nil, err
+	}
+	return ProcessesUsage(root, append([]int{pid}, pids...))
+}
+
+// ProcessesUsage returns the combined usage of the processes with the given
+// PIDs, using the proc filesystem mounted at root. Processes that have
+// exited are skipped, but it's an error if none of them exist.
+func ProcessesUsage(root string, pids []int) (*Usage, error) {
+	usage := &Usage{}
+	for _, pid := range pids {
+		stat, err := readStat(root, pid)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rss, err := readRSS(root, pid)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		usage.Processes++
+		usage.RSS += rss
+		usage.CPUTime += time.Duration(stat.utime+stat.stime) * time.Second / clockTicks
+		usage.Threads += stat.threads
+		if usage.FDs >= 0 {
+			fds, err := ioutil.ReadDir(filepath.Join(root, strconv.Itoa(pid), "fd"))
+			if err != nil {
+				usage.FDs = -1
+			} else {
+				usage.FDs += len(fds)
+			}
+		}
+	}
+	if usage.Processes == 0 {
+		return nil, fmt.Errorf("no processes found with PIDs %v", pids)
+	}
+	return usage, nil
+}
+
+// descendants returns the PIDs of all the descendants of the given process.
+func descendants(root string, pid int) ([]int, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		stat, err := readStat(root, child)
+		if err != nil {
+			// Most likely exited since the directory was read.
+			continue
+		}
+		children[stat.ppid] = append(children[stat.ppid], child)
+	}
+	var pids []int
+	queue := children[pid]
+	for len(queue) > 0 {
+		pids = append(pids, queue[0])
+		queue = append(queue[1:], children[queue[0]]...)
+	}
+	return pids, nil
+}
+
+type procStat struct {
+	ppid    int
+	utime   uint64
+	stime   uint64
+	threads int
+}
+
+func readStat(root string, pid int) (*procStat, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+	stat, err := parseStat(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse stat for process %d: %w", pid, err)
+	}
+	return stat, nil
+}
+
+// parseStat parses the contents of /proc/<pid>/stat, described in proc(5).
+func parseStat(data []byte) (*procStat, error) {
+	// The command name in field 2 is in parentheses and may itself contain
+	// spaces and parentheses, so parse the fields after the last ')'.
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return nil, fmt.Errorf("missing command name")
+	}
+	fields := bytes.Fields(data[end+1:])
+	if len(fields) < 18 {
+		return nil, fmt.Errorf("expected at least 20 fields, got %d", len(fields)+2)
+	}
+	// Indexes are the field numbers in proc(5) minus 3.
+	ppid, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ppid: %w", err)
+	}
+	utime, err := strconv.ParseUint(string(fields[11]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid utime: %w", err)
+	}
+	stime, err := strconv.ParseUint(string(fields[12]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stime: %w", err)
+	}
+	threads, err := strconv.Atoi(string(fields[17]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid num_threads: %w", err)
+	}
+	return &procStat{ppid: ppid, utime: utime, stime: stime, threads: threads}, nil
+}
+
+// readRSS returns the resident set size in bytes from /proc/<pid>/statm.
+func readRSS(root string, pid int) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, strconv.Itoa(pid), "statm"))
+	if err != nil {
+		return 0, err
+	}
+	fields := bytes.Fields(data)
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("cannot parse statm for process %d: expected at least 2 fields", pid)
+	}
+	pages, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse statm for process %d: %w", pid, err)
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package procstat_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/procstat"
+)
+
+// Hook up check.v1 into the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type procstatSuite struct {
+	root string
+}
+
+var _ = Suite(&procstatSuite{})
+
+func (s *procstatSuite) SetUpTest(c *C) {
+	s.root = c.MkDir()
+}
+
+// writeProcess writes fixture stat, statm and fd files for a process.
+func (s *procstatSuite) writeProcess(c *C, pid int, comm string, ppid int, utime, stime, threads, rssPages, fds int) {
+	dir := filepath.Join(s.root, strconv.Itoa(pid))
+	err := os.MkdirAll(filepath.Join(dir, "fd"), 0755)
+	c.Assert(err, IsNil)
+	stat := fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560 100 0 0 0 %d %d 0 0 20 0 %d 0 1234 5000000 %d 18446744073709551615\n",
+		pid, comm, ppid, pid, pid, utime, stime, threads, rssPages)
+	err = ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644)
+	c.Assert(err, IsNil)
+	statm := fmt.Sprintf("1220 %d 100 10 0 120 0\n", rssPages)
+	err = ioutil.WriteFile(filepath.Join(dir, "statm"), []byte(statm), 0644)
+	c.Assert(err, IsNil)
+	for i := 0; i < fds; i++ {
+		err = ioutil.WriteFile(filepath.Join(dir, "fd", strconv.Itoa(i)), nil, 0644)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *procstatSuite) TestTreeUsage(c *C) {
+	page := int64(os.Getpagesize())
+	s.writeProcess(c, 1, "init", 0, 1000, 1000, 1, 100, 50)
+	s.writeProcess(c, 10, "sh", 1, 150, 50, 1, 200, 3)
+	s.writeProcess(c, 11, "my (odd) name", 10, 300, 100, 4, 1000, 10)
+	s.writeProcess(c, 12, "worker", 11, 0, 50, 2, 300, 5)
+	s.writeProcess(c, 20, "other", 1, 10, 10, 1, 10, 1)
+	err := os.Mkdir(filepath.Join(s.root, "self"), 0755)
+	c.Assert(err, IsNil)
+
+	usage, err := procstat.TreeUsage(s.root, 10)
+	c.Assert(err, IsNil)
+	c.Check(usage, DeepEquals, &procstat.Usage{
+		Processes: 3,
+		RSS:       1500 * page,
+		CPUTime:   6500 * time.Millisecond,
+		Threads:   7,
+		FDs:       18,
+	})
+
+	usage, err = procstat.TreeUsage(s.root, 12)
+	c.Assert(err, IsNil)
+	c.Check(usage, DeepEquals, &procstat.Usage{
+		Processes: 1,
+		RSS:       300 * page,
+		CPUTime:   500 * time.Millisecond,
+		Threads:   2,
+		FDs:       5,
+	})
+
+	_, err = procstat.TreeUsage(s.root, 42)
+	c.Check(err, ErrorMatches, `no processes found with PIDs \[42\]`)
+}
+
+func (s *procstatSuite) TestProcessesUsage(c *C) {
+	page := int64(os.Getpagesize())
+	s.writeProcess(c, 10, "a", 1, 100, 0, 1, 10, 1)
+	s.writeProcess(c, 11, "b", 1, 0, 100, 1, 20, 2)
+
+	// Processes that have exited are skipped.
+	usage, err := procstat.ProcessesUsage(s.root, []int{10, 11, 12})
+	c.Assert(err, IsNil)
+	c.Check(usage, DeepEquals, &procstat.Usage{
+		Processes: 2,
+		RSS:       30 * page,
+		CPUTime:   2 * time.Second,
+		Threads:   2,
+		FDs:       3,
+	})
+
+	// File descriptors that can't be counted are reported as -1.
+	err = os.RemoveAll(filepath.Join(s.root, "11", "fd"))
+	c.Assert(err, IsNil)
+	usage, err = procstat.ProcessesUsage(s.root, []int{10, 11})
+	c.Assert(err, IsNil)
+	c.Check(usage.FDs, Equals, -1)
+	c.Check(usage.Processes, Equals, 2)
+}
+
+func (s *procstatSuite) TestParseErrors(c *C) {
+	dir := filepath.Join(s.root, "10")
+	err := os.Mkdir(dir, 0755)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "statm"), []byte("1 2 3\n"), 0644)
+	c.Assert(err, IsNil)
+
+	for _, test := range []struct {
+		stat  string
+		error string
+	}{
+		{"10 sh S 1", "cannot parse stat for process 10: missing command name"},
+		{"10 (sh) S 1 10 10", "cannot parse stat for process 10: expected at least 20 fields, got 6"},
+		{"10 (sh) S x 10 10 0 -1 0 0 0 0 0 1 1 0 0 20 0 1 0", "cannot parse stat for process 10: invalid ppid: .*"},
+		{"10 (sh) S 1 10 10 0 -1 0 0 0 0 0 x 1 0 0 20 0 1 0", "cannot parse stat for process 10: invalid utime: .*"},
+		{"10 (sh) S 1 10 10 0 -1 0 0 0 0 0 1 1 0 0 20 0 x 0", "cannot parse stat for process 10: invalid num_threads: .*"},
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(test.stat), 0644)
+		c.Assert(err, IsNil)
+		_, err = procstat.ProcessesUsage(s.root, []int{10})
+		c.Check(err, ErrorMatches, test.error)
+	}
+}
+
+func (s *procstatSuite) TestRealProcess(c *C) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		c.Skip("proc filesystem not available")
+	}
+	cmd := exec.Command("/bin/sh", "-c", "sleep 10 & sleep 10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	c.Assert(err, IsNil)
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+	}()
+
+	// Wait for the shell to start its children.
+	var usage *procstat.Usage
+	for i := 0; i < 100; i++ {
+		usage, err = procstat.TreeUsage(procstat.DefaultRoot, cmd.Process.Pid)
+		c.Assert(err, IsNil)
+		if usage.Processes == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(usage.Processes, Equals, 3)
+	c.Check(usage.RSS > 0, Equals, true)
+	c.Check(usage.Threads >= 3, Equals, true)
+	c.Check(usage.FDs >= 3, Equals, true)
+}
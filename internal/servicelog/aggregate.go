@@ -0,0 +1,272 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// entryWriter is a formatter that can write several lines of a service's
+// output as a single log entry.
+type entryWriter interface {
+	writeEntry(entry []byte, t time.Time) (int, error)
+}
+
+// AggregateConfig configures an AggregateWriter.
+type AggregateConfig struct {
+	// Start, if set, matches the lines that start an entry, without
+	// their newline, and the lines that don't match it continue the entry
+	// before them. If it's not set, the lines starting with a space or a
+	// tab continue the entry before them.
+	Start *regexp.Regexp
+	// Timeout is how long an entry is held back for lines continuing it,
+	// after its last line. It must be positive.
+	Timeout time.Duration
+	// MaxSize is the size, in bytes, of the largest entry. A line that
+	// would make an entry larger starts one of its own. It must be
+	// positive.
+	MaxSize int
+}
+
+// AggregateWriter groups the lines of a service's output that belong
+// together, such as those of a stack trace, into a single log entry, so
+// that they share the timestamp of the first and aren't split up in the
+// output. It's put in front of a formatter, which writes an entry with a
+// prefix for its first line only, or, for NewJSONFormatWriter and
+// NewLogfmtFormatWriter, as a single record with newlines in its message.
+// Other writers are given the lines of an entry as they are.
+//
+// As it can't be known whether a line is the last of its entry until the
+// next one arrives, each entry is held back until a line starting another
+// one arrives, or for its timeout after its last line. An incomplete line
+// is held back too, and once it's too long to be part of an entry, or the
+// timeout has passed, it's written as the start of an entry of its own,
+// and the rest of the line passed on as it's written.
+type AggregateWriter struct {
+	mu      sync.Mutex
+	dest    io.Writer
+	start   *regexp.Regexp
+	timeout time.Duration
+	maxSize int
+
+	// entry is the entry held back, which started at entryTime, and line
+	// the incomplete line after it, which started at lineTime. passing is
+	// set while the rest of a line written on its own is passed on.
+	entry     []byte
+	entryTime time.Time
+	line      []byte
+	lineTime  time.Time
+	passing   bool
+
+	// timer writes what's held back once it's due.
+	timer *deadlineTimer
+	// err is the error from a write by the timer, returned by the next
+	// Write or Close.
+	err    error
+	closed bool
+}
+
+// NewAggregateWriter returns an AggregateWriter that writes the entries of
+// a service's output to dest, usually a formatter.
+func NewAggregateWriter(dest io.Writer, config AggregateConfig) (*AggregateWriter, error) {
+	if config.Timeout <= 0 {
+		return nil, errors.New("aggregation timeout must be positive")
+	}
+	if config.MaxSize <= 0 {
+		return nil, errors.New("maximum aggregate size must be positive")
+	}
+	a := &AggregateWriter{
+		dest:    dest,
+		start:   config.Start,
+		timeout: config.Timeout,
+		maxSize: config.MaxSize,
+	}
+	a.timer = newDeadlineTimer(&a.mu, a.expire)
+	return a, nil
+}
+
+func (a *AggregateWriter) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.err; err != nil {
+		a.err = nil
+		return 0, err
+	}
+	if a.closed {
+		return a.dest.Write(p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		end := false
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			chunk = p[:i+1]
+			end = true
+		}
+		if a.passing {
+			n, err := a.dest.Write(chunk)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			a.passing = !end
+			p = p[len(chunk):]
+			continue
+		}
+
+		if len(a.line) == 0 {
+			a.lineTime = clock.Now()
+		}
+		a.line = append(a.line, chunk...)
+		written += len(chunk)
+		p = p[len(chunk):]
+		var err error
+		switch {
+		case end:
+			err = a.addLine()
+		case len(a.line) > a.maxSize:
+			err = a.flushLine()
+		default:
+			a.timer.Reset(a.timeout)
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// addLine adds the line held back, now complete, to the entry, or starts
+// another entry with it.
+func (a *AggregateWriter) addLine() error {
+	line := a.line
+	a.line = a.line[:0]
+	if len(a.entry) == 0 || !a.continues(line) || len(a.entry)+len(line) > a.maxSize {
+		if err := a.flushEntry(); err != nil {
+			return err
+		}
+		a.entryTime = a.lineTime
+	}
+	a.entry = append(a.entry, line...)
+	a.timer.Reset(a.timeout)
+	return nil
+}
+
+// continues reports whether line continues the entry before it.
+func (a *AggregateWriter) continues(line []byte) bool {
+	if a.start != nil {
+		return !a.start.Match(bytes.TrimSuffix(line, []byte{'\n'}))
+	}
+	return line[0] == ' ' || line[0] == '\t'
+}
+
+// flushEntry writes the entry held back, if any.
+func (a *AggregateWriter) flushEntry() error {
+	if len(a.entry) == 0 {
+		return nil
+	}
+	entry := a.entry
+	a.entry = a.entry[:0]
+	if cap(entry) > 2*a.maxSize {
+		// Don't keep a buffer grown for a long line.
+		a.entry = nil
+	}
+	return a.writeEntry(entry, a.entryTime)
+}
+
+// flushLine writes the entry held back and the incomplete line after it,
+// as the start of an entry of its own, and passes on the rest of the line
+// as it's written.
+func (a *AggregateWriter) flushLine() error {
+	if err := a.flushEntry(); err != nil {
+		return err
+	}
+	line := a.line
+	a.line = a.line[:0]
+	a.passing = true
+	return a.writeEntry(line, a.lineTime)
+}
+
+func (a *AggregateWriter) writeEntry(entry []byte, t time.Time) error {
+	var err error
+	if w, ok := a.dest.(entryWriter); ok {
+		_, err = w.writeEntry(entry, t)
+	} else {
+		_, err = writeFull(a.dest, entry)
+	}
+	return err
+}
+
+// expire writes what's held back once the timeout has passed.
+func (a *AggregateWriter) expire() {
+	err := a.flushEntry()
+	if err == nil && len(a.line) > 0 {
+		err = a.flushLine()
+	}
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+}
+
+// flushIdle writes the entry held back and the incomplete line after it,
+// for an IdleFlushWriter.
+func (a *AggregateWriter) flushIdle() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	err := a.flushEntry()
+	if err == nil && len(a.line) > 0 {
+		err = a.flushLine()
+	}
+	if err != nil {
+		return err
+	}
+	return flushIdle(a.dest)
+}
+
+// Close writes anything held back, and closes dest, if it's an io.Closer,
+// so that it can end an incomplete line. Writes after Close go straight to
+// dest.
+func (a *AggregateWriter) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	err := a.err
+	a.err = nil
+	a.timer.Close()
+	if flushErr := a.flushEntry(); err == nil {
+		err = flushErr
+	}
+	if len(a.line) > 0 {
+		if flushErr := a.flushLine(); err == nil {
+			err = flushErr
+		}
+	}
+	if closeErr := closeWriter(a.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type aggregateSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&aggregateSuite{})
+
+func (s *aggregateSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *aggregateSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *aggregateSuite) TestNew(c *C) {
+	_, err := servicelog.NewAggregateWriter(&bytes.Buffer{}, servicelog.AggregateConfig{MaxSize: 10})
+	c.Check(err, ErrorMatches, "aggregation timeout must be positive")
+	_, err = servicelog.NewAggregateWriter(&bytes.Buffer{}, servicelog.AggregateConfig{Timeout: time.Second})
+	c.Check(err, ErrorMatches, "maximum aggregate size must be positive")
+}
+
+// writeLines writes each of lines to w, a millisecond apart.
+func (s *aggregateSuite) writeLines(c *C, w io.Writer, lines ...string) {
+	for _, line := range lines {
+		_, err := io.WriteString(w, line)
+		c.Assert(err, IsNil)
+		s.clock.Advance(time.Millisecond)
+	}
+}
+
+func (s *aggregateSuite) TestIndented(c *C) {
+	b := &bytes.Buffer{}
+	a, err := servicelog.NewAggregateWriter(newFormatWriter(b, "test"), servicelog.AggregateConfig{
+		Timeout: time.Second,
+		MaxSize: 1024,
+	})
+	c.Assert(err, IsNil)
+	// The traces are interleaved with other lines, and split across
+	// writes.
+	s.writeLines(c, a,
+		"starting\n",
+		"Exception in thread \"main\" java.lang.RuntimeException: boom\n",
+		"\tat Main.run(Main.java:10)\n\tat Ma",
+		"in.main(Main.java:3)\n",
+		"retrying\n",
+		"Traceback (most recent call last):\n",
+		"  File \"main.py\", line 3, in <module>\n",
+		"ValueError: bad\n",
+	)
+	c.Assert(a.Close(), IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] starting
+2021-05-13T03:16:51.002Z [test] Exception in thread "main" java.lang.RuntimeException: boom
+	at Main.run(Main.java:10)
+	at Main.main(Main.java:3)
+2021-05-13T03:16:51.005Z [test] retrying
+2021-05-13T03:16:51.006Z [test] Traceback (most recent call last):
+  File "main.py", line 3, in <module>
+2021-05-13T03:16:51.008Z [test] ValueError: bad
+`[1:])
+
+	// Continuation lines are read back as part of their entry.
+	p := servicelog.NewParser(bytes.NewReader(b.Bytes()), 1024)
+	var messages []string
+	for p.Next() {
+		entry := p.Entry()
+		c.Check(entry.Service, Equals, "test")
+		messages = append(messages, entry.Time.Format("05.000")+" "+entry.Message)
+	}
+	c.Check(messages[1:4], DeepEquals, []string{
+		"51.002 Exception in thread \"main\" java.lang.RuntimeException: boom\n",
+		"51.002 \tat Main.run(Main.java:10)\n",
+		"51.002 \tat Main.main(Main.java:3)\n",
+	})
+}
+
+func (s *aggregateSuite) TestStartPattern(c *C) {
+	b := &bytes.Buffer{}
+	a, err := servicelog.NewAggregateWriter(servicelog.NewJSONFormatWriter(b, "test"), servicelog.AggregateConfig{
+		Start:   regexp.MustCompile(`^(INFO|ERROR) `),
+		Timeout: time.Second,
+		MaxSize: 1024,
+	})
+	c.Assert(err, IsNil)
+	s.writeLines(c, a,
+		"ERROR failed\n",
+		"Traceback (most recent call last):\n",
+		"  File \"main.py\", line 3, in <module>\n",
+		"ValueError: bad\n",
+		"INFO retrying\n",
+	)
+	c.Assert(a.Close(), IsNil)
+	c.Check(b.String(), Equals, `
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"ERROR failed\nTraceback (most recent call last):\n  File \"main.py\", line 3, in <module>\nValueError: bad"}
+{"time":"2021-05-13T03:16:51.005Z","service":"test","message":"INFO retrying"}
+`[1:])
+}
+
+func (s *aggregateSuite) TestTimeout(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	a, err := servicelog.NewAggregateWriter(newFormatWriter(dest, "test"), servicelog.AggregateConfig{
+		Timeout: time.Second,
+		MaxSize: 1024,
+	})
+	c.Assert(err, IsNil)
+	defer a.Close()
+
+	// A trailing trace is written once there have been no lines for the
+	// timeout.
+	_, err = io.WriteString(a, "Traceback:\n  line 1\n")
+	c.Assert(err, IsNil)
+	s.clock.Advance(999 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(dest.String(), Equals, "")
+	s.clock.Advance(time.Millisecond)
+	expected := "2021-05-13T03:16:51.001Z [test] Traceback:\n  line 1\n"
+	waitFor(c, func() bool { return dest.String() == expected })
+
+	// So is an incomplete line, with the rest of it passed on.
+	_, err = io.WriteString(a, "continue? ")
+	c.Assert(err, IsNil)
+	s.clock.Advance(time.Second)
+	expected += "2021-05-13T03:16:52.001Z [test] continue? "
+	waitFor(c, func() bool { return dest.String() == expected })
+	_, err = io.WriteString(a, "yes\n")
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, expected+"yes\n")
+}
+
+func (s *aggregateSuite) TestMaxSize(c *C) {
+	b := &bytes.Buffer{}
+	a, err := servicelog.NewAggregateWriter(newFormatWriter(b, "test"), servicelog.AggregateConfig{
+		Timeout: time.Second,
+		MaxSize: 23,
+	})
+	c.Assert(err, IsNil)
+	// A line that would make an entry too large starts another, and an
+	// incomplete line too large for an entry is passed on.
+	s.writeLines(c, a,
+		"trace\n",
+		"  line 1\n",
+		"  line 2\n",
+		"  line 3\n",
+		"a very long line that is ",
+		"too long\n",
+	)
+	c.Assert(a.Close(), IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] trace
+  line 1
+2021-05-13T03:16:51.003Z [test]   line 2
+  line 3
+2021-05-13T03:16:51.005Z [test] a very long line that is too long
+`[1:])
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+//go:build arm
+// +build arm
+
+package servicelog
+
+import "unsafe"
+
+// 64-bit atomic operations panic on 32-bit ARM unless the field is 64-bit
+// aligned. These fail to compile if a Budget field is misaligned.
+var (
+	_ [0]struct{} = [unsafe.Offsetof(Budget{}.limit) % 8]struct{}{}
+	_ [0]struct{} = [unsafe.Offsetof(Budget{}.used) % 8]struct{}{}
+	_ [0]struct{} = [unsafe.Offsetof(Budget{}.denied) % 8]struct{}{}
+	_ [0]struct{} = [unsafe.Offsetof(Budget{}.dropped) % 8]struct{}{}
+)
+
+// The same goes for the counters of a writer's statistics.
+var (
+	_ [0]struct{} = [unsafe.Offsetof(writerStats{}.lines) % 8]struct{}{}
+	_ [0]struct{} = [unsafe.Offsetof(writerStats{}.bytes) % 8]struct{}{}
+	_ [0]struct{} = [unsafe.Offsetof(writerStats{}.dropped) % 8]struct{}{}
+)
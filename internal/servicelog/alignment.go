@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"errors"
+	"sync"
+	"unicode/utf8"
+)
+
+// NameAlignment pads the service names in the prefixes of the formatters
+// sharing it to the same width, so that the messages of services logging
+// to the same place, such as a terminal, start at the same column.
+type NameAlignment struct {
+	mu       sync.RWMutex
+	width    int
+	fixed    bool
+	truncate bool
+}
+
+// NewNameAlignment returns a NameAlignment whose width is that of the
+// longest of names, and of the names of the formatters sharing it. It
+// grows as formatters for longer names are added, never shrinking, so the
+// column the messages start at may move right mid-stream, but not left.
+func NewNameAlignment(names ...string) *NameAlignment {
+	a := &NameAlignment{}
+	for _, name := range names {
+		a.add(name)
+	}
+	return a
+}
+
+// NewFixedNameAlignment returns a NameAlignment of the given width, in
+// characters. Longer names are cut short to fit, ending with "…", if
+// truncate is set, or are written whole, pushing their messages right.
+func NewFixedNameAlignment(width int, truncate bool) (*NameAlignment, error) {
+	if width <= 0 {
+		return nil, errors.New("service name width must be positive")
+	}
+	return &NameAlignment{width: width, fixed: true, truncate: truncate}, nil
+}
+
+// Width returns the current width of the names, in characters.
+func (a *NameAlignment) Width() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.width
+}
+
+// add widens the alignment for name, unless its width is fixed.
+func (a *NameAlignment) add(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n := utf8.RuneCountInString(name); !a.fixed && n > a.width {
+		a.width = n
+	}
+}
+
+// fit returns name cut short to width characters, if it's longer and
+// the alignment truncates, and the number of spaces padding it to width.
+func (a *NameAlignment) fit(name string, width int) (string, int) {
+	n := utf8.RuneCountInString(name)
+	if n > width && a.truncate {
+		cut := 0
+		for i := 0; i < width-1; i++ {
+			_, size := utf8.DecodeRuneInString(name[cut:])
+			cut += size
+		}
+		name = name[:cut] + "…"
+		n = width
+	}
+	if n < width {
+		return name, width - n
+	}
+	return name, 0
+}
+
+// WithAlignment pads the service name in each line's prefix as given by
+// align, which may be shared with the formatters of other services, after
+// the closing bracket:
+//
+//	2021-05-13T03:16:51.001Z [web]      listening on :8080\n
+//	2021-05-13T03:16:51.002Z [database] ready\n
+//
+// The service's name, with its stream if given to WithStream, is added to
+// align, widening it unless its width is fixed. A change in the width
+// applies from the next line on. Like the rest of the prefix, the padding
+// doesn't count towards the bytes written.
+func WithAlignment(align *NameAlignment) FormatOption {
+	return func(f *formatter) error {
+		if align == nil {
+			return errors.New("service name alignment must not be nil")
+		}
+		f.align = align
+		return nil
+	}
+}
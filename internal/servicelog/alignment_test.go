@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type alignmentSuite struct {
+	restore func()
+}
+
+var _ = Suite(&alignmentSuite{})
+
+func (s *alignmentSuite) SetUpTest(c *C) {
+	s.restore = servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+}
+
+func (s *alignmentSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func newAligned(c *C, dest io.Writer, name string, align *servicelog.NameAlignment) io.Writer {
+	w, err := servicelog.NewFormatWriter(dest, name, servicelog.WithAlignment(align))
+	c.Assert(err, IsNil)
+	return w
+}
+
+func (s *alignmentSuite) TestNames(c *C) {
+	b := &bytes.Buffer{}
+	align := servicelog.NewNameAlignment("web", "database")
+	c.Check(align.Width(), Equals, 8)
+	web := newAligned(c, b, "web", align)
+	db := newAligned(c, b, "database", align)
+	n, err := io.WriteString(web, "listening\n")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 10)
+	_, err = io.WriteString(db, "ready\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [web]      listening
+2021-05-13T03:16:51.001Z [database] ready
+`[1:])
+}
+
+func (s *alignmentSuite) TestGrowth(c *C) {
+	// The width grows as formatters for longer names are added, from the
+	// next line on, even one continuing a write.
+	b := &bytes.Buffer{}
+	align := servicelog.NewNameAlignment()
+	web := newAligned(c, b, "web", align)
+	_, err := io.WriteString(web, "first\nsec")
+	c.Assert(err, IsNil)
+	db := newAligned(c, b, "database", align)
+	c.Check(align.Width(), Equals, 8)
+	_, err = io.WriteString(web, "ond\nthird\n")
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(db, "ready\n")
+	c.Assert(err, IsNil)
+
+	// A shorter name doesn't narrow it.
+	newAligned(c, b, "x", align)
+	c.Check(align.Width(), Equals, 8)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [web] first
+2021-05-13T03:16:51.001Z [web] second
+2021-05-13T03:16:51.001Z [web]      third
+2021-05-13T03:16:51.001Z [database] ready
+`[1:])
+}
+
+func (s *alignmentSuite) TestFixed(c *C) {
+	b := &bytes.Buffer{}
+	align, err := servicelog.NewFixedNameAlignment(6, false)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(newAligned(c, b, "web", align), "short\n")
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(newAligned(c, b, "database", align), "longer\n")
+	c.Assert(err, IsNil)
+	c.Check(align.Width(), Equals, 6)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [web]    short
+2021-05-13T03:16:51.001Z [database] longer
+`[1:])
+}
+
+func (s *alignmentSuite) TestTruncate(c *C) {
+	b := &bytes.Buffer{}
+	align, err := servicelog.NewFixedNameAlignment(6, true)
+	c.Assert(err, IsNil)
+	for _, name := range []string{"web", "serve", "server", "database", "café-à-la-carte"} {
+		n, err := io.WriteString(newAligned(c, b, name, align), "line\n")
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, 5)
+	}
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [web]    line
+2021-05-13T03:16:51.001Z [serve]  line
+2021-05-13T03:16:51.001Z [server] line
+2021-05-13T03:16:51.001Z [datab…] line
+2021-05-13T03:16:51.001Z [café-…] line
+`[1:])
+}
+
+func (s *alignmentSuite) TestWithOtherOptions(c *C) {
+	// The stream is aligned along with the name.
+	b := &bytes.Buffer{}
+	align := servicelog.NewNameAlignment()
+	out := newFormatWriter(b, "web", servicelog.WithAlignment(align), servicelog.WithStream("stdout"))
+	db := newFormatWriter(b, "database", servicelog.WithAlignment(align), servicelog.WithLayout(servicelog.LayoutUnixMilli))
+	c.Check(align.Width(), Equals, 10)
+	_, err := io.WriteString(out, "listening\n")
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(db, "ready\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [web/stdout] listening
+1620875811001 [database]   ready
+`[1:])
+
+	// The padding follows the colour reset.
+	b.Reset()
+	w := newFormatWriter(b, "web", servicelog.WithColor(servicelog.ColorAlways), servicelog.WithAlignment(align))
+	_, err = io.WriteString(w, "listening\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Matches, `\x1b\[2m2021-05-13T03:16:51.001Z\x1b\[0m \x1b\[[0-9;]+m\[web\]\x1b\[0m        listening\n`)
+}
+
+func (s *alignmentSuite) TestInvalid(c *C) {
+	_, err := servicelog.NewFixedNameAlignment(0, true)
+	c.Check(err, ErrorMatches, "service name width must be positive")
+	_, err = servicelog.NewFormatWriter(&bytes.Buffer{}, "test", servicelog.WithAlignment(nil))
+	c.Check(err, ErrorMatches, "service name alignment must not be nil")
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// ANSIMaxSequence is the length of the longest escape sequence an ANSI
+// stripper removes. Longer ones are taken to be malformed, and passed on.
+const ANSIMaxSequence = 256
+
+// ansiState is where an ANSI stripper is in an escape sequence.
+type ansiState int
+
+const (
+	ansiText ansiState = iota
+	// ansiEscape follows an ESC, and ansiIntermediate the intermediate
+	// bytes of a sequence such as "ESC ( B".
+	ansiEscape
+	ansiIntermediate
+	// ansiCSI follows a CSI, "ESC [".
+	ansiCSI
+	// ansiOSC follows an OSC, "ESC ]", and ansiOSCEscape an ESC in it,
+	// which starts ST, "ESC \", if it doesn't start another sequence.
+	ansiOSC
+	ansiOSCEscape
+)
+
+// ansiStep is what an ANSI stripper does with a byte of an escape
+// sequence.
+type ansiStep int
+
+const (
+	// ansiMore adds the byte to the sequence, and ansiEnd ends the
+	// sequence with it.
+	ansiMore ansiStep = iota
+	ansiEnd
+	// ansiInvalid passes on the sequence so far, which the byte shows to
+	// be malformed, and starts over from the byte.
+	ansiInvalid
+)
+
+type ansiStripper struct {
+	mu    sync.Mutex
+	dest  io.Writer
+	state ansiState
+	// seq is the escape sequence so far, held back until it's complete.
+	seq []byte
+}
+
+// NewANSIStripWriter returns a writer that removes ANSI escape sequences,
+// such as colours and cursor movement, from a service's output on its way
+// to dest, which is usually a formatter. It removes CSI and OSC sequences,
+// and the escape sequences of two bytes or with intermediate bytes, such
+// as "ESC 7" and "ESC ( B". A sequence split across writes is held back
+// until it's complete. Malformed sequences, those interrupted by a byte
+// they can't contain or longer than ANSIMaxSequence, are passed on as they
+// are. Closing the writer passes on any incomplete sequence held back, and
+// closes dest if it's an io.Closer.
+func NewANSIStripWriter(dest io.Writer) io.Writer {
+	return &ansiStripper{dest: dest}
+}
+
+func (a *ansiStripper) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := 0; i < len(p); {
+		if a.state == ansiText {
+			end := len(p)
+			if j := bytes.IndexByte(p[i:], 0x1b); j >= 0 {
+				end = i + j
+			}
+			n, err := writeFull(a.dest, p[i:end])
+			if err != nil {
+				return i + n, err
+			}
+			if end == len(p) {
+				break
+			}
+			a.state = ansiEscape
+			a.seq = append(a.seq[:0], 0x1b)
+			i = end + 1
+			continue
+		}
+
+		b := p[i]
+		switch a.step(b) {
+		case ansiMore:
+			a.seq = append(a.seq, b)
+			i++
+			if len(a.seq) >= ANSIMaxSequence {
+				if err := a.passSequence(); err != nil {
+					return i, err
+				}
+			}
+		case ansiEnd:
+			a.state = ansiText
+			a.seq = a.seq[:0]
+			i++
+		case ansiInvalid:
+			// An ESC ending an OSC that turns out not to start ST may
+			// start another sequence.
+			restart := a.state == ansiOSCEscape
+			if restart {
+				a.seq = a.seq[:len(a.seq)-1]
+			}
+			if err := a.passSequence(); err != nil {
+				return i, err
+			}
+			if restart {
+				a.state = ansiEscape
+				a.seq = append(a.seq, 0x1b)
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// step returns what to do with b, the next byte of the escape sequence,
+// and moves on to the state it leads to.
+func (a *ansiStripper) step(b byte) ansiStep {
+	switch a.state {
+	case ansiEscape:
+		switch {
+		case b == '[':
+			a.state = ansiCSI
+			return ansiMore
+		case b == ']':
+			a.state = ansiOSC
+			return ansiMore
+		case b >= 0x20 && b <= 0x2f:
+			a.state = ansiIntermediate
+			return ansiMore
+		case b >= 0x30 && b <= 0x7e:
+			return ansiEnd
+		}
+	case ansiIntermediate:
+		switch {
+		case b >= 0x20 && b <= 0x2f:
+			return ansiMore
+		case b >= 0x30 && b <= 0x7e:
+			return ansiEnd
+		}
+	case ansiCSI:
+		// Parameter and intermediate bytes, then a final byte.
+		switch {
+		case b >= 0x20 && b <= 0x3f:
+			return ansiMore
+		case b >= 0x40 && b <= 0x7e:
+			return ansiEnd
+		}
+	case ansiOSC:
+		switch {
+		case b == 0x07:
+			return ansiEnd
+		case b == 0x1b:
+			a.state = ansiOSCEscape
+			return ansiMore
+		case b >= 0x20 && b != 0x7f:
+			return ansiMore
+		}
+	case ansiOSCEscape:
+		if b == '\\' {
+			return ansiEnd
+		}
+	}
+	return ansiInvalid
+}
+
+// passSequence passes on the escape sequence held back as it is.
+func (a *ansiStripper) passSequence() error {
+	seq := a.seq
+	a.seq = a.seq[:0]
+	a.state = ansiText
+	_, err := writeFull(a.dest, seq)
+	return err
+}
+
+// Close passes on any incomplete escape sequence held back, and closes
+// dest if it's an io.Closer.
+func (a *ansiStripper) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var err error
+	if len(a.seq) > 0 {
+		err = a.passSequence()
+	}
+	if closeErr := closeWriter(a.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type ansiSuite struct{}
+
+var _ = Suite(&ansiSuite{})
+
+var ansiTests = []struct {
+	summary string
+	input   string
+	output  string
+}{{
+	summary: "SGR colours",
+	input:   "\x1b[1;32mgreen\x1b[0m and \x1b[38;5;208morange\x1b[m\n",
+	output:  "green and orange\n",
+}, {
+	summary: "Cursor movement",
+	input:   "\x1b[2K\x1b[1Gprogress 50%\r\x1b[A\x1b[?25ldone\x1b[?25h\n",
+	output:  "progress 50%\rdone\n",
+}, {
+	summary: "OSC title ended by BEL",
+	input:   "\x1b]0;my title\x07text\n",
+	output:  "text\n",
+}, {
+	summary: "OSC hyperlink ended by ST",
+	input:   "\x1b]8;;http://example.com/\x1b\\link\x1b]8;;\x1b\\\n",
+	output:  "link\n",
+}, {
+	summary: "Other escape sequences",
+	input:   "\x1b7saved\x1b8 \x1b(Bcharset\x1bc\n",
+	output:  "saved charset\n",
+}, {
+	summary: "Text around sequences is kept",
+	input:   "[\x1b[31m[x]\x1b[0m]\n",
+	output:  "[[x]]\n",
+}, {
+	summary: "CSI interrupted by a newline",
+	input:   "\x1b[12\nnext\n",
+	output:  "\x1b[12\nnext\n",
+}, {
+	summary: "OSC interrupted by a newline",
+	input:   "\x1b]0;title\nnext\n",
+	output:  "\x1b]0;title\nnext\n",
+}, {
+	summary: "OSC interrupted by another sequence",
+	input:   "\x1b]0;title\x1b[31mred\n",
+	output:  "\x1b]0;titlered\n",
+}, {
+	summary: "Repeated ESC",
+	input:   "\x1b\x1b[1mbold\n",
+	output:  "\x1bbold\n",
+}, {
+	summary: "Sequence too long",
+	input:   "\x1b]0;" + strings.Repeat("t", servicelog.ANSIMaxSequence) + "\x07\n",
+	output:  "\x1b]0;" + strings.Repeat("t", servicelog.ANSIMaxSequence) + "\x07\n",
+}, {
+	summary: "Incomplete at the end",
+	input:   "text\x1b[3",
+	output:  "text\x1b[3",
+}}
+
+func (s *ansiSuite) TestStrip(c *C) {
+	for _, test := range ansiTests {
+		b := &bytes.Buffer{}
+		w := servicelog.NewANSIStripWriter(b)
+		n, err := io.WriteString(w, test.input)
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, len(test.input))
+		c.Assert(w.(io.Closer).Close(), IsNil)
+		c.Check(b.String(), Equals, test.output, Commentf(test.summary))
+	}
+}
+
+func (s *ansiSuite) TestSplit(c *C) {
+	// A sequence split across writes is held back until it's complete,
+	// and nothing after it is.
+	b := &bytes.Buffer{}
+	w := servicelog.NewANSIStripWriter(b)
+	for _, p := range []string{"start \x1b[", "32mgreen\x1b", "]0;ti", "tle\x1b", "\\end\n"} {
+		n, err := io.WriteString(w, p)
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, len(p))
+	}
+	c.Check(b.String(), Equals, "start green"+"end\n")
+
+	b.Reset()
+	_, err := io.WriteString(w, "held \x1b[1")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "held ")
+	_, err = io.WriteString(w, "\nkept\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "held \x1b[1\nkept\n")
+}
+
+func (s *ansiSuite) TestChunking(c *C) {
+	inputs := append([]string(nil), chunkingInputs...)
+	for _, test := range ansiTests {
+		inputs = append(inputs, test.input)
+	}
+	newWriter := func(dest io.Writer) io.Writer {
+		return servicelog.NewANSIStripWriter(dest)
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		err := checkChunking(newWriter, inputs, seed, 20)
+		c.Assert(err, IsNil, Commentf("seed %d", seed))
+	}
+}
+
+func (s *ansiSuite) TestFormatted(c *C) {
+	restore := servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+	defer restore()
+	b := &bytes.Buffer{}
+	w := servicelog.NewANSIStripWriter(newFormatWriter(b, "test"))
+	_, err := io.WriteString(w, "\x1b[32mok\x1b[0m\n\x1b[31mfail")
+	c.Assert(err, IsNil)
+	c.Assert(w.(io.Closer).Close(), IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] ok
+2021-05-13T03:16:51.001Z [test] fail [incomplete line]
+`[1:])
+}
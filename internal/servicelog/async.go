@@ -0,0 +1,267 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var errAsyncClosed = errors.New("log writer is closed")
+
+// AsyncWriter decouples a service's log pipeline from a destination that
+// may block, such as a network forwarder or a slow disk, so that it can't
+// stall the service. Writes only queue whole lines, up to the writer's size
+// in bytes, and a goroutine writes them to the destination.
+//
+// When the queue is full, lines are dropped whole, and counted. A line
+// that doesn't fit in the queue is dropped as soon as that's known, even
+// if it's incomplete. Once lines fit again, they're preceded by a line
+// saying how many were dropped.
+type AsyncWriter struct {
+	mu           sync.Mutex
+	dest         io.Writer
+	size         int
+	closeTimeout time.Duration
+
+	// queue holds the complete lines to write to dest, and line the
+	// incomplete line after them. inFlight is the number of bytes taken
+	// from the queue being written to dest, which count towards the size.
+	queue    []byte
+	spare    []byte
+	line     []byte
+	inFlight int
+	// dropping is set while the rest of a dropped line is discarded.
+	// stats counts the lines dropped, and unnoticed those that haven't
+	// been mentioned in a notice yet. cutLine is set if a failed write
+	// stopped in the middle of a line, which the notice ends.
+	dropping  bool
+	stats     *writerStats
+	unnoticed int
+	cutLine   bool
+	// err is the error from the last failed write to dest, returned by the
+	// next Write or Close.
+	err    error
+	closed bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// NewAsyncWriter returns an AsyncWriter that queues up to size bytes for
+// dest, and waits up to closeTimeout for them to be written when it's
+// closed.
+func NewAsyncWriter(dest io.Writer, size int, closeTimeout time.Duration) *AsyncWriter {
+	a := &AsyncWriter{
+		dest:         dest,
+		size:         size,
+		closeTimeout: closeTimeout,
+		wake:         make(chan struct{}, 1),
+		stats:        &writerStats{},
+		done:         make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Write queues the lines in p, dropping those that don't fit, and always
+// returns promptly. It returns the error from a failed write to dest, if
+// there was one since the last Write, without queuing anything.
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return 0, errAsyncClosed
+	}
+	if err := a.err; err != nil {
+		a.err = nil
+		return 0, err
+	}
+	written := len(p)
+	queued := false
+	for len(p) > 0 {
+		chunk := p
+		end := false
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			chunk = p[:i+1]
+			end = true
+		}
+		p = p[len(chunk):]
+		if a.dropping {
+			a.dropping = !end
+			continue
+		}
+		if a.used()+len(a.line)+len(chunk) > a.size {
+			a.line = a.line[:0]
+			a.dropping = !end
+			a.stats.addDropped(1)
+			a.unnoticed++
+			continue
+		}
+		a.line = append(a.line, chunk...)
+		if end {
+			queued = a.queueLine() || queued
+		}
+	}
+	if queued {
+		select {
+		case a.wake <- struct{}{}:
+		default:
+		}
+	}
+	return written, nil
+}
+
+// used returns the number of bytes of the queue in use.
+func (a *AsyncWriter) used() int {
+	return len(a.queue) + a.inFlight
+}
+
+// queueLine moves the line to the queue, after a notice of the lines
+// dropped before it if there are any, and reports whether it was queued:
+// if the notice doesn't fit with it, the line is dropped too.
+func (a *AsyncWriter) queueLine() bool {
+	defer func() {
+		a.line = a.line[:0]
+	}()
+	if a.unnoticed > 0 {
+		notice := a.notice()
+		if a.used()+len(notice)+len(a.line) > a.size {
+			a.stats.addDropped(1)
+			a.unnoticed++
+			return false
+		}
+		a.queue = append(a.queue, notice...)
+		a.unnoticed = 0
+		a.cutLine = false
+	}
+	a.queue = append(a.queue, a.line...)
+	return true
+}
+
+// notice returns the line saying how many lines were dropped.
+func (a *AsyncWriter) notice() string {
+	notice := fmt.Sprintf("(... dropped %d log lines ...)\n", a.unnoticed)
+	if a.cutLine {
+		notice = IncompleteLineMarker + "\n" + notice
+	}
+	return notice
+}
+
+// Dropped returns the number of lines dropped so far.
+func (a *AsyncWriter) Dropped() int {
+	return int(a.stats.droppedLines())
+}
+
+// Stats returns the writer's statistics, counting the lines written to
+// dest by its goroutine so far.
+func (a *AsyncWriter) Stats() WriterStats {
+	return a.stats.snapshot()
+}
+
+// run writes the queue to dest until the writer is closed and the queue
+// is empty.
+func (a *AsyncWriter) run() {
+	defer close(a.done)
+	for {
+		a.mu.Lock()
+		for len(a.queue) == 0 && !a.closed {
+			a.mu.Unlock()
+			<-a.wake
+			a.mu.Lock()
+		}
+		if len(a.queue) == 0 {
+			a.mu.Unlock()
+			return
+		}
+		batch := a.queue
+		a.queue, a.spare = a.spare[:0], nil
+		a.inFlight = len(batch)
+		a.mu.Unlock()
+
+		n, err := a.stats.writeFull(a.dest, batch)
+
+		a.mu.Lock()
+		a.inFlight = 0
+		if err != nil {
+			// The rest of the batch is dropped, and the line cut off by
+			// the failure ended by the notice.
+			rest := batch[n:]
+			lines := bytes.Count(rest, []byte{'\n'})
+			if rest[len(rest)-1] != '\n' {
+				lines++
+			}
+			a.stats.addDropped(int64(lines))
+			a.unnoticed += lines
+			a.cutLine = a.cutLine || (n > 0 && batch[n-1] != '\n')
+			a.err = err
+		}
+		if cap(batch) <= 2*a.size {
+			a.spare = batch[:0]
+		}
+		a.mu.Unlock()
+	}
+}
+
+// Close queues the incomplete line, if any, and any notice of lines
+// dropped, and waits for the queue to be written to dest, and then closes
+// dest if it's an io.Closer. If that takes longer than the writer's close
+// timeout, the rest of the queue is dropped and dest isn't closed, as a
+// write to it is still in progress.
+func (a *AsyncWriter) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	if !a.dropping && len(a.line) > 0 {
+		a.queueLine()
+	}
+	if a.unnoticed > 0 {
+		a.queue = append(a.queue, a.notice()...)
+		a.unnoticed = 0
+	}
+	a.mu.Unlock()
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+
+	timer := clock.NewTimer(a.closeTimeout)
+	defer timer.Stop()
+	select {
+	case <-a.done:
+	case <-timer.C():
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		pending := a.used()
+		a.queue = nil
+		return fmt.Errorf("cannot write %d bytes of logs in time", pending)
+	}
+
+	a.mu.Lock()
+	err := a.err
+	a.err = nil
+	a.mu.Unlock()
+	if closeErr := closeWriter(a.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
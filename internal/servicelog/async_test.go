@@ -0,0 +1,166 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type asyncSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&asyncSuite{})
+
+func (s *asyncSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *asyncSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// waitFor polls cond until it's true, failing the test after a while.
+func waitFor(c *C, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			c.Fatalf("timed out waiting for the log writer")
+		}
+	}
+}
+
+func (s *asyncSuite) TestWrite(c *C) {
+	dest := &closeRecorder{}
+	a := servicelog.NewAsyncWriter(dest, 64, time.Second)
+	for _, p := range []string{"first\nsec", "ond\nthi"} {
+		n, err := io.WriteString(a, p)
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, len(p))
+	}
+
+	// The incomplete line is written when the writer is closed.
+	c.Assert(a.Close(), IsNil)
+	c.Check(dest.String(), Equals, "first\nsecond\nthi")
+	c.Check(dest.closed, Equals, true)
+	c.Check(a.Dropped(), Equals, 0)
+
+	_, err := io.WriteString(a, "more\n")
+	c.Check(err, ErrorMatches, "log writer is closed")
+}
+
+func (s *asyncSuite) TestSlowDestination(c *C) {
+	dest := servicelogtest.NewScriptedWriter(servicelogtest.Block())
+	a := servicelog.NewAsyncWriter(dest, 64, time.Second)
+	_, err := io.WriteString(a, "first\n")
+	c.Assert(err, IsNil)
+	waitFor(c, func() bool { return len(dest.Calls()) == 1 })
+
+	// With the write of the first line blocked, the queue has room for
+	// 58 bytes: 8 lines, and writes return without waiting for dest.
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		_, err := fmt.Fprintf(a, "line %d\n", i)
+		c.Assert(err, IsNil)
+	}
+	// An incomplete line is dropped whole.
+	for _, p := range []string{"partial", " line\n"} {
+		_, err := io.WriteString(a, p)
+		c.Assert(err, IsNil)
+	}
+	c.Check(time.Since(start) < time.Second, Equals, true)
+	c.Check(a.Dropped(), Equals, 5)
+
+	dest.Release()
+	waitFor(c, func() bool { return len(dest.String()) == 6+8*7 })
+
+	// Once there's room, the next line says how many were dropped.
+	_, err = io.WriteString(a, "after\n")
+	c.Assert(err, IsNil)
+	c.Assert(a.Close(), IsNil)
+	var expected strings.Builder
+	expected.WriteString("first\n")
+	for i := 0; i < 8; i++ {
+		fmt.Fprintf(&expected, "line %d\n", i)
+	}
+	expected.WriteString("(... dropped 5 log lines ...)\nafter\n")
+	c.Check(dest.String(), Equals, expected.String())
+	c.Check(a.Dropped(), Equals, 5)
+}
+
+func (s *asyncSuite) TestWriteError(c *C) {
+	errFailed := errors.New("failed")
+	dest := servicelogtest.NewScriptedWriter(servicelogtest.FailAfter(3, errFailed))
+	a := servicelog.NewAsyncWriter(dest, 64, time.Second)
+	_, err := io.WriteString(a, "first\nsecond\n")
+	c.Assert(err, IsNil)
+	waitFor(c, func() bool { return a.Dropped() == 2 })
+
+	// The error is returned by the next write, which isn't queued, and the
+	// line cut off is ended before the notice.
+	_, err = io.WriteString(a, "third\n")
+	c.Check(err, Equals, errFailed)
+	_, err = io.WriteString(a, "fourth\n")
+	c.Assert(err, IsNil)
+	c.Assert(a.Close(), IsNil)
+	c.Check(dest.String(), Equals, "fir"+servicelog.IncompleteLineMarker+"\n(... dropped 2 log lines ...)\nfourth\n")
+}
+
+func (s *asyncSuite) TestCloseNotice(c *C) {
+	dest := servicelogtest.NewScriptedWriter(servicelogtest.Block())
+	a := servicelog.NewAsyncWriter(dest, 8, time.Second)
+	_, err := io.WriteString(a, "first\nsecond\n")
+	c.Assert(err, IsNil)
+	waitFor(c, func() bool { return len(dest.Calls()) == 1 })
+	dest.Release()
+
+	// Lines dropped since the last line written are noted when closing.
+	c.Assert(a.Close(), IsNil)
+	c.Check(dest.String(), Equals, "first\n(... dropped 1 log lines ...)\n")
+}
+
+func (s *asyncSuite) TestCloseTimeout(c *C) {
+	dest := servicelogtest.NewScriptedWriter(servicelogtest.Block())
+	a := servicelog.NewAsyncWriter(dest, 64, time.Second)
+	_, err := io.WriteString(a, "first\n")
+	c.Assert(err, IsNil)
+	waitFor(c, func() bool { return len(dest.Calls()) == 1 })
+	_, err = io.WriteString(a, "second\n")
+	c.Assert(err, IsNil)
+
+	done := make(chan error)
+	go func() {
+		done <- a.Close()
+	}()
+	waitTimer(c, s.clock)
+	s.clock.Advance(time.Second)
+	select {
+	case err := <-done:
+		c.Check(err, ErrorMatches, "cannot write 13 bytes of logs in time")
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for Close")
+	}
+	dest.Release()
+}
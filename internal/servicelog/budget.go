@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"sync/atomic"
+)
+
+// Budget bounds the total memory used by log buffers across services.
+// Buffers reserve their memory from the budget when they're allocated and
+// release it when they shrink or are freed. All operations are lock-free,
+// so one Budget can be shared by any number of buffers. A nil *Budget is
+// unlimited.
+type Budget struct {
+	// The fields are accessed atomically, so they must stay at the start
+	// of the struct to be 64-bit aligned on 32-bit platforms.
+	limit   int64
+	used    int64
+	denied  int64
+	dropped int64
+}
+
+// BudgetStats is a snapshot of a Budget's accounting.
+type BudgetStats struct {
+	// Limit is the maximum number of bytes, or 0 if unlimited.
+	Limit int64
+	// Used is the number of bytes currently reserved.
+	Used int64
+	// Denied is the number of reservations refused for lack of memory.
+	Denied int64
+	// Dropped is the number of log bytes dropped because a buffer
+	// couldn't reserve any memory.
+	Dropped int64
+}
+
+// NewBudget returns a budget of limit bytes, or an unlimited one if limit
+// is zero or negative.
+func NewBudget(limit int64) *Budget {
+	b := &Budget{}
+	b.SetLimit(limit)
+	return b
+}
+
+// SetLimit changes the budget's limit (zero or negative for unlimited).
+// Memory already reserved is not released if the new limit is lower.
+func (b *Budget) SetLimit(limit int64) {
+	if limit < 0 {
+		limit = 0
+	}
+	atomic.StoreInt64(&b.limit, limit)
+}
+
+// Reserve reserves between min and max bytes, as many as are available,
+// and returns the number reserved. If fewer than min bytes are available,
+// nothing is reserved and it returns 0.
+func (b *Budget) Reserve(min, max int) int {
+	if b == nil {
+		return max
+	}
+	for {
+		limit := atomic.LoadInt64(&b.limit)
+		used := atomic.LoadInt64(&b.used)
+		n := int64(max)
+		if limit > 0 && used+n > limit {
+			n = limit - used
+			if n < int64(min) || n <= 0 {
+				atomic.AddInt64(&b.denied, 1)
+				return 0
+			}
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			return int(n)
+		}
+	}
+}
+
+// Release returns n previously reserved bytes to the budget.
+func (b *Budget) Release(n int) {
+	if b == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&b.used, -int64(n))
+}
+
+// Available returns the number of bytes that can currently be reserved,
+// or -1 if the budget is unlimited.
+func (b *Budget) Available() int64 {
+	if b == nil {
+		return -1
+	}
+	limit := atomic.LoadInt64(&b.limit)
+	if limit == 0 {
+		return -1
+	}
+	available := limit - atomic.LoadInt64(&b.used)
+	if available < 0 {
+		available = 0
+	}
+	return available
+}
+
+// addDropped records n bytes of logs dropped for lack of memory.
+func (b *Budget) addDropped(n int) {
+	if b == nil {
+		return
+	}
+	atomic.AddInt64(&b.dropped, int64(n))
+}
+
+// Stats returns a snapshot of the budget's accounting.
+func (b *Budget) Stats() BudgetStats {
+	if b == nil {
+		return BudgetStats{}
+	}
+	return BudgetStats{
+		Limit:   atomic.LoadInt64(&b.limit),
+		Used:    atomic.LoadInt64(&b.used),
+		Denied:  atomic.LoadInt64(&b.denied),
+		Dropped: atomic.LoadInt64(&b.dropped),
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"fmt"
+	"sync"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type budgetSuite struct{}
+
+var _ = Suite(&budgetSuite{})
+
+func (s *budgetSuite) TestReserve(c *C) {
+	b := servicelog.NewBudget(100)
+	c.Assert(b.Reserve(10, 60), Equals, 60)
+	c.Assert(b.Available(), Equals, int64(40))
+	c.Assert(b.Reserve(10, 60), Equals, 40)
+	c.Assert(b.Reserve(1, 10), Equals, 0)
+	c.Assert(b.Stats(), Equals, servicelog.BudgetStats{Limit: 100, Used: 100, Denied: 1})
+
+	b.Release(50)
+	c.Assert(b.Reserve(60, 60), Equals, 0)
+	c.Assert(b.Reserve(50, 60), Equals, 50)
+	c.Assert(b.Stats(), Equals, servicelog.BudgetStats{Limit: 100, Used: 100, Denied: 2})
+
+	// Lowering the limit doesn't release anything, but stops reservations.
+	b.SetLimit(50)
+	c.Assert(b.Available(), Equals, int64(0))
+	c.Assert(b.Reserve(1, 1), Equals, 0)
+	b.Release(60)
+	c.Assert(b.Reserve(1, 100), Equals, 10)
+}
+
+func (s *budgetSuite) TestUnlimited(c *C) {
+	b := servicelog.NewBudget(0)
+	c.Assert(b.Reserve(10, 1<<30), Equals, 1<<30)
+	c.Assert(b.Available(), Equals, int64(-1))
+	c.Assert(b.Stats(), Equals, servicelog.BudgetStats{Used: 1 << 30})
+
+	var nilBudget *servicelog.Budget
+	c.Assert(nilBudget.Reserve(10, 100), Equals, 100)
+	nilBudget.Release(100)
+	c.Assert(nilBudget.Available(), Equals, int64(-1))
+	c.Assert(nilBudget.Stats(), Equals, servicelog.BudgetStats{})
+}
+
+func (s *budgetSuite) TestContention(c *C) {
+	// Many pipelines allocating and freeing buffers concurrently must never
+	// take the budget over its limit, and must leave it empty when done.
+	const limit = 64 * 1024
+	b := servicelog.NewBudget(limit)
+	var wg sync.WaitGroup
+	errs := make(chan error, 60)
+	for i := 0; i < 60; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				rb := servicelog.NewRingBufferWithBudget(4096+i*100, b)
+				if used := b.Stats().Used; used > limit {
+					errs <- fmt.Errorf("budget used %d is over limit %d", used, limit)
+					return
+				}
+				fmt.Fprintf(rb, "pipeline %d line %d\n", i, j)
+				if j%3 == 0 {
+					rb.Shrink(rb.Size() / 2)
+				}
+				rb.Free()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Error(err)
+	}
+	stats := b.Stats()
+	c.Assert(stats.Used, Equals, int64(0))
+	c.Logf("denied %d, dropped %d", stats.Denied, stats.Dropped)
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CapWriter caps the total output a service's run can log. Once the run
+// has logged its limit of bytes or lines, it writes a notice that the
+// limit has been reached, as a line of its own, and from then on counts
+// but drops all the service's output, while reporting it as written.
+//
+// The cap applies at a line boundary, so the last line passed on is
+// complete: with a limit of bytes, an incomplete line is held back until
+// it ends, and a line that would take the output over the limit is
+// dropped whole. Composed in front of a formatter, the notice gets the
+// usual prefix, and the prefixes don't count towards the limit.
+type CapWriter struct {
+	mu          sync.Mutex
+	dest        io.Writer
+	serviceName string
+	maxBytes    int64
+	maxLines    int64
+
+	// bytes and lines count what's been passed on. held is the start of a
+	// line held back until it's complete, with a limit of bytes, and
+	// midLine is set while the rest of a line passed on is due, without.
+	bytes   int64
+	lines   int64
+	held    []byte
+	midLine bool
+
+	// capped is set once the limit has been reached, and dropping while
+	// the rest of a suppressed line is discarded.
+	capped          bool
+	dropping        bool
+	suppressedBytes int64
+	// stats counts the lines suppressed, as dropped.
+	stats  *writerStats
+	closed bool
+}
+
+// NewCapWriter returns a CapWriter for the service's output that writes
+// to dest, passing on up to maxBytes bytes and maxLines lines. A limit of
+// zero means no limit of that kind, but there must be one or the other.
+func NewCapWriter(dest io.Writer, serviceName string, maxBytes, maxLines int64) (*CapWriter, error) {
+	if maxBytes < 0 {
+		return nil, errors.New("log output limit of bytes must not be negative")
+	}
+	if maxLines < 0 {
+		return nil, errors.New("log output limit of lines must not be negative")
+	}
+	if maxBytes == 0 && maxLines == 0 {
+		return nil, errors.New("log output limit must be set")
+	}
+	return &CapWriter{
+		dest:        dest,
+		serviceName: serviceName,
+		maxBytes:    maxBytes,
+		maxLines:    maxLines,
+		stats:       &writerStats{},
+	}, nil
+}
+
+// Write passes on the lines in p that are within the limit, and reports
+// the suppressed ones as written too.
+func (w *CapWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return w.stats.write(w.dest, p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		end := false
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			chunk = p[:i+1]
+			end = true
+		}
+		if w.capped {
+			w.suppress(chunk, end)
+			written += len(chunk)
+			p = p[len(chunk):]
+			continue
+		}
+		atStart := len(w.held) == 0 && !w.midLine
+		if atStart && w.maxLines > 0 && w.lines >= w.maxLines {
+			limit := fmt.Sprintf("%d lines", w.maxLines)
+			if w.maxLines == 1 {
+				limit = "1 line"
+			}
+			if err := w.reached(limit); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if w.maxBytes > 0 {
+			size := int64(len(w.held) + len(chunk))
+			if w.bytes+size > w.maxBytes {
+				// The line doesn't fit: it's dropped whole, along with
+				// its start, if that's been held back.
+				if len(w.held) > 0 {
+					w.suppress(w.held, false)
+					w.held = nil
+				}
+				if err := w.reached(formatSize(w.maxBytes)); err != nil {
+					return written, err
+				}
+				continue
+			}
+			if !end {
+				w.held = append(w.held, chunk...)
+				written += len(chunk)
+				p = p[len(chunk):]
+				continue
+			}
+			line := chunk
+			if len(w.held) > 0 {
+				line = append(w.held, chunk...)
+				w.held = nil
+			}
+			if _, err := w.stats.writeFull(w.dest, line); err != nil {
+				return written, err
+			}
+			w.bytes += size
+			w.lines++
+			written += len(chunk)
+			p = p[len(chunk):]
+			continue
+		}
+		n, err := w.stats.writeFull(w.dest, chunk)
+		written += n
+		w.bytes += int64(n)
+		if err != nil {
+			return written, err
+		}
+		w.midLine = !end
+		if end {
+			w.lines++
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// reached writes the notice that the limit, as given, has been reached,
+// from when on all output is suppressed.
+func (w *CapWriter) reached(limit string) error {
+	w.capped = true
+	notice := fmt.Sprintf("[pebble] log output limit (%s) reached for service %s; further output suppressed\n", limit, w.serviceName)
+	_, err := w.stats.writeFull(w.dest, []byte(notice))
+	return err
+}
+
+// suppress counts chunk, which ends a line if end is set, as suppressed.
+func (w *CapWriter) suppress(chunk []byte, end bool) {
+	if !w.dropping {
+		w.stats.addDropped(1)
+	}
+	w.dropping = !end
+	w.suppressedBytes += int64(len(chunk))
+}
+
+// formatSize formats a number of bytes in the largest binary unit that
+// it's a whole number of.
+func formatSize(n int64) string {
+	switch {
+	case n%(1<<30) == 0:
+		return fmt.Sprintf("%dGiB", n>>30)
+	case n%(1<<20) == 0:
+		return fmt.Sprintf("%dMiB", n>>20)
+	case n%(1<<10) == 0:
+		return fmt.Sprintf("%dKiB", n>>10)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// Capped reports whether the limit has been reached.
+func (w *CapWriter) Capped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.capped
+}
+
+// Suppressed returns the number of bytes and lines of output suppressed
+// so far.
+func (w *CapWriter) Suppressed() (bytes, lines int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.suppressedBytes, w.stats.droppedLines()
+}
+
+// Stats returns the writer's statistics, counting the lines suppressed as
+// dropped.
+func (w *CapWriter) Stats() WriterStats {
+	return w.stats.snapshot()
+}
+
+// Close passes on the start of a line held back, which is within the
+// limit, and closes dest, if it's an io.Closer. Writes after Close go
+// straight to dest.
+func (w *CapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	var err error
+	if len(w.held) > 0 {
+		w.bytes += int64(len(w.held))
+		_, err = w.stats.writeFull(w.dest, w.held)
+		w.held = nil
+	}
+	if closeErr := closeWriter(w.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type capSuite struct{}
+
+var _ = Suite(&capSuite{})
+
+func (s *capSuite) TestNew(c *C) {
+	_, err := servicelog.NewCapWriter(&bytes.Buffer{}, "test", -1, 0)
+	c.Check(err, ErrorMatches, "log output limit of bytes must not be negative")
+	_, err = servicelog.NewCapWriter(&bytes.Buffer{}, "test", 0, -1)
+	c.Check(err, ErrorMatches, "log output limit of lines must not be negative")
+	_, err = servicelog.NewCapWriter(&bytes.Buffer{}, "test", 0, 0)
+	c.Check(err, ErrorMatches, "log output limit must be set")
+}
+
+func (s *capSuite) TestBytesMidWrite(c *C) {
+	dest := &bytes.Buffer{}
+	w, err := servicelog.NewCapWriter(dest, "test", 20, 0)
+	c.Assert(err, IsNil)
+
+	// The third line would take the output over the limit, so it's
+	// dropped whole, partway through the write.
+	n, err := w.Write([]byte("line 1\nline 2\nline 3\nline 4\n"))
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 28)
+	n, err = w.Write([]byte("line 5\npartial"))
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 14)
+	c.Assert(w.Close(), IsNil)
+
+	c.Check(dest.String(), Equals, "line 1\nline 2\n"+
+		"[pebble] log output limit (20 bytes) reached for service test; further output suppressed\n")
+	c.Check(w.Capped(), Equals, true)
+	suppressedBytes, suppressedLines := w.Suppressed()
+	c.Check(suppressedBytes, Equals, int64(28))
+	c.Check(suppressedLines, Equals, int64(4))
+	stats := w.Stats()
+	c.Check(stats.Dropped, Equals, int64(4))
+	c.Check(stats.Lines, Equals, int64(3))
+}
+
+func (s *capSuite) TestBytesHeldLine(c *C) {
+	dest := &bytes.Buffer{}
+	w, err := servicelog.NewCapWriter(dest, "test", 10, 0)
+	c.Assert(err, IsNil)
+
+	// The start of a line is held back until it's known to fit.
+	_, err = w.Write([]byte("abc"))
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, "")
+	_, err = w.Write([]byte("def\n"))
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, "abcdef\n")
+
+	// A held line that turns out not to fit is dropped with the rest.
+	_, err = w.Write([]byte("gh"))
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("ij\nkl\n"))
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, "abcdef\n"+
+		"[pebble] log output limit (10 bytes) reached for service test; further output suppressed\n")
+	suppressedBytes, suppressedLines := w.Suppressed()
+	c.Check(suppressedBytes, Equals, int64(8))
+	c.Check(suppressedLines, Equals, int64(2))
+}
+
+func (s *capSuite) TestBytesExact(c *C) {
+	dest := &bytes.Buffer{}
+	w, err := servicelog.NewCapWriter(dest, "test", 2<<20, 0)
+	c.Assert(err, IsNil)
+
+	line := append(bytes.Repeat([]byte("x"), 1023), '\n')
+	for i := 0; i < 2048; i++ {
+		_, err = w.Write(line)
+		c.Assert(err, IsNil)
+	}
+	c.Check(w.Capped(), Equals, false)
+	c.Check(dest.Len(), Equals, 2<<20)
+
+	_, err = w.Write([]byte("more\n"))
+	c.Assert(err, IsNil)
+	c.Check(w.Capped(), Equals, true)
+	c.Check(dest.String()[2<<20:], Equals,
+		"[pebble] log output limit (2MiB) reached for service test; further output suppressed\n")
+}
+
+func (s *capSuite) TestLines(c *C) {
+	dest := &bytes.Buffer{}
+	w, err := servicelog.NewCapWriter(dest, "test", 0, 2)
+	c.Assert(err, IsNil)
+
+	// Without a limit of bytes, an incomplete line isn't held back.
+	_, err = w.Write([]byte("one\ntw"))
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, "one\ntw")
+	_, err = w.Write([]byte("o\nthree\nfour"))
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte(" more\nfive\n"))
+	c.Assert(err, IsNil)
+
+	c.Check(dest.String(), Equals, "one\ntwo\n"+
+		"[pebble] log output limit (2 lines) reached for service test; further output suppressed\n")
+	suppressedBytes, suppressedLines := w.Suppressed()
+	c.Check(suppressedBytes, Equals, int64(21))
+	c.Check(suppressedLines, Equals, int64(3))
+}
+
+func (s *capSuite) TestNoticeOnce(c *C) {
+	dest := &bytes.Buffer{}
+	w, err := servicelog.NewCapWriter(dest, "test", 100, 1)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 10; i++ {
+		_, err = w.Write([]byte("a line\nanother line\n"))
+		c.Assert(err, IsNil)
+	}
+	c.Check(dest.String(), Equals, "a line\n"+
+		"[pebble] log output limit (1 line) reached for service test; further output suppressed\n")
+	c.Check(bytes.Count(dest.Bytes(), []byte("[pebble]")), Equals, 1)
+}
+
+func (s *capSuite) TestCloseHeld(c *C) {
+	dest := &closeRecorder{}
+	w, err := servicelog.NewCapWriter(dest, "test", 100, 0)
+	c.Assert(err, IsNil)
+
+	_, err = w.Write([]byte("done\nprompt> "))
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, "done\n")
+	c.Assert(w.Close(), IsNil)
+	c.Check(dest.String(), Equals, "done\nprompt> ")
+	c.Check(dest.closed, Equals, true)
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+// chunkingInputs are inputs with the usual trouble spots for line-based
+// writers: empty lines, CRLF, lone carriage returns, no trailing newline,
+// and long lines.
+var chunkingInputs = []string{
+	"",
+	"\n",
+	"\n\n\n",
+	"a",
+	"first\nsecond\nthird\n",
+	"no trailing newline\nlast",
+	"crlf\r\nline\r\n\r\n",
+	"\rmixed\r\nendings\rin\r\rone\nstream\r",
+	strings.Repeat("long line ", 5000) + "\n" + strings.Repeat("x", 40000),
+	strings.Repeat("short\n", 5000),
+}
+
+// checkChunking checks that the writers returned by newWriter produce the
+// same output whatever the sizes of the writes the input is split into. For
+// each input, it compares a single Write with the given number of
+// pseudo-random chunkings generated from seed (including zero-length
+// writes), and checks that the counts returned add up to the input length.
+// Writers that are io.Closers are closed after the input is written, so
+// that anything they hold back is compared too. It returns an error
+// describing the first violation found.
+func checkChunking(newWriter func(dest io.Writer) io.Writer, inputs []string, seed int64, rounds int) error {
+	rnd := rand.New(rand.NewSource(seed))
+	for _, input := range inputs {
+		expected := &bytes.Buffer{}
+		w := newWriter(expected)
+		n, err := w.Write([]byte(input))
+		if err != nil {
+			return fmt.Errorf("input %.20q: single write failed: %v", input, err)
+		}
+		if n != len(input) {
+			return fmt.Errorf("input %.20q: single write returned %d, want %d", input, n, len(input))
+		}
+		if err := closeChunked(w); err != nil {
+			return fmt.Errorf("input %.20q: close failed: %v", input, err)
+		}
+
+		for round := 0; round < rounds; round++ {
+			// Mostly small chunks, with the odd large one.
+			maxChunk := 1 + rnd.Intn(16)
+			if rnd.Intn(4) == 0 {
+				maxChunk = 1 + rnd.Intn(len(input)+1)
+			}
+			output := &bytes.Buffer{}
+			w := newWriter(output)
+			total := 0
+			for remaining := []byte(input); len(remaining) > 0; {
+				size := rnd.Intn(maxChunk + 1)
+				if size > len(remaining) {
+					size = len(remaining)
+				}
+				n, err := w.Write(remaining[:size])
+				if err != nil {
+					return fmt.Errorf("input %.20q, seed %d round %d: write failed: %v", input, seed, round, err)
+				}
+				total += n
+				remaining = remaining[size:]
+			}
+			if err := closeChunked(w); err != nil {
+				return fmt.Errorf("input %.20q, seed %d round %d: close failed: %v", input, seed, round, err)
+			}
+			if total != len(input) {
+				return fmt.Errorf("input %.20q, seed %d round %d: writes returned %d in total, want %d", input, seed, round, total, len(input))
+			}
+			if !bytes.Equal(output.Bytes(), expected.Bytes()) {
+				i := 0
+				for i < output.Len() && i < expected.Len() && output.Bytes()[i] == expected.Bytes()[i] {
+					i++
+				}
+				return fmt.Errorf("input %.20q, seed %d round %d: output at offset %d %.40q differs from single write output %.40q",
+					input, seed, round, i, output.Bytes()[i:], expected.Bytes()[i:])
+			}
+		}
+	}
+	return nil
+}
+
+func closeChunked(w io.Writer) error {
+	if closer, ok := w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type chunkingSuite struct{}
+
+var _ = Suite(&chunkingSuite{})
+
+func (s *chunkingSuite) TestFormatter(c *C) {
+	restore := servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+	defer restore()
+
+	newWriter := func(dest io.Writer) io.Writer {
+		return newFormatWriter(dest, "test")
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		err := checkChunking(newWriter, chunkingInputs, seed, 20)
+		c.Assert(err, IsNil, Commentf("seed %d", seed))
+	}
+}
+
+func (s *chunkingSuite) TestFormatterGolden(c *C) {
+	restore := servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+	defer restore()
+
+	// The exact output for each input, whatever its chunking, so that
+	// optimizations of the formatter can't change it.
+	const prefix = "2021-05-13T03:16:51.001Z [test] "
+	const incomplete = servicelog.IncompleteLineMarker + "\n"
+	golden := []string{
+		"",
+		prefix + "\n",
+		prefix + "\n" + prefix + "\n" + prefix + "\n",
+		prefix + "a" + incomplete,
+		prefix + "first\n" + prefix + "second\n" + prefix + "third\n",
+		prefix + "no trailing newline\n" + prefix + "last" + incomplete,
+		prefix + "crlf\n" + prefix + "line\n" + prefix + "\n",
+		prefix + "\rmixed\n" + prefix + "endings\rin\r\rone\n" + prefix + "stream" + incomplete,
+		prefix + strings.Repeat("long line ", 5000) + "\n" + prefix + strings.Repeat("x", 40000) + incomplete,
+		strings.Repeat(prefix+"short\n", 5000),
+	}
+	c.Assert(golden, HasLen, len(chunkingInputs))
+	for i, input := range chunkingInputs {
+		var output bytes.Buffer
+		w := newFormatWriter(&output, "test")
+		_, err := io.WriteString(w, input)
+		c.Assert(err, IsNil)
+		c.Assert(closeChunked(w), IsNil)
+		c.Check(output.String() == golden[i], Equals, true, Commentf("input %.20q: got %.80q", input, output.String()))
+	}
+	newWriter := func(dest io.Writer) io.Writer {
+		return newFormatWriter(dest, "test")
+	}
+	c.Assert(checkChunking(newWriter, chunkingInputs, 42, 50), IsNil)
+}
+
+func (s *chunkingSuite) TestFormatterCRLines(c *C) {
+	restore := servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+	defer restore()
+
+	newWriter := func(dest io.Writer) io.Writer {
+		return newFormatWriter(dest, "test", servicelog.WithCRLines())
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		err := checkChunking(newWriter, chunkingInputs, seed, 20)
+		c.Assert(err, IsNil, Commentf("seed %d", seed))
+	}
+}
+
+func (s *chunkingSuite) TestCoalesce(c *C) {
+	restore := servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+	defer restore()
+
+	// The formatted output is the same with and without coalescing, and
+	// whatever the chunking, as long as the delay doesn't expire.
+	newWriter := func(dest io.Writer) io.Writer {
+		return servicelog.NewCoalesceWriter(newFormatWriter(dest, "test"), 50*time.Millisecond)
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		err := checkChunking(newWriter, chunkingInputs, seed, 20)
+		c.Assert(err, IsNil, Commentf("seed %d", seed))
+	}
+	for _, input := range chunkingInputs {
+		coalesced := &bytes.Buffer{}
+		w := newWriter(coalesced)
+		writeBytes(c, w, input)
+		c.Assert(closeChunked(w), IsNil)
+		direct := &bytes.Buffer{}
+		formatter := newFormatWriter(direct, "test")
+		_, err := io.WriteString(formatter, input)
+		c.Assert(err, IsNil)
+		c.Assert(closeChunked(formatter), IsNil)
+		c.Check(coalesced.String(), Equals, direct.String())
+	}
+}
+
+// writeMarker is broken: it writes a marker before every Write call's data,
+// so its output depends on the chunking.
+type writeMarker struct {
+	dest io.Writer
+}
+
+func (w writeMarker) Write(p []byte) (int, error) {
+	w.dest.Write([]byte("|"))
+	return w.dest.Write(p)
+}
+
+// countDropper is broken: it doesn't count the last byte of two-byte
+// writes, so only chunked writes (none of the inputs is two bytes long)
+// reveal it.
+type countDropper struct {
+	dest io.Writer
+}
+
+func (w countDropper) Write(p []byte) (int, error) {
+	n, err := w.dest.Write(p)
+	if n == 2 {
+		n--
+	}
+	return n, err
+}
+
+// lineLoser is broken: it only remembers the last partial line within a
+// single Write, so a line split across writes loses its start.
+type lineLoser struct {
+	dest io.Writer
+}
+
+func (w lineLoser) Write(p []byte) (int, error) {
+	if i := bytes.LastIndexByte(p, '\n'); i >= 0 {
+		w.dest.Write(p[:i+1])
+	}
+	return len(p), nil
+}
+
+func (s *chunkingSuite) TestDetectsBrokenWriters(c *C) {
+	tests := []struct {
+		newWriter func(dest io.Writer) io.Writer
+		error     string
+	}{{
+		newWriter: func(dest io.Writer) io.Writer { return writeMarker{dest} },
+		error:     `.* differs from single write output .*`,
+	}, {
+		newWriter: func(dest io.Writer) io.Writer { return countDropper{dest} },
+		error:     `.* writes returned \d+ in total, want \d+`,
+	}, {
+		newWriter: func(dest io.Writer) io.Writer { return lineLoser{dest} },
+		error:     `.* differs from single write output .*`,
+	}}
+	for _, test := range tests {
+		err := checkChunking(test.newWriter, chunkingInputs, 1, 20)
+		c.Check(err, ErrorMatches, test.error)
+	}
+
+	// Writers that pass through their input unchanged are fine.
+	err := checkChunking(func(dest io.Writer) io.Writer { return dest }, chunkingInputs, 1, 20)
+	c.Check(err, IsNil)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"time"
+)
+
+// Clock is the source of time for the writers in this package, so that
+// tests can control it.
+//
+// Intervals are measured as the difference between times returned by Now,
+// so the real clock's times keep their monotonic clock reading, and steps
+// of the wall clock (NTP or time zone changes) don't affect them. Only
+// timestamps for display use the wall time, converted to UTC.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the subset of time.Timer used by this package.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the subset of time.Ticker used by this package.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock of the system's time.
+var SystemClock Clock = realClock{}
+
+// clock is the Clock used by the package, replaced in tests.
+var clock Clock = SystemClock
+
+// FakeClock sets the Clock used by the package, for tests here and in
+// packages using its writers, which may need their own clock in step.
+func FakeClock(c Clock) (restore func()) {
+	old := clock
+	clock = c
+	return func() {
+		clock = old
+	}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type clockSuite struct{}
+
+var _ = Suite(&clockSuite{})
+
+var clockStart = time.Date(2021, 5, 13, 3, 16, 51, 0, time.UTC)
+
+// received returns the value waiting on ch, or the zero time if there's
+// none.
+func received(ch <-chan time.Time) time.Time {
+	select {
+	case t := <-ch:
+		return t
+	default:
+		return time.Time{}
+	}
+}
+
+func (s *clockSuite) TestNow(c *C) {
+	clock := servicelog.NewTestClock(clockStart)
+	c.Assert(clock.Now(), Equals, clockStart)
+	clock.Advance(time.Second)
+	c.Assert(clock.Now(), Equals, clockStart.Add(time.Second))
+}
+
+func (s *clockSuite) TestStep(c *C) {
+	clock := servicelog.NewTestClock(clockStart)
+	timer := clock.NewTimer(time.Second)
+
+	clock.Step(6 * time.Hour)
+	c.Assert(clock.Now(), Equals, clockStart.Add(6*time.Hour))
+	c.Assert(received(timer.C()).IsZero(), Equals, true)
+
+	clock.Step(-30 * time.Second)
+	clock.Advance(time.Second)
+	c.Assert(clock.Now(), Equals, clockStart.Add(6*time.Hour-29*time.Second))
+	c.Assert(received(timer.C()), Equals, clockStart.Add(6*time.Hour-29*time.Second))
+}
+
+func (s *clockSuite) TestTimer(c *C) {
+	clock := servicelog.NewTestClock(clockStart)
+	timer := clock.NewTimer(time.Second)
+	c.Assert(clock.Pending(), Equals, 1)
+
+	clock.Advance(999 * time.Millisecond)
+	c.Assert(received(timer.C()).IsZero(), Equals, true)
+
+	clock.Advance(time.Millisecond)
+	c.Assert(received(timer.C()), Equals, clockStart.Add(time.Second))
+	c.Assert(clock.Pending(), Equals, 0)
+	c.Assert(timer.Stop(), Equals, false)
+
+	c.Assert(timer.Reset(time.Second), Equals, false)
+	c.Assert(timer.Reset(2*time.Second), Equals, true)
+	clock.Advance(time.Second)
+	c.Assert(received(timer.C()).IsZero(), Equals, true)
+	c.Assert(timer.Stop(), Equals, true)
+	clock.Advance(time.Hour)
+	c.Assert(received(timer.C()).IsZero(), Equals, true)
+}
+
+func (s *clockSuite) TestTicker(c *C) {
+	clock := servicelog.NewTestClock(clockStart)
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(time.Second)
+	c.Assert(received(ticker.C()), Equals, clockStart.Add(time.Second))
+
+	// Like a real ticker, ticks are dropped if not received.
+	clock.Advance(3 * time.Second)
+	c.Assert(received(ticker.C()), Equals, clockStart.Add(2*time.Second))
+	c.Assert(received(ticker.C()).IsZero(), Equals, true)
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	c.Assert(received(ticker.C()).IsZero(), Equals, true)
+	c.Assert(clock.Pending(), Equals, 0)
+}
+
+func (s *clockSuite) TestFiringOrder(c *C) {
+	clock := servicelog.NewTestClock(clockStart)
+	var fired []string
+	late := clock.NewTimer(2 * time.Second)
+	early := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(1500 * time.Millisecond)
+
+	// Receive each value as it's sent, by advancing in small steps.
+	for i := 0; i < 30; i++ {
+		clock.Advance(100 * time.Millisecond)
+		select {
+		case <-late.C():
+			fired = append(fired, "late")
+		case <-early.C():
+			fired = append(fired, "early")
+		case <-ticker.C():
+			fired = append(fired, "tick")
+		default:
+		}
+	}
+	c.Assert(fired, DeepEquals, []string{"early", "tick", "late", "tick"})
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// CoalesceSize is the number of bytes a CoalesceWriter holds back, at most,
+// before passing them on.
+const CoalesceSize = 4 * 1024
+
+// CoalesceWriter is the ingress of a service's log pipeline for services
+// that write their output in tiny pieces, such as a byte at a time with
+// unbuffered stdio. It holds back the incomplete line at the end of each
+// write and passes it on once the line is complete, it reaches
+// CoalesceSize bytes, or it has been held for the writer's delay,
+// whichever comes first, so the later stages see whole lines instead of
+// each piece.
+type CoalesceWriter struct {
+	mu    sync.Mutex
+	dest  io.Writer
+	delay time.Duration
+	buf   []byte
+
+	// timer flushes buf once it has been held for the delay.
+	timer *deadlineTimer
+	// err is the error from a flush by the timer, returned by the next
+	// Write or Close.
+	err    error
+	closed bool
+}
+
+// NewCoalesceWriter returns a CoalesceWriter that writes to dest, holding
+// incomplete lines back for up to delay, which must be positive.
+func NewCoalesceWriter(dest io.Writer, delay time.Duration) *CoalesceWriter {
+	c := &CoalesceWriter{dest: dest, delay: delay}
+	c.timer = newDeadlineTimer(&c.mu, c.timeout)
+	return c
+}
+
+func (c *CoalesceWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.err; err != nil {
+		c.err = nil
+		return 0, err
+	}
+	if c.closed {
+		return c.dest.Write(p)
+	}
+
+	written := 0
+	if i := bytes.LastIndexByte(p, '\n'); i >= 0 {
+		// The lines completed by p go out with what was held back, in a
+		// single write.
+		n, err := c.flush(p[:i+1])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[i+1:]
+	}
+	if len(c.buf)+len(p) >= CoalesceSize {
+		n, err := c.flush(p)
+		return written + n, err
+	}
+	c.buf = append(c.buf, p...)
+	written += len(p)
+	if len(c.buf) > 0 && !c.timer.Armed() {
+		c.timer.Reset(c.delay)
+	}
+	return written, nil
+}
+
+// flush writes what's held back followed by p to dest, and returns the
+// number of bytes of p written. The line held back is completed from p in
+// a single write, and the rest of p is written as it is. What's held back
+// is dropped even if the write fails, as it was reported written already.
+func (c *CoalesceWriter) flush(p []byte) (int, error) {
+	c.timer.Stop()
+	held := len(c.buf)
+	if held == 0 {
+		return writeFull(c.dest, p)
+	}
+	first := p
+	if i := bytes.IndexByte(p, '\n'); i >= 0 {
+		first = p[:i+1]
+	}
+	c.buf = append(c.buf, first...)
+	n, err := writeFull(c.dest, c.buf)
+	n -= held
+	if n < 0 {
+		n = 0
+	}
+	if cap(c.buf) > 2*CoalesceSize {
+		// Don't keep a buffer grown for a long line.
+		c.buf = nil
+	} else {
+		c.buf = c.buf[:0]
+	}
+	if err != nil || len(first) == len(p) {
+		return n, err
+	}
+	m, err := writeFull(c.dest, p[len(first):])
+	return n + m, err
+}
+
+// timeout flushes what's held back once the delay has passed.
+func (c *CoalesceWriter) timeout() {
+	if _, err := c.flush(nil); err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+// flushIdle passes on anything held back, for an IdleFlushWriter.
+func (c *CoalesceWriter) flushIdle() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.buf) > 0 {
+		if _, err := c.flush(nil); err != nil {
+			return err
+		}
+	}
+	return flushIdle(c.dest)
+}
+
+// Close passes on anything held back and closes dest, if it's an
+// io.Closer, so that it can end an incomplete line. Writes after Close go
+// straight to dest.
+func (c *CoalesceWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	err := c.err
+	c.err = nil
+	if len(c.buf) > 0 {
+		if _, flushErr := c.flush(nil); err == nil {
+			err = flushErr
+		}
+	}
+	c.timer.Close()
+	if closeErr := closeWriter(c.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
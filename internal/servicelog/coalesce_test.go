@@ -0,0 +1,189 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type coalesceSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&coalesceSuite{})
+
+func (s *coalesceSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *coalesceSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// writeBytes writes data to w a byte at a time.
+func writeBytes(c *C, w io.Writer, data string) {
+	for i := 0; i < len(data); i++ {
+		n, err := w.Write([]byte{data[i]})
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 1)
+	}
+}
+
+func (s *coalesceSuite) TestLines(c *C) {
+	dest := &chunkWriter{}
+	w := servicelog.NewCoalesceWriter(dest, 50*time.Millisecond)
+	defer w.Close()
+
+	writeBytes(c, w, "first\nsecond\n")
+	c.Check(dest.chunks, DeepEquals, []string{"first\n", "second\n"})
+
+	// Complete lines in a write go out together, and the incomplete one at
+	// the end is held back until it's complete.
+	dest.chunks = nil
+	_, err := io.WriteString(w, "third\nfourth\nfif")
+	c.Assert(err, IsNil)
+	c.Check(dest.chunks, DeepEquals, []string{"third\nfourth\n"})
+	_, err = io.WriteString(w, "th\n")
+	c.Assert(err, IsNil)
+	c.Check(dest.chunks, DeepEquals, []string{"third\nfourth\n", "fifth\n"})
+
+	// Empty writes are fine.
+	_, err = w.Write(nil)
+	c.Assert(err, IsNil)
+	c.Check(dest.chunks, HasLen, 2)
+}
+
+func (s *coalesceSuite) TestSize(c *C) {
+	dest := &chunkWriter{}
+	w := servicelog.NewCoalesceWriter(dest, 50*time.Millisecond)
+	defer w.Close()
+
+	// An incomplete line is passed on once CoalesceSize bytes are held.
+	long := strings.Repeat("x", servicelog.CoalesceSize)
+	writeBytes(c, w, long[:len(long)-1])
+	c.Check(dest.chunks, HasLen, 0)
+	writeBytes(c, w, "x")
+	c.Check(dest.chunks, DeepEquals, []string{long})
+
+	// A write that's larger still goes out at once.
+	dest.chunks = nil
+	_, err := io.WriteString(w, "y"+long)
+	c.Assert(err, IsNil)
+	c.Check(dest.chunks, DeepEquals, []string{"y" + long})
+}
+
+func (s *coalesceSuite) TestDelay(c *C) {
+	dest := &chunkWriter{writes: make(chan string, 10)}
+	w := servicelog.NewCoalesceWriter(dest, 50*time.Millisecond)
+	defer w.Close()
+
+	// An incomplete line is held for at most the delay after its first
+	// byte arrived.
+	writeBytes(c, w, "prompt")
+	s.clock.Advance(30 * time.Millisecond)
+	writeBytes(c, w, ": ")
+	s.clock.Advance(19 * time.Millisecond)
+	select {
+	case chunk := <-dest.writes:
+		c.Fatalf("unexpected write %q before the delay", chunk)
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.clock.Advance(time.Millisecond)
+	select {
+	case chunk := <-dest.writes:
+		c.Check(chunk, Equals, "prompt: ")
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for the delayed write")
+	}
+
+	// The rest of the line waits for its own delay, unless it's completed
+	// first.
+	writeBytes(c, w, "yes\n")
+	c.Check(<-dest.writes, Equals, "yes\n")
+	s.clock.Advance(time.Second)
+	select {
+	case chunk := <-dest.writes:
+		c.Fatalf("unexpected write %q with nothing held back", chunk)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func (s *coalesceSuite) TestClose(c *C) {
+	b := &bytes.Buffer{}
+	formatter := newFormatWriter(b, "test")
+	w := servicelog.NewCoalesceWriter(formatter, 50*time.Millisecond)
+	writeBytes(c, w, "first\nincomp")
+
+	// Closing passes on what's held back and closes dest, which ends the
+	// incomplete line.
+	c.Assert(w.Close(), IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] incomp [incomplete line]
+`[1:])
+	c.Check(s.clock.Pending(), Equals, 0)
+	c.Assert(w.Close(), IsNil)
+
+	// Later writes go straight to dest.
+	b.Reset()
+	_, err := io.WriteString(w, "late")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] late")
+}
+
+func (s *coalesceSuite) TestWriteError(c *C) {
+	w := servicelog.NewCoalesceWriter(failingWriter(syscall.ENOSPC), 50*time.Millisecond)
+	n, err := io.WriteString(w, "incomp")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 6)
+	n, err = io.WriteString(w, "lete\nnext")
+	c.Check(err, Equals, syscall.ENOSPC)
+	c.Check(n, Equals, 0)
+
+	// What was held back was dropped.
+	c.Check(w.Close(), IsNil)
+}
+
+func (s *coalesceSuite) TestDelayError(c *C) {
+	dest := failingWriter(syscall.ENOSPC)
+	w := servicelog.NewCoalesceWriter(dest, 50*time.Millisecond)
+	_, err := io.WriteString(w, "incomplete")
+	c.Assert(err, IsNil)
+	s.clock.Advance(50 * time.Millisecond)
+	for i := 0; len(dest.Calls()) == 0; i++ {
+		if i >= 500 {
+			c.Fatalf("timed out waiting for the delayed write")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The error from the delayed write is returned by the next write.
+	_, err = io.WriteString(w, "next\n")
+	c.Check(err, Equals, syscall.ENOSPC)
+	_, err = io.WriteString(w, "next\n")
+	c.Check(err, Equals, syscall.ENOSPC)
+	c.Check(dest.Calls(), DeepEquals, []string{"incomplete", "next\n"})
+	c.Check(w.Close(), IsNil)
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// ColorMode is whether WithColor colours the output.
+type ColorMode int
+
+const (
+	// ColorNever writes the output without colours, as NewFormatWriter
+	// does.
+	ColorNever ColorMode = iota
+	// ColorAlways colours the output.
+	ColorAlways
+	// ColorAuto colours the output if it's written to a terminal.
+	ColorAuto
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+)
+
+// serviceColors are the colours of service names, which leave out red and
+// yellow, the colours of errors and warnings.
+var serviceColors = []string{
+	"\x1b[32m", "\x1b[34m", "\x1b[35m", "\x1b[36m",
+	"\x1b[92m", "\x1b[94m", "\x1b[95m", "\x1b[96m",
+}
+
+var (
+	errorWord = []byte("ERROR")
+	warnWord  = []byte("WARN")
+)
+
+// isTerminal reports whether w is a terminal, for ColorAuto.
+var isTerminal = func(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && terminal.IsTerminal(int(f.Fd()))
+}
+
+// WithColor colours the output for reading on a terminal, as given by
+// mode: the timestamps are dimmed, each service name is in a colour of its
+// own, the same every time, and the lines with "ERROR" or "WARN" in them
+// are in red or yellow. Whether a line is highlighted is decided by the
+// part of it in the write it starts in. The escape codes, like the prefix,
+// don't count towards the number of bytes written.
+func WithColor(mode ColorMode) FormatOption {
+	return func(f *formatter) error {
+		switch mode {
+		case ColorNever:
+			f.color = false
+		case ColorAlways:
+			f.color = true
+		case ColorAuto:
+			f.color = isTerminal(f.dest)
+		default:
+			return fmt.Errorf("invalid color mode %d", mode)
+		}
+		f.timeStart = nil
+		if f.color {
+			f.timeStart = []byte(ansiDim)
+		}
+		return nil
+	}
+}
+
+// serviceColor returns the colour of a service's name.
+func serviceColor(serviceName string) string {
+	h := fnv.New32a()
+	h.Write([]byte(serviceName))
+	return serviceColors[h.Sum32()%uint32(len(serviceColors))]
+}
+
+// lineColor returns the colour to highlight line in, if any.
+func lineColor(line []byte) string {
+	switch {
+	case bytes.Contains(line, errorWord):
+		return ansiRed
+	case bytes.Contains(line, warnWord):
+		return ansiYellow
+	}
+	return ""
+}
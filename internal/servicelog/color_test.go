@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type colorSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&colorSuite{})
+
+func (s *colorSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *colorSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+const (
+	testTime  = "\x1b[2m2021-05-13T03:16:51.001Z\x1b[0m"
+	testTag   = " \x1b[94m[test]\x1b[0m "
+	testReset = "\x1b[0m"
+)
+
+func (s *colorSuite) TestColorAlways(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriter(b, "test", servicelog.WithColor(servicelog.ColorAlways))
+	c.Assert(err, IsNil)
+
+	input := "first\nan ERROR here\na WARNing\nlast\n"
+	n, err := io.WriteString(w, input)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(input))
+	c.Assert(b.String(), Equals, testTime+testTag+"first\n"+
+		testTime+testTag+"\x1b[31man ERROR here"+testReset+"\n"+
+		testTime+testTag+"\x1b[33ma WARNing"+testReset+"\n"+
+		testTime+testTag+"last\n")
+}
+
+func (s *colorSuite) TestColorNever(c *C) {
+	for _, mode := range []servicelog.ColorMode{servicelog.ColorNever, servicelog.ColorAuto} {
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewFormatWriter(b, "test", servicelog.WithColor(mode))
+		c.Assert(err, IsNil)
+		_, err = io.WriteString(w, "an ERROR\n")
+		c.Assert(err, IsNil)
+		c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] an ERROR\n")
+	}
+}
+
+func (s *colorSuite) TestColorAuto(c *C) {
+	b := &bytes.Buffer{}
+	var checked io.Writer
+	restore := servicelog.FakeTerminal(func(w io.Writer) bool {
+		checked = w
+		return true
+	})
+	defer restore()
+
+	w, err := servicelog.NewFormatWriter(b, "test", servicelog.WithColor(servicelog.ColorAuto))
+	c.Assert(err, IsNil)
+	c.Check(checked, Equals, b)
+	_, err = io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, testTime+testTag+"first\n")
+}
+
+func (s *colorSuite) TestColorInvalid(c *C) {
+	_, err := servicelog.NewFormatWriter(&bytes.Buffer{}, "test", servicelog.WithColor(servicelog.ColorMode(42)))
+	c.Assert(err, ErrorMatches, "invalid color mode 42")
+}
+
+func (s *colorSuite) TestColorStable(c *C) {
+	for _, t := range []struct {
+		name, color string
+	}{
+		{"test", "94"},
+		{"db", "36"},
+		{"web", "34"},
+	} {
+		for i := 0; i < 2; i++ {
+			b := &bytes.Buffer{}
+			w, err := servicelog.NewFormatWriter(b, t.name, servicelog.WithColor(servicelog.ColorAlways))
+			c.Assert(err, IsNil)
+			_, err = io.WriteString(w, "x\n")
+			c.Assert(err, IsNil)
+			c.Check(b.String(), Equals, testTime+" \x1b["+t.color+"m["+t.name+"]\x1b[0m x\n")
+		}
+	}
+}
+
+func (s *colorSuite) TestColorSplitLine(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriter(b, "test", servicelog.WithColor(servicelog.ColorAlways))
+	c.Assert(err, IsNil)
+
+	// The highlight is decided by the part of the line in its first
+	// write, and lasts until the line ends.
+	for _, p := range []string{"ERROR ", "in two", " parts\r", "\n", "no ", "WARN\n"} {
+		n, err := io.WriteString(w, p)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(p))
+	}
+	c.Assert(b.String(), Equals, testTime+testTag+"\x1b[31mERROR in two parts"+testReset+"\n"+
+		testTime+testTag+"no WARN\n")
+}
+
+func (s *colorSuite) TestColorClose(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriter(b, "test", servicelog.WithColor(servicelog.ColorAlways))
+	c.Assert(err, IsNil)
+
+	_, err = io.WriteString(w, "ERROR cut")
+	c.Assert(err, IsNil)
+	c.Assert(w.(io.Closer).Close(), IsNil)
+	_, err = io.WriteString(w, "next\n")
+	c.Assert(err, IsNil)
+	c.Assert(b.String(), Equals, testTime+testTag+"\x1b[31mERROR cut"+testReset+servicelog.IncompleteLineMarker+"\n"+
+		testTime+testTag+"next\n")
+}
+
+func (s *colorSuite) TestColorWriteError(c *C) {
+	errTest := errors.New("test")
+	input := "an ERROR\n"
+	prefix := len(testTime + testTag + "\x1b[31m")
+	// Fail in the colour code, in the payload, in the reset before the
+	// newline, and just before the newline.
+	for _, failAt := range []int{prefix - 2, prefix + 3, prefix + len("an ERROR") + 2, prefix + len(input) + len(testReset) - 1} {
+		dest := servicelogtest.NewScriptedWriter(servicelogtest.FailAfter(failAt, errTest))
+		w, err := servicelog.NewFormatWriter(dest, "test", servicelog.WithColor(servicelog.ColorAlways))
+		c.Assert(err, IsNil)
+
+		n, err := io.WriteString(w, input)
+		c.Assert(err, ErrorMatches, ".*test")
+		// The rest of the line is written again, resuming the output.
+		_, err = io.WriteString(w, input[n:])
+		c.Assert(err, IsNil)
+		c.Check(dest.String(), Equals, testTime+testTag+"\x1b[31m"+strings.TrimSuffix(input, "\n")+testReset+"\n", Commentf("fail at %d", failAt))
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"io"
+
+	. "gopkg.in/check.v1"
+)
+
+// These tests push cumulative counters and positions past 2^31 (and 2^32)
+// with synthetic increments, to check that nothing truncates them to int on
+// 32-bit platforms.
+
+type countersSuite struct{}
+
+var _ = Suite(&countersSuite{})
+
+func (s *countersSuite) TestBudgetPast2GB(c *C) {
+	b := NewBudget(4 << 30)
+	for i := 0; i < 4; i++ {
+		c.Assert(b.Reserve(1<<30, 1<<30), Equals, 1<<30)
+	}
+	c.Check(b.Reserve(1, 1<<30), Equals, 0)
+	c.Check(b.Available(), Equals, int64(0))
+	for i := 0; i < 3; i++ {
+		b.addDropped(1 << 30)
+	}
+	c.Check(b.Stats(), Equals, BudgetStats{
+		Limit:   4 << 30,
+		Used:    4 << 30,
+		Denied:  1,
+		Dropped: 3 << 30,
+	})
+
+	for i := 0; i < 3; i++ {
+		b.Release(1 << 30)
+	}
+	c.Check(b.Available(), Equals, int64(3<<30))
+	c.Check(b.Stats().Used, Equals, int64(1<<30))
+}
+
+func (s *countersSuite) TestRingBufferPast4GB(c *C) {
+	rb := NewRingBuffer(16)
+	defer rb.Close()
+	start := RingPos(1<<32 - 5)
+	rb.readIndex = start
+	rb.writeIndex = start
+
+	n, err := rb.Write([]byte("abcdefghij"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 10)
+	first, last := rb.Positions()
+	c.Check(first, Equals, start)
+	c.Check(last, Equals, start+10)
+
+	// Writing more discards the oldest bytes across the 2^32 boundary.
+	_, err = rb.Write([]byte("klmnopqrst"))
+	c.Assert(err, IsNil)
+	first, last = rb.Positions()
+	c.Check(first, Equals, start+4)
+	c.Check(last, Equals, start+20)
+	buf := make([]byte, 32)
+	next, n, err := rb.Copy(buf, first)
+	c.Check(err, Equals, io.EOF)
+	c.Check(next, Equals, last)
+	c.Check(string(buf[:n]), Equals, "efghijklmnopqrst")
+}
+
+func (s *countersSuite) TestDroppedPast2GB(c *C) {
+	budget := NewBudget(1)
+	budget.Reserve(1, 1)
+	rb := NewRingBufferWithBudget(1024, budget)
+	defer rb.Close()
+	rb.dropped = 1<<31 - 1
+
+	n, err := rb.Write([]byte("0123456789"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 10)
+	c.Check(rb.Dropped(), Equals, int64(1<<31+9))
+	c.Check(budget.Stats().Dropped, Equals, int64(10))
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+type crossBuildSuite struct{}
+
+var _ = Suite(&crossBuildSuite{})
+
+// TestBuild32BitARM type-checks the log pipeline packages and their tests
+// for 32-bit ARM, where the alignment assertions in align_arm_test.go files
+// are compiled in.
+func (s *crossBuildSuite) TestBuild32BitARM(c *C) {
+	if testing.Short() {
+		c.Skip("cross-compiling is slow")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		c.Skip("go tool not found")
+	}
+	cmd := exec.Command(goTool, "vet", ".", "../overlord/servstate")
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH=arm", "GOARM=7")
+	output, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("%s", output))
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"sync"
+	"time"
+)
+
+// deadlineTimer calls a function once a deadline is due, for the writers
+// that pass on or summarise what they hold back after a while. The
+// function is called with the writer's lock held, and Reset, Stop, Armed
+// and Close must be called with it held too. The timer, and the goroutine
+// waiting on it, are created by the first Reset and stopped by Close.
+type deadlineTimer struct {
+	mu   sync.Locker
+	fire func()
+
+	timer    Timer
+	done     chan struct{}
+	armed    bool
+	deadline time.Time
+	closed   bool
+}
+
+// newDeadlineTimer returns a deadlineTimer calling fire with mu held.
+func newDeadlineTimer(mu sync.Locker, fire func()) *deadlineTimer {
+	return &deadlineTimer{mu: mu, fire: fire}
+}
+
+// Reset arms the timer to fire after d, replacing any earlier deadline.
+// It does nothing once the timer is closed.
+func (t *deadlineTimer) Reset(d time.Duration) {
+	if t.closed {
+		return
+	}
+	t.armed = true
+	t.deadline = clock.Now().Add(d)
+	if t.timer == nil {
+		t.timer = clock.NewTimer(d)
+		t.done = make(chan struct{})
+		go t.run(t.timer, t.done)
+	} else {
+		t.timer.Reset(d)
+	}
+}
+
+// Stop disarms the timer, if it's armed.
+func (t *deadlineTimer) Stop() {
+	if t.armed {
+		t.armed = false
+		t.timer.Stop()
+	}
+}
+
+// Armed reports whether the timer is due to fire.
+func (t *deadlineTimer) Armed() bool {
+	return t.armed
+}
+
+// Close stops the timer for good and ends the goroutine waiting on it.
+func (t *deadlineTimer) Close() {
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.Stop()
+	if t.done != nil {
+		close(t.done)
+	}
+}
+
+// run calls expire when the timer fires, until done is closed.
+func (t *deadlineTimer) run(timer Timer, done <-chan struct{}) {
+	for {
+		select {
+		case <-timer.C():
+			t.expire()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (t *deadlineTimer) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// A stale tick, from before the timer was stopped or reset, is
+	// ignored: the timer fires again when the deadline is due.
+	if !t.armed || clock.Now().Before(t.deadline) {
+		return
+	}
+	t.armed = false
+	t.fire()
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type deadlineSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&deadlineSuite{})
+
+func (s *deadlineSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *deadlineSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func expectFired(c *C, fired chan struct{}) {
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for timer to fire")
+	}
+}
+
+func expectNotFired(c *C, fired chan struct{}) {
+	select {
+	case <-fired:
+		c.Fatalf("timer fired unexpectedly")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func (s *deadlineSuite) TestDeadlineTimer(c *C) {
+	fired := make(chan struct{}, 10)
+	t := servicelog.NewDeadlineTimer(func() { fired <- struct{}{} })
+	defer t.Close()
+	c.Check(t.Armed(), Equals, false)
+
+	t.Reset(time.Second)
+	c.Check(t.Armed(), Equals, true)
+	s.clock.Advance(time.Second)
+	expectFired(c, fired)
+	c.Check(t.Armed(), Equals, false)
+
+	// A reset moves the deadline on.
+	t.Reset(time.Second)
+	s.clock.Advance(500 * time.Millisecond)
+	t.Reset(time.Second)
+	s.clock.Advance(500 * time.Millisecond)
+	expectNotFired(c, fired)
+	s.clock.Advance(500 * time.Millisecond)
+	expectFired(c, fired)
+
+	// A stopped timer doesn't fire.
+	t.Reset(time.Second)
+	t.Stop()
+	c.Check(t.Armed(), Equals, false)
+	s.clock.Advance(time.Second)
+	expectNotFired(c, fired)
+}
+
+func (s *deadlineSuite) TestDeadlineTimerClose(c *C) {
+	fired := make(chan struct{}, 10)
+	t := servicelog.NewDeadlineTimer(func() { fired <- struct{}{} })
+	t.Reset(time.Second)
+	t.Close()
+	c.Check(t.Armed(), Equals, false)
+	s.clock.Advance(time.Second)
+	expectNotFired(c, fired)
+
+	// Once closed, the timer can't be armed again.
+	t.Reset(time.Second)
+	c.Check(t.Armed(), Equals, false)
+	s.clock.Advance(time.Second)
+	expectNotFired(c, fired)
+	t.Close()
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DedupWriter collapses runs of identical lines in a service's formatted
+// output, such as those of a service stuck in a retry loop, into the first
+// of them followed by a line of pebble's own:
+//
+//	2021-05-13T03:16:51.001Z [test] cannot connect: retrying
+//	2021-05-13T03:16:56.001Z [pebble] last message repeated 4 times
+//
+// Lines are compared without their timestamp, the first field of each.
+// The repeats are counted until a different line arrives, there have been
+// none for the writer's interval, or they've been withheld for its maximum,
+// and the line about them is written then. The count starts over after
+// the maximum, and the repeats that follow are withheld again.
+//
+// Lines are only compared once they're complete, so the incomplete line at
+// the end of each write is held back until it's completed or the writer is
+// closed.
+type DedupWriter struct {
+	mu       sync.Mutex
+	dest     io.Writer
+	interval time.Duration
+	max      time.Duration
+
+	// held is the incomplete line held back, and last the last line passed
+	// on, without its timestamp.
+	held []byte
+	last []byte
+	// repeats counts the repeats of the last line withheld since first.
+	repeats int
+	first   time.Time
+
+	// timer writes the line about the repeats once it's due.
+	timer *deadlineTimer
+	// err is the error from a write by the timer, returned by the next
+	// Write or Close.
+	err    error
+	closed bool
+}
+
+// NewDedupWriter returns a DedupWriter that writes to dest, writing the
+// count of repeated lines after interval with no repeats, or max after the
+// first, whichever comes first.
+func NewDedupWriter(dest io.Writer, interval, max time.Duration) *DedupWriter {
+	d := &DedupWriter{dest: dest, interval: interval, max: max}
+	d.timer = newDeadlineTimer(&d.mu, d.timeout)
+	return d
+}
+
+func (d *DedupWriter) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.err; err != nil {
+		d.err = nil
+		return 0, err
+	}
+	if d.closed {
+		return d.dest.Write(p)
+	}
+
+	// The lines passed on are written in runs, the current one starting
+	// at run in p. written counts the bytes of p written or withheld.
+	written, run, pos := 0, 0, 0
+	for pos < len(p) {
+		i := bytes.IndexByte(p[pos:], '\n')
+		if i < 0 {
+			break
+		}
+		end := pos + i + 1
+		line := p[pos:end]
+		held := len(d.held) > 0
+		if held {
+			d.held = append(d.held, line...)
+			line = d.held
+		}
+		key := trimTimestamp(line)
+		repeat := d.last != nil && bytes.Equal(key, d.last)
+		if repeat || held || d.repeats > 0 {
+			n, err := writeFull(d.dest, p[run:pos])
+			written += n
+			if err != nil {
+				return written, err
+			}
+			run = pos
+		}
+		if repeat {
+			d.repeat()
+			run, written = end, end
+		} else {
+			if err := d.flushRepeats(); err != nil {
+				d.held = d.held[:0]
+				return written, err
+			}
+			d.last = append(d.last[:0], key...)
+			if held {
+				if _, err := writeFull(d.dest, line); err != nil {
+					d.held = d.held[:0]
+					return written, err
+				}
+				run, written = end, end
+			}
+		}
+		d.held = d.held[:0]
+		pos = end
+	}
+	n, err := writeFull(d.dest, p[run:pos])
+	written += n
+	if err != nil {
+		return written, err
+	}
+	d.held = append(d.held, p[pos:]...)
+	return len(p), nil
+}
+
+// trimTimestamp returns line without its first field.
+func trimTimestamp(line []byte) []byte {
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		return line[i+1:]
+	}
+	return line
+}
+
+// repeat counts a repeat of the last line, and writes the count if it has
+// been withheld for the maximum.
+func (d *DedupWriter) repeat() {
+	now := clock.Now()
+	if d.repeats == 0 {
+		d.first = now
+	}
+	d.repeats++
+	deadline := now.Add(d.interval)
+	if limit := d.first.Add(d.max); limit.Before(deadline) {
+		deadline = limit
+	}
+	d.timer.Reset(deadline.Sub(now))
+}
+
+// flushRepeats writes the line about the repeats withheld, if any.
+func (d *DedupWriter) flushRepeats() error {
+	if d.repeats == 0 {
+		return nil
+	}
+	line := make([]byte, 0, len(outputTimeFormat)+len(PebbleName)+40)
+	line = clock.Now().UTC().AppendFormat(line, outputTimeFormat)
+	line = append(line, " ["+PebbleName+"] last message repeated "...)
+	line = strconv.AppendInt(line, int64(d.repeats), 10)
+	line = append(line, " times\n"...)
+	d.repeats = 0
+	d.timer.Stop()
+	_, err := writeFull(d.dest, line)
+	return err
+}
+
+// timeout writes the count of repeats once it's due.
+func (d *DedupWriter) timeout() {
+	if err := d.flushRepeats(); err != nil && d.err == nil {
+		d.err = err
+	}
+}
+
+// Close writes the count of any repeats withheld and the incomplete line
+// held back, and closes dest, if it's an io.Closer. Writes after Close go
+// straight to dest.
+func (d *DedupWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	err := d.err
+	d.err = nil
+	if flushErr := d.flushRepeats(); err == nil {
+		err = flushErr
+	}
+	d.timer.Close()
+	if len(d.held) > 0 {
+		if _, writeErr := writeFull(d.dest, d.held); err == nil {
+			err = writeErr
+		}
+		d.held = nil
+	}
+	if closeErr := closeWriter(d.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
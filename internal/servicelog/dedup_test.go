@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type dedupSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&dedupSuite{})
+
+func (s *dedupSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *dedupSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *dedupSuite) TestCollapse(c *C) {
+	dest := &closeRecorder{}
+	d := servicelog.NewDedupWriter(dest, time.Second, time.Minute)
+
+	// Repeats are recognised whatever their timestamps, and however the
+	// lines are split across writes.
+	for _, p := range []string{
+		"2021-05-13T03:16:50.001Z [test] retrying\n2021-05-13T03:16:50.002Z [test] retr",
+		"ying\n2021-05-13T03:16:50.003Z [test] retrying\n2021-05-13T03:16:50.004Z [test] d",
+		"one\n2021-05-13T03:16:50.005Z [test] incomplete",
+	} {
+		n, err := io.WriteString(d, p)
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, len(p))
+	}
+	c.Check(dest.String(), Equals, `
+2021-05-13T03:16:50.001Z [test] retrying
+2021-05-13T03:16:51.001Z [pebble] last message repeated 2 times
+2021-05-13T03:16:50.004Z [test] done
+`[1:])
+	c.Check(s.clock.Pending(), Equals, 0)
+
+	c.Assert(d.Close(), IsNil)
+	c.Check(strings.HasSuffix(dest.String(), "done\n2021-05-13T03:16:50.005Z [test] incomplete"), Equals, true)
+	c.Check(dest.closed, Equals, true)
+}
+
+func (s *dedupSuite) TestAlternating(c *C) {
+	dest := &closeRecorder{}
+	d := servicelog.NewDedupWriter(dest, time.Second, time.Minute)
+	input := `
+2021-05-13T03:16:50.001Z [test] A
+2021-05-13T03:16:50.002Z [test] B
+2021-05-13T03:16:50.003Z [test] A
+2021-05-13T03:16:50.004Z [test] B
+`[1:]
+	_, err := io.WriteString(d, input)
+	c.Assert(err, IsNil)
+	c.Assert(d.Close(), IsNil)
+	c.Check(dest.String(), Equals, input)
+	c.Check(s.clock.Pending(), Equals, 0)
+}
+
+func (s *dedupSuite) TestInterval(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	d := servicelog.NewDedupWriter(dest, time.Second, time.Minute)
+	defer d.Close()
+	for i := 0; i < 3; i++ {
+		_, err := io.WriteString(d, "2021-05-13T03:16:51.001Z [test] retrying\n")
+		c.Assert(err, IsNil)
+	}
+
+	// The count is written once there have been no repeats for the
+	// interval.
+	s.clock.Advance(999 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(dest.String(), Equals, "2021-05-13T03:16:51.001Z [test] retrying\n")
+	s.clock.Advance(time.Millisecond)
+	expected := `
+2021-05-13T03:16:51.001Z [test] retrying
+2021-05-13T03:16:52.001Z [pebble] last message repeated 2 times
+`[1:]
+	waitFor(c, func() bool { return dest.String() == expected })
+
+	// Further repeats are counted again.
+	_, err := io.WriteString(d, "2021-05-13T03:16:52.001Z [test] retrying\n")
+	c.Assert(err, IsNil)
+	c.Assert(d.Close(), IsNil)
+	c.Check(dest.String(), Equals, expected+"2021-05-13T03:16:52.001Z [pebble] last message repeated 1 times\n")
+}
+
+func (s *dedupSuite) TestMax(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	d := servicelog.NewDedupWriter(dest, time.Second, 3*time.Second)
+	defer d.Close()
+	_, err := io.WriteString(d, "2021-05-13T03:16:51.001Z [test] retrying\n")
+	c.Assert(err, IsNil)
+
+	// Repeats that never stop for the interval are counted every maximum.
+	for i := 0; i < 6; i++ {
+		s.clock.Advance(500 * time.Millisecond)
+		_, err := io.WriteString(d, "2021-05-13T03:16:51.001Z [test] retrying\n")
+		c.Assert(err, IsNil)
+	}
+	s.clock.Advance(500 * time.Millisecond)
+	expected := `
+2021-05-13T03:16:51.001Z [test] retrying
+2021-05-13T03:16:54.501Z [pebble] last message repeated 6 times
+`[1:]
+	waitFor(c, func() bool { return dest.String() == expected })
+}
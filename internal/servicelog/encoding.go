@@ -0,0 +1,247 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings of service output understood by NewDecodeWriter.
+const (
+	// EncodingAuto detects the encoding from a byte-order mark at the
+	// start of the output, and passes output without one through as is.
+	EncodingAuto = "auto"
+	EncodingUTF8 = "utf-8"
+	// EncodingUTF16LE and EncodingUTF16BE are for output known to be
+	// UTF-16, with or without a byte-order mark.
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+)
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+type decoder struct {
+	mu       sync.Mutex
+	dest     io.Writer
+	encoding string
+	// detected is set once the byte-order mark at the start of the output
+	// has been checked for, after which the encoding doesn't change.
+	detected bool
+	// pending holds the bytes of a write that couldn't be decoded yet: the
+	// start of a possible byte-order mark, an odd byte of a UTF-16 code
+	// unit, or a high surrogate waiting for its pair. It never holds more
+	// than 3 bytes.
+	pending []byte
+	out     []byte
+}
+
+// NewDecodeWriter returns an io.Writer that converts output in the given
+// encoding (one of the Encoding constants) to UTF-8 and writes it to dest,
+// stripping any byte-order mark at the start. With EncodingAuto, the
+// encoding is decided by the byte-order mark at the start of the output;
+// output without one is passed through unchanged. Invalid UTF-16 is
+// replaced with U+FFFD.
+//
+// Code units split across writes are held back until the rest arrives, so
+// a short write may be delayed, but no more than 3 bytes are held.
+func NewDecodeWriter(dest io.Writer, encoding string) io.Writer {
+	return &decoder{dest: dest, encoding: encoding}
+}
+
+func (d *decoder) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data := p
+	held := len(d.pending)
+	if held > 0 {
+		data = append(d.pending, p...)
+		d.pending = d.pending[:0]
+	}
+	skip := 0
+	if !d.detected {
+		var ok bool
+		skip, ok = d.detect(data)
+		if !ok {
+			d.pending = append(d.pending, data...)
+			return len(p), nil
+		}
+		d.detected = true
+	}
+
+	var n int
+	var err error
+	switch d.encoding {
+	case EncodingUTF16LE, EncodingUTF16BE:
+		var used int
+		d.out, used = d.decode(d.out[:0], data[skip:], -1)
+		d.pending = append(d.pending, data[skip+used:]...)
+		if len(d.out) == 0 {
+			return len(p), nil
+		}
+		n, err = d.dest.Write(d.out)
+		if err != nil {
+			// Report the input whose output was written.
+			_, used = d.decode(d.out[:0], data[skip:], n)
+			n = skip + used
+			d.pending = d.pending[:0]
+		} else {
+			n = len(data) - len(d.pending)
+		}
+	default:
+		if skip == len(data) {
+			return len(p), nil
+		}
+		n, err = d.dest.Write(data[skip:])
+		n += skip
+	}
+	n -= held
+	if n < 0 {
+		n = 0
+	}
+	if err == nil {
+		n = len(p)
+	}
+	return n, err
+}
+
+// Close writes out the bytes held back at the end of the output, which
+// will never be completed: an incomplete UTF-16 code unit or surrogate
+// pair is written as U+FFFD, and anything else (the start of what might
+// have been a byte-order mark) as is. It then closes dest, if it's an
+// io.Closer.
+func (d *decoder) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var err error
+	if len(d.pending) > 0 {
+		rest := d.pending
+		if d.encoding == EncodingUTF16LE || d.encoding == EncodingUTF16BE {
+			rest = appendRune(nil, utf8.RuneError)
+		}
+		d.pending = d.pending[:0]
+		_, err = d.dest.Write(rest)
+	}
+	closeErr := closeWriter(d.dest)
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closeWriter closes w if it's an io.Closer.
+func closeWriter(w io.Writer) error {
+	if c, ok := w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// detect checks for a byte-order mark at the start of data, deciding the
+// encoding if it's EncodingAuto. It returns the length of the mark, and
+// false if more data is needed to tell.
+func (d *decoder) detect(data []byte) (skip int, ok bool) {
+	switch d.encoding {
+	case EncodingAuto:
+		for _, bom := range [][]byte{bomUTF8, bomUTF16LE, bomUTF16BE} {
+			if len(data) < len(bom) && bytes.HasPrefix(bom, data) {
+				return 0, false
+			}
+		}
+		switch {
+		case bytes.HasPrefix(data, bomUTF8):
+			d.encoding = EncodingUTF8
+			return len(bomUTF8), true
+		case bytes.HasPrefix(data, bomUTF16LE):
+			d.encoding = EncodingUTF16LE
+			return len(bomUTF16LE), true
+		case bytes.HasPrefix(data, bomUTF16BE):
+			d.encoding = EncodingUTF16BE
+			return len(bomUTF16BE), true
+		}
+		// No byte-order mark: pass the output through.
+		d.encoding = ""
+		return 0, true
+	case EncodingUTF8:
+		return stripBOM(data, bomUTF8)
+	case EncodingUTF16LE:
+		return stripBOM(data, bomUTF16LE)
+	case EncodingUTF16BE:
+		return stripBOM(data, bomUTF16BE)
+	}
+	return 0, true
+}
+
+func stripBOM(data, bom []byte) (skip int, ok bool) {
+	if len(data) < len(bom) && bytes.HasPrefix(bom, data) {
+		return 0, false
+	}
+	if bytes.HasPrefix(data, bom) {
+		return len(bom), true
+	}
+	return 0, true
+}
+
+// decode appends the UTF-8 encoding of the UTF-16 data to out, stopping
+// before the output would exceed limit bytes (if limit isn't negative) or
+// at a code unit or surrogate pair that isn't complete. It returns the
+// output and the number of bytes of data used.
+func (d *decoder) decode(out, data []byte, limit int) ([]byte, int) {
+	unit := func(b []byte) rune {
+		if d.encoding == EncodingUTF16LE {
+			return rune(b[0]) | rune(b[1])<<8
+		}
+		return rune(b[0])<<8 | rune(b[1])
+	}
+	i := 0
+	for i+2 <= len(data) {
+		r := unit(data[i:])
+		size := 2
+		if utf16.IsSurrogate(r) {
+			if r < 0xdc00 {
+				// A high surrogate, which should be followed by a low one.
+				if i+4 > len(data) {
+					break
+				}
+				r = utf16.DecodeRune(r, unit(data[i+2:]))
+				if r != utf8.RuneError {
+					size = 4
+				}
+			} else {
+				r = utf8.RuneError
+			}
+		}
+		if limit >= 0 && len(out)+utf8.RuneLen(r) > limit {
+			break
+		}
+		out = appendRune(out, r)
+		i += size
+	}
+	return out, i
+}
+
+func appendRune(out []byte, r rune) []byte {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	return append(out, buf[:n]...)
+}
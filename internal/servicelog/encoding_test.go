@@ -0,0 +1,307 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+	"unicode/utf16"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type encodingSuite struct{}
+
+var _ = Suite(&encodingSuite{})
+
+// utf16Bytes encodes s as UTF-16, little-endian unless bigEndian is set.
+func utf16Bytes(s string, bigEndian bool) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			b = append(b, byte(u>>8), byte(u))
+		} else {
+			b = append(b, byte(u), byte(u>>8))
+		}
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+const encodingText = "héllo wörld 🙂\nsecond line ✓\n"
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+var decodeTests = []struct {
+	summary  string
+	encoding string
+	input    []byte
+	output   string
+}{{
+	summary:  "UTF-16LE with BOM",
+	encoding: servicelog.EncodingAuto,
+	input:    concat(bomUTF16LE, utf16Bytes(encodingText, false)),
+	output:   encodingText,
+}, {
+	summary:  "UTF-16BE with BOM",
+	encoding: servicelog.EncodingAuto,
+	input:    concat(bomUTF16BE, utf16Bytes(encodingText, true)),
+	output:   encodingText,
+}, {
+	summary:  "UTF-8 with BOM",
+	encoding: servicelog.EncodingAuto,
+	input:    concat(bomUTF8, []byte(encodingText)),
+	output:   encodingText,
+}, {
+	summary:  "No BOM",
+	encoding: servicelog.EncodingAuto,
+	input:    []byte(encodingText),
+	output:   encodingText,
+}, {
+	summary:  "Start of a BOM",
+	encoding: servicelog.EncodingAuto,
+	input:    []byte("\xef\xbbnot a BOM"),
+	output:   "\xef\xbbnot a BOM",
+}, {
+	summary:  "Not UTF-8 without BOM",
+	encoding: servicelog.EncodingAuto,
+	input:    []byte("\x00\xfe\xffbinary"),
+	output:   "\x00\xfe\xffbinary",
+}, {
+	summary:  "UTF-16LE without BOM",
+	encoding: servicelog.EncodingUTF16LE,
+	input:    utf16Bytes(encodingText, false),
+	output:   encodingText,
+}, {
+	summary:  "UTF-16LE with BOM",
+	encoding: servicelog.EncodingUTF16LE,
+	input:    concat(bomUTF16LE, utf16Bytes(encodingText, false)),
+	output:   encodingText,
+}, {
+	summary:  "UTF-16BE without BOM",
+	encoding: servicelog.EncodingUTF16BE,
+	input:    utf16Bytes(encodingText, true),
+	output:   encodingText,
+}, {
+	summary:  "UTF-8 with BOM, explicitly",
+	encoding: servicelog.EncodingUTF8,
+	input:    concat(bomUTF8, []byte(encodingText)),
+	output:   encodingText,
+}, {
+	summary:  "Invalid surrogates",
+	encoding: servicelog.EncodingUTF16LE,
+	// A lone low surrogate, and a high surrogate followed by a letter.
+	input:  concat(utf16Bytes("a", false), []byte{0x00, 0xdc}, []byte{0x3d, 0xd8}, utf16Bytes("b\n", false)),
+	output: "a\ufffd\ufffdb\n",
+}, {
+	// The encoding decided at the start is kept, whatever the output
+	// looks like later.
+	summary:  "UTF-16LE then other BOMs",
+	encoding: servicelog.EncodingAuto,
+	input: concat(bomUTF16LE, utf16Bytes("one\n", false), bomUTF16BE, utf16Bytes("two\n", true),
+		bomUTF8, []byte("three"), bomUTF16LE, utf16Bytes("four\n", false)),
+	// Decoded as UTF-16LE: the UTF-16BE BOM and text come out byte-swapped,
+	// the UTF-8 BOM and text as pairs of bytes, and the later UTF-16LE BOM
+	// as a zero width no-break space.
+	output: "one\n" + string(utf16.Decode([]uint16{0xfffe, 0x7400, 0x7700, 0x6f00, 0x0a00})) +
+		string(utf16.Decode([]uint16{0xbbef, 0x74bf, 0x7268, 0x6565})) + "\ufefffour\n",
+}, {
+	summary:  "No BOM then UTF-16 BOM",
+	encoding: servicelog.EncodingAuto,
+	input:    concat([]byte("one\n"), bomUTF16LE, utf16Bytes("two\n", false)),
+	output:   string(concat([]byte("one\n"), bomUTF16LE, utf16Bytes("two\n", false))),
+}, {
+	summary:  "UTF-8 BOM then UTF-16 BOM",
+	encoding: servicelog.EncodingAuto,
+	input:    concat(bomUTF8, []byte("one\n"), bomUTF16BE, utf16Bytes("two\n", true)),
+	output:   string(concat([]byte("one\n"), bomUTF16BE, utf16Bytes("two\n", true))),
+}}
+
+// chunkings split input into writes in different ways.
+var chunkings = []struct {
+	summary string
+	split   func(input []byte) [][]byte
+}{{
+	summary: "whole",
+	split:   func(input []byte) [][]byte { return [][]byte{input} },
+}, {
+	summary: "bytes",
+	split: func(input []byte) [][]byte {
+		return splitSizes(input, 1)
+	},
+}, {
+	summary: "odd sizes",
+	split: func(input []byte) [][]byte {
+		return splitSizes(input, 1, 3, 5, 7)
+	},
+}, {
+	summary: "three then odd",
+	split: func(input []byte) [][]byte {
+		return splitSizes(input, 3, 5)
+	},
+}}
+
+func splitSizes(input []byte, sizes ...int) [][]byte {
+	var chunks [][]byte
+	for i := 0; len(input) > 0; i++ {
+		n := sizes[i%len(sizes)]
+		if n > len(input) {
+			n = len(input)
+		}
+		chunks = append(chunks, input[:n])
+		input = input[n:]
+	}
+	return chunks
+}
+
+func (s *encodingSuite) TestDecode(c *C) {
+	for _, test := range decodeTests {
+		var chunkingTests []struct {
+			summary string
+			chunks  [][]byte
+		}
+		for _, chunking := range chunkings {
+			chunkingTests = append(chunkingTests, struct {
+				summary string
+				chunks  [][]byte
+			}{chunking.summary, chunking.split(test.input)})
+		}
+		for i := 1; i < len(test.input); i++ {
+			chunkingTests = append(chunkingTests, struct {
+				summary string
+				chunks  [][]byte
+			}{"split", [][]byte{test.input[:i], test.input[i:]}})
+		}
+		for _, chunking := range chunkingTests {
+			var b bytes.Buffer
+			w := servicelog.NewDecodeWriter(&b, test.encoding)
+			for _, chunk := range chunking.chunks {
+				n, err := w.Write(chunk)
+				c.Assert(err, IsNil)
+				c.Assert(n, Equals, len(chunk))
+			}
+			c.Check(b.String(), Equals, test.output, Commentf("%s, %s %q", test.summary, chunking.summary, chunking.chunks))
+		}
+	}
+}
+
+func (s *encodingSuite) TestWritesCompleteUnits(c *C) {
+	var b bytes.Buffer
+	w := servicelog.NewDecodeWriter(&b, servicelog.EncodingAuto)
+
+	// Nothing is written until the BOM check is done.
+	w.Write(bomUTF16LE[:1])
+	c.Check(b.String(), Equals, "")
+
+	// Complete code units are written straight away.
+	w.Write(concat(bomUTF16LE[1:], utf16Bytes("ab", false)[:3]))
+	c.Check(b.String(), Equals, "a")
+
+	// A high surrogate waits for the rest of the pair.
+	emoji := utf16Bytes("🙂", false)
+	w.Write(concat(utf16Bytes("b", false)[1:], emoji[:3]))
+	c.Check(b.String(), Equals, "ab")
+	w.Write(emoji[3:])
+	c.Check(b.String(), Equals, "ab🙂")
+}
+
+func (s *encodingSuite) TestDestError(c *C) {
+	input := utf16Bytes("aé🙂b", false)
+
+	// Writing "a" and "é" (3 bytes of UTF-8) uses 4 bytes of input.
+	dest := servicelogtest.NewScriptedWriter()
+	dest.Limit(4, errors.New("full"))
+	w := servicelog.NewDecodeWriter(dest, servicelog.EncodingUTF16LE)
+	n, err := w.Write(input)
+	c.Check(err, ErrorMatches, "full")
+	c.Check(n, Equals, 4)
+	c.Check(dest.String(), Equals, "aé\xf0")
+
+	dest = servicelogtest.NewScriptedWriter()
+	dest.Limit(2, errors.New("full"))
+	w = servicelog.NewDecodeWriter(dest, servicelog.EncodingAuto)
+	n, err = w.Write(concat(bomUTF8, []byte("abc")))
+	c.Check(err, ErrorMatches, "full")
+	c.Check(n, Equals, 5)
+	c.Check(dest.String(), Equals, "ab")
+}
+
+func (s *encodingSuite) TestFormatted(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	var b bytes.Buffer
+	w := servicelog.NewDecodeWriter(newFormatWriter(&b, "vendor"), servicelog.EncodingAuto)
+	for _, chunk := range splitSizes(concat(bomUTF16LE, utf16Bytes(encodingText, false)), 7) {
+		_, err := w.Write(chunk)
+		c.Assert(err, IsNil)
+	}
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [vendor] héllo wörld 🙂
+2021-05-13T03:16:51.001Z [vendor] second line ✓
+`[1:])
+}
+
+func (s *encodingSuite) TestClose(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	for _, test := range []struct {
+		encoding string
+		input    []byte
+		output   string
+	}{{
+		// An odd byte at the end of UTF-16 can't be decoded.
+		encoding: servicelog.EncodingUTF16LE,
+		input:    concat(utf16Bytes("done", false), []byte{'x'}),
+		output:   "2021-05-13T03:16:51.001Z [vendor] done\ufffd [incomplete line]\n",
+	}, {
+		// Nor can a high surrogate without its pair.
+		encoding: servicelog.EncodingUTF16BE,
+		input:    utf16Bytes("🙂", true)[:2],
+		output:   "2021-05-13T03:16:51.001Z [vendor] \ufffd [incomplete line]\n",
+	}, {
+		// What might have been the start of a byte-order mark is passed
+		// through, and the formatter writes it as the incomplete
+		// character it is.
+		encoding: servicelog.EncodingAuto,
+		input:    []byte{0xef, 0xbb},
+		output:   "2021-05-13T03:16:51.001Z [vendor] \ufffd [incomplete line]\n",
+	}, {
+		encoding: servicelog.EncodingUTF16LE,
+		input:    utf16Bytes("done\n", false),
+		output:   "2021-05-13T03:16:51.001Z [vendor] done\n",
+	}} {
+		var b bytes.Buffer
+		w := servicelog.NewDecodeWriter(newFormatWriter(&b, "vendor"), test.encoding)
+		_, err := w.Write(test.input)
+		c.Assert(err, IsNil)
+		err = w.(io.Closer).Close()
+		c.Assert(err, IsNil)
+		c.Check(b.String(), Equals, test.output, Commentf("encoding %s, input %q", test.encoding, test.input))
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Stages of a service's log pipeline, as reported in WriteError, in the
+// "stage" profiler label (see WithLabels), and in latency histograms (see
+// Tracer).
+const (
+	// StageCoalesce is the joining of tiny writes into lines (see
+	// NewCoalesceWriter).
+	StageCoalesce = "coalesce"
+	// StageDecode is the conversion of the output to UTF-8 (see
+	// NewDecodeWriter).
+	StageDecode = "decode"
+	// StageFormat is the formatter adding timestamps and service names.
+	StageFormat = "format"
+	// StageBuffer is the append of formatted lines to the log buffer.
+	StageBuffer = "buffer"
+	// StageOutput is the copy of the logs to pebble's own output.
+	StageOutput = "output"
+)
+
+// WriteError is the error returned when writing a service's logs to a
+// destination fails. It records which service and which stage of the log
+// pipeline the failure came from.
+type WriteError struct {
+	Service string
+	Stage   string
+	Err     error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("cannot write logs for service %q (%s): %v", e.Service, e.Stage, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// ReadError is the error returned by ReadFrom when reading a service's
+// output fails, as opposed to writing its logs, which fails with a
+// WriteError. Service is empty if the reader doesn't know the service.
+type ReadError struct {
+	Service string
+	Err     error
+}
+
+func (e *ReadError) Error() string {
+	if e.Service == "" {
+		return fmt.Sprintf("cannot read service output: %v", e.Err)
+	}
+	return fmt.Sprintf("cannot read output of service %q: %v", e.Service, e.Err)
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// wrapWriteError annotates err with the service and stage, unless it's
+// nil or already annotated by a later stage of the pipeline.
+func wrapWriteError(err error, service, stage string) error {
+	var writeErr *WriteError
+	if err == nil || errors.As(err, &writeErr) {
+		return err
+	}
+	return &WriteError{Service: service, Stage: stage, Err: err}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+// PebbleName is the service name given to the lines pebble itself writes to
+// a service's logs, such as those marking where the service started and
+// exited. No service can have this name.
+const PebbleName = "pebble"
+
+// WriteEvent writes message to rb as a log line of pebble's own, on a line
+// of its own even if the service's last line is incomplete.
+func WriteEvent(rb *RingBuffer, message string) error {
+	line := make([]byte, 0, len(outputTimeFormat)+len(PebbleName)+len(message)+5)
+	line = clock.Now().UTC().AppendFormat(line, outputTimeFormat)
+	line = append(line, " ["+PebbleName+"] "...)
+	line = append(line, message...)
+	line = append(line, '\n')
+	return rb.writeLine(line)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type eventSuite struct{}
+
+var _ = Suite(&eventSuite{})
+
+func (s *eventSuite) TestWriteEvent(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	rb := servicelog.NewRingBuffer(1024)
+	w := newFormatWriter(rb, "svc")
+	err := servicelog.WriteEvent(rb, `--- service "svc" started ---`)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "one\ntw")
+	c.Assert(err, IsNil)
+	// The service's incomplete line is ended first.
+	err = servicelog.WriteEvent(rb, `--- service "svc" exited ---`)
+	c.Assert(err, IsNil)
+
+	c.Check(ringBufferString(c, rb), Equals, `
+2021-05-13T03:16:51.001Z [pebble] --- service "svc" started ---
+2021-05-13T03:16:51.001Z [svc] one
+2021-05-13T03:16:51.001Z [svc] tw
+2021-05-13T03:16:51.001Z [pebble] --- service "svc" exited ---
+`[1:])
+
+	parser := servicelog.NewParser(bytes.NewReader([]byte(ringBufferString(c, rb))), 1024)
+	c.Assert(parser.Next(), Equals, true)
+	c.Check(parser.Entry().Service, Equals, servicelog.PebbleName)
+	c.Check(parser.Entry().Message, Equals, "--- service \"svc\" started ---\n")
+}
+
+func (s *eventSuite) TestWriteEventClosed(c *C) {
+	rb := servicelog.NewRingBuffer(1024)
+	c.Assert(rb.Close(), IsNil)
+	err := servicelog.WriteEvent(rb, "event")
+	c.Check(err, Equals, io.ErrClosedPipe)
+}
+
+func ringBufferString(c *C, rb *servicelog.RingBuffer) string {
+	it := rb.TailIterator()
+	defer it.Close()
+	var b bytes.Buffer
+	for it.Next(nil) {
+		_, err := io.Copy(&b, it)
+		c.Assert(err, IsNil)
+	}
+	return b.String()
+}
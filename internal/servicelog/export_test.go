@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+var WriteFull = writeFull
+
+const MaxTracedLines = maxTracedLines
+
+var TailGlobInterval = tailGlobInterval
+
+func (t *Tailer) Poll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.poll()
+}
+
+// FakeSyslogTimeouts sets the backoff between connection attempts and the
+// time Close waits for the lines held to be sent.
+func FakeSyslogTimeouts(backoff, close time.Duration) (restore func()) {
+	oldMin, oldMax, oldClose := syslogMinBackoff, syslogMaxBackoff, syslogCloseTimeout
+	syslogMinBackoff, syslogMaxBackoff, syslogCloseTimeout = backoff, backoff, close
+	return func() {
+		syslogMinBackoff, syslogMaxBackoff, syslogCloseTimeout = oldMin, oldMax, oldClose
+	}
+}
+
+func FakeJournalSocket(path string) (restore func()) {
+	old := journalSocketPath
+	journalSocketPath = path
+	return func() {
+		journalSocketPath = old
+	}
+}
+
+func FakeTerminal(f func(w io.Writer) bool) (restore func()) {
+	old := isTerminal
+	isTerminal = f
+	return func() {
+		isTerminal = old
+	}
+}
+
+// DeadlineTimer is a deadlineTimer with its own lock, for tests.
+type DeadlineTimer struct {
+	mu sync.Mutex
+	t  *deadlineTimer
+}
+
+func NewDeadlineTimer(fire func()) *DeadlineTimer {
+	t := &DeadlineTimer{}
+	t.t = newDeadlineTimer(&t.mu, fire)
+	return t
+}
+
+func (t *DeadlineTimer) Reset(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.t.Reset(d)
+}
+
+func (t *DeadlineTimer) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.t.Stop()
+}
+
+func (t *DeadlineTimer) Armed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.t.Armed()
+}
+
+func (t *DeadlineTimer) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.t.Close()
+}
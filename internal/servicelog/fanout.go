@@ -0,0 +1,193 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// FanoutWriter writes a service's logs to several destinations, such as a
+// file, the log buffer and a network forwarder, without letting one that
+// fails hold up the others. A destination that fails is set aside, and what
+// would have been written to it is dropped and counted, until it's retried
+// after the writer's retry delay.
+//
+// A destination that's retried carries on at the start of a line: if a
+// line was cut off when it failed, it's ended with IncompleteLineMarker,
+// and the rest of the line being written when it's retried is dropped.
+type FanoutWriter struct {
+	mu    sync.Mutex
+	retry time.Duration
+	dests []*fanoutDest
+	// midLine is set if the last write ended in the middle of a line.
+	midLine bool
+}
+
+type fanoutDest struct {
+	label string
+	dest  io.Writer
+	// err is set while the destination is failing, until retryAt, and
+	// midLine if the last write to it ended in the middle of a line.
+	err     error
+	retryAt time.Time
+	midLine bool
+	// resuming is set once the destination has been retried, until the
+	// start of a line is written.
+	resuming bool
+	dropped  int64
+	failures int
+}
+
+// NewFanoutWriter returns a FanoutWriter that retries failed destinations
+// after retry, or never if retry isn't positive.
+func NewFanoutWriter(retry time.Duration) *FanoutWriter {
+	return &FanoutWriter{retry: retry}
+}
+
+// Add adds a destination, with a label to identify it by in Errors and
+// Dropped. Labels must be unique.
+func (f *FanoutWriter) Add(label string, dest io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.dests {
+		if d.label == label {
+			return fmt.Errorf("log destination %q already added", label)
+		}
+	}
+	f.dests = append(f.dests, &fanoutDest{label: label, dest: dest, resuming: f.midLine})
+	return nil
+}
+
+// Write writes p to each destination that isn't failing, and always
+// reports all of p written: failures are reported by Errors instead.
+func (f *FanoutWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	now := clock.Now()
+	for _, d := range f.dests {
+		f.writeDest(d, p, now)
+	}
+	f.midLine = p[len(p)-1] != '\n'
+	return len(p), nil
+}
+
+func (f *FanoutWriter) writeDest(d *fanoutDest, p []byte, now time.Time) {
+	if d.err != nil {
+		if f.retry <= 0 || now.Before(d.retryAt) {
+			d.dropped += int64(len(p))
+			return
+		}
+		d.resuming = true
+	}
+	if d.resuming {
+		if f.midLine {
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				d.dropped += int64(len(p))
+				return
+			}
+			d.dropped += int64(i + 1)
+			p = p[i+1:]
+		}
+		if d.midLine {
+			if _, err := writeFull(d.dest, []byte(IncompleteLineMarker+"\n")); err != nil {
+				f.failed(d, err, len(p), now)
+				return
+			}
+			d.midLine = false
+		}
+		d.resuming = false
+		d.err = nil
+		if len(p) == 0 {
+			return
+		}
+	}
+	n, err := writeFull(d.dest, p)
+	if n > 0 {
+		d.midLine = p[n-1] != '\n'
+	}
+	if err != nil {
+		f.failed(d, err, len(p)-n, now)
+	}
+}
+
+// failed sets d aside after a write to it failed with err, dropping the
+// given number of bytes.
+func (f *FanoutWriter) failed(d *fanoutDest, err error, dropped int, now time.Time) {
+	d.err = err
+	d.retryAt = now.Add(f.retry)
+	d.resuming = false
+	d.dropped += int64(dropped)
+	d.failures++
+}
+
+// Errors returns the error that each destination that's failing failed
+// with, by label.
+func (f *FanoutWriter) Errors() map[string]error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	errs := make(map[string]error)
+	for _, d := range f.dests {
+		if d.err != nil {
+			errs[d.label] = d.err
+		}
+	}
+	return errs
+}
+
+// Dropped returns the number of bytes dropped for each destination so far,
+// by label, while it was failing.
+func (f *FanoutWriter) Dropped() map[string]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dropped := make(map[string]int64, len(f.dests))
+	for _, d := range f.dests {
+		dropped[d.label] = d.dropped
+	}
+	return dropped
+}
+
+// Failures returns the number of times each destination has failed so far,
+// by label.
+func (f *FanoutWriter) Failures() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failures := make(map[string]int, len(f.dests))
+	for _, d := range f.dests {
+		failures[d.label] = d.failures
+	}
+	return failures
+}
+
+// Close closes the destinations that are io.Closers, and returns the first
+// error.
+func (f *FanoutWriter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	for _, d := range f.dests {
+		if closeErr := closeWriter(d.dest); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
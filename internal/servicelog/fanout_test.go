@@ -0,0 +1,173 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type fanoutSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&fanoutSuite{})
+
+func (s *fanoutSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *fanoutSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *fanoutSuite) TestWrite(c *C) {
+	f := servicelog.NewFanoutWriter(time.Second)
+	file, buffer := &bytes.Buffer{}, &bytes.Buffer{}
+	c.Assert(f.Add("file", file), IsNil)
+	c.Assert(f.Add("buffer", buffer), IsNil)
+	c.Check(f.Add("file", &bytes.Buffer{}), ErrorMatches, `log destination "file" already added`)
+
+	for _, p := range []string{"first\nsec", "ond\n"} {
+		n, err := io.WriteString(f, p)
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, len(p))
+	}
+	c.Check(file.String(), Equals, "first\nsecond\n")
+	c.Check(buffer.String(), Equals, "first\nsecond\n")
+	c.Check(f.Errors(), HasLen, 0)
+	c.Check(f.Dropped(), DeepEquals, map[string]int64{"file": 0, "buffer": 0})
+}
+
+func (s *fanoutSuite) TestPermanentFailure(c *C) {
+	f := servicelog.NewFanoutWriter(time.Second)
+	full := failingWriter(syscall.ENOSPC)
+	buffer := &bytes.Buffer{}
+	c.Assert(f.Add("file", full), IsNil)
+	c.Assert(f.Add("buffer", buffer), IsNil)
+
+	// The healthy destination carries on, and the other is retried after
+	// the delay, failing again.
+	for i := 0; i < 3; i++ {
+		n, err := io.WriteString(f, "line\n")
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, 5)
+		s.clock.Advance(600 * time.Millisecond)
+	}
+	c.Check(buffer.String(), Equals, "line\nline\nline\n")
+	c.Check(full.Calls(), DeepEquals, []string{"line\n", "line\n"})
+	c.Check(f.Errors(), DeepEquals, map[string]error{"file": syscall.ENOSPC})
+	c.Check(f.Dropped(), DeepEquals, map[string]int64{"file": 15, "buffer": 0})
+	c.Check(f.Failures(), DeepEquals, map[string]int{"file": 2, "buffer": 0})
+}
+
+func (s *fanoutSuite) TestTransientFailure(c *C) {
+	errTransient := errors.New("transient")
+	f := servicelog.NewFanoutWriter(time.Second)
+	flaky := servicelogtest.NewScriptedWriter(
+		servicelogtest.Accept(),
+		servicelogtest.FailAfter(3, errTransient),
+	)
+	buffer := &bytes.Buffer{}
+	c.Assert(f.Add("network", flaky), IsNil)
+	c.Assert(f.Add("buffer", buffer), IsNil)
+
+	// The destination fails in the middle of a line, and what's written
+	// before the retry delay is dropped.
+	for _, p := range []string{"first\n", "second\nthi", "rd\n"} {
+		_, err := io.WriteString(f, p)
+		c.Assert(err, IsNil)
+	}
+	c.Check(f.Errors(), DeepEquals, map[string]error{"network": errTransient})
+
+	// Once retried, it carries on with the next line, after ending the
+	// line it was cut off in.
+	s.clock.Advance(time.Second)
+	for _, p := range []string{"four", "th\nfifth\n"} {
+		_, err := io.WriteString(f, p)
+		c.Assert(err, IsNil)
+	}
+	c.Check(flaky.String(), Equals, "first\nsec"+servicelog.IncompleteLineMarker+"\nfourth\nfifth\n")
+	c.Check(buffer.String(), Equals, "first\nsecond\nthird\nfourth\nfifth\n")
+	c.Check(f.Errors(), HasLen, 0)
+	c.Check(f.Dropped(), DeepEquals, map[string]int64{"network": 7 + 3, "buffer": 0})
+	c.Check(f.Failures(), DeepEquals, map[string]int{"network": 1, "buffer": 0})
+}
+
+func (s *fanoutSuite) TestRetryMidLine(c *C) {
+	f := servicelog.NewFanoutWriter(time.Second)
+	flaky := servicelogtest.NewScriptedWriter(servicelogtest.Fail(syscall.EIO))
+	c.Assert(f.Add("file", flaky), IsNil)
+	_, err := io.WriteString(f, "first\nsec")
+	c.Assert(err, IsNil)
+
+	// Retried in the middle of a line, the destination skips to the start
+	// of the next one.
+	s.clock.Advance(time.Second)
+	for _, p := range []string{"on", "d\nthird\n"} {
+		_, err := io.WriteString(f, p)
+		c.Assert(err, IsNil)
+	}
+	c.Check(flaky.String(), Equals, "third\n")
+	c.Check(f.Errors(), HasLen, 0)
+	c.Check(f.Dropped(), DeepEquals, map[string]int64{"file": 9 + 2 + 2})
+}
+
+func (s *fanoutSuite) TestNoRetry(c *C) {
+	f := servicelog.NewFanoutWriter(0)
+	flaky := servicelogtest.NewScriptedWriter(servicelogtest.Fail(syscall.EIO))
+	c.Assert(f.Add("file", flaky), IsNil)
+	_, err := io.WriteString(f, "first\n")
+	c.Assert(err, IsNil)
+	s.clock.Advance(time.Hour)
+	_, err = io.WriteString(f, "second\n")
+	c.Assert(err, IsNil)
+	c.Check(flaky.Calls(), DeepEquals, []string{"first\n"})
+	c.Check(f.Errors(), DeepEquals, map[string]error{"file": syscall.EIO})
+	c.Check(f.Dropped(), DeepEquals, map[string]int64{"file": 13})
+}
+
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+	err    error
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return r.err
+}
+
+func (s *fanoutSuite) TestClose(c *C) {
+	f := servicelog.NewFanoutWriter(time.Second)
+	first := &closeRecorder{err: errors.New("cannot close")}
+	second := &closeRecorder{}
+	c.Assert(f.Add("first", first), IsNil)
+	c.Assert(f.Add("plain", &bytes.Buffer{}), IsNil)
+	c.Assert(f.Add("second", second), IsNil)
+	c.Check(f.Close(), ErrorMatches, "cannot close")
+	c.Check(first.closed, Equals, true)
+	c.Check(second.closed, Equals, true)
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+)
+
+// FilterMaxLine is the length of the longest line a FilterWriter holds
+// back to match whole. A longer line is passed on or dropped as decided by
+// its start.
+const FilterMaxLine = 64 * 1024
+
+// FilterWriter passes on only the lines of a service's output that match
+// its include pattern, if it has one, and don't match its exclude pattern,
+// if it has one, so that a line matching both is dropped. The lines are
+// matched without their newline, and those dropped are counted. Lines are
+// matched whole, so an incomplete line is held back until it's complete,
+// up to FilterMaxLine bytes.
+type FilterWriter struct {
+	mu      sync.Mutex
+	dest    io.Writer
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+	// line is the incomplete line held back. Once a line too long to
+	// hold back has been decided on by its start, long is set until its
+	// end, and keepLong if it's passed on.
+	line     []byte
+	long     bool
+	keepLong bool
+	stats    *writerStats
+}
+
+// NewFilterWriter returns a FilterWriter that writes the lines passing the
+// include and exclude patterns to dest. Either pattern may be nil, but not
+// both.
+func NewFilterWriter(dest io.Writer, include, exclude *regexp.Regexp) (*FilterWriter, error) {
+	if include == nil && exclude == nil {
+		return nil, errors.New("no filter patterns given")
+	}
+	return &FilterWriter{
+		dest:    dest,
+		include: include,
+		exclude: exclude,
+		stats:   &writerStats{},
+	}, nil
+}
+
+// Write passes on the lines in p that pass the filter, and reports the
+// lines dropped as written too.
+func (f *FilterWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// The lines kept are passed on in runs, the current one starting at
+	// run in p.
+	run := 0
+	for pos := 0; pos < len(p); {
+		chunk := p[pos:]
+		end := false
+		if i := bytes.IndexByte(chunk, '\n'); i >= 0 {
+			chunk = chunk[:i+1]
+			end = true
+		}
+		keep := false
+		switch {
+		case f.long:
+			keep = f.keepLong
+			f.long = !end
+		case end && len(f.line) == 0:
+			keep = f.keep(chunk)
+			if !keep {
+				f.stats.addDropped(1)
+			}
+		default:
+			if n, err := f.stats.writeFull(f.dest, p[run:pos]); err != nil {
+				return run + n, err
+			}
+			f.line = append(f.line, chunk...)
+			pos += len(chunk)
+			run = pos
+			if !end && len(f.line) < FilterMaxLine {
+				continue
+			}
+			f.long = !end
+			f.keepLong = f.decide()
+			if err := f.flushLine(f.keepLong); err != nil {
+				return pos - len(chunk), err
+			}
+			continue
+		}
+		if !keep {
+			if n, err := f.stats.writeFull(f.dest, p[run:pos]); err != nil {
+				return run + n, err
+			}
+			run = pos + len(chunk)
+		}
+		pos += len(chunk)
+	}
+	if n, err := f.stats.writeFull(f.dest, p[run:]); err != nil {
+		return run + n, err
+	}
+	return len(p), nil
+}
+
+// keep reports whether line passes the filter.
+func (f *FilterWriter) keep(line []byte) bool {
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	if f.include != nil && !f.include.Match(line) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.Match(line)
+}
+
+// decide reports whether the line held back passes the filter, counting
+// it if it doesn't.
+func (f *FilterWriter) decide() bool {
+	keep := f.keep(f.line)
+	if !keep {
+		f.stats.addDropped(1)
+	}
+	return keep
+}
+
+// flushLine writes the line held back, if keep is set, and forgets it.
+func (f *FilterWriter) flushLine(keep bool) error {
+	line := f.line
+	f.line = f.line[:0]
+	if !keep {
+		return nil
+	}
+	_, err := f.stats.writeFull(f.dest, line)
+	return err
+}
+
+// Dropped returns the number of lines dropped so far.
+func (f *FilterWriter) Dropped() int64 {
+	return f.stats.droppedLines()
+}
+
+// Stats returns the writer's statistics.
+func (f *FilterWriter) Stats() WriterStats {
+	return f.stats.snapshot()
+}
+
+// flushIdle decides on the incomplete line held back by its start, as for
+// a line too long to hold back, for an IdleFlushWriter.
+func (f *FilterWriter) flushIdle() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.line) > 0 {
+		f.long = true
+		f.keepLong = f.decide()
+		if err := f.flushLine(f.keepLong); err != nil {
+			return err
+		}
+	}
+	return flushIdle(f.dest)
+}
+
+// Close passes on the incomplete line held back, if it passes the filter,
+// and closes dest if it's an io.Closer.
+func (f *FilterWriter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	if len(f.line) > 0 {
+		err = f.flushLine(f.decide())
+	}
+	if closeErr := closeWriter(f.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
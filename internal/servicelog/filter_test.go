@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type filterSuite struct{}
+
+var _ = Suite(&filterSuite{})
+
+const filterInput = `DEBUG connecting
+INFO connected
+WARN slow response
+ERROR request failed
+WARN retrying (ignore)
+`
+
+var filterTests = []struct {
+	summary string
+	include string
+	exclude string
+	output  string
+	dropped int64
+}{{
+	summary: "Include only",
+	include: `^(WARN|ERROR) `,
+	output:  "WARN slow response\nERROR request failed\nWARN retrying (ignore)\n",
+	dropped: 2,
+}, {
+	summary: "Exclude only",
+	exclude: `^DEBUG `,
+	output:  "INFO connected\nWARN slow response\nERROR request failed\nWARN retrying (ignore)\n",
+	dropped: 1,
+}, {
+	summary: "Both, with exclude winning",
+	include: `^(WARN|ERROR) `,
+	exclude: `\(ignore\)$`,
+	output:  "WARN slow response\nERROR request failed\n",
+	dropped: 3,
+}}
+
+func (s *filterSuite) TestNew(c *C) {
+	_, err := servicelog.NewFilterWriter(&bytes.Buffer{}, nil, nil)
+	c.Check(err, ErrorMatches, "no filter patterns given")
+}
+
+func (s *filterSuite) TestFilter(c *C) {
+	for _, test := range filterTests {
+		var include, exclude *regexp.Regexp
+		if test.include != "" {
+			include = regexp.MustCompile(test.include)
+		}
+		if test.exclude != "" {
+			exclude = regexp.MustCompile(test.exclude)
+		}
+		// The lines are matched whole, whatever the writes.
+		for _, size := range []int{1, 5, len(filterInput)} {
+			b := &bytes.Buffer{}
+			f, err := servicelog.NewFilterWriter(b, include, exclude)
+			c.Assert(err, IsNil)
+			writeSized(c, f, filterInput, size)
+			c.Check(b.String(), Equals, test.output, Commentf("%s, writes of %d bytes", test.summary, size))
+			c.Check(f.Dropped(), Equals, test.dropped, Commentf("%s, writes of %d bytes", test.summary, size))
+		}
+	}
+}
+
+func (s *filterSuite) TestIncompleteLine(c *C) {
+	b := &bytes.Buffer{}
+	f, err := servicelog.NewFilterWriter(b, regexp.MustCompile(`keep`), nil)
+	c.Assert(err, IsNil)
+	n, err := io.WriteString(f, "drop\nkeep this\nkeep tha")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 23)
+	c.Check(b.String(), Equals, "keep this\n")
+	c.Assert(f.Close(), IsNil)
+	c.Check(b.String(), Equals, "keep this\nkeep tha")
+	c.Check(f.Dropped(), Equals, int64(1))
+}
+
+func (s *filterSuite) TestLongLine(c *C) {
+	// A line too long to hold back is decided on by its start.
+	b := &bytes.Buffer{}
+	f, err := servicelog.NewFilterWriter(b, nil, regexp.MustCompile(`^drop`))
+	c.Assert(err, IsNil)
+	long := strings.Repeat("x", servicelog.FilterMaxLine)
+	for _, p := range []string{"drop" + long, "more\n", "keep" + long, "more\n"} {
+		n, err := io.WriteString(f, p)
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, len(p))
+	}
+	c.Check(b.String(), Equals, "keep"+long+"more\n")
+	c.Check(f.Dropped(), Equals, int64(1))
+}
+
+func (s *filterSuite) TestChunking(c *C) {
+	inputs := append([]string(nil), chunkingInputs...)
+	inputs = append(inputs, filterInput)
+	newWriter := func(dest io.Writer) io.Writer {
+		f, err := servicelog.NewFilterWriter(dest, regexp.MustCompile(`[aeiou]`), regexp.MustCompile(`^(WARN|long)`))
+		c.Assert(err, IsNil)
+		return f
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		err := checkChunking(newWriter, inputs, seed, 20)
+		c.Assert(err, IsNil, Commentf("seed %d", seed))
+	}
+}
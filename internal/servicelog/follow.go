@@ -0,0 +1,206 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrFellBehind is returned by Follower.Next when lines the follower had
+// yet to read were overwritten. Following resumes at the oldest whole line
+// left in the buffer.
+var ErrFellBehind = errors.New("log follower fell behind: lines were dropped")
+
+// TailLines returns copies of the last n complete lines in the buffer,
+// oldest first, each with its newline. An incomplete line at the end of
+// the buffer isn't included, and neither is the rest of a line whose start
+// was overwritten.
+func (rb *RingBuffer) TailLines(n int) [][]byte {
+	if n <= 0 {
+		return nil
+	}
+	rb.rwlock.RLock()
+	defer rb.rwlock.RUnlock()
+	start, partial := rb.lineStart(n)
+	end, _ := rb.lineStart(0)
+	if partial {
+		start, _ = rb.nextLine(start, end)
+	}
+	if start >= end {
+		return nil
+	}
+	data := make([]byte, 0, end-start)
+	for _, buffer := range rb.buffers(start, end) {
+		data = append(data, buffer...)
+	}
+	var lines [][]byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		lines = append(lines, data[:i+1:i+1])
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// lineStart returns the position of the start of the n-th last complete
+// line in the buffer, or of the incomplete line at its end if n is zero.
+// If there are fewer lines, it returns the start of the buffer, and
+// whether that's the rest of a line whose start was overwritten. The
+// caller must hold rb.rwlock.
+func (rb *RingBuffer) lineStart(n int) (start RingPos, partial bool) {
+	if len(rb.data) == 0 {
+		return rb.readIndex, rb.partialStart
+	}
+	// The first newline found ends the incomplete line, if any.
+	lines := -1
+	for pos := rb.writeIndex - 1; pos >= rb.readIndex; pos-- {
+		if rb.data[pos%RingPos(len(rb.data))] != '\n' {
+			continue
+		}
+		lines++
+		if lines == n {
+			return pos + 1, false
+		}
+	}
+	return rb.readIndex, rb.partialStart
+}
+
+// nextLine returns the position after the first newline between start and
+// end, if there's one, or end. The caller must hold rb.rwlock.
+func (rb *RingBuffer) nextLine(start, end RingPos) (RingPos, bool) {
+	if start >= end {
+		// buffers doesn't return an empty range.
+		return end, false
+	}
+	pos := start
+	for _, buffer := range rb.buffers(start, end) {
+		if i := bytes.IndexByte(buffer, '\n'); i >= 0 {
+			return pos + RingPos(i) + 1, true
+		}
+		pos += RingPos(len(buffer))
+	}
+	return end, false
+}
+
+// Follower reads the lines written to a RingBuffer one at a time, waiting
+// for more as they're written, like tail -f.
+type Follower struct {
+	rb   *RingBuffer
+	wake *iterator
+	// pos is the start of the next line to read, and scanned is how far
+	// the line has been searched for its newline. If skip is set, pos is
+	// in the middle of a line whose start was overwritten, which is
+	// skipped.
+	pos     RingPos
+	scanned RingPos
+	skip    bool
+	missed  int64
+}
+
+// Follow returns a Follower that starts with the last n complete lines in
+// the buffer, followed by the lines completed after that. It must be
+// closed when no longer needed.
+func (rb *RingBuffer) Follow(n int) *Follower {
+	if n < 0 {
+		n = 0
+	}
+	// The follower is woken like an iterator when the buffer is written to
+	// or closed.
+	wake := rb.TailIterator().(*iterator)
+	rb.rwlock.RLock()
+	defer rb.rwlock.RUnlock()
+	start, partial := rb.lineStart(n)
+	return &Follower{
+		rb:      rb,
+		wake:    wake,
+		pos:     start,
+		scanned: start,
+		skip:    partial,
+	}
+}
+
+// Next returns a copy of the next complete line, with its newline, waiting
+// until one is written. It returns ErrFellBehind, once, if lines were
+// overwritten before they were read, io.EOF once the buffer is closed and
+// its complete lines read, or ctx's error if it's done first.
+func (f *Follower) Next(ctx context.Context) ([]byte, error) {
+	for {
+		line, err := f.next()
+		if line != nil || err != nil {
+			return line, err
+		}
+		select {
+		case <-f.wake.nextChan:
+		case <-f.wake.closeChan:
+			if f.rb.Closed() {
+				line, err := f.next()
+				if line != nil || err != nil {
+					return line, err
+				}
+				return nil, io.EOF
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// next returns the next complete line, if it has been written.
+func (f *Follower) next() ([]byte, error) {
+	f.rb.rwlock.RLock()
+	defer f.rb.rwlock.RUnlock()
+	start, end := f.rb.readIndex, f.rb.writeIndex
+	if f.pos < start {
+		f.missed += int64(start - f.pos)
+		f.pos = start
+		f.scanned = start
+		f.skip = f.rb.partialStart
+		return nil, ErrFellBehind
+	}
+	if f.skip {
+		next, ok := f.rb.nextLine(f.scanned, end)
+		f.missed += int64(next - f.pos)
+		f.pos, f.scanned = next, next
+		if !ok {
+			return nil, nil
+		}
+		f.skip = false
+	}
+	next, ok := f.rb.nextLine(f.scanned, end)
+	if !ok {
+		f.scanned = end
+		return nil, nil
+	}
+	line := make([]byte, 0, next-f.pos)
+	for _, buffer := range f.rb.buffers(f.pos, next) {
+		line = append(line, buffer...)
+	}
+	f.pos, f.scanned = next, next
+	return line, nil
+}
+
+// Missed returns the number of bytes the follower has skipped because
+// they, or the start of their line, were overwritten before it read them.
+func (f *Follower) Missed() int64 {
+	return f.missed
+}
+
+// Close stops the follower.
+func (f *Follower) Close() error {
+	return f.wake.Close()
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type followSuite struct{}
+
+var _ = Suite(&followSuite{})
+
+func linesString(lines [][]byte) string {
+	var b strings.Builder
+	for _, line := range lines {
+		b.Write(line)
+	}
+	return b.String()
+}
+
+func (s *followSuite) TestTailLines(c *C) {
+	rb := servicelog.NewRingBuffer(100)
+	c.Check(rb.TailLines(10), HasLen, 0)
+	fmt.Fprint(rb, "first\nsecond\nthird\nincomp")
+
+	c.Check(rb.TailLines(0), HasLen, 0)
+	lines := rb.TailLines(2)
+	c.Assert(lines, HasLen, 2)
+	c.Check(string(lines[0]), Equals, "second\n")
+	c.Check(string(lines[1]), Equals, "third\n")
+	c.Check(linesString(rb.TailLines(10)), Equals, "first\nsecond\nthird\n")
+
+	// The lines returned are copies.
+	lines[0][0] = 'X'
+	c.Check(linesString(rb.TailLines(2)), Equals, "second\nthird\n")
+}
+
+func (s *followSuite) TestTailLinesWrapped(c *C) {
+	rb := servicelog.NewRingBuffer(20)
+	fmt.Fprint(rb, "0123456789\n")
+	fmt.Fprint(rb, "abcdefghi\n")
+	fmt.Fprint(rb, "ABCDE\n")
+
+	// The buffer starts in the middle of the first line, which isn't
+	// returned.
+	c.Check(linesString(rb.TailLines(10)), Equals, "abcdefghi\nABCDE\n")
+	c.Check(linesString(rb.TailLines(1)), Equals, "ABCDE\n")
+
+	// Overwritten up to a newline: the buffer starts with a whole line.
+	rb = servicelog.NewRingBuffer(20)
+	fmt.Fprint(rb, "0123456789\n")
+	fmt.Fprint(rb, "abcdefgh\n")
+	fmt.Fprint(rb, "ABCDEFGHIJ\n")
+	c.Check(linesString(rb.TailLines(10)), Equals, "abcdefgh\nABCDEFGHIJ\n")
+
+	// No newline left at all.
+	rb = servicelog.NewRingBuffer(10)
+	fmt.Fprint(rb, "0123\n")
+	fmt.Fprint(rb, strings.Repeat("x", 10))
+	c.Check(rb.TailLines(10), HasLen, 0)
+}
+
+func (s *followSuite) TestFollow(c *C) {
+	rb := servicelog.NewRingBuffer(100)
+	fmt.Fprint(rb, "first\nsecond\nthi")
+	f := rb.Follow(1)
+	defer f.Close()
+
+	ctx := context.Background()
+	line, err := f.Next(ctx)
+	c.Assert(err, IsNil)
+	c.Check(string(line), Equals, "second\n")
+
+	// Next waits for the line to be completed.
+	done := make(chan string)
+	go func() {
+		line, err := f.Next(ctx)
+		c.Check(err, IsNil)
+		done <- string(line)
+	}()
+	select {
+	case line := <-done:
+		c.Fatalf("Next returned %q before the line was complete", line)
+	case <-time.After(20 * time.Millisecond):
+	}
+	fmt.Fprint(rb, "rd\nfour")
+	select {
+	case line := <-done:
+		c.Check(line, Equals, "third\n")
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Next didn't return")
+	}
+
+	// Once the buffer is closed, the complete lines are read, and then
+	// Next returns io.EOF.
+	fmt.Fprint(rb, "th\nfifth")
+	rb.Close()
+	line, err = f.Next(ctx)
+	c.Assert(err, IsNil)
+	c.Check(string(line), Equals, "fourth\n")
+	_, err = f.Next(ctx)
+	c.Check(err, Equals, io.EOF)
+	c.Check(f.Missed(), Equals, int64(0))
+}
+
+func (s *followSuite) TestFollowNew(c *C) {
+	rb := servicelog.NewRingBuffer(100)
+	fmt.Fprint(rb, "old\nstarted ")
+	f := rb.Follow(0)
+	defer f.Close()
+	fmt.Fprint(rb, "before following\nnew\n")
+
+	// The incomplete line is followed, as it's completed afterwards.
+	ctx := context.Background()
+	for _, expected := range []string{"started before following\n", "new\n"} {
+		line, err := f.Next(ctx)
+		c.Assert(err, IsNil)
+		c.Check(string(line), Equals, expected)
+	}
+}
+
+func (s *followSuite) TestFollowCancel(c *C) {
+	rb := servicelog.NewRingBuffer(100)
+	f := rb.Follow(10)
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := f.Next(ctx)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		c.Check(err, Equals, context.Canceled)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Next wasn't cancelled")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := f.Next(ctx)
+	c.Check(err, Equals, context.DeadlineExceeded)
+}
+
+func (s *followSuite) TestFollowFellBehind(c *C) {
+	rb := servicelog.NewRingBuffer(20)
+	fmt.Fprint(rb, "first\n")
+	f := rb.Follow(1)
+	defer f.Close()
+
+	// The follower is lapped, in the middle of a line.
+	fmt.Fprint(rb, "0123456789\n")
+	fmt.Fprint(rb, "abcdefghi\n")
+	fmt.Fprint(rb, "ABCD")
+
+	ctx := context.Background()
+	_, err := f.Next(ctx)
+	c.Check(err, Equals, servicelog.ErrFellBehind)
+	c.Check(f.Missed(), Equals, int64(11))
+
+	// It carries on with the first whole line left, skipping the rest of
+	// the line it was lapped in.
+	line, err := f.Next(ctx)
+	c.Assert(err, IsNil)
+	c.Check(string(line), Equals, "abcdefghi\n")
+	c.Check(f.Missed(), Equals, int64(17))
+	fmt.Fprint(rb, "E\n")
+	line, err = f.Next(ctx)
+	c.Assert(err, IsNil)
+	c.Check(string(line), Equals, "ABCDE\n")
+	c.Check(f.Missed(), Equals, int64(17))
+}
+
+func (s *followSuite) TestFollowConcurrentWriters(c *C) {
+	rb := servicelog.NewRingBuffer(1024 * 1024)
+	f := rb.Follow(0)
+	defer f.Close()
+
+	const writers = 4
+	const lines = 2000
+	wg := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				fmt.Fprintf(rb, "writer %d line %d\n", w, i)
+			}
+		}(w)
+	}
+	go func() {
+		wg.Wait()
+		rb.Close()
+	}()
+
+	// Each writer's lines are read whole, and in order.
+	next := make([]int, writers)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		line, err := f.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		var w, i int
+		_, err = fmt.Sscanf(string(line), "writer %d line %d\n", &w, &i)
+		c.Assert(err, IsNil, Commentf("line %q", line))
+		c.Assert(i, Equals, next[w], Commentf("line %q", line))
+		next[w]++
+	}
+	for w := range next {
+		c.Check(next[w], Equals, lines)
+	}
+}
+
+func (s *followSuite) TestFollowConcurrentFellBehind(c *C) {
+	// A follower that can't keep up only ever reads whole lines.
+	rb := servicelog.NewRingBuffer(256)
+	f := rb.Follow(0)
+	defer f.Close()
+	go func() {
+		for i := 0; i < 20000; i++ {
+			fmt.Fprintf(rb, "line %d %s\n", i, strings.Repeat("x", i%37))
+		}
+		rb.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	previous := -1
+	for {
+		line, err := f.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err == servicelog.ErrFellBehind {
+			continue
+		}
+		c.Assert(err, IsNil)
+		var i int
+		_, err = fmt.Sscanf(string(line), "line %d ", &i)
+		c.Assert(err, IsNil, Commentf("line %q", line))
+		c.Assert(string(line), Equals, fmt.Sprintf("line %d %s\n", i, strings.Repeat("x", i%37)))
+		c.Assert(i > previous, Equals, true)
+		previous = i
+	}
+	c.Check(previous, Equals, 19999)
+}
@@ -15,25 +15,139 @@
 package servicelog
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 type formatter struct {
 	mut             sync.Mutex
 	serviceName     string
 	dest            io.Writer
+	stats           *writerStats
 	writeTimestamp  bool
 	timestampBuffer []byte
-	timestamp       []byte
+	// timestamp holds the rest of a prefix that a failed write didn't get
+	// through, to be written before any more payload.
+	timestamp []byte
+	// nameTag is the static part of the prefix, " [serviceName] ",
+	// rendered once so each line only formats its timestamp. stream, if
+	// set, is the name of the output stream, given to WithStream, shown
+	// after the service name.
+	nameTag []byte
+	stream  string
+	// layout is the layout of the timestamps, as given to WithLayout.
+	layout string
+	// location is the time zone of the timestamps, UTC unless given to
+	// WithLocation.
+	location *time.Location
+	// now, if set, is the clock given to WithClock, read once per line for
+	// its timestamp instead of the package's clock.
+	now func() time.Time
+	// lineTime, if set, is the timestamp of the next line, given by
+	// setLineTime, to be used instead of reading the clock.
+	lineTime time.Time
+	// prefixKey is the time (in Unix nanoseconds divided by prefixUnit,
+	// the finest unit the layout shows) that the prefix in timestampBuffer
+	// was rendered for, so that lines written within the same unit can
+	// reuse it.
+	prefixKey  int64
+	prefixUnit int64
+	// batch collects prefixes and lines so that many lines can be passed to
+	// dest in a single write, and segments records its layout.
+	batch    []byte
+	segments []formatSegment
+	// tracer, if set, records the latency of lines: lineArrival is when
+	// the current line's first bytes arrived, and traced holds the lines
+	// ending in the batch, grouped by the write they started in, with
+	// their end offsets in the batch. lineInWrite and groupInWrite are set
+	// if the current line and the last group started in the current write.
+	tracer       *Tracer
+	lineArrival  time.Time
+	traced       []tracedLines
+	lineInWrite  bool
+	groupInWrite bool
+	// joining is set while writeEntry writes an entry, whose lines after
+	// the first continue it without a prefix of their own.
+	joining bool
+	// color is set if the output is coloured, as by WithColor: timeStart
+	// starts each prefix, and
+	// highlight is set while the current line is highlighted.
+	color     bool
+	timeStart []byte
+	highlight bool
+	// cr is set if the last byte consumed was a carriage return, held
+	// until the next byte tells whether it ends a line, and crLines is set
+	// if a carriage return not followed by a newline ends a line too.
+	cr      bool
+	crLines bool
+	// partial holds the start of a character at the end of the last
+	// write, so that it's never split from its rest in dest. It's written
+	// with the next write, after the prefix, if the line starts there.
+	partial []byte
+	// template, if set, is the prefix as given to WithTemplate, instead of
+	// the timestamp and nameTag, parsed from templateText and
+	// templateFields once the options are applied.
+	template       []templateSegment
+	templateText   *string
+	templateFields map[string]string
+	// align, if set, pads nameTag, which was rendered for alignWidth.
+	align      *NameAlignment
+	alignWidth int
+	// readBuf is the buffer the service's output is read into by
+	// ReadFrom, or by that of a writer ahead of the formatter. inPlace is
+	// set while what's written from it is passed to dest in place: lines
+	// of at least inPlaceLine bytes aren't copied into batch, and vector
+	// holds the runs of batch between them and the lines themselves.
+	readBuf []byte
+	inPlace bool
+	vector  [][]byte
 }
 
+// formatSegment is a prefix (possibly empty) and the payload following it
+// in a formatter batch, and the number of bytes of input after the payload
+// that were dropped, a carriage return held. A payload written in place
+// isn't in the batch but at offset in the input; offset is -1 otherwise.
+type formatSegment struct {
+	prefix  int
+	payload int
+	dropped int
+	offset  int
+}
+
+// inPlaceLine is the length from which a line is written in place rather
+// than copied into the batch. Shorter lines cost more to pass as a vector
+// element of their own than to copy.
+const inPlaceLine = 256
+
+// formatBatchSize is the size of payload after which a formatter batch is
+// written to the destination.
+const formatBatchSize = 16 * 1024
+
 const (
 	// outputTimeFormat is RFC3339 with millisecond precision.
 	outputTimeFormat = "2006-01-02T15:04:05.000Z07:00"
 )
 
+// IncompleteLineMarker ends the last line of a service's output when the
+// output is closed before the line is complete, so that nothing written
+// to the log buffer afterwards runs on from it.
+const IncompleteLineMarker = " [incomplete line]"
+
+// LayoutUnixMilli is a timestamp layout for WithLayout that writes the
+// time as the number of milliseconds since the Unix epoch.
+const LayoutUnixMilli = "unix-milli"
+
+// FormatOption changes how the writer returned by NewFormatWriter formats
+// its output. Options can be combined freely, except as they say.
+type FormatOption func(f *formatter) error
+
 // NewFormatWriter returns a io.Writer that inserts timestamp and service name for every
 // line in the stream.
 // For the input:
@@ -44,54 +158,635 @@ const (
 //   2021-05-13T03:16:51.001Z [test] first\n
 //   2021-05-13T03:16:52.002Z [test] second\n
 //   2021-05-13T03:16:53.003Z [test] third\n
-func NewFormatWriter(dest io.Writer, serviceName string) io.Writer {
-	return &formatter{
+// Lines are never accumulated: the prefix is written when the first bytes of
+// a line arrive, and the rest of the line is passed through as it's written,
+// so a line of any length uses no more memory than a short one.
+// A CRLF ends a line as a newline does, and its carriage return is dropped:
+// one at the end of a write is held until the next shows whether a newline
+// follows it. Likewise, the start of a UTF-8 character at the end of a
+// write is held until the next completes it, so that characters are never
+// split in dest; one never completed is written as U+FFFD on Close.
+// The options are applied in order, and an error is returned if any of
+// them is invalid.
+func NewFormatWriter(dest io.Writer, serviceName string, opts ...FormatOption) (io.Writer, error) {
+	f, err := newFormatter(dest, serviceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WithTracer records the latency of each line in tracer (if it's not nil):
+// the time from the line's first bytes being written to the formatter until
+// the whole line has been written to dest, and until it's read by the
+// iterators given to tracer.TraceIterator if dest is a RingBuffer.
+func WithTracer(tracer *Tracer) FormatOption {
+	return func(f *formatter) error {
+		f.tracer = tracer
+		return nil
+	}
+}
+
+// WithLayout writes the timestamps with the given layout, as understood by
+// time.Time.Format, or as Unix milliseconds if layout is LayoutUnixMilli.
+// Only the default layout can be read back by the log parser.
+func WithLayout(layout string) FormatOption {
+	return func(f *formatter) error {
+		switch {
+		case layout == "":
+			return errors.New("timestamp layout must not be empty")
+		case layout == LayoutUnixMilli:
+		case strings.ContainsAny(layout, "\r\n"):
+			return fmt.Errorf("timestamp layout %q must not contain line breaks", layout)
+		case time.Unix(0, 0).UTC().Format(layout) == layout:
+			return fmt.Errorf("timestamp layout %q has no date or time elements", layout)
+		}
+		f.layout = layout
+		f.prefixUnit = int64(time.Millisecond)
+		if layout != LayoutUnixMilli {
+			// Layouts may show fractions of a second down to nanoseconds.
+			f.prefixUnit = 1
+		}
+		return nil
+	}
+}
+
+// WithLocation writes the timestamps in the time zone loc rather than UTC,
+// with its offset from UTC (for example "2021-05-12T23:16:51.001-04:00" in
+// America/New_York).
+func WithLocation(loc *time.Location) FormatOption {
+	return func(f *formatter) error {
+		if loc == nil {
+			return errors.New("timestamp time zone must not be nil")
+		}
+		f.location = loc
+		return nil
+	}
+}
+
+// WithCRLines has a carriage return not followed by a newline end a line
+// too, so that each update of a progress bar, say, is a line of its own,
+// with its own timestamp. A run of carriage returns ends one line, and one
+// at the start of a line is dropped.
+func WithCRLines() FormatOption {
+	return func(f *formatter) error {
+		f.crLines = true
+		return nil
+	}
+}
+
+// WithClock takes each line's timestamp from now instead of the current
+// time. The clock is read exactly once per line, when the line's first
+// bytes are written, so a line written in several writes has the time it
+// started at.
+func WithClock(now func() time.Time) FormatOption {
+	return func(f *formatter) error {
+		if now == nil {
+			return errors.New("timestamp clock must not be nil")
+		}
+		f.now = now
+		return nil
+	}
+}
+
+// newFormatter returns a formatter with the given options applied.
+func newFormatter(dest io.Writer, serviceName string, opts []FormatOption) (*formatter, error) {
+	f := &formatter{
 		serviceName:    serviceName,
 		dest:           dest,
+		stats:          &writerStats{},
 		writeTimestamp: true,
+		layout:         outputTimeFormat,
+		location:       time.UTC,
+		prefixUnit:     int64(time.Millisecond),
+	}
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return nil, err
+		}
 	}
+	if f.templateText != nil {
+		segments, err := parseTemplate(*f.templateText, f.serviceName, f.stream, f.templateFields)
+		if err != nil {
+			return nil, err
+		}
+		f.template = segments
+	}
+	if f.align != nil {
+		f.align.add(f.taggedName())
+	}
+	f.renderNameTag()
+	return f, nil
 }
 
-func (f *formatter) Write(p []byte) (nn int, ee error) {
+// taggedName returns the name shown in the prefix: the service name, and
+// the stream if set.
+func (f *formatter) taggedName() string {
+	if f.stream != "" {
+		return f.serviceName + "/" + f.stream
+	}
+	return f.serviceName
+}
+
+// renderNameTag renders nameTag, the tagged name in brackets, coloured if
+// the output is, and padded to the alignment's current width if set.
+func (f *formatter) renderNameTag() {
+	name, pad := f.taggedName(), 0
+	if f.align != nil {
+		f.alignWidth = f.align.Width()
+		name, pad = f.align.fit(name, f.alignWidth)
+	}
+	if f.color {
+		f.nameTag = []byte(ansiReset + " " + serviceColor(f.serviceName) + "[" + name + "]" + ansiReset + " " + strings.Repeat(" ", pad))
+	} else {
+		f.nameTag = []byte(" [" + name + "] " + strings.Repeat(" ", pad))
+	}
+}
+
+func (f *formatter) Write(p []byte) (int, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.write(p)
+}
+
+// writeEntry writes entry, complete lines of the service's output and
+// possibly the start of another, as a single log entry at time t: only the
+// first line has a prefix.
+func (f *formatter) writeEntry(entry []byte, t time.Time) (int, error) {
 	f.mut.Lock()
 	defer f.mut.Unlock()
+	f.lineTime = t
+	f.joining = true
+	defer func() {
+		f.joining = false
+	}()
+	return f.write(entry)
+}
+
+func (f *formatter) write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if f.tracer != nil {
+		f.lineInWrite = false
+	}
+
+	// Timestamp bytes don't count towards the returned count because they constitute the
+	// encoding not the payload.
+	if len(f.timestamp) > 0 {
+		n, err := f.stats.writeFull(f.dest, f.timestamp)
+		f.timestamp = f.timestamp[n:]
+		if err != nil {
+			return 0, wrapWriteError(err, f.serviceName, StageFormat)
+		}
+	}
+
+	hold := incompleteRune(p)
+	if len(f.partial) > 0 && len(p) < utf8.UTFMax {
+		// The character held may still be incomplete after p, or p may
+		// start another, leaving the bytes held before it, which aren't
+		// a character, to be written as they are.
+		var buf [2 * utf8.UTFMax]byte
+		n := copy(buf[:], f.partial)
+		n += copy(buf[n:], p)
+		if hold = incompleteRune(buf[:n]); hold >= len(p) {
+			held := len(f.partial)
+			f.partial = f.partial[:0]
+			if stale := n - hold; stale > 0 {
+				if err := f.writeStale(buf[:stale]); err != nil {
+					// p isn't taken, so the rest of what was held still is.
+					f.partial = append(f.partial, buf[stale:held]...)
+					return 0, err
+				}
+			}
+			f.partial = append(f.partial, buf[n-hold:n]...)
+			return len(p), nil
+		}
+	}
+	tail := p[len(p)-hold:]
+	p = p[:len(p)-hold]
+
+	// Output read into readBuf is passed on in place if dest takes it as
+	// a vector. Line latency is only traced for batches written whole.
+	var dest vectorWriter
+	if len(p) > 0 && len(f.readBuf) > 0 && &p[0] == &f.readBuf[0] && f.tracer == nil && !f.joining {
+		dest = vectorWriterOf(f.dest)
+	}
+	f.inPlace = dest != nil
+	defer func() {
+		f.inPlace = false
+	}()
+
 	written := 0
 	for len(p) > 0 {
-		if f.writeTimestamp {
+		consumed := f.fillBatch(p)
+		var n int
+		var err error
+		if f.inPlace {
+			n, err = f.writeVector(dest, p)
+		} else {
+			n, err = f.stats.writeFull(f.dest, f.batch)
+		}
+		if err != nil {
+			return written + f.batchFailed(n), wrapWriteError(err, f.serviceName, StageFormat)
+		}
+		if f.tracer != nil && len(f.traced) > 0 {
+			f.traceBatch()
+		}
+		p = p[consumed:]
+		written += consumed
+	}
+	f.partial = append(f.partial[:0], tail...)
+	return written + len(tail), nil
+}
+
+// writeVector writes the batch formatted in place from p to dest: the runs
+// of the batch and the long lines between them, which are still in p.
+func (f *formatter) writeVector(dest vectorWriter, p []byte) (int, error) {
+	f.vector = f.vector[:0]
+	start, offset := 0, 0
+	size := len(f.batch)
+	lines := bytes.Count(f.batch, []byte{'\n'})
+	for _, segment := range f.segments {
+		offset += segment.prefix
+		if segment.offset < 0 {
+			offset += segment.payload
+			continue
+		}
+		line := p[segment.offset : segment.offset+segment.payload]
+		if start < offset {
+			f.vector = append(f.vector, f.batch[start:offset])
+			start = offset
+		}
+		f.vector = append(f.vector, line)
+		size += len(line)
+		if line[len(line)-1] == '\n' {
+			lines++
+		}
+	}
+	if start < len(f.batch) {
+		f.vector = append(f.vector, f.batch[start:])
+	}
+	n, err := dest.writeVector(f.vector, size, lines)
+	if n == size {
+		f.stats.wroteLines(n, lines, err)
+	} else {
+		f.stats.wroteVector(f.vector, n, err)
+	}
+	return n, err
+}
+
+// ReadFrom formats what it reads from r until EOF, exactly as if what each
+// read returns were passed to Write, so that io.Copy, which uses it, reads
+// straight into the formatter's own buffer. Lines are found in place there,
+// and if dest is a RingBuffer long ones are written to it from there, in
+// between their prefixes, without being copied into a batch first. A line split
+// across reads goes on where the last read left off.
+//
+// Reads are made with the formatter unlocked, so a Close may come between
+// them. An error reading is returned as a ReadError, and one writing as a
+// WriteError, as from Write.
+func (f *formatter) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(r, f.readBuffer(), f.serviceName, f.Write)
+}
+
+// readBuffer returns the buffer the formatter's input is to be read into,
+// so that it's formatted in place.
+func (f *formatter) readBuffer() []byte {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.readBuf == nil {
+		f.readBuf = make([]byte, readFromSize)
+	}
+	return f.readBuf
+}
+
+// writeStale writes b, bytes held that turned out not to be a character, in
+// the current line. They were counted as written already, so if the write
+// fails, what's left of them is kept to be written before anything else.
+func (f *formatter) writeStale(b []byte) error {
+	f.fillBatch(b)
+	n, err := f.stats.writeFull(f.dest, f.batch)
+	if err != nil {
+		written := f.batchFailed(n)
+		f.timestamp = append(f.timestamp, b[written:]...)
+		return wrapWriteError(err, f.serviceName, StageFormat)
+	}
+	if f.tracer != nil && len(f.traced) > 0 {
+		f.traceBatch()
+	}
+	return nil
+}
+
+// Stats returns the formatter's statistics, counting the prefixes written
+// to dest too. It never drops lines.
+func (f *formatter) Stats() WriterStats {
+	return f.stats.snapshot()
+}
+
+// Close ends the current line, if it's incomplete, with
+// IncompleteLineMarker and a newline, so that the next line written to
+// dest starts a line of its own. It doesn't close dest, and the writer may
+// still be written to, starting a new line.
+func (f *formatter) Close() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.timestamp = nil
+	if len(f.partial) > 0 {
+		// A character that's never completed is written as U+FFFD.
+		f.partial = f.partial[:0]
+		if _, err := f.write([]byte(string(utf8.RuneError))); err != nil {
+			return err
+		}
+	}
+	endOfLine := false
+	if f.cr {
+		// A carriage return held at the end of a line ends it if it ends
+		// lines, or is dropped if it's the start of a CRLF cut short.
+		f.cr = false
+		endOfLine = f.crLines
+	}
+	if f.writeTimestamp {
+		return nil
+	}
+	f.writeTimestamp = true
+	marker := IncompleteLineMarker + "\n"
+	if endOfLine {
+		marker = "\n"
+	}
+	if f.highlight {
+		f.highlight = false
+		marker = ansiReset + marker
+	}
+	_, err := f.stats.writeFull(f.dest, []byte(marker))
+	if err != nil {
+		return wrapWriteError(err, f.serviceName, StageFormat)
+	}
+	return nil
+}
+
+// setLineTime sets the timestamp of the next line to start, instead of the
+// time its first bytes arrive.
+func (f *formatter) setLineTime(t time.Time) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.lineTime = t
+}
+
+// fillBatch formats lines from the start of p into f.batch, up to about
+// formatBatchSize bytes of payload, and returns the number of bytes of p
+// consumed.
+func (f *formatter) fillBatch(p []byte) int {
+	f.batch = f.batch[:0]
+	f.segments = f.segments[:0]
+	f.traced = f.traced[:0]
+	consumed := 0
+	for consumed < len(p) && consumed < formatBatchSize {
+		start := len(f.batch)
+		crOut := false
+		if f.cr {
+			// The carriage return held before p[consumed] is dropped if
+			// it starts a CRLF, and otherwise ends the line, if lone ones
+			// do, or is written as it is. Where they end lines, a run of
+			// them counts as one.
+			f.cr = false
+			crLines := f.crLines && !f.joining
+			next := p[consumed]
+			if len(f.partial) > 0 {
+				next = f.partial[0]
+			}
+			if next != '\n' && !(crLines && next == '\r') {
+				switch {
+				case f.writeTimestamp:
+					crOut = !crLines
+				case crLines:
+					if f.highlight {
+						f.highlight = false
+						f.batch = append(f.batch, ansiReset...)
+					}
+					f.batch = append(f.batch, '\n')
+					f.writeTimestamp = true
+					if f.tracer != nil {
+						f.traceLine()
+					}
+				default:
+					crOut = true
+				}
+			}
+		}
+		// The prefix of a line is written with its first byte, unless
+		// that's a carriage return to be held.
+		started := false
+		if f.writeTimestamp && (p[consumed] != '\r' || crOut || len(f.partial) > 0) {
 			f.writeTimestamp = false
-			f.timestampBuffer = time.Now().UTC().AppendFormat(f.timestampBuffer[:0], outputTimeFormat)
-			f.timestampBuffer = append(f.timestampBuffer, " ["...)
-			f.timestampBuffer = append(f.timestampBuffer, f.serviceName...)
-			f.timestampBuffer = append(f.timestampBuffer, "] "...)
-			f.timestamp = f.timestampBuffer
-		}
-
-		for len(f.timestamp) > 0 {
-			// Timestamp bytes don't count towards the returned count because they constitute the
-			// encoding not the payload.
-			n, err := f.dest.Write(f.timestamp)
-			f.timestamp = f.timestamp[n:]
-			if err != nil {
-				return written, err
+			started = true
+			var arrival time.Time
+			fromClock := false
+			switch {
+			case !f.lineTime.IsZero():
+				arrival = f.lineTime
+				f.lineTime = time.Time{}
+			case f.now != nil:
+				arrival = f.now()
+			default:
+				arrival = clock.Now()
+				fromClock = true
+			}
+			if f.tracer != nil {
+				// Latency is measured with the package's clock, which
+				// the tracer reads too, whatever the timestamps show.
+				f.lineArrival = arrival
+				if !fromClock {
+					f.lineArrival = clock.Now()
+				}
+				f.lineInWrite = true
+			}
+			now := arrival.In(f.location)
+			key := now.UnixNano() / f.prefixUnit
+			if f.align != nil && f.align.Width() != f.alignWidth {
+				f.renderNameTag()
+				f.timestampBuffer = f.timestampBuffer[:0]
 			}
+			if len(f.timestampBuffer) == 0 || key != f.prefixKey {
+				f.renderPrefix(now, key)
+				f.prefixKey = key
+			}
+			f.batch = append(f.batch, f.timestampBuffer...)
+		}
+		if crOut {
+			f.batch = append(f.batch, '\r')
+		}
+		if len(f.partial) > 0 {
+			f.batch = append(f.batch, f.partial...)
+			f.partial = f.partial[:0]
 		}
+		prefix := len(f.batch) - start
 
-		length := 0
-		for i := 0; i < len(p); i++ {
-			length++
-			if p[i] == '\n' {
-				f.writeTimestamp = true
-				break
+		// Limit the search for the end of line to this batch, so that a
+		// huge write without newlines isn't scanned once per batch.
+		line := p[consumed:]
+		if room := formatBatchSize - consumed; len(line) > room {
+			line = line[:room]
+		}
+		end := false
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+			end = true
+		}
+		dropped := 0
+		if i := bytes.IndexByte(line, '\r'); i >= 0 {
+			// Hold the carriage return until the byte after it shows
+			// whether it ends the line.
+			line = line[:i]
+			end = false
+			dropped = 1
+			f.cr = true
+		}
+		if end {
+			// The lines of an entry being joined only end it at its end.
+			f.writeTimestamp = !f.joining || consumed+len(line) == len(p)
+		}
+		if f.color && started {
+			if code := lineColor(line); code != "" {
+				f.batch = append(f.batch, code...)
+				prefix += len(code)
+				f.highlight = true
 			}
 		}
+		if f.highlight && f.writeTimestamp {
+			// The reset goes before the newline, as the prefix of a
+			// segment of its own, so the line ends uncoloured.
+			f.highlight = false
+			offset := f.appendPayload(line[:len(line)-1], consumed)
+			f.batch = append(f.batch, ansiReset+"\n"...)
+			f.segments = append(f.segments,
+				formatSegment{prefix, len(line) - 1, 0, offset},
+				formatSegment{len(ansiReset), 1, 0, -1})
+		} else {
+			offset := f.appendPayload(line, consumed)
+			f.segments = append(f.segments, formatSegment{prefix, len(line), dropped, offset})
+		}
+		consumed += len(line) + dropped
+		if f.tracer != nil && end && f.writeTimestamp {
+			f.traceLine()
+		}
+	}
+	return consumed
+}
 
-		write := p[:length]
-		n, err := f.dest.Write(write)
-		p = p[n:]
-		written += n
-		if err != nil {
-			return written, err
+// appendPayload appends line, at offset in the input, to the batch unless
+// it's written in place, and returns the offset of a segment with it.
+func (f *formatter) appendPayload(line []byte, offset int) int {
+	if f.inPlace && len(line) >= inPlaceLine {
+		return offset
+	}
+	f.batch = append(f.batch, line...)
+	return -1
+}
+
+// renderPrefix renders the prefix of lines starting at now, key in units
+// of prefixUnit, into timestampBuffer.
+func (f *formatter) renderPrefix(now time.Time, key int64) {
+	f.timestampBuffer = f.timestampBuffer[:0]
+	if f.template == nil {
+		f.timestampBuffer = append(f.timestampBuffer, f.timeStart...)
+		f.timestampBuffer = f.appendTime(f.timestampBuffer, now, key)
+		f.timestampBuffer = append(f.timestampBuffer, f.nameTag...)
+		return
+	}
+	for _, segment := range f.template {
+		if segment.time {
+			f.timestampBuffer = f.appendTime(f.timestampBuffer, now, key)
+		} else {
+			f.timestampBuffer = append(f.timestampBuffer, segment.literal...)
+		}
+	}
+}
+
+// appendTime appends the timestamp of lines starting at now, key in units
+// of prefixUnit, to b.
+func (f *formatter) appendTime(b []byte, now time.Time, key int64) []byte {
+	if f.layout == LayoutUnixMilli {
+		return strconv.AppendInt(b, key, 10)
+	}
+	return now.AppendFormat(b, f.layout)
+}
+
+// traceLine records the end of a line at the end of the batch, in the same
+// group as the line before it if they started in the same write. A group's
+// arrival time is that of its first line, which the others follow within
+// microseconds.
+func (f *formatter) traceLine() {
+	end := RingPos(len(f.batch))
+	if n := len(f.traced); n > 0 && f.lineInWrite && f.groupInWrite {
+		f.traced[n-1].end = end
+		f.traced[n-1].count++
+		return
+	}
+	f.traced = append(f.traced, tracedLines{end, f.lineArrival, 1})
+	f.groupInWrite = f.lineInWrite
+}
+
+// traceBatch records the lines ending in the batch just written to dest.
+// Their end offsets are converted to positions in dest if it's a ring
+// buffer, which is assumed to have had no other writes since.
+func (f *formatter) traceBatch() {
+	if rb, ok := f.dest.(*RingBuffer); ok {
+		_, end := rb.Positions()
+		base := end - RingPos(len(f.batch))
+		for i := range f.traced {
+			f.traced[i].end += base
+		}
+	}
+	f.tracer.appended(f.traced, clock.Now())
+}
+
+// batchFailed updates the formatter's state after only the first n bytes
+// of f.batch were written, counting the payload written in place from the
+// input if it was, and returns the number of payload bytes that
+// were written. The next write resumes exactly where this one stopped: in
+// the middle of a prefix, or in the middle of a line without a new prefix.
+func (f *formatter) batchFailed(n int) int {
+	endOfLine := f.writeTimestamp
+	f.writeTimestamp = false
+	// A carriage return held at the end of the batch is only counted as
+	// written if all of the batch was.
+	cr := f.cr
+	f.cr = false
+	offset := 0
+	payload := 0
+	for i, segment := range f.segments {
+		if n < segment.prefix+segment.payload && f.color {
+			f.highlight = f.resumesHighlight(i)
+		}
+		if n < segment.prefix {
+			f.timestamp = append(f.timestamp[:0], f.batch[offset+n:offset+segment.prefix]...)
+			return payload
+		}
+		n -= segment.prefix
+		offset += segment.prefix
+		if n < segment.payload {
+			return payload + n
 		}
+		n -= segment.payload
+		if segment.offset < 0 {
+			offset += segment.payload
+		}
+		payload += segment.payload + segment.dropped
+	}
+	f.writeTimestamp = endOfLine
+	f.cr = cr
+	return payload
+}
+
+// resumesHighlight reports whether the line of the i'th segment of f.batch
+// is to be highlighted when its writing resumes: if the segment is the
+// last, of a line still highlighted after the batch, or is followed by the
+// reset that ends a highlighted line. Only the prefixes of those resets are
+// as short as ansiReset in a coloured batch.
+func (f *formatter) resumesHighlight(i int) bool {
+	if i == len(f.segments)-1 {
+		return f.highlight
 	}
-	return written, nil
+	return f.segments[i+1].prefix == len(ansiReset)
 }
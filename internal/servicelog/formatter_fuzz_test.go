@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+//go:build go1.18
+// +build go1.18
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+const fuzzPrefix = "2021-05-13T03:16:51.001Z [test] "
+
+// FuzzFormatter checks that the formatter output doesn't depend on how the
+// input stream is split into writes. Each byte of chunks is the length
+// (modulo 17, so zero-length writes are included) of the next write, cycling
+// through the pattern until the input is exhausted.
+//
+// Run with: go test -fuzz=FuzzFormatter ./internal/servicelog
+func FuzzFormatter(f *testing.F) {
+	restore := servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+	defer restore()
+
+	seeds := []struct {
+		data   string
+		chunks []byte
+	}{
+		{"", nil},
+		{"\n", []byte{1}},
+		{"\n\n", []byte{1}},
+		{"a", []byte{0, 1}},
+		{"a\nb", []byte{1, 1}},
+		{"a\r\nb\r\n", []byte{2, 1}},
+		{"first\nsecond\nthird", []byte{3, 5, 7}},
+		{"no trailing newline", []byte{4}},
+		{"split at\r|\nboundary\n", []byte{9, 1}},
+		{"caf\xc3\xa9 \xf0\x9f\x98\x80 \xe2\xf0\x9f end\xc3", []byte{1}},
+		{fuzzPrefix + "looks like a prefix\n", []byte{10, 0, 3}},
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed.data), seed.chunks)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, chunks []byte) {
+		var oneShot bytes.Buffer
+		w := newFormatWriter(&oneShot, "test")
+		n, err := w.Write(data)
+		if err != nil || n != len(data) {
+			t.Fatalf("one-shot write returned (%d, %v), want (%d, nil)", n, err, len(data))
+		}
+
+		var chunked bytes.Buffer
+		w = newFormatWriter(&chunked, "test")
+		writeChunked(t, w, data, chunks)
+
+		if !bytes.Equal(oneShot.Bytes(), chunked.Bytes()) {
+			t.Fatalf("chunked output differs from one-shot output:\n%q\n%q", chunked.Bytes(), oneShot.Bytes())
+		}
+
+		// A CRLF ends a line as a newline does, and a carriage return or
+		// the start of a character at the end of the input is held, in
+		// case the rest follows.
+		var expected strings.Builder
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			if strings.HasSuffix(line, "\r\n") {
+				line = line[:len(line)-2] + "\n"
+			} else if strings.HasSuffix(line, "\r") {
+				line = line[:len(line)-1]
+			} else if n := incompleteRuneLen(line); n > 0 {
+				line = strings.TrimSuffix(line[:len(line)-n], "\r")
+			}
+			if line != "" {
+				expected.WriteString(fuzzPrefix)
+				expected.WriteString(line)
+			}
+		}
+		if oneShot.String() != expected.String() {
+			t.Fatalf("unexpected output:\n%q\nwant:\n%q", oneShot.String(), expected.String())
+		}
+	})
+}
+
+// incompleteRuneLen returns the length of the start of a character at the
+// end of s, if there is one.
+func incompleteRuneLen(s string) int {
+	for i := len(s) - 1; i >= 0 && i > len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if s[i] >= utf8.RuneSelf && !utf8.FullRuneInString(s[i:]) {
+				return len(s) - i
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// writeChunked writes data to w in chunks whose sizes are taken from the
+// chunks pattern. If the pattern has no non-zero sizes, data is written in
+// one go.
+func writeChunked(t *testing.T, w io.Writer, data, chunks []byte) {
+	total := 0
+	for _, c := range chunks {
+		total += int(c % 17)
+	}
+	if total == 0 {
+		chunks = nil
+	}
+	for i := 0; len(data) > 0; i++ {
+		size := len(data)
+		if len(chunks) > 0 {
+			size = int(chunks[i%len(chunks)] % 17)
+		}
+		if size > len(data) {
+			size = len(data)
+		}
+		n, err := w.Write(data[:size])
+		if err != nil || n != size {
+			t.Fatalf("chunked write returned (%d, %v), want (%d, nil)", n, err, size)
+		}
+		data = data[size:]
+	}
+}
@@ -16,45 +16,797 @@ package servicelog_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	. "gopkg.in/check.v1"
 
 	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
 )
 
-const (
-	timeFormatRegex = `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z`
-)
-
-type formatterSuite struct{}
+type formatterSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
 
 var _ = Suite(&formatterSuite{})
 
+func (s *formatterSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *formatterSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// newFormatWriter returns servicelog.NewFormatWriter(dest, serviceName,
+// opts...), for options that can't fail.
+func newFormatWriter(dest io.Writer, serviceName string, opts ...servicelog.FormatOption) io.Writer {
+	w, err := servicelog.NewFormatWriter(dest, serviceName, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
 func (s *formatterSuite) TestFormat(c *C) {
 	b := &bytes.Buffer{}
-	w := servicelog.NewFormatWriter(b, "test")
+	w := newFormatWriter(b, "test")
 
 	fmt.Fprintln(w, "first")
+	s.clock.Advance(1001 * time.Millisecond)
 	fmt.Fprintln(w, "second")
+	s.clock.Advance(1001 * time.Millisecond)
 	fmt.Fprintln(w, "third")
 
-	c.Assert(b.String(), Matches, fmt.Sprintf(`
-%[1]s \[test\] first
-%[1]s \[test\] second
-%[1]s \[test\] third
-`[1:], timeFormatRegex))
+	c.Assert(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:52.002Z [test] second
+2021-05-13T03:16:53.003Z [test] third
+`[1:])
 }
 
 func (s *formatterSuite) TestFormatSingleWrite(c *C) {
 	b := &bytes.Buffer{}
-	w := servicelog.NewFormatWriter(b, "test")
+	w := newFormatWriter(b, "test")
 
 	fmt.Fprintf(w, "first\nsecond\nthird\n")
 
-	c.Assert(b.String(), Matches, fmt.Sprintf(`
-%[1]s \[test\] first
-%[1]s \[test\] second
-%[1]s \[test\] third
-`[1:], timeFormatRegex))
+	c.Assert(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] second
+2021-05-13T03:16:51.001Z [test] third
+`[1:])
+}
+
+func (s *formatterSuite) TestFormatDestWrites(c *C) {
+	dest := &chunkWriter{}
+	w := newFormatWriter(dest, "test")
+
+	// Each write goes to dest in a single write, prefixes included,
+	// whether it holds a line, several, or part of one.
+	for _, p := range []string{"first\n", "second\nthird\n", "four", "th\nfif", "th\n"} {
+		_, err := io.WriteString(w, p)
+		c.Assert(err, IsNil)
+	}
+	c.Check(dest.chunks, DeepEquals, []string{
+		"2021-05-13T03:16:51.001Z [test] first\n",
+		"2021-05-13T03:16:51.001Z [test] second\n2021-05-13T03:16:51.001Z [test] third\n",
+		"2021-05-13T03:16:51.001Z [test] four",
+		"th\n2021-05-13T03:16:51.001Z [test] fif",
+		"th\n",
+	})
+}
+
+func (s *formatterSuite) TestFormatTimestampChanges(c *C) {
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test")
+
+	fmt.Fprintln(w, "first")
+	fmt.Fprintln(w, "second")
+	s.clock.Advance(500 * time.Microsecond)
+	fmt.Fprintln(w, "third")
+	s.clock.Advance(time.Second)
+	fmt.Fprintln(w, "fourth")
+
+	c.Assert(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] second
+2021-05-13T03:16:51.001Z [test] third
+2021-05-13T03:16:52.001Z [test] fourth
+`[1:])
+}
+
+func (s *formatterSuite) TestFormatClockSteps(c *C) {
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test")
+
+	// Timestamps follow the wall clock when it's stepped, even in the
+	// middle of a line.
+	fmt.Fprintln(w, "first")
+	fmt.Fprint(w, "sec")
+	s.clock.Step(6 * time.Hour)
+	fmt.Fprintln(w, "ond")
+	fmt.Fprintln(w, "third")
+	s.clock.Step(-30 * time.Second)
+	fmt.Fprintln(w, "fourth")
+
+	c.Assert(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] second
+2021-05-13T09:16:51.001Z [test] third
+2021-05-13T09:16:21.001Z [test] fourth
+`[1:])
+}
+
+func (s *formatterSuite) TestFormatHugeWrite(c *C) {
+	// Many lines of varying length in one write, followed by a line much
+	// longer than the formatter's internal batches.
+	var input bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&input, "line %d%s\n", i, strings.Repeat("x", i%100))
+	}
+	input.WriteString(strings.Repeat("y", 100000))
+	input.WriteString("\nlast")
+
+	oneShot := &bytes.Buffer{}
+	w := newFormatWriter(oneShot, "test")
+	n, err := w.Write(input.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, input.Len())
+
+	expected := &bytes.Buffer{}
+	for _, line := range strings.SplitAfter(input.String(), "\n") {
+		expected.WriteString("2021-05-13T03:16:51.001Z [test] ")
+		expected.WriteString(line)
+	}
+	c.Assert(oneShot.String() == expected.String(), Equals, true)
+}
+
+func (s *formatterSuite) TestFormatHugeLine(c *C) {
+	// A 200MB line written in 64KB chunks is streamed through to the ring
+	// buffer, with a single prefix, rather than accumulated.
+	const chunkSize = 64 * 1024
+	const chunks = 200 * 1024 * 1024 / chunkSize
+	rb := servicelog.NewRingBuffer(100 * 1024)
+	defer rb.Close()
+	w := newFormatWriter(rb, "test")
+	chunk := bytes.Repeat([]byte("z"), chunkSize)
+
+	var before, stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	maxHeap := before.HeapAlloc
+	for i := 0; i < chunks; i++ {
+		n, err := w.Write(chunk)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, chunkSize)
+		if i%256 == 0 {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > maxHeap {
+				maxHeap = stats.HeapAlloc
+			}
+		}
+	}
+	_, err := w.Write([]byte("\n"))
+	c.Assert(err, IsNil)
+	runtime.ReadMemStats(&stats)
+
+	c.Check(maxHeap-before.HeapAlloc < 1024*1024, Equals, true, Commentf("heap grew by %d bytes", maxHeap-before.HeapAlloc))
+	c.Check(stats.TotalAlloc-before.TotalAlloc < 1024*1024, Equals, true, Commentf("allocated %d bytes", stats.TotalAlloc-before.TotalAlloc))
+
+	prefix := "2021-05-13T03:16:51.001Z [test] "
+	start, end := rb.Positions()
+	c.Check(int(end), Equals, len(prefix)+chunks*chunkSize+1)
+	tail := make([]byte, 10)
+	_, n, err := rb.Copy(tail, end-10)
+	c.Assert(err, Equals, io.EOF)
+	c.Check(string(tail[:n]), Equals, "zzzzzzzzz\n")
+	c.Check(int(end-start), Equals, 100*1024)
+}
+
+func (s *formatterSuite) TestFormatWriteError(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	dest.Limit(39, errTrickle)
+	w := newFormatWriter(dest, "test")
+	n, err := fmt.Fprint(w, "first\nsecond\n")
+	c.Assert(n, Equals, 6)
+	c.Assert(err, ErrorMatches, `cannot write logs for service "test" \(format\): trickle failure`)
+	c.Assert(errors.Is(err, errTrickle), Equals, true)
+	var writeErr *servicelog.WriteError
+	c.Assert(errors.As(err, &writeErr), Equals, true)
+	c.Assert(writeErr.Service, Equals, "test")
+	c.Assert(writeErr.Stage, Equals, servicelog.StageFormat)
+
+	// Errors already annotated by a later stage are passed on unchanged.
+	destErr := &servicelog.WriteError{Service: "other", Stage: "dest", Err: syscall.ENOSPC}
+	w = newFormatWriter(failingWriter(destErr), "test")
+	_, err = fmt.Fprint(w, "first\n")
+	c.Assert(err, Equals, destErr)
+	c.Assert(errors.Is(err, syscall.ENOSPC), Equals, true)
+}
+
+func (s *formatterSuite) TestFormatFlakyDest(c *C) {
+	// A destination that makes little or no progress and fails now and
+	// then: retrying what wasn't reported as written gives whole lines,
+	// each with a single prefix.
+	dest := servicelogtest.NewScriptedWriter(
+		servicelogtest.ShortWrite(3),
+		servicelogtest.ShortWrite(0),
+		servicelogtest.FailAfter(40, errTrickle),
+		servicelogtest.Fail(errTrickle),
+		servicelogtest.ShortWrite(50),
+		servicelogtest.FailAfter(1, errTrickle),
+	)
+	w := newFormatWriter(dest, "test")
+	input := []byte("first\nsecond\n\nthird and the longest of them all\nfourth")
+	failures := 0
+	for p := input; len(p) > 0; {
+		n, err := w.Write(p)
+		if err != nil {
+			c.Assert(errors.Is(err, errTrickle), Equals, true)
+			failures++
+		}
+		p = p[n:]
+	}
+	c.Check(failures, Equals, 3)
+	c.Check(servicelogtest.CheckLines([]byte(dest.String()), input, "test"), IsNil)
+}
+
+const crInput = "crlf\r\nlf\nlone\rcr\r\rrun\n\rstart\r\n\r\nsplit\r"
+
+func (s *formatterSuite) TestFormatCRLF(c *C) {
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test")
+
+	// Each byte in a write of its own, so that every CRLF is split.
+	for i := 0; i < len(crInput); i++ {
+		n, err := w.Write([]byte{crInput[i]})
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 1)
+	}
+	c.Assert(w.(io.Closer).Close(), IsNil)
+	c.Assert(b.String(), Equals, ""+
+		"2021-05-13T03:16:51.001Z [test] crlf\n"+
+		"2021-05-13T03:16:51.001Z [test] lf\n"+
+		"2021-05-13T03:16:51.001Z [test] lone\rcr\r\rrun\n"+
+		"2021-05-13T03:16:51.001Z [test] \rstart\n"+
+		"2021-05-13T03:16:51.001Z [test] \n"+
+		"2021-05-13T03:16:51.001Z [test] split"+servicelog.IncompleteLineMarker+"\n")
+}
+
+func (s *formatterSuite) TestFormatCRLines(c *C) {
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test", servicelog.WithCRLines())
+
+	n, err := io.WriteString(w, crInput)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(crInput))
+	// The last carriage return is held, until closing shows it ends the
+	// line.
+	c.Check(strings.HasSuffix(b.String(), "split"), Equals, true)
+	c.Assert(w.(io.Closer).Close(), IsNil)
+	c.Assert(b.String(), Equals, ""+
+		"2021-05-13T03:16:51.001Z [test] crlf\n"+
+		"2021-05-13T03:16:51.001Z [test] lf\n"+
+		"2021-05-13T03:16:51.001Z [test] lone\n"+
+		"2021-05-13T03:16:51.001Z [test] cr\n"+
+		"2021-05-13T03:16:51.001Z [test] run\n"+
+		"2021-05-13T03:16:51.001Z [test] start\n"+
+		"2021-05-13T03:16:51.001Z [test] \n"+
+		"2021-05-13T03:16:51.001Z [test] split\n")
+}
+
+func (s *formatterSuite) TestFormatCRWriteError(c *C) {
+	for _, crLines := range []bool{false, true} {
+		newWriter := func(dest io.Writer) io.Writer {
+			if crLines {
+				return newFormatWriter(dest, "test", servicelog.WithCRLines())
+			}
+			return newFormatWriter(dest, "test")
+		}
+		want := &bytes.Buffer{}
+		_, err := io.WriteString(newWriter(want), crInput)
+		c.Assert(err, IsNil)
+
+		// Failing at any byte of the output, and retrying what wasn't
+		// reported as written, gives the same output.
+		for failAt := 0; failAt < want.Len(); failAt++ {
+			dest := servicelogtest.NewScriptedWriter(servicelogtest.FailAfter(failAt, errTrickle))
+			w := newWriter(dest)
+			for p := []byte(crInput); len(p) > 0; {
+				n, err := w.Write(p)
+				c.Assert(err == nil || errors.Is(err, errTrickle), Equals, true)
+				p = p[n:]
+			}
+			c.Assert(dest.String(), Equals, want.String(), Commentf("crLines %v, fail at %d", crLines, failAt))
+		}
+	}
+}
+
+const runeInput = "caf\xc3\xa9 \xe2\x82\xac \xf0\x9f\x98\x80\n" +
+	"\xf0\x9f\x98\x80 first\n" +
+	"bad \xe2\xf0\x9f\x98\x80 \xff\n" +
+	"last \xf0\x9f\x98"
+
+func (s *formatterSuite) TestFormatRunesByteAtATime(c *C) {
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test")
+
+	// A character is never split in the output, whatever the writes it
+	// came in, so what's written so far is valid UTF-8 if the input is.
+	validEnd := strings.Index(runeInput, "bad")
+	for i := 0; i < len(runeInput); i++ {
+		n, err := w.Write([]byte{runeInput[i]})
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 1)
+		if i < validEnd {
+			c.Assert(utf8.Valid(b.Bytes()), Equals, true, Commentf("byte %d: %q", i, b.String()))
+		}
+	}
+	// Bytes that aren't characters are written as they are.
+	c.Check(b.String(), Equals, ""+
+		"2021-05-13T03:16:51.001Z [test] caf\u00e9 \u20ac \U0001F600\n"+
+		"2021-05-13T03:16:51.001Z [test] \U0001F600 first\n"+
+		"2021-05-13T03:16:51.001Z [test] bad \xe2\U0001F600 \xff\n"+
+		"2021-05-13T03:16:51.001Z [test] last ")
+
+	// A character that's never completed is written as U+FFFD.
+	c.Assert(w.(io.Closer).Close(), IsNil)
+	c.Check(strings.HasSuffix(b.String(), "last \ufffd"+servicelog.IncompleteLineMarker+"\n"), Equals, true)
+}
+
+func (s *formatterSuite) TestFormatRunesCloseAtLineStart(c *C) {
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test")
+	_, err := io.WriteString(w, "\xf0\x9f")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "")
+	c.Assert(w.(io.Closer).Close(), IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] \ufffd"+servicelog.IncompleteLineMarker+"\n")
+}
+
+func (s *formatterSuite) TestFormatRunesWriteError(c *C) {
+	want := &bytes.Buffer{}
+	_, err := io.WriteString(newFormatWriter(want, "test"), runeInput)
+	c.Assert(err, IsNil)
+
+	// Failing at any byte of the output, and retrying what wasn't
+	// reported as written, a byte at a time, gives the same output.
+	for failAt := 0; failAt < want.Len(); failAt++ {
+		dest := servicelogtest.NewScriptedWriter(servicelogtest.FailAfter(failAt, errTrickle))
+		w := newFormatWriter(dest, "test")
+		for i := 0; i < len(runeInput); {
+			n, err := w.Write([]byte{runeInput[i]})
+			c.Assert(err == nil || errors.Is(err, errTrickle), Equals, true)
+			i += n
+		}
+		c.Assert(dest.String(), Equals, want.String(), Commentf("fail at %d", failAt))
+	}
+}
+
+func (s *formatterSuite) TestFormatLayout(c *C) {
+	for _, test := range []struct {
+		layout string
+		output string
+	}{{
+		layout: time.RFC3339Nano,
+		output: `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.0010005Z [test] second
+2021-05-13T03:16:51.0010015Z [test] third
+2021-05-13T03:16:52.0010015Z [test] fourth
+`[1:],
+	}, {
+		layout: servicelog.LayoutUnixMilli,
+		output: `
+1620875811001 [test] first
+1620875811001 [test] second
+1620875811001 [test] third
+1620875812001 [test] fourth
+`[1:],
+	}, {
+		layout: "15:04",
+		output: `
+03:16 [test] first
+03:16 [test] second
+03:16 [test] third
+03:16 [test] fourth
+`[1:],
+	}} {
+		clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+		restore := servicelog.FakeClock(clock)
+
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewFormatWriter(b, "test", servicelog.WithLayout(test.layout))
+		c.Assert(err, IsNil)
+
+		// Lines written in pieces get a single timestamp, which doesn't
+		// count towards the bytes written.
+		for _, piece := range []string{"fir", "st\nsec", "ond\n"} {
+			n, err := io.WriteString(w, piece)
+			c.Assert(err, IsNil)
+			c.Assert(n, Equals, len(piece))
+			clock.Advance(500 * time.Nanosecond)
+		}
+		n, err := io.WriteString(w, "third\n")
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 6)
+		clock.Advance(time.Second)
+		n, err = io.WriteString(w, "fourth\n")
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 7)
+		restore()
+
+		c.Check(b.String(), Equals, test.output, Commentf("layout %q", test.layout))
+	}
+}
+
+func (s *formatterSuite) TestFormatLayoutWriteError(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	dest.Limit(49, errTrickle)
+	w, err := servicelog.NewFormatWriter(dest, "test", servicelog.WithLayout(time.RFC3339Nano))
+	c.Assert(err, IsNil)
+	n, err := fmt.Fprint(w, "first\nsecond\n")
+	c.Assert(n, Equals, 6)
+	c.Assert(err, ErrorMatches, `cannot write logs for service "test" \(format\): trickle failure`)
+}
+
+func (s *formatterSuite) TestFormatLayoutInvalid(c *C) {
+	for _, test := range []struct {
+		layout string
+		error  string
+	}{
+		{"", "timestamp layout must not be empty"},
+		{"nothing", `timestamp layout "nothing" has no date or time elements`},
+		{"2006-01-02\n15:04", `timestamp layout "2006-01-02\\n15:04" must not contain line breaks`},
+	} {
+		w, err := servicelog.NewFormatWriter(&bytes.Buffer{}, "test", servicelog.WithLayout(test.layout))
+		c.Check(err, ErrorMatches, test.error)
+		c.Check(w, IsNil)
+	}
+}
+
+func (s *formatterSuite) TestFormatOptionsCombined(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriter(b, "test",
+		servicelog.WithLayout("15:04:05"),
+		servicelog.WithStream(servicelog.StreamStderr),
+		servicelog.WithCRLines(),
+		servicelog.WithColor(servicelog.ColorAlways))
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "10%\r20%\nERROR boom\n")
+	c.Assert(err, IsNil)
+	tag := "\x1b[0m \x1b[94m[test/stderr]\x1b[0m "
+	c.Check(b.String(), Equals, ""+
+		"\x1b[2m03:16:51"+tag+"10%\n"+
+		"\x1b[2m03:16:51"+tag+"20%\n"+
+		"\x1b[2m03:16:51"+tag+"\x1b[31mERROR boom\x1b[0m\n")
+
+	// A later option overrides an earlier one of the same kind.
+	b.Reset()
+	w, err = servicelog.NewFormatWriter(b, "test",
+		servicelog.WithColor(servicelog.ColorAlways),
+		servicelog.WithLayout("15:04:05"),
+		servicelog.WithColor(servicelog.ColorNever),
+		servicelog.WithLayout(servicelog.LayoutUnixMilli))
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "1620875811001 [test] first\n")
+}
+
+func (s *formatterSuite) TestFormatLocation(c *C) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		c.Skip(fmt.Sprintf("cannot load time zone: %v", err))
+	}
+	for _, test := range []struct {
+		loc    *time.Location
+		now    time.Time
+		output string
+	}{{
+		loc:    newYork,
+		now:    time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC),
+		output: "2021-05-12T23:16:51.001-04:00 [test] first\n",
+	}, {
+		// The offset follows daylight saving time.
+		loc:    newYork,
+		now:    time.Date(2021, 12, 13, 3, 16, 51, 1e6, time.UTC),
+		output: "2021-12-12T22:16:51.001-05:00 [test] first\n",
+	}, {
+		loc:    time.FixedZone("IST", 5*60*60+30*60),
+		now:    time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC),
+		output: "2021-05-13T08:46:51.001+05:30 [test] first\n",
+	}, {
+		loc:    time.UTC,
+		now:    time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC),
+		output: "2021-05-13T03:16:51.001Z [test] first\n",
+	}} {
+		restore := servicelog.FakeClock(servicelog.NewTestClock(test.now))
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewFormatWriter(b, "test", servicelog.WithLocation(test.loc))
+		c.Assert(err, IsNil)
+		_, err = io.WriteString(w, "first\n")
+		c.Assert(err, IsNil)
+		restore()
+		c.Check(b.String(), Equals, test.output, Commentf("location %s", test.loc))
+
+		// The parser reads back the same time.
+		entry, err := servicelog.Parse(b.Bytes())
+		c.Assert(err, IsNil)
+		c.Check(entry.Time.Equal(test.now), Equals, true, Commentf("location %s", test.loc))
+	}
+}
+
+func (s *formatterSuite) TestFormatLocationWithLayout(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriter(b, "test",
+		servicelog.WithLayout("2006-01-02 15:04:05 MST"),
+		servicelog.WithLocation(time.FixedZone("IST", 5*60*60+30*60)))
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "2021-05-13 08:46:51 IST [test] first\n")
+}
+
+func (s *formatterSuite) TestFormatLocationInvalid(c *C) {
+	w, err := servicelog.NewFormatWriter(&bytes.Buffer{}, "test", servicelog.WithLocation(nil))
+	c.Check(err, ErrorMatches, "timestamp time zone must not be nil")
+	c.Check(w, IsNil)
+}
+
+func (s *formatterSuite) TestFormatClock(c *C) {
+	// Each read of the clock is a millisecond apart, less a microsecond,
+	// so it shows whether each line's timestamp is read when the line
+	// starts, and the timestamps cross millisecond boundaries.
+	start := time.Date(2021, 5, 13, 3, 16, 51, 999999e3, time.UTC)
+	reads := 0
+	now := func() time.Time {
+		t := start.Add(time.Duration(reads) * (time.Millisecond - time.Microsecond))
+		reads++
+		return t
+	}
+
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriter(b, "test", servicelog.WithClock(now))
+	c.Assert(err, IsNil)
+	for _, chunk := range []string{"fir", "st", "\nsec", "ond\nth", "ird", "\n", "\n"} {
+		_, err := io.WriteString(w, chunk)
+		c.Assert(err, IsNil)
+	}
+	c.Check(reads, Equals, 4)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.999Z [test] first
+2021-05-13T03:16:52.000Z [test] second
+2021-05-13T03:16:52.001Z [test] third
+2021-05-13T03:16:52.002Z [test] 
+`[1:])
+}
+
+func (s *formatterSuite) TestFormatClockWithOptions(c *C) {
+	now := func() time.Time {
+		return time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)
+	}
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriter(b, "test",
+		servicelog.WithClock(now),
+		servicelog.WithLocation(time.FixedZone("IST", 5*60*60+30*60)),
+		servicelog.WithCRLines())
+	c.Assert(err, IsNil)
+	s.clock.Advance(time.Hour)
+	_, err = io.WriteString(w, "10%\r20%\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T08:46:51.001+05:30 [test] 10%
+2021-05-13T08:46:51.001+05:30 [test] 20%
+`[1:])
+}
+
+func (s *formatterSuite) TestFormatClockInvalid(c *C) {
+	w, err := servicelog.NewFormatWriter(&bytes.Buffer{}, "test", servicelog.WithClock(nil))
+	c.Check(err, ErrorMatches, "timestamp clock must not be nil")
+	c.Check(w, IsNil)
+}
+
+func (s *formatterSuite) TestFormatClose(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test")
+	closer, ok := w.(io.Closer)
+	c.Assert(ok, Equals, true)
+
+	// Closing at the end of a line writes nothing.
+	_, err := io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+	c.Assert(closer.Close(), IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] first\n")
+
+	// An incomplete line is ended with a marker, and what's written
+	// afterwards starts a line of its own.
+	b.Reset()
+	_, err = io.WriteString(w, "second")
+	c.Assert(err, IsNil)
+	c.Assert(closer.Close(), IsNil)
+	c.Assert(closer.Close(), IsNil)
+	_, err = io.WriteString(w, "third\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] second [incomplete line]
+2021-05-13T03:16:51.001Z [test] third
+`[1:])
+}
+
+func (s *formatterSuite) TestFormatCloseError(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	dest.Limit(49, errTrickle)
+	w := newFormatWriter(dest, "test")
+	_, err := io.WriteString(w, "incomplete")
+	c.Assert(err, IsNil)
+	err = w.(io.Closer).Close()
+	c.Assert(err, ErrorMatches, `cannot write logs for service "test" \(format\): trickle failure`)
+}
+
+// failingWriter returns a destination whose writes all fail with err.
+func failingWriter(err error) *servicelogtest.ScriptedWriter {
+	w := servicelogtest.NewScriptedWriter()
+	w.Default = servicelogtest.Fail(err)
+	return w
+}
+
+// chunkReader returns its chunks, one per read, and then err, or io.EOF
+// if it's nil.
+type chunkReader struct {
+	chunks []string
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if r.chunks[0] = r.chunks[0][n:]; r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+// cutChunks cuts input into chunks of the given size.
+func cutChunks(input string, size int) []string {
+	var chunks []string
+	for len(input) > size {
+		chunks = append(chunks, input[:size])
+		input = input[size:]
+	}
+	if input != "" {
+		chunks = append(chunks, input)
+	}
+	return chunks
+}
+
+// ringContents returns everything in rb.
+func ringContents(c *C, rb *servicelog.RingBuffer) string {
+	b := &bytes.Buffer{}
+	_, _, err := rb.WriteTo(b, servicelog.TailPosition)
+	c.Assert(err, IsNil)
+	return b.String()
+}
+
+func (s *formatterSuite) TestFormatReadFrom(c *C) {
+	// Reading from a reader gives exactly the output of writing what each
+	// read returns, including lines and characters split across reads,
+	// and an incomplete last line, whether the lines are written to a ring
+	// buffer in place, or copied into a batch for other destinations.
+	inputs := append(chunkingInputs,
+		"café ☃\r\nsplit\r\n",
+		"ERROR: failed\nok\nWARN: slow\r\n",
+		"done\nprompt> ",
+		// Lines this long are written in place.
+		strings.Repeat("x", 300)+"\nshort\nERROR: "+strings.Repeat("y", 300)+"\n",
+		strings.Repeat("z", 400)+"\r\n"+strings.Repeat("w", 500))
+	optionSets := [][]servicelog.FormatOption{
+		nil,
+		{servicelog.WithColor(servicelog.ColorAlways), servicelog.WithCRLines()},
+	}
+	for _, opts := range optionSets {
+		for _, input := range inputs {
+			for _, size := range []int{1, 2, 7, 80, len(input) + 1} {
+				comment := Commentf("input %.20q, reads of %d bytes, %d options", input, size, len(opts))
+				expected := &bytes.Buffer{}
+				w := newFormatWriter(expected, "test", opts...)
+				for _, chunk := range cutChunks(input, size) {
+					_, err := io.WriteString(w, chunk)
+					c.Assert(err, IsNil)
+				}
+				c.Assert(w.(io.Closer).Close(), IsNil)
+
+				// A ring buffer smaller than a batch takes the lines
+				// one by one.
+				for _, ringSize := range []int{1 << 20, 64} {
+					rb := servicelog.NewRingBuffer(ringSize)
+					w = newFormatWriter(rb, "test", opts...)
+					c.Assert(w, Implements, new(io.ReaderFrom))
+					n, err := io.Copy(w, &chunkReader{chunks: cutChunks(input, size)})
+					c.Assert(err, IsNil)
+					c.Check(n, Equals, int64(len(input)))
+					c.Assert(w.(io.Closer).Close(), IsNil)
+					output := expected.String()
+					if len(output) > ringSize {
+						output = output[len(output)-ringSize:]
+					}
+					c.Check(ringContents(c, rb), Equals, output, comment)
+				}
+
+				output := &bytes.Buffer{}
+				w = newFormatWriter(output, "test", opts...)
+				_, err := io.Copy(w, &chunkReader{chunks: cutChunks(input, size)})
+				c.Assert(err, IsNil)
+				c.Assert(w.(io.Closer).Close(), IsNil)
+				c.Check(output.String(), Equals, expected.String(), comment)
+			}
+		}
+	}
+}
+
+func (s *formatterSuite) TestFormatReadFromReadError(c *C) {
+	rb := servicelog.NewRingBuffer(1024)
+	w := newFormatWriter(rb, "test")
+	errRead := errors.New("pipe broke")
+	n, err := w.(io.ReaderFrom).ReadFrom(&chunkReader{chunks: []string{"first\nsec"}, err: errRead})
+	c.Check(err, ErrorMatches, `cannot read output of service "test": pipe broke`)
+	c.Check(n, Equals, int64(len("first\nsec")))
+	var readErr *servicelog.ReadError
+	c.Assert(errors.As(err, &readErr), Equals, true)
+	c.Check(readErr.Service, Equals, "test")
+	c.Check(errors.Is(err, errRead), Equals, true)
+	var writeErr *servicelog.WriteError
+	c.Check(errors.As(err, &writeErr), Equals, false)
+
+	// What was read before the error is logged, and the line can go on.
+	_, err = io.WriteString(w, "ond\n")
+	c.Assert(err, IsNil)
+	c.Check(ringContents(c, rb), Equals, `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] second
+`[1:])
+}
+
+func (s *formatterSuite) TestFormatReadFromWriteError(c *C) {
+	errFull := errors.New("full")
+	dest := servicelogtest.NewScriptedWriter(servicelogtest.Accept(), servicelogtest.Fail(errFull))
+	w := newFormatWriter(dest, "test")
+	r := &chunkReader{chunks: []string{"first\n", "second\n", "third\n"}}
+	n, err := w.(io.ReaderFrom).ReadFrom(r)
+	c.Check(err, ErrorMatches, `cannot write logs for service "test" \(format\): full`)
+	var writeErr *servicelog.WriteError
+	c.Check(errors.As(err, &writeErr), Equals, true)
+	var readErr *servicelog.ReadError
+	c.Check(errors.As(err, &readErr), Equals, false)
+	c.Check(n, Equals, int64(len("first\n")))
+	c.Check(r.chunks, DeepEquals, []string{"third\n"})
+	c.Check(dest.String(), Equals, "2021-05-13T03:16:51.001Z [test] first\n")
+
+	// Writing in place to a closed ring buffer fails the same way.
+	rb := servicelog.NewRingBuffer(1024)
+	w = newFormatWriter(rb, "test")
+	_, err = io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+	c.Assert(rb.Close(), IsNil)
+	n, err = w.(io.ReaderFrom).ReadFrom(strings.NewReader("second\n"))
+	c.Check(err, ErrorMatches, `cannot write logs for service "test" \(format\): io: read/write on closed pipe`)
+	c.Check(n, Equals, int64(0))
 }
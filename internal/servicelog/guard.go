@@ -0,0 +1,179 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+)
+
+// PanicError describes a panic recovered from a service's log pipeline.
+type PanicError struct {
+	// Stage is the stage that panicked, as given to NewStageWriter, or ""
+	// if it isn't known.
+	Stage string
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	if e.Stage == "" {
+		return fmt.Sprintf("panic in log pipeline: %v", e.Value)
+	}
+	return fmt.Sprintf("panic in log pipeline stage %q: %v", e.Stage, e.Value)
+}
+
+// newPanicError returns the PanicError for the value v recovered from
+// stage, keeping the one from a later stage if that's where it came from.
+// It must be called from the deferred function that recovered v.
+func newPanicError(stage string, v interface{}) *PanicError {
+	if err, ok := v.(*PanicError); ok {
+		return err
+	}
+	return &PanicError{Stage: stage, Value: v, Stack: debug.Stack()}
+}
+
+type stageWriter struct {
+	dest  io.Writer
+	stage string
+}
+
+// NewStageWriter wraps dest, a stage of a service's log pipeline, so that a
+// panic in it is reported by GuardWriter as coming from stage.
+func NewStageWriter(dest io.Writer, stage string) io.Writer {
+	return &stageWriter{dest: dest, stage: stage}
+}
+
+func (w *stageWriter) Write(p []byte) (int, error) {
+	defer func() {
+		if v := recover(); v != nil {
+			panic(newPanicError(w.stage, v))
+		}
+	}()
+	return w.dest.Write(p)
+}
+
+func (w *stageWriter) readBuffer() []byte {
+	if r, ok := w.dest.(readBufferer); ok {
+		return r.readBuffer()
+	}
+	return nil
+}
+
+// Close closes dest, if it's an io.Closer, reporting a panic as Write
+// does.
+func (w *stageWriter) Close() error {
+	defer func() {
+		if v := recover(); v != nil {
+			panic(newPanicError(w.stage, v))
+		}
+	}()
+	return closeWriter(w.dest)
+}
+
+// GuardWriter is the entry point of a service's log pipeline, and contains
+// panics in any of its stages so that they don't take the daemon down.
+//
+// A panic is recovered and reported, and the write that caused it is
+// repeated on a minimal safe pipeline, usually a new formatter writing
+// straight to the log buffer, which is used for all later writes too. Part
+// of that write may thus be logged twice. If the safe pipeline panics as
+// well, the panic is reported and that write and all later ones are
+// dropped.
+type GuardWriter struct {
+	full     io.Writer
+	safe     io.Writer
+	onPanic  func(err *PanicError)
+	safeMode bool
+	dropping bool
+}
+
+// NewGuardWriter returns a GuardWriter that writes to full until it
+// panics, and then to safe, calling onPanic with each panic recovered.
+func NewGuardWriter(full, safe io.Writer, onPanic func(err *PanicError)) *GuardWriter {
+	return &GuardWriter{full: full, safe: safe, onPanic: onPanic}
+}
+
+func (w *GuardWriter) Write(p []byte) (int, error) {
+	if !w.safeMode {
+		n, panicErr, err := guardedWrite(w.full, p)
+		if panicErr == nil {
+			return n, err
+		}
+		w.safeMode = true
+		w.onPanic(panicErr)
+	}
+	if !w.dropping {
+		n, panicErr, err := guardedWrite(w.safe, p)
+		if panicErr == nil {
+			return n, err
+		}
+		w.dropping = true
+		w.onPanic(panicErr)
+	}
+	return len(p), nil
+}
+
+// ReadFrom writes what it reads from r until EOF as if what each read
+// returns were passed to Write, so that io.Copy reads into the buffer of
+// the formatter at the head of the full pipeline, if there's one, where
+// it's formatted in place. Should a write panic, the safe pipeline still
+// gets what was read. An error reading is returned as a ReadError.
+func (w *GuardWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(r, readBuffer(w.full), "", w.Write)
+}
+
+// Close closes the pipeline in use, if it's an io.Closer, so that its
+// stages write out anything they're holding back, such as an incomplete
+// line. A panic while closing is reported like one while writing, and
+// anything written afterwards is dropped.
+func (w *GuardWriter) Close() error {
+	if w.dropping {
+		return nil
+	}
+	dest := w.full
+	if w.safeMode {
+		dest = w.safe
+	}
+	panicErr, err := guardedClose(dest)
+	if panicErr != nil {
+		w.safeMode = true
+		w.dropping = true
+		w.onPanic(panicErr)
+	}
+	return err
+}
+
+// guardedClose closes dest, recovering any panic.
+func guardedClose(dest io.Writer) (panicErr *PanicError, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			panicErr = newPanicError("", v)
+		}
+	}()
+	return nil, closeWriter(dest)
+}
+
+// guardedWrite writes p to dest, recovering any panic.
+func guardedWrite(dest io.Writer, p []byte) (n int, panicErr *PanicError, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			panicErr = newPanicError("", v)
+		}
+	}()
+	n, err = dest.Write(p)
+	return n, nil, err
+}
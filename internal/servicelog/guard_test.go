@@ -0,0 +1,223 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type guardSuite struct{}
+
+var _ = Suite(&guardSuite{})
+
+// panickingWriter passes writes through to dest, and panics on those
+// containing "boom".
+type panickingWriter struct {
+	dest io.Writer
+}
+
+func (w panickingWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("boom")) {
+		panic("stage exploded")
+	}
+	return w.dest.Write(p)
+}
+
+func (s *guardSuite) TestSafeMode(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	var b bytes.Buffer
+	var panics []*servicelog.PanicError
+	full := servicelog.NewStageWriter(panickingWriter{newFormatWriter(&b, "svc")}, "filter")
+	safe := newFormatWriter(&b, "svc")
+	w := servicelog.NewGuardWriter(full, safe, func(err *servicelog.PanicError) {
+		panics = append(panics, err)
+	})
+
+	for _, chunk := range []string{"one\n", "boom\n", "two\n", "boom again\n"} {
+		n, err := io.WriteString(w, chunk)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(chunk))
+	}
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [svc] one
+2021-05-13T03:16:51.001Z [svc] boom
+2021-05-13T03:16:51.001Z [svc] two
+2021-05-13T03:16:51.001Z [svc] boom again
+`[1:])
+
+	// The full pipeline isn't used again after it panics, so it's only
+	// reported once.
+	c.Assert(panics, HasLen, 1)
+	c.Check(panics[0].Stage, Equals, "filter")
+	c.Check(panics[0].Value, Equals, "stage exploded")
+	c.Check(panics[0], ErrorMatches, `panic in log pipeline stage "filter": stage exploded`)
+	// The stack is where the stage panicked, not where it was recovered.
+	c.Check(string(panics[0].Stack), Matches, `(?s).*panickingWriter\.Write.*`)
+}
+
+func (s *guardSuite) TestReadFrom(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	// What's read goes into the buffer of the full pipeline's formatter,
+	// and still reaches the safe pipeline when the full one panics.
+	var b bytes.Buffer
+	var panics []*servicelog.PanicError
+	full := servicelog.NewStageWriter(newFormatWriter(panickingWriter{&b}, "svc"), servicelog.StageFormat)
+	safe := newFormatWriter(&b, "svc")
+	w := servicelog.NewGuardWriter(full, safe, func(err *servicelog.PanicError) {
+		panics = append(panics, err)
+	})
+	r := &chunkReader{chunks: []string{"one\n", "boom\n", "two\n"}}
+	n, err := io.Copy(w, r)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, int64(len("one\nboom\ntwo\n")))
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [svc] one
+2021-05-13T03:16:51.001Z [svc] boom
+2021-05-13T03:16:51.001Z [svc] two
+`[1:])
+	c.Check(panics, HasLen, 1)
+
+	_, err = w.ReadFrom(&chunkReader{err: errors.New("pipe broke")})
+	c.Check(err, ErrorMatches, "cannot read service output: pipe broke")
+}
+
+func (s *guardSuite) TestInnermostStage(c *C) {
+	var panics []*servicelog.PanicError
+	inner := servicelog.NewStageWriter(panickingWriter{ioutil.Discard}, "inner")
+	outer := servicelog.NewStageWriter(inner, "outer")
+	w := servicelog.NewGuardWriter(outer, ioutil.Discard, func(err *servicelog.PanicError) {
+		panics = append(panics, err)
+	})
+	_, err := io.WriteString(w, "boom\n")
+	c.Assert(err, IsNil)
+	c.Assert(panics, HasLen, 1)
+	c.Check(panics[0].Stage, Equals, "inner")
+}
+
+func (s *guardSuite) TestUnknownStage(c *C) {
+	var panics []*servicelog.PanicError
+	w := servicelog.NewGuardWriter(panickingWriter{ioutil.Discard}, ioutil.Discard, func(err *servicelog.PanicError) {
+		panics = append(panics, err)
+	})
+	_, err := io.WriteString(w, "boom\n")
+	c.Assert(err, IsNil)
+	c.Assert(panics, HasLen, 1)
+	c.Check(panics[0].Stage, Equals, "")
+	c.Check(panics[0], ErrorMatches, "panic in log pipeline: stage exploded")
+}
+
+func (s *guardSuite) TestSafePipelinePanics(c *C) {
+	var b bytes.Buffer
+	var panics []*servicelog.PanicError
+	full := servicelog.NewStageWriter(panickingWriter{&b}, "filter")
+	safe := servicelog.NewStageWriter(panickingWriter{&b}, servicelog.StageFormat)
+	w := servicelog.NewGuardWriter(full, safe, func(err *servicelog.PanicError) {
+		panics = append(panics, err)
+	})
+	for _, chunk := range []string{"one\n", "boom\n", "two\n", "three\n"} {
+		n, err := io.WriteString(w, chunk)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(chunk))
+	}
+	// Once the safe pipeline has panicked too, everything is dropped.
+	c.Check(b.String(), Equals, "one\n")
+	c.Assert(panics, HasLen, 2)
+	c.Check(panics[0].Stage, Equals, "filter")
+	c.Check(panics[1].Stage, Equals, servicelog.StageFormat)
+}
+
+func (s *guardSuite) TestErrors(c *C) {
+	// Errors, unlike panics, are returned from either pipeline.
+	full := servicelog.NewStageWriter(failingWriter(errors.New("full failed")), "filter")
+	w := servicelog.NewGuardWriter(full, failingWriter(errors.New("safe failed")), func(err *servicelog.PanicError) {
+		c.Fatalf("unexpected panic: %v", err)
+	})
+	_, err := io.WriteString(w, "one\n")
+	c.Check(err, ErrorMatches, "full failed")
+
+	var b strings.Builder
+	w = servicelog.NewGuardWriter(panickingWriter{&b}, failingWriter(errors.New("safe failed")), func(err *servicelog.PanicError) {})
+	_, err = io.WriteString(w, "boom\n")
+	c.Check(err, ErrorMatches, "safe failed")
+}
+
+func (s *guardSuite) TestClose(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	// Closing closes the pipeline in use: the full one, and the safe one
+	// after a panic.
+	var b bytes.Buffer
+	full := servicelog.NewStageWriter(panickingWriter{newFormatWriter(&b, "svc")}, "filter")
+	safe := newFormatWriter(&b, "svc")
+	w := servicelog.NewGuardWriter(servicelog.NewStageWriter(newFormatWriter(&b, "svc"), "format"), safe, func(err *servicelog.PanicError) {
+		c.Fatalf("unexpected panic: %v", err)
+	})
+	_, err := io.WriteString(w, "one")
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [svc] one [incomplete line]\n")
+
+	b.Reset()
+	var panics []*servicelog.PanicError
+	w = servicelog.NewGuardWriter(full, safe, func(err *servicelog.PanicError) {
+		panics = append(panics, err)
+	})
+	_, err = io.WriteString(w, "boom")
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [svc] boom [incomplete line]\n")
+	c.Check(panics, HasLen, 1)
+}
+
+// panickingCloser panics when it's closed.
+type panickingCloser struct {
+	io.Writer
+}
+
+func (panickingCloser) Close() error {
+	panic("close exploded")
+}
+
+func (s *guardSuite) TestClosePanics(c *C) {
+	var b bytes.Buffer
+	var panics []*servicelog.PanicError
+	full := servicelog.NewStageWriter(panickingCloser{&b}, "filter")
+	w := servicelog.NewGuardWriter(full, &b, func(err *servicelog.PanicError) {
+		panics = append(panics, err)
+	})
+	c.Assert(w.Close(), IsNil)
+	c.Assert(panics, HasLen, 1)
+	c.Check(panics[0], ErrorMatches, `panic in log pipeline stage "filter": close exploded`)
+
+	// Anything written afterwards is dropped.
+	n, err := io.WriteString(w, "one\n")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 4)
+	c.Check(b.String(), Equals, "")
+}
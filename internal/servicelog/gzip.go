@@ -0,0 +1,168 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// GzipConfig configures a GzipWriter.
+type GzipConfig struct {
+	// Level is the compression level, from gzip.HuffmanOnly to
+	// gzip.BestCompression, or gzip.DefaultCompression if it's zero.
+	Level int
+	// FlushInterval, if positive, is how long the lines written are held
+	// in the compressor, at most, before it's flushed.
+	FlushInterval time.Duration
+	// FlushSize, if positive, is the number of bytes written, at most,
+	// before the compressor is flushed.
+	FlushSize int
+}
+
+// GzipWriter compresses a service's output on its way to dest, such as a
+// file archiving it, as a single gzip stream. The compressor is flushed
+// once the bytes written since it was last flushed reach the writer's
+// flush size, or its flush interval has passed since the first of them
+// was written, so that what's in dest so far always decompresses to the
+// lines written up to then. It's flushed between lines only, so if a
+// flush is due in the middle of a line, it waits for the end of the line.
+// Writes report the bytes of the uncompressed output they're given.
+type GzipWriter struct {
+	mu       sync.Mutex
+	dest     io.Writer
+	zw       *gzip.Writer
+	interval time.Duration
+	size     int
+
+	// pending is the number of bytes written since the compressor was
+	// last flushed, midLine is set if they end in the middle of a line,
+	// and due if the flush interval has passed.
+	pending int
+	midLine bool
+	due     bool
+
+	// timer marks the flush as due once the interval has passed.
+	timer *deadlineTimer
+	// err is the error from a flush by the timer, returned by the next
+	// Write or Close.
+	err    error
+	closed bool
+}
+
+// NewGzipWriter returns a GzipWriter that writes the compressed output to
+// dest.
+func NewGzipWriter(dest io.Writer, config GzipConfig) (*GzipWriter, error) {
+	if config.FlushInterval < 0 {
+		return nil, errors.New("gzip flush interval must not be negative")
+	}
+	if config.FlushSize < 0 {
+		return nil, errors.New("gzip flush size must not be negative")
+	}
+	level := config.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	zw, err := gzip.NewWriterLevel(dest, level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip compression level %d", config.Level)
+	}
+	g := &GzipWriter{
+		dest:     dest,
+		zw:       zw,
+		interval: config.FlushInterval,
+		size:     config.FlushSize,
+	}
+	g.timer = newDeadlineTimer(&g.mu, g.timeout)
+	return g, nil
+}
+
+// Write compresses p, flushing the compressor if a flush is due and p
+// ends a line. Writes after Close fail with io.ErrClosedPipe.
+func (g *GzipWriter) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.err; err != nil {
+		g.err = nil
+		return 0, err
+	}
+	if g.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := g.zw.Write(p)
+	if n > 0 {
+		if g.pending == 0 && g.interval > 0 {
+			g.timer.Reset(g.interval)
+		}
+		g.pending += n
+		g.midLine = p[n-1] != '\n'
+		if g.size > 0 && g.pending >= g.size {
+			g.due = true
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	if g.due && !g.midLine {
+		err = g.flush()
+	}
+	return n, err
+}
+
+// flush flushes the compressor, so that dest gets what's been written.
+func (g *GzipWriter) flush() error {
+	g.timer.Stop()
+	g.pending = 0
+	g.due = false
+	return g.zw.Flush()
+}
+
+// timeout flushes the compressor once the interval has passed, or marks
+// the flush as due at the end of the line.
+func (g *GzipWriter) timeout() {
+	g.due = true
+	if g.midLine {
+		// The next write ending a line flushes the compressor.
+		return
+	}
+	if err := g.flush(); err != nil && g.err == nil {
+		g.err = err
+	}
+}
+
+// Close finishes the gzip stream, and closes dest if it's an io.Closer.
+// Closing the writer again does nothing.
+func (g *GzipWriter) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+	err := g.err
+	g.err = nil
+	g.timer.Close()
+	if closeErr := g.zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := closeWriter(g.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type gzipSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&gzipSuite{})
+
+func (s *gzipSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *gzipSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// gunzip returns what the gzip stream in data decompresses to, reading as
+// far as it can if the stream isn't finished.
+func gunzip(data string) string {
+	zr, err := gzip.NewReader(strings.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	out, _ := ioutil.ReadAll(zr)
+	return string(out)
+}
+
+func (s *gzipSuite) TestFlushSize(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	w, err := servicelog.NewGzipWriter(dest, servicelog.GzipConfig{FlushSize: 100})
+	c.Assert(err, IsNil)
+	defer w.Close()
+
+	// Writes report the uncompressed bytes, and the lines are held in the
+	// compressor until there are enough of them.
+	var written, flushed string
+	for i := 0; i < 9; i++ {
+		line := fmt.Sprintf("2021-05-13T03:16:51.001Z [svc] line %d\n", i)
+		n, err := io.WriteString(w, line)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(line))
+		written += line
+		if len(written)-len(flushed) >= 100 {
+			flushed = written
+		}
+		c.Check(gunzip(dest.String()), Equals, flushed, Commentf("line %d", i))
+	}
+	// The last line written is recoverable mid-stream.
+	c.Check(strings.HasSuffix(flushed, "line 8\n"), Equals, true)
+}
+
+func (s *gzipSuite) TestFlushAtLineEnd(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	w, err := servicelog.NewGzipWriter(dest, servicelog.GzipConfig{FlushSize: 10})
+	c.Assert(err, IsNil)
+	defer w.Close()
+
+	// A flush due in the middle of a line waits for its end.
+	_, err = io.WriteString(w, "first line\nsecond")
+	c.Assert(err, IsNil)
+	c.Check(gunzip(dest.String()), Equals, "")
+	_, err = io.WriteString(w, " line, which is long")
+	c.Assert(err, IsNil)
+	c.Check(gunzip(dest.String()), Equals, "")
+	_, err = io.WriteString(w, "\n")
+	c.Assert(err, IsNil)
+	c.Check(gunzip(dest.String()), Equals, "first line\nsecond line, which is long\n")
+}
+
+func (s *gzipSuite) TestFlushInterval(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	w, err := servicelog.NewGzipWriter(dest, servicelog.GzipConfig{FlushInterval: time.Second})
+	c.Assert(err, IsNil)
+	defer w.Close()
+
+	// The compressor is flushed once the interval has passed since the
+	// first byte written.
+	_, err = io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+	s.clock.Advance(500 * time.Millisecond)
+	_, err = io.WriteString(w, "second\n")
+	c.Assert(err, IsNil)
+	s.clock.Advance(499 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(gunzip(dest.String()), Equals, "")
+	s.clock.Advance(time.Millisecond)
+	waitFor(c, func() bool { return gunzip(dest.String()) == "first\nsecond\n" })
+
+	// If it's due in the middle of a line, it waits for its end.
+	_, err = io.WriteString(w, "third")
+	c.Assert(err, IsNil)
+	s.clock.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(gunzip(dest.String()), Equals, "first\nsecond\n")
+	_, err = io.WriteString(w, " line\n")
+	c.Assert(err, IsNil)
+	waitFor(c, func() bool { return gunzip(dest.String()) == "first\nsecond\nthird line\n" })
+}
+
+func (s *gzipSuite) TestClose(c *C) {
+	dest := &closeRecorder{}
+	w, err := servicelog.NewGzipWriter(dest, servicelog.GzipConfig{Level: gzip.BestCompression, FlushInterval: time.Second})
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "first\nincomplete")
+	c.Assert(err, IsNil)
+
+	// Closing finishes the stream, which then decompresses without
+	// errors.
+	c.Check(w.Close(), IsNil)
+	c.Check(dest.closed, Equals, true)
+	c.Check(s.clock.Pending(), Equals, 0)
+	zr, err := gzip.NewReader(bytes.NewReader(dest.Bytes()))
+	c.Assert(err, IsNil)
+	out, err := ioutil.ReadAll(zr)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Equals, "first\nincomplete")
+
+	c.Check(w.Close(), IsNil)
+	_, err = io.WriteString(w, "more\n")
+	c.Check(err, Equals, io.ErrClosedPipe)
+}
+
+func (s *gzipSuite) TestInvalid(c *C) {
+	_, err := servicelog.NewGzipWriter(ioutil.Discard, servicelog.GzipConfig{Level: 10})
+	c.Check(err, ErrorMatches, "invalid gzip compression level 10")
+	_, err = servicelog.NewGzipWriter(ioutil.Discard, servicelog.GzipConfig{FlushInterval: -time.Second})
+	c.Check(err, ErrorMatches, "gzip flush interval must not be negative")
+	_, err = servicelog.NewGzipWriter(ioutil.Discard, servicelog.GzipConfig{FlushSize: -1})
+	c.Check(err, ErrorMatches, "gzip flush size must not be negative")
+}
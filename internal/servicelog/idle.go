@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// idleFlusher is a writer holding back an incomplete line that can pass it
+// on before it's complete.
+type idleFlusher interface {
+	flushIdle() error
+}
+
+// flushIdle has w pass on the incomplete line it holds back, if it's an
+// idleFlusher.
+func flushIdle(w io.Writer) error {
+	if f, ok := w.(idleFlusher); ok {
+		return f.flushIdle()
+	}
+	return nil
+}
+
+// IdleFlushWriter is put in front of the writers of a service's log
+// pipeline that hold back an incomplete line, such as a FilterWriter or a
+// SeverityWriter, so that a prompt or a partial status the service writes
+// before blocking doesn't wait for the next newline to be logged. Once no
+// newline has been written for the writer's idle duration after the
+// incomplete line at the end of the last write, the line is ended with
+// IncompleteLineMarker and a newline if the writer marks it, or else dest
+// and the writers after it that hold the line back are made to pass it on
+// as it is, and the rest of the line follows as it's written. The writer
+// flushes at most once per idle period.
+//
+// The writers that can pass on a line before it's complete are the
+// AggregateWriter, CoalesceWriter, FilterWriter, PipelineWriter,
+// SampleWriter, SeverityWriter and those returned by NewRedactWriter.
+// Others only see the line ended by a marked flush.
+type IdleFlushWriter struct {
+	mu   sync.Mutex
+	dest io.Writer
+	idle time.Duration
+	mark bool
+
+	// timer flushes the incomplete line once it has been idle.
+	timer *deadlineTimer
+	// err is the error from a flush by the timer, returned by the next
+	// Write or Close.
+	err    error
+	closed bool
+}
+
+// NewIdleFlushWriter returns an IdleFlushWriter that writes to dest,
+// flushing an incomplete line once it has been idle for idle, which must
+// be positive. If mark is set, the line is ended with IncompleteLineMarker.
+func NewIdleFlushWriter(dest io.Writer, idle time.Duration, mark bool) *IdleFlushWriter {
+	w := &IdleFlushWriter{dest: dest, idle: idle, mark: mark}
+	w.timer = newDeadlineTimer(&w.mu, w.timeout)
+	return w
+}
+
+// Write writes p to dest. Writes after Close fail with io.ErrClosedPipe.
+func (w *IdleFlushWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.err; err != nil {
+		w.err = nil
+		return 0, err
+	}
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := w.dest.Write(p)
+	if n > 0 {
+		if p[n-1] != '\n' {
+			w.timer.Reset(w.idle)
+		} else {
+			w.timer.Stop()
+		}
+	}
+	return n, err
+}
+
+// timeout flushes the incomplete line once it has been idle.
+func (w *IdleFlushWriter) timeout() {
+	var err error
+	if w.mark {
+		_, err = writeFull(w.dest, []byte(IncompleteLineMarker+"\n"))
+	} else {
+		err = flushIdle(w.dest)
+	}
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// Close stops the timer and closes dest, if it's an io.Closer, so that it
+// can end an incomplete line. Closing the writer again does nothing.
+func (w *IdleFlushWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.err
+	w.err = nil
+	w.timer.Close()
+	if closeErr := closeWriter(w.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"io"
+	"regexp"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type idleSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&idleSuite{})
+
+func (s *idleSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *idleSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// expectWrite checks that the next write to dest is expected.
+func expectWrite(c *C, dest *chunkWriter, expected string) {
+	select {
+	case chunk := <-dest.writes:
+		c.Check(chunk, Equals, expected)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for write %q", expected)
+	}
+}
+
+// expectNoWrite checks that nothing is written to dest for a while.
+func expectNoWrite(c *C, dest *chunkWriter) {
+	select {
+	case chunk := <-dest.writes:
+		c.Fatalf("unexpected write %q", chunk)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func (s *idleSuite) TestMarked(c *C) {
+	dest := &chunkWriter{writes: make(chan string, 10)}
+	filter, err := servicelog.NewFilterWriter(dest, nil, regexp.MustCompile("^debug"))
+	c.Assert(err, IsNil)
+	w := servicelog.NewIdleFlushWriter(filter, 50*time.Millisecond, true)
+	defer w.Close()
+
+	// The line is ended with the marker once it has been idle, and goes
+	// through the filter whole.
+	_, err = io.WriteString(w, "first\npassword: ")
+	c.Assert(err, IsNil)
+	expectWrite(c, dest, "first\n")
+	s.clock.Advance(50 * time.Millisecond)
+	expectWrite(c, dest, "password: "+servicelog.IncompleteLineMarker+"\n")
+
+	// It's flushed only once, and what follows is a line of its own.
+	s.clock.Advance(time.Second)
+	expectNoWrite(c, dest)
+	_, err = io.WriteString(w, "secret\n")
+	c.Assert(err, IsNil)
+	expectWrite(c, dest, "secret\n")
+	c.Check(dest.String(), Equals, "first\npassword: "+servicelog.IncompleteLineMarker+"\nsecret\n")
+}
+
+func (s *idleSuite) TestUnmarked(c *C) {
+	dest := &chunkWriter{writes: make(chan string, 10)}
+	filter, err := servicelog.NewFilterWriter(dest, nil, regexp.MustCompile("^debug"))
+	c.Assert(err, IsNil)
+	w := servicelog.NewIdleFlushWriter(filter, 50*time.Millisecond, false)
+	defer w.Close()
+
+	// The start of the line is passed on as it is once it has been idle,
+	// and the rest follows as it's written.
+	_, err = io.WriteString(w, "continue? ")
+	c.Assert(err, IsNil)
+	s.clock.Advance(50 * time.Millisecond)
+	expectWrite(c, dest, "continue? ")
+	s.clock.Advance(time.Second)
+	expectNoWrite(c, dest)
+	_, err = io.WriteString(w, "[y/n]")
+	c.Assert(err, IsNil)
+	expectWrite(c, dest, "[y/n]")
+
+	// Each idle period flushes once, and the filter decided on the line
+	// by its start.
+	_, err = io.WriteString(w, " y\ndebug: ")
+	c.Assert(err, IsNil)
+	expectWrite(c, dest, " y\n")
+	s.clock.Advance(50 * time.Millisecond)
+	expectNoWrite(c, dest)
+	_, err = io.WriteString(w, "dropped\n")
+	c.Assert(err, IsNil)
+	expectNoWrite(c, dest)
+	c.Check(filter.Dropped(), Equals, int64(1))
+	c.Check(dest.String(), Equals, "continue? [y/n] y\n")
+}
+
+func (s *idleSuite) TestNewlineCancels(c *C) {
+	dest := &chunkWriter{writes: make(chan string, 10)}
+	filter, err := servicelog.NewFilterWriter(dest, regexp.MustCompile("."), nil)
+	c.Assert(err, IsNil)
+	w := servicelog.NewIdleFlushWriter(filter, 50*time.Millisecond, true)
+	defer w.Close()
+
+	// Each write restarts the idle period.
+	_, err = io.WriteString(w, "wait")
+	c.Assert(err, IsNil)
+	s.clock.Advance(30 * time.Millisecond)
+	_, err = io.WriteString(w, "ing")
+	c.Assert(err, IsNil)
+	s.clock.Advance(30 * time.Millisecond)
+	expectNoWrite(c, dest)
+
+	// A newline just before the deadline cancels the flush.
+	s.clock.Advance(19 * time.Millisecond)
+	_, err = io.WriteString(w, "\n")
+	c.Assert(err, IsNil)
+	expectWrite(c, dest, "waiting\n")
+	s.clock.Advance(time.Second)
+	expectNoWrite(c, dest)
+	c.Check(s.clock.Pending(), Equals, 0)
+}
+
+func (s *idleSuite) TestFlushedWriters(c *C) {
+	aggregate := func(dest io.Writer) io.Writer {
+		w, err := servicelog.NewAggregateWriter(dest, servicelog.AggregateConfig{Timeout: time.Hour, MaxSize: 1024})
+		c.Assert(err, IsNil)
+		return w
+	}
+	coalesce := func(dest io.Writer) io.Writer {
+		return servicelog.NewCoalesceWriter(dest, time.Hour)
+	}
+	filter := func(dest io.Writer) io.Writer {
+		w, err := servicelog.NewFilterWriter(dest, regexp.MustCompile("."), nil)
+		c.Assert(err, IsNil)
+		return w
+	}
+	redact := func(dest io.Writer) io.Writer {
+		w, err := servicelog.NewRedactWriter(dest, servicelog.RedactRule{Pattern: regexp.MustCompile("hunter2")})
+		c.Assert(err, IsNil)
+		return w
+	}
+	severity := func(dest io.Writer) io.Writer {
+		w, err := servicelog.NewSeverityWriter(dest, servicelog.SeverityConfig{})
+		c.Assert(err, IsNil)
+		return w
+	}
+	for i, stages := range [][]func(io.Writer) io.Writer{
+		{aggregate},
+		{coalesce},
+		{filter},
+		{redact},
+		{severity},
+		// The flush goes down the pipeline.
+		{coalesce, severity, redact, filter},
+	} {
+		dest := &chunkWriter{writes: make(chan string, 10)}
+		var head io.Writer = dest
+		for j := len(stages) - 1; j >= 0; j-- {
+			head = stages[j](head)
+		}
+		w := servicelog.NewIdleFlushWriter(head, 50*time.Millisecond, false)
+		_, err := io.WriteString(w, "hunter2> ")
+		c.Assert(err, IsNil)
+		s.clock.Advance(50 * time.Millisecond)
+		select {
+		case chunk := <-dest.writes:
+			c.Check(chunk, Matches, `(hunter2|\[REDACTED\])> `, Commentf("pipeline %d", i))
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for the flush of pipeline %d", i)
+		}
+		c.Check(w.Close(), IsNil)
+	}
+}
+
+func (s *idleSuite) TestFlushError(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	dest.Limit(len("incomplete"), syscall.ENOSPC)
+	w := servicelog.NewIdleFlushWriter(dest, 50*time.Millisecond, true)
+	_, err := io.WriteString(w, "incomplete")
+	c.Assert(err, IsNil)
+	s.clock.Advance(50 * time.Millisecond)
+	for i := 0; len(dest.Calls()) < 2; i++ {
+		if i >= 500 {
+			c.Fatalf("timed out waiting for the flush")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The error from the flush is returned by the next write.
+	dest.Limit(-1, nil)
+	_, err = io.WriteString(w, "next\n")
+	c.Check(err, Equals, syscall.ENOSPC)
+	_, err = io.WriteString(w, "next\n")
+	c.Check(err, IsNil)
+	c.Check(dest.String(), Equals, "incompletenext\n")
+	c.Check(w.Close(), IsNil)
+}
+
+func (s *idleSuite) TestClose(c *C) {
+	dest := &closeRecorder{}
+	w := servicelog.NewIdleFlushWriter(dest, 50*time.Millisecond, true)
+	_, err := io.WriteString(w, "incomplete")
+	c.Assert(err, IsNil)
+	c.Check(s.clock.Pending(), Equals, 1)
+
+	// Closing stops the timer and closes dest, once.
+	c.Check(w.Close(), IsNil)
+	c.Check(s.clock.Pending(), Equals, 0)
+	c.Check(dest.closed, Equals, true)
+	dest.closed = false
+	c.Check(w.Close(), IsNil)
+	c.Check(dest.closed, Equals, false)
+	s.clock.Advance(time.Second)
+	c.Check(dest.String(), Equals, "incomplete")
+
+	_, err = io.WriteString(w, "more\n")
+	c.Check(err, Equals, io.ErrClosedPipe)
+}
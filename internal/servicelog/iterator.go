@@ -37,6 +37,12 @@ type Iterator interface {
 	Notify(ch chan bool)
 
 	Buffered() int
+
+	// Missed returns the number of bytes the iterator has skipped because
+	// they were overwritten before it read them. Each time it's lapped like
+	// this, the truncation text is read in their place.
+	Missed() int64
+
 	io.Reader
 	io.WriterTo
 }
@@ -49,8 +55,34 @@ type iterator struct {
 	nextChan     chan bool
 	closeChan    chan struct{}
 
+	// missed counts the bytes skipped when truncated, up to lappedAt, the
+	// start of the buffer then. Reading restarts at the buffer's start at
+	// that time, so whatever is overwritten before then is added to it.
+	missed   int64
+	lappedAt RingPos
+
 	notifyLock sync.Mutex
 	notifyChan chan bool
+
+	// tracer, if set, records when lines are read for traceStage.
+	tracer     *Tracer
+	traceStage string
+
+	// With seqs set, for a Parser, offset counts the bytes read, and jumps
+	// records where the lines read don't follow on from those before: at
+	// the start, and at the truncation text and after it. seqKnown is set
+	// while the next bytes read from the buffer follow on.
+	seqs     bool
+	seqKnown bool
+	offset   int64
+	jumps    []seqJump
+}
+
+// seqJump gives the sequence number of the line starting, or continuing,
+// at offset in what an iterator has read, or zero for the truncation text.
+type seqJump struct {
+	offset int64
+	seq    int64
 }
 
 var _ Iterator = (*iterator)(nil)
@@ -79,10 +111,9 @@ func (it *iterator) Next(cancel <-chan struct{}) bool {
 	}
 	start, end := it.rb.Positions()
 	if it.index != TailPosition && it.index < start {
-		it.index = start
 		it.truncated()
 	}
-	if end != 0 && it.index < end {
+	if it.more(start, end) {
 		return true
 	}
 	if len(it.trunc) > 0 {
@@ -100,10 +131,9 @@ func (it *iterator) Next(cancel <-chan struct{}) bool {
 		}
 		start, end := it.rb.Positions()
 		if it.index != TailPosition && it.index < start {
-			it.index = start
 			it.truncated()
 		}
-		if end != 0 && it.index < end {
+		if it.more(start, end) {
 			return true
 		}
 		if len(it.trunc) > 0 {
@@ -116,20 +146,44 @@ func (it *iterator) Next(cancel <-chan struct{}) bool {
 	return false
 }
 
+// more reports whether there's data to read between start and end. At
+// TailPosition (after truncation), reading starts at start, so there's
+// nothing to read if the buffer is empty, as it is once freed.
+func (it *iterator) more(start, end RingPos) bool {
+	if it.index == TailPosition {
+		return start < end
+	}
+	return it.index < end
+}
+
 // Read implements io.Reader
 func (it *iterator) Read(dest []byte) (int, error) {
 	if it.rb == nil {
 		return 0, io.EOF
 	}
 	if len(it.trunc) > 0 {
+		if it.seqs && !it.truncWritten {
+			it.jumps = append(it.jumps, seqJump{offset: it.offset})
+		}
 		n := copy(dest, it.trunc)
 		it.trunc = it.trunc[n:]
 		it.truncWritten = true
+		it.offset += int64(n)
 		return n, nil
 	}
-	next, n, err := it.rb.Copy(dest, it.index)
+	withSeq := it.seqs && !it.seqKnown
+	next, n, seq, err := it.rb.copySeq(dest, it.index, withSeq)
 	if n > 0 {
+		it.restarted(next - RingPos(n))
 		it.truncWritten = false
+		if it.tracer != nil {
+			it.tracer.delivered(it.traceStage, next)
+		}
+		if withSeq {
+			it.jumps = append(it.jumps, seqJump{offset: it.offset, seq: seq})
+			it.seqKnown = true
+		}
+		it.offset += int64(n)
 	}
 	it.index = next
 	if err == ErrRange {
@@ -145,14 +199,18 @@ func (it *iterator) WriteTo(writer io.Writer) (int64, error) {
 		return 0, io.EOF
 	}
 	if len(it.trunc) > 0 {
-		n, err := writer.Write(it.trunc)
+		n, err := writeFull(writer, it.trunc)
 		it.trunc = it.trunc[n:]
 		it.truncWritten = true
 		return int64(n), err
 	}
 	next, n, err := it.rb.WriteTo(writer, it.index)
 	if n > 0 {
+		it.restarted(next - RingPos(n))
 		it.truncWritten = false
+		if it.tracer != nil {
+			it.tracer.delivered(it.traceStage, next)
+		}
 	}
 	it.index = next
 	if err == ErrRange {
@@ -176,7 +234,23 @@ func (it *iterator) Notify(ch chan bool) {
 	it.notifyChan = ch
 }
 
+func (it *iterator) Missed() int64 {
+	return it.missed
+}
+
 func (it *iterator) truncated() {
+	it.seqKnown = false
+	start, _ := it.rb.Positions()
+	if it.tracer != nil {
+		// Lines no longer in the buffer won't be read.
+		it.tracer.discard(it.traceStage, start)
+	}
+	if it.index != TailPosition {
+		if it.index < start {
+			it.missed += int64(start - it.index)
+		}
+		it.lappedAt = start
+	}
 	it.index = TailPosition
 	if len(it.trunc) > 0 {
 		// trunc being written
@@ -188,3 +262,11 @@ func (it *iterator) truncated() {
 	}
 	it.trunc = truncBytes
 }
+
+// restarted counts the bytes overwritten between the iterator being
+// truncated and reading restarting at readPos.
+func (it *iterator) restarted(readPos RingPos) {
+	if it.index == TailPosition && readPos > it.lappedAt {
+		it.missed += int64(readPos - it.lappedAt)
+	}
+}
@@ -270,6 +270,117 @@ func (s *iteratorSuite) TestTruncationByteByByte(c *C) {
 	c.Assert(buffer.String(), Equals, "\n(... output truncated ...)\n0123456789")
 }
 
+func (s *iteratorSuite) TestTruncationFreed(c *C) {
+	rb := servicelog.NewRingBuffer(10)
+	iter := rb.TailIterator()
+	fmt.Fprint(rb, "0123456789")
+	rb.Free()
+
+	// Once the truncation notice is read, there's nothing left to read.
+	cancel := make(chan struct{})
+	close(cancel)
+	buffer := &bytes.Buffer{}
+	for i := 0; iter.Next(cancel); i++ {
+		c.Assert(i < 10, Equals, true, Commentf("Next keeps returning true"))
+		_, err := io.Copy(buffer, iter)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(buffer.String(), Equals, "\n(... output truncated ...)\n")
+}
+
+func (s *iteratorSuite) TestMissed(c *C) {
+	rb := servicelog.NewRingBuffer(10)
+	iter := rb.TailIterator()
+	c.Check(iter.Missed(), Equals, int64(0))
+	fmt.Fprint(rb, "0123456789")
+	fmt.Fprint(rb, "abcdefghij")
+	c.Assert(iter.Next(nil), Equals, true)
+	c.Check(iter.Missed(), Equals, int64(10))
+
+	// What's overwritten after the iterator was lapped, before it reads
+	// again, is missed too.
+	fmt.Fprint(rb, "01234")
+	buffer := &bytes.Buffer{}
+	for iter.Next(nil) {
+		_, err := io.Copy(buffer, iter)
+		c.Assert(err, IsNil)
+	}
+	c.Check(buffer.String(), Equals, "\n(... output truncated ...)\nfghij01234")
+	c.Check(iter.Missed(), Equals, int64(15))
+}
+
+func (s *iteratorSuite) TestMissedConcurrent(c *C) {
+	// A writer that never waits for its readers, which are lapped now and
+	// then: each reader gets or misses every byte.
+	rb := servicelog.NewRingBuffer(4096)
+	numReaders := runtime.NumCPU()
+	if numReaders < 4 {
+		numReaders = 4
+	}
+	iters := make([]servicelog.Iterator, numReaders)
+	for i := range iters {
+		iters[i] = rb.TailIterator()
+	}
+	type result struct {
+		read, truncations int
+		missed            int64
+	}
+	results := make([]result, numReaders)
+	wg := sync.WaitGroup{}
+	for i, iter := range iters {
+		wg.Add(1)
+		go func(i int, iter servicelog.Iterator) {
+			defer wg.Done()
+			defer iter.Close()
+			output := &bytes.Buffer{}
+			buf := make([]byte, 1+i*97%1000)
+			cancel := make(chan struct{})
+			for n := 0; iter.Next(cancel); n++ {
+				if i%2 == 0 {
+					_, err := iter.WriteTo(output)
+					if err != nil && err != io.EOF {
+						c.Errorf("reader %d: %v", i, err)
+						return
+					}
+				} else {
+					n, err := iter.Read(buf)
+					if err != nil && err != io.EOF {
+						c.Errorf("reader %d: %v", i, err)
+						return
+					}
+					output.Write(buf[:n])
+				}
+				if n%(i+1) == 0 {
+					runtime.Gosched()
+				}
+			}
+			truncations := bytes.Count(output.Bytes(), []byte("\n(... output truncated ...)\n"))
+			results[i] = result{
+				read:        output.Len() - truncations*len("\n(... output truncated ...)\n"),
+				truncations: truncations,
+				missed:      iter.Missed(),
+			}
+		}(i, iter)
+	}
+
+	written := 0
+	for i := 0; i < 50000; i++ {
+		n, err := fmt.Fprintf(rb, "line %d\n", i)
+		c.Assert(err, IsNil)
+		written += n
+		if i%100 == 0 {
+			runtime.Gosched()
+		}
+	}
+	c.Assert(rb.Close(), IsNil)
+	wg.Wait()
+
+	for i, result := range results {
+		c.Check(int64(result.read)+result.missed, Equals, int64(written), Commentf("reader %d: %+v", i, result))
+		c.Check(result.missed > 0, Equals, result.truncations > 0, Commentf("reader %d: %+v", i, result))
+	}
+}
+
 func (s *iteratorSuite) TestClosed(c *C) {
 	rb := servicelog.NewRingBuffer(10)
 	fmt.Fprint(rb, "0123456789")
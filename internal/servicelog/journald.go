@@ -0,0 +1,177 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// ErrJournalUnavailable is returned by NewJournalWriter if there's no
+// journal to write to, so that callers can fall back to another writer.
+var ErrJournalUnavailable = errors.New("journal socket not available")
+
+var journalSocketPath = "/run/systemd/journal/socket"
+
+// JournalMaxLine is the length, in bytes, of the longest line a
+// JournalWriter sends as a single entry. Longer lines are split.
+const JournalMaxLine = 1024 * 1024
+
+// JournalWriter writes a service's output to the systemd journal using
+// its native protocol, each line as an entry with the line as MESSAGE and
+// the service name as SYSLOG_IDENTIFIER. Lines starting with a priority
+// prefix as described in sd-daemon(3), such as "<3>", have it removed and
+// given as the entry's PRIORITY.
+type JournalWriter struct {
+	mu          sync.Mutex
+	conn        *net.UnixConn
+	serviceName string
+	// line is the start of the current line, and midLine is set until the
+	// line ends, even if it's empty.
+	line    []byte
+	midLine bool
+	// entry is the datagram being sent, and fields holds the fields that
+	// are the same in every entry.
+	entry  []byte
+	fields []byte
+}
+
+// NewJournalWriter returns a JournalWriter for the given service. It
+// returns ErrJournalUnavailable if the journal's socket doesn't exist or
+// nothing is listening on it.
+func NewJournalWriter(serviceName string) (*JournalWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocketPath, Net: "unixgram"})
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, ErrJournalUnavailable
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to journal: %v", err)
+	}
+	return &JournalWriter{
+		conn:        conn,
+		serviceName: serviceName,
+		fields:      appendJournalField(nil, "SYSLOG_IDENTIFIER", []byte(serviceName)),
+	}, nil
+}
+
+// Write sends the lines completed by p to the journal, and holds on to the
+// incomplete line at its end. If a line can't be sent it's dropped: the
+// count returned includes it, along with the error.
+func (j *JournalWriter) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		j.midLine = true
+		chunk := p
+		i := bytes.IndexByte(chunk, '\n')
+		if i >= 0 {
+			chunk = chunk[:i]
+		}
+		if room := JournalMaxLine - len(j.line); len(chunk) > room {
+			j.line = append(j.line, chunk[:room]...)
+			written += room
+			p = p[room:]
+			if err := j.send(); err != nil {
+				return written, err
+			}
+			continue
+		}
+		j.line = append(j.line, chunk...)
+		written += len(chunk)
+		if i < 0 {
+			break
+		}
+		written++
+		p = p[i+1:]
+		j.midLine = false
+		if err := j.send(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// send sends the current line as an entry.
+func (j *JournalWriter) send() error {
+	message := j.line
+	j.entry = append(j.entry[:0], j.fields...)
+	if len(message) >= 3 && message[0] == '<' && message[1] >= '0' && message[1] <= '7' && message[2] == '>' {
+		j.entry = appendJournalField(j.entry, "PRIORITY", message[1:2])
+		message = message[3:]
+	}
+	j.entry = appendJournalField(j.entry, "MESSAGE", message)
+	if len(j.line) > JournalMaxLine {
+		// Don't keep a buffer grown for a long line.
+		j.line = nil
+	} else {
+		j.line = j.line[:0]
+	}
+
+	_, err := j.conn.Write(j.entry)
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		// Too large for a datagram: the protocol has it passed in a
+		// sealed memory file instead.
+		err = sendJournalFile(j.conn, j.entry)
+	}
+	if cap(j.entry) > 2*JournalMaxLine {
+		j.entry = nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot send log line to journal: %v", err)
+	}
+	return nil
+}
+
+// Close sends the incomplete line, if any, and closes the connection to
+// the journal.
+func (j *JournalWriter) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var err error
+	if j.midLine {
+		j.midLine = false
+		err = j.send()
+	}
+	if closeErr := j.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// appendJournalField appends a field in the journal's native format:
+// KEY=value and a newline, or if the value has newlines, the key, a
+// newline, the value's length as a little-endian 64-bit integer, the value
+// and a newline.
+func appendJournalField(out []byte, key string, value []byte) []byte {
+	out = append(out, key...)
+	if bytes.IndexByte(value, '\n') < 0 {
+		out = append(out, '=')
+		out = append(out, value...)
+		return append(out, '\n')
+	}
+	out = append(out, '\n')
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	out = append(out, size[:]...)
+	out = append(out, value...)
+	return append(out, '\n')
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type journalSuite struct {
+	conn    *net.UnixConn
+	restore func()
+}
+
+var _ = Suite(&journalSuite{})
+
+func (s *journalSuite) SetUpTest(c *C) {
+	path := filepath.Join(c.MkDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, IsNil)
+	s.conn = conn
+	s.restore = servicelog.FakeJournalSocket(path)
+}
+
+func (s *journalSuite) TearDownTest(c *C) {
+	s.restore()
+	s.conn.Close()
+}
+
+// receive reads the next entry sent to the journal socket, from the
+// datagram or from the file passed with it, and returns its fields.
+func (s *journalSuite) receive(c *C) map[string]string {
+	buf := make([]byte, 1024*1024)
+	oob := make([]byte, unix.CmsgSpace(4))
+	c.Assert(s.conn.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+	n, oobn, _, _, err := s.conn.ReadMsgUnix(buf, oob)
+	c.Assert(err, IsNil)
+	data := buf[:n]
+	if oobn > 0 {
+		c.Assert(n, Equals, 0)
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		c.Assert(err, IsNil)
+		c.Assert(msgs, HasLen, 1)
+		fds, err := unix.ParseUnixRights(&msgs[0])
+		c.Assert(err, IsNil)
+		c.Assert(fds, HasLen, 1)
+		f := os.NewFile(uintptr(fds[0]), "entry")
+		defer f.Close()
+		seals, err := unix.FcntlInt(f.Fd(), unix.F_GET_SEALS, 0)
+		c.Assert(err, IsNil)
+		c.Check(seals, Equals, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL)
+		// The file shares its offset with the sender's, after what it
+		// wrote.
+		_, err = f.Seek(0, io.SeekStart)
+		c.Assert(err, IsNil)
+		data, err = ioutil.ReadAll(f)
+		c.Assert(err, IsNil)
+	}
+	return parseJournalEntry(c, data)
+}
+
+func parseJournalEntry(c *C, data []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "=\n")
+		c.Assert(i > 0, Equals, true, Commentf("entry %q", data))
+		key := string(data[:i])
+		if data[i] == '=' {
+			end := bytes.IndexByte(data, '\n')
+			c.Assert(end >= 0, Equals, true)
+			fields[key] = string(data[i+1 : end])
+			data = data[end+1:]
+			continue
+		}
+		data = data[i+1:]
+		c.Assert(len(data) >= 8, Equals, true)
+		size := int(binary.LittleEndian.Uint64(data))
+		data = data[8:]
+		c.Assert(len(data) > size, Equals, true)
+		c.Assert(data[size], Equals, byte('\n'))
+		fields[key] = string(data[:size])
+		data = data[size+1:]
+	}
+	return fields
+}
+
+func (s *journalSuite) TestWrite(c *C) {
+	w, err := servicelog.NewJournalWriter("test")
+	c.Assert(err, IsNil)
+	for _, p := range []string{"first\nsec", "ond\n", "\n<3>an error\n<9>not a priority\nlast"} {
+		n, err := w.Write([]byte(p))
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(p))
+	}
+	c.Assert(w.Close(), IsNil)
+
+	for _, expected := range []map[string]string{
+		{"MESSAGE": "first", "SYSLOG_IDENTIFIER": "test"},
+		{"MESSAGE": "second", "SYSLOG_IDENTIFIER": "test"},
+		{"MESSAGE": "", "SYSLOG_IDENTIFIER": "test"},
+		{"MESSAGE": "an error", "SYSLOG_IDENTIFIER": "test", "PRIORITY": "3"},
+		{"MESSAGE": "<9>not a priority", "SYSLOG_IDENTIFIER": "test"},
+		{"MESSAGE": "last", "SYSLOG_IDENTIFIER": "test"},
+	} {
+		c.Check(s.receive(c), DeepEquals, expected)
+	}
+}
+
+func (s *journalSuite) TestBinaryField(c *C) {
+	w, err := servicelog.NewJournalWriter("odd\nname")
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("caf\xc3\xa9 \x00 \r\n"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Check(s.receive(c), DeepEquals, map[string]string{
+		"MESSAGE":           "caf\xc3\xa9 \x00 \r",
+		"SYSLOG_IDENTIFIER": "odd\nname",
+	})
+}
+
+func (s *journalSuite) TestLargeEntry(c *C) {
+	w, err := servicelog.NewJournalWriter("test")
+	c.Assert(err, IsNil)
+	defer w.Close()
+
+	// Entries too large for a datagram are passed in a sealed file, and
+	// lines too long for an entry are split.
+	line := strings.Repeat("x", servicelog.JournalMaxLine+10)
+	_, err = w.Write([]byte(line + "\nsmall\n"))
+	c.Assert(err, IsNil)
+	for _, message := range []string{line[:servicelog.JournalMaxLine], line[:10], "small"} {
+		c.Check(s.receive(c)["MESSAGE"] == message, Equals, true, Commentf("message of %d bytes", len(message)))
+	}
+}
+
+func (s *journalSuite) TestUnavailable(c *C) {
+	restore := servicelog.FakeJournalSocket(filepath.Join(c.MkDir(), "missing"))
+	defer restore()
+	w, err := servicelog.NewJournalWriter("test")
+	c.Check(err, Equals, servicelog.ErrJournalUnavailable)
+	c.Check(w, IsNil)
+
+	// A socket nobody listens on any more.
+	path := filepath.Join(c.MkDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, IsNil)
+	conn.Close()
+	restore = servicelog.FakeJournalSocket(path)
+	defer restore()
+	w, err = servicelog.NewJournalWriter("test")
+	c.Check(err, Equals, servicelog.ErrJournalUnavailable)
+	c.Check(w, IsNil)
+}
+
+func (s *journalSuite) TestSendError(c *C) {
+	w, err := servicelog.NewJournalWriter("test")
+	c.Assert(err, IsNil)
+	defer w.Close()
+	s.conn.Close()
+
+	// A line that can't be sent is dropped, and counted as written.
+	n, err := w.Write([]byte("first\nsecond\n"))
+	c.Check(n, Equals, 6)
+	c.Check(err, ErrorMatches, "cannot send log line to journal: .*")
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const hexDigits = "0123456789abcdef"
+
+type recordFormatter struct {
+	mut         sync.Mutex
+	serviceName string
+	dest        io.Writer
+	// start, fields and end are written around each line's time and
+	// message: fields has the service name, escaped once, and the start of
+	// the message, which end finishes, and incomplete instead if the line
+	// is incomplete when the writer is closed. levelFields are the fields
+	// with each level too, for lines given a level by setLineLevel.
+	start       []byte
+	fields      []byte
+	levelFields [][]byte
+	end         []byte
+	incomplete  []byte
+	// midLine is set once the start of the current line's record has been
+	// written, until the end of the line.
+	midLine bool
+	// partial holds the first bytes of a character split across writes,
+	// until the rest of it arrives.
+	partial []byte
+	// pending holds the part of a batch that a failed write didn't get
+	// through, to be written before anything else.
+	pending []byte
+	batch   []byte
+	// lineTime, if set, is the time of the next record, given to
+	// writeEntry or setLineTime, and joining is set while it writes an entry, whose lines
+	// are all in the one record.
+	lineTime time.Time
+	joining  bool
+	// lineLevel, if set, is the level of the next record.
+	lineLevel Level
+}
+
+// NewJSONFormatWriter returns an io.Writer that writes every line in the
+// stream as a JSON object on a line of its own, with the time the line
+// started, the service name and the line without its newline.
+// For the input:
+//
+//	first\n
+//	say "hi"\n
+//
+// The expected output is:
+//
+//	{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"first"}\n
+//	{"time":"2021-05-13T03:16:52.002Z","service":"test","message":"say \"hi\""}\n
+//
+// Like NewFormatWriter, lines aren't accumulated: each object is written as
+// its line is. Invalid UTF-8 in a line is written as U+FFFD, and a line
+// that's incomplete when the writer is closed is ended with
+// "incomplete":true.
+//
+// If a write to dest fails, the part of the output that wasn't written is
+// kept and written before anything else, so the input is counted as
+// written, up to the end of the batch that failed.
+func NewJSONFormatWriter(dest io.Writer, serviceName string) io.Writer {
+	return newJSONFormatter(dest, serviceName, "")
+}
+
+// NewJSONFormatWriterWithStream is like NewJSONFormatWriter, but writes
+// stream, the name of the output stream the lines are from, as a "stream"
+// field after the service name, unless it's empty.
+func NewJSONFormatWriterWithStream(dest io.Writer, serviceName, stream string) io.Writer {
+	return newJSONFormatter(dest, serviceName, stream)
+}
+
+func newJSONFormatter(dest io.Writer, serviceName, stream string) *recordFormatter {
+	service := append([]byte(`","service":"`), appendJSONString(nil, []byte(serviceName), true)...)
+	if stream != "" {
+		service = append(service, `","stream":"`...)
+		service = appendJSONString(service, []byte(stream), true)
+	}
+	fields := append(service[:len(service):len(service)], `","message":"`...)
+	levelFields := make([][]byte, len(levelNames))
+	for level := LevelTrace; level <= LevelFatal; level++ {
+		levelFields[level] = append(service[:len(service):len(service)], `","level":"`+level.String()+`","message":"`...)
+	}
+	return &recordFormatter{
+		serviceName: serviceName,
+		dest:        dest,
+		start:       []byte(`{"time":"`),
+		fields:      fields,
+		levelFields: levelFields,
+		end:         []byte("\"}\n"),
+		incomplete:  []byte("\",\"incomplete\":true}\n"),
+	}
+}
+
+func (f *recordFormatter) Write(p []byte) (int, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.write(p)
+}
+
+// writeEntry writes entry, complete lines of the service's output and
+// possibly the start of another, as a single record at time t, with
+// newlines between the lines in its message.
+func (f *recordFormatter) writeEntry(entry []byte, t time.Time) (int, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.lineTime = t
+	f.joining = true
+	defer func() {
+		f.joining = false
+	}()
+	return f.write(entry)
+}
+
+// setLineLevel sets the level of the next line to start, written as a
+// field of its record.
+func (f *recordFormatter) setLineLevel(level Level) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.lineLevel = level
+}
+
+// setLineTime sets the time of the next line to start, instead of the time
+// its first bytes arrive.
+func (f *recordFormatter) setLineTime(t time.Time) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.lineTime = t
+}
+
+func (f *recordFormatter) write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := f.writePending(); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		consumed := f.fillBatch(p)
+		n, err := writeFull(f.dest, f.batch)
+		written += consumed
+		if err != nil {
+			f.pending = append(f.pending[:0], f.batch[n:]...)
+			return written, wrapWriteError(err, f.serviceName, StageFormat)
+		}
+		p = p[consumed:]
+	}
+	return written, nil
+}
+
+// Close ends the current line's record, if the line is incomplete, marking
+// it as incomplete. It doesn't close dest, and the writer may still be
+// written to, starting a new line.
+func (f *recordFormatter) Close() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if err := f.writePending(); err != nil {
+		return err
+	}
+	if !f.midLine {
+		return nil
+	}
+	f.batch = appendJSONString(f.batch[:0], f.partial, true)
+	f.batch = append(f.batch, f.incomplete...)
+	f.partial = f.partial[:0]
+	f.midLine = false
+	n, err := writeFull(f.dest, f.batch)
+	if err != nil {
+		f.pending = append(f.pending[:0], f.batch[n:]...)
+		return wrapWriteError(err, f.serviceName, StageFormat)
+	}
+	return nil
+}
+
+func (f *recordFormatter) writePending() error {
+	n, err := writeFull(f.dest, f.pending)
+	f.pending = f.pending[n:]
+	if err != nil {
+		return wrapWriteError(err, f.serviceName, StageFormat)
+	}
+	return nil
+}
+
+// fillBatch formats lines from the start of p into f.batch, up to about
+// formatBatchSize bytes of input, and returns the number of bytes of p
+// consumed.
+func (f *recordFormatter) fillBatch(p []byte) int {
+	f.batch = f.batch[:0]
+	consumed := 0
+	for consumed < len(p) && consumed < formatBatchSize {
+		if !f.midLine {
+			f.midLine = true
+			f.batch = append(f.batch, f.start...)
+			t := f.lineTime
+			if t.IsZero() {
+				t = clock.Now()
+			}
+			f.lineTime = time.Time{}
+			f.batch = t.UTC().AppendFormat(f.batch, outputTimeFormat)
+			fields := f.fields
+			if f.lineLevel != 0 {
+				fields = f.levelFields[f.lineLevel]
+				f.lineLevel = 0
+			}
+			f.batch = append(f.batch, fields...)
+		}
+
+		line := p[consumed:]
+		if room := formatBatchSize - consumed; len(line) > room {
+			line = line[:room]
+		}
+		end := false
+		if f.joining {
+			// The lines of an entry being joined only end it at its end,
+			// and the newlines between them are escaped in the message.
+			if last := len(p) - 1; p[last] == '\n' && last-consumed < len(line) {
+				line = line[:last-consumed]
+				end = true
+			}
+		} else if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+			end = true
+		}
+		f.appendMessage(line, end)
+		consumed += len(line)
+		if end {
+			f.batch = append(f.batch, f.end...)
+			f.midLine = false
+			consumed++
+		}
+	}
+	return consumed
+}
+
+// appendMessage escapes data, the next part of the current line, into
+// f.batch, holding back the start of a character at its end unless end is
+// set.
+func (f *recordFormatter) appendMessage(data []byte, end bool) {
+	if len(f.partial) > 0 {
+		// Complete the held character from the start of data. Three more
+		// bytes are enough to tell whether it's valid.
+		held := len(f.partial)
+		take := len(data)
+		if take > utf8.UTFMax-1 {
+			take = utf8.UTFMax - 1
+		}
+		f.partial = append(f.partial, data[:take]...)
+		var n int
+		f.batch, n = appendJSONRunes(f.batch, f.partial, end && take == len(data))
+		if n < held {
+			// All of data was taken, and is still held.
+			f.partial = append(f.partial[:0], f.partial[n:]...)
+			return
+		}
+		f.partial = f.partial[:0]
+		data = data[n-held:]
+	}
+	var n int
+	f.batch, n = appendJSONRunes(f.batch, data, end)
+	f.partial = append(f.partial, data[n:]...)
+}
+
+// appendJSONString appends data escaped for a JSON string, with invalid
+// UTF-8 written as U+FFFD.
+func appendJSONString(out, data []byte, end bool) []byte {
+	out, _ = appendJSONRunes(out, data, end)
+	return out
+}
+
+// appendJSONRunes appends data escaped for a JSON string and returns the
+// number of bytes of data escaped, which is less than len(data) if end
+// isn't set and data ends with the start of a character.
+func appendJSONRunes(out, data []byte, end bool) ([]byte, int) {
+	start := 0
+	i := 0
+	for i < len(data) {
+		b := data[i]
+		if b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i++
+				continue
+			}
+			out = append(out, data[start:i]...)
+			switch b {
+			case '"', '\\':
+				out = append(out, '\\', b)
+			case '\n':
+				out = append(out, '\\', 'n')
+			case '\r':
+				out = append(out, '\\', 'r')
+			case '\t':
+				out = append(out, '\\', 't')
+			default:
+				out = append(out, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		if !end && !utf8.FullRune(data[i:]) {
+			break
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			out = append(out, data[start:i]...)
+			out = append(out, `\ufffd`...)
+		case r == '\u2028' || r == '\u2029':
+			// Valid JSON, but not valid JavaScript.
+			out = append(out, data[start:i]...)
+			out = append(out, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+		default:
+			i += size
+			continue
+		}
+		i += size
+		start = i
+	}
+	return append(out, data[start:i]...), i
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type jsonFormatSuite struct {
+	restore func()
+}
+
+var _ = Suite(&jsonFormatSuite{})
+
+func (s *jsonFormatSuite) SetUpTest(c *C) {
+	s.restore = servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+}
+
+func (s *jsonFormatSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+const jsonInput = "first\n" +
+	"say \"hi\" to C:\\ and [test] ] \n" +
+	"\ttabs\r\n" +
+	"\x00\x01\x1f\x7f\n" +
+	"\n" +
+	"caf\xc3\xa9 \xe2\x82\xac \xf0\x9f\x98\x80\n" +
+	"bad \xff \xc3( \xe2\x82 \xed\xa0\x80 end\xc3\n" +
+	"separators \xe2\x80\xa8\xe2\x80\xa9\n" +
+	"last"
+
+const jsonOutput = `{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"first"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"say \"hi\" to C:\\ and [test] ] "}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"\ttabs\r"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"\u0000\u0001\u001f` + "\x7f" + `"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":""}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"café € 😀"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"bad \ufffd \ufffd( \ufffd\ufffd \ufffd\ufffd\ufffd end\ufffd"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"separators \u2028\u2029"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"last","incomplete":true}
+`
+
+type jsonLine struct {
+	Time       string `json:"time"`
+	Service    string `json:"service"`
+	Message    string `json:"message"`
+	Incomplete bool   `json:"incomplete"`
+}
+
+func (s *jsonFormatSuite) TestFormat(c *C) {
+	for _, size := range []int{1, 2, 3, 7, len(jsonInput)} {
+		b := &bytes.Buffer{}
+		w := servicelog.NewJSONFormatWriter(b, "test")
+		for p := jsonInput; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			written, err := io.WriteString(w, p[:n])
+			c.Assert(err, IsNil)
+			c.Assert(written, Equals, n)
+			p = p[n:]
+		}
+		c.Assert(w.(io.Closer).Close(), IsNil)
+		c.Check(b.String(), Equals, jsonOutput, Commentf("writes of %d bytes", size))
+	}
+}
+
+func (s *jsonFormatSuite) TestDecode(c *C) {
+	b := &bytes.Buffer{}
+	w := servicelog.NewJSONFormatWriter(b, `odd "name"`)
+	_, err := io.WriteString(w, jsonInput)
+	c.Assert(err, IsNil)
+	c.Assert(w.(io.Closer).Close(), IsNil)
+
+	// Each line is an object with the line as its message, with each
+	// byte of invalid UTF-8 replaced.
+	inputLines := strings.Split(jsonInput, "\n")
+	scanner := bufio.NewScanner(b)
+	i := 0
+	for ; scanner.Scan(); i++ {
+		var line jsonLine
+		c.Assert(json.Unmarshal(scanner.Bytes(), &line), IsNil, Commentf("line %d: %q", i, scanner.Text()))
+		c.Check(line.Time, Equals, "2021-05-13T03:16:51.001Z")
+		c.Check(line.Service, Equals, `odd "name"`)
+		c.Check(line.Message, Equals, string([]rune(inputLines[i])))
+		c.Check(line.Incomplete, Equals, i == len(inputLines)-1)
+	}
+	c.Assert(scanner.Err(), IsNil)
+	c.Check(i, Equals, len(inputLines))
+}
+
+func (s *jsonFormatSuite) TestRunesByteAtATime(c *C) {
+	b := &bytes.Buffer{}
+	w := servicelog.NewJSONFormatWriter(b, "test")
+
+	// Whatever the writes characters come in, the output is valid UTF-8
+	// after each, and each object written is valid JSON.
+	input := "caf\xc3\xa9 \xe2\x82\xac\n\xf0\x9f\x98\x80 first\nlast \xf0\x9f\x98\x80\xf0\x9f"
+	for i := 0; i < len(input); i++ {
+		n, err := w.Write([]byte{input[i]})
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 1)
+		c.Assert(utf8.Valid(b.Bytes()), Equals, true, Commentf("byte %d: %q", i, b.String()))
+	}
+	c.Assert(w.(io.Closer).Close(), IsNil)
+
+	var messages []string
+	scanner := bufio.NewScanner(b)
+	for scanner.Scan() {
+		var line jsonLine
+		c.Assert(json.Unmarshal(scanner.Bytes(), &line), IsNil, Commentf("%q", scanner.Text()))
+		messages = append(messages, line.Message)
+	}
+	c.Check(messages, DeepEquals, []string{"café €", "\U0001F600 first", "last \U0001F600\ufffd\ufffd"})
+}
+
+func (s *jsonFormatSuite) TestChunking(c *C) {
+	newWriter := func(dest io.Writer) io.Writer {
+		return servicelog.NewJSONFormatWriter(dest, "test")
+	}
+	inputs := append([]string{jsonInput}, chunkingInputs...)
+	for seed := int64(0); seed < 10; seed++ {
+		err := checkChunking(newWriter, inputs, seed, 20)
+		c.Assert(err, IsNil, Commentf("seed %d", seed))
+	}
+}
+
+func (s *jsonFormatSuite) TestClose(c *C) {
+	b := &bytes.Buffer{}
+	w := servicelog.NewJSONFormatWriter(b, "test")
+	closer := w.(io.Closer)
+
+	// Closing at the end of a line writes nothing.
+	_, err := io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+	c.Assert(closer.Close(), IsNil)
+	c.Check(b.String(), Equals, `{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"first"}`+"\n")
+
+	// An incomplete line is ended, including a character held back in
+	// case the rest of it was still to come, and what's written
+	// afterwards starts a line of its own.
+	b.Reset()
+	_, err = io.WriteString(w, "second \xe2\x82")
+	c.Assert(err, IsNil)
+	c.Assert(closer.Close(), IsNil)
+	c.Assert(closer.Close(), IsNil)
+	_, err = io.WriteString(w, "\xacthird\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, `
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"second \ufffd\ufffd","incomplete":true}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"\ufffdthird"}
+`[1:])
+}
+
+func (s *jsonFormatSuite) TestWriteError(c *C) {
+	errFull := errors.New("full")
+	dest := servicelogtest.NewScriptedWriter(
+		servicelogtest.ShortWrite(20),
+		servicelogtest.Fail(errFull),
+	)
+	w := servicelog.NewJSONFormatWriter(dest, "test")
+
+	// The input of a batch that fails is taken, and the output that
+	// wasn't written is written before anything else.
+	n, err := io.WriteString(w, "first\nsecond")
+	c.Check(n, Equals, 12)
+	c.Assert(err, ErrorMatches, `cannot write logs for service "test" \(format\): full`)
+	c.Check(errors.Is(err, errFull), Equals, true)
+	c.Check(dest.String(), HasLen, 20)
+
+	n, err = io.WriteString(w, " line\n")
+	c.Check(n, Equals, 6)
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, `
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"first"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"second line"}
+`[1:])
+}
+
+func (s *jsonFormatSuite) TestAllocations(c *C) {
+	w := servicelog.NewJSONFormatWriter(ioutil.Discard, "test")
+	line := []byte("a line with \"quotes\", \ttabs and caf\xc3\xa9 \xe2\x82")
+	rest := []byte("\xac end\n")
+	_, err := w.Write(line)
+	c.Assert(err, IsNil)
+	allocs := testing.AllocsPerRun(100, func() {
+		w.Write(line)
+		w.Write(rest)
+	})
+	c.Check(allocs, Equals, 0.0)
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type labelsSuite struct{}
+
+var _ = Suite(&labelsSuite{})
+
+func (s *labelsSuite) TestProfileLabels(c *C) {
+	var profile bytes.Buffer
+	err := pprof.StartCPUProfile(&profile)
+	if err != nil {
+		c.Skip(fmt.Sprintf("cannot start CPU profile: %v", err))
+	}
+
+	// Hammer two pipelines from goroutines started with their labels, as
+	// servstate starts the goroutines writing each service's output.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, service := range []string{"svc1", "svc2"} {
+		service := service
+		wg.Add(1)
+		servicelog.WithLabels(service, servicelog.StageFormat, func() {
+			go func() {
+				defer wg.Done()
+				rb := servicelog.NewRingBuffer(64 * 1024)
+				defer rb.Close()
+				w := newFormatWriter(rb, service)
+				line := []byte("the quick brown fox jumps over the lazy dog\n")
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					for i := 0; i < 100; i++ {
+						w.Write(line)
+					}
+				}
+			}()
+		})
+	}
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	pprof.StopCPUProfile()
+
+	labels, err := profileLabels(profile.Bytes())
+	c.Assert(err, IsNil)
+	c.Check(labels["service=svc1,stage=format"] > 0, Equals, true, Commentf("labels: %v", labels))
+	c.Check(labels["service=svc2,stage=format"] > 0, Equals, true, Commentf("labels: %v", labels))
+}
+
+// profileLabels decodes a gzipped pprof profile and returns the number of
+// samples with each set of labels, formatted as "key=value,...".
+func profileLabels(data []byte) (map[string]int, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	data, err = ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Profile messages have samples in field 2 and the string table in
+	// field 6. Each sample has its labels in field 3, and each label has
+	// the key and value string indexes in fields 1 and 2.
+	var strs []string
+	var samples [][]byte
+	err = protoFields(data, func(field int, _ uint64, contents []byte) error {
+		switch field {
+		case 2:
+			samples = append(samples, contents)
+		case 6:
+			strs = append(strs, string(contents))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	str := func(i uint64) string {
+		if i < uint64(len(strs)) {
+			return strs[i]
+		}
+		return ""
+	}
+	counts := make(map[string]int)
+	for _, sample := range samples {
+		var labels []string
+		err := protoFields(sample, func(field int, _ uint64, label []byte) error {
+			if field != 3 {
+				return nil
+			}
+			var key, value uint64
+			err := protoFields(label, func(field int, v uint64, _ []byte) error {
+				switch field {
+				case 1:
+					key = v
+				case 2:
+					value = v
+				}
+				return nil
+			})
+			labels = append(labels, str(key)+"="+str(value))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(labels)
+		counts[strings.Join(labels, ",")]++
+	}
+	return counts, nil
+}
+
+// protoFields calls f for each field of a protobuf message, with the
+// value of varint fields or the contents of length-delimited ones.
+func protoFields(data []byte, f func(field int, value uint64, contents []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint in field %d", field)
+			}
+			data = data[n:]
+			if err := f(field, value, nil); err != nil {
+				return err
+			}
+		case 1:
+			if len(data) < 8 {
+				return fmt.Errorf("short fixed64 in field %d", field)
+			}
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return fmt.Errorf("invalid length in field %d", field)
+			}
+			if err := f(field, 0, data[n:n+int(length)]); err != nil {
+				return err
+			}
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return fmt.Errorf("short fixed32 in field %d", field)
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type in field %d", field)
+		}
+	}
+	return nil
+}
+
+// BenchmarkWithLabels measures the cost of starting a goroutine with the
+// pipeline labels, which servstate pays once per service start (writes
+// have no added cost). On a single-core amd64 VM:
+//
+//	WithLabels/plain     426 ns/op     16 B/op    1 allocs/op
+//	WithLabels/labels    544 ns/op    152 B/op    4 allocs/op
+func BenchmarkWithLabels(b *testing.B) {
+	done := make(chan struct{})
+	b.Run("plain", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			go func() { done <- struct{}{} }()
+			<-done
+		}
+	})
+	b.Run("labels", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			servicelog.WithLabels("service", servicelog.StageFormat, func() {
+				go func() { done <- struct{}{} }()
+			})
+			<-done
+		}
+	})
+}
@@ -24,22 +24,35 @@ import (
 // Timestamp must match format in logger.timestampFormat.
 var timestampServiceRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z \[[^]]+\] `)
 
+// Matches the lines written by WriteEvent.
+var eventRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}Z \[` + PebbleName + `\] `)
+
 // LastLines fetches the last n lines of output and, if stripPrefix is true,
 // strips the timestamp and service name prefix from each line. If there are
-// more than n lines, the result is prefixed with a "(...)" line.
+// more than n lines, the result is prefixed with a "(...)" line. Lines
+// written by WriteEvent aren't output, and are left out.
 func LastLines(logBuffer *RingBuffer, n int, indent string, stripPrefix bool) (string, error) {
-	it := logBuffer.HeadIterator(n + 1)
+	// The whole buffer is read, as it's not known how many of the last
+	// lines are events.
+	it := logBuffer.TailIterator()
 	defer it.Close()
 	logBytes, err := ioutil.ReadAll(it)
 	if err != nil {
 		return "", err
 	}
 
+	var lines []string
+	for _, line := range strings.Split(string(logBytes), "\n") {
+		if !eventRegexp.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
 	// Indent lines
-	trimmed := strings.TrimSpace(string(logBytes))
-	lines := strings.Split(trimmed, "\n")
+	trimmed := strings.TrimSpace(strings.Join(lines, "\n"))
+	lines = strings.Split(trimmed, "\n")
 	if len(lines) > n {
 		// Prefix with truncation marker if too many lines
+		lines = lines[len(lines)-n-1:]
 		lines[0] = "(...)"
 	}
 	for i, line := range lines {
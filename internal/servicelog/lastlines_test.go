@@ -61,3 +61,17 @@ func (s *lastLinesSuite) TestLastLinesStripPrefix(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(lines, Equals, "foo\nbar\nlog msg")
 }
+
+func (s *lastLinesSuite) TestLastLinesSkipsEvents(c *C) {
+	buffer := servicelog.NewRingBuffer(1024)
+	defer buffer.Close()
+
+	c.Assert(servicelog.WriteEvent(buffer, "started"), IsNil)
+	for i := 1; i <= 3; i++ {
+		fmt.Fprintf(buffer, "2000-01-01T00:00:00.000Z [svc] line %d\n", i)
+	}
+	c.Assert(servicelog.WriteEvent(buffer, "exited"), IsNil)
+	lines, err := servicelog.LastLines(buffer, 2, "", true)
+	c.Assert(err, IsNil)
+	c.Assert(lines, Equals, "(...)\nline 2\nline 3")
+}
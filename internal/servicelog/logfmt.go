@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// NewLogfmtFormatWriter returns an io.Writer that writes every line in the
+// stream as a logfmt record, with the time the line started, the service
+// name and the line without its newline.
+// For the input:
+//
+//	first line here\n
+//	key=value\n
+//
+// The expected output is:
+//
+//	ts=2021-05-13T03:16:51.001Z service=test msg="first line here"\n
+//	ts=2021-05-13T03:16:52.002Z service=test msg="key=value"\n
+//
+// The message is always quoted, so that lines can be written as they are
+// by NewJSONFormatWriter, without accumulating them, and is escaped the
+// same way. A line that's incomplete when the writer is closed is ended
+// with incomplete=true.
+func NewLogfmtFormatWriter(dest io.Writer, serviceName string) io.Writer {
+	service := append([]byte(" service="), appendLogfmtValue(nil, serviceName)...)
+	fields := append(service[:len(service):len(service)], ` msg="`...)
+	levelFields := make([][]byte, len(levelNames))
+	for level := LevelTrace; level <= LevelFatal; level++ {
+		levelFields[level] = append(service[:len(service):len(service)], " level="+level.String()+` msg="`...)
+	}
+	return &recordFormatter{
+		serviceName: serviceName,
+		dest:        dest,
+		start:       []byte("ts="),
+		fields:      fields,
+		levelFields: levelFields,
+		end:         []byte("\"\n"),
+		incomplete:  []byte("\" incomplete=true\n"),
+	}
+}
+
+// appendLogfmtValue appends value as a logfmt value, quoted if it's empty
+// or has spaces, quotes, equals signs, or characters that need escaping.
+func appendLogfmtValue(out []byte, value string) []byte {
+	plain := value != "" && utf8.ValidString(value)
+	for i := 0; plain && i < len(value); i++ {
+		b := value[i]
+		plain = b > ' ' && b != '"' && b != '=' && b != '\\' && b != 0x7f
+	}
+	if plain {
+		return append(out, value...)
+	}
+	out = append(out, '"')
+	out = appendJSONString(out, []byte(value), true)
+	return append(out, '"')
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type logfmtSuite struct {
+	restore func()
+}
+
+var _ = Suite(&logfmtSuite{})
+
+func (s *logfmtSuite) SetUpTest(c *C) {
+	s.restore = servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+}
+
+func (s *logfmtSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+const logfmtOutput = `ts=2021-05-13T03:16:51.001Z service=test msg="first"
+ts=2021-05-13T03:16:51.001Z service=test msg="say \"hi\" to C:\\ and [test] ] "
+ts=2021-05-13T03:16:51.001Z service=test msg="\ttabs\r"
+ts=2021-05-13T03:16:51.001Z service=test msg="\u0000\u0001\u001f` + "\x7f" + `"
+ts=2021-05-13T03:16:51.001Z service=test msg=""
+ts=2021-05-13T03:16:51.001Z service=test msg="café € 😀"
+ts=2021-05-13T03:16:51.001Z service=test msg="bad \ufffd \ufffd( \ufffd\ufffd \ufffd\ufffd\ufffd end\ufffd"
+ts=2021-05-13T03:16:51.001Z service=test msg="separators \u2028\u2029"
+ts=2021-05-13T03:16:51.001Z service=test msg="last" incomplete=true
+`
+
+func (s *logfmtSuite) TestFormat(c *C) {
+	for _, size := range []int{1, 2, 3, 7, len(jsonInput)} {
+		b := &bytes.Buffer{}
+		w := servicelog.NewLogfmtFormatWriter(b, "test")
+		for p := jsonInput; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			written, err := io.WriteString(w, p[:n])
+			c.Assert(err, IsNil)
+			c.Assert(written, Equals, n)
+			p = p[n:]
+		}
+		c.Assert(w.(io.Closer).Close(), IsNil)
+		c.Check(b.String(), Equals, logfmtOutput, Commentf("writes of %d bytes", size))
+	}
+}
+
+func (s *logfmtSuite) TestUnquote(c *C) {
+	b := &bytes.Buffer{}
+	w := servicelog.NewLogfmtFormatWriter(b, "test")
+	input := "key=value\nspaces and \"quotes\"\n\\n isn't a newline\n"
+	_, err := io.WriteString(w, input)
+	c.Assert(err, IsNil)
+
+	// The quoted messages are the lines.
+	const prefix = "ts=2021-05-13T03:16:51.001Z service=test msg="
+	output := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	lines := strings.Split(strings.TrimSuffix(input, "\n"), "\n")
+	c.Assert(output, HasLen, len(lines))
+	for i, line := range output {
+		c.Assert(strings.HasPrefix(line, prefix), Equals, true, Commentf("line %q", line))
+		msg, err := strconv.Unquote(strings.TrimPrefix(line, prefix))
+		c.Assert(err, IsNil, Commentf("line %q", line))
+		c.Check(msg, Equals, lines[i])
+	}
+}
+
+func (s *logfmtSuite) TestServiceName(c *C) {
+	for _, test := range []struct {
+		name   string
+		output string
+	}{
+		{"web-1.2_x", `service=web-1.2_x`},
+		{"", `service=""`},
+		{"my service", `service="my service"`},
+		{"a=b", `service="a=b"`},
+		{`say "hi"`, `service="say \"hi\""`},
+		{"caf\xc3\xa9", "service=caf\xc3\xa9"},
+		{"bad\xff", `service="bad\ufffd"`},
+	} {
+		b := &bytes.Buffer{}
+		w := servicelog.NewLogfmtFormatWriter(b, test.name)
+		_, err := io.WriteString(w, "x\n")
+		c.Assert(err, IsNil)
+		c.Check(b.String(), Equals, "ts=2021-05-13T03:16:51.001Z "+test.output+` msg="x"`+"\n", Commentf("name %q", test.name))
+	}
+}
+
+func (s *logfmtSuite) TestChunking(c *C) {
+	newWriter := func(dest io.Writer) io.Writer {
+		return servicelog.NewLogfmtFormatWriter(dest, "test")
+	}
+	inputs := append([]string{jsonInput}, chunkingInputs...)
+	for seed := int64(0); seed < 10; seed++ {
+		err := checkChunking(newWriter, inputs, seed, 20)
+		c.Assert(err, IsNil, Commentf("seed %d", seed))
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// LongLineMode is what NewFormatWriterWithMaxLine does with lines longer
+// than the maximum.
+type LongLineMode int
+
+const (
+	// TruncateLongLines drops the end of a long line, and ends it with a
+	// marker saying how many bytes were dropped, as in
+	// "... (truncated 1048576 bytes)".
+	TruncateLongLines LongLineMode = iota
+	// SplitLongLines splits a long line into lines of the maximum length,
+	// each with the usual prefix.
+	SplitLongLines
+)
+
+// maxLineWriter limits the length of the lines it passes to the formatter
+// it writes to.
+type maxLineWriter struct {
+	mu   sync.Mutex
+	dest *formatter
+	max  int
+	mode LongLineMode
+	// lineLen is the length of the current line passed on, and truncated
+	// the number of bytes dropped from its end, if it's being truncated.
+	lineLen    int
+	truncating bool
+	truncated  int64
+	// held is an incomplete rune at the end of the last write, held back
+	// so that a line isn't cut in the middle of it, and scratch is where
+	// it's joined to the next write.
+	held    []byte
+	scratch []byte
+}
+
+// NewFormatWriterWithMaxLine is like NewFormatWriter, but limits the lines
+// of the service's output to max bytes, not counting the prefix and the
+// newline, truncating or splitting longer lines as given by mode. Lines
+// are only cut between runes, so a cut line may be up to 3 bytes shorter
+// than max. An incomplete UTF-8 sequence at the end of a write is held
+// back until the next write, to see where the rune ends. The options apply
+// to the formatter the lines are passed to, as for NewFormatWriter.
+func NewFormatWriterWithMaxLine(dest io.Writer, serviceName string, max int, mode LongLineMode, opts ...FormatOption) (io.Writer, error) {
+	if max < utf8.UTFMax {
+		return nil, fmt.Errorf("maximum line length must be at least %d bytes", utf8.UTFMax)
+	}
+	if mode != TruncateLongLines && mode != SplitLongLines {
+		return nil, fmt.Errorf("invalid long line mode %d", mode)
+	}
+	f, err := newFormatter(dest, serviceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &maxLineWriter{
+		dest: f,
+		max:  max,
+		mode: mode,
+	}, nil
+}
+
+func (w *maxLineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			chunk = p[:i+1]
+		}
+		n, err := w.writeChunk(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeChunk passes on the rest of the current line, or part of it, in
+// chunk, and returns the number of bytes of chunk written or dropped.
+func (w *maxLineWriter) writeChunk(chunk []byte) (int, error) {
+	line := chunk
+	held := len(w.held)
+	if held > 0 {
+		w.scratch = append(append(w.scratch[:0], w.held...), chunk...)
+		line = w.scratch
+		w.held = w.held[:0]
+	}
+	end := line[len(line)-1] == '\n'
+	body := len(line)
+	if end {
+		body--
+	}
+	// written returns the number of bytes of chunk in the first n bytes of
+	// line, as the bytes held back were reported written already.
+	written := func(n int) int {
+		if n < held {
+			return 0
+		}
+		return n - held
+	}
+
+	for pos := 0; ; {
+		if w.truncating {
+			w.truncated += int64(body - pos)
+			if end {
+				if err := w.endTruncated(true); err != nil {
+					return len(chunk) - 1, err
+				}
+			}
+			return len(chunk), nil
+		}
+
+		rest := line[pos:]
+		room := w.max - w.lineLen
+		if body-pos <= room {
+			if !end {
+				// An incomplete rune might not fit once it's complete.
+				if tail := incompleteRune(rest); tail > 0 {
+					w.held = append(w.held, rest[len(rest)-tail:]...)
+					rest = rest[:len(rest)-tail]
+				}
+			}
+			n, err := w.pass(rest)
+			if err != nil {
+				return written(pos + n), err
+			}
+			return len(chunk), nil
+		}
+
+		cut := runeCut(rest, room)
+		n, err := w.pass(rest[:cut])
+		pos += n
+		if err != nil {
+			return written(pos), err
+		}
+		if w.mode == TruncateLongLines {
+			w.truncating = true
+			w.truncated = 0
+			continue
+		}
+		if _, err := w.dest.Write([]byte{'\n'}); err != nil {
+			return written(pos), err
+		}
+		w.lineLen = 0
+	}
+}
+
+// pass writes p, part of a line, to the formatter.
+func (w *maxLineWriter) pass(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := w.dest.Write(p)
+	if n == len(p) && p[n-1] == '\n' {
+		w.lineLen = 0
+	} else {
+		w.lineLen += n
+	}
+	return n, err
+}
+
+// endTruncated ends a truncated line with the marker saying how many bytes
+// were dropped, and a newline if newline is set.
+func (w *maxLineWriter) endTruncated(newline bool) error {
+	marker := strconv.AppendInt([]byte("... (truncated "), w.truncated, 10)
+	marker = append(marker, " bytes)"...)
+	if newline {
+		marker = append(marker, '\n')
+	}
+	if _, err := writeFull(w.dest, marker); err != nil {
+		return err
+	}
+	w.truncating = false
+	w.lineLen = 0
+	return nil
+}
+
+// incompleteRune returns the length of the incomplete UTF-8 sequence at the
+// end of p, if there is one.
+func incompleteRune(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if p[i] >= utf8.RuneSelf && !utf8.FullRune(p[i:]) {
+				return len(p) - i
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// runeCut returns where to cut p to keep at most max bytes of it, before
+// the rune straddling max, unless the bytes there aren't valid UTF-8.
+func runeCut(p []byte, max int) int {
+	for cut := max; cut >= 0 && cut > max-utf8.UTFMax; cut-- {
+		if utf8.RuneStart(p[cut]) {
+			return cut
+		}
+	}
+	return max
+}
+
+// Close passes on any incomplete rune held back, ends a truncated line
+// with its marker, and closes the formatter so that it ends an incomplete
+// line. It doesn't close dest.
+func (w *maxLineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.held) > 0 {
+		held := w.held
+		w.held = nil
+		if _, err := w.pass(held); err != nil {
+			return err
+		}
+	}
+	if w.truncating {
+		if err := w.endTruncated(false); err != nil {
+			return err
+		}
+	}
+	w.lineLen = 0
+	return w.dest.Close()
+}
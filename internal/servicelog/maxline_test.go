@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type maxLineSuite struct {
+	restore func()
+}
+
+var _ = Suite(&maxLineSuite{})
+
+func (s *maxLineSuite) SetUpTest(c *C) {
+	s.restore = servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+}
+
+func (s *maxLineSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// writeSized writes input to w in writes of size bytes, and closes it.
+func writeSized(c *C, w io.Writer, input string, size int) {
+	for p := input; len(p) > 0; {
+		n := size
+		if n > len(p) {
+			n = len(p)
+		}
+		written, err := io.WriteString(w, p[:n])
+		c.Assert(err, IsNil)
+		c.Assert(written, Equals, n)
+		p = p[n:]
+	}
+	c.Assert(w.(io.Closer).Close(), IsNil)
+}
+
+func (s *maxLineSuite) TestNew(c *C) {
+	_, err := servicelog.NewFormatWriterWithMaxLine(&bytes.Buffer{}, "test", 3, servicelog.TruncateLongLines)
+	c.Check(err, ErrorMatches, "maximum line length must be at least 4 bytes")
+	_, err = servicelog.NewFormatWriterWithMaxLine(&bytes.Buffer{}, "test", 80, 7)
+	c.Check(err, ErrorMatches, "invalid long line mode 7")
+}
+
+const maxLineInput = "12345678\n123456789\n1234567é\nshort\n"
+
+func (s *maxLineSuite) TestTruncate(c *C) {
+	// A line at the limit is passed on whole, and one a byte over is
+	// truncated. A rune straddling the limit is dropped whole, wherever
+	// the writes split it.
+	for _, size := range []int{1, 2, 7, len(maxLineInput)} {
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewFormatWriterWithMaxLine(b, "test", 8, servicelog.TruncateLongLines)
+		c.Assert(err, IsNil)
+		writeSized(c, w, maxLineInput, size)
+		c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] 12345678
+2021-05-13T03:16:51.001Z [test] 12345678... (truncated 1 bytes)
+2021-05-13T03:16:51.001Z [test] 1234567... (truncated 2 bytes)
+2021-05-13T03:16:51.001Z [test] short
+`[1:], Commentf("writes of %d bytes", size))
+	}
+}
+
+func (s *maxLineSuite) TestTruncateCount(c *C) {
+	// The count is of the bytes dropped across all the writes.
+	for _, size := range []int{1, 1000, 1 << 20} {
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewFormatWriterWithMaxLine(b, "test", 1024, servicelog.TruncateLongLines)
+		c.Assert(err, IsNil)
+		writeSized(c, w, strings.Repeat("x", 1<<20+1024)+"\nnext\nincomplete line", size)
+		c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] "+strings.Repeat("x", 1024)+"... (truncated 1048576 bytes)\n"+
+			"2021-05-13T03:16:51.001Z [test] next\n"+
+			"2021-05-13T03:16:51.001Z [test] incomplete line"+servicelog.IncompleteLineMarker+"\n", Commentf("writes of %d bytes", size))
+	}
+}
+
+func (s *maxLineSuite) TestTruncateIncomplete(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriterWithMaxLine(b, "test", 8, servicelog.TruncateLongLines)
+	c.Assert(err, IsNil)
+	writeSized(c, w, "123456789", 9)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] 12345678... (truncated 1 bytes)"+servicelog.IncompleteLineMarker+"\n")
+}
+
+func (s *maxLineSuite) TestSplit(c *C) {
+	for _, size := range []int{1, 2, 7, len(maxLineInput)} {
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewFormatWriterWithMaxLine(b, "test", 8, servicelog.SplitLongLines)
+		c.Assert(err, IsNil)
+		writeSized(c, w, maxLineInput+"1234567890123456789", size)
+		c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] 12345678
+2021-05-13T03:16:51.001Z [test] 12345678
+2021-05-13T03:16:51.001Z [test] 9
+2021-05-13T03:16:51.001Z [test] 1234567
+2021-05-13T03:16:51.001Z [test] é
+2021-05-13T03:16:51.001Z [test] short
+2021-05-13T03:16:51.001Z [test] 12345678
+2021-05-13T03:16:51.001Z [test] 90123456
+2021-05-13T03:16:51.001Z [test] 789 [incomplete line]
+`[1:], Commentf("writes of %d bytes", size))
+	}
+}
+
+func (s *maxLineSuite) TestChunking(c *C) {
+	inputs := append(chunkingInputs, maxLineInput, strings.Repeat("ünïcödé ", 2000)+"\n")
+	for _, mode := range []servicelog.LongLineMode{servicelog.TruncateLongLines, servicelog.SplitLongLines} {
+		newWriter := func(dest io.Writer) io.Writer {
+			w, err := servicelog.NewFormatWriterWithMaxLine(dest, "test", 100, mode)
+			c.Assert(err, IsNil)
+			return w
+		}
+		for seed := int64(0); seed < 5; seed++ {
+			err := checkChunking(newWriter, inputs, seed, 10)
+			c.Assert(err, IsNil, Commentf("mode %d, seed %d", mode, seed))
+		}
+	}
+}
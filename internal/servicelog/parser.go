@@ -39,6 +39,12 @@ type Entry struct {
 	Time    time.Time
 	Service string
 	Message string
+	// Seq is the sequence number of the entry's line in the service's log
+	// buffer, if it's known: the buffer's first line is numbered 1, and
+	// each line after it one more than the line before, so a gap in the
+	// numbers of the entries read is the number of lines missed. The parts
+	// of a line too long to parse in one go have the same number.
+	Seq int64
 }
 
 // Parser parses and iterates over logs from a Reader until EOF (or another
@@ -48,14 +54,29 @@ type Parser struct {
 	br    *bufio.Reader
 	entry Entry
 	err   error
+
+	// it is the reader if it's a buffer's iterator, which gives the lines
+	// read their sequence numbers. offset counts the bytes parsed, and seq
+	// is the sequence number of the line at offset, or zero if it's not
+	// known.
+	it     *iterator
+	offset int64
+	seq    int64
 }
 
-// NewParser creates a Parser with the given buffer size.
+// NewParser creates a Parser with the given buffer size. If r is an
+// Iterator of a RingBuffer, which mustn't have been read from yet, the
+// entries parsed have their sequence numbers.
 func NewParser(r io.Reader, size int) *Parser {
-	return &Parser{
+	p := &Parser{
 		r:  r,
 		br: bufio.NewReaderSize(r, size),
 	}
+	if it, ok := r.(*iterator); ok {
+		it.seqs = true
+		p.it = it
+	}
+	return p
 }
 
 // Next parses the next log from the reader and reports whether another log
@@ -76,8 +97,10 @@ func (p *Parser) Next() bool {
 		// If EOF reached, stop iterating after processing line.
 		eof = errors.Is(err, io.EOF)
 
+		seq := p.lineSeq(line)
 		entry, err := Parse(line)
 		if err == nil {
+			entry.Seq = seq
 			p.entry = entry
 			if entry.Message == "" {
 				// FormatWriter has only written "timestamp [service]" and not
@@ -93,12 +116,48 @@ func (p *Parser) Next() bool {
 			// Partial log line due to long line or "(... output truncated ...)",
 			// use timestamp and service from previous entry.
 			p.entry.Message = string(line)
+			p.entry.Seq = seq
 			return true
 		}
 	}
 	return false
 }
 
+// lineSeq returns the sequence number of line, the next one parsed, and
+// moves past it, following the iterator's jumps in the sequence: those at
+// the start of the line apply to it, and those within it to what follows.
+func (p *Parser) lineSeq(line []byte) int64 {
+	if p.it == nil {
+		return 0
+	}
+	start := p.offset
+	end := start + int64(len(line))
+	for len(p.it.jumps) > 0 && p.it.jumps[0].offset <= start {
+		p.seq = p.it.jumps[0].seq
+		p.it.jumps = p.it.jumps[1:]
+	}
+	seq := p.seq
+	from := start
+	for len(p.it.jumps) > 0 && p.it.jumps[0].offset < end {
+		jump := p.it.jumps[0]
+		p.it.jumps = p.it.jumps[1:]
+		p.countLines(line[from-start : jump.offset-start])
+		p.seq = jump.seq
+		from = jump.offset
+	}
+	p.countLines(line[from-start:])
+	p.offset = end
+	return seq
+}
+
+// countLines moves the sequence number on past the lines ended in b, if
+// it's known.
+func (p *Parser) countLines(b []byte) {
+	if p.seq > 0 {
+		p.seq += int64(bytes.Count(b, []byte{'\n'}))
+	}
+}
+
 // Entry returns the current log entry (should only be called after Next
 // returns true).
 func (p *Parser) Entry() Entry {
@@ -126,5 +185,5 @@ func Parse(line []byte) (Entry, error) {
 	}
 	service := string(fields[1][1 : len(fields[1])-1]) // Trim [ and ] from "[service]"
 	message := string(fields[2])
-	return Entry{timestamp, service, message}, nil
+	return Entry{Time: timestamp, Service: service, Message: message}, nil
 }
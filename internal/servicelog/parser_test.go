@@ -65,6 +65,7 @@ func checkEntry(c *C, got, expected servicelog.Entry) {
 		Commentf("expected timestamp %v, got %v", expected.Time, got.Time))
 	c.Check(got.Service, Equals, expected.Service)
 	c.Check(got.Message, Equals, expected.Message)
+	c.Check(got.Seq, Equals, expected.Seq)
 }
 
 func (s *parserSuite) TestParser(c *C) {
@@ -153,7 +154,7 @@ func (s *parserSuite) TestRoundTrip(c *C) {
 	start := time.Now().UTC()
 	time.Sleep(10 * time.Millisecond) // to ensure that log timestamps are strictly after start
 	buf := &bytes.Buffer{}
-	fw := servicelog.NewFormatWriter(buf, "svc")
+	fw := newFormatWriter(buf, "svc")
 	for i := 0; i < 10; i++ {
 		fmt.Fprintf(fw, "message %d\n", i)
 	}
@@ -192,3 +193,88 @@ func (s *parserSuite) TestNewDataAfterEOF(c *C) {
 	c.Check(parser.Next(), Equals, false)
 	c.Check(parser.Err(), IsNil)
 }
+
+// parseAll parses the entries available from parser.
+func parseAll(parser *servicelog.Parser) []servicelog.Entry {
+	var entries []servicelog.Entry
+	for parser.Next() {
+		entries = append(entries, parser.Entry())
+	}
+	return entries
+}
+
+func (s *parserSuite) TestSeq(c *C) {
+	now := func() time.Time { return time.Date(2021, 5, 13, 3, 16, 51, 0, time.UTC) }
+	rb := servicelog.NewRingBuffer(200)
+	fw, err := servicelog.NewFormatWriter(rb, "svc", servicelog.WithClock(now))
+	c.Assert(err, IsNil)
+	for i := 1; i <= 3; i++ {
+		fmt.Fprintf(fw, "line %d\n", i)
+	}
+	it := rb.TailIterator()
+	defer it.Close()
+	parser := servicelog.NewParser(it, 1024)
+	entries := parseAll(parser)
+	c.Assert(entries, HasLen, 3)
+	for i, entry := range entries {
+		c.Check(entry.Seq, Equals, int64(i+1))
+	}
+
+	// Lapping the reader loses lines, and the numbers of those read after
+	// the truncation text skip as many. The first may be the end of a line
+	// whose start was lost.
+	for i := 4; i <= 20; i++ {
+		fmt.Fprintf(fw, "line %d\n", i)
+	}
+	c.Assert(it.Next(nil), Equals, true)
+	var seqs []int64
+	for _, entry := range parseAll(parser) {
+		if entry.Seq == 0 {
+			c.Check(entry.Message, Matches, `(\(\.\.\. output truncated \.\.\.\))?\n`)
+			continue
+		}
+		c.Check(strings.HasSuffix(fmt.Sprintf("line %d\n", entry.Seq), entry.Message), Equals, true,
+			Commentf("line %d: %q", entry.Seq, entry.Message))
+		seqs = append(seqs, entry.Seq)
+	}
+	c.Assert(seqs, Not(HasLen), 0)
+	c.Check(seqs[len(seqs)-1], Equals, int64(20))
+	missed := seqs[0] - 3 - 1
+	c.Check(missed > 0, Equals, true)
+	c.Check(int64(len(seqs)), Equals, 20-3-missed)
+}
+
+func (s *parserSuite) TestSeqLongLine(c *C) {
+	// The parts of a line too long for the parser's buffer, and of a line
+	// written in parts, have its number.
+	now := func() time.Time { return time.Date(2021, 5, 13, 3, 16, 51, 0, time.UTC) }
+	rb := servicelog.NewRingBuffer(4096)
+	fw, err := servicelog.NewFormatWriter(rb, "svc", servicelog.WithClock(now))
+	c.Assert(err, IsNil)
+	fmt.Fprintf(fw, "first\n%s\npart", strings.Repeat("x", 100))
+	it := rb.TailIterator()
+	defer it.Close()
+	parser := servicelog.NewParser(it, 64)
+	entries := parseAll(parser)
+	c.Assert(it.Next(nil), Equals, false)
+	fmt.Fprintf(fw, "ial\nlast\n")
+	c.Assert(it.Next(nil), Equals, true)
+	entries = append(entries, parseAll(parser)...)
+
+	var seqs []int64
+	var messages []string
+	for _, entry := range entries {
+		seqs = append(seqs, entry.Seq)
+		messages = append(messages, entry.Message)
+	}
+	c.Check(strings.Join(messages, ""), Equals, "first\n"+strings.Repeat("x", 100)+"\npartial\nlast\n")
+	c.Check(seqs[0], Equals, int64(1))
+	c.Check(seqs[len(seqs)-1], Equals, int64(4))
+	for i, entry := range entries[1 : len(entries)-1] {
+		if strings.HasPrefix(entry.Message, "x") || strings.HasSuffix(messages[i], "x") {
+			c.Check(entry.Seq, Equals, int64(2), Commentf("%q", entry.Message))
+		} else {
+			c.Check(entry.Seq, Equals, int64(3), Commentf("%q", entry.Message))
+		}
+	}
+}
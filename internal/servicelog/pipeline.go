@@ -0,0 +1,350 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Stages of a Pipeline, besides StageFormat, as named in the stats of a
+// PipelineWriter.
+const (
+	StageRedact    = "redact"
+	StageFilter    = "filter"
+	StageSample    = "sample"
+	StageSeverity  = "severity"
+	StageCap       = "cap"
+	StageRateLimit = "ratelimit"
+	StageFanout    = "fanout"
+)
+
+// pipelineDestLabel is the label of the destination of a pipeline in a
+// fanout stage.
+const pipelineDestLabel = "dest"
+
+var errPipelineClosed = errors.New("log pipeline is closed")
+
+// Pipeline describes the log pipeline of a service as a list of stages, in
+// the order its output flows through them. It only records the stages and
+// their options, so the same Pipeline can be built again, with fresh
+// writers, each time the service is started.
+//
+// Unlike NewPipeline, which builds the stages used to replay captures, a
+// Pipeline closes its destination when it's closed.
+type Pipeline struct {
+	serviceName string
+	stages      []pipelineStage
+}
+
+type pipelineStage struct {
+	name  string
+	build func(dest io.Writer) (io.Writer, error)
+}
+
+// NewServicePipeline returns an empty Pipeline for the named service.
+func NewServicePipeline(serviceName string) *Pipeline {
+	return &Pipeline{serviceName: serviceName}
+}
+
+func (p *Pipeline) add(name string, build func(dest io.Writer) (io.Writer, error)) *Pipeline {
+	p.stages = append(p.stages, pipelineStage{name: name, build: build})
+	return p
+}
+
+// Redact adds a stage masking the matches of the given rules, as
+// NewRedactWriter.
+func (p *Pipeline) Redact(rules ...RedactRule) *Pipeline {
+	rules = append([]RedactRule(nil), rules...)
+	return p.add(StageRedact, func(dest io.Writer) (io.Writer, error) {
+		return NewRedactWriter(dest, rules...)
+	})
+}
+
+// Filter adds a stage passing on only the lines that pass the include and
+// exclude patterns, as NewFilterWriter.
+func (p *Pipeline) Filter(include, exclude *regexp.Regexp) *Pipeline {
+	return p.add(StageFilter, func(dest io.Writer) (io.Writer, error) {
+		return NewFilterWriter(dest, include, exclude)
+	})
+}
+
+// Sample adds a stage passing on a sample of the lines, as
+// NewSampleWriter.
+func (p *Pipeline) Sample(config SampleConfig) *Pipeline {
+	return p.add(StageSample, func(dest io.Writer) (io.Writer, error) {
+		return NewSampleWriter(dest, config)
+	})
+}
+
+// Severity adds a stage dropping the lines below a minimum level, as
+// NewSeverityWriter.
+func (p *Pipeline) Severity(config SeverityConfig) *Pipeline {
+	return p.add(StageSeverity, func(dest io.Writer) (io.Writer, error) {
+		return NewSeverityWriter(dest, config)
+	})
+}
+
+// Cap adds a stage suppressing the output past a limit, as NewCapWriter.
+func (p *Pipeline) Cap(maxBytes, maxLines int64) *Pipeline {
+	return p.add(StageCap, func(dest io.Writer) (io.Writer, error) {
+		return NewCapWriter(dest, p.serviceName, maxBytes, maxLines)
+	})
+}
+
+// RateLimit adds a stage limiting the rate of lines, as
+// NewRateLimitWriter.
+func (p *Pipeline) RateLimit(rate, burst int) *Pipeline {
+	return p.add(StageRateLimit, func(dest io.Writer) (io.Writer, error) {
+		return NewRateLimitWriter(dest, p.serviceName, rate, burst)
+	})
+}
+
+// Format adds a stage formatting lines as NewFormatWriter, with the given
+// options.
+func (p *Pipeline) Format(opts ...FormatOption) *Pipeline {
+	return p.FormatWith(func(dest io.Writer, serviceName string) (io.Writer, error) {
+		return NewFormatWriter(dest, serviceName, opts...)
+	})
+}
+
+// FormatWith adds a stage formatting lines with the writer returned by
+// newFormatter, such as one from NewJSONFormatWriter.
+func (p *Pipeline) FormatWith(newFormatter func(dest io.Writer, serviceName string) (io.Writer, error)) *Pipeline {
+	return p.add(StageFormat, func(dest io.Writer) (io.Writer, error) {
+		return newFormatter(dest, p.serviceName)
+	})
+}
+
+// PipelineTarget is a destination a fanout stage copies the output to,
+// besides the destination of the pipeline.
+type PipelineTarget struct {
+	// Label identifies the target in the Errors and Dropped of the
+	// FanoutWriter. It must be unique, and not "dest", which labels the
+	// destination of the pipeline.
+	Label  string
+	Writer io.Writer
+}
+
+// Fanout adds a stage copying the output to the given targets as well as
+// to the destination of the pipeline, as a FanoutWriter with the given
+// retry interval. It must be the last stage. The targets aren't closed
+// when the pipeline is, so that they can be shared by the pipelines built
+// for each run of the service.
+func (p *Pipeline) Fanout(retry time.Duration, targets ...PipelineTarget) *Pipeline {
+	targets = append([]PipelineTarget(nil), targets...)
+	return p.add(StageFanout, func(dest io.Writer) (io.Writer, error) {
+		fanout := NewFanoutWriter(retry)
+		if err := fanout.Add(pipelineDestLabel, dest); err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			if err := fanout.Add(target.Label, noCloseWriter{target.Writer}); err != nil {
+				return nil, err
+			}
+		}
+		return fanout, nil
+	})
+}
+
+// Stages returns the names of the stages, in order.
+func (p *Pipeline) Stages() []string {
+	names := make([]string, len(p.stages))
+	for i, stage := range p.stages {
+		names[i] = stage.name
+	}
+	return names
+}
+
+// Validate checks that the stages can be combined: each stage may appear
+// only once, so that there's at most one formatter, and a fanout stage
+// must be the last. The options of each stage are checked by Build.
+func (p *Pipeline) Validate() error {
+	seen := make(map[string]bool, len(p.stages))
+	for i, stage := range p.stages {
+		if seen[stage.name] {
+			return fmt.Errorf("log pipeline for service %q has more than one %s stage", p.serviceName, stage.name)
+		}
+		seen[stage.name] = true
+		if stage.name == StageFanout && i != len(p.stages)-1 {
+			return fmt.Errorf("log pipeline for service %q has stages after its fanout stage", p.serviceName)
+		}
+	}
+	return nil
+}
+
+// Build returns a new PipelineWriter passing its input through the stages
+// to dest.
+func (p *Pipeline) Build(dest io.Writer) (*PipelineWriter, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	w := &PipelineWriter{
+		dest:        dest,
+		serviceName: p.serviceName,
+		names:       p.Stages(),
+		stages:      make([]io.Writer, len(p.stages)),
+	}
+	// The stages are built from the last, each writing to the next. Their
+	// destinations are shielded from their Close, so that the pipeline
+	// closes each stage exactly once, and in order.
+	next := io.Writer(noCloseWriter{dest})
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		stage, err := p.stages[i].build(next)
+		if err != nil {
+			return nil, fmt.Errorf("cannot build %s stage of log pipeline for service %q: %v", p.stages[i].name, p.serviceName, err)
+		}
+		w.stages[i] = stage
+		next = noCloseWriter{stage}
+	}
+	if len(w.stages) > 0 {
+		w.head = w.stages[0]
+	} else {
+		w.head = dest
+	}
+	return w, nil
+}
+
+// PipelineWriter is a log pipeline built by Pipeline.Build.
+type PipelineWriter struct {
+	mu          sync.Mutex
+	dest        io.Writer
+	serviceName string
+	head        io.Writer
+	names       []string
+	stages      []io.Writer
+	closed      bool
+}
+
+// Write writes p to the first stage of the pipeline.
+func (w *PipelineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, errPipelineClosed
+	}
+	return w.head.Write(p)
+}
+
+// ReadFrom writes what it reads from r until EOF to the first stage of
+// the pipeline, as if what each read returns were passed to Write, so that
+// io.Copy reads into the buffer of the first stage if it's a formatter,
+// or else one of the pipeline's. An error reading is returned as a
+// ReadError.
+func (w *PipelineWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(r, readBuffer(w.head), w.serviceName, w.Write)
+}
+
+func (w *PipelineWriter) flushIdle() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	return flushIdle(w.head)
+}
+
+// Close closes the stages from the first, so that each passes on what it
+// holds back, such as an incomplete line, through the stages after it,
+// and then closes dest, if it's an io.Closer. It returns the first error,
+// and does nothing if the pipeline is already closed.
+func (w *PipelineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	var err error
+	for _, stage := range w.stages {
+		if closeErr := closeWriter(stage); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := closeWriter(w.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// StageStats returns the statistics of the stages that keep them, by
+// stage name.
+func (w *PipelineWriter) StageStats() map[string]WriterStats {
+	stats := make(map[string]WriterStats, len(w.stages))
+	for i, stage := range w.stages {
+		if r, ok := stage.(StatsReporter); ok {
+			stats[w.names[i]] = r.Stats()
+		}
+	}
+	return stats
+}
+
+// Stats returns the statistics of the whole pipeline: the lines and bytes
+// written by the last stage keeping statistics, the lines dropped by all
+// of them, and the last error seen by the one nearest to dest.
+func (w *PipelineWriter) Stats() WriterStats {
+	var stats WriterStats
+	last := true
+	for i := len(w.stages) - 1; i >= 0; i-- {
+		r, ok := w.stages[i].(StatsReporter)
+		if !ok {
+			continue
+		}
+		s := r.Stats()
+		if last {
+			stats.Lines = s.Lines
+			stats.Bytes = s.Bytes
+			last = false
+		}
+		stats.Dropped += s.Dropped
+		if stats.LastError == nil {
+			stats.LastError = s.LastError
+		}
+	}
+	return stats
+}
+
+// Register adds the stages keeping statistics to registry, under the
+// service's name, replacing those of the pipeline built for the previous
+// run of the service.
+func (w *PipelineWriter) Register(registry *StatsRegistry) {
+	for i, stage := range w.stages {
+		if r, ok := stage.(StatsReporter); ok {
+			registry.Add(w.serviceName, w.names[i], r)
+		}
+	}
+}
+
+// noCloseWriter hides the Close of a writer from the stage writing to it,
+// which would otherwise close it too. An idle flush is passed on, and so
+// is the writer's read buffer.
+type noCloseWriter struct {
+	io.Writer
+}
+
+func (w noCloseWriter) flushIdle() error {
+	return flushIdle(w.Writer)
+}
+
+func (w noCloseWriter) readBuffer() []byte {
+	if r, ok := w.Writer.(readBufferer); ok {
+		return r.readBuffer()
+	}
+	return nil
+}
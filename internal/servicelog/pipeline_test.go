@@ -0,0 +1,295 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type pipelineSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&pipelineSuite{})
+
+func (s *pipelineSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *pipelineSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// closeCounter is a destination counting the times it's closed.
+type closeCounter struct {
+	bytes.Buffer
+	closes int
+}
+
+func (c *closeCounter) Close() error {
+	c.closes++
+	return nil
+}
+
+func newTestPipeline() *servicelog.Pipeline {
+	return servicelog.NewServicePipeline("test").
+		Filter(nil, regexp.MustCompile(`debug`)).
+		Redact(servicelog.RedactRule{Pattern: regexp.MustCompile(`secret-\d+`)}).
+		Format()
+}
+
+func (s *pipelineSuite) TestStages(c *C) {
+	c.Check(newTestPipeline().Stages(), DeepEquals, []string{"filter", "redact", "format"})
+}
+
+func (s *pipelineSuite) TestWrite(c *C) {
+	dest := &closeCounter{}
+	w, err := newTestPipeline().Build(dest)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "got secret-1\ndebug: secret-2\nend\n")
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] got [REDACTED]
+2021-05-13T03:16:51.001Z [test] end
+`[1:])
+}
+
+func (s *pipelineSuite) TestCloseFlushOrder(c *C) {
+	// An incomplete line held back by the first stage is still redacted
+	// and formatted when the pipeline is closed, and ended by the
+	// formatter before dest is closed.
+	dest := &closeCounter{}
+	w, err := newTestPipeline().Build(dest)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "got secret-1\npassword for secret-2: ")
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, "2021-05-13T03:16:51.001Z [test] got [REDACTED]\n")
+	c.Check(dest.closes, Equals, 0)
+
+	c.Assert(w.Close(), IsNil)
+	c.Check(dest.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] got [REDACTED]
+2021-05-13T03:16:51.001Z [test] password for [REDACTED]:  [incomplete line]
+`[1:])
+	c.Check(dest.closes, Equals, 1)
+}
+
+func (s *pipelineSuite) TestCloseIdempotent(c *C) {
+	dest := &closeCounter{}
+	w, err := newTestPipeline().Build(dest)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "partial")
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	out := dest.String()
+
+	c.Assert(w.Close(), IsNil)
+	c.Check(dest.String(), Equals, out)
+	c.Check(dest.closes, Equals, 1)
+
+	n, err := io.WriteString(w, "late\n")
+	c.Check(err, ErrorMatches, "log pipeline is closed")
+	c.Check(n, Equals, 0)
+	c.Check(dest.String(), Equals, out)
+}
+
+func (s *pipelineSuite) TestCloseError(c *C) {
+	dest := &closeRecorder{err: errors.New("cannot close")}
+	w, err := servicelog.NewServicePipeline("test").Format().Build(dest)
+	c.Assert(err, IsNil)
+	c.Check(w.Close(), ErrorMatches, "cannot close")
+	c.Check(dest.closed, Equals, true)
+}
+
+func (s *pipelineSuite) TestNoStages(c *C) {
+	dest := &closeCounter{}
+	w, err := servicelog.NewServicePipeline("test").Build(dest)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "as it is")
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Check(dest.String(), Equals, "as it is")
+	c.Check(dest.closes, Equals, 1)
+}
+
+func (s *pipelineSuite) TestInvalid(c *C) {
+	for _, test := range []struct {
+		pipeline *servicelog.Pipeline
+		error    string
+	}{{
+		pipeline: servicelog.NewServicePipeline("test").Format().FormatWith(func(dest io.Writer, serviceName string) (io.Writer, error) {
+			return servicelog.NewJSONFormatWriter(dest, serviceName), nil
+		}),
+		error: `log pipeline for service "test" has more than one format stage`,
+	}, {
+		pipeline: servicelog.NewServicePipeline("test").Redact(redactRules...).Format().Redact(redactRules...),
+		error:    `log pipeline for service "test" has more than one redact stage`,
+	}, {
+		pipeline: servicelog.NewServicePipeline("test").Fanout(time.Second).Format(),
+		error:    `log pipeline for service "test" has stages after its fanout stage`,
+	}, {
+		pipeline: servicelog.NewServicePipeline("test").Filter(nil, nil).Format(),
+		error:    `cannot build filter stage of log pipeline for service "test": no filter patterns given`,
+	}, {
+		pipeline: servicelog.NewServicePipeline("test").Format().Fanout(time.Second, servicelog.PipelineTarget{Label: "dest", Writer: &bytes.Buffer{}}),
+		error:    `cannot build fanout stage of log pipeline for service "test": log destination "dest" already added`,
+	}} {
+		w, err := test.pipeline.Build(&bytes.Buffer{})
+		c.Check(err, ErrorMatches, test.error)
+		c.Check(w, IsNil)
+	}
+	c.Check(servicelog.NewServicePipeline("test").Format().Format().Validate(), ErrorMatches, ".* more than one format stage")
+	c.Check(newTestPipeline().Validate(), IsNil)
+}
+
+func (s *pipelineSuite) TestStats(c *C) {
+	dest := &closeCounter{}
+	w, err := newTestPipeline().Build(dest)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "one\ndebug\ntwo\ndebug\n")
+	c.Assert(err, IsNil)
+
+	stages := w.StageStats()
+	c.Check(stages, HasLen, 3)
+	c.Check(stages["filter"].Dropped, Equals, int64(2))
+	c.Check(stages["redact"].Lines, Equals, int64(2))
+	c.Check(stages["format"].Lines, Equals, int64(2))
+
+	var stats servicelog.StatsReporter = w
+	c.Check(stats.Stats(), DeepEquals, servicelog.WriterStats{
+		Lines:   2,
+		Bytes:   int64(dest.Len()),
+		Dropped: 2,
+	})
+}
+
+func (s *pipelineSuite) TestRebuild(c *C) {
+	// The same pipeline is built again with fresh stages, as for a
+	// restart of the service, replacing the stats registered for the last
+	// run.
+	p := newTestPipeline()
+	registry := servicelog.NewStatsRegistry()
+	var dests []*closeCounter
+	for i := 0; i < 2; i++ {
+		dest := &closeCounter{}
+		dests = append(dests, dest)
+		w, err := p.Build(dest)
+		c.Assert(err, IsNil)
+		w.Register(registry)
+		_, err = io.WriteString(w, strings.Repeat("debug\n", i+1)+"half")
+		c.Assert(err, IsNil)
+		c.Assert(w.Close(), IsNil)
+		c.Check(registry.Snapshot()["test"]["filter"].Dropped, Equals, int64(i+1))
+	}
+	for _, dest := range dests {
+		c.Check(dest.String(), Equals, "2021-05-13T03:16:51.001Z [test] half [incomplete line]\n")
+		c.Check(dest.closes, Equals, 1)
+	}
+	c.Check(registry.Snapshot()["test"], HasLen, 3)
+}
+
+func (s *pipelineSuite) TestFanout(c *C) {
+	dest := &closeCounter{}
+	target := &closeCounter{}
+	w, err := newTestPipeline().Fanout(time.Second, servicelog.PipelineTarget{Label: "target", Writer: target}).Build(dest)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "got secret-1\nprompt> ")
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	output := `
+2021-05-13T03:16:51.001Z [test] got [REDACTED]
+2021-05-13T03:16:51.001Z [test] prompt>  [incomplete line]
+`[1:]
+	c.Check(dest.String(), Equals, output)
+	c.Check(dest.closes, Equals, 1)
+	// The target may be shared with the pipeline for the next run.
+	c.Check(target.String(), Equals, output)
+	c.Check(target.closes, Equals, 0)
+}
+
+func (s *pipelineSuite) TestIdleFlush(c *C) {
+	// An idle flush in front of the pipeline reaches the stages holding
+	// back the incomplete line.
+	dest := &chunkWriter{writes: make(chan string, 10)}
+	p, err := newTestPipeline().Build(dest)
+	c.Assert(err, IsNil)
+	w := servicelog.NewIdleFlushWriter(p, 50*time.Millisecond, false)
+	defer w.Close()
+
+	_, err = io.WriteString(w, "prompt secret-1> ")
+	c.Assert(err, IsNil)
+	expectNoWrite(c, dest)
+	s.clock.Advance(50 * time.Millisecond)
+	expectWrite(c, dest, "2021-05-13T03:16:51.051Z [test] prompt [REDACTED]> ")
+}
+
+func (s *pipelineSuite) TestReadFrom(c *C) {
+	input := []string{"got secret-1\npass", "word: secret-2\ndebug\nprom", "pt> "}
+	expected := &bytes.Buffer{}
+	w, err := newTestPipeline().Build(expected)
+	c.Assert(err, IsNil)
+	for _, chunk := range input {
+		_, err := io.WriteString(w, chunk)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(w.Close(), IsNil)
+
+	output := &closeCounter{}
+	w, err = newTestPipeline().Build(output)
+	c.Assert(err, IsNil)
+	n, err := io.Copy(w, &chunkReader{chunks: append([]string(nil), input...)})
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, int64(len(strings.Join(input, ""))))
+	c.Assert(w.Close(), IsNil)
+	c.Check(output.String(), Equals, expected.String())
+	c.Check(output.closes, Equals, 1)
+
+	_, err = w.ReadFrom(strings.NewReader("late\n"))
+	c.Check(err, ErrorMatches, "log pipeline is closed")
+	_, err = w.ReadFrom(&chunkReader{err: errors.New("pipe broke")})
+	c.Check(err, ErrorMatches, `cannot read output of service "test": pipe broke`)
+}
+
+func (s *pipelineSuite) TestReadFromInPlace(c *C) {
+	// With the formatter first, the pipeline reads into its buffer, and
+	// the lines are written to a ring buffer in place.
+	input := "first\nsecond\nthi"
+	expected := &bytes.Buffer{}
+	w, err := servicelog.NewServicePipeline("test").Format().Build(expected)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, input)
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	rb := servicelog.NewRingBuffer(1024)
+	w, err = servicelog.NewServicePipeline("test").Format().Build(rb)
+	c.Assert(err, IsNil)
+	_, err = io.Copy(w, &chunkReader{chunks: cutChunks(input, 4)})
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Check(ringContents(c, rb), Equals, expected.String())
+}
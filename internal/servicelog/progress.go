@@ -0,0 +1,227 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// ProgressMaxLine is the length of line a ProgressWriter holds, at most.
+// The rest of a longer line is passed on as it is.
+const ProgressMaxLine = 64 * 1024
+
+// ProgressWriter keeps only the final state of lines rewritten with
+// carriage returns, such as the progress bars of tools like pip and apt,
+// so that a completed progress line is logged once, instead of as one huge
+// line, or as a line per update. It holds each incomplete line, and a
+// carriage return not followed by a newline discards what came before it
+// on the line. A CRLF ends a line as a newline does.
+//
+// If a line isn't completed within the writer's delay, its latest state
+// is written as a line of its own, so that long-running progress is
+// visible, and again each time the delay passes with the line changed.
+// A line completed unchanged since then isn't written again.
+type ProgressWriter struct {
+	mu    sync.Mutex
+	dest  io.Writer
+	delay time.Duration
+	// line is the state of the incomplete line, and cr is set if a
+	// carriage return after it was held at the end of a write, until the
+	// next byte shows whether it ends the line or discards it. flushed is
+	// set if line has been written by the timer since it last changed.
+	line    []byte
+	cr      bool
+	flushed bool
+	// passing is set while the rest of a line too long to hold is passed
+	// on as it is.
+	passing bool
+
+	// timer writes line once it has been held for the delay.
+	timer *deadlineTimer
+	// err is the error from a write by the timer, returned by the next
+	// Write or Close.
+	err    error
+	closed bool
+}
+
+// NewProgressWriter returns a ProgressWriter that writes to dest, writing
+// the state of lines held for delay, which must be positive.
+func NewProgressWriter(dest io.Writer, delay time.Duration) *ProgressWriter {
+	w := &ProgressWriter{dest: dest, delay: delay}
+	w.timer = newDeadlineTimer(&w.mu, w.timeout)
+	return w
+}
+
+func (w *ProgressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.err; err != nil {
+		w.err = nil
+		return 0, err
+	}
+	if w.closed {
+		return w.dest.Write(p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if w.cr {
+			w.cr = false
+			if p[0] != '\n' {
+				w.line = w.line[:0]
+				w.flushed = false
+			}
+		}
+		line := p
+		end := bytes.IndexByte(p, '\n')
+		if end >= 0 {
+			line = p[:end+1]
+		}
+		if w.passing {
+			n, err := writeFull(w.dest, line)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			w.passing = end < 0
+			p = p[len(line):]
+			continue
+		}
+		if i := bytes.IndexByte(line, '\r'); i >= 0 {
+			n, err := w.hold(line[:i])
+			written += n
+			if err != nil {
+				return written, err
+			}
+			p = p[i:]
+			if !w.passing {
+				w.cr = true
+				written++
+				p = p[1:]
+			}
+			continue
+		}
+		var n int
+		var err error
+		if end < 0 {
+			n, err = w.hold(line)
+		} else {
+			n, err = w.complete(line)
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(line):]
+	}
+	if len(w.line) > 0 && !w.flushed && !w.timer.Armed() {
+		w.timer.Reset(w.delay)
+	}
+	return written, nil
+}
+
+// hold adds data to the line held, or passes both on if that makes the
+// line too long to hold, and returns the number of bytes of data written.
+func (w *ProgressWriter) hold(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	w.flushed = false
+	if len(w.line)+len(data) <= ProgressMaxLine {
+		w.line = append(w.line, data...)
+		return len(data), nil
+	}
+	w.passing = true
+	return w.writeHeld(data)
+}
+
+// complete writes the line held completed by data, which ends with a
+// newline, unless the timer wrote it and it hasn't changed since.
+func (w *ProgressWriter) complete(data []byte) (int, error) {
+	if w.flushed && len(data) == 1 {
+		w.timer.Stop()
+		w.line = w.line[:0]
+		w.flushed = false
+		return len(data), nil
+	}
+	return w.writeHeld(data)
+}
+
+// writeHeld writes the line held followed by data to dest, in a single
+// write, and returns the number of bytes of data written. The line is
+// dropped even if the write fails, as it was reported written already.
+func (w *ProgressWriter) writeHeld(data []byte) (int, error) {
+	w.timer.Stop()
+	w.flushed = false
+	held := len(w.line)
+	if held == 0 {
+		return writeFull(w.dest, data)
+	}
+	w.line = append(w.line, data...)
+	n, err := writeFull(w.dest, w.line)
+	n -= held
+	if n < 0 {
+		n = 0
+	}
+	if cap(w.line) > 2*ProgressMaxLine {
+		// Don't keep a buffer grown for a long line.
+		w.line = nil
+	} else {
+		w.line = w.line[:0]
+	}
+	return n, err
+}
+
+// timeout writes the line held once the delay has passed.
+func (w *ProgressWriter) timeout() {
+	if len(w.line) == 0 || w.flushed {
+		return
+	}
+	// The line is kept, as it may be rewritten or completed yet.
+	w.line = append(w.line, '\n')
+	_, err := writeFull(w.dest, w.line)
+	w.line = w.line[:len(w.line)-1]
+	w.flushed = true
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// Close writes the line held, if the timer hasn't, and closes dest, if
+// it's an io.Closer, so that it can end the incomplete line. Writes after
+// Close go straight to dest.
+func (w *ProgressWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.err
+	w.err = nil
+	if len(w.line) > 0 && !w.flushed {
+		if _, writeErr := w.writeHeld(nil); err == nil {
+			err = writeErr
+		}
+	}
+	w.timer.Close()
+	if closeErr := closeWriter(w.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type progressSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&progressSuite{})
+
+func (s *progressSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *progressSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+const progressInput = "10%\r50%\r100%\nplain\n" +
+	"crlf\r\n" +
+	"first\rsecond\r\r\n" +
+	"\rstart\n" +
+	"\r\n" +
+	"last\r"
+
+func (s *progressSuite) TestFinalState(c *C) {
+	for _, chunked := range []bool{false, true} {
+		dest := &chunkWriter{}
+		w := servicelog.NewProgressWriter(dest, time.Second)
+		if chunked {
+			writeBytes(c, w, progressInput)
+		} else {
+			n, err := io.WriteString(w, progressInput)
+			c.Assert(err, IsNil)
+			c.Assert(n, Equals, len(progressInput))
+		}
+		c.Check(dest.String(), Equals, "100%\nplain\ncrlf\n\nstart\n\n")
+		c.Assert(w.Close(), IsNil)
+		c.Check(dest.String(), Equals, "100%\nplain\ncrlf\n\nstart\n\nlast")
+	}
+}
+
+func (s *progressSuite) TestSplitWrites(c *C) {
+	dest := &chunkWriter{}
+	w := servicelog.NewProgressWriter(dest, time.Second)
+	defer w.Close()
+
+	for _, p := range []string{"a\r", "\nb\r", "c\r", "\r", "\n", "d\r", "e\n"} {
+		n, err := io.WriteString(w, p)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(p))
+	}
+	c.Check(dest.chunks, DeepEquals, []string{"a\n", "\n", "e\n"})
+}
+
+func (s *progressSuite) TestDelay(c *C) {
+	dest := &chunkWriter{writes: make(chan string, 10)}
+	w := servicelog.NewProgressWriter(dest, time.Second)
+	defer w.Close()
+
+	next := func() string {
+		select {
+		case chunk := <-dest.writes:
+			return chunk
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for a write")
+		}
+		return ""
+	}
+
+	// The latest state is written once the line has been held for the
+	// delay, and again if it changes.
+	_, err := io.WriteString(w, "10%")
+	c.Assert(err, IsNil)
+	waitTimer(c, s.clock)
+	s.clock.Advance(500 * time.Millisecond)
+	_, err = io.WriteString(w, "\r20%")
+	c.Assert(err, IsNil)
+	s.clock.Advance(500 * time.Millisecond)
+	c.Check(next(), Equals, "20%\n")
+
+	_, err = io.WriteString(w, "\r30%")
+	c.Assert(err, IsNil)
+	waitTimer(c, s.clock)
+	s.clock.Advance(time.Second)
+	c.Check(next(), Equals, "30%\n")
+
+	// A line completed as it was written isn't written again, and one
+	// that changed is.
+	_, err = io.WriteString(w, "\r\n40%")
+	c.Assert(err, IsNil)
+	waitTimer(c, s.clock)
+	s.clock.Advance(time.Second)
+	c.Check(next(), Equals, "40%\n")
+	_, err = io.WriteString(w, "\r50%\n")
+	c.Assert(err, IsNil)
+	c.Check(next(), Equals, "50%\n")
+	c.Check(dest.String(), Equals, "20%\n30%\n40%\n50%\n")
+}
+
+func (s *progressSuite) TestLongLine(c *C) {
+	dest := &chunkWriter{}
+	w := servicelog.NewProgressWriter(dest, time.Second)
+	defer w.Close()
+
+	// The rest of a line too long to hold is passed on as it is, carriage
+	// returns and all.
+	long := strings.Repeat("x", servicelog.ProgressMaxLine)
+	_, err := io.WriteString(w, "gone\r"+long+"y\rz\nnext\rline\n")
+	c.Assert(err, IsNil)
+	c.Check(dest.chunks, DeepEquals, []string{long + "y", "\rz\n", "line\n"})
+}
+
+func (s *progressSuite) TestWriteError(c *C) {
+	errTest := errors.New("test")
+	dest := servicelogtest.NewScriptedWriter(servicelogtest.FailAfter(2, errTest))
+	w := servicelog.NewProgressWriter(dest, time.Second)
+	defer w.Close()
+
+	// The line held was reported written already, so only the bytes of
+	// the write completing it that got through are counted.
+	_, err := io.WriteString(w, "held\rnew")
+	c.Assert(err, IsNil)
+	n, err := io.WriteString(w, " line\n")
+	c.Assert(err, Equals, errTest)
+	c.Check(n, Equals, 0)
+	n, err = io.WriteString(w, "next\n")
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 5)
+	c.Check(dest.String(), Equals, "nenext\n")
+}
+
+func (s *progressSuite) TestClose(c *C) {
+	dest := &closeRecorder{}
+	w := servicelog.NewProgressWriter(dest, time.Second)
+
+	_, err := io.WriteString(w, "1%\r2%\r")
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Check(dest.String(), Equals, "2%")
+	c.Check(dest.closed, Equals, true)
+
+	// Writes after Close go straight to dest.
+	_, err = io.WriteString(w, "3%\r")
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, "2%3%\r")
+}
+
+func (s *progressSuite) TestChunking(c *C) {
+	newWriter := func(dest io.Writer) io.Writer {
+		return servicelog.NewProgressWriter(dest, time.Hour)
+	}
+	inputs := append([]string{progressInput}, chunkingInputs...)
+	for seed := int64(0); seed < 10; seed++ {
+		err := checkChunking(newWriter, inputs, seed, 20)
+		c.Assert(err, IsNil, Commentf("seed %d", seed))
+	}
+}
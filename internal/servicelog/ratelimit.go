@@ -0,0 +1,224 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimitInterval is how long after a line is suppressed by a
+// RateLimitWriter, at most, the summary of the lines suppressed is written.
+const RateLimitInterval = time.Second
+
+// RateLimitWriter limits the lines of output a service can log, so that a
+// crash-looping or debug-spewing service can't flood the log destinations.
+// It passes on up to the writer's rate of lines per second, with bursts of
+// up to its burst size, and drops the lines over the limit whole. Once a
+// line has been suppressed, a summary of how many were is written within
+// RateLimitInterval, as a line of its own, even if the service has gone
+// quiet by then. Composed in front of a formatter, the summary gets the
+// usual prefix.
+type RateLimitWriter struct {
+	mu          sync.Mutex
+	dest        io.Writer
+	serviceName string
+
+	// The bucket holds credit, as time, of up to burst lines: each line
+	// passed on takes cost from it, and it fills up as time passes.
+	cost     time.Duration
+	capacity time.Duration
+	credit   time.Duration
+	filled   time.Time
+
+	// midLine is set while the rest of a line passed on is due, and
+	// dropping while the rest of a suppressed line is discarded.
+	midLine  bool
+	dropping bool
+	// pending counts the lines suppressed since the last summary. A
+	// summary that's due while a line passed on is incomplete is written
+	// once the line is complete.
+	pending int64
+	due     bool
+	// stats counts the lines suppressed, as dropped.
+	stats *writerStats
+
+	// timer writes the summary once it's due.
+	timer *deadlineTimer
+	// err is the error from a summary written by the timer, returned by
+	// the next Write or Close.
+	err    error
+	closed bool
+}
+
+// NewRateLimitWriter returns a RateLimitWriter for the service's output
+// that writes to dest, passing on up to rate lines per second with bursts
+// of up to burst lines.
+func NewRateLimitWriter(dest io.Writer, serviceName string, rate, burst int) (*RateLimitWriter, error) {
+	if rate <= 0 {
+		return nil, errors.New("log rate limit must be positive")
+	}
+	if burst <= 0 {
+		return nil, errors.New("log rate limit burst must be positive")
+	}
+	cost := time.Second / time.Duration(rate)
+	r := &RateLimitWriter{
+		dest:        dest,
+		serviceName: serviceName,
+		cost:        cost,
+		capacity:    time.Duration(burst) * cost,
+		credit:      time.Duration(burst) * cost,
+		filled:      clock.Now(),
+		stats:       &writerStats{},
+	}
+	r.timer = newDeadlineTimer(&r.mu, r.timeout)
+	return r, nil
+}
+
+// Write passes on the lines in p that are within the limit, and reports
+// the suppressed ones as written too.
+func (r *RateLimitWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.err; err != nil {
+		r.err = nil
+		return 0, err
+	}
+	if r.closed {
+		return r.stats.write(r.dest, p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		end := false
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			chunk = p[:i+1]
+			end = true
+		}
+		if !r.midLine && !r.dropping && !r.take() {
+			r.dropping = true
+			r.pending++
+			r.stats.addDropped(1)
+			if !r.timer.Armed() {
+				r.timer.Reset(RateLimitInterval)
+			}
+		}
+		if r.dropping {
+			r.dropping = !end
+			written += len(chunk)
+			p = p[len(chunk):]
+			continue
+		}
+		n, err := r.stats.writeFull(r.dest, chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		r.midLine = !end
+		p = p[len(chunk):]
+		if end && r.due {
+			if err := r.summarize(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// take takes the cost of a line from the bucket, and reports whether there
+// was enough credit for it.
+func (r *RateLimitWriter) take() bool {
+	now := clock.Now()
+	if elapsed := now.Sub(r.filled); elapsed > 0 {
+		r.credit += elapsed
+		if r.credit > r.capacity {
+			r.credit = r.capacity
+		}
+	}
+	r.filled = now
+	if r.credit < r.cost {
+		return false
+	}
+	r.credit -= r.cost
+	return true
+}
+
+// summarize writes the summary of the lines suppressed since the last one.
+func (r *RateLimitWriter) summarize() error {
+	r.due = false
+	if r.pending == 0 {
+		return nil
+	}
+	summary := fmt.Sprintf("[pebble] suppressed %d log lines from service %s\n", r.pending, r.serviceName)
+	r.pending = 0
+	_, err := r.stats.writeFull(r.dest, []byte(summary))
+	return err
+}
+
+// Suppressed returns the number of lines suppressed so far.
+func (r *RateLimitWriter) Suppressed() int64 {
+	return r.stats.droppedLines()
+}
+
+// Stats returns the writer's statistics, counting the lines suppressed as
+// dropped.
+func (r *RateLimitWriter) Stats() WriterStats {
+	return r.stats.snapshot()
+}
+
+// timeout writes the summary once it's due, or once the line passed on is
+// complete.
+func (r *RateLimitWriter) timeout() {
+	if r.midLine {
+		r.due = true
+		return
+	}
+	if err := r.summarize(); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// Close writes the summary of any lines suppressed since the last one,
+// after ending an incomplete line with IncompleteLineMarker, and closes
+// dest, if it's an io.Closer. Writes after Close go straight to dest.
+func (r *RateLimitWriter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.err
+	r.err = nil
+	r.timer.Close()
+	if r.pending > 0 && err == nil {
+		if r.midLine {
+			_, err = r.stats.writeFull(r.dest, []byte(IncompleteLineMarker+"\n"))
+			r.midLine = false
+		}
+		if err == nil {
+			err = r.summarize()
+		}
+	}
+	if closeErr := closeWriter(r.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type rateLimitSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&rateLimitSuite{})
+
+func (s *rateLimitSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *rateLimitSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// lines returns the lines "<prefix> <first>\n" to "<prefix> <last>\n".
+func lines(prefix string, first, last int) string {
+	var b strings.Builder
+	for i := first; i <= last; i++ {
+		fmt.Fprintf(&b, "%s %d\n", prefix, i)
+	}
+	return b.String()
+}
+
+func (s *rateLimitSuite) TestNew(c *C) {
+	_, err := servicelog.NewRateLimitWriter(&bytes.Buffer{}, "test", 0, 1)
+	c.Check(err, ErrorMatches, "log rate limit must be positive")
+	_, err = servicelog.NewRateLimitWriter(&bytes.Buffer{}, "test", 1, -1)
+	c.Check(err, ErrorMatches, "log rate limit burst must be positive")
+}
+
+func (s *rateLimitSuite) TestLimit(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	r, err := servicelog.NewRateLimitWriter(dest, "test", 10, 5)
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	// The limit counts lines, however they're written.
+	input := lines("burst", 1, 20)
+	n, err := io.WriteString(r, input)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, len(input))
+	c.Check(r.Suppressed(), Equals, int64(15))
+
+	// Credit for one line builds up every 100ms.
+	s.clock.Advance(500 * time.Millisecond)
+	for i := 1; i <= 10; i++ {
+		_, err := fmt.Fprintf(r, "more %d\n", i)
+		c.Assert(err, IsNil)
+	}
+	c.Check(r.Suppressed(), Equals, int64(20))
+	c.Check(dest.String(), Equals, lines("burst", 1, 5)+lines("more", 1, 5))
+
+	// The summary is written once due, even with nothing else written.
+	s.clock.Advance(500 * time.Millisecond)
+	expected := lines("burst", 1, 5) + lines("more", 1, 5) +
+		"[pebble] suppressed 20 log lines from service test\n"
+	waitFor(c, func() bool { return dest.String() == expected })
+
+	// There's no summary without lines suppressed.
+	_, err = io.WriteString(r, "quiet\n")
+	c.Assert(err, IsNil)
+	s.clock.Advance(time.Hour)
+	c.Assert(r.Close(), IsNil)
+	c.Check(dest.String(), Equals, expected+"quiet\n")
+}
+
+func (s *rateLimitSuite) TestPartialLines(c *C) {
+	dest := servicelogtest.NewScriptedWriter()
+	r, err := servicelog.NewRateLimitWriter(dest, "test", 2, 1)
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	// A line is passed on or suppressed whole, as decided by its start.
+	for _, p := range []string{"fir", "st\nsec", "ond\nthi"} {
+		_, err := io.WriteString(r, p)
+		c.Assert(err, IsNil)
+	}
+	c.Check(r.Suppressed(), Equals, int64(2))
+	s.clock.Advance(time.Second)
+	expected := "first\n[pebble] suppressed 2 log lines from service test\n"
+	waitFor(c, func() bool { return dest.String() == expected })
+
+	// A summary due in the middle of a line passed on waits for the line
+	// to be complete.
+	_, err = io.WriteString(r, "rd\nfourth\nfif")
+	c.Assert(err, IsNil)
+	s.clock.Advance(500 * time.Millisecond)
+	_, err = io.WriteString(r, "th\nsix")
+	c.Assert(err, IsNil)
+	s.clock.Advance(500 * time.Millisecond)
+	_, err = io.WriteString(r, "th\n")
+	c.Assert(err, IsNil)
+	expected += "fourth\nsixth\n[pebble] suppressed 1 log lines from service test\n"
+	waitFor(c, func() bool { return dest.String() == expected })
+}
+
+func (s *rateLimitSuite) TestFormatted(c *C) {
+	b := &bytes.Buffer{}
+	r, err := servicelog.NewRateLimitWriter(newFormatWriter(b, "test"), "test", 2, 2)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(r, "first\nsecond\nthird\n")
+	c.Assert(err, IsNil)
+	s.clock.Advance(500 * time.Millisecond)
+	_, err = io.WriteString(r, "incomp")
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(r, "lete")
+	c.Assert(err, IsNil)
+
+	// Closing writes the summary before it's due, after ending the incomplete line,
+	// with the formatter's prefix.
+	c.Assert(r.Close(), IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] second
+2021-05-13T03:16:51.501Z [test] incomplete [incomplete line]
+2021-05-13T03:16:51.501Z [test] [pebble] suppressed 1 log lines from service test
+`[1:])
+}
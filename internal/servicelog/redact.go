@@ -0,0 +1,243 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// RedactReplacement is what a RedactRule without a replacement replaces
+// its matches with.
+const RedactReplacement = "[REDACTED]"
+
+// RedactMaxLine is the length of the longest line a redaction writer holds
+// back to match whole. The start of a longer line is matched and passed on
+// as it is, and the rest of it matched separately.
+const RedactMaxLine = 64 * 1024
+
+// RedactRule is a pattern to mask in a service's output.
+type RedactRule struct {
+	// Pattern is matched against each line, without its newline.
+	Pattern *regexp.Regexp
+	// Replacement replaces each match of the pattern, with "$1" or
+	// "${name}" expanded to the submatches as by regexp.Regexp.Expand, so
+	// that a rule can mask a secret and keep what identifies it.
+	// RedactReplacement is used if it's empty.
+	Replacement string
+}
+
+// redactMatch is a match of a redaction rule in a line.
+type redactMatch struct {
+	start, end int
+	rule       int
+	submatches []int
+}
+
+type redactor struct {
+	mu           sync.Mutex
+	dest         io.Writer
+	rules        []RedactRule
+	replacements [][]byte
+	// line is the incomplete line held back, and out the line being
+	// redacted.
+	line    []byte
+	out     []byte
+	matches []redactMatch
+	stats   *writerStats
+}
+
+// NewRedactWriter returns a writer that masks the matches of the given
+// rules in each line of a service's output, on its way to dest, which is
+// usually a formatter. Lines are matched whole, so an incomplete line is
+// held back until it's complete, up to RedactMaxLine bytes. Where matches
+// of several rules overlap, the replacement of the first match covers all
+// of them. Closing the writer passes on an incomplete line held back, and
+// closes dest if it's an io.Closer.
+func NewRedactWriter(dest io.Writer, rules ...RedactRule) (io.Writer, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("no redaction rules given")
+	}
+	replacements := make([][]byte, len(rules))
+	for i, rule := range rules {
+		if rule.Pattern == nil {
+			return nil, fmt.Errorf("redaction rule %d has no pattern", i)
+		}
+		replacements[i] = []byte(rule.Replacement)
+	}
+	return &redactor{
+		dest:         dest,
+		rules:        append([]RedactRule(nil), rules...),
+		replacements: replacements,
+		stats:        &writerStats{},
+	}, nil
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Lines without matches are passed on in runs, the current one
+	// starting at run in p.
+	run := 0
+	for pos := 0; pos < len(p); {
+		chunk := p[pos:]
+		end := false
+		if i := bytes.IndexByte(chunk, '\n'); i >= 0 {
+			chunk = chunk[:i+1]
+			end = true
+		}
+		held := len(r.line) > 0
+		if !end || held {
+			// The line is held back until it's complete, unless it's too
+			// long. The run so far goes out first.
+			if held || len(chunk) < RedactMaxLine {
+				if n, err := r.stats.writeFull(r.dest, p[run:pos]); err != nil {
+					return run + n, err
+				}
+				r.line = append(r.line, chunk...)
+				pos += len(chunk)
+				run = pos
+				if !end && len(r.line) < RedactMaxLine {
+					continue
+				}
+				line := r.line
+				r.line = r.line[:0]
+				if err := r.writeLine(line); err != nil {
+					return pos - len(chunk), err
+				}
+				continue
+			}
+		}
+		if r.redact(chunk) != nil {
+			if n, err := r.stats.writeFull(r.dest, p[run:pos]); err != nil {
+				return run + n, err
+			}
+			if _, err := r.stats.writeFull(r.dest, r.out); err != nil {
+				return pos, err
+			}
+			pos += len(chunk)
+			run = pos
+			continue
+		}
+		pos += len(chunk)
+	}
+	if n, err := r.stats.writeFull(r.dest, p[run:]); err != nil {
+		return run + n, err
+	}
+	return len(p), nil
+}
+
+// writeLine writes line, or the start of one, redacted.
+func (r *redactor) writeLine(line []byte) error {
+	if out := r.redact(line); out != nil {
+		line = out
+	}
+	_, err := r.stats.writeFull(r.dest, line)
+	return err
+}
+
+// redact returns line, or the start of one, with the matches of the rules
+// masked, or nil if there are none. The result is only valid until the
+// next call.
+func (r *redactor) redact(line []byte) []byte {
+	body := line
+	if len(body) > 0 && body[len(body)-1] == '\n' {
+		body = body[:len(body)-1]
+	}
+	r.matches = r.matches[:0]
+	for i, rule := range r.rules {
+		// Match doesn't allocate, so lines without secrets are cheap.
+		if !rule.Pattern.Match(body) {
+			continue
+		}
+		for _, m := range rule.Pattern.FindAllSubmatchIndex(body, -1) {
+			if m[0] < m[1] {
+				r.matches = append(r.matches, redactMatch{m[0], m[1], i, m})
+			}
+		}
+	}
+	if len(r.matches) == 0 {
+		return nil
+	}
+	sort.Slice(r.matches, func(i, j int) bool {
+		a, b := r.matches[i], r.matches[j]
+		return a.start < b.start || a.start == b.start && a.end > b.end
+	})
+
+	out := r.out[:0]
+	pos := 0
+	for i := 0; i < len(r.matches); {
+		m := r.matches[i]
+		end := m.end
+		for i++; i < len(r.matches) && r.matches[i].start < end; i++ {
+			if r.matches[i].end > end {
+				end = r.matches[i].end
+			}
+		}
+		out = append(out, body[pos:m.start]...)
+		if replacement := r.replacements[m.rule]; len(replacement) > 0 {
+			out = r.rules[m.rule].Pattern.Expand(out, replacement, body, m.submatches)
+		} else {
+			out = append(out, RedactReplacement...)
+		}
+		pos = end
+	}
+	out = append(out, line[pos:]...)
+	r.out = out
+	return out
+}
+
+// Stats returns the writer's statistics. It never drops lines.
+func (r *redactor) Stats() WriterStats {
+	return r.stats.snapshot()
+}
+
+// flushIdle passes on the incomplete line held back, redacted, for an
+// IdleFlushWriter. The rest of the line is matched separately, as for a
+// line too long to hold back.
+func (r *redactor) flushIdle() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.line) > 0 {
+		line := r.line
+		r.line = r.line[:0]
+		if err := r.writeLine(line); err != nil {
+			return err
+		}
+	}
+	return flushIdle(r.dest)
+}
+
+// Close passes on the incomplete line held back, if any, and closes dest
+// if it's an io.Closer.
+func (r *redactor) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	if len(r.line) > 0 {
+		line := r.line
+		r.line = nil
+		err = r.writeLine(line)
+	}
+	if closeErr := closeWriter(r.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
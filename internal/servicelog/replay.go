@@ -0,0 +1,378 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A capture records the chunks written to a log pipeline so that they can
+// be replayed later, with the same chunk boundaries and pacing. It starts
+// with a header of captureMagic followed by the capture's start time (Unix
+// nanoseconds, 8 bytes big-endian), and has a record for each chunk:
+//
+//	uvarint  nanoseconds since the start time
+//	uvarint  length of the chunk
+//	bytes    the chunk itself
+//
+// An empty capture (no header) holds no chunks.
+const captureMagic = "pebble-log-capture-1\n"
+
+const captureHeaderSize = len(captureMagic) + 8
+
+var (
+	// ErrTruncatedCapture is returned after reading or replaying all the
+	// complete records of a capture that ends part way through a record.
+	ErrTruncatedCapture = errors.New("capture is truncated")
+	// ErrInvalidCapture is returned when reading data that isn't a capture.
+	ErrInvalidCapture = errors.New("invalid capture")
+)
+
+// Recorder is an io.Writer that records each chunk written to it to a
+// capture before passing it on to its destination.
+type Recorder struct {
+	mu      sync.Mutex
+	dest    io.Writer
+	capture io.Writer
+	started bool
+	start   time.Time
+	buf     []byte
+	err     error
+	closed  bool
+}
+
+// NewRecorder returns a Recorder writing to dest and recording to capture.
+// The capture's header is written along with the first chunk.
+func NewRecorder(dest, capture io.Writer) *Recorder {
+	return &Recorder{dest: dest, capture: capture}
+}
+
+// Write records p and writes it to the destination. Failing to record p
+// doesn't fail the write, but stops the recording (see Err). Writes after
+// Close fail with io.ErrClosedPipe.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if r.err == nil && len(p) > 0 {
+		r.record(p)
+	}
+	r.mu.Unlock()
+	return r.dest.Write(p)
+}
+
+// Close closes the destination, if it's an io.Closer, so that it can pass
+// on anything it holds. It doesn't close the capture. Closing the recorder
+// again does nothing.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.mu.Unlock()
+	return closeWriter(r.dest)
+}
+
+func (r *Recorder) record(p []byte) {
+	now := clock.Now()
+	r.buf = r.buf[:0]
+	if !r.started {
+		r.started = true
+		r.start = now
+		r.buf = append(r.buf, captureMagic...)
+		var start [8]byte
+		binary.BigEndian.PutUint64(start[:], uint64(now.UnixNano()))
+		r.buf = append(r.buf, start[:]...)
+	}
+	offset := now.Sub(r.start)
+	if offset < 0 {
+		offset = 0
+	}
+	var header [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(offset))
+	n += binary.PutUvarint(header[n:], uint64(len(p)))
+	r.buf = append(r.buf, header[:n]...)
+	r.buf = append(r.buf, p...)
+	_, r.err = writeFull(r.capture, r.buf)
+}
+
+// Err returns the error that stopped the recording, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// CaptureChunk is a chunk read from a capture, with the time it was
+// written to the recorder.
+type CaptureChunk struct {
+	Time time.Time
+	Data []byte
+}
+
+// CaptureReader reads the chunks of a capture.
+type CaptureReader struct {
+	r      *bufio.Reader
+	header bool
+	start  time.Time
+	chunk  CaptureChunk
+	err    error
+}
+
+// NewCaptureReader returns a CaptureReader reading the capture from r.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r)}
+}
+
+// Next reads the next chunk, returning false at the end of the capture or
+// on error (see Err).
+func (cr *CaptureReader) Next() bool {
+	if cr.err != nil {
+		return false
+	}
+	// Once the header is read, the capture can only end cleanly after
+	// the first record, as the recorder writes them together.
+	partial := 0
+	if !cr.header {
+		partial = 1
+		var header [captureHeaderSize]byte
+		n, err := io.ReadFull(cr.r, header[:])
+		if err != nil {
+			cr.err = cr.readError(n, err)
+			return false
+		}
+		if string(header[:len(captureMagic)]) != captureMagic {
+			cr.err = ErrInvalidCapture
+			return false
+		}
+		cr.start = time.Unix(0, int64(binary.BigEndian.Uint64(header[len(captureMagic):])))
+		cr.header = true
+	}
+
+	offset, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		// A clean end of the capture comes between records.
+		cr.err = cr.readError(partial, err)
+		return false
+	}
+	length, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		cr.err = cr.readError(1, err)
+		return false
+	}
+	// Don't trust the length with an allocation before reading the data.
+	data, err := readCaptureData(cr.r, length)
+	if err != nil {
+		cr.err = cr.readError(1, err)
+		return false
+	}
+	cr.chunk = CaptureChunk{
+		Time: cr.start.Add(time.Duration(offset)),
+		Data: data,
+	}
+	return true
+}
+
+// readError translates an error from reading a capture, after n bytes of
+// the current item were read.
+func (cr *CaptureReader) readError(n int, err error) error {
+	switch {
+	case err == io.EOF && n == 0:
+		return nil
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return ErrTruncatedCapture
+	}
+	return err
+}
+
+func readCaptureData(r io.Reader, length uint64) ([]byte, error) {
+	const chunkSize = 64 * 1024
+	var data []byte
+	for uint64(len(data)) < length {
+		n := length - uint64(len(data))
+		if n > chunkSize {
+			n = chunkSize
+		}
+		start := len(data)
+		data = append(data, make([]byte, n)...)
+		_, err := io.ReadFull(r, data[start:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Chunk returns the chunk read by the last call to Next.
+func (cr *CaptureReader) Chunk() CaptureChunk {
+	return cr.chunk
+}
+
+// Err returns the error that stopped Next, or nil if it reached the end of
+// the capture. It returns ErrTruncatedCapture if the capture ends part way
+// through a record.
+func (cr *CaptureReader) Err() error {
+	return cr.err
+}
+
+// Replay writes each chunk of the capture read from r to dest in a single
+// write, preserving the chunk boundaries. If speed is greater than zero the
+// original pacing is reproduced, scaled by speed (2 replays twice as fast);
+// otherwise chunks are written as fast as dest accepts them.
+//
+// A truncated capture is replayed up to the last complete record, and then
+// ErrTruncatedCapture is returned.
+func Replay(r io.Reader, dest io.Writer, speed float64) error {
+	cr := NewCaptureReader(r)
+	var first, started time.Time
+	for i := 0; cr.Next(); i++ {
+		chunk := cr.Chunk()
+		if speed > 0 {
+			if i == 0 {
+				first = chunk.Time
+				started = clock.Now()
+			}
+			due := started.Add(time.Duration(float64(chunk.Time.Sub(first)) / speed))
+			if wait := due.Sub(clock.Now()); wait > 0 {
+				timer := clock.NewTimer(wait)
+				<-timer.C()
+			}
+		}
+		if _, err := writeFull(dest, chunk.Data); err != nil {
+			return err
+		}
+	}
+	return cr.Err()
+}
+
+// NewPipeline returns a writer passing its input through the stages given
+// in spec to dest, for replaying captures through the same stages as a
+// service's logs. The spec is a comma-separated list of stages, in the
+// order data flows through them:
+//
+//	decode=ENCODING convert output in ENCODING to UTF-8 (see NewDecodeWriter)
+//	format[=NAME]   format lines as for service NAME ("replay" by default)
+//	ring[=SIZE]     pass data through a ring buffer of SIZE bytes (by
+//	                default the size of a service's log buffer)
+//
+// Closing the pipeline closes its stages, from the first, so that anything
+// they hold is passed on and an incomplete last line is ended, and then its
+// ring buffers. It doesn't close dest.
+func NewPipeline(spec string, dest io.Writer) (io.WriteCloser, error) {
+	p := &pipeline{head: dest}
+	stages := strings.Split(spec, ",")
+	for i := len(stages) - 1; i >= 0; i-- {
+		stage := strings.TrimSpace(stages[i])
+		name, arg := stage, ""
+		if eq := strings.IndexByte(stage, '='); eq >= 0 {
+			name, arg = stage[:eq], stage[eq+1:]
+		}
+		switch name {
+		case "decode":
+			switch arg {
+			case EncodingAuto, EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE:
+			default:
+				p.Close()
+				return nil, fmt.Errorf("invalid pipeline encoding %q", arg)
+			}
+			p.head = NewDecodeWriter(p.head, arg)
+			p.stages = append(p.stages, p.head)
+		case "format":
+			if arg == "" {
+				arg = "replay"
+			}
+			p.head, _ = NewFormatWriter(p.head, arg) // can't fail without options
+			p.stages = append(p.stages, p.head)
+		case "ring":
+			size := defaultPipelineRingSize
+			if arg != "" {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n <= 0 {
+					p.Close()
+					return nil, fmt.Errorf("invalid pipeline ring size %q", arg)
+				}
+				size = n
+			}
+			ring := &ringStage{rb: NewRingBuffer(size), dest: p.head}
+			p.rings = append(p.rings, ring.rb)
+			p.head = ring
+		default:
+			p.Close()
+			return nil, fmt.Errorf("invalid pipeline stage %q", stage)
+		}
+	}
+	return p, nil
+}
+
+// defaultPipelineRingSize matches the size of a service's log buffer.
+const defaultPipelineRingSize = 100 * 1024
+
+type pipeline struct {
+	head io.Writer
+	// stages are the stages that may hold data, last first.
+	stages []io.Writer
+	rings  []*RingBuffer
+}
+
+func (p *pipeline) Write(b []byte) (int, error) {
+	return p.head.Write(b)
+}
+
+func (p *pipeline) Close() error {
+	var err error
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		if closeErr := closeWriter(p.stages[i]); err == nil {
+			err = closeErr
+		}
+	}
+	p.stages = nil
+	for _, rb := range p.rings {
+		rb.Close()
+	}
+	return err
+}
+
+// ringStage writes to a ring buffer and copies what was written on to the
+// next stage, as a service's output copier would.
+type ringStage struct {
+	rb   *RingBuffer
+	dest io.Writer
+	pos  RingPos
+}
+
+func (s *ringStage) Write(p []byte) (int, error) {
+	n, err := s.rb.Write(p)
+	next, _, copyErr := s.rb.WriteTo(s.dest, s.pos)
+	s.pos = next
+	if err == nil {
+		err = copyErr
+	}
+	return n, err
+}
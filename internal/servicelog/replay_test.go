@@ -0,0 +1,302 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type replaySuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&replaySuite{})
+
+var replayStart = time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)
+
+func (s *replaySuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(replayStart)
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *replaySuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// replayChunks are written to a recorder with the given delay before each.
+var replayChunks = []struct {
+	delay time.Duration
+	data  string
+}{
+	{0, "first line\nsecond "},
+	{1001 * time.Millisecond, "line\n"},
+	{0, "third line, "},
+	{2500 * time.Millisecond, "in three "},
+	{time.Millisecond, "parts\nno newline"},
+}
+
+// chunkWriter records the boundaries of the writes made to it.
+type chunkWriter struct {
+	bytes.Buffer
+	chunks []string
+	writes chan string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, string(p))
+	if w.writes != nil {
+		w.writes <- string(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+// record writes replayChunks through the pipeline given by spec, starting
+// at replayStart, and returns the capture and the pipeline's output.
+func (s *replaySuite) record(c *C, spec string) (capture []byte, output *chunkWriter) {
+	s.clock = servicelog.NewTestClock(replayStart)
+	servicelog.FakeClock(s.clock)
+	output = &chunkWriter{}
+	pipeline, err := servicelog.NewPipeline(spec, output)
+	c.Assert(err, IsNil)
+	defer pipeline.Close()
+	var buf bytes.Buffer
+	recorder := servicelog.NewRecorder(pipeline, &buf)
+	for _, chunk := range replayChunks {
+		s.clock.Advance(chunk.delay)
+		n, err := recorder.Write([]byte(chunk.data))
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(chunk.data))
+	}
+	c.Assert(recorder.Err(), IsNil)
+	return buf.Bytes(), output
+}
+
+func (s *replaySuite) TestCaptureReader(c *C) {
+	capture, output := s.record(c, "format=svc")
+	c.Check(output.String(), Equals, `
+2021-05-13T03:16:51.001Z [svc] first line
+2021-05-13T03:16:51.001Z [svc] second line
+2021-05-13T03:16:52.002Z [svc] third line, in three parts
+2021-05-13T03:16:54.503Z [svc] no newline [incomplete line]
+`[1:])
+
+	r := servicelog.NewCaptureReader(bytes.NewReader(capture))
+	when := replayStart
+	for _, chunk := range replayChunks {
+		c.Assert(r.Next(), Equals, true)
+		when = when.Add(chunk.delay)
+		c.Check(r.Chunk().Time.Equal(when), Equals, true, Commentf("%s != %s", r.Chunk().Time, when))
+		c.Check(string(r.Chunk().Data), Equals, chunk.data)
+	}
+	c.Check(r.Next(), Equals, false)
+	c.Check(r.Err(), IsNil)
+}
+
+func (s *replaySuite) TestRoundTrip(c *C) {
+	for _, spec := range []string{"format=svc", "format=svc,ring=100", "ring,format", "decode=auto,format"} {
+		capture, original := s.record(c, spec)
+
+		// Replay from the same time with the original pacing, so that the
+		// formatter's timestamps are the same too.
+		clock := servicelog.NewTestClock(replayStart)
+		restore := servicelog.FakeClock(clock)
+		replayed := &chunkWriter{}
+		pipeline, err := servicelog.NewPipeline(spec, replayed)
+		c.Assert(err, IsNil)
+		done := make(chan error, 1)
+		go func() {
+			done <- servicelog.Replay(bytes.NewReader(capture), pipeline, 1)
+		}()
+		for _, chunk := range replayChunks[1:] {
+			if chunk.delay == 0 {
+				continue
+			}
+			select {
+			case err := <-done:
+				c.Fatalf("pipeline %q: %v", spec, err)
+			default:
+			}
+			waitTimer(c, clock)
+			clock.Advance(chunk.delay)
+		}
+		c.Assert(<-done, IsNil)
+		pipeline.Close()
+		restore()
+
+		c.Check(replayed.String(), Equals, original.String(), Commentf("pipeline %q", spec))
+		c.Check(replayed.chunks, DeepEquals, original.chunks, Commentf("pipeline %q", spec))
+	}
+}
+
+// waitTimer waits for the code under test to start waiting on a timer.
+func waitTimer(c *C, clock *servicelog.TestClock) {
+	for i := 0; clock.Pending() == 0; i++ {
+		if i >= 1000 {
+			c.Fatalf("timed out waiting for timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *replaySuite) TestReplayScaledPacing(c *C) {
+	capture, _ := s.record(c, "format")
+
+	clock := servicelog.NewTestClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer servicelog.FakeClock(clock)()
+	output := &chunkWriter{writes: make(chan string, len(replayChunks))}
+	done := make(chan error, 1)
+	go func() {
+		done <- servicelog.Replay(bytes.NewReader(capture), output, 4)
+	}()
+
+	for _, chunk := range replayChunks {
+		if chunk.delay > 0 {
+			waitTimer(c, clock)
+			select {
+			case data := <-output.writes:
+				c.Fatalf("chunk %q written early", data)
+			default:
+			}
+			clock.Advance(chunk.delay / 4)
+		}
+		select {
+		case data := <-output.writes:
+			c.Check(data, Equals, chunk.data)
+		case <-time.After(time.Second):
+			c.Fatalf("timed out waiting for chunk %q", chunk.data)
+		}
+	}
+	c.Assert(<-done, IsNil)
+}
+
+func (s *replaySuite) TestReplayUnpaced(c *C) {
+	capture, _ := s.record(c, "ring")
+
+	output := &chunkWriter{}
+	err := servicelog.Replay(bytes.NewReader(capture), output, 0)
+	c.Assert(err, IsNil)
+	c.Check(s.clock.Pending(), Equals, 0)
+	c.Assert(output.chunks, HasLen, len(replayChunks))
+	for i, chunk := range replayChunks {
+		c.Check(output.chunks[i], Equals, chunk.data)
+	}
+}
+
+func (s *replaySuite) TestTruncated(c *C) {
+	capture, _ := s.record(c, "format")
+
+	// Find where each record ends, working back from the end of the
+	// capture.
+	var elapsed time.Duration
+	var sizes []int
+	var varint [binary.MaxVarintLen64]byte
+	for _, chunk := range replayChunks {
+		elapsed += chunk.delay
+		size := binary.PutUvarint(varint[:], uint64(elapsed))
+		size += binary.PutUvarint(varint[:], uint64(len(chunk.data)))
+		sizes = append(sizes, size+len(chunk.data))
+	}
+	ends := make([]int, len(sizes))
+	end := len(capture)
+	for i := len(sizes) - 1; i >= 0; i-- {
+		ends[i] = end
+		end -= sizes[i]
+	}
+
+	for size := 0; size < len(capture); size++ {
+		complete := 0
+		for complete < len(ends) && ends[complete] <= size {
+			complete++
+		}
+		output := &chunkWriter{}
+		err := servicelog.Replay(bytes.NewReader(capture[:size]), output, 0)
+		if size == 0 || (complete > 0 && ends[complete-1] == size) {
+			c.Check(err, IsNil, Commentf("size %d", size))
+		} else {
+			c.Check(err, Equals, servicelog.ErrTruncatedCapture, Commentf("size %d", size))
+		}
+		c.Assert(output.chunks, HasLen, complete, Commentf("size %d", size))
+		for i := 0; i < complete; i++ {
+			c.Check(output.chunks[i], Equals, replayChunks[i].data)
+		}
+	}
+}
+
+func (s *replaySuite) TestInvalid(c *C) {
+	r := servicelog.NewCaptureReader(bytes.NewReader([]byte("2021-05-13T03:16:51.001Z [svc] not a capture\n")))
+	c.Check(r.Next(), Equals, false)
+	c.Check(r.Err(), Equals, servicelog.ErrInvalidCapture)
+}
+
+func (s *replaySuite) TestRecorderCaptureError(c *C) {
+	var output bytes.Buffer
+	recorder := servicelog.NewRecorder(&output, failingWriter(errors.New("disk full")))
+	for _, chunk := range replayChunks {
+		_, err := io.WriteString(recorder, chunk.data)
+		c.Assert(err, IsNil)
+	}
+	c.Check(recorder.Err(), ErrorMatches, "disk full")
+	c.Check(output.String(), Equals, "first line\nsecond line\nthird line, in three parts\nno newline")
+}
+
+func (s *replaySuite) TestRecorderClose(c *C) {
+	output := &closeRecorder{}
+	var capture bytes.Buffer
+	recorder := servicelog.NewRecorder(output, &capture)
+	_, err := io.WriteString(recorder, "one\n")
+	c.Assert(err, IsNil)
+	c.Check(recorder.Close(), IsNil)
+	c.Check(output.closed, Equals, true)
+
+	// Closing again does nothing, and writes fail without being recorded.
+	output.closed = false
+	c.Check(recorder.Close(), IsNil)
+	c.Check(output.closed, Equals, false)
+	recorded := capture.Len()
+	_, err = io.WriteString(recorder, "two\n")
+	c.Check(err, Equals, io.ErrClosedPipe)
+	c.Check(output.String(), Equals, "one\n")
+	c.Check(capture.Len(), Equals, recorded)
+}
+
+func (s *replaySuite) TestPipelineClose(c *C) {
+	output := &closeRecorder{}
+	pipeline, err := servicelog.NewPipeline("format=svc,ring", output)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(pipeline, "one\ntwo")
+	c.Assert(err, IsNil)
+	c.Check(pipeline.Close(), IsNil)
+	c.Check(output.String(), Equals, ""+
+		"2021-05-13T03:16:51.001Z [svc] one\n"+
+		"2021-05-13T03:16:51.001Z [svc] two"+servicelog.IncompleteLineMarker+"\n")
+	c.Check(output.closed, Equals, false)
+}
+
+func (s *replaySuite) TestPipelineErrors(c *C) {
+	for _, spec := range []string{"", "format,", "filter", "ring=0", "ring=1MB", "decode", "decode=latin1"} {
+		_, err := servicelog.NewPipeline(spec, ioutil.Discard)
+		c.Check(err, ErrorMatches, `invalid pipeline (stage|ring size|encoding) ".*"`, Commentf("spec %q", spec))
+	}
+}
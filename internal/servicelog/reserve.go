@@ -0,0 +1,215 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"sync"
+	"time"
+)
+
+// ReserveChunk is the granularity in bytes of the memory buffers borrow
+// from a Reserve, so that a burst of small writes doesn't reallocate the
+// buffer for each of them.
+const ReserveChunk = 16 * 1024
+
+// Reserve is a pool of memory shared by log buffers to absorb bursts. A
+// buffer keeps its base size, and when more than that is written to it
+// within the loan duration, so a write would evict recent data, it borrows
+// from the reserve to grow instead, up to the reserve's per-buffer limit.
+// Borrowed memory also counts against the buffer's Budget.
+//
+// A buffer returns its loan, shrinking back to its base size and evicting
+// its oldest data, once it hasn't borrowed for the loan duration. When the
+// reserve runs out, a buffer that needs to borrow reclaims memory from the
+// buffer with the largest loan (or any expired one), so that no buffer can
+// hold on to the reserve while others need it. A nil *Reserve lends
+// nothing.
+type Reserve struct {
+	mu          sync.Mutex
+	limit       int
+	bufferLimit int
+	duration    time.Duration
+	lent        int
+	loans       map[*RingBuffer]*loan
+	stats       ReserveStats
+}
+
+type loan struct {
+	size int
+	last time.Time
+}
+
+// ReserveStats is a snapshot of a Reserve's accounting.
+type ReserveStats struct {
+	// Limit is the size of the reserve in bytes.
+	Limit int64
+	// BufferLimit is the most a single buffer may borrow, in bytes.
+	BufferLimit int64
+	// Lent is the number of bytes currently lent to buffers.
+	Lent int64
+	// Loans is the number of buffers currently borrowing.
+	Loans int64
+	// Borrows is the number of loans granted (or extended).
+	Borrows int64
+	// Denied is the number of loans refused because the reserve or the
+	// budget had run out.
+	Denied int64
+	// Returned is the number of bytes buffers returned as their loans
+	// expired or they were shrunk or freed.
+	Returned int64
+	// Reclaimed is the number of bytes reclaimed from buffers for others
+	// that needed to borrow.
+	Reclaimed int64
+}
+
+// NewReserve returns a reserve of limit bytes, of which each buffer may
+// borrow up to bufferLimit bytes, keeping its loan until it hasn't
+// borrowed for duration.
+func NewReserve(limit, bufferLimit int, duration time.Duration) *Reserve {
+	if bufferLimit > limit {
+		bufferLimit = limit
+	}
+	return &Reserve{
+		limit:       limit,
+		bufferLimit: bufferLimit,
+		duration:    duration,
+		loans:       make(map[*RingBuffer]*loan),
+	}
+}
+
+// borrow lends rb up to want bytes, reserving them from budget too, and
+// returns the number of bytes lent. If it lends nothing, it may return
+// another buffer to reclaim n bytes from, which the caller must do with
+// victim.repay once it no longer holds rb's lock.
+func (r *Reserve) borrow(rb *RingBuffer, want int, budget *Budget) (lent int, victim *RingBuffer, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := 0
+	if l := r.loans[rb]; l != nil {
+		current = l.size
+	}
+	if want%ReserveChunk != 0 {
+		want += ReserveChunk - want%ReserveChunk
+	}
+	if want > r.bufferLimit-current {
+		want = r.bufferLimit - current
+	}
+	if want <= 0 {
+		return 0, nil, 0
+	}
+	if free := r.limit - r.lent; free > 0 {
+		max := want
+		if max > free {
+			max = free
+		}
+		min := ReserveChunk
+		if min > max {
+			min = max
+		}
+		lent = budget.Reserve(min, max)
+		if lent > 0 {
+			l := r.loans[rb]
+			if l == nil {
+				l = &loan{}
+				r.loans[rb] = l
+			}
+			l.size += lent
+			l.last = clock.Now()
+			r.lent += lent
+			r.stats.Borrows++
+			return lent, nil, 0
+		}
+	}
+	r.stats.Denied++
+
+	// Reclaim from an expired loan, largest first, or failing that from
+	// the largest loan if it's larger than rb's.
+	var victimLoan *loan
+	now := clock.Now()
+	for other, l := range r.loans {
+		if other == rb {
+			continue
+		}
+		expired := now.Sub(l.last) >= r.duration
+		victimExpired := victimLoan != nil && now.Sub(victimLoan.last) >= r.duration
+		switch {
+		case victimLoan == nil,
+			expired && !victimExpired,
+			expired == victimExpired && l.size > victimLoan.size:
+			victim, victimLoan = other, l
+		}
+	}
+	if victim == nil {
+		return 0, nil, 0
+	}
+	n = victimLoan.size
+	if now.Sub(victimLoan.last) < r.duration {
+		n -= current
+	}
+	if n > want {
+		n = want
+	}
+	if n <= 0 {
+		return 0, nil, 0
+	}
+	return 0, victim, n
+}
+
+// repaid records that rb returned n bytes of its loan.
+func (r *Reserve) repaid(rb *RingBuffer, n int, reclaimed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.loans[rb]
+	if l == nil {
+		return
+	}
+	if n > l.size {
+		n = l.size
+	}
+	l.size -= n
+	r.lent -= n
+	if reclaimed {
+		r.stats.Reclaimed += int64(n)
+	} else {
+		r.stats.Returned += int64(n)
+	}
+	if l.size == 0 {
+		delete(r.loans, rb)
+	}
+}
+
+// expired reports whether rb's loan has expired.
+func (r *Reserve) expired(rb *RingBuffer) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.loans[rb]
+	return l != nil && clock.Now().Sub(l.last) >= r.duration
+}
+
+// Stats returns a snapshot of the reserve's accounting.
+func (r *Reserve) Stats() ReserveStats {
+	if r == nil {
+		return ReserveStats{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Limit = int64(r.limit)
+	stats.BufferLimit = int64(r.bufferLimit)
+	stats.Lent = int64(r.lent)
+	stats.Loans = int64(len(r.loans))
+	return stats
+}
@@ -0,0 +1,376 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type reserveSuite struct{}
+
+var _ = Suite(&reserveSuite{})
+
+const chunk = servicelog.ReserveChunk
+
+func (s *reserveSuite) TestBorrow(c *C) {
+	reserve := servicelog.NewReserve(4*chunk, 2*chunk, time.Minute)
+	rb := servicelog.NewRingBuffer(1024)
+	rb.SetReserve(reserve)
+
+	// Writes that fit in the base size don't borrow.
+	_, err := rb.Write(bytes.Repeat([]byte("a"), 1024))
+	c.Assert(err, IsNil)
+	c.Check(rb.Size(), Equals, 1024)
+	c.Check(rb.Borrowed(), Equals, 0)
+
+	// A write that would evict data borrows a chunk instead.
+	_, err = rb.Write([]byte("b"))
+	c.Assert(err, IsNil)
+	c.Check(rb.Size(), Equals, 1024+chunk)
+	c.Check(rb.Borrowed(), Equals, chunk)
+	c.Check(rb.Buffered(), Equals, 1025)
+	c.Check(reserve.Stats(), Equals, servicelog.ReserveStats{
+		Limit:       4 * chunk,
+		BufferLimit: 2 * chunk,
+		Lent:        chunk,
+		Loans:       1,
+		Borrows:     1,
+	})
+
+	// The data is all still there, in order.
+	buf := make([]byte, 1025)
+	start, _ := rb.Positions()
+	_, n, err := rb.Copy(buf, start)
+	c.Assert(err, Equals, io.EOF)
+	c.Check(n, Equals, 1025)
+	c.Check(string(buf), Equals, string(bytes.Repeat([]byte("a"), 1024))+"b")
+
+	// A large write borrows as many chunks as it needs, up to the buffer
+	// limit, and then evicts data.
+	_, err = rb.Write(bytes.Repeat([]byte("c"), 2*chunk))
+	c.Assert(err, IsNil)
+	c.Check(rb.Borrowed(), Equals, 2*chunk)
+	c.Check(rb.Buffered(), Equals, 1024+2*chunk)
+	c.Check(reserve.Stats().Lent, Equals, int64(2*chunk))
+	c.Check(reserve.Stats().Borrows, Equals, int64(2))
+
+	// More writes at the limit don't go to the reserve.
+	_, err = rb.Write([]byte("d"))
+	c.Assert(err, IsNil)
+	c.Check(reserve.Stats().Borrows, Equals, int64(2))
+	c.Check(reserve.Stats().Denied, Equals, int64(0))
+}
+
+func (s *reserveSuite) TestNoBurst(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 0, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	reserve := servicelog.NewReserve(4*chunk, 4*chunk, time.Minute)
+	rb := servicelog.NewRingBuffer(1024)
+	rb.SetReserve(reserve)
+	_, err := rb.Write(bytes.Repeat([]byte("a"), 1000))
+	c.Assert(err, IsNil)
+	clock.Advance(time.Minute)
+
+	// A full buffer written to slowly evicts its oldest data, as that's
+	// older than the loan duration, rather than borrowing.
+	for i := 0; i < 10; i++ {
+		clock.Advance(20 * time.Second)
+		_, err = rb.Write(bytes.Repeat([]byte("b"), 100))
+		c.Assert(err, IsNil)
+	}
+	c.Check(rb.Borrowed(), Equals, 0)
+	c.Check(rb.Buffered(), Equals, 1024)
+	c.Check(reserve.Stats(), Equals, servicelog.ReserveStats{
+		Limit:       4 * chunk,
+		BufferLimit: 4 * chunk,
+	})
+}
+
+func (s *reserveSuite) TestBudget(c *C) {
+	// Loans are reserved from the buffer's budget too, and refused if it
+	// has run out.
+	budget := servicelog.NewBudget(1024 + chunk + 100)
+	reserve := servicelog.NewReserve(4*chunk, 4*chunk, time.Minute)
+	rb := servicelog.NewRingBufferWithBudget(1024, budget)
+	rb.SetReserve(reserve)
+
+	_, err := rb.Write(bytes.Repeat([]byte("a"), 1025))
+	c.Assert(err, IsNil)
+	c.Check(rb.Borrowed(), Equals, chunk)
+	c.Check(budget.Stats().Used, Equals, int64(1024+chunk))
+
+	_, err = rb.Write(bytes.Repeat([]byte("b"), chunk))
+	c.Assert(err, IsNil)
+	c.Check(rb.Borrowed(), Equals, chunk)
+	c.Check(budget.Stats().Used, Equals, int64(1024+chunk))
+	c.Check(reserve.Stats().Denied, Equals, int64(1))
+
+	rb.Free()
+	c.Check(budget.Stats().Used, Equals, int64(0))
+	c.Check(reserve.Stats().Lent, Equals, int64(0))
+	c.Check(reserve.Stats().Loans, Equals, int64(0))
+	c.Check(reserve.Stats().Returned, Equals, int64(chunk))
+}
+
+func (s *reserveSuite) TestLoanExpiry(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 0, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	budget := servicelog.NewBudget(0)
+	reserve := servicelog.NewReserve(4*chunk, 4*chunk, time.Minute)
+	rb := servicelog.NewRingBufferWithBudget(1024, budget)
+	rb.SetReserve(reserve)
+	_, err := rb.Write(bytes.Repeat([]byte("a"), 1024+chunk-10))
+	c.Assert(err, IsNil)
+	c.Check(rb.Borrowed(), Equals, chunk)
+
+	// The loan is kept while it's younger than the loan duration.
+	clock.Advance(59 * time.Second)
+	_, err = rb.Write([]byte("b"))
+	c.Assert(err, IsNil)
+	c.Check(rb.Borrowed(), Equals, chunk)
+
+	// Once it has expired, the next write returns it, keeping the most
+	// recent data.
+	clock.Advance(time.Second)
+	_, err = rb.Write([]byte("c"))
+	c.Assert(err, IsNil)
+	c.Check(rb.Borrowed(), Equals, 0)
+	c.Check(rb.Size(), Equals, 1024)
+	c.Check(rb.Buffered(), Equals, 1024)
+	c.Check(budget.Stats().Used, Equals, int64(1024))
+	stats := reserve.Stats()
+	c.Check(stats.Lent, Equals, int64(0))
+	c.Check(stats.Returned, Equals, int64(chunk))
+	buf := make([]byte, 3)
+	_, end := rb.Positions()
+	_, _, err = rb.Copy(buf, end-3)
+	c.Assert(err, Equals, io.EOF)
+	c.Check(string(buf), Equals, "abc")
+}
+
+func (s *reserveSuite) TestReclaim(c *C) {
+	reserve := servicelog.NewReserve(2*chunk, 2*chunk, time.Minute)
+	greedy := servicelog.NewRingBuffer(1024)
+	greedy.SetReserve(reserve)
+	other := servicelog.NewRingBuffer(1024)
+	other.SetReserve(reserve)
+
+	_, err := greedy.Write(bytes.Repeat([]byte("a"), 1024+2*chunk))
+	c.Assert(err, IsNil)
+	c.Check(greedy.Borrowed(), Equals, 2*chunk)
+
+	// The reserve is exhausted, so the other buffer reclaims half of the
+	// greedy buffer's loan.
+	_, err = other.Write(bytes.Repeat([]byte("b"), 1025))
+	c.Assert(err, IsNil)
+	c.Check(other.Borrowed(), Equals, chunk)
+	c.Check(other.Buffered(), Equals, 1025)
+	c.Check(greedy.Borrowed(), Equals, chunk)
+	c.Check(greedy.Buffered(), Equals, 1024+chunk)
+	c.Check(reserve.Stats(), Equals, servicelog.ReserveStats{
+		Limit:       2 * chunk,
+		BufferLimit: 2 * chunk,
+		Lent:        2 * chunk,
+		Loans:       2,
+		Borrows:     2,
+		Denied:      1,
+		Reclaimed:   chunk,
+	})
+
+	// With equal loans, neither reclaims from the other.
+	_, err = other.Write(bytes.Repeat([]byte("b"), chunk))
+	c.Assert(err, IsNil)
+	c.Check(other.Borrowed(), Equals, chunk)
+	c.Check(greedy.Borrowed(), Equals, chunk)
+	c.Check(reserve.Stats().Denied, Equals, int64(2))
+	c.Check(reserve.Stats().Reclaimed, Equals, int64(chunk))
+}
+
+func (s *reserveSuite) TestReclaimExpired(c *C) {
+	clock := servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 0, time.UTC))
+	defer servicelog.FakeClock(clock)()
+
+	reserve := servicelog.NewReserve(2*chunk, 2*chunk, time.Minute)
+	quiet := servicelog.NewRingBuffer(1024)
+	quiet.SetReserve(reserve)
+	busy := servicelog.NewRingBuffer(1024)
+	busy.SetReserve(reserve)
+
+	_, err := quiet.Write(bytes.Repeat([]byte("b"), 1024+chunk))
+	c.Assert(err, IsNil)
+	clock.Advance(30 * time.Second)
+	_, err = busy.Write(bytes.Repeat([]byte("a"), 1024+chunk))
+	c.Assert(err, IsNil)
+	c.Check(busy.Borrowed(), Equals, chunk)
+	c.Check(quiet.Borrowed(), Equals, chunk)
+
+	// The quiet buffer doesn't write again, but once its loan has expired
+	// the busy one reclaims all of it, even though it's no larger.
+	clock.Advance(30 * time.Second)
+	_, err = busy.Write(bytes.Repeat([]byte("a"), chunk))
+	c.Assert(err, IsNil)
+	c.Check(busy.Borrowed(), Equals, 2*chunk)
+	c.Check(quiet.Borrowed(), Equals, 0)
+	c.Check(quiet.Buffered(), Equals, 1024)
+	c.Check(reserve.Stats().Reclaimed, Equals, int64(chunk))
+}
+
+func (s *reserveSuite) TestShrink(c *C) {
+	budget := servicelog.NewBudget(0)
+	reserve := servicelog.NewReserve(4*chunk, 4*chunk, time.Minute)
+	rb := servicelog.NewRingBufferWithBudget(4096, budget)
+	rb.SetReserve(reserve)
+	_, err := rb.Write(bytes.Repeat([]byte("a"), 4096+2*chunk))
+	c.Assert(err, IsNil)
+	c.Check(rb.Borrowed(), Equals, 2*chunk)
+
+	// Shrinking returns the loan first.
+	c.Check(rb.Shrink(4096+chunk), Equals, chunk)
+	c.Check(rb.Borrowed(), Equals, chunk)
+	c.Check(reserve.Stats().Lent, Equals, int64(chunk))
+
+	// Below the base size, the base size shrinks too.
+	c.Check(rb.Shrink(1024), Equals, 3072+chunk)
+	c.Check(rb.Borrowed(), Equals, 0)
+	c.Check(rb.Size(), Equals, 1024)
+	c.Check(reserve.Stats().Lent, Equals, int64(0))
+	c.Check(reserve.Stats().Returned, Equals, int64(2*chunk))
+	c.Check(budget.Stats().Used, Equals, int64(1024))
+}
+
+func (s *reserveSuite) TestResize(c *C) {
+	budget := servicelog.NewBudget(0)
+	reserve := servicelog.NewReserve(4*chunk, 4*chunk, time.Minute)
+	rb := servicelog.NewRingBufferWithBudget(4096, budget)
+	rb.SetReserve(reserve)
+	_, err := rb.Write(bytes.Repeat([]byte("a"), 4096+2*chunk))
+	c.Assert(err, IsNil)
+	c.Check(rb.Borrowed(), Equals, 2*chunk)
+
+	// Resizing returns the loan, and sets the base size.
+	c.Check(rb.Resize(8192), Equals, 8192)
+	c.Check(rb.Borrowed(), Equals, 0)
+	c.Check(reserve.Stats().Lent, Equals, int64(0))
+	c.Check(budget.Stats().Used, Equals, int64(8192))
+	c.Check(rb.Buffered(), Equals, 4096)
+}
+
+func (s *reserveSuite) TestSetReserve(c *C) {
+	reserve := servicelog.NewReserve(4*chunk, 4*chunk, time.Minute)
+	rb := servicelog.NewRingBuffer(1024)
+	rb.SetReserve(reserve)
+	_, err := rb.Write(bytes.Repeat([]byte("a"), 1025))
+	c.Assert(err, IsNil)
+	c.Check(rb.Borrowed(), Equals, chunk)
+
+	// Removing the reserve returns the loan.
+	rb.SetReserve(nil)
+	c.Check(rb.Borrowed(), Equals, 0)
+	c.Check(rb.Size(), Equals, 1024)
+	c.Check(reserve.Stats().Lent, Equals, int64(0))
+	_, err = rb.Write([]byte("b"))
+	c.Assert(err, IsNil)
+	c.Check(rb.Size(), Equals, 1024)
+
+	var nilReserve *servicelog.Reserve
+	c.Check(nilReserve.Stats(), Equals, servicelog.ReserveStats{})
+}
+
+func (s *reserveSuite) TestContention(c *C) {
+	// Many buffers bursting at once must never take the reserve or the
+	// budget over their limits, or a buffer over its borrowing limit, and
+	// must leave them empty when freed.
+	const (
+		buffers  = 20
+		base     = 4096
+		limit    = 8 * chunk
+		perLimit = 2 * chunk
+		budget   = buffers*base + 6*chunk
+	)
+	b := servicelog.NewBudget(budget)
+	reserve := servicelog.NewReserve(limit, perLimit, time.Millisecond)
+	rbs := make([]*servicelog.RingBuffer, buffers)
+	for i := range rbs {
+		rbs[i] = servicelog.NewRingBufferWithBudget(base, b)
+		rbs[i].SetReserve(reserve)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, buffers)
+	for i, rb := range rbs {
+		wg.Add(1)
+		go func(i int, rb *servicelog.RingBuffer) {
+			defer wg.Done()
+			line := bytes.Repeat([]byte{'a' + byte(i)}, 100+i*50)
+			line[len(line)-1] = '\n'
+			for j := 0; j < 2000; j++ {
+				rb.Write(line)
+				if borrowed := rb.Borrowed(); borrowed > perLimit {
+					errs <- fmt.Errorf("buffer %d borrowed %d, over limit %d", i, borrowed, perLimit)
+					return
+				}
+				stats := reserve.Stats()
+				if stats.Lent > limit {
+					errs <- fmt.Errorf("reserve lent %d, over limit %d", stats.Lent, limit)
+					return
+				}
+				if used := b.Stats().Used; used > budget {
+					errs <- fmt.Errorf("budget used %d is over limit %d", used, budget)
+					return
+				}
+				if j%500 == 0 {
+					time.Sleep(2 * time.Millisecond)
+				}
+			}
+		}(i, rb)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Error(err)
+	}
+
+	// The loans add up, and each buffer only holds its own data.
+	var borrowed int
+	buf := make([]byte, base+perLimit)
+	for i, rb := range rbs {
+		borrowed += rb.Borrowed()
+		start, end := rb.Positions()
+		_, n, err := rb.Copy(buf, start)
+		c.Assert(err, Equals, io.EOF)
+		c.Assert(n, Equals, int(end-start))
+		c.Check(bytes.Trim(buf[:n], string([]byte{'a' + byte(i), '\n'})), HasLen, 0)
+	}
+	stats := reserve.Stats()
+	c.Check(stats.Lent, Equals, int64(borrowed))
+	c.Logf("borrows %d, denied %d, returned %d, reclaimed %d", stats.Borrows, stats.Denied, stats.Returned, stats.Reclaimed)
+
+	for _, rb := range rbs {
+		rb.Free()
+	}
+	c.Check(reserve.Stats().Lent, Equals, int64(0))
+	c.Check(reserve.Stats().Loans, Equals, int64(0))
+	c.Check(b.Stats().Used, Equals, int64(0))
+}
@@ -15,9 +15,11 @@
 package servicelog
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"sync"
+	"time"
 )
 
 var (
@@ -41,6 +43,20 @@ type RingBuffer struct {
 	writeIndex  RingPos
 	writeClosed bool
 	data        []byte
+	lastWrite   time.Time
+	budget      *Budget
+	dropped     int64
+	base        int
+	reserve     *Reserve
+	burstStart  time.Time
+	burstBytes  int
+	// partialStart is set if the data at readIndex is the rest of a line
+	// whose start was discarded.
+	partialStart bool
+	// lines counts the lines ever written to the buffer, including those
+	// discarded or dropped since, which gives the lines their sequence
+	// numbers.
+	lines int64
 
 	iteratorMutex sync.RWMutex
 	iteratorList  []*iterator
@@ -53,10 +69,232 @@ var _ io.WriteCloser = (*RingBuffer)(nil)
 func NewRingBuffer(size int) *RingBuffer {
 	rb := RingBuffer{
 		data: make([]byte, size),
+		base: size,
 	}
 	return &rb
 }
 
+// MinBudgetedSize is the smallest buffer NewRingBufferWithBudget will
+// allocate when the budget can't cover the requested size.
+const MinBudgetedSize = 4 * 1024
+
+// NewRingBufferWithBudget creates a RingBuffer like NewRingBuffer, but
+// reserves its memory from budget. If the budget can't cover size bytes, a
+// smaller buffer is allocated with what's available (but at least
+// MinBudgetedSize bytes). If not even that is available, the buffer has no
+// memory and drops everything written to it, counting the bytes dropped.
+func NewRingBufferWithBudget(size int, budget *Budget) *RingBuffer {
+	min := MinBudgetedSize
+	if min > size {
+		min = size
+	}
+	reserved := budget.Reserve(min, size)
+	return &RingBuffer{
+		data:   make([]byte, reserved),
+		budget: budget,
+		base:   reserved,
+	}
+}
+
+// SetReserve sets the reserve the buffer borrows from when a write would
+// evict data (nil to stop borrowing). The buffer's current size is its
+// base size, which it shrinks back to when its loans expire.
+func (rb *RingBuffer) SetReserve(reserve *Reserve) {
+	rb.rwlock.Lock()
+	defer rb.rwlock.Unlock()
+	rb.returnLoan(len(rb.data)-rb.base, false)
+	rb.base = len(rb.data)
+	rb.reserve = reserve
+}
+
+// Borrowed returns the number of bytes the buffer has borrowed from its
+// reserve.
+func (rb *RingBuffer) Borrowed() int {
+	rb.rwlock.RLock()
+	defer rb.rwlock.RUnlock()
+	return len(rb.data) - rb.base
+}
+
+// Shrink reduces the buffer to size bytes, keeping the most recently
+// written data, and releases the memory saved to the buffer's budget. It
+// returns the number of bytes released. Readers positioned before the data
+// kept will see the buffer as truncated.
+func (rb *RingBuffer) Shrink(size int) int {
+	rb.rwlock.Lock()
+	defer rb.rwlock.Unlock()
+	if size < 0 || size >= len(rb.data) {
+		return 0
+	}
+	freed := len(rb.data) - size
+	loaned := len(rb.data) - rb.base
+	if loaned > freed {
+		loaned = freed
+	}
+	rb.resize(size)
+	if rb.base > size {
+		rb.base = size
+	}
+	if loaned > 0 {
+		rb.reserve.repaid(rb, loaned, false)
+	}
+	if rb.budget != nil {
+		rb.budget.Release(freed)
+	}
+	return freed
+}
+
+// Resize changes the buffer's base size to size bytes, keeping as much of
+// the most recently written data as fits, and returns the new size. Any
+// loan from the buffer's reserve is returned first. Growing reserves the
+// extra memory from the buffer's budget, growing by as much as it has
+// available, and shrinking releases the memory saved. Readers positioned
+// before the data kept will see the buffer as truncated.
+func (rb *RingBuffer) Resize(size int) int {
+	rb.rwlock.Lock()
+	defer rb.rwlock.Unlock()
+	if size < 0 {
+		size = 0
+	}
+	rb.returnLoan(len(rb.data)-rb.base, false)
+	switch {
+	case size < len(rb.data):
+		freed := len(rb.data) - size
+		rb.resize(size)
+		if rb.budget != nil {
+			rb.budget.Release(freed)
+		}
+	case size > len(rb.data):
+		extra := size - len(rb.data)
+		if available := rb.budget.Available(); available >= 0 && int64(extra) > available {
+			extra = int(available)
+		}
+		if extra > 0 {
+			extra = rb.budget.Reserve(0, extra)
+		}
+		if extra > 0 {
+			rb.resize(len(rb.data) + extra)
+		}
+	}
+	rb.base = len(rb.data)
+	return len(rb.data)
+}
+
+// resize reallocates the buffer's memory with the given size, keeping the
+// most recently written data that fits. The caller must hold rb.rwlock for
+// writing.
+func (rb *RingBuffer) resize(size int) {
+	if buffered := rb.buffered(); buffered > size {
+		rb.discard(buffered - size)
+	}
+	// Positions are absolute, so the data kept is moved to where its
+	// positions map to in the resized buffer.
+	data := make([]byte, size)
+	if rb.buffered() > 0 {
+		pos := int(rb.readIndex % RingPos(size))
+		for _, buffer := range rb.buffers(rb.readIndex, rb.writeIndex) {
+			for len(buffer) > 0 {
+				n := copy(data[pos:], buffer)
+				buffer = buffer[n:]
+				pos = (pos + n) % size
+			}
+		}
+	}
+	rb.data = data
+}
+
+// lockForWrite acquires rb.rwlock for writing n bytes, first borrowing
+// from the buffer's reserve if it's bursting and the write would evict
+// data. If the reserve
+// has run out, memory is reclaimed from another buffer (without holding
+// rb's lock, as that buffer may be reclaiming from rb) and the loan is
+// tried again.
+func (rb *RingBuffer) lockForWrite(n int) {
+	rb.rwlock.Lock()
+	if rb.reserve != nil {
+		now := clock.Now()
+		if now.Sub(rb.burstStart) >= rb.reserve.duration {
+			rb.burstStart = now
+			rb.burstBytes = 0
+		}
+		rb.burstBytes += n
+	}
+	victim, reclaim := rb.borrow(n)
+	if victim == nil {
+		return
+	}
+	rb.rwlock.Unlock()
+	victim.repay(reclaim)
+	rb.rwlock.Lock()
+	rb.borrow(n)
+}
+
+// borrow grows the buffer with memory from its reserve so that n more
+// bytes fit without evicting data, returning its loan first if it has
+// expired. The buffer only borrows during a burst: when more than its base
+// size has been written within the reserve's loan duration, so that it
+// would evict data younger than that. If the reserve can't lend any, it returns the buffer to
+// reclaim memory from, if any. The caller must hold rb.rwlock for writing.
+func (rb *RingBuffer) borrow(n int) (victim *RingBuffer, reclaim int) {
+	if rb.reserve == nil || rb.writeClosed || rb.base == 0 {
+		return nil, 0
+	}
+	if len(rb.data) > rb.base && rb.reserve.expired(rb) {
+		rb.returnLoan(len(rb.data)-rb.base, false)
+	}
+	available := rb.available()
+	if n <= available || rb.burstBytes <= rb.base || len(rb.data)-rb.base >= rb.reserve.bufferLimit {
+		return nil, 0
+	}
+	lent, victim, reclaim := rb.reserve.borrow(rb, n-available, rb.budget)
+	if lent > 0 {
+		rb.resize(len(rb.data) + lent)
+	}
+	return victim, reclaim
+}
+
+// repay returns up to n bytes of the buffer's loan, reclaimed for another
+// buffer.
+func (rb *RingBuffer) repay(n int) {
+	rb.rwlock.Lock()
+	defer rb.rwlock.Unlock()
+	if loaned := len(rb.data) - rb.base; n > loaned {
+		n = loaned
+	}
+	rb.returnLoan(n, true)
+}
+
+// returnLoan shrinks the buffer by n bytes of its loan, evicting its
+// oldest data, and returns them to the reserve and budget. The caller must
+// hold rb.rwlock for writing.
+func (rb *RingBuffer) returnLoan(n int, reclaimed bool) {
+	if n <= 0 || rb.reserve == nil {
+		return
+	}
+	rb.resize(len(rb.data) - n)
+	rb.reserve.repaid(rb, n, reclaimed)
+	if rb.budget != nil {
+		rb.budget.Release(n)
+	}
+}
+
+// Free releases all of the buffer's memory to its budget, discarding its
+// data. Anything written to the buffer afterwards is dropped.
+func (rb *RingBuffer) Free() {
+	rb.Shrink(0)
+	rb.rwlock.Lock()
+	defer rb.rwlock.Unlock()
+	rb.budget = nil
+	rb.reserve = nil
+}
+
+// Dropped returns the number of bytes written to the buffer that were
+// dropped because it couldn't reserve any memory from its budget.
+func (rb *RingBuffer) Dropped() int64 {
+	rb.rwlock.RLock()
+	defer rb.rwlock.RUnlock()
+	return rb.dropped
+}
+
 // Close closes the writer to further writes, readers may continue.
 func (rb *RingBuffer) Close() error {
 	rb.rwlock.Lock()
@@ -77,9 +315,9 @@ func (rb *RingBuffer) Closed() bool {
 }
 
 // Write writes p to the backing buffer, allocating the number of bytes in p.
-// If p is larger than the size of the buffer then io.ErrShortWrite is returned and the
-// number of bytes written. If the p is larger than the number of bytes available,
-// then the tail is discarded to make room.
+// If the p is larger than the number of bytes available, then the tail is
+// discarded to make room. If p is larger than the size of the buffer, only
+// its end is kept, as if it had been written and then partly overwritten.
 func (rb *RingBuffer) Write(p []byte) (written int, err error) {
 	if len(p) == 0 {
 		return 0, nil
@@ -89,16 +327,114 @@ func (rb *RingBuffer) Write(p []byte) (written int, err error) {
 			rb.signalIterators()
 		}
 	}()
-	rb.rwlock.Lock()
+	rb.lockForWrite(len(p))
+	defer rb.rwlock.Unlock()
+	return rb.write(p)
+}
+
+// writeVector writes the buffers in bufs, of the given total size and
+// number of newlines, as if they were one, taking the lock and reading the
+// clock once, so that a formatter can pass on the prefixes of lines and
+// the lines themselves from where they are.
+func (rb *RingBuffer) writeVector(bufs [][]byte, total, lines int) (written int, err error) {
+	if total == 0 {
+		return 0, nil
+	}
+	defer func() {
+		if written > 0 {
+			rb.signalIterators()
+		}
+	}()
+	rb.lockForWrite(total)
 	defer rb.rwlock.Unlock()
 	if rb.writeClosed {
 		return 0, io.ErrClosedPipe
 	}
-	size := rb.Size()
-	writeLength := len(p)
-	if writeLength > size {
-		writeLength = size
+	size := len(rb.data)
+	if total > size {
+		// Rare enough (if the buffer has no memory at all, or is smaller
+		// than a batch) that the buffers are written one by one.
+		for _, buf := range bufs {
+			n, err := rb.write(buf)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		return written, nil
+	}
+	if available := rb.available(); available < total {
+		err := rb.discard(total - available)
+		if err != nil {
+			return 0, err
+		}
+	}
+	i := int(rb.writeIndex % RingPos(size))
+	for _, buf := range bufs {
+		n := copy(rb.data[i:], buf)
+		i += n
+		if n < len(buf) {
+			i = copy(rb.data, buf[n:])
+		}
 	}
+	rb.writeIndex += RingPos(total)
+	rb.lines += int64(lines)
+	rb.lastWrite = clock.Now()
+	return total, nil
+}
+
+// writeLine writes line, which must end with a newline, first ending the
+// last line in the buffer if it's incomplete, so that line starts a line of
+// its own. It's a line of pebble's own, so it doesn't change LastWrite.
+func (rb *RingBuffer) writeLine(line []byte) error {
+	written := 0
+	defer func() {
+		if written > 0 {
+			rb.signalIterators()
+		}
+	}()
+	rb.lockForWrite(len(line) + 1)
+	defer rb.rwlock.Unlock()
+	lastWrite := rb.lastWrite
+	defer func() {
+		rb.lastWrite = lastWrite
+	}()
+	if len(rb.data) > 0 && rb.writeIndex > rb.readIndex && rb.data[(rb.writeIndex-1)%RingPos(len(rb.data))] != '\n' {
+		n, err := rb.write([]byte{'\n'})
+		written += n
+		if err != nil {
+			return err
+		}
+	}
+	n, err := rb.write(line)
+	written += n
+	return err
+}
+
+// write writes p to the buffer. The caller must hold rb.rwlock for writing.
+func (rb *RingBuffer) write(p []byte) (written int, err error) {
+	if rb.writeClosed {
+		return 0, io.ErrClosedPipe
+	}
+	rb.lines += int64(bytes.Count(p, []byte{'\n'}))
+	size := len(rb.data)
+	if size == 0 {
+		rb.dropped += int64(len(p))
+		rb.budget.addDropped(len(p))
+		return len(p), nil
+	}
+	if len(p) > size {
+		// Only the end of p fits, replacing everything buffered, so the
+		// start of p is as good as written and discarded straight away.
+		skip := len(p) - size
+		_ = rb.discard(rb.buffered())
+		rb.writeIndex += RingPos(skip)
+		rb.readIndex = rb.writeIndex
+		rb.partialStart = p[skip-1] != '\n'
+		written = skip
+		p = p[skip:]
+	}
+	writeLength := len(p)
 	available := rb.available()
 	if available < writeLength {
 		err := rb.discard(writeLength - available)
@@ -121,10 +457,17 @@ func (rb *RingBuffer) Write(p []byte) (written int, err error) {
 		copy(rb.data[:high], p[lowLength:])
 	}
 	rb.writeIndex += RingPos(writeLength)
-	if writeLength < len(p) {
-		return writeLength, io.ErrShortWrite
-	}
-	return writeLength, nil
+	rb.lastWrite = clock.Now()
+	return written + writeLength, nil
+}
+
+// LastWrite returns the time of the most recent write to the buffer, or the
+// zero time if nothing has been written yet. Lines written by WriteEvent
+// don't count, being pebble's own rather than the service's output.
+func (rb *RingBuffer) LastWrite() time.Time {
+	rb.rwlock.RLock()
+	defer rb.rwlock.RUnlock()
+	return rb.lastWrite
 }
 
 // Available returns the number of bytes available to allocate.
@@ -151,6 +494,8 @@ func (rb *RingBuffer) buffered() int {
 
 // Size returns the size in bytes of the internal buffer.
 func (rb *RingBuffer) Size() int {
+	rb.rwlock.RLock()
+	defer rb.rwlock.RUnlock()
 	return len(rb.data)
 }
 
@@ -165,6 +510,13 @@ func (rb *RingBuffer) Positions() (start RingPos, end RingPos) {
 // start position in the RingBuffer. If start is outside of the range that is
 // buffered, ErrRange is returned.
 func (rb *RingBuffer) Copy(dest []byte, start RingPos) (next RingPos, n int, err error) {
+	next, n, _, err = rb.copySeq(dest, start, false)
+	return next, n, err
+}
+
+// copySeq copies bytes into dest as Copy does. If withSeq is set, it also
+// returns the sequence number of the line the bytes copied start in.
+func (rb *RingBuffer) copySeq(dest []byte, start RingPos, withSeq bool) (next RingPos, n int, seq int64, err error) {
 	rb.rwlock.RLock()
 	defer rb.rwlock.RUnlock()
 	readPos := start
@@ -172,17 +524,20 @@ func (rb *RingBuffer) Copy(dest []byte, start RingPos) (next RingPos, n int, err
 		readPos = rb.readIndex
 	}
 	if readPos < rb.readIndex || readPos > rb.writeIndex {
-		return start, 0, ErrRange
+		return start, 0, 0, ErrRange
 	}
 	if readPos == rb.writeIndex {
-		return start, 0, io.EOF
+		return start, 0, 0, io.EOF
 	}
 	copyLength := int(rb.writeIndex - readPos)
 	if copyLength > len(dest) {
 		copyLength = len(dest)
 	}
 	if copyLength == 0 {
-		return start, 0, nil
+		return start, 0, 0, nil
+	}
+	if withSeq {
+		seq = rb.lineSeq(readPos)
 	}
 	end := readPos + RingPos(copyLength)
 	buffers := rb.buffers(readPos, end)
@@ -197,9 +552,20 @@ func (rb *RingBuffer) Copy(dest []byte, start RingPos) (next RingPos, n int, err
 	}
 	nextReadPos := readPos + RingPos(written)
 	if nextReadPos == rb.writeIndex {
-		return nextReadPos, written, io.EOF
+		return nextReadPos, written, seq, io.EOF
 	}
-	return nextReadPos, written, nil
+	return nextReadPos, written, seq, nil
+}
+
+// lineSeq returns the sequence number of the line that pos, a position in
+// the buffer, is in: the first line written is numbered 1. The caller must
+// hold rb.rwlock.
+func (rb *RingBuffer) lineSeq(pos RingPos) int64 {
+	after := 0
+	for _, buffer := range rb.buffers(pos, rb.writeIndex) {
+		after += bytes.Count(buffer, []byte{'\n'})
+	}
+	return rb.lines - int64(after) + 1
 }
 
 // WriteTo writes the selected range to a io.Writer.
@@ -224,7 +590,7 @@ func (rb *RingBuffer) WriteTo(writer io.Writer, start RingPos) (next RingPos, n
 		if len(buffer) == 0 {
 			continue
 		}
-		n, err := writer.Write(buffer)
+		n, err := writeFull(writer, buffer)
 		written += int64(n)
 		if err != nil {
 			nextReadPos := readPos + RingPos(written)
@@ -317,6 +683,10 @@ func (rb *RingBuffer) discard(n int) error {
 	if n > buffered {
 		n = buffered
 	}
+	if n > 0 {
+		last := rb.data[(rb.readIndex+RingPos(n)-1)%RingPos(len(rb.data))]
+		rb.partialStart = last != '\n'
+	}
 	rb.readIndex = rb.readIndex + RingPos(n)
 	return nil
 }
@@ -376,7 +746,7 @@ func (rb *RingBuffer) removeIterator(iter *iterator) {
 // the end of the internal buffer wrapping around to the start.
 func (rb *RingBuffer) buffers(start, end RingPos) [2][]byte {
 	buffers := [2][]byte{}
-	if end < start {
+	if end < start || len(rb.data) == 0 {
 		return buffers
 	}
 	if start < rb.readIndex || start > rb.writeIndex {
@@ -15,7 +15,9 @@
 package servicelog_test
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/canonical/pebble/internal/servicelog"
 )
@@ -51,6 +53,44 @@ func BenchmarkRingBufferCopy(b *testing.B) {
 	}
 }
 
+func BenchmarkRingBufferWriteBorrowing(b *testing.B) {
+	// A buffer bursting continually, so it's always at its borrowing limit
+	// and returning and borrowing its loan again as it expires.
+	payload := []byte("pebblepebblepebblepebble\n")
+	reserve := servicelog.NewReserve(1024*1024, 256*1024, time.Millisecond)
+	rb := servicelog.NewRingBuffer(4096)
+	rb.SetReserve(reserve)
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		rb.Write(payload)
+	}
+}
+
+func BenchmarkRingBufferWriteBorrowingContended(b *testing.B) {
+	// Many buffers bursting at once, with a reserve that can only lend to a
+	// few of them, so loans are constantly denied and reclaimed.
+	payload := []byte("pebblepebblepebblepebble\n")
+	reserve := servicelog.NewReserve(4*servicelog.ReserveChunk, 2*servicelog.ReserveChunk, 10*time.Millisecond)
+	var mu sync.Mutex
+	var rbs []*servicelog.RingBuffer
+	b.SetBytes(int64(len(payload)))
+	b.RunParallel(func(pb *testing.PB) {
+		rb := servicelog.NewRingBuffer(4096)
+		rb.SetReserve(reserve)
+		mu.Lock()
+		rbs = append(rbs, rb)
+		mu.Unlock()
+		for pb.Next() {
+			rb.Write(payload)
+		}
+	})
+	stats := reserve.Stats()
+	b.ReportMetric(float64(stats.Reclaimed)/float64(b.N), "reclaimed-B/op")
+	for _, rb := range rbs {
+		rb.Free()
+	}
+}
+
 func BenchmarkRingBufferConcurrentSmall(b *testing.B) {
 	payload := []byte("p")
 	benchmarkConcurrent(b, payload)
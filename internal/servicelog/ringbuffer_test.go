@@ -18,7 +18,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/canonical/pebble/internal/servicelog"
 	. "gopkg.in/check.v1"
@@ -41,6 +43,36 @@ func (s *ringBufferSuite) TestWrites(c *C) {
 	c.Assert(rb.Available(), Equals, 0)
 }
 
+func (s *ringBufferSuite) TestLastWrite(c *C) {
+	now := time.Date(2021, 5, 13, 3, 16, 51, 0, time.UTC)
+	clock := servicelog.NewTestClock(now)
+	restore := servicelog.FakeClock(clock)
+	defer restore()
+
+	rb := servicelog.NewRingBuffer(10)
+	c.Assert(rb.LastWrite().IsZero(), Equals, true)
+
+	_, err := fmt.Fprint(rb, "pebble")
+	c.Assert(err, IsNil)
+	c.Assert(rb.LastWrite(), Equals, now)
+
+	// Empty writes don't count as output.
+	clock.Advance(time.Minute)
+	_, err = rb.Write(nil)
+	c.Assert(err, IsNil)
+	c.Assert(rb.LastWrite(), Equals, now)
+
+	_, err = fmt.Fprint(rb, "tron")
+	c.Assert(err, IsNil)
+	c.Assert(rb.LastWrite(), Equals, now.Add(time.Minute))
+
+	// Nor do pebble's own lines.
+	clock.Advance(time.Minute)
+	err = servicelog.WriteEvent(rb, "x")
+	c.Assert(err, IsNil)
+	c.Assert(rb.LastWrite(), Equals, now.Add(time.Minute))
+}
+
 func (s *ringBufferSuite) TestCrossBoundaryWriteCopy(c *C) {
 	rb := servicelog.NewRingBuffer(13)
 	_, a1 := rb.Positions()
@@ -151,11 +183,30 @@ func (s *ringBufferSuite) TestCrossBoundaryWriteWithWriteTo(c *C) {
 	c.Assert(cc.String(), Equals, "PEBBLE")
 }
 
-func (s *ringBufferSuite) TestWriteShort(c *C) {
-	rb := servicelog.NewRingBuffer(1)
-	n, err := fmt.Fprint(rb, "ab")
-	c.Assert(err, Equals, io.ErrShortWrite)
-	c.Assert(n, Equals, 1)
+func (s *ringBufferSuite) TestWriteLarger(c *C) {
+	rb := servicelog.NewRingBuffer(4)
+	_, err := fmt.Fprint(rb, "xy\n")
+	c.Assert(err, IsNil)
+	it := rb.TailIterator()
+	defer it.Close()
+
+	// Only the end of a write larger than the buffer is kept.
+	n, err := fmt.Fprint(rb, "abc\ndefgh")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 9)
+	start, end := rb.Positions()
+	c.Check(start, Equals, servicelog.RingPos(8))
+	c.Check(end, Equals, servicelog.RingPos(12))
+	buf := make([]byte, 4)
+	_, n, err = rb.Copy(buf, start)
+	c.Assert(err, Equals, io.EOF)
+	c.Check(string(buf[:n]), Equals, "efgh")
+
+	// Readers see the buffer as truncated.
+	c.Assert(it.Next(nil), Equals, true)
+	data, err := ioutil.ReadAll(it)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "\n(... output truncated ...)\nefgh")
 }
 
 func (s *ringBufferSuite) TestCopy(c *C) {
@@ -253,3 +304,137 @@ func (s *ringBufferSuite) TestAllocs(c *C) {
 	})
 	c.Assert(int(numAllocs), Equals, 0)
 }
+
+func (s *ringBufferSuite) TestBudget(c *C) {
+	budget := servicelog.NewBudget(20 * 1024)
+
+	// The first buffer gets all it asks for, the second what's left.
+	rb1 := servicelog.NewRingBufferWithBudget(16*1024, budget)
+	c.Assert(rb1.Size(), Equals, 16*1024)
+	rb2 := servicelog.NewRingBufferWithBudget(16*1024, budget)
+	c.Assert(rb2.Size(), Equals, 4*1024)
+	c.Assert(budget.Stats().Used, Equals, int64(20*1024))
+
+	// With nothing left, writes are dropped and counted.
+	rb3 := servicelog.NewRingBufferWithBudget(16*1024, budget)
+	c.Assert(rb3.Size(), Equals, 0)
+	n, err := fmt.Fprint(rb3, "pebble")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 6)
+	c.Assert(rb3.Dropped(), Equals, int64(6))
+	c.Assert(rb3.Buffered(), Equals, 0)
+	it := rb3.HeadIterator(10)
+	c.Assert(it.Next(nil), Equals, false)
+	it.Close()
+	c.Assert(budget.Stats(), Equals, servicelog.BudgetStats{Limit: 20 * 1024, Used: 20 * 1024, Denied: 1, Dropped: 6})
+
+	// Once freed, writes are dropped but no longer counted in the budget.
+	rb1.Free()
+	c.Assert(budget.Stats().Used, Equals, int64(4*1024))
+	n, err = fmt.Fprint(rb1, "pebble")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 6)
+	c.Assert(rb1.Dropped(), Equals, int64(6))
+	c.Assert(budget.Stats().Dropped, Equals, int64(6))
+}
+
+func (s *ringBufferSuite) TestShrink(c *C) {
+	budget := servicelog.NewBudget(0)
+	rb := servicelog.NewRingBufferWithBudget(16, budget)
+	_, err := fmt.Fprint(rb, "0123456789")
+	c.Assert(err, IsNil)
+	_, err = fmt.Fprint(rb, "abcdefghij")
+	c.Assert(err, IsNil)
+	start, end := rb.Positions()
+	c.Assert(start, Equals, servicelog.RingPos(4))
+	c.Assert(end, Equals, servicelog.RingPos(20))
+	it := rb.TailIterator()
+	defer it.Close()
+
+	c.Assert(rb.Shrink(7), Equals, 9)
+	c.Assert(rb.Size(), Equals, 7)
+	c.Assert(budget.Stats().Used, Equals, int64(7))
+	start, end = rb.Positions()
+	c.Assert(start, Equals, servicelog.RingPos(13))
+	c.Assert(end, Equals, servicelog.RingPos(20))
+
+	buf := make([]byte, 7)
+	_, n, err := rb.Copy(buf, start)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(string(buf[:n]), Equals, "defghij")
+
+	// The buffer keeps working at its new size.
+	_, err = fmt.Fprint(rb, "XYZ")
+	c.Assert(err, IsNil)
+	_, n, err = rb.Copy(buf, servicelog.TailPosition)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(string(buf[:n]), Equals, "ghijXYZ")
+
+	// The iterator was positioned before the data kept, so it's truncated
+	// and continues from the oldest data left.
+	c.Assert(it.Next(nil), Equals, true)
+	data, err := ioutil.ReadAll(it)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "\n(... output truncated ...)\nghijXYZ")
+
+	// Growing isn't supported.
+	c.Assert(rb.Shrink(100), Equals, 0)
+	c.Assert(rb.Size(), Equals, 7)
+
+	c.Assert(rb.Shrink(0), Equals, 7)
+	c.Assert(rb.Buffered(), Equals, 0)
+	c.Assert(budget.Stats().Used, Equals, int64(0))
+}
+
+func (s *ringBufferSuite) TestResize(c *C) {
+	budget := servicelog.NewBudget(24)
+	rb := servicelog.NewRingBufferWithBudget(16, budget)
+	_, err := fmt.Fprint(rb, "0123456789")
+	c.Assert(err, IsNil)
+	_, err = fmt.Fprint(rb, "abcdefghij")
+	c.Assert(err, IsNil)
+	it := rb.TailIterator()
+	defer it.Close()
+
+	// Shrinking keeps the tail of the data.
+	c.Assert(rb.Resize(7), Equals, 7)
+	c.Assert(rb.Size(), Equals, 7)
+	c.Assert(budget.Stats().Used, Equals, int64(7))
+	buf := make([]byte, 16)
+	_, n, err := rb.Copy(buf, servicelog.TailPosition)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(string(buf[:n]), Equals, "defghij")
+	c.Assert(it.Next(nil), Equals, true)
+	data, err := ioutil.ReadAll(it)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "\n(... output truncated ...)\ndefghij")
+
+	// Growing keeps all the data, and makes room for more.
+	c.Assert(rb.Resize(12), Equals, 12)
+	c.Assert(budget.Stats().Used, Equals, int64(12))
+	_, err = fmt.Fprint(rb, "XYZ")
+	c.Assert(err, IsNil)
+	_, n, err = rb.Copy(buf, servicelog.TailPosition)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(string(buf[:n]), Equals, "defghijXYZ")
+
+	// It only grows by as much as the budget has available.
+	other := servicelog.NewRingBufferWithBudget(8, budget)
+	c.Assert(rb.Resize(100), Equals, 16)
+	c.Assert(budget.Stats().Used, Equals, int64(24))
+	c.Assert(budget.Stats().Denied, Equals, int64(0))
+	_, n, err = rb.Copy(buf, servicelog.TailPosition)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(string(buf[:n]), Equals, "defghijXYZ")
+	c.Assert(rb.Resize(16), Equals, 16)
+
+	// With the budget used up, it can't grow at all.
+	c.Assert(rb.Resize(20), Equals, 16)
+	c.Assert(budget.Stats().Denied, Equals, int64(0))
+	other.Free()
+	c.Assert(rb.Resize(20), Equals, 20)
+
+	c.Assert(rb.Resize(0), Equals, 0)
+	c.Assert(rb.Buffered(), Equals, 0)
+	c.Assert(budget.Stats().Used, Equals, int64(0))
+}
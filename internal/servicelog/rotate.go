@@ -0,0 +1,285 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// rotatingFile writes to a file, rotating it once it's full.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	compress bool
+
+	// file is the file written, of size bytes, and midLine is set if it
+	// ends in the middle of a line.
+	file    *os.File
+	size    int64
+	midLine bool
+	closed  bool
+
+	// compressing waits for the rotated file being compressed, if any,
+	// and compressErr is the error from compressing it, only read once
+	// it's done.
+	compressing sync.WaitGroup
+	compressErr error
+}
+
+// NewRotatingFileWriter returns a writer appending to the file at path,
+// created if needed, for the output of services persisted to disk. When a
+// line would take the file over maxSize bytes, the file is rotated: it's
+// renamed to path.1, the files rotated before it are renamed from path.N
+// to path.N+1, and those beyond path.maxFiles are removed. A rotated file
+// is gzipped in the background to path.N.gz if compress is set.
+//
+// Files are only rotated between lines, so none starts in the middle of a
+// line, and a line longer than maxSize is written to a file of its own,
+// whole. If the file is removed or renamed by something else, it's
+// created again. The writer may be shared by the formatters of several
+// services. An error compressing a rotated file is returned by the write
+// rotating the next one, or by Close, which waits for the compression to
+// finish. Writes after Close fail with io.ErrClosedPipe.
+func NewRotatingFileWriter(path string, maxSize int64, maxFiles int, compress bool) (io.WriteCloser, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("maximum log file size must be positive")
+	}
+	if maxFiles < 0 {
+		return nil, errors.New("maximum number of log files must not be negative")
+	}
+	r := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		compress: compress,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file at path for appending, creating it if needed.
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// reopen opens the file at path again if the file written is no longer
+// there.
+func (r *rotatingFile) reopen() error {
+	info, err := os.Stat(r.path)
+	if err == nil {
+		current, err := r.file.Stat()
+		if err != nil || os.SameFile(info, current) {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	r.file.Close()
+	r.midLine = false
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := r.reopen(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := r.fits(p)
+		if n == 0 {
+			if err := r.rotate(); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n, err := r.file.Write(p[:n])
+		written += n
+		r.size += int64(n)
+		if n > 0 {
+			r.midLine = p[n-1] != '\n'
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// fits returns the length of the start of p to write to the file before
+// rotating it: the end of a line the file ends in the middle of, and the
+// whole lines that fit after it, or, if the file is empty, at least a
+// line however long.
+func (r *rotatingFile) fits(p []byte) int {
+	if r.size+int64(len(p)) <= r.maxSize {
+		return len(p)
+	}
+	start := 0
+	if r.midLine {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			return len(p)
+		}
+		start = i + 1
+	}
+	end := start
+	if room := r.maxSize - r.size - int64(start); room > 0 {
+		if room > int64(len(p)-start) {
+			room = int64(len(p) - start)
+		}
+		if i := bytes.LastIndexByte(p[start:start+int(room)], '\n'); i >= 0 {
+			end = start + i + 1
+		}
+	}
+	if end == 0 && r.size == 0 {
+		end = len(p)
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			end = i + 1
+		}
+	}
+	return end
+}
+
+// rotatedPath returns the path of the nth rotated file.
+func (r *rotatingFile) rotatedPath(n int) string {
+	return r.path + "." + strconv.Itoa(n)
+}
+
+// rotate renames the file to path.1, after renaming those rotated before
+// it and removing the oldest, and opens a new one.
+func (r *rotatingFile) rotate() error {
+	r.compressing.Wait()
+	if err := r.compressErr; err != nil {
+		r.compressErr = nil
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if r.maxFiles == 0 {
+		if err := removeIfExists(r.path); err != nil {
+			return err
+		}
+		return r.open()
+	}
+	for _, suffix := range []string{"", ".gz"} {
+		if err := removeIfExists(r.rotatedPath(r.maxFiles) + suffix); err != nil {
+			return err
+		}
+		for n := r.maxFiles - 1; n > 0; n-- {
+			err := os.Rename(r.rotatedPath(n)+suffix, r.rotatedPath(n+1)+suffix)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	rotated := r.rotatedPath(1)
+	if err := os.Rename(r.path, rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if r.compress {
+		r.compressing.Add(1)
+		go func() {
+			defer r.compressing.Done()
+			r.compressErr = compressFile(rotated)
+		}()
+	}
+	return r.open()
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// compressFile gzips the file at path to path.gz, and removes it.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot compress rotated log file: %v", err)
+	}
+	return os.Remove(path)
+}
+
+// Close closes the file, after waiting for a rotated file being
+// compressed. Closing the writer again does nothing.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.file.Close()
+	r.compressing.Wait()
+	if err == nil {
+		err = r.compressErr
+	}
+	r.compressErr = nil
+	return err
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type rotateSuite struct {
+	dir  string
+	path string
+}
+
+var _ = Suite(&rotateSuite{})
+
+func (s *rotateSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.path = filepath.Join(s.dir, "svc.log")
+}
+
+// files returns the contents of the files in the test directory by name,
+// gunzipping those compressed.
+func (s *rotateSuite) files(c *C) map[string]string {
+	entries, err := ioutil.ReadDir(s.dir)
+	c.Assert(err, IsNil)
+	files := make(map[string]string)
+	for _, entry := range entries {
+		f, err := os.Open(filepath.Join(s.dir, entry.Name()))
+		c.Assert(err, IsNil)
+		var r io.Reader = f
+		if strings.HasSuffix(entry.Name(), ".gz") {
+			zr, err := gzip.NewReader(f)
+			c.Assert(err, IsNil)
+			r = zr
+		}
+		data, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		f.Close()
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func (s *rotateSuite) TestExactSize(c *C) {
+	w, err := servicelog.NewRotatingFileWriter(s.path, 10, 5, false)
+	c.Assert(err, IsNil)
+
+	// Lines filling the file exactly don't rotate it; the next one does.
+	_, err = io.WriteString(w, "1234\n")
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "6789\n")
+	c.Assert(err, IsNil)
+	c.Check(s.files(c), DeepEquals, map[string]string{"svc.log": "1234\n6789\n"})
+	_, err = io.WriteString(w, "a\n")
+	c.Assert(err, IsNil)
+	c.Check(s.files(c), DeepEquals, map[string]string{
+		"svc.log":   "a\n",
+		"svc.log.1": "1234\n6789\n",
+	})
+
+	// A single write is split between lines: those that fit go in the
+	// file, the others in the next.
+	_, err = io.WriteString(w, "bcdefgh\nij\nkl\n")
+	c.Assert(err, IsNil)
+	c.Check(s.files(c), DeepEquals, map[string]string{
+		"svc.log":   "ij\nkl\n",
+		"svc.log.1": "a\nbcdefgh\n",
+		"svc.log.2": "1234\n6789\n",
+	})
+	c.Check(w.Close(), IsNil)
+}
+
+func (s *rotateSuite) TestLineBoundaries(c *C) {
+	w, err := servicelog.NewRotatingFileWriter(s.path, 10, 5, false)
+	c.Assert(err, IsNil)
+
+	// A line isn't split between files, even if it's written in pieces
+	// and goes over the maximum size.
+	for _, chunk := range []string{"first ", "line, which is long", "\nsecond", " line\nthird\n"} {
+		n, err := io.WriteString(w, chunk)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(chunk))
+	}
+	c.Check(s.files(c), DeepEquals, map[string]string{
+		"svc.log":   "third\n",
+		"svc.log.1": "second line\n",
+		"svc.log.2": "first line, which is long\n",
+	})
+	c.Check(w.Close(), IsNil)
+}
+
+func (s *rotateSuite) TestMaxFiles(c *C) {
+	w, err := servicelog.NewRotatingFileWriter(s.path, 6, 2, false)
+	c.Assert(err, IsNil)
+	for i := 1; i <= 5; i++ {
+		_, err = fmt.Fprintf(w, "line%d\n", i)
+		c.Assert(err, IsNil)
+	}
+	c.Check(s.files(c), DeepEquals, map[string]string{
+		"svc.log":   "line5\n",
+		"svc.log.1": "line4\n",
+		"svc.log.2": "line3\n",
+	})
+	c.Check(w.Close(), IsNil)
+
+	// Without rotated files, the file starts over.
+	w, err = servicelog.NewRotatingFileWriter(s.path, 6, 0, false)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "line6\n")
+	c.Assert(err, IsNil)
+	c.Check(s.files(c), DeepEquals, map[string]string{
+		"svc.log":   "line6\n",
+		"svc.log.1": "line4\n",
+		"svc.log.2": "line3\n",
+	})
+	c.Check(w.Close(), IsNil)
+}
+
+func (s *rotateSuite) TestCompress(c *C) {
+	w, err := servicelog.NewRotatingFileWriter(s.path, 6, 3, true)
+	c.Assert(err, IsNil)
+	for i := 1; i <= 5; i++ {
+		_, err = fmt.Fprintf(w, "line%d\n", i)
+		c.Assert(err, IsNil)
+	}
+	// Close waits for the last rotated file to be compressed.
+	c.Check(w.Close(), IsNil)
+	c.Check(s.files(c), DeepEquals, map[string]string{
+		"svc.log":      "line5\n",
+		"svc.log.1.gz": "line4\n",
+		"svc.log.2.gz": "line3\n",
+		"svc.log.3.gz": "line2\n",
+	})
+}
+
+func (s *rotateSuite) TestAppend(c *C) {
+	err := ioutil.WriteFile(s.path, []byte("old\n"), 0644)
+	c.Assert(err, IsNil)
+	w, err := servicelog.NewRotatingFileWriter(s.path, 10, 1, false)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "new\nnewer\n")
+	c.Assert(err, IsNil)
+	c.Check(s.files(c), DeepEquals, map[string]string{
+		"svc.log":   "newer\n",
+		"svc.log.1": "old\nnew\n",
+	})
+	c.Check(w.Close(), IsNil)
+}
+
+func (s *rotateSuite) TestRemoved(c *C) {
+	w, err := servicelog.NewRotatingFileWriter(s.path, 100, 1, false)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+
+	// The file is created again once it's removed, or moved away.
+	c.Assert(os.Remove(s.path), IsNil)
+	_, err = io.WriteString(w, "second\n")
+	c.Assert(err, IsNil)
+	c.Check(s.files(c), DeepEquals, map[string]string{"svc.log": "second\n"})
+	c.Assert(os.Rename(s.path, s.path+".old"), IsNil)
+	_, err = io.WriteString(w, "third\n")
+	c.Assert(err, IsNil)
+	c.Check(s.files(c), DeepEquals, map[string]string{
+		"svc.log":     "third\n",
+		"svc.log.old": "second\n",
+	})
+	c.Check(w.Close(), IsNil)
+}
+
+func (s *rotateSuite) TestConcurrent(c *C) {
+	w, err := servicelog.NewRotatingFileWriter(s.path, 1000, 100, false)
+	c.Assert(err, IsNil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		formatter := newFormatWriter(w, fmt.Sprintf("svc%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fmt.Fprintf(formatter, "line %d\n", j)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(w.Close(), IsNil)
+
+	// Every file holds whole lines, and all of them are there.
+	var lines []string
+	for name, data := range s.files(c) {
+		c.Check(len(data) <= 1000, Equals, true, Commentf("%s is %d bytes", name, len(data)))
+		c.Check(strings.HasSuffix(data, "\n"), Equals, true, Commentf("%s ends mid-line", name))
+		lines = append(lines, strings.SplitAfter(strings.TrimSuffix(data, "\n"), "\n")...)
+	}
+	c.Check(lines, HasLen, 400)
+	for _, line := range lines {
+		c.Check(line, Matches, `\S+ \[svc\d\] line \d+\n?`)
+	}
+}
+
+func (s *rotateSuite) TestClose(c *C) {
+	w, err := servicelog.NewRotatingFileWriter(s.path, 100, 1, false)
+	c.Assert(err, IsNil)
+	c.Check(w.Close(), IsNil)
+	c.Check(w.Close(), IsNil)
+	_, err = io.WriteString(w, "more\n")
+	c.Check(err, Equals, io.ErrClosedPipe)
+}
+
+func (s *rotateSuite) TestInvalid(c *C) {
+	_, err := servicelog.NewRotatingFileWriter(s.path, 0, 1, false)
+	c.Check(err, ErrorMatches, "maximum log file size must be positive")
+	_, err = servicelog.NewRotatingFileWriter(s.path, 100, -1, false)
+	c.Check(err, ErrorMatches, "maximum number of log files must not be negative")
+	_, err = servicelog.NewRotatingFileWriter(filepath.Join(s.dir, "missing", "svc.log"), 100, 1, false)
+	c.Check(err, ErrorMatches, ".*no such file or directory")
+}
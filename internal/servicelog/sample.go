@@ -0,0 +1,226 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// SampleConfig configures a SampleWriter. Exactly one of Every and
+// Probability must be set.
+type SampleConfig struct {
+	// Every, if set, keeps one line in every Every lines: the first, and
+	// every Every'th one after it.
+	Every int
+	// Probability, if set, keeps each line with that probability, which
+	// must be above zero and at most one.
+	Probability float64
+	// Keep, if set, matches the lines, without their newline, that are
+	// always kept, regardless of sampling. Those lines don't count towards
+	// Every.
+	Keep *regexp.Regexp
+	// Rand, if set, is the source of randomness for Probability, so that a
+	// fixed seed gives the same selection. Otherwise one seeded with the
+	// current time is used.
+	Rand *rand.Rand
+}
+
+// SampleWriter passes on a sample of the lines of a service's output, for
+// services logging at rates where even rate limiting lets too much
+// through. Lines are kept or dropped whole. Without a Keep pattern, a line
+// is sampled as it starts; with one, an incomplete line is held back until
+// it's complete, up to FilterMaxLine bytes, so that it can be matched
+// whole, as by a FilterWriter. It's put in front of a formatter, so that
+// the lines kept get their timestamps when they're passed on.
+type SampleWriter struct {
+	mu          sync.Mutex
+	dest        io.Writer
+	every       int64
+	probability float64
+	keep        *regexp.Regexp
+	rand        *rand.Rand
+
+	// count is the number of lines sampled with Every. line is the
+	// incomplete line held back. Once a line has been decided on, midLine
+	// is set until its end, and keepLine if it's passed on.
+	count    int64
+	line     []byte
+	midLine  bool
+	keepLine bool
+	// kept counts the lines sampled in, and stats the lines sampled out,
+	// as dropped.
+	kept  int64
+	stats *writerStats
+}
+
+// NewSampleWriter returns a SampleWriter that writes the lines sampled
+// from a service's output to dest, usually a formatter.
+func NewSampleWriter(dest io.Writer, config SampleConfig) (*SampleWriter, error) {
+	if config.Every < 0 {
+		return nil, errors.New("log sampling ratio must not be negative")
+	}
+	if config.Probability < 0 || config.Probability > 1 {
+		return nil, errors.New("log sampling probability must be between 0 and 1")
+	}
+	if (config.Every == 0) == (config.Probability == 0) {
+		return nil, errors.New("log sampling needs either a ratio or a probability")
+	}
+	rng := config.Rand
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &SampleWriter{
+		dest:        dest,
+		every:       int64(config.Every),
+		probability: config.Probability,
+		keep:        config.Keep,
+		rand:        rng,
+		stats:       &writerStats{},
+	}, nil
+}
+
+// Write passes on the lines in p that are sampled in, and reports those
+// sampled out as written too.
+func (s *SampleWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		end := false
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			chunk = p[:i+1]
+			end = true
+		}
+		p = p[len(chunk):]
+		if !s.midLine && s.keep != nil {
+			s.line = append(s.line, chunk...)
+			written += len(chunk)
+			if !end && len(s.line) < FilterMaxLine {
+				continue
+			}
+			s.midLine = !end
+			if err := s.flushLine(); err != nil {
+				return written - len(chunk), err
+			}
+			continue
+		}
+		if !s.midLine {
+			s.keepLine = s.decide(nil)
+		}
+		s.midLine = !end
+		if !s.keepLine {
+			written += len(chunk)
+			continue
+		}
+		n, err := s.stats.writeFull(s.dest, chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// decide reports whether the line, or the line starting with it, is kept,
+// and counts it.
+func (s *SampleWriter) decide(line []byte) bool {
+	keep := false
+	if s.keep != nil {
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		keep = s.keep.Match(line)
+	}
+	if !keep {
+		keep = s.sample()
+	}
+	if keep {
+		s.kept++
+	} else {
+		s.stats.addDropped(1)
+	}
+	return keep
+}
+
+// sample reports whether the next line is sampled in.
+func (s *SampleWriter) sample() bool {
+	if s.every > 0 {
+		keep := s.count%s.every == 0
+		s.count++
+		return keep
+	}
+	return s.rand.Float64() < s.probability
+}
+
+// flushLine decides on the line held back, writes it if it's kept, and
+// forgets it.
+func (s *SampleWriter) flushLine() error {
+	line := s.line
+	s.line = s.line[:0]
+	s.keepLine = s.decide(line)
+	if !s.keepLine {
+		return nil
+	}
+	_, err := s.stats.writeFull(s.dest, line)
+	return err
+}
+
+// Sampled returns the number of lines sampled in, including those kept
+// for matching the Keep pattern, and sampled out so far.
+func (s *SampleWriter) Sampled() (in, out int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kept, s.stats.droppedLines()
+}
+
+// Stats returns the writer's statistics, counting the lines sampled out
+// as dropped.
+func (s *SampleWriter) Stats() WriterStats {
+	return s.stats.snapshot()
+}
+
+// flushIdle decides on the incomplete line held back by its start, as for
+// a line too long to hold back, for an IdleFlushWriter.
+func (s *SampleWriter) flushIdle() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.line) > 0 {
+		s.midLine = true
+		if err := s.flushLine(); err != nil {
+			return err
+		}
+	}
+	return flushIdle(s.dest)
+}
+
+// Close passes on the incomplete line held back, if it's sampled in, and
+// closes dest if it's an io.Closer.
+func (s *SampleWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if len(s.line) > 0 {
+		err = s.flushLine()
+	}
+	if closeErr := closeWriter(s.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
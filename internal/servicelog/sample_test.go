@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type sampleSuite struct{}
+
+var _ = Suite(&sampleSuite{})
+
+func (s *sampleSuite) TestNew(c *C) {
+	_, err := servicelog.NewSampleWriter(&bytes.Buffer{}, servicelog.SampleConfig{})
+	c.Check(err, ErrorMatches, "log sampling needs either a ratio or a probability")
+	_, err = servicelog.NewSampleWriter(&bytes.Buffer{}, servicelog.SampleConfig{Every: 2, Probability: 0.5})
+	c.Check(err, ErrorMatches, "log sampling needs either a ratio or a probability")
+	_, err = servicelog.NewSampleWriter(&bytes.Buffer{}, servicelog.SampleConfig{Every: -1})
+	c.Check(err, ErrorMatches, "log sampling ratio must not be negative")
+	_, err = servicelog.NewSampleWriter(&bytes.Buffer{}, servicelog.SampleConfig{Probability: 1.5})
+	c.Check(err, ErrorMatches, "log sampling probability must be between 0 and 1")
+}
+
+func (s *sampleSuite) TestEvery(c *C) {
+	dest := &bytes.Buffer{}
+	w, err := servicelog.NewSampleWriter(dest, servicelog.SampleConfig{Every: 3})
+	c.Assert(err, IsNil)
+
+	// Lines are sampled whole, across writes.
+	n, err := w.Write([]byte(lines("line", 1, 4) + "line 5 st"))
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 37)
+	_, err = w.Write([]byte("arts\n" + lines("line", 6, 7) + "line 8\nline 9"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	c.Check(dest.String(), Equals, "line 1\nline 4\nline 7\n")
+	in, out := w.Sampled()
+	c.Check(in, Equals, int64(3))
+	c.Check(out, Equals, int64(6))
+	c.Check(w.Stats().Dropped, Equals, int64(6))
+}
+
+// sampleLines writes the lines "line 1\n" to "line 100\n" to a SampleWriter
+// keeping lines with probability 0.3, using a source seeded with seed, and
+// returns its output.
+func sampleLines(c *C, seed int64) string {
+	dest := &bytes.Buffer{}
+	w, err := servicelog.NewSampleWriter(dest, servicelog.SampleConfig{
+		Probability: 0.3,
+		Rand:        rand.New(rand.NewSource(seed)),
+	})
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte(lines("line", 1, 100)))
+	c.Assert(err, IsNil)
+	return dest.String()
+}
+
+func (s *sampleSuite) TestProbabilitySeeded(c *C) {
+	// The selection is the source's: a line is kept when its next float
+	// is under the probability.
+	r := rand.New(rand.NewSource(42))
+	var expected []string
+	for i := 1; i <= 100; i++ {
+		if r.Float64() < 0.3 {
+			expected = append(expected, lines("line", i, i))
+		}
+	}
+	output := sampleLines(c, 42)
+	c.Check(output, Equals, strings.Join(expected, ""))
+	c.Check(sampleLines(c, 42), Equals, output)
+	c.Check(sampleLines(c, 7), Not(Equals), output)
+}
+
+func (s *sampleSuite) TestKeep(c *C) {
+	dest := &bytes.Buffer{}
+	w, err := servicelog.NewSampleWriter(dest, servicelog.SampleConfig{
+		Every: 100,
+		Keep:  regexp.MustCompile(`ERROR`),
+	})
+	c.Assert(err, IsNil)
+
+	// The error lines bypass sampling, even when written in parts, and
+	// don't count towards the ratio.
+	_, err = w.Write([]byte("debug 1\ndebug 2\nan ER"))
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, "debug 1\n")
+	_, err = w.Write([]byte("ROR here\ndebug 3\nERROR again\n"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	c.Check(dest.String(), Equals, "debug 1\nan ERROR here\nERROR again\n")
+	in, out := w.Sampled()
+	c.Check(in, Equals, int64(3))
+	c.Check(out, Equals, int64(2))
+}
+
+func (s *sampleSuite) TestBeforeFormatter(c *C) {
+	dest := &bytes.Buffer{}
+	now := func() time.Time { return time.Date(2021, 5, 13, 3, 16, 51, 0, time.UTC) }
+	formatter, err := servicelog.NewFormatWriter(dest, "test", servicelog.WithClock(now))
+	c.Assert(err, IsNil)
+	w, err := servicelog.NewSampleWriter(formatter, servicelog.SampleConfig{Every: 2})
+	c.Assert(err, IsNil)
+
+	_, err = w.Write([]byte("one\ntwo\nthree\n"))
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, "2021-05-13T03:16:51.000Z [test] one\n2021-05-13T03:16:51.000Z [test] three\n")
+}
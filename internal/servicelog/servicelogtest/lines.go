@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelogtest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+// CheckLines checks that output is input as formatted for the named
+// service: each line of input, in order, whole and once, with a single
+// prefix at its start giving a timestamp no earlier than the line before's
+// and the service's name. A last line without a newline is expected to
+// stay that way. It returns an error describing the first discrepancy.
+func CheckLines(output, input []byte, service string) error {
+	want := splitLines(string(input))
+	got := splitLines(string(output))
+	var last servicelog.Entry
+	for i, line := range got {
+		if i >= len(want) {
+			return fmt.Errorf("line %d %.40q is extra", i+1, line)
+		}
+		entry, err := servicelog.Parse([]byte(line))
+		if err != nil {
+			return fmt.Errorf("line %d %.40q has no valid prefix: %v", i+1, line, err)
+		}
+		if entry.Service != service {
+			return fmt.Errorf("line %d %.40q is for service %q, want %q", i+1, line, entry.Service, service)
+		}
+		if entry.Time.Before(last.Time) {
+			return fmt.Errorf("line %d %.40q has a timestamp earlier than the line before", i+1, line)
+		}
+		if entry.Message != want[i] {
+			return fmt.Errorf("line %d has message %.40q, want %.40q", i+1, entry.Message, want[i])
+		}
+		last = entry
+	}
+	if len(got) < len(want) {
+		return fmt.Errorf("line %d %.40q is missing", len(got)+1, want[len(got)])
+	}
+	return nil
+}
+
+// splitLines splits s into lines, each with its newline except perhaps the
+// last.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+// Package servicelogtest provides test doubles and checks for the writers
+// of service log pipelines.
+package servicelogtest
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+type behaviorKind int
+
+const (
+	accept behaviorKind = iota
+	shortWrite
+	fail
+	block
+	delay
+)
+
+// Behavior is what a ScriptedWriter does with one call to Write. The zero
+// Behavior is Accept.
+type Behavior struct {
+	kind  behaviorKind
+	n     int
+	err   error
+	delay time.Duration
+}
+
+// Accept writes all of p.
+func Accept() Behavior {
+	return Behavior{kind: accept}
+}
+
+// ShortWrite writes the first n bytes of p (or all of it, if it's
+// shorter), returning a short count without an error if n is less than
+// len(p). ShortWrite(0) makes no progress at all.
+func ShortWrite(n int) Behavior {
+	return Behavior{kind: shortWrite, n: n}
+}
+
+// Fail writes nothing and returns err.
+func Fail(err error) Behavior {
+	return Behavior{kind: fail, n: -1, err: err}
+}
+
+// FailAfter writes the first n bytes of p and returns err, or writes all
+// of p without an error if it's no longer than n.
+func FailAfter(n int, err error) Behavior {
+	return Behavior{kind: fail, n: n, err: err}
+}
+
+// Block waits until ScriptedWriter.Release is called, and then writes all
+// of p.
+func Block() Behavior {
+	return Behavior{kind: block}
+}
+
+// Delay waits for d, and then writes all of p.
+func Delay(d time.Duration) Behavior {
+	return Behavior{kind: delay, delay: d}
+}
+
+// Repeat returns the behaviors given repeated n times, for scripts such as
+// a number of one-byte writes followed by a failure.
+func Repeat(n int, behaviors ...Behavior) []Behavior {
+	script := make([]Behavior, 0, n*len(behaviors))
+	for i := 0; i < n; i++ {
+		script = append(script, behaviors...)
+	}
+	return script
+}
+
+// ScriptedWriter is a destination for log pipeline writers under test, with
+// scriptable failure modes. Each call to Write takes the next Behavior from
+// its script, and the calls after the script has run out take Default. It
+// records the bytes passed to each call, and the bytes written. It's safe
+// for concurrent use, and a call that's blocked or delayed doesn't hold up
+// the others.
+type ScriptedWriter struct {
+	// Default is the behavior for calls once the script has run out:
+	// Accept unless set.
+	Default Behavior
+
+	mu       sync.Mutex
+	script   []Behavior
+	calls    []string
+	written  bytes.Buffer
+	limit    int
+	limitErr error
+	release  chan struct{}
+}
+
+// NewScriptedWriter returns a ScriptedWriter that behaves as given by
+// script for its first calls to Write.
+func NewScriptedWriter(script ...Behavior) *ScriptedWriter {
+	return &ScriptedWriter{
+		script:  script,
+		limit:   -1,
+		release: make(chan struct{}),
+	}
+}
+
+func (w *ScriptedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	b := w.Default
+	if len(w.script) > 0 {
+		b = w.script[0]
+		w.script = w.script[1:]
+	}
+	w.calls = append(w.calls, string(p))
+	w.mu.Unlock()
+
+	n := len(p)
+	var err error
+	switch b.kind {
+	case shortWrite:
+		if b.n < n {
+			n = b.n
+		}
+	case fail:
+		if b.n < 0 {
+			n, err = 0, b.err
+		} else if b.n < n {
+			n, err = b.n, b.err
+		}
+	case block:
+		<-w.release
+	case delay:
+		time.Sleep(b.delay)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.limit >= 0 && w.written.Len()+n > w.limit {
+		n, err = w.limit-w.written.Len(), w.limitErr
+		if n < 0 {
+			n = 0
+		}
+	}
+	w.written.Write(p[:n])
+	return n, err
+}
+
+// Limit makes the writer fail with err once n bytes have been written in
+// total, across calls: a call that would go over the limit writes up to it
+// and returns err, and so do all later calls, whatever their behavior. A
+// negative n removes the limit.
+func (w *ScriptedWriter) Limit(n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.limit = n
+	w.limitErr = err
+}
+
+// Release lets a call blocked by Block carry on, waiting until there is
+// one.
+func (w *ScriptedWriter) Release() {
+	w.release <- struct{}{}
+}
+
+// Calls returns the bytes passed to each call to Write so far, whether
+// they were written or not.
+func (w *ScriptedWriter) Calls() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.calls...)
+}
+
+// String returns the bytes written so far.
+func (w *ScriptedWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.written.String()
+}
+
+// Reset forgets the calls and bytes written so far. The rest of the script
+// is kept.
+func (w *ScriptedWriter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls = nil
+	w.written.Reset()
+}
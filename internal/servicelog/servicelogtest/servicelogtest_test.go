@@ -0,0 +1,245 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelogtest_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+// Hook up check.v1 into the "go test" runner
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type servicelogtestSuite struct{}
+
+var _ = Suite(&servicelogtestSuite{})
+
+var errTest = errors.New("test failure")
+
+func (s *servicelogtestSuite) TestScript(c *C) {
+	w := servicelogtest.NewScriptedWriter(
+		servicelogtest.Accept(),
+		servicelogtest.ShortWrite(2),
+		servicelogtest.ShortWrite(0),
+		servicelogtest.Fail(errTest),
+		servicelogtest.FailAfter(1, errTest),
+		servicelogtest.FailAfter(10, errTest),
+		servicelogtest.Delay(time.Millisecond),
+	)
+	for _, test := range []struct {
+		p   string
+		n   int
+		err error
+	}{
+		{"one", 3, nil},
+		{"two", 2, nil},
+		{"three", 0, nil},
+		{"four", 0, errTest},
+		{"five", 1, errTest},
+		{"six", 3, nil},
+		{"seven", 5, nil},
+		// The script has run out.
+		{"eight", 5, nil},
+		{"", 0, nil},
+	} {
+		n, err := io.WriteString(w, test.p)
+		c.Check(n, Equals, test.n, Commentf("writing %q", test.p))
+		c.Check(err, Equals, test.err, Commentf("writing %q", test.p))
+	}
+	c.Check(w.Calls(), DeepEquals, []string{"one", "two", "three", "four", "five", "six", "seven", "eight", ""})
+	c.Check(w.String(), Equals, "onetwfsixseveneight")
+
+	// Fail fails even writes with nothing to write.
+	w = servicelogtest.NewScriptedWriter(servicelogtest.Fail(errTest))
+	_, err := w.Write(nil)
+	c.Check(err, Equals, errTest)
+
+	w.Reset()
+	c.Check(w.Calls(), HasLen, 0)
+	c.Check(w.String(), Equals, "")
+}
+
+func (s *servicelogtestSuite) TestDefault(c *C) {
+	w := servicelogtest.NewScriptedWriter(servicelogtest.Accept())
+	w.Default = servicelogtest.ShortWrite(1)
+	n, err := io.WriteString(w, "one")
+	c.Check(n, Equals, 3)
+	c.Check(err, IsNil)
+	n, err = io.WriteString(w, "two")
+	c.Check(n, Equals, 1)
+	c.Check(err, IsNil)
+	c.Check(w.String(), Equals, "onet")
+}
+
+func (s *servicelogtestSuite) TestRepeat(c *C) {
+	script := servicelogtest.Repeat(2, servicelogtest.ShortWrite(1), servicelogtest.Fail(errTest))
+	c.Check(script, DeepEquals, []servicelogtest.Behavior{
+		servicelogtest.ShortWrite(1), servicelogtest.Fail(errTest),
+		servicelogtest.ShortWrite(1), servicelogtest.Fail(errTest),
+	})
+	c.Check(servicelogtest.Repeat(0, servicelogtest.Accept()), HasLen, 0)
+}
+
+func (s *servicelogtestSuite) TestLimit(c *C) {
+	w := servicelogtest.NewScriptedWriter()
+	w.Limit(5, errTest)
+	n, err := io.WriteString(w, "one")
+	c.Check(n, Equals, 3)
+	c.Check(err, IsNil)
+	n, err = io.WriteString(w, "two")
+	c.Check(n, Equals, 2)
+	c.Check(err, Equals, errTest)
+	n, err = io.WriteString(w, "three")
+	c.Check(n, Equals, 0)
+	c.Check(err, Equals, errTest)
+
+	// Empty writes, and writes that make no progress, don't go over it.
+	n, err = io.WriteString(w, "")
+	c.Check(n, Equals, 0)
+	c.Check(err, IsNil)
+
+	w.Limit(-1, nil)
+	n, err = io.WriteString(w, "four")
+	c.Check(n, Equals, 4)
+	c.Check(err, IsNil)
+	c.Check(w.String(), Equals, "onetwfour")
+
+	// A limit below what's been written fails the next write.
+	w.Limit(1, errTest)
+	n, err = io.WriteString(w, "five")
+	c.Check(n, Equals, 0)
+	c.Check(err, Equals, errTest)
+}
+
+func (s *servicelogtestSuite) TestBlock(c *C) {
+	w := servicelogtest.NewScriptedWriter(servicelogtest.Block())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := io.WriteString(w, "blocked")
+		c.Check(n, Equals, 7)
+		c.Check(err, IsNil)
+	}()
+
+	// Other calls aren't held up by the blocked one.
+	for len(w.Calls()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err := io.WriteString(w, "other")
+	c.Assert(err, IsNil)
+	select {
+	case <-done:
+		c.Fatalf("blocked write returned before being released")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	w.Release()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for the released write")
+	}
+	c.Check(w.String(), Equals, "otherblocked")
+}
+
+func (s *servicelogtestSuite) TestCheckLines(c *C) {
+	input := "first\n\nthird [test] with a prefix's tag\nlast"
+	for _, test := range []struct {
+		output string
+		error  string
+	}{{
+		output: `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] 
+2021-05-13T03:16:51.002Z [test] third [test] with a prefix's tag
+2021-05-13T03:16:51.002Z [test] last`[1:],
+	}, {
+		output: `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] 
+2021-05-13T03:16:51.002Z [test] third [test] with a prefix's tag
+2021-05-13T03:16:51.002Z [test] last
+`[1:],
+		error: `line 4 has message "last\\n", want "last"`,
+	}, {
+		output: `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] 
+2021-05-13T03:16:51.002Z [test] third [test] with 
+2021-05-13T03:16:51.002Z [test] a prefix's tag
+2021-05-13T03:16:51.002Z [test] last`[1:],
+		error: `line 3 has message "third \[test\] with \\n", want .*`,
+	}, {
+		output: `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] 
+third [test] with a prefix's tag
+2021-05-13T03:16:51.002Z [test] last`[1:],
+		error: `line 3 "third \[test\] with a prefix's tag\\n" has no valid prefix: .*`,
+	}, {
+		output: `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [other] 
+`[1:],
+		error: `line 2 .* is for service "other", want "test"`,
+	}, {
+		output: `
+2021-05-13T03:16:51.002Z [test] first
+2021-05-13T03:16:51.001Z [test] 
+`[1:],
+		error: `line 2 .* has a timestamp earlier than the line before`,
+	}, {
+		output: `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] 
+`[1:],
+		error: `line 3 "third \[test\] .*" is missing`,
+	}, {
+		output: `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] 
+2021-05-13T03:16:51.002Z [test] third [test] with a prefix's tag
+2021-05-13T03:16:51.002Z [test] last
+2021-05-13T03:16:51.002Z [test] again`[1:],
+		error: `line 4 has message "last\\n", want "last"`,
+	}, {
+		output: `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] 
+2021-05-13T03:16:51.002Z [test] third [test] with a prefix's tag
+2021-05-13T03:16:51.002Z [test] last2021-05-13T03:16:51.002Z [test] again`[1:],
+		error: `line 4 has message .*, want "last"`,
+	}} {
+		err := servicelogtest.CheckLines([]byte(test.output), []byte(input), "test")
+		if test.error == "" {
+			c.Check(err, IsNil)
+		} else {
+			c.Check(err, ErrorMatches, test.error)
+		}
+	}
+
+	// Extra lines are reported.
+	err := servicelogtest.CheckLines([]byte("2021-05-13T03:16:51.001Z [test] one\n2021-05-13T03:16:51.001Z [test] two\n"), []byte("one\n"), "test")
+	c.Check(err, ErrorMatches, `line 2 .* is extra`)
+	c.Check(servicelogtest.CheckLines(nil, nil, "test"), IsNil)
+}
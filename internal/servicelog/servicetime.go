@@ -0,0 +1,310 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceTimeSlack is how much longer than its layout a service's
+// timestamp may be, for fractional seconds that the layout doesn't show
+// and names that are longer than the layout's ("Wednesday" for "Mon").
+const serviceTimeSlack = 16
+
+// serviceTimeWriter takes the timestamp of each line from the service's
+// own timestamp at its start, if it has one, for the formatter it writes
+// to.
+type serviceTimeWriter struct {
+	mu      sync.Mutex
+	dest    *formatter
+	layouts []*serviceTimeLayout
+	// max is the length of the longest timestamp in any of the layouts,
+	// and first the bytes any of them can start with.
+	max   int
+	first [256]bool
+	// held is the start of the current line, held back until it's known
+	// whether it starts with a timestamp, and arrival is when its first
+	// bytes arrived.
+	held    []byte
+	arrival time.Time
+	// midLine is set once the start of the current line has been passed
+	// on, until the end of the line.
+	midLine bool
+}
+
+// serviceTimeLayout is one of the layouts of a service's timestamps.
+type serviceTimeLayout struct {
+	layout string
+	// first is the bytes a timestamp in the layout can start with.
+	first [256]bool
+	// noYear and noDate are set if the layout has no year, or no date at
+	// all, to be taken from the time the line arrived.
+	noYear bool
+	noDate bool
+}
+
+// NewFormatWriterWithServiceTime is like NewFormatWriter, but for services
+// that write their own timestamp at the start of each line, in the given
+// layout as understood by time.Parse. Such a timestamp is removed from the
+// line, and the line is logged with it, in the usual format, rather than
+// with the time it was written, so lines the service wrote out in bursts
+// keep the times it logged them at. Timestamps without a time zone are
+// taken to be in UTC, and without a year, in the year they were written.
+// Lines that don't start with a timestamp in the layout, including ones
+// that merely look like one, are logged unchanged at the time they were
+// written.
+//
+// The start of each line is held back until the line is complete or it's
+// longer than a timestamp in the layout can be (16 bytes longer than the
+// layout), unless its first byte can't start a timestamp.
+//
+// The options apply to the formatter the lines are passed to, as for
+// NewFormatWriter.
+func NewFormatWriterWithServiceTime(dest io.Writer, serviceName, layout string, opts ...FormatOption) (io.Writer, error) {
+	return NewFormatWriterWithServiceTimes(dest, serviceName, []string{layout}, opts...)
+}
+
+// NewFormatWriterWithServiceTimes is like NewFormatWriterWithServiceTime,
+// for services whose lines start with timestamps in any of several
+// layouts, such as those of a library or a subprocess they log for. The
+// timestamp removed from a line is the longest one that parses in any of
+// the layouts, or in the first of them if several are as long, so a layout
+// that's the start of another doesn't shadow it.
+func NewFormatWriterWithServiceTimes(dest io.Writer, serviceName string, layouts []string, opts ...FormatOption) (io.Writer, error) {
+	if len(layouts) == 0 {
+		return nil, errors.New("no service timestamp layouts given")
+	}
+	f, err := newFormatter(dest, serviceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	w := &serviceTimeWriter{dest: f}
+	for _, layout := range layouts {
+		l, err := newServiceTimeLayout(layout)
+		if err != nil {
+			return nil, err
+		}
+		w.layouts = append(w.layouts, l)
+		if max := len(layout) + serviceTimeSlack; max > w.max {
+			w.max = max
+		}
+		for b, ok := range l.first {
+			w.first[b] = w.first[b] || ok
+		}
+	}
+	return w, nil
+}
+
+func newServiceTimeLayout(layout string) (*serviceTimeLayout, error) {
+	switch {
+	case layout == "":
+		return nil, errors.New("service timestamp layout must not be empty")
+	case strings.ContainsAny(layout, "\r\n"):
+		return nil, fmt.Errorf("service timestamp layout %q must not contain line breaks", layout)
+	case time.Unix(0, 0).UTC().Format(layout) == layout:
+		return nil, fmt.Errorf("service timestamp layout %q has no date or time elements", layout)
+	}
+	ref := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	formatted := ref.Format(layout)
+	noYear := ref.AddDate(1, 0, 0).Format(layout) == formatted
+	l := &serviceTimeLayout{
+		layout: layout,
+		noYear: noYear,
+		noDate: noYear && ref.AddDate(0, 1, 1).Format(layout) == formatted,
+	}
+	// The first byte of the layout formatted at a couple of times gives
+	// the kind of byte a timestamp in it starts with: a digit, a letter of
+	// a name, a zone's sign, or a literal byte. A space may be the padding
+	// of a day.
+	for _, t := range []time.Time{ref, time.Date(1999, 11, 13, 16, 15, 16, 0, time.FixedZone("", -3600))} {
+		b := t.Format(layout)[0]
+		switch {
+		case b >= '0' && b <= '9', b == ' ':
+			for c := '0'; c <= '9'; c++ {
+				l.first[c] = true
+			}
+			l.first[b] = true
+		case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z':
+			for c := 'a'; c <= 'z'; c++ {
+				l.first[c] = true
+				l.first[c-'a'+'A'] = true
+			}
+		case b == '+', b == '-', b == 'Z':
+			l.first['+'] = true
+			l.first['-'] = true
+			l.first['Z'] = true
+		default:
+			l.first[b] = true
+		}
+	}
+	return l, nil
+}
+
+func (w *serviceTimeWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		if w.midLine {
+			line := p
+			if i := bytes.IndexByte(p, '\n'); i >= 0 {
+				line = p[:i+1]
+				w.midLine = false
+			}
+			n, err := w.dest.Write(line)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			p = p[len(line):]
+			continue
+		}
+
+		// Hold back the start of the line until it's complete or as long
+		// as a timestamp can be.
+		if len(w.held) == 0 {
+			w.arrival = clock.Now()
+		}
+		max := w.max
+		chunk := p
+		if len(chunk) > max-len(w.held) {
+			chunk = chunk[:max-len(w.held)]
+		}
+		if i := bytes.IndexByte(chunk, '\n'); i >= 0 {
+			chunk = chunk[:i+1]
+		}
+		w.held = append(w.held, chunk...)
+		p = p[len(chunk):]
+		written += len(chunk)
+		if len(w.held) < max && w.held[len(w.held)-1] != '\n' && w.first[w.held[0]] {
+			break
+		}
+		held := len(w.held)
+		t, end := w.parse()
+		n, err := w.flush(t, end)
+		if err != nil {
+			// The bytes held back from earlier writes were reported
+			// written already.
+			unwritten := held - n
+			if unwritten > len(chunk) {
+				unwritten = len(chunk)
+			}
+			return written - unwritten, err
+		}
+	}
+	return written, nil
+}
+
+// parse returns the time of the timestamp at the start of the bytes held
+// back, if they start with one, and its length.
+func (w *serviceTimeWriter) parse() (t time.Time, end int) {
+	if !w.first[w.held[0]] {
+		return time.Time{}, 0
+	}
+	value := string(w.held)
+	for _, l := range w.layouts {
+		if !l.first[value[0]] {
+			continue
+		}
+		if lt, lend := l.parse(value, w.arrival); lend > end {
+			t, end = lt, lend
+		}
+	}
+	return t, end
+}
+
+// parse returns the time of the timestamp in the layout at the start of
+// value, if it starts with one, and its length, for a line that arrived at
+// the given time.
+func (l *serviceTimeLayout) parse(value string, arrival time.Time) (t time.Time, end int) {
+	t, err := time.ParseInLocation(l.layout, value, time.UTC)
+	if err != nil {
+		// The timestamp may be followed by the rest of the line, which
+		// time.Parse reports as extra text.
+		var parseErr *time.ParseError
+		if !errors.As(err, &parseErr) || parseErr.LayoutElem != "" || !strings.HasPrefix(parseErr.Message, ": extra text") {
+			return time.Time{}, 0
+		}
+		value = value[:len(value)-len(parseErr.ValueElem)]
+		t, err = time.ParseInLocation(l.layout, value, time.UTC)
+		if err != nil {
+			return time.Time{}, 0
+		}
+	}
+	arrival = arrival.UTC()
+	switch {
+	case l.noDate:
+		// Use the day the line was written, or the day before if that's
+		// more than 12 hours in the future, for lines from just before
+		// midnight written after it.
+		t = time.Date(arrival.Year(), arrival.Month(), arrival.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+		if t.After(arrival.Add(12 * time.Hour)) {
+			t = t.AddDate(0, 0, -1)
+		}
+	case l.noYear:
+		// Use the year the line was written, or the year before if that's
+		// more than a day in the future, for lines from the end of
+		// December written in January.
+		t = t.AddDate(arrival.Year(), 0, 0)
+		if t.After(arrival.Add(24 * time.Hour)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+	}
+	return t, len(value)
+}
+
+// flush passes on the bytes held back, without their first end bytes, the
+// timestamp, as the start of a line at time t, or at the time they arrived
+// if t is zero. It returns the number of bytes held back that were
+// written, counting the timestamp, and forgets them all.
+func (w *serviceTimeWriter) flush(t time.Time, end int) (int, error) {
+	if t.IsZero() {
+		t = w.arrival
+	}
+	held := w.held
+	w.held = w.held[:0]
+	w.midLine = held[len(held)-1] != '\n'
+	w.dest.setLineTime(t)
+	rest := held[end:]
+	n, err := w.dest.Write(rest)
+	if n < len(rest) {
+		// The line hasn't started if nothing of it was written, and the
+		// timestamp must be written again with it.
+		w.midLine = n > 0
+		if n == 0 {
+			return 0, err
+		}
+	}
+	return end + n, err
+}
+
+// Close passes on any start of a line held back, and closes the formatter
+// so that it ends an incomplete line. It doesn't close dest.
+func (w *serviceTimeWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.held) > 0 {
+		if _, err := w.flush(time.Time{}, 0); err != nil {
+			return err
+		}
+	}
+	return w.dest.Close()
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type serviceTimeSuite struct {
+	restore func()
+}
+
+var _ = Suite(&serviceTimeSuite{})
+
+func (s *serviceTimeSuite) SetUpTest(c *C) {
+	s.restore = servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+}
+
+func (s *serviceTimeSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+const rfc3339Input = `2021-05-13T03:16:49Z first
+2021-05-13T05:16:50.123456+02:00 second, logged in another zone
+2021-05-13T03:16:50.5Z
+2021-13-01T00:00:00Z looks like a timestamp but isn't one
+
+not a timestamp
+2021-05-13T03:16:51Z ` + "a long line " + `2021-05-13T03:16:51Z with a timestamp in it
+2021-05-13T03:16:50Z last, without a newline`
+
+const rfc3339Output = `2021-05-13T03:16:49.000Z [test] first
+2021-05-13T03:16:50.123Z [test] second, logged in another zone
+2021-05-13T03:16:51.001Z [test] 2021-05-13T03:16:50.5Z
+2021-05-13T03:16:51.001Z [test] 2021-13-01T00:00:00Z looks like a timestamp but isn't one
+2021-05-13T03:16:51.001Z [test] 
+2021-05-13T03:16:51.001Z [test] not a timestamp
+2021-05-13T03:16:51.000Z [test] a long line 2021-05-13T03:16:51Z with a timestamp in it
+2021-05-13T03:16:50.000Z [test] last, without a newline`
+
+func (s *serviceTimeSuite) TestRFC3339(c *C) {
+	for _, size := range []int{1, 7, len(rfc3339Input)} {
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewFormatWriterWithServiceTime(b, "test", "2006-01-02T15:04:05Z07:00 ")
+		c.Assert(err, IsNil)
+		for p := rfc3339Input; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			written, err := io.WriteString(w, p[:n])
+			c.Assert(err, IsNil)
+			c.Assert(written, Equals, n)
+			p = p[n:]
+		}
+		c.Assert(w.(io.Closer).Close(), IsNil)
+		c.Check(b.String(), Equals, rfc3339Output+servicelog.IncompleteLineMarker+"\n", Commentf("writes of %d bytes", size))
+	}
+}
+
+func (s *serviceTimeSuite) TestSyslog(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriterWithServiceTime(b, "test", "Jan _2 15:04:05 ")
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, `May  3 10:00:00 padded day
+May 3 10:00:01 unpadded day
+Dec 31 23:59:59 last year's
+May 13 03:16:51.25 fractional seconds
+Feb 30 10:00:00 no such day
+May  3 10:00 no seconds
+Mayday 10:00:00
+`)
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-03T10:00:00.000Z [test] padded day
+2021-05-03T10:00:01.000Z [test] unpadded day
+2020-12-31T23:59:59.000Z [test] last year's
+2021-05-13T03:16:51.250Z [test] fractional seconds
+2021-05-13T03:16:51.001Z [test] Feb 30 10:00:00 no such day
+2021-05-13T03:16:51.001Z [test] May  3 10:00 no seconds
+2021-05-13T03:16:51.001Z [test] Mayday 10:00:00
+`[1:])
+}
+
+func (s *serviceTimeSuite) TestNoSeparator(c *C) {
+	// The end of a timestamp is found even if the layout doesn't end with
+	// a separator.
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriterWithServiceTime(b, "test", "15:04:05")
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "03:16:40|first\n03:16:41.5\n03:16\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:40.000Z [test] |first
+2021-05-13T03:16:41.500Z [test] 
+2021-05-13T03:16:51.001Z [test] 03:16
+`[1:])
+}
+
+func (s *serviceTimeSuite) TestLayouts(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriterWithServiceTimes(b, "test", []string{
+		"I0102 15:04:05 ",
+		"2006-01-02T15:04:05Z07:00 ",
+		"15:04:05 ",
+	})
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, `I0513 03:16:49.001 glog
+2021-05-13T03:16:50Z from a library
+03:16:50.5 from a subprocess
+W0513 03:16:49 another severity
+03:16 none
+`)
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:49.001Z [test] glog
+2021-05-13T03:16:50.000Z [test] from a library
+2021-05-13T03:16:50.500Z [test] from a subprocess
+2021-05-13T03:16:51.001Z [test] W0513 03:16:49 another severity
+2021-05-13T03:16:51.001Z [test] 03:16 none
+`[1:])
+}
+
+func (s *serviceTimeSuite) TestLongestLayout(c *C) {
+	// A layout that's the start of another doesn't shadow it, whatever
+	// their order.
+	for _, layouts := range [][]string{
+		{"2006-01-02 ", "2006-01-02 15:04:05 "},
+		{"2006-01-02 15:04:05 ", "2006-01-02 "},
+	} {
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewFormatWriterWithServiceTimes(b, "test", layouts)
+		c.Assert(err, IsNil)
+		_, err = io.WriteString(w, "2021-05-12 03:16:50 with a time\n2021-05-12 without\n")
+		c.Assert(err, IsNil)
+		c.Check(b.String(), Equals, `
+2021-05-12T03:16:50.000Z [test] with a time
+2021-05-12T00:00:00.000Z [test] without
+`[1:], Commentf("layouts %q", layouts))
+	}
+}
+
+func (s *serviceTimeSuite) TestFirstByte(c *C) {
+	// A line whose first byte can't start a timestamp isn't held back.
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriterWithServiceTimes(b, "test", []string{"Jan _2 15:04:05 ", "2006-01-02T15:04:05Z07:00 "})
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "[x] prompt: ")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] [x] prompt: ")
+	_, err = io.WriteString(w, "yes\n2021")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] [x] prompt: yes\n")
+}
+
+func (s *serviceTimeSuite) TestChunking(c *C) {
+	// The original instants survive whatever the chunking.
+	newWriter := func(dest io.Writer) io.Writer {
+		w, err := servicelog.NewFormatWriterWithServiceTime(dest, "test", "2006-01-02T15:04:05Z07:00 ")
+		c.Assert(err, IsNil)
+		return w
+	}
+	inputs := append([]string{rfc3339Input, strings.Repeat("2021-05-13T03:16:49.999Z x\n", 1000)}, chunkingInputs...)
+	for seed := int64(0); seed < 10; seed++ {
+		err := checkChunking(newWriter, inputs, seed, 20)
+		c.Assert(err, IsNil, Commentf("seed %d", seed))
+	}
+}
+
+func (s *serviceTimeSuite) TestClose(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriterWithServiceTime(b, "test", "2006-01-02T15:04:05Z07:00 ")
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "2021-05-13T03:16:49Z first\n2021-05-13T03:1")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:49.000Z [test] first\n")
+
+	// The start of a line held back is logged as it is.
+	c.Assert(w.(io.Closer).Close(), IsNil)
+	c.Check(b.String(), Equals, `
+2021-05-13T03:16:49.000Z [test] first
+2021-05-13T03:16:51.001Z [test] 2021-05-13T03:1 [incomplete line]
+`[1:])
+}
+
+func (s *serviceTimeSuite) TestWriteError(c *C) {
+	errFull := errors.New("full")
+	dest := servicelogtest.NewScriptedWriter(servicelogtest.Accept(), servicelogtest.Fail(errFull))
+	w, err := servicelog.NewFormatWriterWithServiceTime(dest, "test", "2006-01-02T15:04:05Z07:00 ")
+	c.Assert(err, IsNil)
+	input := "2021-05-13T03:16:49Z first\n2021-05-13T03:16:50Z second\n"
+	n, err := io.WriteString(w, input)
+	c.Check(err, ErrorMatches, `cannot write logs for service "test" \(format\): full`)
+	c.Check(n, Equals, len("2021-05-13T03:16:49Z first\n"))
+
+	// The rest of the input is logged when it's written again.
+	_, err = io.WriteString(w, input[n:])
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, `
+2021-05-13T03:16:49.000Z [test] first
+2021-05-13T03:16:50.000Z [test] second
+`[1:])
+}
+
+func (s *serviceTimeSuite) TestInvalidLayout(c *C) {
+	for _, test := range []struct {
+		layout string
+		error  string
+	}{
+		{"", "service timestamp layout must not be empty"},
+		{"15:04\n", `service timestamp layout "15:04\\n" must not contain line breaks`},
+		{"[pebble] ", `service timestamp layout "\[pebble\] " has no date or time elements`},
+	} {
+		w, err := servicelog.NewFormatWriterWithServiceTime(&bytes.Buffer{}, "test", test.layout)
+		c.Check(err, ErrorMatches, test.error)
+		c.Check(w, IsNil)
+		w, err = servicelog.NewFormatWriterWithServiceTimes(&bytes.Buffer{}, "test", []string{"15:04:05 ", test.layout})
+		c.Check(err, ErrorMatches, test.error)
+		c.Check(w, IsNil)
+	}
+	w, err := servicelog.NewFormatWriterWithServiceTimes(&bytes.Buffer{}, "test", nil)
+	c.Check(err, ErrorMatches, "no service timestamp layouts given")
+	c.Check(w, IsNil)
+}
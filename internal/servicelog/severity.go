@@ -0,0 +1,282 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a line of a service's output.
+type Level int
+
+const (
+	LevelTrace Level = iota + 1
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+var levelNames = [...]string{
+	LevelTrace: "trace",
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+	LevelFatal: "fatal",
+}
+
+func (l Level) String() string {
+	if l < LevelTrace || l > LevelFatal {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// SeverityScanLength is the number of bytes at the start of each line
+// that a SeverityWriter looks for the line's level in.
+const SeverityScanLength = 64
+
+// LevelPattern is a regexp matching the lines of a level.
+type LevelPattern struct {
+	Level   Level
+	Pattern string
+}
+
+// DefaultLevelPatterns match the usual level names, in any case, as words
+// of their own, as in "WARN", "[Warning]" or "<warn>".
+var DefaultLevelPatterns = []LevelPattern{
+	{LevelTrace, `(?i)\btrace\b`},
+	{LevelDebug, `(?i)\b(debug|dbg)\b`},
+	{LevelInfo, `(?i)\b(info|notice)\b`},
+	{LevelWarn, `(?i)\b(warn|warning)\b`},
+	{LevelError, `(?i)\b(error|err)\b`},
+	{LevelFatal, `(?i)\b(fatal|critical|crit|panic)\b`},
+}
+
+// SeverityConfig configures a SeverityWriter.
+type SeverityConfig struct {
+	// Patterns are the patterns the levels of lines are detected with,
+	// DefaultLevelPatterns if it's nil.
+	Patterns []LevelPattern
+	// Default is the level of the lines without a level, LevelInfo if
+	// it's not set.
+	Default Level
+	// Min is the lowest level of the lines passed on. Lines of lower
+	// levels are dropped.
+	Min Level
+}
+
+// levelSetter is a formatter that can write the level of a line.
+type levelSetter interface {
+	setLineLevel(level Level)
+}
+
+// timeSetter is a formatter that can be given the time of a line.
+type timeSetter interface {
+	setLineTime(t time.Time)
+}
+
+type levelRegexp struct {
+	level Level
+	re    *regexp.Regexp
+}
+
+// SeverityWriter detects the level of each line of a service's output,
+// from the earliest match of its patterns in the first SeverityScanLength
+// bytes of the line, and drops the lines below its minimum level. It's put
+// in front of a formatter, and the formatters of NewJSONFormatWriter and
+// NewLogfmtFormatWriter write each line's level as a field of its record.
+// The start of each line is held back until the line is complete or it's
+// SeverityScanLength bytes long.
+type SeverityWriter struct {
+	mu       sync.Mutex
+	dest     io.Writer
+	patterns []levelRegexp
+	def      Level
+	min      Level
+
+	// held is the start of the current line, held back until its level is
+	// known, and arrival is when its first bytes arrived. Once the level
+	// is known, passing is set if the line is passed on, and dropping if
+	// it's dropped, until its end.
+	held     []byte
+	arrival  time.Time
+	passing  bool
+	dropping bool
+	stats    *writerStats
+}
+
+// NewSeverityWriter returns a SeverityWriter that writes to dest, usually
+// a formatter.
+func NewSeverityWriter(dest io.Writer, config SeverityConfig) (*SeverityWriter, error) {
+	patterns := config.Patterns
+	if patterns == nil {
+		patterns = DefaultLevelPatterns
+	}
+	if len(patterns) == 0 {
+		return nil, errors.New("no level patterns given")
+	}
+	w := &SeverityWriter{
+		dest:  dest,
+		stats: &writerStats{},
+		def:   config.Default,
+		min:   config.Min,
+	}
+	if w.def == 0 {
+		w.def = LevelInfo
+	}
+	for _, level := range []Level{w.def, w.min} {
+		if level != 0 && (level < LevelTrace || level > LevelFatal) {
+			return nil, fmt.Errorf("invalid log level %d", level)
+		}
+	}
+	for _, pattern := range patterns {
+		if pattern.Level < LevelTrace || pattern.Level > LevelFatal {
+			return nil, fmt.Errorf("invalid log level %d", pattern.Level)
+		}
+		re, err := regexp.Compile(pattern.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s level pattern: %v", pattern.Level, err)
+		}
+		w.patterns = append(w.patterns, levelRegexp{pattern.Level, re})
+	}
+	return w, nil
+}
+
+func (w *SeverityWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		end := false
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			chunk = p[:i+1]
+			end = true
+		}
+		switch {
+		case w.passing:
+			n, err := w.stats.write(w.dest, chunk)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			w.passing = !end
+		case w.dropping:
+			written += len(chunk)
+			w.dropping = !end
+		default:
+			if room := SeverityScanLength - len(w.held); len(chunk) > room {
+				chunk = chunk[:room]
+				end = false
+			}
+			if len(w.held) == 0 {
+				w.arrival = clock.Now()
+			}
+			w.held = append(w.held, chunk...)
+			written += len(chunk)
+			if end || len(w.held) == SeverityScanLength {
+				if err := w.decide(end); err != nil {
+					return written - len(chunk), err
+				}
+			}
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// decide detects the level of the line held back, and passes it on or
+// drops it. end is set if the line is complete.
+func (w *SeverityWriter) decide(end bool) error {
+	held := w.held
+	w.held = w.held[:0]
+	level := w.detect(bytes.TrimSuffix(held, []byte{'\n'}))
+	if level < w.min {
+		w.stats.addDropped(1)
+		w.dropping = !end
+		return nil
+	}
+	if setter, ok := w.dest.(levelSetter); ok {
+		setter.setLineLevel(level)
+	}
+	if setter, ok := w.dest.(timeSetter); ok {
+		setter.setLineTime(w.arrival)
+	}
+	w.passing = !end
+	_, err := w.stats.writeFull(w.dest, held)
+	return err
+}
+
+// detect returns the level of the earliest match of the patterns in line,
+// or the default level if none matches.
+func (w *SeverityWriter) detect(line []byte) Level {
+	level, start := w.def, len(line)+1
+	for _, pattern := range w.patterns {
+		if loc := pattern.re.FindIndex(line); loc != nil && loc[0] < start {
+			level, start = pattern.level, loc[0]
+		}
+	}
+	return level
+}
+
+// Dropped returns the number of lines dropped so far.
+func (w *SeverityWriter) Dropped() int64 {
+	return w.stats.droppedLines()
+}
+
+// Stats returns the writer's statistics.
+func (w *SeverityWriter) Stats() WriterStats {
+	return w.stats.snapshot()
+}
+
+// flushIdle decides on the start of a line held back, for an
+// IdleFlushWriter.
+func (w *SeverityWriter) flushIdle() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.held) > 0 {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	return flushIdle(w.dest)
+}
+
+// Close passes on the start of a line held back, unless its level is below
+// the minimum, and closes dest, if it's an io.Closer, so that it can end
+// an incomplete line.
+func (w *SeverityWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	if len(w.held) > 0 {
+		err = w.decide(false)
+	}
+	w.passing = false
+	w.dropping = false
+	if closeErr := closeWriter(w.dest); err == nil {
+		err = closeErr
+	}
+	return err
+}
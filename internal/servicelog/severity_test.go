@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type severitySuite struct {
+	restore func()
+}
+
+var _ = Suite(&severitySuite{})
+
+func (s *severitySuite) SetUpTest(c *C) {
+	s.restore = servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+}
+
+func (s *severitySuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *severitySuite) TestNew(c *C) {
+	_, err := servicelog.NewSeverityWriter(&bytes.Buffer{}, servicelog.SeverityConfig{Patterns: []servicelog.LevelPattern{}})
+	c.Check(err, ErrorMatches, "no level patterns given")
+	_, err = servicelog.NewSeverityWriter(&bytes.Buffer{}, servicelog.SeverityConfig{
+		Patterns: []servicelog.LevelPattern{{servicelog.LevelWarn, "("}},
+	})
+	c.Check(err, ErrorMatches, "invalid warn level pattern: .*")
+	_, err = servicelog.NewSeverityWriter(&bytes.Buffer{}, servicelog.SeverityConfig{Min: 9})
+	c.Check(err, ErrorMatches, "invalid log level 9")
+}
+
+func (s *severitySuite) TestLevel(c *C) {
+	c.Check(servicelog.LevelWarn.String(), Equals, "warn")
+	c.Check(servicelog.Level(0).String(), Equals, "Level(0)")
+}
+
+const severityInput = `Warning: disk low
+[ERROR] request failed
+<Info> connected
+dEbUg: polling
+plain line
+2021-05-13 03:16:49 FATAL crashed
+INFO no error here
+`
+
+func (s *severitySuite) TestJSON(c *C) {
+	// Tokens are detected in any case, and the earliest one wins.
+	for _, size := range []int{1, 10, len(severityInput)} {
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewSeverityWriter(servicelog.NewJSONFormatWriter(b, "test"), servicelog.SeverityConfig{})
+		c.Assert(err, IsNil)
+		writeSized(c, w, severityInput, size)
+		c.Check(b.String(), Equals, `
+{"time":"2021-05-13T03:16:51.001Z","service":"test","level":"warn","message":"Warning: disk low"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","level":"error","message":"[ERROR] request failed"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","level":"info","message":"<Info> connected"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","level":"debug","message":"dEbUg: polling"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","level":"info","message":"plain line"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","level":"fatal","message":"2021-05-13 03:16:49 FATAL crashed"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","level":"info","message":"INFO no error here"}
+`[1:], Commentf("writes of %d bytes", size))
+		c.Check(w.Dropped(), Equals, int64(0))
+	}
+}
+
+func (s *severitySuite) TestLogfmt(c *C) {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewSeverityWriter(servicelog.NewLogfmtFormatWriter(b, "test"), servicelog.SeverityConfig{
+		Default: servicelog.LevelDebug,
+	})
+	c.Assert(err, IsNil)
+	writeSized(c, w, "WARN slow\nunknown\n", 18)
+	c.Check(b.String(), Equals, `
+ts=2021-05-13T03:16:51.001Z service=test level=warn msg="WARN slow"
+ts=2021-05-13T03:16:51.001Z service=test level=debug msg="unknown"
+`[1:])
+}
+
+func (s *severitySuite) TestMin(c *C) {
+	// Lines at the minimum level are kept, and those below it dropped,
+	// including those of the default level.
+	for _, size := range []int{1, 10, len(severityInput)} {
+		b := &bytes.Buffer{}
+		w, err := servicelog.NewSeverityWriter(b, servicelog.SeverityConfig{Min: servicelog.LevelWarn})
+		c.Assert(err, IsNil)
+		writeSized(c, w, severityInput, size)
+		c.Check(b.String(), Equals, "Warning: disk low\n[ERROR] request failed\n2021-05-13 03:16:49 FATAL crashed\n", Commentf("writes of %d bytes", size))
+		c.Check(w.Dropped(), Equals, int64(4))
+	}
+
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewSeverityWriter(b, servicelog.SeverityConfig{
+		Default: servicelog.LevelWarn,
+		Min:     servicelog.LevelWarn,
+	})
+	c.Assert(err, IsNil)
+	writeSized(c, w, "info\nplain\nincomplete info", 100)
+	c.Check(b.String(), Equals, "plain\n")
+	c.Check(w.Dropped(), Equals, int64(2))
+}
+
+func (s *severitySuite) TestLongLine(c *C) {
+	// Only the start of a line is scanned, and the rest of a line kept is
+	// passed on as it is.
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewSeverityWriter(b, servicelog.SeverityConfig{Min: servicelog.LevelInfo})
+	c.Assert(err, IsNil)
+	long := strings.Repeat("x", servicelog.SeverityScanLength)
+	writeSized(c, w, long+" DEBUG\nERROR "+long+"\n", 7)
+	c.Check(b.String(), Equals, long+" DEBUG\nERROR "+long+"\n")
+}
+
+func (s *severitySuite) TestServiceTime(c *C) {
+	// The level after a service's own timestamp is detected, and the
+	// timestamp removed after it.
+	b := &bytes.Buffer{}
+	f, err := servicelog.NewFormatWriterWithServiceTime(b, "test", "2006-01-02T15:04:05Z07:00 ")
+	c.Assert(err, IsNil)
+	w, err := servicelog.NewSeverityWriter(f, servicelog.SeverityConfig{Min: servicelog.LevelWarn})
+	c.Assert(err, IsNil)
+	writeSized(c, w, "2021-05-13T03:16:49Z DEBUG starting\n2021-05-13T03:16:50Z WARN slow\n", 5)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:50.000Z [test] WARN slow\n")
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/testutil"
+)
+
+// The soak test runs synthetic chatty services through full log pipelines
+// for a long time, while followers attach and detach and pipelines are
+// rebuilt, and then checks that goroutines, open file descriptors, and heap
+// usage are back near where they started. It's opt-in, as it's meant to
+// find slow leaks over hours:
+//
+//	PEBBLE_TEST_SOAK=2h go test -check.f soakSuite -timeout 3h ./internal/servicelog
+
+// soakStage is a writer wrapped around the rest of a soak pipeline. If the
+// writer it returns is an io.Closer, it's closed when the pipeline is
+// replaced.
+type soakStage struct {
+	name string
+	wrap func(dest io.Writer, service string) io.Writer
+}
+
+// soakStages are the stages of each soak pipeline in front of its ring
+// buffer, outermost first. Adding a writer type here is all it takes to
+// include it in the soak test.
+var soakStages = []soakStage{{
+	name: "format",
+	wrap: func(dest io.Writer, service string) io.Writer {
+		return newFormatWriter(dest, service)
+	},
+}}
+
+type soakConfig struct {
+	duration  time.Duration
+	services  int
+	followers int // per service
+	stages    []soakStage
+	// swapEvery is how often each service's pipeline is replaced with a
+	// new one, closing the old one.
+	swapEvery time.Duration
+	// settle is how long to wait for resource usage to return to the
+	// baseline before reporting a leak.
+	settle time.Duration
+}
+
+// soakPipeline is one service's writers and the ring buffer they end in.
+type soakPipeline struct {
+	writer  io.Writer
+	buffer  *servicelog.RingBuffer
+	closers []io.Closer
+}
+
+func newSoakPipeline(service string, stages []soakStage) *soakPipeline {
+	p := &soakPipeline{buffer: servicelog.NewRingBuffer(64 * 1024)}
+	p.writer = p.buffer
+	for i := len(stages) - 1; i >= 0; i-- {
+		p.writer = stages[i].wrap(p.writer, service)
+		if closer, ok := p.writer.(io.Closer); ok {
+			p.closers = append(p.closers, closer)
+		}
+	}
+	return p
+}
+
+func (p *soakPipeline) close() {
+	for _, closer := range p.closers {
+		closer.Close()
+	}
+	p.buffer.Close()
+}
+
+// soakService writes to its current pipeline, which followers read from
+// and which is replaced periodically.
+type soakService struct {
+	name     string
+	stages   []soakStage
+	mutex    sync.Mutex
+	pipeline *soakPipeline
+}
+
+func (s *soakService) current() *soakPipeline {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pipeline
+}
+
+func (s *soakService) write(line []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.pipeline.writer.Write(line)
+	return err
+}
+
+func (s *soakService) swap() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pipeline.close()
+	s.pipeline = newSoakPipeline(s.name, s.stages)
+}
+
+// runSoak runs the soak test and returns an error if a pipeline fails or
+// resources are leaked.
+func runSoak(config soakConfig) error {
+	baseline := testutil.SnapshotResources()
+
+	stop := make(chan struct{})
+	errs := make(chan error, config.services)
+	var wg sync.WaitGroup
+	var services []*soakService
+	for i := 0; i < config.services; i++ {
+		s := &soakService{
+			name:   fmt.Sprintf("soak%d", i),
+			stages: config.stages,
+		}
+		s.pipeline = newSoakPipeline(s.name, s.stages)
+		services = append(services, s)
+		seed := int64(i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			line := make([]byte, 0, 512)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				line = line[:0]
+				for n := rnd.Intn(500); n > 0; n-- {
+					line = append(line, byte('a'+rnd.Intn(26)))
+				}
+				line = append(line, '\n')
+				if err := s.write(line); err != nil {
+					errs <- fmt.Errorf("cannot write to %s: %v", s.name, err)
+					return
+				}
+				if rnd.Intn(100) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+
+		for j := 0; j < config.followers; j++ {
+			seed := int64(i*config.followers + j)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				soakFollow(s, stop, rand.New(rand.NewSource(seed)))
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(config.swapEvery)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					s.swap()
+				}
+			}
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		close(stop)
+		wg.Wait()
+		return err
+	case <-time.After(config.duration):
+	}
+	close(stop)
+	wg.Wait()
+	for _, s := range services {
+		s.current().close()
+	}
+	services = nil
+
+	return testutil.CheckResources(baseline, testutil.ResourceTolerance{
+		Goroutines: 2,
+		FDs:        2,
+		HeapInuse:  8 * 1024 * 1024,
+	}, config.settle)
+}
+
+// soakFollow repeatedly attaches to the service's current buffer, follows
+// it for a random time, and detaches.
+func soakFollow(s *soakService, stop <-chan struct{}, rnd *rand.Rand) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		var it servicelog.Iterator
+		if rnd.Intn(2) == 0 {
+			it = s.current().buffer.TailIterator()
+		} else {
+			it = s.current().buffer.HeadIterator(rnd.Intn(100))
+		}
+		detach := time.After(time.Duration(rnd.Intn(50)) * time.Millisecond)
+		cancel := make(chan struct{})
+		go func() {
+			select {
+			case <-stop:
+			case <-detach:
+			}
+			close(cancel)
+		}()
+		for it.Next(cancel) {
+			io.Copy(ioutil.Discard, it)
+		}
+		it.Close()
+	}
+}
+
+type soakSuite struct{}
+
+var _ = Suite(&soakSuite{})
+
+func (s *soakSuite) TestSoak(c *C) {
+	value := os.Getenv("PEBBLE_TEST_SOAK")
+	if value == "" {
+		c.Skip("set PEBBLE_TEST_SOAK to a duration (such as 2h) to run the soak test")
+	}
+	duration, err := time.ParseDuration(value)
+	c.Assert(err, IsNil)
+
+	err = runSoak(soakConfig{
+		duration:  duration,
+		services:  8,
+		followers: 4,
+		stages:    soakStages,
+		swapEvery: time.Second,
+		settle:    5 * time.Second,
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *soakSuite) TestDetectsLeaks(c *C) {
+	// A stage that leaks a goroutine each time a pipeline is built.
+	leaked := make(chan struct{})
+	defer close(leaked)
+	leaky := soakStage{
+		name: "leaky",
+		wrap: func(dest io.Writer, service string) io.Writer {
+			go func() { <-leaked }()
+			return dest
+		},
+	}
+
+	err := runSoak(soakConfig{
+		duration:  200 * time.Millisecond,
+		services:  2,
+		followers: 2,
+		stages:    append([]soakStage{leaky}, soakStages...),
+		swapEvery: 20 * time.Millisecond,
+		settle:    100 * time.Millisecond,
+	})
+	c.Assert(err, ErrorMatches, `resources leaked: \[goroutines .*`)
+}
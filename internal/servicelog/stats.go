@@ -0,0 +1,193 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// WriterStats is a snapshot of the accounting of a writer in a service's
+// log pipeline.
+type WriterStats struct {
+	// Lines is the number of complete lines written to the destination.
+	Lines int64
+	// Bytes is the number of bytes written to the destination.
+	Bytes int64
+	// Dropped is the number of lines of the service's output dropped.
+	Dropped int64
+	// LastError is the last error from writing to the destination, or nil
+	// if there's been none.
+	LastError error
+}
+
+// StatsReporter is implemented by the writers that keep WriterStats: the
+// writers returned by NewFormatWriter and NewRedactWriter, and the
+// AsyncWriter, CapWriter, FilterWriter, PipelineWriter, RateLimitWriter,
+// SampleWriter and SeverityWriter. Stats may be called while the writer is being written
+// to.
+type StatsReporter interface {
+	Stats() WriterStats
+}
+
+// writerStats counts what a writer writes to its destination, and the
+// lines it drops. The counters are updated atomically, without locking.
+type writerStats struct {
+	// The counters are accessed atomically, so they must stay at the start
+	// of the struct to be 64-bit aligned on 32-bit platforms.
+	lines   int64
+	bytes   int64
+	dropped int64
+	lastErr atomic.Value // statsError
+}
+
+// statsError wraps an error, as an atomic.Value needs values of the same
+// concrete type.
+type statsError struct {
+	err error
+}
+
+// wrote counts p, written to the destination, and records err if it's
+// not nil.
+func (s *writerStats) wrote(p []byte, err error) {
+	if len(p) > 0 {
+		atomic.AddInt64(&s.bytes, int64(len(p)))
+		if lines := bytes.Count(p, []byte{'\n'}); lines > 0 {
+			atomic.AddInt64(&s.lines, int64(lines))
+		}
+	}
+	if err != nil {
+		s.lastErr.Store(statsError{err})
+	}
+}
+
+// wroteLines counts n bytes written, holding the given number of newlines.
+func (s *writerStats) wroteLines(n, lines int, err error) {
+	atomic.AddInt64(&s.bytes, int64(n))
+	if lines > 0 {
+		atomic.AddInt64(&s.lines, int64(lines))
+	}
+	if err != nil {
+		s.lastErr.Store(statsError{err})
+	}
+}
+
+// wroteVector counts the first n bytes of bufs, written as one.
+func (s *writerStats) wroteVector(bufs [][]byte, n int, err error) {
+	for _, buf := range bufs {
+		if n < len(buf) {
+			buf = buf[:n]
+		}
+		s.wrote(buf, nil)
+		n -= len(buf)
+	}
+	s.wrote(nil, err)
+}
+
+// write writes p to dest, counting what's written.
+func (s *writerStats) write(dest io.Writer, p []byte) (int, error) {
+	n, err := dest.Write(p)
+	if n > 0 && n <= len(p) {
+		s.wrote(p[:n], err)
+	} else {
+		s.wrote(nil, err)
+	}
+	return n, err
+}
+
+// writeFull writes all of p to dest, as writeFull, counting what's
+// written.
+func (s *writerStats) writeFull(dest io.Writer, p []byte) (int, error) {
+	n, err := writeFull(dest, p)
+	s.wrote(p[:n], err)
+	return n, err
+}
+
+func (s *writerStats) addDropped(n int64) {
+	atomic.AddInt64(&s.dropped, n)
+}
+
+func (s *writerStats) droppedLines() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+func (s *writerStats) snapshot() WriterStats {
+	stats := WriterStats{
+		Lines:   atomic.LoadInt64(&s.lines),
+		Bytes:   atomic.LoadInt64(&s.bytes),
+		Dropped: atomic.LoadInt64(&s.dropped),
+	}
+	if v, ok := s.lastErr.Load().(statsError); ok {
+		stats.LastError = v.err
+	}
+	return stats
+}
+
+// StatsRegistry collects the writers keeping statistics in the log
+// pipelines of services, so that they can all be snapshotted at once.
+type StatsRegistry struct {
+	mu       sync.Mutex
+	services map[string][]registeredStats
+}
+
+type registeredStats struct {
+	stage  string
+	writer StatsReporter
+}
+
+// NewStatsRegistry returns an empty StatsRegistry.
+func NewStatsRegistry() *StatsRegistry {
+	return &StatsRegistry{services: make(map[string][]registeredStats)}
+}
+
+// Add adds w as the given stage of the service's pipeline, replacing the
+// writer added for that stage before, if any.
+func (r *StatsRegistry) Add(serviceName, stage string, w StatsReporter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stages := r.services[serviceName]
+	for i := range stages {
+		if stages[i].stage == stage {
+			stages[i].writer = w
+			return
+		}
+	}
+	r.services[serviceName] = append(stages, registeredStats{stage, w})
+}
+
+// Remove removes the writers of the service's pipeline.
+func (r *StatsRegistry) Remove(serviceName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.services, serviceName)
+}
+
+// Snapshot returns the statistics of every writer added, by service name
+// and then stage.
+func (r *StatsRegistry) Snapshot() map[string]map[string]WriterStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot := make(map[string]map[string]WriterStats, len(r.services))
+	for name, stages := range r.services {
+		service := make(map[string]WriterStats, len(stages))
+		for _, s := range stages {
+			service[s.stage] = s.writer.Stats()
+		}
+		snapshot[name] = service
+	}
+	return snapshot
+}
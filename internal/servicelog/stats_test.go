@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type statsSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&statsSuite{})
+
+func (s *statsSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *statsSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *statsSuite) TestFormatter(c *C) {
+	w := newFormatWriter(ioutil.Discard, "test")
+	_, err := io.WriteString(w, "first\nsecond\nthi")
+	c.Assert(err, IsNil)
+
+	// The prefixes written are counted, and the incomplete line isn't.
+	const prefix = "2021-05-13T03:16:51.001Z [test] "
+	c.Check(w.(servicelog.StatsReporter).Stats(), Equals, servicelog.WriterStats{
+		Lines: 2,
+		Bytes: int64(3*len(prefix) + len("first\nsecond\nthi")),
+	})
+}
+
+func (s *statsSuite) TestConcurrentWriters(c *C) {
+	formatter := newFormatWriter(ioutil.Discard, "test")
+	filter, err := servicelog.NewFilterWriter(formatter, nil, regexp.MustCompile("^drop"))
+	c.Assert(err, IsNil)
+
+	// Stats can be read while the writer is written to, and the counts
+	// add up once it's done.
+	const writers, lines = 8, 500
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				fmt.Fprintf(filter, "keep %d %d\ndrop %d %d\n", i, j, i, j)
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var last servicelog.WriterStats
+		for {
+			stats := filter.Stats()
+			if stats.Lines < last.Lines || stats.Bytes < last.Bytes || stats.Dropped < last.Dropped {
+				c.Errorf("stats went backwards: %+v after %+v", stats, last)
+				return
+			}
+			last = stats
+			if stats.Lines == writers*lines && stats.Dropped == writers*lines {
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	stats := filter.Stats()
+	c.Check(stats.Lines, Equals, int64(writers*lines))
+	c.Check(stats.Dropped, Equals, int64(writers*lines))
+	c.Check(stats.LastError, IsNil)
+	c.Check(filter.Dropped(), Equals, stats.Dropped)
+	c.Check(formatter.(servicelog.StatsReporter).Stats().Lines, Equals, int64(writers*lines))
+}
+
+func (s *statsSuite) TestDestinationError(c *C) {
+	errFull := errors.New("disk full")
+	dest := servicelogtest.NewScriptedWriter()
+	dest.Limit(len("first\nsec"), errFull)
+	w, err := servicelog.NewSeverityWriter(dest, servicelog.SeverityConfig{Min: servicelog.LevelInfo})
+	c.Assert(err, IsNil)
+
+	// Only what dest took is counted, and its error is kept.
+	_, err = io.WriteString(w, "first\nsecond\n")
+	c.Check(err, Equals, errFull)
+	stats := w.Stats()
+	c.Check(stats, DeepEquals, servicelog.WriterStats{
+		Lines:     1,
+		Bytes:     int64(len("first\nsec")),
+		LastError: errFull,
+	})
+
+	// The error is kept after writes succeed again.
+	dest.Limit(-1, nil)
+	_, err = io.WriteString(w, "DEBUG: dropped\nthird\n")
+	c.Assert(err, IsNil)
+	c.Check(w.Stats(), DeepEquals, servicelog.WriterStats{
+		Lines:     2,
+		Bytes:     int64(len("first\nsecthird\n")),
+		Dropped:   1,
+		LastError: errFull,
+	})
+}
+
+func (s *statsSuite) TestAsyncDestinationError(c *C) {
+	errFailed := errors.New("failed")
+	dest := servicelogtest.NewScriptedWriter(servicelogtest.FailAfter(3, errFailed))
+	a := servicelog.NewAsyncWriter(dest, 64, time.Second)
+	_, err := io.WriteString(a, "first\nsecond\n")
+	c.Assert(err, IsNil)
+	waitFor(c, func() bool { return a.Stats().Dropped == 2 })
+	c.Check(a.Stats(), DeepEquals, servicelog.WriterStats{
+		Bytes:     3,
+		Dropped:   2,
+		LastError: errFailed,
+	})
+	c.Check(a.Dropped(), Equals, 2)
+	c.Check(a.Close(), Equals, errFailed)
+}
+
+func (s *statsSuite) TestRateLimit(c *C) {
+	w, err := servicelog.NewRateLimitWriter(ioutil.Discard, "test", 1, 2)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "one\ntwo\nthree\nfour\n")
+	c.Assert(err, IsNil)
+	c.Check(w.Stats(), Equals, servicelog.WriterStats{Lines: 2, Bytes: 8, Dropped: 2})
+	c.Check(w.Suppressed(), Equals, int64(2))
+
+	// The summary is counted as written.
+	c.Assert(w.Close(), IsNil)
+	stats := w.Stats()
+	c.Check(stats.Lines, Equals, int64(3))
+	c.Check(stats.Dropped, Equals, int64(2))
+}
+
+func (s *statsSuite) TestRegistry(c *C) {
+	formatter := newFormatWriter(ioutil.Discard, "web")
+	redact, err := servicelog.NewRedactWriter(formatter, servicelog.RedactRule{Pattern: regexp.MustCompile("secret")})
+	c.Assert(err, IsNil)
+	filter, err := servicelog.NewFilterWriter(ioutil.Discard, regexp.MustCompile("."), nil)
+	c.Assert(err, IsNil)
+
+	r := servicelog.NewStatsRegistry()
+	r.Add("web", "redact", redact.(servicelog.StatsReporter))
+	r.Add("web", "format", formatter.(servicelog.StatsReporter))
+	r.Add("db", "filter", filter)
+	_, err = io.WriteString(redact, "the secret\n")
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(filter, "\nkept\n")
+	c.Assert(err, IsNil)
+	c.Check(r.Snapshot(), DeepEquals, map[string]map[string]servicelog.WriterStats{
+		"web": {
+			"redact": {Lines: 1, Bytes: int64(len("the [REDACTED]\n"))},
+			"format": {Lines: 1, Bytes: int64(len("2021-05-13T03:16:51.001Z [web] the [REDACTED]\n"))},
+		},
+		"db": {
+			"filter": {Lines: 1, Bytes: 5, Dropped: 1},
+		},
+	})
+
+	// A stage added again replaces the writer added before, and removing
+	// a service removes all its stages.
+	other, err := servicelog.NewFilterWriter(ioutil.Discard, regexp.MustCompile("."), nil)
+	c.Assert(err, IsNil)
+	r.Add("db", "filter", other)
+	r.Remove("web")
+	c.Check(r.Snapshot(), DeepEquals, map[string]map[string]servicelog.WriterStats{
+		"db": {"filter": {}},
+	})
+}
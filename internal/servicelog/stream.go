@@ -0,0 +1,195 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"io"
+	"sync"
+)
+
+// The names of a service's output streams.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// StreamMaxHeld is the most output of one stream that NewStreamWriters
+// holds while a line of the other stream is incomplete.
+const StreamMaxHeld = 64 * 1024
+
+// WithStream tags each line with stream, the name of the output stream
+// it's from, after the service name, as in:
+//
+//	2021-05-13T03:16:51.001Z [test/stderr] boom\n
+//
+// If stream is empty, the lines are tagged with the service name alone.
+func WithStream(stream string) FormatOption {
+	return func(f *formatter) error {
+		f.stream = stream
+		return nil
+	}
+}
+
+// NewStreamWriters returns writers for a service's stdout and stderr that
+// format their output with the writers newFormatter returns for each
+// stream, called with StreamStdout and StreamStderr, and write it to dest
+// without interleaving their lines. For example, to tag only the lines
+// from stderr:
+//
+//	stdout, stderr := NewStreamWriters(dest, func(w io.Writer, stream string) io.Writer {
+//		if stream == StreamStdout {
+//			stream = ""
+//		}
+//		f, _ := NewFormatWriter(w, "test", WithStream(stream))
+//		return f
+//	})
+//
+// While a line from one stream is incomplete, the other's output is held,
+// up to StreamMaxHeld bytes, and written once the line ends. If there's
+// more, the incomplete line is ended early, as by closing its writer, so
+// that it's marked as incomplete and its rest starts a new line. An error
+// writing held output to dest is returned by the next call to the held
+// stream's writer.
+//
+// Closing a stream's writer closes its formatter, ending its incomplete
+// line, and writes any of its output still held, ending the other stream's
+// line early if need be. It doesn't close dest.
+func NewStreamWriters(dest io.Writer, newFormatter func(dest io.Writer, stream string) io.Writer) (stdout, stderr io.WriteCloser) {
+	m := &streamMux{dest: dest}
+	for i, stream := range []string{StreamStdout, StreamStderr} {
+		s := &streamWriter{mux: m}
+		s.formatter = newFormatter(streamSink{s}, stream)
+		m.streams[i] = s
+	}
+	return m.streams[0], m.streams[1]
+}
+
+type streamMux struct {
+	mu      sync.Mutex
+	dest    io.Writer
+	streams [2]*streamWriter
+	// owner is the stream with an incomplete line in dest, if any.
+	owner *streamWriter
+}
+
+type streamWriter struct {
+	mux       *streamMux
+	formatter io.Writer
+	// held is the formatted output held while the other stream's line is
+	// incomplete, or that couldn't be written to dest when it ended.
+	held []byte
+	// err is the error writing held output, for the next call.
+	err error
+}
+
+// streamSink is the destination of a stream's formatter, only written to
+// with the mutex held.
+type streamSink struct {
+	s *streamWriter
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.mux.mu.Lock()
+	defer s.mux.mu.Unlock()
+	if err := s.err; err != nil {
+		s.err = nil
+		return 0, err
+	}
+	return s.formatter.Write(p)
+}
+
+func (s *streamWriter) Close() error {
+	m := s.mux
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := closeWriter(s.formatter)
+	if other := m.other(s); len(s.held) > 0 && m.owner == other {
+		// Don't leave the output held behind a line that may never end.
+		if e := closeWriter(other.formatter); err == nil {
+			err = e
+		}
+	}
+	if m.owner == nil || m.owner == s {
+		if e := m.flush(s); err == nil {
+			err = e
+		}
+	}
+	if err == nil {
+		err = s.err
+	}
+	s.err = nil
+	return err
+}
+
+func (k streamSink) Write(p []byte) (int, error) {
+	s, m := k.s, k.s.mux
+	if other := m.other(s); m.owner == other && len(s.held)+len(p) > StreamMaxHeld {
+		// Rather than hold any more, end the other stream's line early.
+		if err := closeWriter(other.formatter); err != nil {
+			return 0, err
+		}
+	}
+	if m.owner == nil || m.owner == s {
+		if err := m.flush(s); err != nil {
+			return 0, err
+		}
+	}
+	if m.owner != nil && m.owner != s || len(s.held) > 0 {
+		s.held = append(s.held, p...)
+		return len(p), nil
+	}
+	return m.write(s, p)
+}
+
+func (m *streamMux) other(s *streamWriter) *streamWriter {
+	if s == m.streams[0] {
+		return m.streams[1]
+	}
+	return m.streams[0]
+}
+
+// write writes stream s's output p to dest, and the other stream's held
+// output if that leaves no line incomplete.
+func (m *streamMux) write(s *streamWriter, p []byte) (int, error) {
+	n, err := writeFull(m.dest, p)
+	if n > 0 {
+		if p[n-1] == '\n' {
+			m.owner = nil
+		} else {
+			m.owner = s
+		}
+	}
+	if m.owner == nil {
+		other := m.other(s)
+		if err := m.flush(other); err != nil && other.err == nil {
+			other.err = err
+		}
+	}
+	return n, err
+}
+
+// flush writes the output held for stream s to dest.
+func (m *streamMux) flush(s *streamWriter) error {
+	if len(s.held) == 0 {
+		return nil
+	}
+	// The output is taken from s while it's written, so that the other
+	// stream's output written after it doesn't write it again.
+	held := s.held
+	s.held = nil
+	n, err := m.write(s, held)
+	s.held = held[:copy(held, held[n:])]
+	return err
+}
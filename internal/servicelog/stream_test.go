@@ -0,0 +1,241 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type streamSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&streamSuite{})
+
+func (s *streamSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *streamSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// textStreams formats the lines of each stream with its name, or only
+// those of stderr unless labelStdout is set.
+func textStreams(labelStdout bool) func(w io.Writer, stream string) io.Writer {
+	return func(w io.Writer, stream string) io.Writer {
+		if stream == servicelog.StreamStdout && !labelStdout {
+			stream = ""
+		}
+		return newFormatWriter(w, "test", servicelog.WithStream(stream))
+	}
+}
+
+func (s *streamSuite) TestFormatWithStream(c *C) {
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test", servicelog.WithStream(servicelog.StreamStderr))
+	_, err := io.WriteString(w, "boom\n")
+	c.Assert(err, IsNil)
+	w = newFormatWriter(b, "test", servicelog.WithStream(""))
+	_, err = io.WriteString(w, "fine\n")
+	c.Assert(err, IsNil)
+	c.Assert(b.String(), Equals, `
+2021-05-13T03:16:51.001Z [test/stderr] boom
+2021-05-13T03:16:51.001Z [test] fine
+`[1:])
+}
+
+func (s *streamSuite) TestJSONWithStream(c *C) {
+	b := &bytes.Buffer{}
+	w := servicelog.NewJSONFormatWriterWithStream(b, "test", servicelog.StreamStderr)
+	_, err := io.WriteString(w, "boom\n")
+	c.Assert(err, IsNil)
+	w = servicelog.NewJSONFormatWriterWithStream(b, "test", "")
+	_, err = io.WriteString(w, "fine\n")
+	c.Assert(err, IsNil)
+	c.Assert(b.String(), Equals, `
+{"time":"2021-05-13T03:16:51.001Z","service":"test","stream":"stderr","message":"boom"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","message":"fine"}
+`[1:])
+}
+
+func (s *streamSuite) TestStreamWriters(c *C) {
+	s.testStreamWriters(c, false, "[test]")
+}
+
+func (s *streamSuite) TestStreamWritersLabelStdout(c *C) {
+	s.testStreamWriters(c, true, "[test/stdout]")
+}
+
+func (s *streamSuite) testStreamWriters(c *C, labelStdout bool, tag string) {
+	b := &bytes.Buffer{}
+	stdout, stderr := servicelog.NewStreamWriters(b, textStreams(labelStdout))
+
+	// The lines from stderr are held until the one from stdout ends.
+	fmt.Fprint(stdout, "out ")
+	s.clock.Advance(time.Second)
+	fmt.Fprint(stderr, "err\nerr ")
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z "+tag+" out ")
+	fmt.Fprint(stdout, "line\n")
+	fmt.Fprint(stdout, "next\n")
+	fmt.Fprint(stderr, "line\n")
+	c.Assert(stdout.Close(), IsNil)
+	c.Assert(stderr.Close(), IsNil)
+
+	c.Check(b.String(), Equals, ""+
+		"2021-05-13T03:16:51.001Z "+tag+" out line\n"+
+		"2021-05-13T03:16:52.001Z [test/stderr] err\n"+
+		"2021-05-13T03:16:52.001Z [test/stderr] err line\n"+
+		"2021-05-13T03:16:52.001Z "+tag+" next\n")
+}
+
+func (s *streamSuite) TestStreamWritersJSON(c *C) {
+	b := &bytes.Buffer{}
+	stdout, stderr := servicelog.NewStreamWriters(b, func(w io.Writer, stream string) io.Writer {
+		return servicelog.NewJSONFormatWriterWithStream(w, "test", stream)
+	})
+	fmt.Fprint(stdout, "out ")
+	fmt.Fprint(stderr, "err\n")
+	fmt.Fprint(stdout, "line\n")
+	c.Check(b.String(), Equals, `
+{"time":"2021-05-13T03:16:51.001Z","service":"test","stream":"stdout","message":"out line"}
+{"time":"2021-05-13T03:16:51.001Z","service":"test","stream":"stderr","message":"err"}
+`[1:])
+}
+
+func (s *streamSuite) TestStreamWritersMaxHeld(c *C) {
+	b := &bytes.Buffer{}
+	stdout, stderr := servicelog.NewStreamWriters(b, textStreams(false))
+
+	fmt.Fprint(stdout, "out ")
+	long := strings.Repeat("x", servicelog.StreamMaxHeld) + "\n"
+	n, err := io.WriteString(stderr, long)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, len(long))
+	// The line from stdout was ended early, and its rest starts a new one.
+	fmt.Fprint(stdout, "line\n")
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] out "+servicelog.IncompleteLineMarker+"\n"+
+		"2021-05-13T03:16:51.001Z [test/stderr] "+long+
+		"2021-05-13T03:16:51.001Z [test] line\n")
+}
+
+func (s *streamSuite) TestStreamWritersClose(c *C) {
+	b := &bytes.Buffer{}
+	stdout, stderr := servicelog.NewStreamWriters(b, textStreams(false))
+
+	fmt.Fprint(stdout, "out")
+	fmt.Fprint(stderr, "err")
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] out")
+	// Closing stderr ends its line, and stdout's so that it's written.
+	c.Assert(stderr.Close(), IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] out"+servicelog.IncompleteLineMarker+"\n"+
+		"2021-05-13T03:16:51.001Z [test/stderr] err"+servicelog.IncompleteLineMarker+"\n")
+	c.Assert(stdout.Close(), IsNil)
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] out"+servicelog.IncompleteLineMarker+"\n"+
+		"2021-05-13T03:16:51.001Z [test/stderr] err"+servicelog.IncompleteLineMarker+"\n")
+}
+
+func (s *streamSuite) TestStreamWritersHeldError(c *C) {
+	errTest := errors.New("test")
+	dest := servicelogtest.NewScriptedWriter(
+		servicelogtest.Accept(),
+		servicelogtest.Accept(),
+		servicelogtest.Fail(errTest),
+	)
+	stdout, stderr := servicelog.NewStreamWriters(dest, textStreams(false))
+
+	fmt.Fprint(stdout, "out ")
+	_, err := fmt.Fprint(stderr, "err\n")
+	c.Assert(err, IsNil)
+	// Writing the held line fails, which stdout's write isn't told of.
+	_, err = fmt.Fprint(stdout, "line\n")
+	c.Assert(err, IsNil)
+	_, err = fmt.Fprint(stderr, "next\n")
+	c.Assert(err, Equals, errTest)
+	_, err = fmt.Fprint(stderr, "next\n")
+	c.Assert(err, IsNil)
+	c.Check(dest.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] out line
+2021-05-13T03:16:51.001Z [test/stderr] err
+2021-05-13T03:16:51.001Z [test/stderr] next
+`[1:])
+}
+
+var streamLineRegexp = regexp.MustCompile(`^2021-05-13T03:16:51.001Z \[test/(stdout|stderr)\] (stdout|stderr) (\d+) (x*)$`)
+
+func (s *streamSuite) TestStreamWritersConcurrent(c *C) {
+	b := &bytes.Buffer{}
+	stdout, stderr := servicelog.NewStreamWriters(b, textStreams(true))
+
+	const lines = 500
+	var wg sync.WaitGroup
+	for _, stream := range []struct {
+		name string
+		w    io.WriteCloser
+	}{
+		{servicelog.StreamStdout, stdout},
+		{servicelog.StreamStderr, stderr},
+	} {
+		wg.Add(1)
+		go func(name string, w io.WriteCloser) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				// Write each line in pieces, to be interleaved with the
+				// other stream's.
+				line := fmt.Sprintf("%s %d %s\n", name, i, strings.Repeat("x", i%50))
+				for len(line) > 0 {
+					n := 1 + i%7
+					if n > len(line) {
+						n = len(line)
+					}
+					_, err := io.WriteString(w, line[:n])
+					c.Check(err, IsNil)
+					line = line[n:]
+				}
+			}
+		}(stream.name, stream.w)
+	}
+	wg.Wait()
+	c.Assert(stdout.Close(), IsNil)
+	c.Assert(stderr.Close(), IsNil)
+
+	next := map[string]int{}
+	for _, line := range strings.SplitAfter(b.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		m := streamLineRegexp.FindStringSubmatch(strings.TrimSuffix(line, "\n"))
+		c.Assert(m, NotNil, Commentf("line %q", line))
+		c.Assert(m[1], Equals, m[2])
+		c.Assert(m[3], Equals, fmt.Sprint(next[m[1]]))
+		c.Assert(len(m[4]), Equals, next[m[1]]%50)
+		next[m[1]]++
+	}
+	c.Check(next, DeepEquals, map[string]int{servicelog.StreamStdout: lines, servicelog.StreamStderr: lines})
+}
@@ -0,0 +1,394 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority is a syslog facility, as given to NewSyslogWriter.
+type Priority int
+
+// Syslog facilities, as defined by RFC 5424.
+const (
+	FacilityKern Priority = iota << 3
+	FacilityUser
+	FacilityMail
+	FacilityDaemon
+	FacilityAuth
+	FacilitySyslog
+	FacilityLPR
+	FacilityNews
+	FacilityUUCP
+	FacilityCron
+	FacilityAuthPriv
+	FacilityFTP
+	_
+	_
+	_
+	_
+	FacilityLocal0
+	FacilityLocal1
+	FacilityLocal2
+	FacilityLocal3
+	FacilityLocal4
+	FacilityLocal5
+	FacilityLocal6
+	FacilityLocal7
+)
+
+// severityInfo is the severity of the lines a SyslogWriter sends.
+const severityInfo = 6
+
+// SyslogMaxMessage is the length, in bytes, of the longest line a
+// SyslogWriter sends as a single message. Longer lines are split.
+const SyslogMaxMessage = 8 * 1024
+
+// SyslogQueueLines is the number of lines a SyslogWriter holds while it
+// can't send them to the receiver, after which the oldest are dropped.
+const SyslogQueueLines = 512
+
+// syslogTimeLayout is RFC3339 with microsecond precision, the most
+// RFC 5424 allows.
+const syslogTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+var (
+	// syslogMinBackoff and syslogMaxBackoff bound the time between
+	// attempts to reconnect to the receiver, which doubles after each
+	// failure.
+	syslogMinBackoff = 100 * time.Millisecond
+	syslogMaxBackoff = 30 * time.Second
+	// syslogTimeout limits each connection attempt and each write.
+	syslogTimeout = 5 * time.Second
+	// syslogCloseTimeout is how long Close waits for the lines held to be
+	// sent.
+	syslogCloseTimeout = 5 * time.Second
+)
+
+var errSyslogClosed = errors.New("syslog writer is closed")
+
+// SyslogWriter forwards a service's output to a syslog receiver, each line
+// as an RFC 5424 message with the service name as its APP-NAME. Over TCP,
+// messages are framed with their length, as in RFC 6587.
+//
+// Writes never wait for the network: complete lines are queued and sent
+// in the background, reconnecting with backoff if the connection fails,
+// and up to SyslogQueueLines lines are held while the receiver is
+// unavailable.
+type SyslogWriter struct {
+	network string
+	addr    string
+	stream  bool
+	// header is the part of each message between its time and the line,
+	// rendered once.
+	priority []byte
+	header   []byte
+
+	mu sync.Mutex
+	// line is the start of the current line, which started at lineTime,
+	// and midLine is set until the line ends, even if it's empty.
+	line     []byte
+	lineTime time.Time
+	midLine  bool
+	// queue holds the messages still to be sent, and inFlight is set while
+	// the sender has taken one from it but not sent it yet.
+	queue    [][]byte
+	inFlight bool
+	dropped  int
+	err      error
+	closed   bool
+
+	wake    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	frame   []byte
+}
+
+// NewSyslogWriter returns a SyslogWriter that sends the lines written to
+// it for the given service to the receiver at addr, over network, which is
+// "udp" or "tcp" (or their "4" and "6" variants), with the given facility.
+// The lines are sent with severity informational. The receiver doesn't
+// have to be available yet.
+func NewSyslogWriter(network, addr, serviceName string, facility Priority) (*SyslogWriter, error) {
+	switch network {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid syslog address: %v", err)
+	}
+	if facility < FacilityKern || facility > FacilityLocal7 || facility&7 != 0 {
+		return nil, fmt.Errorf("invalid syslog facility %d", facility)
+	}
+	hostname, _ := os.Hostname()
+	header := []byte(" " + syslogField(hostname, 255) + " " + syslogField(serviceName, 48) + " - - - ")
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &SyslogWriter{
+		network:  network,
+		addr:     addr,
+		stream:   strings.HasPrefix(network, "tcp"),
+		priority: []byte("<" + strconv.Itoa(int(facility)|severityInfo) + ">1 "),
+		header:   header,
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		stopped:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// syslogField returns value as a header field of at most max bytes,
+// with anything but printable ASCII replaced by underscores, or "-" if
+// it's empty.
+func syslogField(value string, max int) string {
+	if value == "" {
+		return "-"
+	}
+	if len(value) > max {
+		value = value[:max]
+	}
+	field := []byte(value)
+	for i, b := range field {
+		if b < '!' || b > '~' {
+			field[i] = '_'
+		}
+	}
+	return string(field)
+}
+
+// Write queues the lines completed by p to be sent, and holds on to the
+// incomplete line at its end. Lines longer than SyslogMaxMessage are sent
+// in several messages.
+func (s *SyslogWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, errSyslogClosed
+	}
+	written := len(p)
+	for len(p) > 0 {
+		if !s.midLine {
+			s.midLine = true
+			s.lineTime = clock.Now()
+		}
+		chunk := p
+		i := bytes.IndexByte(chunk, '\n')
+		if i >= 0 {
+			chunk = chunk[:i]
+		}
+		if room := SyslogMaxMessage - len(s.line); len(chunk) > room {
+			s.line = append(s.line, chunk[:room]...)
+			s.enqueue()
+			p = p[room:]
+			continue
+		}
+		s.line = append(s.line, chunk...)
+		if i < 0 {
+			break
+		}
+		s.enqueue()
+		s.midLine = false
+		p = p[i+1:]
+	}
+	return written, nil
+}
+
+// enqueue queues the current line as a message, dropping the oldest
+// message if the queue is full, and wakes the sender.
+func (s *SyslogWriter) enqueue() {
+	msg := make([]byte, 0, len(s.priority)+len(syslogTimeLayout)+len(s.header)+len(s.line))
+	msg = append(msg, s.priority...)
+	msg = s.lineTime.UTC().AppendFormat(msg, syslogTimeLayout)
+	msg = append(msg, s.header...)
+	msg = append(msg, s.line...)
+	s.line = s.line[:0]
+	if len(s.queue) >= SyslogQueueLines {
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	s.queue = append(s.queue, msg)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Dropped returns the number of lines dropped so far because the queue
+// was full.
+func (s *SyslogWriter) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// run sends the queued messages until the writer is closed and the queue
+// is empty, or Close gives up waiting for it.
+func (s *SyslogWriter) run() {
+	defer close(s.stopped)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	dialer := net.Dialer{Timeout: syslogTimeout}
+	backoff := syslogMinBackoff
+	for {
+		msg, ok := s.next()
+		if !ok {
+			return
+		}
+		for {
+			var err error
+			if conn == nil {
+				conn, err = dialer.DialContext(s.ctx, s.network, s.addr)
+			}
+			if err == nil {
+				err = s.send(conn, msg)
+				if err == nil {
+					s.sent()
+					backoff = syslogMinBackoff
+					break
+				}
+				conn.Close()
+			}
+			conn = nil
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+
+			timer := clock.NewTimer(backoff)
+			select {
+			case <-timer.C():
+			case <-s.ctx.Done():
+				timer.Stop()
+				return
+			}
+			backoff *= 2
+			if backoff > syslogMaxBackoff {
+				backoff = syslogMaxBackoff
+			}
+		}
+	}
+}
+
+// next takes the next message from the queue, waiting for one if it's
+// empty. It returns false once the writer is closed and the queue is
+// empty, or Close has given up.
+func (s *SyslogWriter) next() ([]byte, bool) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			msg := s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.inFlight = true
+			s.mu.Unlock()
+			return msg, true
+		}
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-s.wake:
+		case <-s.ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+func (s *SyslogWriter) sent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight = false
+	s.err = nil
+}
+
+// send writes msg to conn, framed with its length on a stream.
+func (s *SyslogWriter) send(conn net.Conn, msg []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(syslogTimeout)); err != nil {
+		return err
+	}
+	if !s.stream {
+		_, err := conn.Write(msg)
+		return err
+	}
+	s.frame = strconv.AppendInt(s.frame[:0], int64(len(msg)), 10)
+	s.frame = append(s.frame, ' ')
+	s.frame = append(s.frame, msg...)
+	_, err := writeFull(conn, s.frame)
+	return err
+}
+
+// Close sends the incomplete line, if any, and waits up to a few seconds
+// for the lines held to be sent before closing the connection. It returns
+// an error if some couldn't be sent.
+func (s *SyslogWriter) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.midLine {
+		s.enqueue()
+		s.midLine = false
+	}
+	s.closed = true
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	timer := clock.NewTimer(syslogCloseTimeout)
+	select {
+	case <-s.stopped:
+	case <-timer.C():
+	}
+	timer.Stop()
+	s.cancel()
+	<-s.stopped
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unsent := len(s.queue)
+	if s.inFlight {
+		unsent++
+	}
+	if unsent > 0 && s.err != nil {
+		return fmt.Errorf("cannot send %d log lines to syslog at %s: %v", unsent, s.addr, s.err)
+	} else if unsent > 0 {
+		return fmt.Errorf("cannot send %d log lines to syslog at %s in time", unsent, s.addr)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type syslogSuite struct {
+	restore func()
+}
+
+var _ = Suite(&syslogSuite{})
+
+func (s *syslogSuite) SetUpTest(c *C) {
+	s.restore = servicelog.FakeSyslogTimeouts(10*time.Millisecond, time.Second)
+}
+
+func (s *syslogSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+var syslogMessage = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) (\S+) - - - (.*)$`)
+
+// checkSyslogMessage checks the header of msg and returns its line.
+func checkSyslogMessage(c *C, msg string, priority int, appName string) string {
+	match := syslogMessage.FindStringSubmatch(msg)
+	c.Assert(match, NotNil, Commentf("message %q", msg))
+	c.Check(match[1], Equals, strconv.Itoa(priority))
+	t, err := time.Parse(time.RFC3339Nano, match[2])
+	c.Check(err, IsNil)
+	c.Check(time.Since(t) < time.Minute, Equals, true, Commentf("time %s", match[2]))
+	hostname, _ := os.Hostname()
+	if hostname != "" {
+		c.Check(match[3], Equals, hostname)
+	}
+	c.Check(match[4], Equals, appName)
+	return match[5]
+}
+
+// syslogReceiver accepts TCP connections and sends the messages received
+// on each, framed with their length, to messages, with the connections
+// to conns.
+func syslogReceiver(c *C) (l net.Listener, conns chan net.Conn, messages chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	conns = make(chan net.Conn, 10)
+	messages = make(chan string, 1000)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go readFramed(conn, messages)
+		}
+	}()
+	return l, conns, messages
+}
+
+func readFramed(conn net.Conn, messages chan<- string) {
+	r := bufio.NewReader(conn)
+	for {
+		size, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(size, " "))
+		if err != nil {
+			messages <- fmt.Sprintf("invalid frame length %q", size)
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return
+		}
+		messages <- string(msg)
+	}
+}
+
+func receive(c *C, messages <-chan string) string {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		c.Fatalf("no message received")
+		return ""
+	}
+}
+
+func (s *syslogSuite) TestTCP(c *C) {
+	l, _, messages := syslogReceiver(c)
+	defer l.Close()
+
+	w, err := servicelog.NewSyslogWriter("tcp", l.Addr().String(), "test", servicelog.FacilityDaemon)
+	c.Assert(err, IsNil)
+	for _, p := range []string{"first\nsec", "on", "d\n", "\n", "with spaces and \"quotes\"\nlast"} {
+		n, err := io.WriteString(w, p)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(p))
+	}
+	c.Assert(w.Close(), IsNil)
+
+	// Lines written in several pieces arrive as one message, and the
+	// incomplete line is sent by Close.
+	for _, line := range []string{"first", "second", "", `with spaces and "quotes"`, "last"} {
+		msg := receive(c, messages)
+		c.Check(checkSyslogMessage(c, msg, 3<<3|6, "test"), Equals, line)
+	}
+
+	_, err = io.WriteString(w, "closed\n")
+	c.Check(err, ErrorMatches, "syslog writer is closed")
+	c.Check(w.Close(), IsNil)
+}
+
+func (s *syslogSuite) TestUDP(c *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	w, err := servicelog.NewSyslogWriter("udp", conn.LocalAddr().String(), "my service", servicelog.FacilityLocal3)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, "first\nsecond\n")
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	buf := make([]byte, 64*1024)
+	for _, line := range []string{"first", "second"} {
+		c.Assert(conn.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+		n, _, err := conn.ReadFrom(buf)
+		c.Assert(err, IsNil)
+		c.Check(checkSyslogMessage(c, string(buf[:n]), 19<<3|6, "my_service"), Equals, line)
+	}
+}
+
+func (s *syslogSuite) TestLongLine(c *C) {
+	l, _, messages := syslogReceiver(c)
+	defer l.Close()
+
+	w, err := servicelog.NewSyslogWriter("tcp", l.Addr().String(), "test", servicelog.FacilityUser)
+	c.Assert(err, IsNil)
+	line := strings.Repeat("x", 2*servicelog.SyslogMaxMessage+10)
+	for i := 0; i < len(line); i += 1000 {
+		end := i + 1000
+		if end > len(line) {
+			end = len(line)
+		}
+		_, err := io.WriteString(w, line[i:end])
+		c.Assert(err, IsNil)
+	}
+	_, err = io.WriteString(w, "\n")
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	for _, size := range []int{servicelog.SyslogMaxMessage, servicelog.SyslogMaxMessage, 10} {
+		msg := receive(c, messages)
+		c.Check(checkSyslogMessage(c, msg, 1<<3|6, "test"), Equals, strings.Repeat("x", size))
+	}
+	select {
+	case msg := <-messages:
+		c.Errorf("unexpected message %q", msg)
+	default:
+	}
+}
+
+func (s *syslogSuite) TestReconnect(c *C) {
+	l, conns, messages := syslogReceiver(c)
+	defer l.Close()
+
+	w, err := servicelog.NewSyslogWriter("tcp", l.Addr().String(), "test", servicelog.FacilityUser)
+	c.Assert(err, IsNil)
+	defer w.Close()
+	_, err = io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+	c.Check(checkSyslogMessage(c, receive(c, messages), 1<<3|6, "test"), Equals, "first")
+
+	// When the receiver drops the connection, lines are sent on a new one,
+	// in order. Those sent before the sender noticed may be lost.
+	(<-conns).Close()
+	var last string
+	for i := 0; ; i++ {
+		_, err = fmt.Fprintf(w, "line %d\n", i)
+		c.Assert(err, IsNil)
+		select {
+		case conn := <-conns:
+			defer conn.Close()
+			c.Assert(w.Close(), IsNil)
+			last = fmt.Sprintf("line %d", i)
+		case <-time.After(10 * time.Millisecond):
+			c.Assert(i < 500, Equals, true, Commentf("no reconnection"))
+			continue
+		}
+		break
+	}
+	previous := -1
+	for {
+		line := checkSyslogMessage(c, receive(c, messages), 1<<3|6, "test")
+		var n int
+		_, err := fmt.Sscanf(line, "line %d", &n)
+		c.Assert(err, IsNil)
+		c.Assert(n > previous, Equals, true, Commentf("%q after line %d", line, previous))
+		previous = n
+		if line == last {
+			break
+		}
+	}
+}
+
+func (s *syslogSuite) TestUnavailable(c *C) {
+	// A receiver that isn't there: lines are held, up to a limit, and
+	// Close gives up on them.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := l.Addr().String()
+	l.Close()
+	restore := servicelog.FakeSyslogTimeouts(time.Hour, 50*time.Millisecond)
+	defer restore()
+
+	w, err := servicelog.NewSyslogWriter("tcp", addr, "test", servicelog.FacilityUser)
+	c.Assert(err, IsNil)
+	lines := servicelog.SyslogQueueLines + 10
+	start := time.Now()
+	for i := 0; i < lines; i++ {
+		_, err := fmt.Fprintf(w, "line %d\n", i)
+		c.Assert(err, IsNil)
+	}
+	c.Check(time.Since(start) < time.Second, Equals, true)
+	err = w.Close()
+	c.Assert(err, ErrorMatches, `cannot send \d+ log lines to syslog at `+regexp.QuoteMeta(addr)+`: .*`)
+	unsent, err := strconv.Atoi(strings.Fields(err.Error())[2])
+	c.Assert(err, IsNil)
+	c.Check(w.Dropped()+unsent, Equals, lines)
+	c.Check(unsent >= servicelog.SyslogQueueLines, Equals, true)
+}
+
+func (s *syslogSuite) TestInvalid(c *C) {
+	for _, test := range []struct {
+		network, addr string
+		facility      servicelog.Priority
+		error         string
+	}{
+		{"unix", "/dev/log", servicelog.FacilityUser, `unsupported syslog network "unix"`},
+		{"tcp", "localhost", servicelog.FacilityUser, `invalid syslog address: .*missing port.*`},
+		{"udp", "localhost:514", 7, `invalid syslog facility 7`},
+		{"udp", "localhost:514", servicelog.FacilityLocal7 + 8, `invalid syslog facility 192`},
+		{"udp", "localhost:514", -8, `invalid syslog facility -8`},
+	} {
+		w, err := servicelog.NewSyslogWriter(test.network, test.addr, "test", test.facility)
+		c.Check(err, ErrorMatches, test.error)
+		c.Check(w, IsNil)
+	}
+}
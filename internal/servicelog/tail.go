@@ -0,0 +1,245 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// tailPollInterval is how often tailed files are checked for new data,
+	// rotation and truncation.
+	tailPollInterval = 250 * time.Millisecond
+	// tailGlobInterval is how often the patterns are expanded again to
+	// find new files.
+	tailGlobInterval = 5 * time.Second
+)
+
+// tailReadSize is the size of the reads from tailed files. A line longer
+// than this is written in pieces.
+const tailReadSize = 32 * 1024
+
+// Tailer follows the files matching a set of glob patterns, like tail -F,
+// and writes the lines appended to them to a writer, usually a formatter
+// for a service's log buffer.
+//
+// Only complete lines are written, so that lines from different files
+// aren't mixed up. Files are polled: a file replaced by a new one with the
+// same name (rotated by rename, or removed and created again) is read to
+// its end and the new one is then read from the start, and a file that
+// shrinks (truncated in place) is read again from the start.
+type Tailer struct {
+	patterns []string
+	dest     io.Writer
+
+	mu       sync.Mutex
+	files    map[string]*tailedFile
+	lastGlob time.Time
+	buf      []byte
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// tailedFile is an open file being followed, read up to offset.
+type tailedFile struct {
+	file   *os.File
+	info   os.FileInfo
+	offset int64
+}
+
+// NewTailer returns a Tailer that writes the lines appended to the files
+// matching patterns (as understood by filepath.Glob) to dest.
+func NewTailer(patterns []string, dest io.Writer) *Tailer {
+	return &Tailer{
+		patterns: patterns,
+		dest:     dest,
+		files:    make(map[string]*tailedFile),
+		buf:      make([]byte, tailReadSize),
+	}
+}
+
+// Start starts following the files. Files that match the patterns now are
+// followed from their current end, and files that appear later from their
+// start.
+func (t *Tailer) Start() {
+	t.mu.Lock()
+	t.glob(true)
+	t.mu.Unlock()
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go t.loop()
+}
+
+// Stop stops following the files, after writing what has been appended to
+// them since they were last polled, including any last incomplete lines.
+func (t *Tailer) Stop() {
+	close(t.stop)
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.poll()
+	for _, path := range t.paths() {
+		t.finish(t.files[path])
+		delete(t.files, path)
+	}
+}
+
+func (t *Tailer) loop() {
+	defer close(t.done)
+	ticker := clock.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			t.mu.Lock()
+			t.poll()
+			t.mu.Unlock()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// glob opens the files matching the patterns that aren't followed yet,
+// from their end if atEnd is set, and otherwise reads them from the start.
+func (t *Tailer) glob(atEnd bool) {
+	t.lastGlob = clock.Now()
+	for _, pattern := range t.patterns {
+		// The only error is for a malformed pattern, which the plan
+		// doesn't allow.
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			if t.files[path] != nil {
+				continue
+			}
+			f := openTailed(path, atEnd)
+			if f == nil {
+				continue
+			}
+			t.files[path] = f
+			t.read(f)
+		}
+	}
+}
+
+// openTailed opens the regular file at path, or returns nil if it can't.
+func openTailed(path string, atEnd bool) *tailedFile {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil
+	}
+	f := &tailedFile{file: file, info: info}
+	if atEnd {
+		f.offset = info.Size()
+	}
+	return f
+}
+
+// poll reads what has been appended to the followed files, handling
+// rotation and truncation, and looks for new files every tailGlobInterval.
+func (t *Tailer) poll() {
+	for _, path := range t.paths() {
+		f := t.files[path]
+		info, err := os.Stat(path)
+		if err != nil || !os.SameFile(info, f.info) {
+			// Rotated or removed: finish reading the old file, and follow
+			// its replacement (if any) from the start.
+			t.finish(f)
+			delete(t.files, path)
+			if err == nil {
+				if f := openTailed(path, false); f != nil {
+					t.files[path] = f
+					t.read(f)
+				}
+			}
+			continue
+		}
+		if info.Size() < f.offset {
+			// Truncated in place.
+			f.offset = 0
+		}
+		t.read(f)
+	}
+	// A negative interval means the wall clock was stepped back (the
+	// clock's times have no monotonic reading), so don't wait for it to
+	// catch up. A step forward only makes the next glob early.
+	if elapsed := clock.Now().Sub(t.lastGlob); elapsed >= tailGlobInterval || elapsed < 0 {
+		t.glob(false)
+	}
+}
+
+// paths returns the paths of the followed files, sorted so that they're
+// read in a consistent order.
+func (t *Tailer) paths() []string {
+	paths := make([]string, 0, len(t.files))
+	for path := range t.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// read writes the complete lines appended to f since it was last read.
+func (t *Tailer) read(f *tailedFile) {
+	for {
+		n, _ := f.file.ReadAt(t.buf, f.offset)
+		if n == 0 {
+			return
+		}
+		end := bytes.LastIndexByte(t.buf[:n], '\n') + 1
+		if end == 0 {
+			if n < len(t.buf) {
+				// An incomplete line: wait for the rest.
+				return
+			}
+			end = n
+		}
+		t.write(t.buf[:end])
+		f.offset += int64(end)
+		if n < len(t.buf) {
+			return
+		}
+	}
+}
+
+// finish writes the rest of f, ending any last incomplete line, and closes
+// it.
+func (t *Tailer) finish(f *tailedFile) {
+	t.read(f)
+	n, _ := f.file.ReadAt(t.buf, f.offset)
+	if n > 0 {
+		// Less than a buffer's worth, as read leaves at most that.
+		t.write(append(t.buf[:n], '\n'))
+	}
+	f.file.Close()
+}
+
+func (t *Tailer) write(p []byte) {
+	// As with the service's own output, lines that can't be written to
+	// its logs are lost.
+	_, _ = t.dest.Write(p)
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type tailSuite struct {
+	dir     string
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&tailSuite{})
+
+func (s *tailSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *tailSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// syncBuffer is a bytes.Buffer that's safe to use from the tailer's
+// goroutine, returning what has been written since it was last read.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Next() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data := b.buf.String()
+	b.buf.Reset()
+	return data
+}
+
+func (s *tailSuite) appendFile(c *C, name, data string) {
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	c.Assert(err, IsNil)
+	_, err = f.WriteString(data)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+}
+
+func (s *tailSuite) TestTail(c *C) {
+	s.appendFile(c, "app.log", "before start\n")
+	s.appendFile(c, "app.txt", "not matched\n")
+	output := &syncBuffer{}
+	tailer := servicelog.NewTailer([]string{filepath.Join(s.dir, "*.log")}, output)
+	tailer.Start()
+
+	// Files that exist already are followed from their end, and only
+	// complete lines are written.
+	s.appendFile(c, "app.log", "one\ntwo\npart")
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "one\ntwo\n")
+	s.appendFile(c, "app.log", "ial\n")
+	s.appendFile(c, "app.txt", "still not matched\n")
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "partial\n")
+
+	// Rotated by rename: the rest of the old file is read, ending its last
+	// line, then the new file from its start.
+	s.appendFile(c, "app.log", "last\nunfinished")
+	err := os.Rename(filepath.Join(s.dir, "app.log"), filepath.Join(s.dir, "app.log.1"))
+	c.Assert(err, IsNil)
+	s.appendFile(c, "app.log", "new file\n")
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "last\nunfinished\nnew file\n")
+
+	// Truncated in place: read again from the start.
+	err = os.Truncate(filepath.Join(s.dir, "app.log"), 0)
+	c.Assert(err, IsNil)
+	s.appendFile(c, "app.log", "trunc\n")
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "trunc\n")
+
+	// New files are found when the patterns are expanded again, and read
+	// from their start.
+	s.appendFile(c, "other.log", "other\n")
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "")
+	s.clock.Advance(servicelog.TailGlobInterval)
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "other\n")
+
+	// Stopping writes what's left, including incomplete lines.
+	s.appendFile(c, "app.log", "no newline")
+	s.appendFile(c, "other.log", "bye\n")
+	tailer.Stop()
+	c.Check(output.Next(), Equals, "bye\nno newline\n")
+
+	s.appendFile(c, "app.log", "after stop\n")
+	c.Check(output.Next(), Equals, "")
+}
+
+func (s *tailSuite) TestClockSteps(c *C) {
+	output := &syncBuffer{}
+	tailer := servicelog.NewTailer([]string{filepath.Join(s.dir, "*.log")}, output)
+	tailer.Start()
+	defer tailer.Stop()
+
+	// A step forward makes the patterns be expanded once, not once for
+	// every interval skipped.
+	s.appendFile(c, "one.log", "one\n")
+	s.clock.Step(6 * time.Hour)
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "one\n")
+	s.appendFile(c, "two.log", "two\n")
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "")
+
+	// A step back doesn't hold off expanding them until the wall clock
+	// catches up.
+	s.clock.Step(-30 * time.Second)
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "two\n")
+	s.appendFile(c, "three.log", "three\n")
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "")
+	s.clock.Advance(servicelog.TailGlobInterval)
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "three\n")
+}
+
+func (s *tailSuite) TestRemoved(c *C) {
+	output := &syncBuffer{}
+	tailer := servicelog.NewTailer([]string{filepath.Join(s.dir, "*.log")}, output)
+	tailer.Start()
+	defer tailer.Stop()
+
+	s.appendFile(c, "app.log", "created\n")
+	s.clock.Advance(servicelog.TailGlobInterval)
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "created\n")
+
+	// A removed file is finished, and picked up from the start if it's
+	// created again.
+	s.appendFile(c, "app.log", "removed")
+	c.Assert(os.Remove(filepath.Join(s.dir, "app.log")), IsNil)
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "removed\n")
+	s.appendFile(c, "app.log", "again\n")
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "")
+	s.clock.Advance(servicelog.TailGlobInterval)
+	tailer.Poll()
+	c.Check(output.Next(), Equals, "again\n")
+}
+
+func (s *tailSuite) TestLongLines(c *C) {
+	output := &syncBuffer{}
+	tailer := servicelog.NewTailer([]string{filepath.Join(s.dir, "app.log")}, output)
+	s.appendFile(c, "app.log", "")
+	tailer.Start()
+	defer tailer.Stop()
+
+	long := strings.Repeat("x", 100*1024)
+	s.appendFile(c, "app.log", long+"\nshort\n")
+	tailer.Poll()
+	c.Check(output.Next(), Equals, long+"\nshort\n")
+}
+
+func (s *tailSuite) TestPolling(c *C) {
+	output := &syncBuffer{}
+	s.appendFile(c, "app.log", "")
+	tailer := servicelog.NewTailer([]string{filepath.Join(s.dir, "app.log")}, output)
+	tailer.Start()
+	defer tailer.Stop()
+
+	s.appendFile(c, "app.log", "polled\n")
+	waitTimer(c, s.clock)
+	s.clock.Advance(time.Second)
+	var polled string
+	for i := 0; polled == "" && i < 1000; i++ {
+		time.Sleep(time.Millisecond)
+		polled = output.Next()
+	}
+	c.Check(polled, Equals, "polled\n")
+}
+
+func (s *tailSuite) TestFormatted(c *C) {
+	output := &syncBuffer{}
+	s.appendFile(c, "app.log", "")
+	tailer := servicelog.NewTailer([]string{filepath.Join(s.dir, "app.log")}, newFormatWriter(output, "vendor"))
+	tailer.Start()
+
+	s.appendFile(c, "app.log", "first\nsecond\n")
+	tailer.Stop()
+	c.Check(output.Next(), Equals, `
+2021-05-13T03:16:51.001Z [vendor] first
+2021-05-13T03:16:51.001Z [vendor] second
+`[1:])
+}
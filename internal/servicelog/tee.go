@@ -0,0 +1,308 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// TeeWriter writes a service's logs to a primary destination, usually the
+// log buffer, and then to secondary destinations such as files. Each line
+// is prefixed with a sequence number and a space, so that after a crash
+// CheckDivergence can tell which lines one destination has and another
+// lacks.
+//
+// Writes are ordered write-ahead style: the secondaries only get what the
+// primary has accepted, so after a crash they may lack the primary's latest
+// lines, but shouldn't have lines it doesn't.
+type TeeWriter struct {
+	primary     io.Writer
+	secondaries []io.Writer
+
+	seq     uint64 // sequence number of the next line
+	midLine bool   // whether the last write ended in the middle of a line
+	closed  bool
+
+	out      []byte
+	prefixes []teePrefix
+}
+
+// teePrefix is the position of a sequence number prefix in TeeWriter.out.
+type teePrefix struct {
+	start, end int
+}
+
+// NewTeeWriter returns a TeeWriter that numbers lines from next onwards.
+func NewTeeWriter(next uint64, primary io.Writer, secondaries ...io.Writer) *TeeWriter {
+	return &TeeWriter{
+		primary:     primary,
+		secondaries: secondaries,
+		seq:         next,
+	}
+}
+
+// Write writes p, with sequence numbers added, to the primary and then to
+// the secondaries. If the primary fails, the secondaries get what it
+// accepted and its error is returned; otherwise the first error from the
+// secondaries, if any, is returned. Writes after Close fail with
+// io.ErrClosedPipe.
+func (t *TeeWriter) Write(p []byte) (int, error) {
+	if t.closed {
+		return 0, io.ErrClosedPipe
+	}
+	t.out = t.out[:0]
+	t.prefixes = t.prefixes[:0]
+	seq, midLine := t.seq, t.midLine
+	for rest := p; len(rest) > 0; {
+		if !midLine {
+			start := len(t.out)
+			t.out = strconv.AppendUint(t.out, seq, 10)
+			t.out = append(t.out, ' ')
+			t.prefixes = append(t.prefixes, teePrefix{start, len(t.out)})
+			seq++
+			midLine = true
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			t.out = append(t.out, rest...)
+			break
+		}
+		t.out = append(t.out, rest[:i+1]...)
+		rest = rest[i+1:]
+		midLine = false
+	}
+
+	n, err := writeFull(t.primary, t.out)
+	written := t.accepted(n)
+	for _, w := range t.secondaries {
+		if _, secondaryErr := writeFull(w, t.out[:n]); err == nil {
+			err = secondaryErr
+		}
+	}
+	return written, err
+}
+
+// Close ends the last line, if it's incomplete, with IncompleteLineMarker
+// and a newline, written like any other data, so that every destination
+// stays line-oriented, and then closes the destinations that are
+// io.Closers. It returns the first error. Closing the writer again does
+// nothing.
+func (t *TeeWriter) Close() error {
+	if t.closed {
+		return nil
+	}
+	var err error
+	if t.midLine {
+		_, err = t.Write([]byte(IncompleteLineMarker + "\n"))
+	}
+	t.closed = true
+	for _, w := range append([]io.Writer{t.primary}, t.secondaries...) {
+		if closeErr := closeWriter(w); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// accepted updates the line state for the first n bytes of t.out having
+// been written to the primary, and returns how many bytes of the caller's
+// data they hold.
+func (t *TeeWriter) accepted(n int) int {
+	written := n
+	for _, prefix := range t.prefixes {
+		if prefix.start >= n {
+			break
+		}
+		t.seq++
+		end := prefix.end
+		if end > n {
+			end = n
+		}
+		written -= end - prefix.start
+	}
+	if n > 0 {
+		t.midLine = t.out[n-1] != '\n'
+	}
+	return written
+}
+
+// Divergence describes how the lines of two destinations of a TeeWriter
+// differ.
+type Divergence struct {
+	// First and Last are the range of sequence numbers compared: from the
+	// first line of whichever destination starts later (as older lines may
+	// have been dropped from the other when its buffer wrapped or file was
+	// rotated) to the last line of either.
+	First, Last uint64
+
+	// OnlyPrimary and OnlySecondary are the numbers of lines in that range
+	// found in one destination but not the other.
+	OnlyPrimary   uint64
+	OnlySecondary uint64
+}
+
+// Diverged reports whether any lines are in one destination but not the
+// other.
+func (d Divergence) Diverged() bool {
+	return d.OnlyPrimary > 0 || d.OnlySecondary > 0
+}
+
+// CheckDivergence reads the logs written by a TeeWriter to its primary and
+// to one of its secondaries, and reports which lines are in one but not the
+// other. Lines without a sequence number, such as the end of a line whose
+// start was dropped, are ignored. If a secondary is split into several
+// files, pass them all, oldest first, with io.MultiReader.
+func CheckDivergence(primary, secondary io.Reader) (Divergence, error) {
+	primaryRanges, err := readSeqRanges(primary)
+	if err != nil {
+		return Divergence{}, err
+	}
+	secondaryRanges, err := readSeqRanges(secondary)
+	if err != nil {
+		return Divergence{}, err
+	}
+	if len(primaryRanges) == 0 && len(secondaryRanges) == 0 {
+		return Divergence{}, nil
+	}
+
+	var d Divergence
+	switch {
+	case len(primaryRanges) == 0:
+		d.First = secondaryRanges[0].first
+	case len(secondaryRanges) == 0:
+		d.First = primaryRanges[0].first
+	default:
+		d.First = maxSeq(primaryRanges[0].first, secondaryRanges[0].first)
+	}
+	if len(primaryRanges) > 0 {
+		d.Last = primaryRanges[len(primaryRanges)-1].last
+	}
+	if len(secondaryRanges) > 0 {
+		d.Last = maxSeq(d.Last, secondaryRanges[len(secondaryRanges)-1].last)
+	}
+
+	window := []seqRange{{d.First, d.Last}}
+	primaryRanges = intersectRanges(primaryRanges, window)
+	secondaryRanges = intersectRanges(secondaryRanges, window)
+	common := countSeqs(intersectRanges(primaryRanges, secondaryRanges))
+	d.OnlyPrimary = countSeqs(primaryRanges) - common
+	d.OnlySecondary = countSeqs(secondaryRanges) - common
+	return d, nil
+}
+
+// seqRange is an inclusive range of sequence numbers.
+type seqRange struct {
+	first, last uint64
+}
+
+// readSeqRanges returns the sequence numbers of the lines read from r as
+// sorted, non-overlapping ranges.
+func readSeqRanges(r io.Reader) ([]seqRange, error) {
+	var ranges []seqRange
+	br := bufio.NewReader(r)
+	lineStart := true
+	for {
+		line, err := br.ReadSlice('\n')
+		if lineStart {
+			if seq, ok := parseSeq(line); ok {
+				n := len(ranges)
+				if n > 0 && ranges[n-1].last+1 == seq {
+					ranges[n-1].last = seq
+				} else {
+					ranges = append(ranges, seqRange{seq, seq})
+				}
+			}
+		}
+		// A long line is read in pieces; only its first has the prefix.
+		lineStart = err != bufio.ErrBufferFull
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+	return mergeRanges(ranges), nil
+}
+
+// parseSeq parses the sequence number prefix of line.
+func parseSeq(line []byte) (uint64, bool) {
+	i := bytes.IndexByte(line, ' ')
+	if i <= 0 {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(string(line[:i]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// mergeRanges sorts ranges and merges those that overlap or adjoin, as a
+// destination written to again after a restart may repeat sequence numbers.
+func mergeRanges(ranges []seqRange) []seqRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first < ranges[j].first })
+	var merged []seqRange
+	for _, r := range ranges {
+		n := len(merged)
+		if n > 0 && r.first <= merged[n-1].last+1 {
+			merged[n-1].last = maxSeq(merged[n-1].last, r.last)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// intersectRanges returns the sequence numbers in both a and b, which must
+// be sorted and non-overlapping.
+func intersectRanges(a, b []seqRange) []seqRange {
+	var both []seqRange
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		first := maxSeq(a[i].first, b[j].first)
+		last := a[i].last
+		if b[j].last < last {
+			last = b[j].last
+		}
+		if first <= last {
+			both = append(both, seqRange{first, last})
+		}
+		if a[i].last < b[j].last {
+			i++
+		} else {
+			j++
+		}
+	}
+	return both
+}
+
+func countSeqs(ranges []seqRange) uint64 {
+	var count uint64
+	for _, r := range ranges {
+		count += r.last - r.first + 1
+	}
+	return count
+}
+
+func maxSeq(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+type teeSuite struct{}
+
+var _ = Suite(&teeSuite{})
+
+func (s *teeSuite) TestWrite(c *C) {
+	var primary, secondary1, secondary2 bytes.Buffer
+	w := servicelog.NewTeeWriter(41, &primary, &secondary1, &secondary2)
+	for _, chunk := range []string{"one\ntw", "o\n", "", "thr", "ee\nfour\nfive"} {
+		n, err := io.WriteString(w, chunk)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(chunk))
+	}
+	expected := "41 one\n42 two\n43 three\n44 four\n45 five"
+	c.Check(primary.String(), Equals, expected)
+	c.Check(secondary1.String(), Equals, expected)
+	c.Check(secondary2.String(), Equals, expected)
+}
+
+func (s *teeSuite) TestPrimaryError(c *C) {
+	// The primary fails part way through the second line's prefix: the
+	// secondary only gets what it accepted.
+	primary := servicelogtest.NewScriptedWriter()
+	primary.Limit(len("1 one\n2"), errors.New("full"))
+	var secondary bytes.Buffer
+	w := servicelog.NewTeeWriter(1, primary, &secondary)
+	n, err := io.WriteString(w, "one\ntwo\n")
+	c.Check(err, ErrorMatches, "full")
+	c.Check(n, Equals, len("one\n"))
+	c.Check(secondary.String(), Equals, "1 one\n2")
+
+	// The failed line keeps its sequence number, and isn't prefixed again.
+	primary.Limit(-1, nil)
+	n, err = io.WriteString(w, "two\nthree\n")
+	c.Check(err, IsNil)
+	c.Check(n, Equals, len("two\nthree\n"))
+	c.Check(primary.String(), Equals, "1 one\n2two\n3 three\n")
+	c.Check(secondary.String(), Equals, primary.String())
+}
+
+func (s *teeSuite) TestSecondaryError(c *C) {
+	var primary, secondary bytes.Buffer
+	w := servicelog.NewTeeWriter(0, &primary, failingWriter(errors.New("disk full")), &secondary)
+	n, err := io.WriteString(w, "one\n")
+	c.Check(err, ErrorMatches, "disk full")
+	c.Check(n, Equals, len("one\n"))
+	c.Check(primary.String(), Equals, "0 one\n")
+	c.Check(secondary.String(), Equals, "0 one\n")
+}
+
+func (s *teeSuite) TestClose(c *C) {
+	primary := &closeRecorder{}
+	var secondary bytes.Buffer
+	w := servicelog.NewTeeWriter(1, primary, &secondary)
+	_, err := io.WriteString(w, "one\ntw")
+	c.Assert(err, IsNil)
+	c.Check(w.Close(), IsNil)
+	expected := "1 one\n2 tw" + servicelog.IncompleteLineMarker + "\n"
+	c.Check(primary.String(), Equals, expected)
+	c.Check(secondary.String(), Equals, expected)
+	c.Check(primary.closed, Equals, true)
+
+	// Closing again does nothing, and writes fail.
+	c.Check(w.Close(), IsNil)
+	c.Check(primary.String(), Equals, expected)
+	_, err = io.WriteString(w, "three\n")
+	c.Check(err, Equals, io.ErrClosedPipe)
+}
+
+func (s *teeSuite) TestCloseError(c *C) {
+	primary := &closeRecorder{err: errors.New("cannot close")}
+	secondary := &closeRecorder{}
+	w := servicelog.NewTeeWriter(1, primary, secondary)
+	_, err := io.WriteString(w, "one\n")
+	c.Assert(err, IsNil)
+	c.Check(w.Close(), ErrorMatches, "cannot close")
+	c.Check(primary.String(), Equals, "1 one\n")
+	c.Check(secondary.closed, Equals, true)
+}
+
+// numbered returns the lines first to last as written by a TeeWriter.
+func numbered(first, last int) string {
+	var b strings.Builder
+	w := servicelog.NewTeeWriter(uint64(first), &b)
+	for i := first; i <= last; i++ {
+		io.WriteString(w, "2021-05-13T03:16:51.001Z [svc] line\n")
+	}
+	return b.String()
+}
+
+var divergenceTests = []struct {
+	summary    string
+	primary    string
+	secondary  string
+	divergence servicelog.Divergence
+}{{
+	summary: "Empty",
+}, {
+	summary:    "Same",
+	primary:    numbered(0, 9),
+	secondary:  numbered(0, 9),
+	divergence: servicelog.Divergence{First: 0, Last: 9},
+}, {
+	summary:    "Buffer wrapped",
+	primary:    "line\n" + numbered(5, 9),
+	secondary:  numbered(0, 9),
+	divergence: servicelog.Divergence{First: 5, Last: 9},
+}, {
+	summary:    "File rotated",
+	primary:    numbered(0, 9),
+	secondary:  numbered(7, 9),
+	divergence: servicelog.Divergence{First: 7, Last: 9},
+}, {
+	summary:    "Crash before secondary write",
+	primary:    numbered(0, 9),
+	secondary:  numbered(0, 6),
+	divergence: servicelog.Divergence{First: 0, Last: 9, OnlyPrimary: 3},
+}, {
+	summary:    "Crash before primary write",
+	primary:    numbered(3, 6),
+	secondary:  numbered(0, 8),
+	divergence: servicelog.Divergence{First: 3, Last: 8, OnlySecondary: 2},
+}, {
+	summary:    "Gaps in both",
+	primary:    numbered(0, 3) + numbered(6, 9),
+	secondary:  numbered(0, 1) + numbered(4, 7) + numbered(9, 9),
+	divergence: servicelog.Divergence{First: 0, Last: 9, OnlyPrimary: 3, OnlySecondary: 2},
+}, {
+	summary:    "Repeated after restart",
+	primary:    numbered(0, 5) + numbered(3, 9),
+	secondary:  numbered(0, 4),
+	divergence: servicelog.Divergence{First: 0, Last: 9, OnlyPrimary: 5},
+}, {
+	summary:    "Empty secondary",
+	primary:    numbered(2, 4),
+	divergence: servicelog.Divergence{First: 2, Last: 4, OnlyPrimary: 3},
+}, {
+	summary:    "Long lines",
+	primary:    "0 " + strings.Repeat("x", 10000) + "\n1 " + strings.Repeat("1 ", 5000) + "\n",
+	secondary:  numbered(0, 0),
+	divergence: servicelog.Divergence{First: 0, Last: 1, OnlyPrimary: 1},
+}}
+
+func (s *teeSuite) TestCheckDivergence(c *C) {
+	for _, test := range divergenceTests {
+		d, err := servicelog.CheckDivergence(strings.NewReader(test.primary), strings.NewReader(test.secondary))
+		c.Assert(err, IsNil, Commentf("%s", test.summary))
+		c.Check(d, Equals, test.divergence, Commentf("%s", test.summary))
+		c.Check(d.Diverged(), Equals, test.divergence.OnlyPrimary > 0 || test.divergence.OnlySecondary > 0)
+	}
+}
+
+func (s *teeSuite) TestCheckDivergenceReadError(c *C) {
+	_, err := servicelog.CheckDivergence(strings.NewReader(numbered(0, 1)), &failingReader{})
+	c.Check(err, ErrorMatches, "read failed")
+}
+
+type failingReader struct{}
+
+func (*failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func (s *teeSuite) TestCheckRingBuffer(c *C) {
+	// A buffer that has wrapped still lines up with a file that has all the
+	// lines.
+	rb := servicelog.NewRingBuffer(1000)
+	var file bytes.Buffer
+	w := servicelog.NewTeeWriter(0, rb, &file)
+	for i := 0; i < 100; i++ {
+		_, err := io.WriteString(w, "2021-05-13T03:16:51.001Z [svc] line\n")
+		c.Assert(err, IsNil)
+	}
+	it := rb.TailIterator()
+	defer it.Close()
+	var buffered bytes.Buffer
+	for it.Next(nil) {
+		_, err := io.Copy(&buffered, it)
+		c.Assert(err, IsNil)
+	}
+	d, err := servicelog.CheckDivergence(&buffered, &file)
+	c.Assert(err, IsNil)
+	c.Check(d.Diverged(), Equals, false)
+	c.Check(d.Last, Equals, uint64(99))
+	c.Check(d.First > 0, Equals, true)
+}
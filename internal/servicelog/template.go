@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultTemplate is the template of the prefix NewFormatWriter writes,
+// for WithTemplate.
+const DefaultTemplate = "{time} [{service}] "
+
+// templateSegment is part of a prefix template: literal text, with the
+// static placeholders filled in, or the line's timestamp.
+type templateSegment struct {
+	literal []byte
+	time    bool
+}
+
+// WithTemplate writes the prefix of each line as given by template, in
+// which these placeholders are filled in:
+//
+//	{time}     the line's timestamp, as NewFormatWriter writes it
+//	{service}  the service's name
+//	{stream}   fields["stream"], or else the stream given to WithStream,
+//	           or nothing if neither is set
+//	{<name>}   fields[name], for any other name in fields
+//
+// Literal braces are written doubled, as "{{" and "}}". A placeholder for a
+// field that isn't set is an error, as are "time" and "service" in fields.
+// For example, with the template "{service} | " lines are written as
+// "test | first", and DefaultTemplate gives the usual prefix. Only that
+// can be read back by the log parser. The timestamps are written as given
+// by the other options, such as WithLayout, but the prefix isn't coloured.
+//
+// The template is split into its literal text, including the fields, and
+// timestamps once, so writing a line's prefix costs no more than usual.
+func WithTemplate(template string, fields map[string]string) FormatOption {
+	return func(f *formatter) error {
+		// The template is parsed once all options are applied, as it
+		// depends on the stream.
+		f.templateText = &template
+		f.templateFields = fields
+		return nil
+	}
+}
+
+// parseTemplate splits template into its segments, merging literal text
+// and static placeholders.
+func parseTemplate(template, serviceName, stream string, fields map[string]string) ([]templateSegment, error) {
+	if strings.ContainsAny(template, "\r\n") {
+		return nil, fmt.Errorf("log prefix template %q must not contain line breaks", template)
+	}
+	for _, name := range []string{"time", "service"} {
+		if _, ok := fields[name]; ok {
+			return nil, fmt.Errorf("log prefix template field %q is reserved", name)
+		}
+	}
+	segments := []templateSegment{}
+	var literal []byte
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		switch {
+		case c == '{' && strings.HasPrefix(template[i:], "{{"),
+			c == '}' && strings.HasPrefix(template[i:], "}}"):
+			literal = append(literal, c)
+			i++
+		case c == '}':
+			return nil, fmt.Errorf("log prefix template %q has an unmatched %q (write \"}}\" for a literal brace)", template, "}")
+		case c == '{':
+			end := strings.IndexAny(template[i+1:], "{}")
+			if end < 0 || template[i+1+end] != '}' {
+				return nil, fmt.Errorf("log prefix template %q has an unclosed placeholder (write \"{{\" for a literal brace)", template)
+			}
+			name := template[i+1 : i+1+end]
+			i += end + 1
+			switch name {
+			case "time":
+				if len(literal) > 0 {
+					segments = append(segments, templateSegment{literal: literal})
+					literal = nil
+				}
+				segments = append(segments, templateSegment{time: true})
+			case "service":
+				literal = append(literal, serviceName...)
+			case "stream":
+				if value, ok := fields[name]; ok {
+					stream = value
+				}
+				literal = append(literal, stream...)
+			default:
+				value, ok := fields[name]
+				if !ok {
+					return nil, fmt.Errorf("log prefix template %q has unknown placeholder {%s}", template, name)
+				}
+				literal = append(literal, value...)
+			}
+		default:
+			literal = append(literal, c)
+		}
+	}
+	if len(literal) > 0 {
+		segments = append(segments, templateSegment{literal: literal})
+	}
+	return segments, nil
+}
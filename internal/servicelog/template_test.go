@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type templateSuite struct {
+	restore func()
+}
+
+var _ = Suite(&templateSuite{})
+
+func (s *templateSuite) SetUpTest(c *C) {
+	s.restore = servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+}
+
+func (s *templateSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// formatTemplate returns input as written by a template formatter.
+func formatTemplate(c *C, template string, fields map[string]string, input string) string {
+	b := &bytes.Buffer{}
+	w, err := servicelog.NewFormatWriter(b, "test", servicelog.WithTemplate(template, fields))
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(w, input)
+	c.Assert(err, IsNil)
+	return b.String()
+}
+
+func (s *templateSuite) TestDefault(c *C) {
+	input := "first\nsecond\r\nthird"
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test")
+	_, err := io.WriteString(w, input)
+	c.Assert(err, IsNil)
+	c.Check(formatTemplate(c, servicelog.DefaultTemplate, nil, input), Equals, b.String())
+	c.Check(b.String(), Equals, "2021-05-13T03:16:51.001Z [test] first\n2021-05-13T03:16:51.001Z [test] second\n2021-05-13T03:16:51.001Z [test] third")
+}
+
+func (s *templateSuite) TestPlaceholders(c *C) {
+	for _, test := range []struct {
+		template string
+		fields   map[string]string
+		output   string
+	}{
+		{"{service} | ", nil, "test | first\ntest | second\n"},
+		{"[{service}] {time} ", nil, "[test] 2021-05-13T03:16:51.001Z first\n[test] 2021-05-13T03:16:51.001Z second\n"},
+		{"{env}/{service}/{stream}: ", map[string]string{"env": "prod", "stream": "stderr"}, "prod/test/stderr: first\nprod/test/stderr: second\n"},
+		{"{service}{stream}{time}{env} ", map[string]string{"env": "!"}, "test2021-05-13T03:16:51.001Z! first\ntest2021-05-13T03:16:51.001Z! second\n"},
+		{"> ", nil, "> first\n> second\n"},
+		{"", nil, "first\nsecond\n"},
+		{"{{{service}}} {{time}} ", nil, "{test} {time} first\n{test} {time} second\n"},
+	} {
+		output := formatTemplate(c, test.template, test.fields, "first\nsecond\n")
+		c.Check(output, Equals, test.output, Commentf("template %q", test.template))
+	}
+}
+
+func (s *templateSuite) TestInvalid(c *C) {
+	for _, test := range []struct {
+		template string
+		fields   map[string]string
+		error    string
+	}{
+		{"{env} ", nil, `log prefix template "{env} " has unknown placeholder {env}`},
+		{"{} ", nil, `log prefix template "{} " has unknown placeholder {}`},
+		{"{time ", nil, `log prefix template "{time " has an unclosed placeholder \(write "{{" for a literal brace\)`},
+		{"{ti{me} ", nil, `log prefix template "{ti{me} " has an unclosed placeholder .*`},
+		{"time} ", nil, `log prefix template "time} " has an unmatched "}" \(write "}}" for a literal brace\)`},
+		{"{time}\n", nil, `log prefix template "{time}\\n" must not contain line breaks`},
+		{"{service} ", map[string]string{"service": "x"}, `log prefix template field "service" is reserved`},
+		{"{time} ", map[string]string{"time": "x"}, `log prefix template field "time" is reserved`},
+	} {
+		w, err := servicelog.NewFormatWriter(&bytes.Buffer{}, "test", servicelog.WithTemplate(test.template, test.fields))
+		c.Check(err, ErrorMatches, test.error, Commentf("template %q", test.template))
+		c.Check(w, IsNil)
+	}
+}
+
+func (s *templateSuite) TestWithOtherOptions(c *C) {
+	b := &bytes.Buffer{}
+	w := newFormatWriter(b, "test",
+		servicelog.WithTemplate("{service}/{stream} {time} ", nil),
+		servicelog.WithStream("stderr"),
+		servicelog.WithLayout(servicelog.LayoutUnixMilli),
+		servicelog.WithCRLines())
+	_, err := io.WriteString(w, "first\rsecond\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "test/stderr 1620875811001 first\ntest/stderr 1620875811001 second\n")
+
+	// A stream in the fields takes precedence.
+	b.Reset()
+	w = newFormatWriter(b, "test",
+		servicelog.WithStream("stderr"),
+		servicelog.WithTemplate("{stream}: ", map[string]string{"stream": "err"}))
+	_, err = io.WriteString(w, "first\n")
+	c.Assert(err, IsNil)
+	c.Check(b.String(), Equals, "err: first\n")
+}
+
+func (s *templateSuite) TestAllocations(c *C) {
+	w, err := servicelog.NewFormatWriter(ioutil.Discard, "test", servicelog.WithTemplate("{env} {time} {service} | ", map[string]string{"env": "prod"}))
+	c.Assert(err, IsNil)
+	line := []byte("a line\nand the start of another")
+	_, err = w.Write(line)
+	c.Assert(err, IsNil)
+	allocs := testing.AllocsPerRun(100, func() {
+		w.Write(line)
+	})
+	c.Check(allocs, Equals, 0.0)
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TestClock is a Clock for tests, set with FakeClock. Time only moves when Advance is called,
+// which fires any timers and tickers that have become due, in order, or when
+// the wall clock is stepped with Step.
+type TestClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	step    time.Duration
+	waiters []*testWaiter
+}
+
+// NewTestClock returns a TestClock whose time is now.
+func NewTestClock(now time.Time) *TestClock {
+	return &TestClock{now: now}
+}
+
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now.Add(c.step)
+}
+
+func (c *TestClock) NewTimer(d time.Duration) Timer {
+	return c.newWaiter(d, 0)
+}
+
+func (c *TestClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return testTicker{c.newWaiter(d, d)}
+}
+
+func (c *TestClock) newWaiter(d, period time.Duration) *testWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &testWaiter{
+		clock:  c,
+		ch:     make(chan time.Time, 1),
+		period: period,
+	}
+	c.start(w, d)
+	return w
+}
+
+// start schedules w to fire after d. The caller must hold c.mu.
+func (c *TestClock) start(w *testWaiter, d time.Duration) {
+	w.when = c.now.Add(d)
+	if !w.active {
+		w.active = true
+		c.waiters = append(c.waiters, w)
+	}
+}
+
+// stop unschedules w, reporting whether it was scheduled. The caller must
+// hold c.mu.
+func (c *TestClock) stop(w *testWaiter) bool {
+	if !w.active {
+		return false
+	}
+	w.active = false
+	for i, waiter := range c.waiters {
+		if waiter == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Advance moves the time forward by d, firing the timers and tickers that
+// become due in deadline order. As with real timers and tickers, a value is
+// dropped if the previous one hasn't been received yet.
+func (c *TestClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.waiters, func(i, j int) bool {
+			return c.waiters[i].when.Before(c.waiters[j].when)
+		})
+		if len(c.waiters) == 0 || c.waiters[0].when.After(end) {
+			break
+		}
+		w := c.waiters[0]
+		c.now = w.when
+		select {
+		case w.ch <- w.when.Add(c.step):
+		default:
+		}
+		if w.period > 0 {
+			w.when = w.when.Add(w.period)
+		} else {
+			c.stop(w)
+		}
+	}
+	c.now = end
+}
+
+// Step changes the wall clock time by d, forwards or backwards, as when the
+// system clock is set. Timers and tickers aren't affected, as like real ones
+// they measure elapsed time. The times returned by Now have no monotonic
+// clock reading, so the step shows in the durations between them.
+func (c *TestClock) Step(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.step += d
+}
+
+// Pending returns the number of timers and tickers waiting to fire.
+func (c *TestClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// testWaiter is a TestClock timer or ticker.
+type testWaiter struct {
+	clock  *TestClock
+	ch     chan time.Time
+	when   time.Time
+	period time.Duration
+	active bool
+}
+
+func (w *testWaiter) C() <-chan time.Time {
+	return w.ch
+}
+
+func (w *testWaiter) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	return w.clock.stop(w)
+}
+
+func (w *testWaiter) Reset(d time.Duration) bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	active := w.active
+	w.clock.start(w, d)
+	return active
+}
+
+// testTicker adapts a testWaiter to the Ticker interface.
+type testTicker struct {
+	*testWaiter
+}
+
+func (t testTicker) Stop() {
+	t.testWaiter.Stop()
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of a LatencyHistogram.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram counts log lines by the time they took to reach a
+// stage of the pipeline after arriving at the formatter.
+type LatencyHistogram struct {
+	// Buckets holds the number of lines with a latency up to each of
+	// LatencyBuckets (and above the one before), followed by the number
+	// of lines slower than all of them.
+	Buckets []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+// observe adds count lines with latency d. A negative latency, which a step
+// back of the wall clock could give if the times had no monotonic clock
+// reading, is counted as zero.
+func (h *LatencyHistogram) observe(d time.Duration, count uint64) {
+	if d < 0 {
+		d = 0
+	}
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.Buckets[i] += count
+	h.Count += count
+	h.Sum += d * time.Duration(count)
+}
+
+// maxTracedLines is the number of entries per stage (each a group of lines
+// appended together) whose arrival times are kept until they're delivered.
+// Lines appended while the queue is full aren't traced for that stage.
+const maxTracedLines = 1024
+
+// tracedLines is a group of count lines that started in the same write to
+// the formatter, the first at arrival, and were appended to the log buffer
+// together, the last of them ending at end.
+type tracedLines struct {
+	end     RingPos
+	arrival time.Time
+	count   uint64
+}
+
+// lineQueue is a bounded FIFO of lines waiting to be delivered to a stage.
+type lineQueue struct {
+	lines []tracedLines
+	head  int
+	len   int
+}
+
+func (q *lineQueue) push(lines tracedLines) {
+	if q.len == maxTracedLines {
+		return
+	}
+	if q.len == len(q.lines) {
+		// Grow up to maxTracedLines, unwrapping the queue.
+		size := 2*len(q.lines) + 16
+		if size > maxTracedLines {
+			size = maxTracedLines
+		}
+		grown := make([]tracedLines, size)
+		for i := 0; i < q.len; i++ {
+			grown[i] = q.lines[(q.head+i)%len(q.lines)]
+		}
+		q.lines, q.head = grown, 0
+	}
+	q.lines[(q.head+q.len)%len(q.lines)] = lines
+	q.len++
+}
+
+// pop removes and returns the oldest lines if they end at or before end.
+func (q *lineQueue) pop(end RingPos) (tracedLines, bool) {
+	if q.len == 0 || q.lines[q.head].end > end {
+		return tracedLines{}, false
+	}
+	lines := q.lines[q.head]
+	q.head = (q.head + 1) % len(q.lines)
+	q.len--
+	return lines, true
+}
+
+// Tracer measures the latency of a service's log lines, from the arrival of
+// their first bytes at the formatter to each terminal stage of the
+// pipeline: StageBuffer when they've been appended to the log buffer, and
+// the stage given to TraceIterator when they've been read from the buffer
+// by an iterator. Lines are traced in groups, as they were written and
+// appended, so the cost is per write rather than per line.
+// Memory use is bounded: histograms have fixed buckets, and at most
+// maxTracedLines groups per stage are waiting to be read at any time.
+type Tracer struct {
+	mu         sync.Mutex
+	histograms map[string]*LatencyHistogram
+	queues     map[string]*lineQueue
+}
+
+// NewTracer returns a Tracer to pass to WithTracer.
+func NewTracer() *Tracer {
+	t := &Tracer{
+		histograms: make(map[string]*LatencyHistogram),
+		queues:     make(map[string]*lineQueue),
+	}
+	t.histogram(StageBuffer)
+	return t
+}
+
+// histogram returns the histogram for stage, creating it if needed. The
+// caller must hold t.mu (or be the constructor).
+func (t *Tracer) histogram(stage string) *LatencyHistogram {
+	h := t.histograms[stage]
+	if h == nil {
+		h = &LatencyHistogram{Buckets: make([]uint64, len(LatencyBuckets)+1)}
+		t.histograms[stage] = h
+	}
+	return h
+}
+
+// TraceIterator records the latency of lines read by it for stage. The
+// iterator must read from the buffer the traced formatter writes to, and
+// TraceIterator must be called before it's used. Lines written to the
+// buffer before TraceIterator is called aren't traced for stage.
+func (t *Tracer) TraceIterator(it Iterator, stage string) {
+	iter, ok := it.(*iterator)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	t.histogram(stage)
+	t.queues[stage] = &lineQueue{}
+	t.mu.Unlock()
+	iter.tracer = t
+	iter.traceStage = stage
+}
+
+// appended records that lines were appended to the log buffer at now.
+func (t *Tracer) appended(lines []tracedLines, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.histograms[StageBuffer]
+	for _, group := range lines {
+		h.observe(now.Sub(group.arrival), group.count)
+		for _, q := range t.queues {
+			q.push(group)
+		}
+	}
+}
+
+// delivered records that the lines ending up to end were read for stage
+// now. The clock is only read if there are any.
+func (t *Tracer) delivered(stage string, end RingPos) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q := t.queues[stage]
+	if q == nil || q.len == 0 || q.lines[q.head].end > end {
+		return
+	}
+	now := clock.Now()
+	h := t.histograms[stage]
+	for {
+		group, ok := q.pop(end)
+		if !ok {
+			break
+		}
+		h.observe(now.Sub(group.arrival), group.count)
+	}
+}
+
+// discard forgets the lines ending up to end, which were dropped from the
+// buffer before being read for stage.
+func (t *Tracer) discard(stage string, end RingPos) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if q := t.queues[stage]; q != nil {
+		for {
+			if _, ok := q.pop(end); !ok {
+				break
+			}
+		}
+	}
+}
+
+// Latency returns a copy of the latency histogram of each traced stage.
+func (t *Tracer) Latency() map[string]LatencyHistogram {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	latency := make(map[string]LatencyHistogram, len(t.histograms))
+	for stage, h := range t.histograms {
+		copied := *h
+		copied.Buckets = append([]uint64(nil), h.Buckets...)
+		latency[stage] = copied
+	}
+	return latency
+}
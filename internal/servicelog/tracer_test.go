@@ -0,0 +1,206 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+)
+
+type tracerSuite struct {
+	clock   *servicelog.TestClock
+	restore func()
+}
+
+var _ = Suite(&tracerSuite{})
+
+func (s *tracerSuite) SetUpTest(c *C) {
+	s.clock = servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC))
+	s.restore = servicelog.FakeClock(s.clock)
+}
+
+func (s *tracerSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// histogram returns a LatencyHistogram with the given latencies.
+func histogram(latencies ...time.Duration) servicelog.LatencyHistogram {
+	h := servicelog.LatencyHistogram{Buckets: make([]uint64, len(servicelog.LatencyBuckets)+1)}
+	for _, d := range latencies {
+		i := 0
+		for i < len(servicelog.LatencyBuckets) && d > servicelog.LatencyBuckets[i] {
+			i++
+		}
+		h.Buckets[i]++
+		h.Count++
+		h.Sum += d
+	}
+	return h
+}
+
+func (s *tracerSuite) TestLatency(c *C) {
+	rb := servicelog.NewRingBuffer(1024)
+	defer rb.Close()
+	tracer := servicelog.NewTracer()
+	it := rb.HeadIterator(0)
+	defer it.Close()
+	tracer.TraceIterator(it, servicelog.StageOutput)
+	w := newFormatWriter(rb, "svc", servicelog.WithTracer(tracer))
+
+	// The first line takes 3ms to arrive in full, and the second arrives
+	// all at once.
+	io.WriteString(w, "hel")
+	s.clock.Advance(3 * time.Millisecond)
+	io.WriteString(w, "lo\nworld\npartial")
+
+	// The lines are read from the buffer 200ms later, but the partial line
+	// isn't traced until it's complete.
+	s.clock.Advance(200 * time.Millisecond)
+	var out bytes.Buffer
+	c.Assert(it.Next(nil), Equals, true)
+	_, err := it.WriteTo(&out)
+	c.Assert(err, IsNil)
+
+	c.Check(tracer.Latency(), DeepEquals, map[string]servicelog.LatencyHistogram{
+		servicelog.StageBuffer: histogram(3*time.Millisecond, 0),
+		servicelog.StageOutput: histogram(203*time.Millisecond, 200*time.Millisecond),
+	})
+
+	// The partial line is completed 10s later, and read straight away.
+	s.clock.Advance(10 * time.Second)
+	io.WriteString(w, " line\n")
+	c.Assert(it.Next(nil), Equals, true)
+	_, err = it.Read(make([]byte, 1024))
+	c.Assert(err, Equals, io.EOF)
+	c.Check(tracer.Latency(), DeepEquals, map[string]servicelog.LatencyHistogram{
+		servicelog.StageBuffer: histogram(3*time.Millisecond, 0, 10200*time.Millisecond),
+		servicelog.StageOutput: histogram(203*time.Millisecond, 200*time.Millisecond, 10200*time.Millisecond),
+	})
+	c.Check(tracer.Latency()[servicelog.StageOutput].Buckets[len(servicelog.LatencyBuckets)], Equals, uint64(1))
+}
+
+func (s *tracerSuite) TestClockSteps(c *C) {
+	tracer := servicelog.NewTracer()
+	w := newFormatWriter(ioutil.Discard, "svc", servicelog.WithTracer(tracer))
+
+	// A step back of the wall clock can't give negative latencies.
+	io.WriteString(w, "one")
+	s.clock.Step(-30 * time.Second)
+	io.WriteString(w, "\n")
+
+	// A step forward adds to latency measured with the test clock, which
+	// has no monotonic clock readings, but doesn't upset later lines.
+	io.WriteString(w, "two")
+	s.clock.Step(6 * time.Hour)
+	io.WriteString(w, "\nthree")
+	s.clock.Advance(time.Millisecond)
+	io.WriteString(w, "\n")
+
+	c.Check(tracer.Latency()[servicelog.StageBuffer], DeepEquals, histogram(0, 6*time.Hour, time.Millisecond))
+}
+
+func (s *tracerSuite) TestBucketBounds(c *C) {
+	for i, bound := range servicelog.LatencyBuckets {
+		tracer := servicelog.NewTracer()
+		w := newFormatWriter(ioutil.Discard, "svc", servicelog.WithTracer(tracer))
+		io.WriteString(w, "a")
+		s.clock.Advance(bound)
+		io.WriteString(w, "\nb")
+		s.clock.Advance(bound + time.Nanosecond)
+		io.WriteString(w, "\n")
+
+		h := tracer.Latency()[servicelog.StageBuffer]
+		c.Check(h.Buckets[i], Equals, uint64(1), Commentf("bound %s", bound))
+		c.Check(h.Buckets[i+1], Equals, uint64(1), Commentf("bound %s", bound))
+		c.Check(h.Count, Equals, uint64(2))
+		c.Check(h.Sum, Equals, 2*bound+time.Nanosecond)
+	}
+}
+
+func (s *tracerSuite) TestTruncated(c *C) {
+	rb := servicelog.NewRingBuffer(100)
+	defer rb.Close()
+	tracer := servicelog.NewTracer()
+	it := rb.HeadIterator(0)
+	defer it.Close()
+	tracer.TraceIterator(it, servicelog.StageOutput)
+	w := newFormatWriter(rb, "svc", servicelog.WithTracer(tracer))
+
+	// Each formatted line is 38 bytes, so the first is overwritten before
+	// it's read. Only the end of the second is left, but that still counts
+	// as delivering it.
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	s.clock.Advance(time.Second)
+	var out bytes.Buffer
+	for it.Next(nil) {
+		_, err := it.WriteTo(&out)
+		if err == io.EOF {
+			continue
+		}
+		c.Assert(err, IsNil)
+	}
+	c.Check(out.String(), Matches, `(?s).*line 3\n`)
+	c.Check(tracer.Latency()[servicelog.StageOutput], DeepEquals, histogram(time.Second, time.Second, time.Second))
+	c.Check(tracer.Latency()[servicelog.StageBuffer].Count, Equals, uint64(4))
+}
+
+func (s *tracerSuite) TestBoundedQueue(c *C) {
+	rb := servicelog.NewRingBuffer(1024 * 1024)
+	defer rb.Close()
+	tracer := servicelog.NewTracer()
+	it := rb.HeadIterator(0)
+	defer it.Close()
+	tracer.TraceIterator(it, servicelog.StageOutput)
+	w := newFormatWriter(rb, "svc", servicelog.WithTracer(tracer))
+
+	// Each write is traced separately, and those beyond the queue's
+	// capacity while nothing is read aren't traced for the output stage.
+	lines := servicelog.MaxTracedLines + 100
+	for i := 0; i < lines; i++ {
+		io.WriteString(w, "line\n")
+	}
+	for it.Next(nil) {
+		_, err := it.WriteTo(ioutil.Discard)
+		c.Assert(err, IsNil)
+	}
+	io.WriteString(w, "more\n")
+	c.Assert(it.Next(nil), Equals, true)
+	_, err := it.WriteTo(ioutil.Discard)
+	c.Assert(err, IsNil)
+
+	latency := tracer.Latency()
+	c.Check(latency[servicelog.StageBuffer].Count, Equals, uint64(lines+1))
+	c.Check(latency[servicelog.StageOutput].Count, Equals, uint64(servicelog.MaxTracedLines+1))
+}
+
+func (s *tracerSuite) TestNilTracer(c *C) {
+	var traced, plain bytes.Buffer
+	w := newFormatWriter(&traced, "svc", servicelog.WithTracer(nil))
+	io.WriteString(w, "first\nsec")
+	io.WriteString(w, "ond\n")
+	w = newFormatWriter(&plain, "svc")
+	io.WriteString(w, "first\nsec")
+	io.WriteString(w, "ond\n")
+	c.Check(traced.String(), Equals, plain.String())
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog
+
+import (
+	"io"
+)
+
+// maxZeroWrites is the number of consecutive writes making no progress
+// that writeFull tolerates before giving up.
+const maxZeroWrites = 16
+
+// writeFull writes all of p to w, retrying after short writes. It returns
+// the number of bytes of p written, and io.ErrShortWrite if w repeatedly
+// writes nothing without returning an error.
+func writeFull(w io.Writer, p []byte) (int, error) {
+	written := 0
+	zeroWrites := 0
+	for written < len(p) {
+		n, err := w.Write(p[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n > 0 {
+			zeroWrites = 0
+			continue
+		}
+		zeroWrites++
+		if zeroWrites >= maxZeroWrites {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// readFromSize is the size of the buffer a ReadFrom reads into: that of a
+// pipe's buffer, so that everything a service has written to its output
+// pipe can be taken in one read.
+const readFromSize = 64 * 1024
+
+// readFrom reads from r into buf until EOF, passing what each read returns
+// to write, and returns the number of bytes written. An error from r is
+// returned as a ReadError for the service, so that it can be told from an
+// error writing.
+func readFrom(r io.Reader, buf []byte, serviceName string, write func(p []byte) (int, error)) (int64, error) {
+	var written int64
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			m, err := write(buf[:n])
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, &ReadError{Service: serviceName, Err: readErr}
+		}
+	}
+}
+
+// readBufferer is implemented by writers that keep a buffer for their input
+// to be read into, such as a formatter, which formats what's written from
+// it in place. Writers passing their input on unchanged offer the buffer of
+// their destination.
+type readBufferer interface {
+	readBuffer() []byte
+}
+
+// readBuffer returns the buffer w keeps for its input to be read into, or
+// a new one if it keeps none.
+func readBuffer(w io.Writer) []byte {
+	if r, ok := w.(readBufferer); ok {
+		if buf := r.readBuffer(); buf != nil {
+			return buf
+		}
+	}
+	return make([]byte, readFromSize)
+}
+
+// vectorWriter is implemented by writers that take a batch of buffers in a
+// single write, as if they were one, such as a RingBuffer. The writer is
+// given their total size and the number of newlines in them, which the
+// caller knows already, so that it doesn't have to count them again.
+type vectorWriter interface {
+	writeVector(bufs [][]byte, size, lines int) (int, error)
+}
+
+// vectorWriterOf returns w as a vectorWriter, looking through the
+// writers that only hide its Close, or nil if it isn't one.
+func vectorWriterOf(w io.Writer) vectorWriter {
+	if nc, ok := w.(noCloseWriter); ok {
+		w = nc.Writer
+	}
+	vw, _ := w.(vectorWriter)
+	return vw
+}
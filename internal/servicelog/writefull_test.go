@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package servicelog_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/pebble/internal/servicelog"
+	"github.com/canonical/pebble/internal/servicelog/servicelogtest"
+)
+
+// newTrickleWriter returns a badly behaved destination: it writes at most
+// one byte per call, and makes no progress at all on every other call for
+// the first 2*zeroWrites calls.
+func newTrickleWriter(zeroWrites int) *servicelogtest.ScriptedWriter {
+	w := servicelogtest.NewScriptedWriter(servicelogtest.Repeat(zeroWrites, servicelogtest.ShortWrite(1), servicelogtest.ShortWrite(0))...)
+	w.Default = servicelogtest.ShortWrite(1)
+	return w
+}
+
+var errTrickle = errors.New("trickle failure")
+
+type writeFullSuite struct{}
+
+var _ = Suite(&writeFullSuite{})
+
+func (s *writeFullSuite) TestWriteFull(c *C) {
+	w := newTrickleWriter(5)
+	n, err := servicelog.WriteFull(w, []byte("pebble"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 6)
+	c.Assert(w.String(), Equals, "pebble")
+	c.Assert(w.Calls(), HasLen, 11)
+}
+
+func (s *writeFullSuite) TestWriteFullNoProgress(c *C) {
+	w := servicelogtest.NewScriptedWriter()
+	w.Default = servicelogtest.ShortWrite(0)
+	n, err := servicelog.WriteFull(w, []byte("pebble"))
+	c.Assert(err, Equals, io.ErrShortWrite)
+	c.Assert(n, Equals, 0)
+	c.Assert(w.Calls(), HasLen, 16)
+}
+
+func (s *writeFullSuite) TestWriteFullError(c *C) {
+	w := newTrickleWriter(0)
+	w.Limit(3, errTrickle)
+	n, err := servicelog.WriteFull(w, []byte("pebble"))
+	c.Assert(err, Equals, errTrickle)
+	c.Assert(n, Equals, 3)
+	c.Assert(w.String(), Equals, "peb")
+}
+
+func (s *writeFullSuite) TestFormatterTrickle(c *C) {
+	restore := servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+	defer restore()
+
+	w := newTrickleWriter(10)
+	fw := newFormatWriter(w, "test")
+	n, err := fmt.Fprint(fw, "first\nsecond\nthi")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 16)
+	n, err = fmt.Fprint(fw, "rd\n")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	c.Assert(w.String(), Equals, `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] second
+2021-05-13T03:16:51.001Z [test] third
+`[1:])
+}
+
+func (s *writeFullSuite) TestFormatterErrorResume(c *C) {
+	restore := servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+	defer restore()
+
+	const prefixLen = len("2021-05-13T03:16:51.001Z [test] ")
+	input := []byte("first\nsecond\n")
+	expected := `
+2021-05-13T03:16:51.001Z [test] first
+2021-05-13T03:16:51.001Z [test] second
+`[1:]
+
+	// Fail at every possible point of the output, then retry the bytes of
+	// the input that weren't reported as written: the output must be the
+	// same as if the write had never failed.
+	for fail := 1; fail <= len(expected); fail++ {
+		w := newTrickleWriter(0)
+		w.Limit(fail-1, errTrickle)
+		fw := newFormatWriter(w, "test")
+		n, err := fw.Write(input)
+		c.Assert(errors.Is(err, errTrickle), Equals, true)
+		c.Assert(n <= len(input), Equals, true)
+		if fail <= prefixLen {
+			c.Assert(n, Equals, 0)
+		}
+		w.Limit(-1, nil)
+		n, err = fw.Write(input[n:])
+		c.Assert(err, IsNil)
+		c.Assert(w.String(), Equals, expected, Commentf("failing after %d bytes", fail))
+	}
+}
+
+func (s *writeFullSuite) TestRingBufferWriteToTrickle(c *C) {
+	rb := servicelog.NewRingBuffer(13)
+	_, err := fmt.Fprint(rb, "pebbletron")
+	c.Assert(err, IsNil)
+	err = rb.Discard(6)
+	c.Assert(err, IsNil)
+	// Wrap around the end of the buffer, so WriteTo writes two segments.
+	_, err = fmt.Fprint(rb, "pebble")
+	c.Assert(err, IsNil)
+	start, _ := rb.Positions()
+
+	w := newTrickleWriter(10)
+	next, n, err := rb.WriteTo(w, start)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(10))
+	c.Assert(next, Equals, servicelog.RingPos(16))
+	c.Assert(w.String(), Equals, "tronpebble")
+}
+
+func (s *writeFullSuite) TestFormatterErrorResumeLarge(c *C) {
+	restore := servicelog.FakeClock(servicelog.NewTestClock(time.Date(2021, 5, 13, 3, 16, 51, 1e6, time.UTC)))
+	defer restore()
+
+	// Enough lines for the formatter to write them in several batches.
+	var input, expected bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		line := fmt.Sprintf("line %d with some padding to make it longer\n", i)
+		input.WriteString(line)
+		expected.WriteString("2021-05-13T03:16:51.001Z [test] " + line)
+	}
+
+	for _, fail := range []int{1, 32, 33, 16384, 16385, 20000, expected.Len() - 1, expected.Len()} {
+		// Whole batches are accepted up to the failure, as recording each
+		// byte's call would take too much memory.
+		w := servicelogtest.NewScriptedWriter()
+		w.Limit(fail-1, errTrickle)
+		fw := newFormatWriter(w, "test")
+		n, err := fw.Write(input.Bytes())
+		c.Assert(errors.Is(err, errTrickle), Equals, true)
+		w.Limit(-1, nil)
+		n, err = fw.Write(input.Bytes()[n:])
+		c.Assert(err, IsNil)
+		c.Assert(w.String() == expected.String(), Equals, true, Commentf("failing after %d bytes", fail))
+	}
+}
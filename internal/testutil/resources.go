@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"time"
+)
+
+// Resources is a snapshot of the process resources that leak tests compare
+// before and after exercising the code under test.
+type Resources struct {
+	Goroutines int
+	// FDs is the number of open file descriptors, or -1 if they can't be
+	// counted on this platform.
+	FDs       int
+	HeapInuse uint64
+}
+
+// SnapshotResources runs the garbage collector and returns the resources
+// currently in use by the process.
+func SnapshotResources() Resources {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	fds, err := OpenFDs()
+	if err != nil {
+		fds = -1
+	}
+	return Resources{
+		Goroutines: runtime.NumGoroutine(),
+		FDs:        fds,
+		HeapInuse:  stats.HeapInuse,
+	}
+}
+
+// ResourceTolerance is how much each resource may exceed its baseline
+// before CheckResources reports a leak.
+type ResourceTolerance struct {
+	Goroutines int
+	FDs        int
+	HeapInuse  uint64
+}
+
+// CheckResources compares the resources in use with baseline, and returns
+// an error describing the resources that exceed it by more than tolerance.
+// As goroutines and finalizers may take a moment to finish, it retries
+// until wait has elapsed before reporting a leak.
+func CheckResources(baseline Resources, tolerance ResourceTolerance, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		current := SnapshotResources()
+		err := compareResources(baseline, current, tolerance)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func compareResources(baseline, current Resources, tolerance ResourceTolerance) error {
+	var leaks []string
+	if current.Goroutines > baseline.Goroutines+tolerance.Goroutines {
+		leaks = append(leaks, fmt.Sprintf("goroutines %d -> %d", baseline.Goroutines, current.Goroutines))
+	}
+	if baseline.FDs >= 0 && current.FDs > baseline.FDs+tolerance.FDs {
+		leaks = append(leaks, fmt.Sprintf("open fds %d -> %d", baseline.FDs, current.FDs))
+	}
+	if current.HeapInuse > baseline.HeapInuse+tolerance.HeapInuse {
+		leaks = append(leaks, fmt.Sprintf("heap in use %d -> %d", baseline.HeapInuse, current.HeapInuse))
+	}
+	if len(leaks) > 0 {
+		return fmt.Errorf("resources leaked: %v", leaks)
+	}
+	return nil
+}
+
+// OpenFDs returns the number of file descriptors the process has open. It's
+// only supported on Linux, where it reads /proc/self/fd.
+func OpenFDs() (int, error) {
+	if runtime.GOOS != "linux" {
+		return 0, fmt.Errorf("cannot count open file descriptors on %s", runtime.GOOS)
+	}
+	entries, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	// Reading the directory opens a descriptor of its own, which is
+	// closed again by the time we return.
+	return len(entries) - 1, nil
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2021 Canonical Ltd
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License version 3 as
+// published by the Free Software Foundation.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package testutil_test
+
+import (
+	"os"
+	"runtime"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	. "github.com/canonical/pebble/internal/testutil"
+)
+
+type resourcesSuite struct{}
+
+var _ = check.Suite(&resourcesSuite{})
+
+func (*resourcesSuite) TestOpenFDs(c *check.C) {
+	if runtime.GOOS != "linux" {
+		c.Skip("open file descriptors are only counted on Linux")
+	}
+	before, err := OpenFDs()
+	c.Assert(err, check.IsNil)
+	f, err := os.Open(os.DevNull)
+	c.Assert(err, check.IsNil)
+	after, err := OpenFDs()
+	c.Assert(err, check.IsNil)
+	c.Check(after, check.Equals, before+1)
+	f.Close()
+	after, err = OpenFDs()
+	c.Assert(err, check.IsNil)
+	c.Check(after, check.Equals, before)
+}
+
+func (*resourcesSuite) TestCheckResources(c *check.C) {
+	baseline := SnapshotResources()
+	c.Check(baseline.Goroutines > 0, check.Equals, true)
+	c.Check(baseline.HeapInuse > 0, check.Equals, true)
+
+	stop := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		go func() { <-stop }()
+	}
+	err := CheckResources(baseline, ResourceTolerance{Goroutines: 2, HeapInuse: 1 << 20}, 0)
+	c.Check(err, check.ErrorMatches, "resources leaked: \\[goroutines [0-9]+ -> [0-9]+\\]")
+
+	// Goroutines that finish within the wait aren't leaks.
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	err = CheckResources(baseline, ResourceTolerance{Goroutines: 1, HeapInuse: 1 << 20}, 5*time.Second)
+	c.Check(err, check.IsNil)
+}